@@ -0,0 +1,15 @@
+DELETE FROM power_metrics;
+
+INSERT INTO power_metrics (run_id, source, component, process_id, power, timestamp)
+VALUES
+
+-- run_1, scenario_1, it 1
+('1', 'rapl:package-0', 'cpu', NULL, 12.0, 1717507590000),
+('1', 'rapl:package-0', 'cpu', NULL, 14.0, 1717507590200),
+('1', 'rapl:package-0', 'cpu', NULL, 13.0, 1717507590400),
+('1', 'rapl:package-0', 'cpu', NULL, 15.0, 1717507590600),
+('1', 'rapl:package-0', 'cpu', NULL, 12.0, 1717507590800),
+
+-- run_1, scenario_2, it 1
+('1', 'rapl:package-0', 'cpu', NULL, 12.0, 1717507592000),
+('1', 'rapl:package-0', 'cpu', NULL, 14.0, 1717507592200);
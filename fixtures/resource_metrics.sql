@@ -0,0 +1,12 @@
+DELETE FROM resource_metrics;
+
+INSERT INTO resource_metrics (run_id, process_id, bytes_sent, bytes_received, read_bytes, write_bytes, read_ops, write_ops, memory_bytes, memory_total, cpu_periods, throttled_periods, throttled_ns, timestamp)
+VALUES
+
+-- run_1, scenario_1, it 1
+('1', '1337', 1000, 5000, 2000, 5000, 10, 50, 52428800, 17179869184, 10, 0, 0, 1717507590000),
+('1', '1337', 3000, 9000, 6000, 9000, 30, 90, 62914560, 17179869184, 12, 1, 4000000, 1717507590200),
+('1', '1337', 4000, 12000, 8000, 12000, 40, 120, 62914560, 17179869184, 14, 3, 15000000, 1717507590400),
+
+-- run_1, scenario_2, it 1
+('1', '1337', 9000, 30000, 18000, 30000, 90, 300, 41943040, 17179869184, 30, 5, 25000000, 1717507592000);
@@ -0,0 +1,7 @@
+DELETE FROM run;
+
+INSERT INTO run (run_id, start_time, stop_time, tdp, tdp_source, energy_unavailable)
+VALUES
+('1', 1717507590000, 1717507695000, 15.0, 'config', NULL),
+('2', 1717507690000, 1717507699000, 28.0, 'detected', NULL),
+('3', 1717507790000, 1717507795000, NULL, 'unavailable', 'No TDP configured and auto-detection failed.');
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS run (
+    run_id TEXT NOT NULL,
+    start_time BIGINT NOT NULL,
+    stop_time BIGINT NOT NULL,
+    tdp DOUBLE,
+    tdp_source TEXT NOT NULL,
+    energy_unavailable TEXT,
+    PRIMARY KEY (run_id)
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS artifact (
+    run_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    file_name TEXT NOT NULL,
+    content BLOB NOT NULL,
+    created_at BIGINT NOT NULL,
+    PRIMARY KEY (run_id, name)
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS power_metrics (
+    run_id TEXT NOT NULL,
+    source TEXT NOT NULL,
+    component TEXT NOT NULL,
+    process_id TEXT,
+    power DOUBLE NOT NULL,
+    timestamp BIGINT NOT NULL
+);
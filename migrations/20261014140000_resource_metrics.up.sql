@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS resource_metrics (
+    run_id TEXT NOT NULL,
+    process_id TEXT NOT NULL,
+    bytes_sent BIGINT,
+    bytes_received BIGINT,
+    timestamp BIGINT NOT NULL
+);
@@ -0,0 +1,4 @@
+ALTER TABLE resource_metrics DROP COLUMN write_ops;
+ALTER TABLE resource_metrics DROP COLUMN read_ops;
+ALTER TABLE resource_metrics DROP COLUMN write_bytes;
+ALTER TABLE resource_metrics DROP COLUMN read_bytes;
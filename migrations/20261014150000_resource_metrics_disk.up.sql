@@ -0,0 +1,4 @@
+ALTER TABLE resource_metrics ADD COLUMN read_bytes BIGINT;
+ALTER TABLE resource_metrics ADD COLUMN write_bytes BIGINT;
+ALTER TABLE resource_metrics ADD COLUMN read_ops BIGINT;
+ALTER TABLE resource_metrics ADD COLUMN write_ops BIGINT;
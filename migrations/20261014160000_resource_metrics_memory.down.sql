@@ -0,0 +1,2 @@
+ALTER TABLE resource_metrics DROP COLUMN memory_total;
+ALTER TABLE resource_metrics DROP COLUMN memory_bytes;
@@ -0,0 +1,2 @@
+ALTER TABLE resource_metrics ADD COLUMN memory_bytes BIGINT;
+ALTER TABLE resource_metrics ADD COLUMN memory_total BIGINT;
@@ -0,0 +1,3 @@
+ALTER TABLE resource_metrics DROP COLUMN throttled_ns;
+ALTER TABLE resource_metrics DROP COLUMN throttled_periods;
+ALTER TABLE resource_metrics DROP COLUMN cpu_periods;
@@ -0,0 +1,3 @@
+ALTER TABLE resource_metrics ADD COLUMN cpu_periods BIGINT;
+ALTER TABLE resource_metrics ADD COLUMN throttled_periods BIGINT;
+ALTER TABLE resource_metrics ADD COLUMN throttled_ns BIGINT;
@@ -0,0 +1,2 @@
+ALTER TABLE run DROP COLUMN baseline_stop;
+ALTER TABLE run DROP COLUMN baseline_start;
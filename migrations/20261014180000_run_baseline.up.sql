@@ -0,0 +1,2 @@
+ALTER TABLE run ADD COLUMN baseline_start BIGINT;
+ALTER TABLE run ADD COLUMN baseline_stop BIGINT;
@@ -0,0 +1,2 @@
+ALTER TABLE resource_metrics DROP COLUMN scenario_name;
+ALTER TABLE cpu_metrics DROP COLUMN scenario_name;
@@ -0,0 +1,2 @@
+ALTER TABLE cpu_metrics ADD COLUMN scenario_name TEXT;
+ALTER TABLE resource_metrics ADD COLUMN scenario_name TEXT;
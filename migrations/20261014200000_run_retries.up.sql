@@ -0,0 +1 @@
+ALTER TABLE run ADD COLUMN retries BIGINT NOT NULL DEFAULT 0;
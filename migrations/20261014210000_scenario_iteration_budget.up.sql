@@ -0,0 +1 @@
+ALTER TABLE scenario_iteration ADD COLUMN budget_exceeded BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,2 @@
+ALTER TABLE run DROP COLUMN scenario_order;
+ALTER TABLE run DROP COLUMN shuffle_seed;
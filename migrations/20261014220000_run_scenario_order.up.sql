@@ -0,0 +1,2 @@
+ALTER TABLE run ADD COLUMN shuffle_seed BIGINT;
+ALTER TABLE run ADD COLUMN scenario_order TEXT;
@@ -0,0 +1 @@
+ALTER TABLE run DROP COLUMN pauses;
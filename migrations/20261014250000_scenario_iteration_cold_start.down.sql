@@ -0,0 +1 @@
+ALTER TABLE scenario_iteration DROP COLUMN cold_start;
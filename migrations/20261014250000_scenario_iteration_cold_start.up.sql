@@ -0,0 +1 @@
+ALTER TABLE scenario_iteration ADD COLUMN cold_start BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1 @@
+ALTER TABLE scenario_iteration DROP COLUMN functional_units;
@@ -0,0 +1 @@
+ALTER TABLE scenario_iteration ADD COLUMN functional_units REAL;
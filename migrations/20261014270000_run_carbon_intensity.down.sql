@@ -0,0 +1,2 @@
+ALTER TABLE run DROP COLUMN carbon_intensity_source;
+ALTER TABLE run DROP COLUMN carbon_intensity;
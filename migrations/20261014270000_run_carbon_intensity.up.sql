@@ -0,0 +1,2 @@
+ALTER TABLE run ADD COLUMN carbon_intensity REAL;
+ALTER TABLE run ADD COLUMN carbon_intensity_source TEXT;
@@ -0,0 +1 @@
+ALTER TABLE run ADD COLUMN label TEXT;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS endpoint_energy (
+    run_id TEXT NOT NULL,
+    scenario_name TEXT NOT NULL,
+    iteration INTEGER NOT NULL,
+    process_name TEXT NOT NULL,
+    route TEXT NOT NULL,
+    requests INTEGER NOT NULL,
+    joules REAL NOT NULL,
+    PRIMARY KEY (run_id, scenario_name, iteration, process_name, route)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE scenario_iteration ADD COLUMN stdout TEXT;
+ALTER TABLE scenario_iteration ADD COLUMN stderr TEXT;
+ALTER TABLE scenario_iteration ADD COLUMN exit_code INTEGER;
@@ -0,0 +1 @@
+ALTER TABLE scenario_iteration ADD COLUMN failed BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS compressed_samples;
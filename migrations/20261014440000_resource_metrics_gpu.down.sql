@@ -0,0 +1 @@
+ALTER TABLE resource_metrics DROP COLUMN gpu_utilisation;
@@ -0,0 +1 @@
+ALTER TABLE resource_metrics ADD COLUMN gpu_utilisation DOUBLE;
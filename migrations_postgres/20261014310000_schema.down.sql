@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS endpoint_energy;
+DROP TABLE IF EXISTS artifact;
+DROP TABLE IF EXISTS resource_metrics;
+DROP TABLE IF EXISTS power_metrics;
+DROP TABLE IF EXISTS cpu_metrics;
+DROP TABLE IF EXISTS scenario_iteration;
+DROP TABLE IF EXISTS run;
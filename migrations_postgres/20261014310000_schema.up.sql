@@ -0,0 +1,95 @@
+CREATE TABLE IF NOT EXISTS run (
+    run_id TEXT NOT NULL,
+    start_time BIGINT NOT NULL,
+    stop_time BIGINT NOT NULL,
+    tdp DOUBLE PRECISION,
+    tdp_source TEXT NOT NULL,
+    energy_unavailable TEXT,
+    config TEXT,
+    baseline_start BIGINT,
+    baseline_stop BIGINT,
+    retries BIGINT NOT NULL DEFAULT 0,
+    shuffle_seed BIGINT,
+    scenario_order TEXT,
+    pauses TEXT,
+    environment TEXT,
+    carbon_intensity DOUBLE PRECISION,
+    carbon_intensity_source TEXT,
+    pue DOUBLE PRECISION,
+    label TEXT,
+    PRIMARY KEY (run_id)
+);
+
+CREATE TABLE IF NOT EXISTS scenario_iteration (
+    run_id TEXT NOT NULL,
+    scenario_name TEXT NOT NULL,
+    iteration BIGINT NOT NULL,
+    start_time BIGINT NOT NULL,
+    stop_time BIGINT NOT NULL,
+    requests BIGINT,
+    budget_exceeded BOOLEAN NOT NULL DEFAULT FALSE,
+    cold_start BOOLEAN NOT NULL DEFAULT FALSE,
+    functional_units DOUBLE PRECISION,
+    PRIMARY KEY (run_id, scenario_name, iteration)
+);
+
+CREATE TABLE IF NOT EXISTS cpu_metrics (
+    run_id TEXT NOT NULL,
+    process_id TEXT NOT NULL,
+    process_name TEXT NOT NULL,
+    cpu_usage DOUBLE PRECISION NOT NULL,
+    total_usage DOUBLE PRECISION NOT NULL,
+    core_count BIGINT NOT NULL,
+    timestamp BIGINT NOT NULL,
+    scenario_name TEXT,
+    PRIMARY KEY (run_id, process_id, timestamp)
+);
+
+CREATE TABLE IF NOT EXISTS power_metrics (
+    run_id TEXT NOT NULL,
+    source TEXT NOT NULL,
+    component TEXT NOT NULL,
+    process_id TEXT,
+    power DOUBLE PRECISION NOT NULL,
+    timestamp BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS power_metrics_run ON power_metrics (run_id, timestamp);
+
+CREATE TABLE IF NOT EXISTS resource_metrics (
+    run_id TEXT NOT NULL,
+    process_id TEXT NOT NULL,
+    bytes_sent BIGINT,
+    bytes_received BIGINT,
+    read_bytes BIGINT,
+    write_bytes BIGINT,
+    read_ops BIGINT,
+    write_ops BIGINT,
+    memory_bytes BIGINT,
+    memory_total BIGINT,
+    cpu_periods BIGINT,
+    throttled_periods BIGINT,
+    throttled_ns BIGINT,
+    timestamp BIGINT NOT NULL,
+    scenario_name TEXT
+);
+CREATE INDEX IF NOT EXISTS resource_metrics_run ON resource_metrics (run_id, timestamp);
+
+CREATE TABLE IF NOT EXISTS artifact (
+    run_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    file_name TEXT NOT NULL,
+    content BYTEA NOT NULL,
+    created_at BIGINT NOT NULL,
+    PRIMARY KEY (run_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS endpoint_energy (
+    run_id TEXT NOT NULL,
+    scenario_name TEXT NOT NULL,
+    iteration BIGINT NOT NULL,
+    process_name TEXT NOT NULL,
+    route TEXT NOT NULL,
+    requests BIGINT NOT NULL,
+    joules DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (run_id, scenario_name, iteration, process_name, route)
+);
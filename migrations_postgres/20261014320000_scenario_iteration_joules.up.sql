@@ -0,0 +1 @@
+ALTER TABLE scenario_iteration ADD COLUMN joules DOUBLE PRECISION;
@@ -0,0 +1,4 @@
+ALTER TABLE run DROP COLUMN git_tag;
+ALTER TABLE run DROP COLUMN git_dirty;
+ALTER TABLE run DROP COLUMN git_branch;
+ALTER TABLE run DROP COLUMN git_commit;
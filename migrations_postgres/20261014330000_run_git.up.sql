@@ -0,0 +1,4 @@
+ALTER TABLE run ADD COLUMN git_commit TEXT;
+ALTER TABLE run ADD COLUMN git_branch TEXT;
+ALTER TABLE run ADD COLUMN git_dirty BOOLEAN;
+ALTER TABLE run ADD COLUMN git_tag TEXT;
@@ -0,0 +1,3 @@
+ALTER TABLE scenario_iteration DROP COLUMN exit_code;
+ALTER TABLE scenario_iteration DROP COLUMN stderr;
+ALTER TABLE scenario_iteration DROP COLUMN stdout;
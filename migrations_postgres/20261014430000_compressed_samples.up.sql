@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS compressed_samples (
+    run_id TEXT NOT NULL,
+    samples BIGINT NOT NULL,
+    content BYTEA NOT NULL,
+    PRIMARY KEY (run_id)
+);
@@ -0,0 +1,160 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    config::Blend,
+    dataset::{RunDataset, Stats},
+    significance::{TTest, SIGNIFICANCE_LEVEL},
+};
+
+/// The result of running a base and a candidate alternately. Each iteration of the candidate is
+/// paired with the iteration of the base which ran just before it, so drift over the run, such as
+/// the machine warming up, affects both sides of a pair equally.
+#[derive(Debug, PartialEq)]
+pub struct Comparison {
+    pub base: Stats,
+    pub candidate: Stats,
+    /// The energy of the candidate minus the energy of the base, for each pair of iterations.
+    pub difference: Stats,
+}
+impl Comparison {
+    pub fn variance(&self) -> f64 {
+        self.difference.stddev.powi(2)
+    }
+
+    /// The standard error of the mean difference.
+    pub fn standard_error(&self) -> f64 {
+        self.difference.stddev / (self.difference.iterations as f64).sqrt()
+    }
+
+    /// The mean difference as a percentage of the base's mean energy.
+    pub fn relative_difference(&self) -> f64 {
+        if self.base.mean == 0.0 {
+            0.0
+        } else {
+            self.difference.mean / self.base.mean * 100.0
+        }
+    }
+
+    /// The paired t-test of the difference, None if there's a single pair or the difference
+    /// didn't vary between pairs.
+    pub fn t_test(&self) -> Option<TTest> {
+        TTest::paired(&self.difference)
+    }
+
+    /// The chance of a mean difference at least this large if the base and candidate were the
+    /// same.
+    pub fn p_value(&self) -> Option<f64> {
+        self.t_test().map(|test| test.p_value())
+    }
+
+    /// A difference with a p-value over SIGNIFICANCE_LEVEL can't be told apart from noise, nor
+    /// can a single pair, the same as when runs are compared. A difference which didn't vary
+    /// between pairs is significant if it isn't 0.
+    pub fn is_significant(&self) -> bool {
+        match self.p_value() {
+            Some(p_value) => p_value < SIGNIFICANCE_LEVEL,
+            None => self.difference.iterations > 1 && self.difference.mean != 0.0,
+        }
+    }
+}
+
+/// # Arguments
+/// * base - the energy of each iteration of the base, with the iteration it was measured in
+/// * candidate - the energy of each iteration of the candidate, with the iteration it was measured
+///   in
+///
+/// # Returns
+/// The comparison of the iterations measured for both, None if no iteration was
+pub fn pair(base: &[(i64, f64)], candidate: &[(i64, f64)]) -> Option<Comparison> {
+    let pairs = base
+        .iter()
+        .filter_map(|(iteration, base)| {
+            candidate
+                .iter()
+                .find(|(other, _)| other == iteration)
+                .map(|(_, candidate)| (*base, *candidate))
+        })
+        .collect::<Vec<_>>();
+
+    Some(Comparison {
+        base: Stats::of(&pairs.iter().map(|(base, _)| *base).collect::<Vec<_>>())?,
+        candidate: Stats::of(
+            &pairs
+                .iter()
+                .map(|(_, candidate)| *candidate)
+                .collect::<Vec<_>>(),
+        )?,
+        difference: Stats::of(
+            &pairs
+                .iter()
+                .map(|(base, candidate)| candidate - base)
+                .collect::<Vec<_>>(),
+        )?,
+    })
+}
+
+/// # Arguments
+/// * base - the iterations of the base in the A/B run
+/// * candidate - the iterations of the candidate in the same run
+/// * blend - confidence in estimates and measurements
+///
+/// # Returns
+/// The comparison of their energy, None if the energy of no pair of iterations is known
+pub fn compare(
+    base: &RunDataset,
+    candidate: &RunDataset,
+    blend: Option<&Blend>,
+) -> Option<Comparison> {
+    let tdp = base.run().and_then(|run| run.tdp);
+    let joules = |run_dataset: &RunDataset| {
+        run_dataset
+            .by_iterations()
+            .iter()
+            .filter_map(|it| {
+                it.joules(tdp, blend)
+                    .map(|joules| (it.scenario_iteration().iteration, joules))
+            })
+            .collect::<Vec<_>>()
+    };
+    pair(&joules(base), &joules(candidate))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn iterations_are_paired_before_they_are_compared() {
+        // the machine heats up over the run, the candidate is around 2 J better throughout
+        let base = [(0, 10.0), (1, 14.0), (2, 18.0), (3, 22.0)];
+        let candidate = [(0, 8.0), (1, 12.0), (2, 16.5), (3, 19.5)];
+
+        let comparison = pair(&base, &candidate).expect("iterations should be paired");
+        assert_eq!(comparison.difference.iterations, 4);
+        assert_eq!(comparison.difference.mean, -2.0);
+        assert!(comparison.variance() < comparison.base.stddev.powi(2));
+        assert!(comparison.is_significant());
+        assert!((comparison.relative_difference() + 12.5).abs() < 1e-9);
+
+        // an iteration which failed on one side can't be paired
+        let comparison = pair(&base, &candidate[1..]).expect("iterations should be paired");
+        assert_eq!(comparison.base.iterations, 3);
+
+        let noisy = [(0, 13.0), (1, 11.0), (2, 18.5), (3, 21.5)];
+        let comparison = pair(&base, &noisy).expect("iterations should be paired");
+        assert!(!comparison.is_significant());
+
+        // more than 2 standard errors apart, but 3 pairs aren't enough to tell
+        let few = [(0, 11.0), (1, 16.0), (2, 21.0)];
+        let comparison = pair(&base, &few).expect("iterations should be paired");
+        assert!(comparison.difference.mean.abs() > 2.0 * comparison.standard_error());
+        assert!(comparison.p_value().is_some_and(|p| p > 0.05));
+        assert!(!comparison.is_significant());
+
+        assert_eq!(pair(&base, &[]), None);
+    }
+}
@@ -0,0 +1,355 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    config::{AccessLog, AccessLogFormat, Blend},
+    data_access::endpoint_energy::EndpointEnergy,
+    dataset::IterationWithMetrics,
+};
+use anyhow::Context;
+use itertools::Itertools;
+use serde_json::Value;
+use std::{collections::BTreeMap, fs};
+
+/// A request read from an access log.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Request {
+    /// When the request was logged in milliseconds since the unix epoch.
+    pub timestamp: i64,
+    pub route: String,
+    /// How long the request took in milliseconds, None if it wasn't logged.
+    pub duration_ms: Option<f64>,
+}
+
+/// Reads every request in the access log, lines which can't be parsed are skipped.
+pub fn read(access_log: &AccessLog) -> anyhow::Result<Vec<Request>> {
+    let content = fs::read_to_string(&access_log.path)
+        .context(format!("Unable to read access log {}", access_log.path))?;
+    Ok(parse(access_log, &content))
+}
+
+pub fn parse(access_log: &AccessLog, content: &str) -> Vec<Request> {
+    content
+        .lines()
+        .filter_map(|line| match access_log.format {
+            AccessLogFormat::Combined => parse_combined(line),
+            AccessLogFormat::Json => parse_json(access_log, line),
+        })
+        .collect()
+}
+
+/// Parses a line of the common or combined log format, e.g.
+/// `127.0.0.1 - - [14/Oct/2026:13:55:36 +0000] "GET /notes/42 HTTP/1.1" 200 2326`.
+fn parse_combined(line: &str) -> Option<Request> {
+    let (_, rest) = line.split_once('[')?;
+    let (time, rest) = rest.split_once(']')?;
+    let timestamp = chrono::DateTime::parse_from_str(time, "%d/%b/%Y:%H:%M:%S %z").ok()?;
+
+    let (_, rest) = rest.split_once('"')?;
+    let (request, _) = rest.split_once('"')?;
+    let mut parts = request.split_whitespace();
+    let method = parts.next()?;
+    let path = parts.next()?;
+    Some(Request {
+        timestamp: timestamp.timestamp_millis(),
+        route: route(Some(method), path),
+        duration_ms: None,
+    })
+}
+
+fn parse_json(access_log: &AccessLog, line: &str) -> Option<Request> {
+    let field =
+        |field: &Option<String>, default: &str| String::from(field.as_deref().unwrap_or(default));
+    let object = serde_json::from_str::<Value>(line).ok()?;
+
+    let timestamp = match &object[field(&access_log.time_field, "time")] {
+        Value::String(time) => chrono::DateTime::parse_from_rfc3339(time)
+            .ok()?
+            .timestamp_millis(),
+        // anything before 1973 in milliseconds is a timestamp in seconds
+        Value::Number(time) => match time.as_f64()? {
+            time if time < 1e11 => (time * 1000.0) as i64,
+            time => time as i64,
+        },
+        _ => return None,
+    };
+    let method = object[field(&access_log.method_field, "method")].as_str();
+    let path = object[field(&access_log.path_field, "path")].as_str()?;
+    Some(Request {
+        timestamp,
+        route: route(method, path),
+        duration_ms: object[field(&access_log.duration_field, "duration_ms")].as_f64(),
+    })
+}
+
+/// Requests are grouped by their method and path without the query. Path segments which look
+/// like ids are replaced with `:id` so `/notes/42` and `/notes/43` are the same route.
+fn route(method: Option<&str>, path: &str) -> String {
+    let path = path.split(['?', '#']).next().unwrap_or_default();
+    let path = path
+        .split('/')
+        .map(|segment| {
+            let is_number = !segment.is_empty() && segment.chars().all(|c| c.is_ascii_digit());
+            let is_hex =
+                segment.len() >= 16 && segment.chars().all(|c| c.is_ascii_hexdigit() || c == '-');
+            if is_number || is_hex {
+                ":id"
+            } else {
+                segment
+            }
+        })
+        .join("/");
+    match method {
+        Some(method) => format!("{} {}", method.to_uppercase(), path),
+        None => path,
+    }
+}
+
+/// Apportions the energy of a process during an iteration between the routes of the requests it
+/// served. The energy of each interval between CPU samples is split between the requests in it,
+/// a request with a duration is spread over the intervals it overlaps. Energy of intervals
+/// without a request, e.g. the process idling, isn't attributed to any route.
+///
+/// # Arguments
+/// * iteration - the scenario iteration and the metrics logged while it ran
+/// * process_name - the name of the process in the config
+/// * process_ids - the ids the process's samples were logged with
+/// * requests - every request in the process's access log
+/// * tdp - the TDP of the run
+/// * blend - confidence in estimates and measurements
+///
+/// # Returns
+/// The requests and energy of each route during the iteration, empty if the energy of the process
+/// is unknown
+pub fn apportion(
+    iteration: &IterationWithMetrics,
+    process_name: &str,
+    process_ids: &[String],
+    requests: &[Request],
+    tdp: Option<f64>,
+    blend: Option<&Blend>,
+) -> Vec<EndpointEnergy> {
+    let scenario_iteration = iteration.scenario_iteration();
+    let Some(joules) = iteration
+        .accumulate_by_process()
+        .iter()
+        .filter(|metrics| {
+            process_ids
+                .iter()
+                .any(|id| id.as_str() == metrics.process_id())
+        })
+        .filter_map(|metrics| metrics.energy(tdp, blend))
+        .map(|energy| energy.joules())
+        .reduce(|a, b| a + b)
+    else {
+        return vec![];
+    };
+
+    // the share of the CPU the process used between each of its samples, like the TDP model
+    let intervals = iteration
+        .cpu_metrics()
+        .iter()
+        .filter(|metrics| process_ids.contains(&metrics.process_id))
+        .into_group_map_by(|metrics| &metrics.process_id)
+        .into_values()
+        .flat_map(|samples| {
+            samples
+                .into_iter()
+                .sorted_by_key(|metrics| metrics.timestamp)
+                .tuple_windows()
+                .map(|(prev, curr)| {
+                    let secs = (curr.timestamp - prev.timestamp) as f64 / 1000.0;
+                    let share = curr.cpu_usage / 100.0 / curr.core_count.max(1) as f64;
+                    (prev.timestamp, curr.timestamp, share.min(1.0) * secs)
+                })
+        })
+        .collect::<Vec<_>>();
+    let total_share = intervals.iter().map(|(_, _, share)| share).sum::<f64>();
+
+    let requests = requests
+        .iter()
+        .filter(|request| {
+            request.timestamp >= scenario_iteration.start_time
+                && request.timestamp <= scenario_iteration.stop_time
+        })
+        .collect::<Vec<_>>();
+    let mut routes: BTreeMap<&str, (i64, f64)> = BTreeMap::new();
+    for request in requests.iter() {
+        routes.entry(request.route.as_str()).or_default().0 += 1;
+    }
+
+    for (from, to, share) in intervals.iter() {
+        // how much of each request was served in the interval
+        let weights = requests
+            .iter()
+            .map(|request| match request.duration_ms.filter(|ms| *ms > 0.0) {
+                Some(duration_ms) => {
+                    let end = request.timestamp as f64;
+                    let overlap = end.min(*to as f64) - (end - duration_ms).max(*from as f64);
+                    overlap.max(0.0) / duration_ms
+                }
+                None if request.timestamp > *from && request.timestamp <= *to => 1.0,
+                None => 0.0,
+            })
+            .collect::<Vec<_>>();
+        let total_weight = weights.iter().sum::<f64>();
+        if total_weight == 0.0 || total_share == 0.0 {
+            continue;
+        }
+
+        let interval_joules = joules * share / total_share;
+        for (request, weight) in requests.iter().zip(weights) {
+            if let Some((_, route_joules)) = routes.get_mut(request.route.as_str()) {
+                *route_joules += interval_joules * weight / total_weight;
+            }
+        }
+    }
+
+    routes
+        .into_iter()
+        .map(|(route, (requests, joules))| {
+            EndpointEnergy::new(
+                &scenario_iteration.run_id,
+                &scenario_iteration.scenario_name,
+                scenario_iteration.iteration,
+                process_name,
+                route,
+                requests,
+                joules,
+            )
+        })
+        .collect()
+}
+
+/// The requests and energy of a route over every iteration of a scenario.
+#[derive(Debug, PartialEq)]
+pub struct RouteSummary {
+    pub process_name: String,
+    pub route: String,
+    pub requests: i64,
+    pub joules: f64,
+}
+impl RouteSummary {
+    pub fn joules_per_request(&self) -> f64 {
+        if self.requests == 0 {
+            0.0
+        } else {
+            self.joules / self.requests as f64
+        }
+    }
+}
+
+/// # Returns
+/// The routes of the scenario summed over its iterations, the most energy per request first
+pub fn summarise(endpoint_energy: &[EndpointEnergy], scenario_name: &str) -> Vec<RouteSummary> {
+    endpoint_energy
+        .iter()
+        .filter(|endpoint| endpoint.scenario_name == scenario_name)
+        .into_group_map_by(|endpoint| (&endpoint.process_name, &endpoint.route))
+        .into_iter()
+        .map(|((process_name, route), endpoints)| RouteSummary {
+            process_name: process_name.clone(),
+            route: route.clone(),
+            requests: endpoints.iter().map(|endpoint| endpoint.requests).sum(),
+            joules: endpoints.iter().map(|endpoint| endpoint.joules).sum(),
+        })
+        .sorted_by(|a, b| b.joules_per_request().total_cmp(&a.joules_per_request()))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::data_access::{cpu_metrics::CpuMetrics, scenario_iteration::ScenarioIteration};
+
+    fn access_log(format: AccessLogFormat) -> AccessLog {
+        AccessLog {
+            path: String::from("access.log"),
+            format,
+            time_field: None,
+            method_field: None,
+            path_field: None,
+            duration_field: None,
+        }
+    }
+
+    #[test]
+    fn energy_is_apportioned_between_routes() {
+        let combined = "127.0.0.1 - - [01/Jan/1970:00:00:01 +0000] \"POST /login HTTP/1.1\" 200 12\n\
+             127.0.0.1 - - [01/Jan/1970:00:00:02 +0000] \"GET /notes/42?page=2 HTTP/1.1\" 200 2326 \"-\" \"curl/8.0\"\n\
+             not a request";
+        let requests = parse(&access_log(AccessLogFormat::Combined), combined);
+        assert_eq!(
+            requests,
+            [
+                Request {
+                    timestamp: 1000,
+                    route: String::from("POST /login"),
+                    duration_ms: None,
+                },
+                Request {
+                    timestamp: 2000,
+                    route: String::from("GET /notes/:id"),
+                    duration_ms: None,
+                },
+            ]
+        );
+        let json = r#"{"time":"1970-01-01T00:00:03Z","method":"get","path":"/notes/43","duration_ms":250}"#;
+        let requests = parse(&access_log(AccessLogFormat::Json), json);
+        assert_eq!(requests[0].timestamp, 3000);
+        assert_eq!(requests[0].route, "GET /notes/:id");
+        assert_eq!(requests[0].duration_ms, Some(250.0));
+
+        // 10 W for the first second and 5 W for the second at 40 W TDP
+        let iteration = IterationWithMetrics::new(
+            ScenarioIteration::new("1", "notes", 0, 0, 3000, None),
+            vec![
+                CpuMetrics::new("1", "10", "node", 0.0, 100.0, 4, 0),
+                CpuMetrics::new("1", "10", "node", 100.0, 100.0, 4, 1000),
+                CpuMetrics::new("1", "10", "node", 50.0, 100.0, 4, 2000),
+                CpuMetrics::new("1", "20", "postgres", 100.0, 100.0, 4, 0),
+                CpuMetrics::new("1", "20", "postgres", 100.0, 100.0, 4, 2000),
+            ],
+            vec![],
+            vec![],
+        );
+        let requests = [
+            Request {
+                timestamp: 900,
+                route: String::from("POST /login"),
+                duration_ms: None,
+            },
+            Request {
+                timestamp: 1500,
+                route: String::from("GET /notes/:id"),
+                duration_ms: None,
+            },
+            Request {
+                timestamp: 1900,
+                route: String::from("GET /notes/:id"),
+                duration_ms: None,
+            },
+        ];
+        let ids = [String::from("10")];
+        let routes = apportion(&iteration, "server", &ids, &requests, Some(40.0), None);
+        assert_eq!(routes.len(), 2);
+        assert_eq!(routes[0].route, "GET /notes/:id");
+        assert_eq!(routes[0].requests, 2);
+        assert!((routes[0].joules - 5.0).abs() < 1e-9);
+        assert_eq!(routes[1].process_name, "server");
+        assert!((routes[1].joules - 10.0).abs() < 1e-9);
+
+        let summary = summarise(&routes, "notes");
+        assert_eq!(summary[0].route, "POST /login");
+        // the login costs 4 times as much per request
+        assert!(
+            (summary[0].joules_per_request() / summary[1].joules_per_request() - 4.0).abs() < 1e-9
+        );
+
+        // without a TDP or power source nothing is known
+        assert!(apportion(&iteration, "server", &ids, &requests, None, None).is_empty());
+    }
+}
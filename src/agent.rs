@@ -0,0 +1,224 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    config::{ContainerRuntime, ContainerStats, CpuAccounting, ProcessToObserve},
+    metrics::{CpuMetrics, MetricsLog, ResourceMetrics},
+    metrics_logger::{self, StopHandle},
+};
+use anyhow::Context;
+use axum::{
+    extract::State,
+    http::StatusCode,
+    routing::{get, post},
+    Json, Router,
+};
+use serde::{Deserialize, Serialize};
+use std::{sync::Arc, time::Duration};
+use tokio::sync::Mutex;
+
+/// The port `cardamon agent` listens on unless told otherwise.
+pub const DEFAULT_PORT: u16 = 7420;
+
+/// The address `cardamon agent` listens on unless told otherwise. The agent doesn't authenticate
+/// requests, so it's only reachable from its own host, e.g. through an ssh tunnel, by default.
+pub const DEFAULT_BIND: &str = "127.0.0.1";
+
+/// The processes the coordinating cardamon instance asks an agent to observe on its host.
+#[derive(Debug, Clone, PartialEq, Deserialize, Serialize)]
+pub struct Observe {
+    /// Regexes matching the names of processes to observe.
+    pub names: Vec<String>,
+    /// TCP ports of processes to observe.
+    pub ports: Vec<u16>,
+    /// Names of containers to observe.
+    pub containers: Vec<String>,
+    pub sample_interval_ms: u64,
+}
+impl Observe {
+    fn processes_to_observe(&self) -> Vec<(ProcessToObserve, Duration)> {
+        let sample_interval = Duration::from_millis(self.sample_interval_ms);
+        self.names
+            .iter()
+            .map(|name| ProcessToObserve::NameMatch(name.clone()))
+            .chain(
+                self.ports
+                    .iter()
+                    .map(|port| ProcessToObserve::PortMatch(*port)),
+            )
+            .chain(
+                self.containers
+                    .iter()
+                    .map(|name| ProcessToObserve::ContainerName(name.clone())),
+            )
+            .map(|proc| (proc, sample_interval))
+            .collect()
+    }
+}
+
+/// Metrics an agent has logged since it was last asked for them.
+#[derive(Debug, Default, Deserialize, Serialize)]
+pub struct Batch {
+    pub cpu_metrics: Vec<CpuMetrics>,
+    pub resource_metrics: Vec<ResourceMetrics>,
+    pub errors: Vec<String>,
+}
+impl Batch {
+    fn from_log(metrics_log: &MetricsLog) -> Self {
+        Self {
+            cpu_metrics: metrics_log.get_metrics().clone(),
+            resource_metrics: metrics_log.get_resource_metrics().clone(),
+            errors: metrics_log
+                .get_errors()
+                .iter()
+                .map(|err| err.to_string())
+                .collect(),
+        }
+    }
+
+    /// Prefixes every process with the host it ran on, so processes with the same pid or name on
+    /// different hosts are kept apart when they're merged into one run.
+    ///
+    /// # Arguments
+    ///
+    /// * `host` - The name the host is given in the config
+    pub fn keyed_by(self, host: &str) -> Self {
+        Self {
+            cpu_metrics: self
+                .cpu_metrics
+                .into_iter()
+                .map(|metrics| CpuMetrics {
+                    process_id: format!("{host}/{}", metrics.process_id),
+                    process_name: format!("{host}/{}", metrics.process_name),
+                    ..metrics
+                })
+                .collect(),
+            resource_metrics: self
+                .resource_metrics
+                .into_iter()
+                .map(|metrics| ResourceMetrics {
+                    process_id: format!("{host}/{}", metrics.process_id),
+                    ..metrics
+                })
+                .collect(),
+            errors: self.errors,
+        }
+    }
+}
+
+#[derive(Clone)]
+struct AgentState {
+    /// The loggers of the processes the agent is currently observing, if any.
+    session: Arc<Mutex<Option<StopHandle>>>,
+    container_runtime: ContainerRuntime,
+}
+
+/// Runs the agent daemon until it's killed. The coordinating cardamon instance tells it which
+/// processes to observe at the start of every scenario and then drains the metrics it logs.
+///
+/// # Arguments
+///
+/// * `bind` - The address to listen on
+/// * `port` - The port to listen on
+/// * `container_runtime` - The runtime the observed containers are running in
+pub async fn serve(
+    bind: &str,
+    port: u16,
+    container_runtime: ContainerRuntime,
+) -> anyhow::Result<()> {
+    let state = AgentState {
+        session: Arc::new(Mutex::new(None)),
+        container_runtime,
+    };
+    let app = Router::new()
+        .route("/observe", post(observe))
+        .route("/metrics", get(drain))
+        .route("/stop", post(stop))
+        .with_state(state);
+
+    let listener = tokio::net::TcpListener::bind((bind, port))
+        .await
+        .context(format!("Unable to listen on {bind}:{port}"))?;
+    tracing::info!("Agent listening on {bind}:{port}");
+    axum::serve(listener, app)
+        .await
+        .context("Agent stopped unexpectedly")
+}
+
+async fn observe(
+    State(state): State<AgentState>,
+    Json(observe): Json<Observe>,
+) -> Result<StatusCode, (StatusCode, String)> {
+    tracing::info!("Observing {:?}", observe);
+    let mut session = state.session.lock().await;
+    // metrics logged for a previous scenario are no longer wanted
+    if let Some(stop_handle) = session.take() {
+        let _ = stop_handle.stop().await;
+    }
+
+    let stop_handle = metrics_logger::start_logging(
+        &observe.processes_to_observe(),
+        &[],
+        &[],
+        &[],
+        state.container_runtime,
+        ContainerStats::default(),
+        CpuAccounting::default(),
+    )
+    .map_err(|err| (StatusCode::BAD_REQUEST, err.to_string()))?;
+    *session = Some(stop_handle);
+
+    Ok(StatusCode::OK)
+}
+
+async fn drain(State(state): State<AgentState>) -> Json<Batch> {
+    let session = state.session.lock().await;
+    let batch = match session.as_ref() {
+        Some(stop_handle) => Batch::from_log(&stop_handle.drain()),
+        None => Batch::default(),
+    };
+    Json(batch)
+}
+
+async fn stop(State(state): State<AgentState>) -> StatusCode {
+    if let Some(stop_handle) = state.session.lock().await.take() {
+        tracing::info!("Stopped observing");
+        let _ = stop_handle.stop().await;
+    }
+    StatusCode::OK
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn metrics_are_keyed_by_host() {
+        let batch = Batch {
+            cpu_metrics: vec![CpuMetrics {
+                process_id: String::from("1234"),
+                process_name: String::from("postgres"),
+                cpu_usage: 12.5,
+                core_count: 4,
+                timestamp: 1000,
+            }],
+            resource_metrics: vec![ResourceMetrics {
+                process_id: String::from("1234"),
+                memory_bytes: Some(4096),
+                timestamp: 1000,
+                ..Default::default()
+            }],
+            errors: vec![],
+        }
+        .keyed_by("db");
+
+        assert_eq!(batch.cpu_metrics[0].process_id, "db/1234");
+        assert_eq!(batch.cpu_metrics[0].process_name, "db/postgres");
+        assert_eq!(batch.cpu_metrics[0].cpu_usage, 12.5);
+        assert_eq!(batch.resource_metrics[0].process_id, "db/1234");
+        assert_eq!(batch.resource_metrics[0].memory_bytes, Some(4096));
+    }
+}
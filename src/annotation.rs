@@ -0,0 +1,92 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use serde::{Deserialize, Serialize};
+use std::{collections::BTreeMap, fmt};
+
+/// A note added to a run with `cardamon annotate` after it finished, e.g. what changed since the
+/// previous run, so the context of a result is kept with it.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Annotation {
+    /// Unix timestamp in milliseconds.
+    pub created_at: i64,
+    pub note: Option<String>,
+    /// e.g. `allocator = "jemalloc"`, so runs can be told apart by more than their label.
+    #[serde(default)]
+    pub labels: BTreeMap<String, String>,
+}
+impl Annotation {
+    pub fn new(created_at: i64, note: Option<&str>, labels: Vec<(String, String)>) -> Self {
+        Self {
+            created_at,
+            note: note.map(String::from),
+            labels: labels.into_iter().collect(),
+        }
+    }
+}
+
+impl fmt::Display for Annotation {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let labels = self
+            .labels
+            .iter()
+            .map(|(key, value)| format!("{}={}", key, value))
+            .collect::<Vec<_>>()
+            .join(", ");
+        match (&self.note, labels.is_empty()) {
+            (Some(note), true) => write!(f, "{}", note),
+            (Some(note), false) => write!(f, "{} ({})", note, labels),
+            (None, _) => write!(f, "{}", labels),
+        }
+    }
+}
+
+/// # Returns
+/// The annotations on one line, oldest first, e.g. for a column of a table. None if there are
+/// none
+pub fn summary(annotations: &[Annotation]) -> Option<String> {
+    if annotations.is_empty() {
+        return None;
+    }
+    Some(
+        annotations
+            .iter()
+            .map(Annotation::to_string)
+            .collect::<Vec<_>>()
+            .join("; "),
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn annotations_show_their_note_then_labels() {
+        let note = Annotation::new(1, Some("switched to jemalloc"), vec![]);
+        let labelled = Annotation::new(
+            2,
+            Some("bigger pool"),
+            vec![
+                (String::from("pool"), String::from("8")),
+                (String::from("allocator"), String::from("jemalloc")),
+            ],
+        );
+        let labels_only = Annotation::new(3, None, vec![(String::from("ci"), String::from("1"))]);
+
+        assert_eq!(note.to_string(), "switched to jemalloc");
+        assert_eq!(
+            labelled.to_string(),
+            "bigger pool (allocator=jemalloc, pool=8)"
+        );
+        assert_eq!(labels_only.to_string(), "ci=1");
+        assert_eq!(
+            summary(&[note, labels_only]).as_deref(),
+            Some("switched to jemalloc; ci=1")
+        );
+        assert_eq!(summary(&[]), None);
+    }
+}
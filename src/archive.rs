@@ -0,0 +1,351 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::data_access::{
+    artifact::Artifact, cpu_metrics::CpuMetrics, endpoint_energy::EndpointEnergy,
+    power_metrics::PowerMetrics, resource_metrics::ResourceMetrics, run::Run,
+    scenario_iteration::ScenarioIteration, DataAccessService,
+};
+use anyhow::{anyhow, Context};
+use std::{fs, io::Read, path::Path};
+
+/// Everything saved for a run, so it can be moved to another database.
+#[derive(Debug, PartialEq, serde::Deserialize, serde::Serialize)]
+pub struct RunArchive {
+    pub run: Run,
+    pub scenario_iterations: Vec<ScenarioIteration>,
+    pub cpu_metrics: Vec<CpuMetrics>,
+    pub power_metrics: Vec<PowerMetrics>,
+    pub resource_metrics: Vec<ResourceMetrics>,
+    pub endpoint_energy: Vec<EndpointEnergy>,
+    pub artifacts: Vec<Artifact>,
+}
+impl RunArchive {
+    /// # Returns
+    /// The run with its iterations, every sample including its idle baseline and its artifacts,
+    /// an error if there's no run with the given id
+    pub async fn fetch(
+        run_id: &str,
+        data_access_service: &dyn DataAccessService,
+    ) -> anyhow::Result<Self> {
+        let run = data_access_service
+            .run_dao()
+            .fetch(run_id)
+            .await?
+            .context(format!("Unable to find run {}", run_id))?;
+
+        // the samples of a downsampled run are archived decompressed
+        let samples = data_access_service
+            .fetch_samples_within(run_id, 0, i64::MAX)
+            .await?;
+        Ok(Self {
+            run,
+            scenario_iterations: data_access_service
+                .scenario_iteration_dao()
+                .fetch_by_run(run_id)
+                .await?,
+            cpu_metrics: samples.cpu_metrics,
+            power_metrics: samples.power_metrics,
+            resource_metrics: samples.resource_metrics,
+            endpoint_energy: data_access_service
+                .endpoint_energy_dao()
+                .fetch_by_run(run_id)
+                .await?,
+            artifacts: data_access_service
+                .artifact_dao()
+                .fetch_by_run(run_id)
+                .await?,
+        })
+    }
+
+    /// Saves everything in the archive. The run itself is saved last so it isn't in the
+    /// database's history until everything else is.
+    pub async fn persist(&self, data_access_service: &dyn DataAccessService) -> anyhow::Result<()> {
+        for scenario_iteration in self.scenario_iterations.iter() {
+            data_access_service
+                .scenario_iteration_dao()
+                .persist(scenario_iteration)
+                .await?;
+        }
+        for metrics in self.cpu_metrics.iter() {
+            data_access_service
+                .cpu_metrics_dao()
+                .persist(metrics)
+                .await?;
+        }
+        for metrics in self.power_metrics.iter() {
+            data_access_service
+                .power_metrics_dao()
+                .persist(metrics)
+                .await?;
+        }
+        for metrics in self.resource_metrics.iter() {
+            data_access_service
+                .resource_metrics_dao()
+                .persist(metrics)
+                .await?;
+        }
+        for endpoint_energy in self.endpoint_energy.iter() {
+            data_access_service
+                .endpoint_energy_dao()
+                .persist(endpoint_energy)
+                .await?;
+        }
+        for artifact in self.artifacts.iter() {
+            data_access_service.artifact_dao().persist(artifact).await?;
+        }
+
+        data_access_service.run_dao().persist(&self.run).await
+    }
+
+    /// CPU, power and resource samples.
+    pub fn samples(&self) -> usize {
+        self.cpu_metrics.len() + self.power_metrics.len() + self.resource_metrics.len()
+    }
+
+    /// Gives the run and everything saved for it a new id, e.g. when a run from another machine
+    /// has the same id as a local one.
+    pub fn with_run_id(mut self, run_id: &str) -> Self {
+        self.run.run_id = String::from(run_id);
+        for scenario_iteration in self.scenario_iterations.iter_mut() {
+            scenario_iteration.run_id = String::from(run_id);
+        }
+        for metrics in self.cpu_metrics.iter_mut() {
+            metrics.run_id = String::from(run_id);
+        }
+        for metrics in self.power_metrics.iter_mut() {
+            metrics.run_id = String::from(run_id);
+        }
+        for metrics in self.resource_metrics.iter_mut() {
+            metrics.run_id = String::from(run_id);
+        }
+        for endpoint_energy in self.endpoint_energy.iter_mut() {
+            endpoint_energy.run_id = String::from(run_id);
+        }
+        for artifact in self.artifacts.iter_mut() {
+            artifact.run_id = String::from(run_id);
+        }
+        self
+    }
+}
+
+/// A run read from an export, see [`import`].
+#[derive(Debug, PartialEq)]
+pub struct Imported {
+    /// The id of the run in the export.
+    pub run_id: String,
+    /// The id the run was saved with, None if it had already been imported.
+    pub imported_as: Option<String>,
+}
+
+/// Writes runs to a zstd compressed tarball with a JSON file per run, so they can be imported
+/// into the database of another machine.
+///
+/// # Arguments
+/// * path - where the export is written, e.g. `runs.tar.zst`
+/// * run_ids - the runs to export
+pub async fn export(
+    path: &Path,
+    run_ids: &[&str],
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<()> {
+    let file = fs::File::create(path).context(format!("Unable to create {}", path.display()))?;
+    let encoder = zstd::Encoder::new(file, 0)?;
+    let mut tarball = tar::Builder::new(encoder);
+
+    for run_id in run_ids {
+        let archive = RunArchive::fetch(run_id, data_access_service).await?;
+        let json = serde_json::to_vec(&archive)?;
+
+        let mut header = tar::Header::new_gnu();
+        header.set_size(json.len() as u64);
+        header.set_mode(0o644);
+        header.set_mtime((archive.run.start_time / 1000).max(0) as u64);
+        header.set_cksum();
+        tarball
+            .append_data(
+                &mut header,
+                format!("runs/{}.json", run_id),
+                json.as_slice(),
+            )
+            .context(format!("Unable to write run {} to the export", run_id))?;
+    }
+
+    tarball.into_inner()?.finish()?;
+    Ok(())
+}
+
+/// Saves the runs in an export. A run whose id is already taken by a different run is given a
+/// new id, a run which was already imported is skipped even if it was given a new id or has been
+/// annotated since.
+///
+/// # Returns
+/// The runs in the export in the order they were read
+pub async fn import(
+    path: &Path,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<Vec<Imported>> {
+    let file = fs::File::open(path).context(format!("Unable to open {}", path.display()))?;
+    let mut tarball = tar::Archive::new(zstd::Decoder::new(file)?);
+
+    let mut imported = vec![];
+    for entry in tarball.entries().context("Unable to read the export")? {
+        let mut entry = entry.context("Unable to read the export")?;
+        let entry_path = entry.path()?.to_string_lossy().to_string();
+        if !entry_path.ends_with(".json") {
+            continue;
+        }
+        let mut json = vec![];
+        entry.read_to_end(&mut json)?;
+        let archive = serde_json::from_slice::<RunArchive>(&json)
+            .context(format!("{} isn't a cardamon run", entry_path))?;
+
+        let run_id = archive.run.run_id.clone();
+        if already_imported(&archive.run, data_access_service).await? {
+            imported.push(Imported {
+                run_id,
+                imported_as: None,
+            });
+            continue;
+        }
+        let imported_as = match data_access_service.run_dao().fetch(&run_id).await? {
+            Some(_) => {
+                let new_id = unused_run_id(data_access_service).await?;
+                let source_id = archive.run.imported_from.clone().unwrap_or(run_id.clone());
+                let mut archive = archive.with_run_id(&new_id);
+                archive.run.imported_from = Some(source_id);
+                archive.persist(data_access_service).await?;
+                Some(new_id)
+            }
+            None => {
+                archive.persist(data_access_service).await?;
+                Some(run_id.clone())
+            }
+        };
+        imported.push(Imported {
+            run_id,
+            imported_as,
+        });
+    }
+    Ok(imported)
+}
+
+/// # Returns
+/// True if a run started at the same time has the id of the run or the id it was imported
+/// from, either as its own id or as the id it was imported from
+async fn already_imported(
+    run: &Run,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<bool> {
+    let ids = [Some(run.run_id.as_str()), run.imported_from.as_deref()];
+    let ids = ids.iter().flatten().collect::<Vec<_>>();
+    Ok(data_access_service
+        .run_dao()
+        .fetch_since(run.start_time)
+        .await?
+        .iter()
+        .filter(|existing| existing.start_time == run.start_time)
+        .any(|existing| {
+            ids.contains(&&existing.run_id.as_str())
+                || existing
+                    .imported_from
+                    .as_deref()
+                    .is_some_and(|imported_from| ids.contains(&&imported_from))
+        }))
+}
+
+async fn unused_run_id(data_access_service: &dyn DataAccessService) -> anyhow::Result<String> {
+    for _ in 0..10 {
+        let run_id = nanoid::nanoid!(5);
+        if data_access_service
+            .run_dao()
+            .fetch(&run_id)
+            .await?
+            .is_none()
+        {
+            return Ok(run_id);
+        }
+    }
+    Err(anyhow!("Unable to find an unused run id"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn archives_can_be_given_a_new_run_id() {
+        let archive = RunArchive {
+            run: Run::new("1", 0, 1000, None, "config", None, None),
+            scenario_iterations: vec![ScenarioIteration::new("1", "basket", 0, 0, 1000, None)],
+            cpu_metrics: vec![CpuMetrics::new("1", "10", "server", 50.0, 100.0, 4, 500)],
+            power_metrics: vec![],
+            resource_metrics: vec![],
+            endpoint_energy: vec![],
+            artifacts: vec![Artifact::new("1", "flamegraph", "flame.svg", vec![1, 2], 0)],
+        };
+
+        let archive = archive.with_run_id("abcde");
+        assert_eq!(archive.run.run_id, "abcde");
+        assert_eq!(archive.scenario_iterations[0].run_id, "abcde");
+        assert_eq!(archive.cpu_metrics[0].run_id, "abcde");
+        assert_eq!(archive.artifacts[0].run_id, "abcde");
+        assert_eq!(archive.samples(), 1);
+    }
+
+    #[sqlx::test(migrations = "./migrations", fixtures("../fixtures/runs.sql"))]
+    async fn runs_are_only_imported_once(pool: sqlx::SqlitePool) -> anyhow::Result<()> {
+        let data_access_service = crate::data_access::LocalDataAccessService::new(pool.clone());
+        let path = std::env::temp_dir().join(format!("cardamon-{}.tar.zst", nanoid::nanoid!(5)));
+
+        export(&path, &["2", "3"], &data_access_service).await?;
+        let imported = import(&path, &data_access_service).await?;
+        assert_eq!(
+            imported,
+            [
+                Imported {
+                    run_id: String::from("2"),
+                    imported_as: None
+                },
+                Imported {
+                    run_id: String::from("3"),
+                    imported_as: None
+                }
+            ]
+        );
+
+        // another run took the id of run 2, so it's imported under a new id
+        let run_dao = data_access_service.run_dao();
+        run_dao.delete("2").await?;
+        run_dao
+            .persist(&Run::new("2", 1, 2, None, "config", None, None))
+            .await?;
+        let imported = import(&path, &data_access_service).await?;
+        let new_id = imported[0]
+            .imported_as
+            .clone()
+            .expect("run 2 should be imported under a new id");
+        assert_ne!(new_id, "2");
+        assert_eq!(imported[1].imported_as, None);
+        let copy = run_dao.fetch(&new_id).await?.expect("run 2 was imported");
+        assert_eq!(copy.imported_from.as_deref(), Some("2"));
+
+        // and isn't imported again, even once it's been annotated
+        let annotated = copy.with_annotation(crate::annotation::Annotation::new(
+            1,
+            Some("imported"),
+            vec![],
+        ))?;
+        run_dao.annotate(&annotated).await?;
+        let imported = import(&path, &data_access_service).await?;
+        fs::remove_file(&path)?;
+        assert!(imported.iter().all(|run| run.imported_as.is_none()));
+        assert_eq!(run_dao.fetch_since(0).await?.len(), 4);
+
+        pool.close().await;
+        Ok(())
+    }
+}
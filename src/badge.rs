@@ -0,0 +1,233 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    compare,
+    dataset::{RunDataset, Stats},
+    report,
+};
+use std::fmt::Write;
+
+const LABEL_COLOUR: &str = "#555";
+const WORSE_COLOUR: &str = "#e05d44";
+const BETTER_COLOUR: &str = "#4c1";
+const STEADY_COLOUR: &str = "#007ec6";
+
+/// Roughly the width of a character of 11px Verdana, badges are sized by it as there's no font
+/// to measure text with.
+const CHAR_WIDTH: f64 = 7.0;
+const PADDING: f64 = 10.0;
+
+/// How the latest run of a scenario compares with the one before it.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Trend {
+    Up,
+    Down,
+    /// The change can't be told apart from noise.
+    Steady,
+}
+impl Trend {
+    fn arrow(&self) -> &'static str {
+        match self {
+            Trend::Up => "↑",
+            Trend::Down => "↓",
+            Trend::Steady => "→",
+        }
+    }
+
+    /// More energy or carbon is worse.
+    fn colour(&self) -> &'static str {
+        match self {
+            Trend::Up => WORSE_COLOUR,
+            Trend::Down => BETTER_COLOUR,
+            Trend::Steady => STEADY_COLOUR,
+        }
+    }
+}
+
+/// # Arguments
+/// * runs - the runs of a scenario, oldest first
+/// * metric - the metric shown, "energy" or "emissions" as compared between runs
+///
+/// # Returns
+/// The metric of the latest run, its unit and how it changed since the run before it, None if
+/// the latest run didn't measure the metric
+pub fn latest(runs: &[RunDataset], metric: &str) -> Option<(Stats, &'static str, Option<Trend>)> {
+    let latest = runs.last()?;
+    let (_, unit, values) = compare::per_iteration(latest)
+        .into_iter()
+        .find(|(name, _, _)| *name == metric)?;
+    let threshold = latest.run().and_then(report::run_outlier_threshold);
+    let stats = Stats::excluding_outliers(&values, threshold)?;
+
+    let trend = runs
+        .len()
+        .checked_sub(2)
+        .and_then(|previous| {
+            compare::compare_runs(&runs[previous], latest)
+                .into_iter()
+                .find(|change| change.metric == metric)
+        })
+        .map(|change| {
+            if !change.is_significant() {
+                Trend::Steady
+            } else if change.difference() > 0.0 {
+                Trend::Up
+            } else {
+                Trend::Down
+            }
+        });
+    Some((stats, unit, trend))
+}
+
+/// Scales a value to a prefix which keeps it readable on a badge, e.g. 12300 J is 12.3 kJ.
+fn humanise(value: f64, unit: &str) -> String {
+    let (value, prefix) = match value.abs() {
+        v if v >= 1e6 => (value / 1e6, "M"),
+        v if v >= 1e3 => (value / 1e3, "k"),
+        v if v >= 1.0 || v == 0.0 => (value, ""),
+        v if v >= 1e-3 => (value * 1e3, "m"),
+        _ => (value * 1e6, "µ"),
+    };
+    let precision = match value.abs() {
+        v if v >= 100.0 => 0,
+        v if v >= 10.0 => 1,
+        _ => 2,
+    };
+    format!("{:.*} {}{}", precision, value, prefix, unit)
+}
+
+/// # Arguments
+/// * label - the left of the badge, e.g. the scenario
+/// * value - the figure shown on the right of the badge
+/// * unit - the unit of the figure
+/// * trend - how the figure changed since the previous run, the badge is coloured by it
+///
+/// # Returns
+/// A flat shields style SVG badge
+pub fn svg(label: &str, value: f64, unit: &str, trend: Option<Trend>) -> String {
+    let mut message = humanise(value, unit);
+    if let Some(trend) = trend {
+        message.push(' ');
+        message.push_str(trend.arrow());
+    }
+    let colour = trend.map(|trend| trend.colour()).unwrap_or(STEADY_COLOUR);
+
+    let width = |text: &str| text.chars().count() as f64 * CHAR_WIDTH + PADDING;
+    let label_width = width(label);
+    let message_width = width(&message);
+    let total_width = label_width + message_width;
+    let title = escape(&format!("{label}: {message}"));
+
+    let mut svg = String::new();
+    let _ = write!(
+        svg,
+        "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"{total_width}\" height=\"20\" role=\"img\" aria-label=\"{title}\"><title>{title}</title>"
+    );
+    let _ = write!(
+        svg,
+        "<linearGradient id=\"s\" x2=\"0\" y2=\"100%\"><stop offset=\"0\" stop-color=\"#bbb\" stop-opacity=\".1\"/><stop offset=\"1\" stop-opacity=\".1\"/></linearGradient>\
+        <clipPath id=\"r\"><rect width=\"{total_width}\" height=\"20\" rx=\"3\" fill=\"#fff\"/></clipPath>"
+    );
+    let _ = write!(
+        svg,
+        "<g clip-path=\"url(#r)\"><rect width=\"{label_width}\" height=\"20\" fill=\"{LABEL_COLOUR}\"/><rect x=\"{label_width}\" width=\"{message_width}\" height=\"20\" fill=\"{colour}\"/><rect width=\"{total_width}\" height=\"20\" fill=\"url(#s)\"/></g>"
+    );
+    svg.push_str("<g fill=\"#fff\" text-anchor=\"middle\" font-family=\"Verdana,Geneva,DejaVu Sans,sans-serif\" font-size=\"11\">");
+    for (x, text) in [
+        (label_width / 2.0, escape(label)),
+        (label_width + message_width / 2.0, escape(&message)),
+    ] {
+        // the shadow under the text
+        let _ = write!(
+            svg,
+            "<text x=\"{x}\" y=\"15\" fill=\"#010101\" fill-opacity=\".3\">{text}</text><text x=\"{x}\" y=\"14\">{text}</text>"
+        );
+    }
+    svg.push_str("</g></svg>\n");
+    svg
+}
+
+fn escape(text: &str) -> String {
+    text.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        data_access::{cpu_metrics::CpuMetrics, run::Run, scenario_iteration::ScenarioIteration},
+        dataset::{IterationWithMetrics, ObservationDataset},
+    };
+
+    fn run(run_id: &str, start: i64, cpu_usage: &[f64]) -> ObservationDataset {
+        let iterations = cpu_usage
+            .iter()
+            .enumerate()
+            .map(|(iteration, cpu_usage)| {
+                let start = start + iteration as i64 * 5000;
+                IterationWithMetrics::new(
+                    ScenarioIteration::new(
+                        run_id,
+                        "basket_10",
+                        iteration as i64,
+                        start,
+                        start + 2000,
+                        None,
+                    ),
+                    vec![
+                        CpuMetrics::new(run_id, "10", "server", *cpu_usage, 100.0, 4, start),
+                        CpuMetrics::new(run_id, "10", "server", *cpu_usage, 100.0, 4, start + 2000),
+                    ],
+                    vec![],
+                    vec![],
+                )
+            })
+            .collect();
+        let runs = vec![Run::new(
+            run_id,
+            start,
+            start + 20000,
+            Some(40.0),
+            "config",
+            None,
+            None,
+        )];
+        ObservationDataset::new(iterations, runs, vec![])
+    }
+
+    #[test]
+    fn badges_show_the_latest_run_and_its_trend() {
+        let a = run("a", 0, &[100.0, 102.0, 98.0]);
+        let b = run("b", 100000, &[50.0, 51.0, 49.0]);
+        let a_scenarios = a.by_scenario();
+        let b_scenarios = b.by_scenario();
+        let mut runs = a_scenarios[0].by_run();
+        runs.extend(b_scenarios[0].by_run());
+
+        // half the CPU for the same time at 40 W
+        let (stats, unit, trend) = latest(&runs, "energy").expect("energy should be measured");
+        assert!((stats.mean - 10.0).abs() < 1e-9);
+        assert_eq!(unit, "J");
+        assert_eq!(trend, Some(Trend::Down));
+        // there's nothing to compare a single run with
+        assert_eq!(
+            latest(&runs[..1], "energy").map(|(_, _, trend)| trend),
+            Some(None)
+        );
+        // there's no carbon intensity
+        assert!(latest(&runs, "emissions").is_none());
+
+        let svg = svg("basket<10> energy", 12345.0, "J", Some(Trend::Down));
+        assert!(svg.starts_with("<svg"));
+        assert!(svg.contains("<title>basket&lt;10&gt; energy: 12.3 kJ ↓</title>"));
+        assert!(svg.contains(BETTER_COLOUR));
+        assert_eq!(humanise(0.0042, "gCO2e"), "4.20 mgCO2e");
+    }
+}
@@ -0,0 +1,140 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{config::Budget, energy, metrics::CpuMetrics, metrics_logger::StopHandle};
+use itertools::Itertools;
+use tokio::time::Duration;
+use tokio_util::sync::CancellationToken;
+
+/// How often the live estimate is checked against the budget.
+const CHECK_INTERVAL: Duration = Duration::from_secs(1);
+
+/// The energy an iteration has used so far and the power it's drawing now, estimated from the
+/// CPU usage of the observed processes.
+#[derive(Debug, PartialEq)]
+pub struct Estimate {
+    pub joules: f64,
+    pub watts: f64,
+}
+
+/// # Arguments
+/// * cpu_metrics - every sample logged since the iteration started
+/// * tdp - the thermal design power of the CPU in watts
+///
+/// # Returns
+/// The estimate, the power is that of the latest sample of each process
+pub fn estimate(cpu_metrics: &[CpuMetrics], tdp: f64) -> Estimate {
+    let by_process = cpu_metrics
+        .iter()
+        .into_group_map_by(|metrics| metrics.process_id.as_str());
+
+    let mut estimate = Estimate {
+        joules: 0.0,
+        watts: 0.0,
+    };
+    for samples in by_process.values() {
+        // the power model works on the metrics as they're saved
+        let saved = samples
+            .iter()
+            .map(|metrics| metrics.into_data_access(""))
+            .collect_vec();
+        let share_seconds = energy::cpu_share_seconds(&saved.iter().collect_vec());
+        estimate.joules += energy::estimate_joules(share_seconds, tdp);
+        if let Some(latest) = samples.iter().max_by_key(|metrics| metrics.timestamp) {
+            let share = latest.cpu_usage / 100.0 / latest.core_count.max(1) as f64;
+            estimate.watts += share.min(1.0) * tdp;
+        }
+    }
+    estimate
+}
+
+/// # Returns
+/// Why the estimate is over budget, None if it's within it
+pub fn over_budget(budget: &Budget, estimate: &Estimate) -> Option<String> {
+    match (budget.joules, budget.watts) {
+        (Some(joules), _) if estimate.joules > joules => Some(format!(
+            "used {:.1} J of its {:.1} J budget",
+            estimate.joules, joules
+        )),
+        (_, Some(watts)) if estimate.watts > watts => Some(format!(
+            "drew {:.1} W, over its {:.1} W budget",
+            estimate.watts, watts
+        )),
+        _ => None,
+    }
+}
+
+/// Checks the metrics logged for an iteration against its budget until the iteration finishes,
+/// cancelling `exceeded` if it goes over so the iteration is stopped.
+///
+/// # Arguments
+/// * `name` - The name of the scenario, used in the warning
+/// * `stop_handle` - The loggers of the iteration
+/// * `budget` - The budget of the iteration
+/// * `tdp` - The thermal design power of the CPU in watts
+/// * `exceeded` - Cancelled once the budget is exceeded
+/// * `finished` - Cancelled once the iteration has finished
+pub async fn watch(
+    name: &str,
+    stop_handle: &StopHandle,
+    budget: &Budget,
+    tdp: f64,
+    exceeded: &CancellationToken,
+    finished: &CancellationToken,
+) {
+    loop {
+        tokio::select! {
+            _ = finished.cancelled() => return,
+            _ = tokio::time::sleep(CHECK_INTERVAL) => {}
+        }
+
+        let estimate = stop_handle.with_log(|log| estimate(log.get_metrics(), tdp));
+        if let Some(reason) = over_budget(budget, &estimate) {
+            tracing::warn!("Scenario {name} {reason}, stopping it");
+            exceeded.cancel();
+            return;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn sample(process_id: &str, cpu_usage: f64, timestamp: i64) -> CpuMetrics {
+        CpuMetrics {
+            process_id: String::from(process_id),
+            process_name: String::from(process_id),
+            cpu_usage,
+            core_count: 4,
+            timestamp,
+        }
+    }
+
+    #[test]
+    fn estimates_are_checked_against_budgets() {
+        let cpu_metrics = vec![
+            sample("1", 100.0, 0),
+            sample("1", 100.0, 2000),
+            sample("2", 200.0, 0),
+            sample("2", 400.0, 2000),
+        ];
+
+        // a quarter of the CPU for 2s and all of it for 2s at 40W
+        let estimate = estimate(&cpu_metrics, 40.0);
+        assert_eq!(estimate.joules, 100.0);
+        assert_eq!(estimate.watts, 50.0);
+
+        let budget = |joules, watts| Budget { joules, watts };
+        assert_eq!(
+            over_budget(&budget(Some(200.0), Some(60.0)), &estimate),
+            None
+        );
+        assert!(over_budget(&budget(Some(80.0), None), &estimate)
+            .is_some_and(|reason| reason.contains("100.0 J")));
+        assert!(over_budget(&budget(None, Some(45.0)), &estimate).is_some());
+    }
+}
@@ -0,0 +1,181 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::config::Embodied;
+use std::time::Duration;
+
+const JOULES_PER_KWH: f64 = 3_600_000.0;
+
+/// Approximate annual average grams of CO2e per kWh of the electricity generated in each region,
+/// keyed by ISO 3166 country code. They're a rough guide for machines which can't look up the
+/// grid, an intensity from the grid operator is more accurate.
+const REGIONS: [(&str, f64); 21] = [
+    ("AU", 549.0),
+    ("BR", 98.0),
+    ("CA", 128.0),
+    ("CH", 35.0),
+    ("CN", 582.0),
+    ("DE", 381.0),
+    ("DK", 151.0),
+    ("ES", 174.0),
+    ("FR", 56.0),
+    ("GB", 238.0),
+    ("IE", 282.0),
+    ("IN", 713.0),
+    ("IT", 331.0),
+    ("JP", 485.0),
+    ("NL", 268.0),
+    ("NO", 30.0),
+    ("PL", 662.0),
+    ("SE", 41.0),
+    ("SG", 470.0),
+    ("US", 369.0),
+    ("WORLD", 481.0),
+];
+
+/// Converts energy into the carbon emitted generating it (operational carbon).
+///
+/// # Arguments
+/// * joules - energy used
+/// * intensity - grams of CO2e emitted per kWh of electricity
+///
+/// # Returns
+/// The operational carbon in grams CO2e
+pub fn operational_grams(joules: f64, intensity: f64) -> f64 {
+    joules / JOULES_PER_KWH * intensity
+}
+
+/// # Arguments
+/// * joules - energy used
+/// * price_per_kwh - the price of a kWh of electricity
+///
+/// # Returns
+/// What the electricity cost
+pub fn electricity_cost(joules: f64, price_per_kwh: f64) -> f64 {
+    joules / JOULES_PER_KWH * price_per_kwh
+}
+
+/// Adds the overhead of the facility the machine runs in, e.g. cooling, to the energy the machine
+/// used. Energy spent outside the facility, such as on the network, shouldn't include it.
+///
+/// # Arguments
+/// * joules - energy used by the machine
+/// * pue - the Power Usage Effectiveness of the facility, 1 if it isn't known
+///
+/// # Returns
+/// The energy of the facility in joules
+pub fn facility_joules(joules: f64, pue: Option<f64>) -> f64 {
+    joules * pue.unwrap_or(1.0)
+}
+
+/// Amortises the carbon emitted manufacturing the hardware (embodied carbon) over its expected
+/// lifetime and returns the portion attributable to the given period of use of the software's
+/// share of the hardware.
+///
+/// # Arguments
+/// * embodied - the embodied carbon and expected lifetime of the hardware
+/// * wall_clock - how long the hardware was in use for
+///
+/// # Returns
+/// The embodied carbon in grams CO2e
+pub fn embodied_grams(embodied: &Embodied, wall_clock: Duration) -> f64 {
+    let time_share = wall_clock.as_secs_f64() / embodied.lifetime.as_secs_f64();
+    embodied.carbon * 1000.0 * time_share * embodied.share.unwrap_or(1.0)
+}
+
+/// The Software Carbon Intensity (SCI) of some software, `(E * I + M) / R`: the operational and
+/// embodied carbon of serving a number of functional units divided by that number.
+///
+/// # Arguments
+/// * joules - energy used serving the functional units (E)
+/// * intensity - grams of CO2e emitted per kWh of electricity (I)
+/// * embodied - the embodied carbon of the hardware (M), if it's known
+/// * wall_clock - how long the hardware was in use for
+/// * functional_units - how many functional units were served (R)
+///
+/// # Returns
+/// The grams CO2e per functional unit, None if no functional units were served
+pub fn sci(
+    joules: f64,
+    intensity: f64,
+    embodied: Option<&Embodied>,
+    wall_clock: Duration,
+    functional_units: f64,
+) -> Option<f64> {
+    if functional_units <= 0.0 {
+        return None;
+    }
+    let embodied = embodied.map_or(0.0, |embodied| embodied_grams(embodied, wall_clock));
+    Some((operational_grams(joules, intensity) + embodied) / functional_units)
+}
+
+/// # Returns
+/// The annual average grams of CO2e per kWh of the region, e.g. `GB` or `world`, None if it
+/// isn't known
+pub fn region_intensity(region: &str) -> Option<f64> {
+    REGIONS
+        .iter()
+        .find(|(code, _)| code.eq_ignore_ascii_case(region))
+        .map(|(_, intensity)| *intensity)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn operational_carbon_uses_intensity_per_kwh() {
+        assert_eq!(operational_grams(JOULES_PER_KWH, 300.0), 300.0);
+        assert_eq!(operational_grams(JOULES_PER_KWH / 2.0, 300.0), 150.0);
+    }
+
+    #[test]
+    fn electricity_is_priced_per_kwh() {
+        assert_eq!(electricity_cost(JOULES_PER_KWH * 2.0, 0.25), 0.5);
+    }
+
+    #[test]
+    fn pue_adds_the_overhead_of_the_facility() {
+        assert_eq!(facility_joules(100.0, Some(1.4)), 140.0);
+        assert_eq!(facility_joules(100.0, None), 100.0);
+    }
+
+    #[test]
+    fn embodied_carbon_is_prorated_by_wall_clock_time() {
+        let embodied = Embodied {
+            carbon: 100.0,
+            lifetime: Duration::from_secs(1000),
+            share: None,
+        };
+        assert_eq!(embodied_grams(&embodied, Duration::from_secs(10)), 1000.0);
+        assert_eq!(embodied_grams(&embodied, Duration::ZERO), 0.0);
+
+        // a VM with a quarter of the server is attributed a quarter of its embodied carbon
+        let embodied = Embodied {
+            share: Some(0.25),
+            ..embodied
+        };
+        assert_eq!(embodied_grams(&embodied, Duration::from_secs(10)), 250.0);
+    }
+
+    #[test]
+    fn sci_is_carbon_per_functional_unit() {
+        let joules = JOULES_PER_KWH;
+        assert_eq!(sci(joules, 300.0, None, Duration::ZERO, 100.0), Some(3.0));
+        assert_eq!(sci(joules, 300.0, None, Duration::ZERO, 0.0), None);
+
+        let embodied = Embodied {
+            carbon: 100.0,
+            lifetime: Duration::from_secs(1000),
+            share: None,
+        };
+        let wall_clock = Duration::from_secs(10);
+        assert_eq!(
+            sci(joules, 300.0, Some(&embodied), wall_clock, 100.0),
+            Some(13.0)
+        );
+    }
+}
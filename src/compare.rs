@@ -0,0 +1,266 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    carbon,
+    dataset::{IterationWithMetrics, ObservationDataset, RunDataset, ScenarioDataset, Stats},
+    report,
+    significance::{TTest, SIGNIFICANCE_LEVEL},
+};
+
+/// How something measured once per iteration differs between two runs of a scenario.
+#[derive(Debug, PartialEq)]
+pub struct Change {
+    pub metric: &'static str,
+    pub unit: &'static str,
+    pub a: Stats,
+    pub b: Stats,
+}
+impl Change {
+    /// The mean of run b minus the mean of run a.
+    pub fn difference(&self) -> f64 {
+        self.b.mean - self.a.mean
+    }
+
+    /// The difference as a percentage of run a's mean.
+    pub fn relative_difference(&self) -> f64 {
+        if self.a.mean == 0.0 {
+            0.0
+        } else {
+            self.difference() / self.a.mean * 100.0
+        }
+    }
+
+    /// The standard error of the difference between the means. Unlike an A/B run the iterations
+    /// of separate runs can't be paired, so the spread of both runs is taken into account.
+    pub fn standard_error(&self) -> f64 {
+        let variance = |stats: &Stats| stats.stddev.powi(2) / stats.iterations as f64;
+        (variance(&self.a) + variance(&self.b)).sqrt()
+    }
+
+    /// Welch's t-test of the difference, None if either run had a single iteration or neither
+    /// run's iterations varied.
+    pub fn t_test(&self) -> Option<TTest> {
+        TTest::welch(&self.a, &self.b)
+    }
+
+    /// The chance of a difference at least this large between runs which are the same.
+    pub fn p_value(&self) -> Option<f64> {
+        self.t_test().map(|test| test.p_value())
+    }
+
+    /// The range the true difference is within with 95% confidence.
+    pub fn confidence_interval(&self) -> Option<(f64, f64)> {
+        self.t_test().map(|test| test.confidence_interval(0.95))
+    }
+
+    /// A difference with a p-value over SIGNIFICANCE_LEVEL can't be told apart from noise, nor
+    /// can one between runs of a single iteration. Iterations which didn't vary at all differ
+    /// significantly if their means differ.
+    pub fn is_significant(&self) -> bool {
+        match self.p_value() {
+            Some(p_value) => p_value < SIGNIFICANCE_LEVEL,
+            None => self.a.iterations > 1 && self.b.iterations > 1 && self.difference() != 0.0,
+        }
+    }
+}
+
+/// A scenario aligned by name between two runs.
+#[derive(Debug, PartialEq)]
+pub enum ScenarioComparison {
+    Both {
+        scenario: String,
+        changes: Vec<Change>,
+    },
+    OnlyInA(String),
+    OnlyInB(String),
+}
+
+/// The energy, emissions, CPU time and duration of each iteration of the run, along with their
+/// units. Emissions are left out if the run has no carbon intensity.
+pub fn per_iteration(run_dataset: &RunDataset) -> Vec<(&'static str, &'static str, Vec<f64>)> {
+    let run = run_dataset.run();
+    let tdp = run.and_then(|run| run.tdp);
+    let blend = run.and_then(report::run_blend);
+    let intensity = run.and_then(|run| run.carbon_intensity);
+    let pue = run.and_then(|run| run.pue);
+
+    let iterations = run_dataset.by_iterations();
+    let values = |f: &dyn Fn(&IterationWithMetrics) -> Option<f64>| {
+        iterations.iter().filter_map(|it| f(it)).collect::<Vec<_>>()
+    };
+    vec![
+        ("energy", "J", values(&|it| it.joules(tdp, blend.as_ref()))),
+        (
+            "emissions",
+            "gCO2e",
+            values(&|it| {
+                let joules = carbon::facility_joules(it.joules(tdp, blend.as_ref())?, pue);
+                Some(carbon::operational_grams(joules, intensity?))
+            }),
+        ),
+        (
+            "cpu time",
+            "s",
+            values(&|it| {
+                Some(
+                    it.accumulate_by_process()
+                        .iter()
+                        .map(|metrics| metrics.cpu_seconds())
+                        .sum(),
+                )
+            }),
+        ),
+        (
+            "duration",
+            "s",
+            values(&|it| {
+                let scenario_iteration = it.scenario_iteration();
+                Some((scenario_iteration.stop_time - scenario_iteration.start_time) as f64 / 1000.0)
+            }),
+        ),
+    ]
+}
+
+/// # Returns
+/// What changed in each scenario, metrics which weren't measured in both runs are left out
+pub fn compare_runs(a: &RunDataset, b: &RunDataset) -> Vec<Change> {
+    // each run leaves out the outliers its own config asked for
+    let threshold =
+        |run_dataset: &RunDataset| run_dataset.run().and_then(report::run_outlier_threshold);
+    let (a_threshold, b_threshold) = (threshold(a), threshold(b));
+    per_iteration(a)
+        .into_iter()
+        .zip(per_iteration(b))
+        .filter_map(|((metric, unit, a), (_, _, b))| {
+            Some(Change {
+                metric,
+                unit,
+                a: Stats::excluding_outliers(&a, a_threshold)?,
+                b: Stats::excluding_outliers(&b, b_threshold)?,
+            })
+        })
+        .collect()
+}
+
+/// Aligns the scenarios of two runs by name, in the order they're in run a followed by those
+/// only in run b.
+///
+/// # Arguments
+/// * a - the run compared against, e.g. before a change
+/// * b - the run being compared, e.g. after a change
+pub fn compare(a: &ObservationDataset, b: &ObservationDataset) -> Vec<ScenarioComparison> {
+    fn runs<'a>(scenario_datasets: &'a [ScenarioDataset<'a>]) -> Vec<(String, RunDataset<'a>)> {
+        scenario_datasets
+            .iter()
+            .flat_map(|scenario_dataset| scenario_dataset.by_run())
+            .map(|run_dataset| (String::from(run_dataset.scenario_name()), run_dataset))
+            .collect()
+    }
+    let a_scenarios = a.by_scenario();
+    let b_scenarios = b.by_scenario();
+    let a_runs = runs(&a_scenarios);
+    let b_runs = runs(&b_scenarios);
+
+    let mut comparisons = a_runs
+        .iter()
+        .map(
+            |(scenario, a_run)| match b_runs.iter().find(|(other, _)| other == scenario) {
+                Some((_, b_run)) => ScenarioComparison::Both {
+                    scenario: scenario.clone(),
+                    changes: compare_runs(a_run, b_run),
+                },
+                None => ScenarioComparison::OnlyInA(scenario.clone()),
+            },
+        )
+        .collect::<Vec<_>>();
+    comparisons.extend(
+        b_runs
+            .iter()
+            .filter(|(scenario, _)| a_runs.iter().all(|(other, _)| other != scenario))
+            .map(|(scenario, _)| ScenarioComparison::OnlyInB(scenario.clone())),
+    );
+    comparisons
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::data_access::{
+        cpu_metrics::CpuMetrics, run::Run, scenario_iteration::ScenarioIteration,
+    };
+
+    fn run(run_id: &str, scenarios: &[&str], cpu_usage: &[f64]) -> ObservationDataset {
+        let mut iterations = vec![];
+        let mut start = 0;
+        for scenario in scenarios.iter() {
+            for (iteration, cpu_usage) in cpu_usage.iter().enumerate() {
+                iterations.push(IterationWithMetrics::new(
+                    ScenarioIteration::new(
+                        run_id,
+                        scenario,
+                        iteration as i64,
+                        start,
+                        start + 2000,
+                        None,
+                    ),
+                    vec![
+                        CpuMetrics::new(run_id, "10", "server", *cpu_usage, 100.0, 4, start),
+                        CpuMetrics::new(run_id, "10", "server", *cpu_usage, 100.0, 4, start + 2000),
+                    ],
+                    vec![],
+                    vec![],
+                ));
+                start += 5000;
+            }
+        }
+        let runs = vec![Run::new(run_id, 0, start, Some(40.0), "config", None, None)];
+        ObservationDataset::new(iterations, runs, vec![])
+    }
+
+    #[test]
+    fn scenarios_are_aligned_by_name() {
+        let a = run("a", &["basket_10", "checkout"], &[100.0, 102.0, 98.0]);
+        let b = run("b", &["basket_10", "search"], &[50.0, 51.0, 49.0]);
+
+        let comparisons = compare(&a, &b);
+        assert_eq!(comparisons.len(), 3);
+        assert_eq!(
+            comparisons[1],
+            ScenarioComparison::OnlyInA(String::from("checkout"))
+        );
+        assert_eq!(
+            comparisons[2],
+            ScenarioComparison::OnlyInB(String::from("search"))
+        );
+
+        let ScenarioComparison::Both { scenario, changes } = &comparisons[0] else {
+            panic!("basket_10 should be in both runs");
+        };
+        assert_eq!(scenario, "basket_10");
+        // there's no carbon intensity so emissions aren't compared
+        let metrics = changes
+            .iter()
+            .map(|change| change.metric)
+            .collect::<Vec<_>>();
+        assert_eq!(metrics, vec!["energy", "cpu time", "duration"]);
+
+        // half the CPU for the same time at 40 W
+        let energy = &changes[0];
+        assert!((energy.a.mean - 20.0).abs() < 1e-9);
+        assert!((energy.b.mean - 10.0).abs() < 1e-9);
+        assert!((energy.relative_difference() + 50.0).abs() < 1e-9);
+        assert!(energy.is_significant());
+        assert!(energy.p_value().is_some_and(|p| p < 0.001));
+        let (low, high) = energy.confidence_interval().expect("both runs vary");
+        assert!(low < -10.0 && high > -10.0 && high < 0.0);
+
+        // every iteration took exactly as long
+        let duration = &changes[2];
+        assert_eq!(duration.difference(), 0.0);
+        assert!(!duration.is_significant());
+    }
+}
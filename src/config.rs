@@ -4,14 +4,80 @@
  * file, You can obtain one at https://mozilla.org/MPL/2.0/.
  */
 
-use anyhow::Context;
+use crate::{
+    carbon, exporter, k8s::Pod, metrics::PowerComponent, metrics_logger::scope::Scope, pinning,
+    schedule::Schedule, shuffle, units::Units,
+};
+use anyhow::{anyhow, Context};
+use chrono::Timelike;
+use itertools::Itertools;
 use serde::Deserialize;
-use std::{fs, io::Read};
+use std::{collections::BTreeMap, fs, io::Read, time::Duration};
 
 #[derive(Debug, Deserialize)]
 pub struct Config {
+    /// The TOML this config was parsed from, stored with each run as provenance.
+    #[serde(skip)]
+    pub source: String,
     pub debug_level: Option<String>,
+    /// Saved with every run so the runs of many repositories can share a database without
+    /// their scenarios getting mixed up, e.g. the name of the repository.
+    pub project: Option<String>,
     pub metrics_server_url: Option<String>,
+    #[serde(default)]
+    pub container_runtime: ContainerRuntime,
+    #[serde(default)]
+    pub container_stats: ContainerStats,
+    #[serde(default)]
+    pub cpu_accounting: CpuAccounting,
+    /// How often processes are sampled unless the process sets its own interval.
+    pub sample_interval_ms: Option<u64>,
+    /// How many scenarios can run at the same time. Only scenarios which observe separate
+    /// processes are run together, defaults to 1.
+    pub parallelism: Option<usize>,
+    /// Run the scenarios of each iteration in a random order, so effects which build up over a
+    /// run, such as thermal throttling and caches warming up, don't always favour the same
+    /// scenario.
+    #[serde(default)]
+    pub shuffle: bool,
+    /// The seed of the shuffle, set it to the seed of a previous run to run in the same order.
+    pub shuffle_seed: Option<u64>,
+    /// Values of the `{{name}}` placeholders in process and scenario commands.
+    #[serde(default)]
+    pub variables: BTreeMap<String, String>,
+    pub cpu: Option<Cpu>,
+    pub blend: Option<Blend>,
+    pub carbon: Option<Carbon>,
+    pub cost: Option<Cost>,
+    pub network: Option<Network>,
+    pub storage: Option<Storage>,
+    pub baseline: Option<Baseline>,
+    #[serde(default)]
+    pub checks: Checks,
+    pub pinning: Option<Pinning>,
+    pub prometheus: Option<Prometheus>,
+    pub otlp: Option<Otlp>,
+    /// The budget of every scenario which doesn't set its own.
+    pub budget: Option<Budget>,
+    /// The run id, label, branch or commit of the run `cardamon run --check` compares against,
+    /// the latest run with the label, branch or commit is used.
+    pub regression_baseline: Option<String>,
+    /// Iterations whose energy has a modified z-score above this, e.g. 3.5, are outliers and are
+    /// left out of the statistics of their scenario. Outliers aren't excluded unless it's set.
+    pub outlier_threshold: Option<f64>,
+    /// The units figures are printed and exported in, the command line flags override them.
+    #[serde(default)]
+    pub units: Units,
+    /// Where runs are saved, the local cardamon.db unless it's set.
+    pub database: Option<Database>,
+    pub retention: Option<Retention>,
+    #[serde(default)]
+    pub power_sources: Vec<PowerSource>,
+    #[serde(default)]
+    pub metrics_sources: Vec<MetricsSource>,
+    #[serde(default)]
+    pub hosts: Vec<Host>,
+    #[serde(default)]
     pub processes: Vec<ProcessToExecute>,
     pub scenarios: Vec<Scenario>,
     pub observations: Vec<Observation>,
@@ -21,7 +87,145 @@ impl Config {
         let mut config_str = String::new();
         fs::File::open(path)?.read_to_string(&mut config_str)?;
 
-        toml::from_str::<Config>(&config_str).context("Error parsing config file.")
+        let mut config =
+            toml::from_str::<Config>(&config_str).context("Error parsing config file.")?;
+        config.source = config_str;
+
+        if let Some(blend) = &config.blend {
+            blend.validate()?;
+        }
+        validate_sample_interval(config.sample_interval_ms)
+            .context("Invalid sample_interval_ms.")?;
+        if config.parallelism == Some(0) {
+            return Err(anyhow!("parallelism must be at least 1."));
+        }
+        if config.shuffle_seed.is_some() && !config.shuffle {
+            return Err(anyhow!("shuffle_seed is only used if shuffle = true."));
+        }
+        if config
+            .outlier_threshold
+            .is_some_and(|threshold| threshold <= 0.0)
+        {
+            return Err(anyhow!("outlier_threshold must be more than 0."));
+        }
+        for scenario in config.scenarios.iter() {
+            scenario.validate()?;
+            if let Some(budget) = &scenario.budget {
+                budget
+                    .validate()
+                    .context(format!("Invalid budget of scenario {}.", scenario.name))?;
+            }
+            if scenario
+                .max_regression_pct
+                .is_some_and(|pct| !(pct.is_finite() && pct >= 0.0))
+            {
+                return Err(anyhow!(
+                    "max_regression_pct of scenario {} must be a positive number.",
+                    scenario.name
+                ));
+            }
+            if let Some(functional_unit) = &scenario.functional_unit {
+                functional_unit.validate().context(format!(
+                    "Invalid functional unit of scenario {}.",
+                    scenario.name
+                ))?;
+            }
+            scenario.validate_start(&config.processes)?;
+        }
+        for process in config.processes.iter() {
+            process.validate()?;
+        }
+        for obs in config.observations.iter() {
+            if let Some(schedule) = &obs.schedule {
+                Schedule::parse(schedule)
+                    .context(format!("Invalid schedule of observation {}.", obs.name))?;
+            }
+        }
+        if let Some(carbon) = &config.carbon {
+            carbon.validate()?;
+        }
+        if let Some(cost) = &config.cost {
+            cost.validate()?;
+        }
+        if let Some(network) = &config.network {
+            network.validate()?;
+        }
+        if let Some(storage) = &config.storage {
+            storage.validate()?;
+        }
+        if let Some(baseline) = &config.baseline {
+            baseline.validate()?;
+        }
+        if let Some(budget) = &config.budget {
+            budget.validate().context("Invalid budget.")?;
+        }
+        config.checks.validate().context("Invalid checks.")?;
+        config.units.validate().context("Invalid units.")?;
+        if let Some(database) = &config.database {
+            database.validate().context("Invalid database.")?;
+        }
+        if let Some(retention) = &config.retention {
+            retention.validate().context("Invalid retention.")?;
+        }
+        if let Some(pinning) = &config.pinning {
+            pinning.validate().context("Invalid pinning.")?;
+        }
+        for metrics_source in config.metrics_sources.iter() {
+            metrics_source.validate()?;
+        }
+        for host in config.hosts.iter() {
+            host.validate()?;
+        }
+
+        Ok(config)
+    }
+
+    /// Replaces the configured project, e.g. with the one given on the command line.
+    pub fn with_project(self, project: Option<String>) -> Self {
+        match project {
+            Some(project) => Self {
+                project: Some(project),
+                ..self
+            },
+            None => self,
+        }
+    }
+
+    /// Reads only the parts of a config every command uses, so commands which don't run
+    /// anything don't need the rest of the config to be valid.
+    ///
+    /// # Returns
+    /// The global config, the defaults if there's no config at the path
+    pub fn global_from_path(path: &std::path::Path) -> anyhow::Result<GlobalConfig> {
+        if !path.exists() {
+            return Ok(GlobalConfig::default());
+        }
+        let config_str = fs::read_to_string(path)?;
+        let global =
+            toml::from_str::<GlobalConfig>(&config_str).context("Error parsing config file.")?;
+        global.units.validate().context("Invalid units.")?;
+        if let Some(database) = &global.database {
+            database.validate().context("Invalid database.")?;
+        }
+        if let Some(retention) = &global.retention {
+            retention.validate().context("Invalid retention.")?;
+        }
+        if let Some(server) = &global.server {
+            server.validate().context("Invalid server.")?;
+        }
+        if let Some(sync) = &global.sync {
+            sync.destination().context("Invalid sync.")?;
+        }
+        Ok(global)
+    }
+
+    /// # Returns
+    /// How often processes are sampled unless the process sets its own interval
+    pub fn sample_interval(&self) -> Duration {
+        Duration::from_millis(
+            self.sample_interval_ms
+                .unwrap_or(DEFAULT_SAMPLE_INTERVAL_MS),
+        )
     }
 
     fn find_observation(&self, observation_name: &str) -> Option<&Observation> {
@@ -90,32 +294,147 @@ impl Config {
                 ))?;
                 scenarios.push(scenario);
             }
-        } else {
+        } else if let Some(scenario) = self.find_scenario(name) {
             // if there isn't an observation with the given name then try to find a single scenario
             // with the name instead.
-            let scenario = self.find_scenario(name).context(format!(
-                "Unable to find observation or scenario with name: {}",
-                name
-            ))?;
             scenarios.push(scenario);
+        } else {
+            // otherwise the name may be a pattern matching several scenarios, e.g. `checkout-*`
+            let pattern = glob_regex(name)?;
+            scenarios.extend(
+                self.scenarios
+                    .iter()
+                    .filter(|scenario| pattern.is_match(&scenario.name)),
+            );
+            if scenarios.is_empty() {
+                return Err(anyhow!(
+                    "Unable to find observation or scenario with name: {}",
+                    name
+                ));
+            }
         }
 
-        let mut scenarios_to_execute = vec![];
+        let mut ordered = vec![];
         for scenario in scenarios {
+            self.order_by_dependencies(scenario, &mut vec![], &mut ordered)?;
+        }
+
+        let mut scenarios_to_execute = vec![];
+        for scenario in ordered {
             scenarios_to_execute.append(&mut scenario.build_scenarios_to_execute());
         }
 
         Ok(scenarios_to_execute)
     }
 
+    /// Adds a scenario to the ordered scenarios after the scenarios it depends on.
+    ///
+    /// # Arguments
+    /// * scenario - the scenario to add
+    /// * visiting - the scenarios whose dependencies are being added, used to find cycles
+    /// * ordered - the scenarios in the order they should run
+    fn order_by_dependencies<'a>(
+        &'a self,
+        scenario: &'a Scenario,
+        visiting: &mut Vec<&'a str>,
+        ordered: &mut Vec<&'a Scenario>,
+    ) -> anyhow::Result<()> {
+        if ordered.iter().any(|s| s.name == scenario.name) {
+            return Ok(());
+        }
+        if visiting.contains(&scenario.name.as_str()) {
+            return Err(anyhow!(
+                "Scenario {} depends on itself: {} -> {}",
+                scenario.name,
+                visiting.join(" -> "),
+                scenario.name
+            ));
+        }
+
+        visiting.push(&scenario.name);
+        for dependency in scenario.depends_on.iter() {
+            let dependency = self.find_scenario(dependency).context(format!(
+                "Unable to find scenario {dependency} which {} depends on",
+                scenario.name
+            ))?;
+            self.order_by_dependencies(dependency, visiting, ordered)?;
+        }
+        visiting.pop();
+
+        ordered.push(scenario);
+        Ok(())
+    }
+
+    /// # Arguments
+    /// * name - the name of the observation
+    ///
+    /// # Returns
+    /// When the observation should run, an error if it doesn't have a schedule
+    pub fn schedule(&self, name: &str) -> anyhow::Result<Schedule> {
+        let schedule = self
+            .find_observation(name)
+            .context(format!("Unable to find observation with name: {name}"))?
+            .schedule
+            .as_ref()
+            .context(format!("Observation {name} doesn't have a schedule"))?;
+        Schedule::parse(schedule)
+    }
+
+    /// Every combination of the environment variables in the matrix of an observation. A plan is
+    /// created and run for each combination.
+    ///
+    /// # Arguments
+    /// * name - the name of the observation or scenario being run
+    ///
+    /// # Returns
+    /// The environment variables of each combination, a single empty combination if there's no
+    /// matrix
+    pub fn matrix_combinations(&self, name: &str) -> Vec<Vec<(String, String)>> {
+        let Some(obs) = self.find_observation(name) else {
+            return vec![vec![]];
+        };
+        if obs.matrix.is_empty() {
+            return vec![vec![]];
+        }
+
+        obs.matrix
+            .iter()
+            .map(|(key, values)| values.iter().map(move |value| (key.clone(), value.clone())))
+            .multi_cartesian_product()
+            .collect()
+    }
+
     pub fn create_execution_plan(&self, name: &str) -> anyhow::Result<ExecutionPlan> {
         let scenarios_to_execute = self.collect_scenarios_to_execute(name)?;
         let processes_to_execute = self.collect_processes(&scenarios_to_execute)?;
 
         Ok(ExecutionPlan {
+            config_source: &self.source,
+            cpu: self.cpu.as_ref(),
+            power_sources: &self.power_sources,
+            metrics_sources: &self.metrics_sources,
+            hosts: &self.hosts,
+            container_runtime: self.container_runtime,
+            container_stats: self.container_stats,
+            cpu_accounting: self.cpu_accounting,
+            sample_interval: self.sample_interval(),
+            parallelism: self.parallelism.unwrap_or(1),
+            baseline: self.baseline.as_ref(),
+            checks: &self.checks,
+            pinning: self.pinning.as_ref(),
+            prometheus: self.prometheus.as_ref(),
+            otlp: self.otlp.as_ref(),
+            carbon: self.carbon.as_ref(),
+            blend: self.blend.as_ref(),
+            budget: self.budget.as_ref(),
             processes_to_execute,
             scenarios_to_execute,
             external_processes_to_observe: vec![],
+            env: vec![],
+            variables: self.variables.clone(),
+            shuffle_seed: None,
+            label: None,
+            project: self.project.clone(),
         })
     }
 
@@ -123,116 +442,2840 @@ impl Config {
         let scenarios_to_execute = self.collect_scenarios_to_execute(name)?;
 
         Ok(ExecutionPlan {
+            config_source: &self.source,
+            cpu: self.cpu.as_ref(),
+            power_sources: &self.power_sources,
+            metrics_sources: &self.metrics_sources,
+            hosts: &self.hosts,
+            container_runtime: self.container_runtime,
+            container_stats: self.container_stats,
+            cpu_accounting: self.cpu_accounting,
+            sample_interval: self.sample_interval(),
+            parallelism: self.parallelism.unwrap_or(1),
+            baseline: self.baseline.as_ref(),
+            checks: &self.checks,
+            pinning: self.pinning.as_ref(),
+            prometheus: self.prometheus.as_ref(),
+            otlp: self.otlp.as_ref(),
+            carbon: self.carbon.as_ref(),
+            blend: self.blend.as_ref(),
+            budget: self.budget.as_ref(),
             processes_to_execute: vec![],
             scenarios_to_execute,
             external_processes_to_observe: vec![],
+            env: vec![],
+            variables: self.variables.clone(),
+            shuffle_seed: None,
+            label: None,
+            project: self.project.clone(),
+        })
+    }
+
+    /// Finds a scenario to compare in an A/B run, if there's no scenario with the given name it's
+    /// run as a command observing every configured process.
+    ///
+    /// # Arguments
+    /// * label - the name of the scenario if a command is given, e.g. `base`
+    /// * scenario_or_command - the name of a scenario or the command to run
+    ///
+    /// # Returns
+    /// The name of the scenario to compare
+    pub fn scenario_or_command(&mut self, label: &str, scenario_or_command: &str) -> String {
+        if self.find_scenario(scenario_or_command).is_some() {
+            return String::from(scenario_or_command);
+        }
+
+        // the command replaces any scenario already using the label as its name
+        self.scenarios.retain(|scenario| scenario.name != label);
+        self.scenarios.push(Scenario {
+            name: String::from(label),
+            desc: format!("A/B {label}"),
+            command: Some(String::from(scenario_or_command)),
+            replay: None,
+            container: None,
+            iterations: 1,
+            processes: self
+                .processes
+                .iter()
+                .map(|proc| proc.name.clone())
+                .collect(),
+            timeout: None,
+            stop_signal: StopSignal::default(),
+            kill_grace_period: default_kill_grace_period(),
+            warmup: None,
+            cooldown: None,
+            before: None,
+            after: None,
+            on_failure: OnFailure::default(),
+            start: Start::default(),
+            retries: None,
+            depends_on: vec![],
+            tags: vec![],
+            budget: None,
+            functional_unit: None,
+            max_regression_pct: None,
+            cgroup: false,
+        });
+        String::from(label)
+    }
+
+    /// A plan which runs two scenarios alternately, A, B, A, B and so on, so they're compared
+    /// under the same conditions rather than one after the other.
+    ///
+    /// # Arguments
+    /// * base - the name of the scenario being compared against
+    /// * candidate - the name of the scenario being compared
+    /// * iterations - how many times each scenario runs
+    /// * external_only - don't start any processes, only observe those which are already running
+    pub fn create_ab_plan(
+        &self,
+        base: &str,
+        candidate: &str,
+        iterations: u32,
+        external_only: bool,
+    ) -> anyhow::Result<ExecutionPlan> {
+        if base == candidate {
+            return Err(anyhow!(
+                "The base and candidate must be different scenarios"
+            ));
+        }
+        let base = self
+            .find_scenario(base)
+            .context(format!("Unable to find scenario with name: {base}"))?;
+        let candidate = self
+            .find_scenario(candidate)
+            .context(format!("Unable to find scenario with name: {candidate}"))?;
+
+        let mut scenarios_to_execute = vec![];
+        for i in 0..iterations {
+            scenarios_to_execute.push(ScenarioToExecute::new(base, i));
+            scenarios_to_execute.push(ScenarioToExecute::new(candidate, i));
+        }
+        let processes_to_execute = if external_only {
+            vec![]
+        } else {
+            self.collect_processes(&scenarios_to_execute)?
+        };
+
+        Ok(ExecutionPlan {
+            config_source: &self.source,
+            cpu: self.cpu.as_ref(),
+            power_sources: &self.power_sources,
+            metrics_sources: &self.metrics_sources,
+            hosts: &self.hosts,
+            container_runtime: self.container_runtime,
+            container_stats: self.container_stats,
+            cpu_accounting: self.cpu_accounting,
+            sample_interval: self.sample_interval(),
+            parallelism: 1,
+            baseline: self.baseline.as_ref(),
+            checks: &self.checks,
+            pinning: self.pinning.as_ref(),
+            prometheus: self.prometheus.as_ref(),
+            otlp: self.otlp.as_ref(),
+            carbon: self.carbon.as_ref(),
+            blend: self.blend.as_ref(),
+            budget: self.budget.as_ref(),
+            processes_to_execute,
+            scenarios_to_execute,
+            external_processes_to_observe: vec![],
+            env: vec![],
+            variables: self.variables.clone(),
+            shuffle_seed: None,
+            label: None,
+            project: self.project.clone(),
         })
     }
+
+    /// A plan for metering the application without running any scenarios, every configured
+    /// process is started and observed.
+    ///
+    /// # Arguments
+    /// * external_only - don't start any processes, only observe those which are already running
+    pub fn create_observe_plan(&self, external_only: bool) -> ExecutionPlan {
+        let processes_to_execute = if external_only {
+            vec![]
+        } else {
+            self.processes.iter().collect()
+        };
+
+        ExecutionPlan {
+            config_source: &self.source,
+            cpu: self.cpu.as_ref(),
+            power_sources: &self.power_sources,
+            metrics_sources: &self.metrics_sources,
+            hosts: &self.hosts,
+            container_runtime: self.container_runtime,
+            container_stats: self.container_stats,
+            cpu_accounting: self.cpu_accounting,
+            sample_interval: self.sample_interval(),
+            parallelism: 1,
+            baseline: None,
+            checks: &self.checks,
+            pinning: self.pinning.as_ref(),
+            prometheus: self.prometheus.as_ref(),
+            otlp: self.otlp.as_ref(),
+            carbon: self.carbon.as_ref(),
+            blend: self.blend.as_ref(),
+            budget: None,
+            processes_to_execute,
+            scenarios_to_execute: vec![],
+            external_processes_to_observe: vec![],
+            env: vec![],
+            variables: self.variables.clone(),
+            shuffle_seed: None,
+            label: None,
+            project: self.project.clone(),
+        }
+    }
+}
+
+/// The CPU the software is being measured on. Used by the TDP power model to estimate energy
+/// consumption from CPU utilisation. If the TDP isn't given cardamon will attempt to detect it.
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct Cpu {
+    pub name: Option<String>,
+    pub tdp: Option<f64>,
+    /// The logical processors of the host when cardamon runs in WSL2, the TDP is scaled by the
+    /// share of them the VM can use. Windows is asked if it isn't given.
+    pub host_processors: Option<u32>,
 }
 
+/// Confidence in each energy source, used when both a model estimate and a direct measurement
+/// are available for the same process. The weights are relative to each other and don't need to
+/// sum to 1.
 #[derive(Debug, Deserialize, PartialEq, Clone, Copy)]
-#[serde(tag = "to", rename_all = "lowercase")]
-pub enum Redirect {
-    Null,
-    Parent,
-    File,
+pub struct Blend {
+    pub estimate_confidence: f64,
+    pub measurement_confidence: f64,
+}
+impl Blend {
+    fn validate(&self) -> anyhow::Result<()> {
+        let weights = [self.estimate_confidence, self.measurement_confidence];
+        if weights.iter().any(|w| !w.is_finite() || *w < 0.0) {
+            return Err(anyhow!("Blend confidences must be positive numbers."));
+        }
+        if weights.iter().sum::<f64>() == 0.0 {
+            return Err(anyhow!(
+                "At least one blend confidence must be greater than 0."
+            ));
+        }
+        Ok(())
+    }
+
+    /// Normalises the confidences so they sum to 1.
+    ///
+    /// # Returns
+    /// A tuple containing the estimate weight and the measurement weight
+    pub fn weights(&self) -> (f64, f64) {
+        let total = self.estimate_confidence + self.measurement_confidence;
+        (
+            self.estimate_confidence / total,
+            self.measurement_confidence / total,
+        )
+    }
 }
 
+/// Used to convert energy into carbon. Operational carbon comes from the electricity used while
+/// the software runs, embodied carbon comes from manufacturing the hardware it runs on.
 #[derive(Debug, Deserialize, PartialEq)]
-pub struct Scenario {
-    pub name: String,
-    pub desc: String,
-    pub command: String,
-    pub iterations: u32,
-    pub processes: Vec<String>,
+pub struct Carbon {
+    /// grams of CO2e emitted per kWh of electricity
+    pub intensity: Option<f64>,
+    /// A country code whose annual average intensity is used if `intensity` isn't set, see
+    /// [carbon::region_intensity].
+    pub region: Option<String>,
+    /// The intensity of each hour of the day in UTC, used over `intensity` and `region` for runs
+    /// starting in that hour.
+    pub hourly: Option<Vec<f64>>,
+    /// The Power Usage Effectiveness of the datacentre, its total energy over the energy of its
+    /// machines. The machine's energy is multiplied by it to include cooling and other overhead.
+    pub pue: Option<f64>,
+    pub embodied: Option<Embodied>,
+    /// Where to look up the intensity of the grid when a run starts, it's used over `intensity`
+    /// unless the lookup fails.
+    pub grid: Option<Grid>,
 }
-impl Scenario {
-    fn build_scenarios_to_execute(&self) -> Vec<ScenarioToExecute> {
-        let mut scenarios_to_execute = vec![];
-        for i in 0..self.iterations {
-            let scenario_to_exec = ScenarioToExecute::new(self, i);
-            scenarios_to_execute.push(scenario_to_exec);
+
+impl Carbon {
+    fn validate(&self) -> anyhow::Result<()> {
+        if let Some(embodied) = &self.embodied {
+            embodied.validate()?;
         }
-        scenarios_to_execute
+        if let Some(region) = &self.region {
+            if carbon::region_intensity(region).is_none() {
+                return Err(anyhow!("Unknown carbon intensity region {}.", region));
+            }
+        }
+        if let Some(hourly) = &self.hourly {
+            if hourly.len() != 24 {
+                return Err(anyhow!(
+                    "An hourly carbon intensity needs a value for each of the 24 hours."
+                ));
+            }
+        }
+        if self.pue.is_some_and(|pue| !(pue.is_finite() && pue >= 1.0)) {
+            return Err(anyhow!("PUE must be at least 1."));
+        }
+        let intensities = self.intensity.iter().chain(self.hourly.iter().flatten());
+        if intensities.into_iter().any(|i| !i.is_finite() || *i < 0.0) {
+            return Err(anyhow!("Carbon intensity must be a positive number."));
+        }
+        Ok(())
+    }
+
+    /// The intensity configured for a run, which doesn't look up the grid so it can be used
+    /// without a network connection.
+    ///
+    /// # Arguments
+    /// * start_time - when the run started in milliseconds since the unix epoch
+    ///
+    /// # Returns
+    /// The grams of CO2e per kWh and where they came from, None if no intensity is configured
+    pub fn static_intensity(&self, start_time: i64) -> Option<(f64, String)> {
+        if let Some(hourly) = &self.hourly {
+            let hour = chrono::DateTime::from_timestamp_millis(start_time)?.hour() as usize;
+            return hourly
+                .get(hour)
+                .map(|intensity| (*intensity, format!("hourly profile {hour:02}:00 UTC")));
+        }
+        if let Some(intensity) = self.intensity {
+            return Some((intensity, String::from("config")));
+        }
+        let region = self.region.as_ref()?;
+        carbon::region_intensity(region).map(|intensity| (intensity, format!("region {region}")))
     }
 }
 
-#[derive(Debug, Deserialize, PartialEq)]
-#[serde(tag = "type", rename_all = "lowercase")]
-pub enum ProcessType {
-    BareMetal,
-    Docker { containers: Vec<String> },
+/// The price of electricity, used to report what each scenario costs to run.
+#[derive(Debug, Deserialize, PartialEq, Clone)]
+pub struct Cost {
+    /// The price of a kWh of electricity.
+    pub price_per_kwh: Option<f64>,
+    /// The price of a kWh in each hour of the day in UTC for time-of-use tariffs, used over
+    /// `price_per_kwh` for iterations starting in that hour.
+    pub hourly: Option<Vec<f64>>,
+    /// Shown with costs, e.g. `EUR`.
+    #[serde(default = "default_currency")]
+    pub currency: String,
+}
+fn default_currency() -> String {
+    String::from("EUR")
 }
 
-#[derive(Debug, Deserialize, PartialEq)]
-pub struct ProcessToExecute {
-    pub name: String,
-    pub up: String,
-    pub down: Option<String>,
-    pub redirect: Option<Redirect>,
-    pub process: ProcessType,
+impl Cost {
+    fn validate(&self) -> anyhow::Result<()> {
+        match &self.hourly {
+            Some(hourly) if hourly.len() != 24 => {
+                return Err(anyhow!(
+                    "An hourly electricity price needs a value for each of the 24 hours."
+                ));
+            }
+            None if self.price_per_kwh.is_none() => {
+                return Err(anyhow!("Cost needs a price_per_kwh or hourly prices."));
+            }
+            _ => {}
+        }
+        let prices = self
+            .price_per_kwh
+            .iter()
+            .chain(self.hourly.iter().flatten());
+        if prices.into_iter().any(|p| !p.is_finite() || *p < 0.0) {
+            return Err(anyhow!("Electricity prices must be positive numbers."));
+        }
+        Ok(())
+    }
+
+    /// # Arguments
+    /// * time - when the electricity was used in milliseconds since the unix epoch
+    ///
+    /// # Returns
+    /// The price of a kWh at the time, None if there's no price for it
+    pub fn price_per_kwh(&self, time: i64) -> Option<f64> {
+        match &self.hourly {
+            Some(hourly) => {
+                let hour = chrono::DateTime::from_timestamp_millis(time)?.hour() as usize;
+                hourly.get(hour).copied()
+            }
+            None => self.price_per_kwh,
+        }
+    }
 }
 
-#[derive(Debug, Clone)]
-pub enum ProcessToObserve {
-    Pid(Option<String>, u32),
-    ContainerName(String),
+/// The parts of a config used by every command, see [`Config::global_from_path`].
+#[derive(Debug, Deserialize, PartialEq, Default)]
+pub struct GlobalConfig {
+    #[serde(default)]
+    pub units: Units,
+    pub project: Option<String>,
+    pub database: Option<Database>,
+    pub retention: Option<Retention>,
+    pub server: Option<Server>,
+    pub sync: Option<ObjectStorage>,
 }
 
-#[derive(Debug)]
-pub struct ScenarioToExecute<'a> {
-    pub scenario: &'a Scenario,
-    pub iteration: u32,
+/// A database shared by many machines, e.g. CI runners, so their runs can be compared. The url
+/// is read from `$CARDAMON_DATABASE_URL` if it isn't set, so the password isn't saved with the
+/// run's config.
+#[derive(Debug, Deserialize, PartialEq, Clone)]
+pub struct Database {
+    /// e.g. `postgres://cardamon@db.internal/cardamon`, or `sqlite://cardamon.db` for the
+    /// local database
+    pub url: Option<String>,
+    /// The most connections kept open to the database, defaults to 4.
+    pub max_connections: Option<u32>,
 }
-impl<'a> ScenarioToExecute<'a> {
-    fn new(scenario: &'a Scenario, iteration: u32) -> Self {
-        Self {
-            scenario,
-            iteration,
+impl Database {
+    pub fn validate(&self) -> anyhow::Result<()> {
+        if self.max_connections == Some(0) {
+            return Err(anyhow!("max_connections must be at least 1."));
+        }
+        if let Some(url) = &self.url {
+            DatabaseBackend::of(url)?;
+        }
+        Ok(())
+    }
+
+    /// # Returns
+    /// The configured url, otherwise the one in `$CARDAMON_DATABASE_URL`
+    pub fn url(&self) -> anyhow::Result<String> {
+        match &self.url {
+            Some(url) => Ok(url.clone()),
+            None => std::env::var("CARDAMON_DATABASE_URL")
+                .context("The database needs a url or $CARDAMON_DATABASE_URL."),
         }
     }
+
+    pub fn max_connections(&self) -> u32 {
+        self.max_connections.unwrap_or(4)
+    }
 }
 
-#[derive(Debug, Deserialize)]
-pub struct Observation {
-    pub name: String,
-    pub scenarios: Vec<String>,
+/// How long the samples of runs are kept before `cardamon prune` deletes them. A run is pruned
+/// once it's outside every limit, i.e. it's older than `older_than` and isn't one of the last
+/// `keep_last` runs. Runs can be downsampled before then, so only recent runs keep every sample.
+/// Downsampling also happens after every `cardamon run` and scheduled run, pruning only happens
+/// when `cardamon prune` is run.
+#[derive(Debug, Deserialize, PartialEq, Clone, Default)]
+pub struct Retention {
+    /// Keep the samples of this many of the latest runs of each project.
+    pub keep_last: Option<usize>,
+    /// Keep the samples of runs started less than this long ago, e.g. `90d`.
+    #[serde(default, with = "humantime_serde")]
+    pub older_than: Option<Duration>,
+    /// Keep each pruned run and the energy of its iterations, so it can still be reported on and
+    /// compared. Defaults to true, otherwise the whole run is deleted.
+    pub keep_summaries: Option<bool>,
+    /// Replace the samples of runs started longer ago than this with averages, e.g. `7d`. The
+    /// averages are saved zstd compressed in a single row per run.
+    #[serde(default, with = "humantime_serde")]
+    pub downsample_after: Option<Duration>,
+    /// How long each average of a downsampled run covers, defaults to `1m`.
+    #[serde(default, with = "humantime_serde")]
+    pub downsample_to: Option<Duration>,
+}
+impl Retention {
+    pub fn validate(&self) -> anyhow::Result<()> {
+        if self.keep_last.is_none() && self.older_than.is_none() && self.downsample_after.is_none()
+        {
+            return Err(anyhow!(
+                "Retention needs keep_last, older_than or downsample_after."
+            ));
+        }
+        if self.keep_last == Some(0) {
+            return Err(anyhow!("keep_last must be at least 1."));
+        }
+        if self.downsample_to.is_some() && self.downsample_after.is_none() {
+            return Err(anyhow!("downsample_to is only used with downsample_after."));
+        }
+        if self
+            .downsample_to
+            .is_some_and(|interval| interval.as_millis() == 0)
+        {
+            return Err(anyhow!("downsample_to must be at least 1ms."));
+        }
+        Ok(())
+    }
+
+    pub fn keep_summaries(&self) -> bool {
+        self.keep_summaries.unwrap_or(true)
+    }
+
+    /// # Returns
+    /// How long each average of a downsampled run covers in milliseconds
+    pub fn downsample_interval(&self) -> i64 {
+        self.downsample_to
+            .map_or(60_000, |interval| interval.as_millis() as i64)
+    }
 }
 
-#[derive(Debug)]
-pub struct ExecutionPlan<'a> {
-    pub processes_to_execute: Vec<&'a ProcessToExecute>,
-    pub scenarios_to_execute: Vec<ScenarioToExecute<'a>>,
-    pub external_processes_to_observe: Vec<ProcessToObserve>,
+/// Object storage every run is uploaded to once it finishes, see [crate::sync]. Credentials are
+/// read from the standard `AWS_` environment variables.
+#[derive(Debug, Deserialize, PartialEq, Clone)]
+pub struct ObjectStorage {
+    /// e.g. `s3://ci-reports/cardamon`
+    pub to: String,
 }
-impl<'a> ExecutionPlan<'a> {
-    pub fn scenario_names(&self) -> Vec<&str> {
-        self.scenarios_to_execute
-            .iter()
-            .map(|x| x.scenario.name.as_str())
-            .collect()
+impl ObjectStorage {
+    pub fn destination(&self) -> anyhow::Result<crate::sync::Destination> {
+        crate::sync::Destination::parse(&self.to)
     }
+}
 
-    /// Adds a process that has not been started by Cardamon to this execution plan for observation.
-    ///
-    /// # Arguments
-    /// * process_to_observe - A process which has been started externally to Cardamon.
-    pub fn observe_external_process(&mut self, process_to_observe: ProcessToObserve) {
-        self.external_processes_to_observe.push(process_to_observe);
+/// Who can use `cardamon server` and `cardamon ui`. Without tokens anyone who can reach the port
+/// can read and push runs.
+#[derive(Debug, Deserialize, PartialEq, Clone, Default)]
+pub struct Server {
+    #[serde(default)]
+    pub tokens: Vec<ApiToken>,
+}
+impl Server {
+    pub fn validate(&self) -> anyhow::Result<()> {
+        for (i, token) in self.tokens.iter().enumerate() {
+            if token.name.is_empty() || token.env.is_empty() {
+                return Err(anyhow!("Tokens need a name and env."));
+            }
+            if self.tokens[..i]
+                .iter()
+                .any(|other| other.name == token.name)
+            {
+                return Err(anyhow!("There's more than one token named {}.", token.name));
+            }
+        }
+        Ok(())
     }
 }
 
-#[cfg(test)]
-mod tests {
-    use itertools::Itertools;
+/// A token clients send as `Authorization: Bearer <token>`, or as the password of HTTP basic auth
+/// from a browser.
+#[derive(Debug, Deserialize, PartialEq, Clone)]
+pub struct ApiToken {
+    /// Who the token was given to, e.g. `ci`, logged with the requests made with it.
+    pub name: String,
+    /// The environment variable the token is read from, so it isn't saved with the config of
+    /// every run.
+    pub env: String,
+    #[serde(default)]
+    pub scope: TokenScope,
+}
+impl ApiToken {
+    /// # Returns
+    /// The token, an error if its environment variable isn't set
+    pub fn secret(&self) -> anyhow::Result<String> {
+        std::env::var(&self.env).context(format!(
+            "Token {} is read from ${} which isn't set.",
+            self.name, self.env
+        ))
+    }
+}
 
-    use super::*;
-    use std::path::Path;
+/// What a token may do, a write token can also read.
+#[derive(Debug, Deserialize, PartialEq, Eq, PartialOrd, Ord, Clone, Copy, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum TokenScope {
+    /// Query runs and browse the dashboard.
+    #[default]
+    Read,
+    /// Push runs too.
+    Write,
+}
 
-    #[test]
-    fn can_load_config_file() -> anyhow::Result<()> {
-        let cfg = Config::from_path(Path::new("./fixtures/cardamon.success.toml"))?;
-        assert_eq!(cfg.debug_level, Some("info".to_string()));
+#[derive(Debug, PartialEq, Clone, Copy)]
+pub enum DatabaseBackend {
+    Sqlite,
+    Postgres,
+}
+impl DatabaseBackend {
+    /// # Returns
+    /// The database the url is for, by its scheme
+    pub fn of(url: &str) -> anyhow::Result<Self> {
+        match url.split_once(':').map(|(scheme, _)| scheme) {
+            Some("sqlite") => Ok(DatabaseBackend::Sqlite),
+            Some("postgres" | "postgresql") => Ok(DatabaseBackend::Postgres),
+            // the url isn't repeated as it could have a password in it
+            _ => Err(anyhow!(
+                "Database urls must start with postgres:// or sqlite://."
+            )),
+        }
+    }
+}
+
+/// A service reporting the live carbon intensity of the electricity grid. Credentials left out
+/// here are read from the environment so they aren't saved with the run's config.
+#[derive(Debug, Deserialize, PartialEq, Clone)]
+#[serde(tag = "provider", rename_all = "lowercase")]
+pub enum Grid {
+    /// https://www.electricitymaps.com, `$ELECTRICITYMAPS_API_KEY` if there's no api_key.
+    ElectricityMaps {
+        api_key: Option<String>,
+        /// e.g. `GB` or `US-CAL-CISO`
+        zone: String,
+    },
+    /// https://watttime.org, `$WATTTIME_PASSWORD` if there's no password.
+    WattTime {
+        username: String,
+        password: Option<String>,
+        /// The WattTime region, e.g. `CAISO_NORTH`
+        zone: String,
+    },
+}
+
+/// Used to estimate the energy of moving data over the network, which is spent in routers,
+/// switches and access networks outside the machine rather than by the machine itself.
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct Network {
+    /// kWh used per GB transferred, estimates range from around 0.06 for fixed broadband down to
+    /// 0.01 or less for data centre networks
+    pub kwh_per_gb: f64,
+}
+impl Network {
+    fn validate(&self) -> anyhow::Result<()> {
+        if !self.kwh_per_gb.is_finite() || self.kwh_per_gb < 0.0 {
+            return Err(anyhow!("Network kwh_per_gb must be a positive number."));
+        }
+        Ok(())
+    }
+}
+
+/// The kind of device the observed processes read from and write to.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum StorageDevice {
+    #[default]
+    Ssd,
+    Hdd,
+}
+
+/// Used to estimate the energy of storage I/O. Each device has default coefficients which can be
+/// overridden with figures from the drive's spec sheet.
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct Storage {
+    #[serde(default)]
+    pub device: StorageDevice,
+    /// joules used per GB read or written
+    pub joules_per_gb: Option<f64>,
+    /// joules used per read or write operation
+    pub joules_per_op: Option<f64>,
+}
+impl Storage {
+    /// An SSD draws a few watts while transferring at hundreds of MB/s and has no seek cost. An
+    /// HDD draws slightly more at a fraction of the throughput and spins for every random access.
+    ///
+    /// # Returns
+    /// The joules used per GB and per operation
+    pub fn coefficients(&self) -> (f64, f64) {
+        let (joules_per_gb, joules_per_op) = match self.device {
+            StorageDevice::Ssd => (10.0, 0.00005),
+            StorageDevice::Hdd => (45.0, 0.06),
+        };
+        (
+            self.joules_per_gb.unwrap_or(joules_per_gb),
+            self.joules_per_op.unwrap_or(joules_per_op),
+        )
+    }
+
+    fn validate(&self) -> anyhow::Result<()> {
+        let (joules_per_gb, joules_per_op) = self.coefficients();
+        if !joules_per_gb.is_finite() || joules_per_gb < 0.0 {
+            return Err(anyhow!("Storage joules_per_gb must be a positive number."));
+        }
+        if !joules_per_op.is_finite() || joules_per_op < 0.0 {
+            return Err(anyhow!("Storage joules_per_op must be a positive number."));
+        }
+        Ok(())
+    }
+}
+
+/// The embodied carbon of the hardware. A share of it is attributed to each run in proportion to
+/// the run's wall-clock time against the expected lifetime of the hardware, and to the share of
+/// the hardware the software has to itself.
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct Embodied {
+    /// kgCO2e emitted manufacturing the hardware
+    pub carbon: f64,
+    #[serde(with = "humantime_serde")]
+    pub lifetime: Duration,
+    /// The share of the hardware reserved for the software, e.g. 0.25 for a VM with 4 of a
+    /// server's 16 cores. Defaults to all of it.
+    pub share: Option<f64>,
+}
+impl Embodied {
+    fn validate(&self) -> anyhow::Result<()> {
+        if !self.carbon.is_finite() || self.carbon < 0.0 {
+            return Err(anyhow!("Embodied carbon must be a positive number."));
+        }
+        if self.lifetime.is_zero() {
+            return Err(anyhow!("Hardware lifetime must be greater than 0."));
+        }
+        if self
+            .share
+            .is_some_and(|share| !(share.is_finite() && share > 0.0 && share <= 1.0))
+        {
+            return Err(anyhow!(
+                "Embodied share must be greater than 0 and at most 1."
+            ));
+        }
+        Ok(())
+    }
+}
+
+/// Measures the idle power of the machine and the observed processes once the processes have
+/// started and before the first scenario runs. Subtracting it from each scenario leaves the
+/// energy the scenario itself caused.
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct Baseline {
+    #[serde(with = "humantime_serde")]
+    pub duration: Duration,
+}
+impl Baseline {
+    fn validate(&self) -> anyhow::Result<()> {
+        if self.duration < Duration::from_secs(1) {
+            return Err(anyhow!("Baseline duration must be at least 1s."));
+        }
+        Ok(())
+    }
+}
+
+/// Pins cardamon and the processes it measures to separate CPUs so the collector and the
+/// operating system don't compete with the workload. CPUs are lists such as `0-3,6`.
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct Pinning {
+    /// The CPUs cardamon runs on.
+    pub cardamon: Option<String>,
+    /// The CPUs baremetal processes run on unless they set their own.
+    pub processes: Option<String>,
+}
+impl Pinning {
+    fn validate(&self) -> anyhow::Result<()> {
+        let cardamon = self
+            .cardamon
+            .as_deref()
+            .map(pinning::parse_cpus)
+            .transpose()
+            .context("Invalid cardamon cpus.")?;
+        let processes = self
+            .processes
+            .as_deref()
+            .map(pinning::parse_cpus)
+            .transpose()
+            .context("Invalid processes cpus.")?;
+        if let (Some(cardamon), Some(processes)) = (cardamon, processes) {
+            if cardamon.iter().any(|cpu| processes.contains(cpu)) {
+                return Err(anyhow!(
+                    "Cardamon and the processes share CPUs, they should be pinned to separate ones."
+                ));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Serves the live power and energy of the processes on `/metrics` while a run is in progress,
+/// so Prometheus can scrape them, and streams them along with the progress of the run over a
+/// WebSocket on `/live`.
+#[derive(Debug, Deserialize, PartialEq, Default)]
+pub struct Prometheus {
+    pub port: Option<u16>,
+}
+impl Prometheus {
+    pub fn port(&self) -> u16 {
+        self.port.unwrap_or(exporter::DEFAULT_PORT)
+    }
+}
+
+/// Pushes the power and energy of every scenario iteration to an OpenTelemetry collector.
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct Otlp {
+    /// The collector's OTLP/HTTP endpoint, e.g. `http://localhost:4318`.
+    pub endpoint: String,
+    /// Headers sent with every push, e.g. an API key.
+    #[serde(default)]
+    pub headers: BTreeMap<String, String>,
+}
+
+/// What the machine should look like before a run starts. Each check is skipped if it can't be
+/// read on this machine, e.g. AC power on a desktop. Without `[checks]` the defaults are used and
+/// failed checks are warnings.
+#[derive(Debug, Deserialize, PartialEq, Default)]
+pub struct Checks {
+    /// The CPU frequency governor every core should use, defaults to performance.
+    pub governor: Option<String>,
+    /// Whether turbo boost should be on, not checked unless it's set.
+    pub turbo: Option<bool>,
+    /// The highest 1 minute load average per core, defaults to 0.2.
+    pub max_load: Option<f64>,
+    /// Whether a laptop should be plugged in, defaults to true.
+    pub ac_power: Option<bool>,
+    /// Refuse to run if a check fails rather than warn.
+    #[serde(default)]
+    pub strict: bool,
+}
+impl Checks {
+    fn validate(&self) -> anyhow::Result<()> {
+        if self
+            .max_load
+            .is_some_and(|max_load| !(max_load.is_finite() && max_load >= 0.0))
+        {
+            return Err(anyhow!("max_load can't be negative."));
+        }
+        Ok(())
+    }
+
+    pub fn governor(&self) -> &str {
+        self.governor.as_deref().unwrap_or("performance")
+    }
+
+    pub fn max_load(&self) -> f64 {
+        self.max_load.unwrap_or(0.2)
+    }
+
+    pub fn ac_power(&self) -> bool {
+        self.ac_power.unwrap_or(true)
+    }
+}
+
+/// A ceiling on the energy or power of each iteration of a scenario, estimated while it runs from
+/// the CPU usage of the observed processes with the TDP power model. An iteration which goes over
+/// it is stopped and saved as over budget, then the observation moves on.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy)]
+pub struct Budget {
+    pub joules: Option<f64>,
+    pub watts: Option<f64>,
+}
+impl Budget {
+    fn validate(&self) -> anyhow::Result<()> {
+        if self.joules.is_none() && self.watts.is_none() {
+            return Err(anyhow!("A budget needs joules or watts."));
+        }
+        let positive = |limit: Option<f64>| limit.map_or(true, |l| l.is_finite() && l > 0.0);
+        if !positive(self.joules) || !positive(self.watts) {
+            return Err(anyhow!("Budgets must be greater than 0."));
+        }
+        Ok(())
+    }
+}
+
+/// What a scenario does for its users, e.g. serve requests or run jobs, so its carbon can be
+/// reported per unit as a Software Carbon Intensity (SCI) score.
+#[derive(Debug, Deserialize, PartialEq, Clone)]
+pub struct FunctionalUnit {
+    /// What's counted, e.g. `request`.
+    pub name: String,
+    /// How many units each iteration serves. Without it the scenario reports the count itself by
+    /// writing it to the file named by `CARDAMON_FUNCTIONAL_UNITS` or printing a
+    /// `CARDAMON_FUNCTIONAL_UNITS=<count>` line, scenarios which replay a trace count the requests
+    /// which succeed.
+    pub count: Option<f64>,
+}
+impl FunctionalUnit {
+    fn validate(&self) -> anyhow::Result<()> {
+        if self.name.trim().is_empty() {
+            return Err(anyhow!("A functional unit needs a name."));
+        }
+        if self
+            .count
+            .is_some_and(|count| !(count.is_finite() && count > 0.0))
+        {
+            return Err(anyhow!("Functional unit count must be greater than 0."));
+        }
+        Ok(())
+    }
+}
+
+/// Something which measures power rather than estimating it from each process's CPU usage. Power
+/// sources are read throughout every scenario and the measured power is attributed to the
+/// observed processes.
+#[derive(Debug, Deserialize, PartialEq, Clone)]
+#[serde(tag = "type", rename_all = "lowercase")]
+pub enum PowerSource {
+    /// The RAPL energy counters of Intel and AMD CPUs, attributed to processes by their CPU share.
+    Rapl {
+        #[serde(default)]
+        interface: RaplInterface,
+    },
+
+    /// The power draw of NVIDIA GPUs read through NVML, attributed to bare metal processes by
+    /// their share of each GPU. Needs the `nvml` feature, which is on by default.
+    Nvml,
+
+    /// The power draw of AMD GPUs on ROCm systems, attributed to bare metal processes by the time
+    /// they kept each GPU busy.
+    Rocm {
+        #[serde(default)]
+        interface: RocmInterface,
+    },
+
+    /// The CPU, GPU and Neural Engine power of Apple Silicon Macs reported by `powermetrics`,
+    /// attributed to processes by their CPU share.
+    Powermetrics,
+
+    /// Whole machine power read from the BMC with `ipmitool dcmi power reading`, attributed to
+    /// processes by their CPU share.
+    Ipmi {
+        /// The BMC to query over the network, the local BMC is used if not given.
+        host: Option<String>,
+        username: Option<String>,
+        /// Read from the `IPMI_PASSWORD` environment variable if not given.
+        password: Option<String>,
+    },
+
+    /// Whole machine power read from the BMC's Redfish API, attributed to processes by their CPU
+    /// share.
+    Redfish {
+        /// The BMC's base url, e.g. `https://10.0.0.2`.
+        url: String,
+        username: Option<String>,
+        password: Option<String>,
+        #[serde(default = "default_redfish_chassis")]
+        chassis: String,
+        /// Accept the self-signed certificates BMCs usually ship with.
+        #[serde(default)]
+        insecure: bool,
+    },
+
+    /// Wall power read from a smart plug or external power meter on the local network,
+    /// attributed to processes by their CPU share.
+    Meter { device: MeterDevice, host: String },
+
+    /// Per pod power exported to Prometheus by Kepler, for measuring services running in a
+    /// Kubernetes cluster. Each selected pod is reported as a process of its own.
+    Kepler {
+        /// The base url of the Prometheus server Kepler exports to.
+        url: String,
+        namespace: Option<String>,
+        /// A regex matched against pod names.
+        pod: Option<String>,
+    },
+
+    /// Whole board power of an ARM board worked out from the utilisation of all its cores with a
+    /// built-in power curve, for boards without power telemetry. Attributed to processes by their
+    /// CPU share.
+    Board { model: Board },
+
+    /// The power of every rail of a Raspberry Pi 5's PMIC read with `vcgencmd pmic_read_adc`,
+    /// attributed to processes by their CPU share. Peripherals powered over USB aren't included.
+    Pmic,
+
+    /// The discharge rate of a laptop's batteries, attributed to processes by their CPU share.
+    /// The laptop has to be unplugged for the whole run.
+    Battery,
+}
+
+/// ARM boards with a built-in utilisation to power curve.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy)]
+#[serde(rename_all = "kebab-case")]
+pub enum Board {
+    RaspberryPi4,
+    RaspberryPi5,
+    JetsonNano,
+    JetsonOrinNano,
+}
+impl Board {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Board::RaspberryPi4 => "raspberry-pi-4",
+            Board::RaspberryPi5 => "raspberry-pi-5",
+            Board::JetsonNano => "jetson-nano",
+            Board::JetsonOrinNano => "jetson-orin-nano",
+        }
+    }
+}
+
+fn default_redfish_chassis() -> String {
+    String::from("1")
+}
+
+/// How RAPL counters are read. The powercap sysfs interface is preferred, reading the MSRs
+/// directly requires the msr kernel module.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum RaplInterface {
+    #[default]
+    Powercap,
+    Msr,
+}
+
+/// How AMD GPU power is read. The amdgpu hwmon sysfs interface is preferred, `rocm-smi` is
+/// available for systems where hwmon doesn't report power.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum RocmInterface {
+    #[default]
+    Hwmon,
+    #[serde(rename = "rocm-smi")]
+    RocmSmi,
+}
+
+/// Somewhere cardamon can read metrics which are already being collected, instead of observing
+/// processes itself.
+#[derive(Debug, Deserialize, PartialEq, Clone)]
+#[serde(tag = "type", rename_all = "lowercase")]
+pub enum MetricsSource {
+    /// Queries run against a Prometheus server once a second.
+    Prometheus {
+        /// The base url of the Prometheus server, e.g. `http://localhost:9090`.
+        url: String,
+        queries: Vec<PrometheusQuery>,
+    },
+    /// A `cardamon agent` running on another host, e.g. the database server of a system which
+    /// spans several machines. The agent observes processes on its own host and streams their
+    /// metrics back, they're stored in the same run with process ids prefixed by the host. Both
+    /// hosts' clocks should be kept in sync, e.g. with NTP.
+    Agent {
+        /// Identifies the host in the run, e.g. `db`.
+        host: String,
+        /// The base url of the agent, e.g. `http://10.0.0.12:7420`. Agents only listen on
+        /// localhost unless they're started with `--bind`.
+        url: String,
+        /// Regexes matching the names of processes to observe.
+        #[serde(default)]
+        names: Vec<String>,
+        /// TCP ports of processes to observe.
+        #[serde(default)]
+        ports: Vec<u16>,
+        /// Names of containers to observe.
+        #[serde(default)]
+        containers: Vec<String>,
+        sample_interval_ms: Option<u64>,
+    },
+}
+impl MetricsSource {
+    fn validate(&self) -> anyhow::Result<()> {
+        match self {
+            MetricsSource::Prometheus { .. } => Ok(()),
+            MetricsSource::Agent {
+                host,
+                names,
+                ports,
+                containers,
+                sample_interval_ms,
+                ..
+            } => {
+                if names.is_empty() && ports.is_empty() && containers.is_empty() {
+                    return Err(anyhow!(
+                        "Agent {host} needs at least one of names, ports or containers to observe."
+                    ));
+                }
+                for name in names.iter() {
+                    regex::Regex::new(name)
+                        .context(format!("Agent {host} has an invalid name regex."))?;
+                }
+                validate_sample_interval(*sample_interval_ms)
+                    .context(format!("Agent {host} has an invalid sample_interval_ms."))
+            }
+        }
+    }
+}
+
+/// A host cardamon logs into over SSH to observe processes, for machines where nothing can be
+/// installed. Processes are stored in the run with their ids prefixed by the host's name.
+#[derive(Debug, Deserialize, PartialEq, Clone)]
+pub struct Host {
+    /// Identifies the host in the run, e.g. `db`.
+    pub name: String,
+    /// The ssh destination, e.g. `deploy@10.0.0.12` or a host from the ssh config. Logging in
+    /// can't prompt for a password.
+    pub ssh: String,
+    /// Regexes matching the names of processes to observe.
+    pub processes: Vec<String>,
+    pub sample_interval_ms: Option<u64>,
+}
+impl Host {
+    fn validate(&self) -> anyhow::Result<()> {
+        if self.processes.is_empty() {
+            return Err(anyhow!("Host {} has no processes to observe.", self.name));
+        }
+        for pattern in self.processes.iter() {
+            regex::Regex::new(pattern)
+                .context(format!("Host {} has an invalid process regex.", self.name))?;
+        }
+        validate_sample_interval(self.sample_interval_ms).context(format!(
+            "Host {} has an invalid sample_interval_ms.",
+            self.name
+        ))
+    }
+
+    /// # Returns
+    /// How often the host is sampled
+    pub fn sample_interval(&self) -> Duration {
+        Duration::from_millis(
+            self.sample_interval_ms
+                .unwrap_or(DEFAULT_SAMPLE_INTERVAL_MS),
+        )
+    }
+}
+
+/// A PromQL query and the metric each series in its result is logged as.
+#[derive(Debug, Deserialize, PartialEq, Clone)]
+pub struct PrometheusQuery {
+    pub query: String,
+    pub field: PrometheusField,
+    /// The label identifying the process each series belongs to. Required for `cpu_usage`,
+    /// power without a process is attributed to processes by their CPU share.
+    pub process: Option<String>,
+    /// The component power is measured for, defaults to the whole machine.
+    pub component: Option<PowerComponent>,
+    /// The number of cores `cpu_usage` is a percentage of, as with docker stats 100% is one core.
+    #[serde(default = "default_core_count")]
+    pub core_count: i32,
+}
+
+fn default_core_count() -> i32 {
+    1
+}
+
+/// The metric a Prometheus query gives.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy)]
+#[serde(rename_all = "snake_case")]
+pub enum PrometheusField {
+    /// CPU usage as a percentage of a single core.
+    CpuUsage,
+    /// Power in watts.
+    Power,
+}
+
+/// The smart plugs and power meters which can be read as a power source.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy)]
+#[serde(rename_all = "lowercase")]
+pub enum MeterDevice {
+    Tasmota,
+    Shelly,
+    /// TP-Link Kasa plugs with energy monitoring, e.g. the KP115 or HS110.
+    Kasa,
+}
+impl MeterDevice {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            MeterDevice::Tasmota => "tasmota",
+            MeterDevice::Shelly => "shelly",
+            MeterDevice::Kasa => "kasa",
+        }
+    }
+}
+
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy)]
+#[serde(tag = "to", rename_all = "lowercase")]
+pub enum Redirect {
+    Null,
+    Parent,
+    File,
+}
+
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct Scenario {
+    pub name: String,
+    pub desc: String,
+    pub command: Option<String>,
+    pub replay: Option<Replay>,
+    pub container: Option<ScenarioContainer>,
+    pub iterations: u32,
+    pub processes: Vec<String>,
+    #[serde(default, with = "humantime_serde")]
+    pub timeout: Option<Duration>,
+    #[serde(default)]
+    pub stop_signal: StopSignal,
+    #[serde(default = "default_kill_grace_period", with = "humantime_serde")]
+    pub kill_grace_period: Duration,
+    /// How long the scenario runs before it's measured, so the time spent warming up caches and
+    /// JIT compilers isn't included.
+    #[serde(default, with = "humantime_serde")]
+    pub warmup: Option<Duration>,
+    /// How long to keep measuring once the scenario has finished, so work it leaves behind such
+    /// as garbage collection and flushing writes is included.
+    #[serde(default, with = "humantime_serde")]
+    pub cooldown: Option<Duration>,
+    /// Run before every iteration before it's measured, e.g. to seed a database or clear caches.
+    pub before: Option<String>,
+    /// Run after every iteration once it's been measured, e.g. to truncate tables.
+    pub after: Option<String>,
+    #[serde(default)]
+    pub on_failure: OnFailure,
+    #[serde(default)]
+    pub start: Start,
+    /// How many times a failed iteration is run again when `on_failure` is retry, defaults to 1.
+    pub retries: Option<u32>,
+    /// Scenarios which have to finish every iteration before this one starts. They're run
+    /// first even if they're not part of the observation.
+    #[serde(default)]
+    pub depends_on: Vec<String>,
+    /// Labels used to run a subset of the scenarios, e.g. `--tags api,!slow`.
+    #[serde(default)]
+    pub tags: Vec<String>,
+    pub budget: Option<Budget>,
+    pub functional_unit: Option<FunctionalUnit>,
+    /// How much more energy than the baseline run the scenario can use, as a percentage, before
+    /// `cardamon run --check` fails.
+    pub max_regression_pct: Option<f64>,
+    /// Runs the command in a cgroup of its own with `systemd-run` and observes the whole cgroup
+    /// as part of the scenario, e.g. headless browsers which detach from the command. Everything
+    /// left in the cgroup is stopped once the scenario has finished.
+    #[serde(default)]
+    pub cgroup: bool,
+}
+impl Scenario {
+    fn validate(&self) -> anyhow::Result<()> {
+        match (&self.command, &self.replay) {
+            (Some(_), Some(_)) => Err(anyhow!(
+                "Scenario {} has both a command and a replay, only one is allowed.",
+                self.name
+            )),
+            (None, None) => Err(anyhow!(
+                "Scenario {} must have either a command or a replay.",
+                self.name
+            )),
+            (None, Some(replay)) if !(replay.speed.is_finite() && replay.speed > 0.0) => {
+                Err(anyhow!(
+                    "Replay speed of scenario {} must be greater than 0.",
+                    self.name
+                ))
+            }
+            _ if self.retries.is_some() && self.on_failure != OnFailure::Retry => Err(anyhow!(
+                "Scenario {} has retries but on_failure isn't retry.",
+                self.name
+            )),
+            (None, Some(_)) if self.cgroup => Err(anyhow!(
+                "Scenario {} can only use cgroup with a command.",
+                self.name
+            )),
+            _ => Ok(()),
+        }
+    }
+
+    /// # Returns
+    /// How many times a failed iteration of the scenario is run again
+    /// A cold scenario restarts its processes, so every process cardamon starts for it needs a
+    /// down command to stop it.
+    fn validate_start(&self, processes: &[ProcessToExecute]) -> anyhow::Result<()> {
+        if self.start == Start::Warm {
+            return Ok(());
+        }
+        let unstoppable = processes.iter().find(|proc| {
+            self.processes.contains(&proc.name) && proc.up.is_some() && proc.down.is_none()
+        });
+        match unstoppable {
+            Some(proc) => Err(anyhow!(
+                "Scenario {} starts cold but process {} has no down command to stop it.",
+                self.name,
+                proc.name
+            )),
+            None => Ok(()),
+        }
+    }
+
+    pub fn max_retries(&self) -> u32 {
+        match self.on_failure {
+            OnFailure::Retry => self.retries.unwrap_or(1),
+            _ => 0,
+        }
+    }
+
+    fn build_scenarios_to_execute(&self) -> Vec<ScenarioToExecute> {
+        let mut scenarios_to_execute = vec![];
+        for i in 0..self.iterations {
+            let scenario_to_exec = ScenarioToExecute::new(self, i);
+            scenarios_to_execute.push(scenario_to_exec);
+        }
+        scenarios_to_execute
+    }
+}
+
+/// Selects scenarios by their tags. A scenario is selected if it has any of the included tags, or
+/// there aren't any, and none of the excluded tags.
+#[derive(Debug, Default, PartialEq)]
+pub struct TagFilter {
+    include: Vec<String>,
+    exclude: Vec<String>,
+}
+impl TagFilter {
+    /// # Arguments
+    /// * tags - the tags to include, tags starting with `!` are excluded
+    pub fn new(tags: &[String]) -> Self {
+        let (exclude, include): (Vec<_>, Vec<_>) = tags
+            .iter()
+            .map(|tag| tag.trim())
+            .filter(|tag| !tag.is_empty())
+            .partition(|tag| tag.starts_with('!'));
+        Self {
+            include: include.into_iter().map(String::from).collect(),
+            exclude: exclude
+                .into_iter()
+                .map(|tag| String::from(&tag[1..]))
+                .collect(),
+        }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.include.is_empty() && self.exclude.is_empty()
+    }
+
+    pub fn matches(&self, scenario: &Scenario) -> bool {
+        (self.include.is_empty() || self.include.iter().any(|tag| scenario.tags.contains(tag)))
+            && !self.exclude.iter().any(|tag| scenario.tags.contains(tag))
+    }
+}
+
+/// Drives a scenario by replaying a recorded HTTP trace instead of running a command. The trace
+/// can be a HAR file or a request log with one `<offset ms> <METHOD> <URL>` per line.
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct Replay {
+    pub trace: String,
+    /// Replaces the scheme and host of every request in the trace, e.g. `http://localhost:8080`.
+    pub base_url: Option<String>,
+    /// How much faster than recorded to replay requests, 2.0 halves the gaps between requests.
+    #[serde(default = "default_replay_speed")]
+    pub speed: f64,
+}
+
+fn default_replay_speed() -> f64 {
+    1.0
+}
+
+/// A container which cardamon creates, starts and stops for every iteration of a scenario so
+/// that the energy of its full lifecycle, including cold start and shutdown, is attributed to
+/// the scenario. The scenario's command or replay is run once the container has started.
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct ScenarioContainer {
+    pub image: String,
+    pub cmd: Option<Vec<String>>,
+    /// Environment variables in the form `KEY=value`.
+    #[serde(default)]
+    pub env: Vec<String>,
+    /// Ports to publish in the form `host:container`, e.g. `8080:80`.
+    #[serde(default)]
+    pub ports: Vec<String>,
+    /// How long the container is given to stop before it's killed.
+    #[serde(default = "default_container_stop_timeout", with = "humantime_serde")]
+    pub stop_timeout: Duration,
+}
+
+fn default_container_stop_timeout() -> Duration {
+    Duration::from_secs(10)
+}
+
+fn default_kill_grace_period() -> Duration {
+    Duration::from_secs(10)
+}
+
+/// The signal sent to a scenario's process group when it exceeds its timeout. If the scenario is
+/// still running after the kill grace period it is sent SIGKILL.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default)]
+#[serde(rename_all = "UPPERCASE")]
+pub enum StopSignal {
+    #[default]
+    Sigterm,
+    Sigint,
+    Sighup,
+    Sigquit,
+    Sigkill,
+}
+
+/// What happens to the rest of an observation when an iteration of a scenario fails or times
+/// out. A failed iteration is saved with its output and exit code for `cardamon logs`, but not
+/// its metrics so it's left out of the stats.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum OnFailure {
+    /// Stop the application and give up on the rest of the observation, the run is saved as
+    /// aborted with the iterations which ran before it.
+    #[default]
+    Abort,
+    /// Carry on with the next iteration.
+    Continue,
+    /// Run the iteration again up to `retries` times, carrying on if every attempt fails.
+    Retry,
+}
+
+/// Whether the processes of a scenario keep running between its iterations. Serverless style
+/// workloads use very different amounts of energy starting up than once they're running.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum Start {
+    /// The processes are started once and keep running between iterations.
+    #[default]
+    Warm,
+    /// The processes are restarted before every iteration, their down command is run and then
+    /// their up command.
+    Cold,
+}
+
+/// The container engine which runs `docker` processes and scenario containers. Both are reached
+/// through the Docker API, Podman serves a compatible API from its REST socket. Containerd has no
+/// Docker API so its containers are found with `nerdctl` and measured through their cgroups, it
+/// can only observe containers and can't run scenario containers.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default, clap::ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub enum ContainerRuntime {
+    #[default]
+    Docker,
+    Podman,
+    Containerd,
+}
+
+/// Where the CPU usage of docker and podman containers is read from. The engine's stats API
+/// needs nothing extra on the host, reading the container's cgroup directly is cheaper and
+/// doesn't depend on the engine computing usage. Containerd is always read from cgroups.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum ContainerStats {
+    #[default]
+    Api,
+    Cgroup,
+}
+
+/// How the CPU usage of baremetal processes is measured. Sampling `/proc` works everywhere but
+/// misses bursts between samples and processes which exit before they're sampled. `ebpf`
+/// accounts every time slice from scheduler events, it needs Linux, `bpftrace` and root. On
+/// Windows `proc` samples the CPU time Windows keeps for each process; attributing it from ETW
+/// events, like `ebpf` does on Linux, isn't supported yet.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum CpuAccounting {
+    #[default]
+    Proc,
+    Ebpf,
+}
+
+#[derive(Debug, Deserialize, PartialEq)]
+#[serde(tag = "type", rename_all = "lowercase")]
+pub enum ProcessType {
+    BareMetal,
+    /// Containers started by the process's `up` command. If none are listed and the command runs
+    /// compose, every container of the compose project is observed, including any added by
+    /// scaling a service during a scenario.
+    Docker {
+        #[serde(default)]
+        containers: Vec<String>,
+        project: Option<String>,
+    },
+    /// Pods matching a label selector, resolved once the process's `up` command has run.
+    K8s {
+        namespace: Option<String>,
+        selector: String,
+    },
+}
+
+/// How the lines of an access log are written.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum AccessLogFormat {
+    /// The common or combined log format of Apache and nginx, timestamps are to the second.
+    #[default]
+    Combined,
+    /// A JSON object per line, as written by most structured loggers.
+    Json,
+}
+
+/// A log of the requests a process served, the energy of the process is apportioned between the
+/// routes in it.
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct AccessLog {
+    pub path: String,
+    #[serde(default)]
+    pub format: AccessLogFormat,
+    /// The field of a JSON line with the time of the request, an RFC 3339 string or milliseconds
+    /// since the unix epoch. Defaults to `time`.
+    pub time_field: Option<String>,
+    /// Defaults to `method`.
+    pub method_field: Option<String>,
+    /// Defaults to `path`.
+    pub path_field: Option<String>,
+    /// The field of a JSON line with how long the request took in milliseconds, its energy is
+    /// spread over that time. Defaults to `duration_ms`.
+    pub duration_field: Option<String>,
+}
+
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct ProcessToExecute {
+    pub name: String,
+    /// The command which starts the process, None if it's already running.
+    pub up: Option<String>,
+    pub down: Option<String>,
+    pub redirect: Option<Redirect>,
+    pub process: ProcessType,
+    /// A regex matched against the names of running processes. Matching processes are observed
+    /// as well as any started by `up`, and matches are refreshed every sample so restarted
+    /// daemons keep being measured.
+    pub match_name: Option<String>,
+    /// A TCP port, the process listening on it is observed. The listener is looked up again if
+    /// it exits so servers restarted during a scenario keep being measured.
+    pub match_port: Option<u16>,
+    /// How often the process is sampled, overrides the global `sample_interval_ms`.
+    pub sample_interval_ms: Option<u64>,
+    /// Runs `up` in a cgroup of its own with `systemd-run` and observes the whole cgroup, so
+    /// daemons and double forked children which leave the process tree are still measured. The
+    /// whole cgroup is stopped when the process is.
+    #[serde(default)]
+    pub cgroup: bool,
+    /// The CPUs the process runs on, e.g. `2-3`, overrides `processes` in `[pinning]`.
+    pub cpus: Option<String>,
+    pub access_log: Option<AccessLog>,
+}
+impl ProcessToExecute {
+    /// # Arguments
+    /// * default - the interval used if the process doesn't set its own
+    ///
+    /// # Returns
+    /// How often the process is sampled
+    pub fn sample_interval(&self, default: Duration) -> Duration {
+        self.sample_interval_ms
+            .map(Duration::from_millis)
+            .unwrap_or(default)
+    }
+
+    fn validate(&self) -> anyhow::Result<()> {
+        validate_sample_interval(self.sample_interval_ms).context(format!(
+            "Process {} has an invalid sample_interval_ms.",
+            self.name
+        ))?;
+        if self.up.is_none() && self.match_name.is_none() && self.match_port.is_none() {
+            return Err(anyhow!(
+                "Process {} needs an up command, a match_name or a match_port to observe.",
+                self.name
+            ));
+        }
+        if self.cgroup && (self.up.is_none() || self.process != ProcessType::BareMetal) {
+            return Err(anyhow!(
+                "Process {} can only use cgroup with baremetal processes which have an up command.",
+                self.name
+            ));
+        }
+        if let Some(cpus) = &self.cpus {
+            if self.process != ProcessType::BareMetal {
+                return Err(anyhow!(
+                    "Process {} can only use cpus with baremetal processes, pin containers with \
+                     cpuset in their compose file or pod spec.",
+                    self.name
+                ));
+            }
+            pinning::parse_cpus(cpus).context(format!(
+                "Process {} has an invalid list of cpus.",
+                self.name
+            ))?;
+        }
+        if self.match_port.is_some() && self.process != ProcessType::BareMetal {
+            return Err(anyhow!(
+                "Process {} can only use match_port with baremetal processes.",
+                self.name
+            ));
+        }
+        if let Some(match_name) = &self.match_name {
+            if self.process != ProcessType::BareMetal {
+                return Err(anyhow!(
+                    "Process {} can only use match_name with baremetal processes.",
+                    self.name
+                ));
+            }
+            regex::Regex::new(match_name)
+                .context(format!("Process {} has an invalid match_name.", self.name))?;
+        }
+        Ok(())
+    }
+}
+
+/// Processes are sampled every second unless configured otherwise.
+pub const DEFAULT_SAMPLE_INTERVAL_MS: u64 = 1000;
+
+/// CPU usage is worked out from the CPU time used between samples, sysinfo can't work it out over
+/// shorter intervals.
+const MIN_SAMPLE_INTERVAL_MS: u64 = 200;
+
+/// Converts a glob, where `*` matches any characters and `?` matches one, into a regex matching
+/// whole names.
+fn glob_regex(glob: &str) -> anyhow::Result<regex::Regex> {
+    let pattern = regex::escape(glob).replace(r"\*", ".*").replace(r"\?", ".");
+    regex::Regex::new(&format!("^{pattern}$")).context(format!("Invalid pattern: {glob}"))
+}
+
+fn validate_sample_interval(sample_interval_ms: Option<u64>) -> anyhow::Result<()> {
+    match sample_interval_ms {
+        Some(ms) if ms < MIN_SAMPLE_INTERVAL_MS => Err(anyhow!(
+            "Processes can't be sampled more often than every {MIN_SAMPLE_INTERVAL_MS} ms, got {ms} ms."
+        )),
+        _ => Ok(()),
+    }
+}
+
+#[derive(Debug, Clone)]
+pub enum ProcessToObserve {
+    Pid(Option<String>, u32),
+    /// A process started in a cgroup of its own, everything in the cgroup is observed.
+    Cgroup(Scope),
+    ContainerName(String),
+    /// Every container of a compose project, discovered while logging.
+    ComposeProject(String),
+    /// Every process with a name matching the regex, resolved while logging.
+    NameMatch(String),
+    /// The process listening on a TCP port, resolved while logging.
+    PortMatch(u16),
+    Pod(Pod),
+}
+
+#[derive(Debug)]
+pub struct ScenarioToExecute<'a> {
+    pub scenario: &'a Scenario,
+    pub iteration: u32,
+    /// The name results are saved under, the scenario's name labelled with the matrix values it
+    /// runs with, e.g. `checkout[NODE_ENV=prod,WORKERS=4]`.
+    pub name: String,
+}
+impl<'a> ScenarioToExecute<'a> {
+    fn new(scenario: &'a Scenario, iteration: u32) -> Self {
+        Self {
+            scenario,
+            iteration,
+            name: scenario.name.clone(),
+        }
+    }
+}
+
+#[derive(Debug, Deserialize)]
+pub struct Observation {
+    pub name: String,
+    pub scenarios: Vec<String>,
+    /// Environment variables and the values to run the observation with, the observation is run
+    /// once for every combination of values.
+    #[serde(default)]
+    pub matrix: BTreeMap<String, Vec<String>>,
+    /// A cron expression, e.g. `0 2 * * *`, the observation is run on it by `cardamon schedule`.
+    pub schedule: Option<String>,
+}
+
+#[derive(Debug)]
+pub struct ExecutionPlan<'a> {
+    pub config_source: &'a str,
+    pub cpu: Option<&'a Cpu>,
+    pub power_sources: &'a [PowerSource],
+    pub metrics_sources: &'a [MetricsSource],
+    pub hosts: &'a [Host],
+    pub container_runtime: ContainerRuntime,
+    pub container_stats: ContainerStats,
+    pub cpu_accounting: CpuAccounting,
+    /// How often processes are sampled unless the process sets its own interval.
+    pub sample_interval: Duration,
+    /// How many scenarios can run at the same time.
+    pub parallelism: usize,
+    pub baseline: Option<&'a Baseline>,
+    pub checks: &'a Checks,
+    pub pinning: Option<&'a Pinning>,
+    pub prometheus: Option<&'a Prometheus>,
+    pub otlp: Option<&'a Otlp>,
+    pub carbon: Option<&'a Carbon>,
+    pub blend: Option<&'a Blend>,
+    pub budget: Option<&'a Budget>,
+    pub processes_to_execute: Vec<&'a ProcessToExecute>,
+    pub scenarios_to_execute: Vec<ScenarioToExecute<'a>>,
+    pub external_processes_to_observe: Vec<ProcessToObserve>,
+    /// Environment variables of the matrix combination the plan runs with, they're set for the
+    /// processes, scenarios and hooks.
+    pub env: Vec<(String, String)>,
+    /// Values of the placeholders in commands, see [crate::template::render].
+    pub variables: BTreeMap<String, String>,
+    /// The seed the scenarios were shuffled with, None if they run in the order they're
+    /// configured.
+    pub shuffle_seed: Option<u64>,
+    /// The name the run is saved with, e.g. the branch it measured.
+    pub label: Option<String>,
+    pub project: Option<String>,
+}
+impl<'a> ExecutionPlan<'a> {
+    pub fn scenario_names(&self) -> Vec<&str> {
+        self.scenarios_to_execute
+            .iter()
+            .map(|x| x.name.as_str())
+            .collect()
+    }
+
+    /// # Returns
+    /// The CPUs the process is pinned to, None if it isn't pinned
+    pub fn cpus_for(&self, proc: &'a ProcessToExecute) -> Option<&'a str> {
+        if proc.process != ProcessType::BareMetal {
+            return None;
+        }
+        proc.cpus.as_deref().or(self
+            .pinning
+            .and_then(|pinning| pinning.processes.as_deref()))
+    }
+
+    /// # Returns
+    /// The budget of the scenario, or the budget of every scenario if it doesn't have one
+    pub fn budget_for(&self, scenario: &'a Scenario) -> Option<&'a Budget> {
+        scenario.budget.as_ref().or(self.budget)
+    }
+
+    /// # Arguments
+    /// * scenario_to_execute - the iteration about to run
+    ///
+    /// # Returns
+    /// The variables of the plan along with the scenario's name and the number of the iteration
+    pub fn scenario_variables(
+        &self,
+        scenario_to_execute: &ScenarioToExecute,
+    ) -> BTreeMap<String, String> {
+        let mut variables = self.variables.clone();
+        variables
+            .entry(String::from("scenario"))
+            .or_insert(scenario_to_execute.name.clone());
+        variables
+            .entry(String::from("iteration"))
+            .or_insert((scenario_to_execute.iteration + 1).to_string());
+        variables
+    }
+
+    /// Sets a variable, replacing the value from the config.
+    ///
+    /// # Arguments
+    /// * name - the name of the variable
+    /// * value - its value
+    pub fn set_variable(&mut self, name: &str, value: &str) {
+        self.variables
+            .insert(String::from(name), String::from(value));
+    }
+
+    /// Only runs the scenarios selected by the tags, along with the scenarios they depend on.
+    /// Processes which are no longer needed by any scenario aren't started.
+    ///
+    /// # Arguments
+    /// * tags - selects the scenarios to run
+    pub fn filter_by_tags(&mut self, tags: &TagFilter) -> anyhow::Result<()> {
+        if tags.is_empty() {
+            return Ok(());
+        }
+
+        // scenarios come after their dependencies, so walking backwards finds every dependency
+        // of a selected scenario before the dependency itself
+        let mut needed: Vec<&str> = vec![];
+        let mut selected = vec![];
+        for scenario_to_execute in self.scenarios_to_execute.drain(..).rev() {
+            let scenario = scenario_to_execute.scenario;
+            if tags.matches(scenario) || needed.contains(&scenario.name.as_str()) {
+                needed.extend(scenario.depends_on.iter().map(String::as_str));
+                selected.push(scenario_to_execute);
+            }
+        }
+        selected.reverse();
+        if selected.is_empty() {
+            return Err(anyhow!("No scenarios match the tags {:?}", tags));
+        }
+
+        self.processes_to_execute.retain(|proc| {
+            selected
+                .iter()
+                .any(|s| s.scenario.processes.contains(&proc.name))
+        });
+        self.scenarios_to_execute = selected;
+        Ok(())
+    }
+
+    /// Runs the plan with a combination of matrix values, the scenarios are labelled with the
+    /// values so the results of each combination are kept apart.
+    ///
+    /// # Arguments
+    /// * env - the environment variables of the combination
+    pub fn apply_matrix(&mut self, env: Vec<(String, String)>) {
+        if !env.is_empty() {
+            let label = env
+                .iter()
+                .map(|(key, value)| format!("{key}={value}"))
+                .join(",");
+            for scenario_to_execute in self.scenarios_to_execute.iter_mut() {
+                scenario_to_execute.name =
+                    format!("{}[{label}]", scenario_to_execute.scenario.name);
+            }
+        }
+        self.env = env;
+    }
+
+    /// Groups the scenarios into waves which run one after another, the scenarios in a wave run
+    /// at the same time. Scenarios only share a wave if they observe separate processes, so the
+    /// usage of each process can be attributed to a single scenario. Iterations of a scenario run
+    /// in order and a scenario only starts once every iteration of the scenarios it depends on
+    /// has run. Externally started processes aren't tied to any scenario, so if there are any
+    /// every scenario runs on its own.
+    ///
+    /// # Returns
+    /// The waves of scenarios in the order they should run
+    pub fn waves(&self) -> Vec<Vec<&ScenarioToExecute<'a>>> {
+        let parallelism = if self.external_processes_to_observe.is_empty() {
+            self.parallelism.max(1)
+        } else {
+            1
+        };
+
+        let mut pending = self.scenarios_to_execute.iter().collect::<Vec<_>>();
+        let mut waves = vec![];
+        while !pending.is_empty() {
+            let mut wave: Vec<&ScenarioToExecute> = vec![];
+            let mut deferred = vec![];
+            for scenario_to_execute in pending.into_iter() {
+                let scenario = scenario_to_execute.scenario;
+                let fits = wave.len() < parallelism
+                    && !deferred
+                        .iter()
+                        .any(|s: &&ScenarioToExecute| s.scenario.name == scenario.name)
+                    && !wave
+                        .iter()
+                        .chain(deferred.iter())
+                        .any(|s| scenario.depends_on.contains(&s.scenario.name))
+                    && wave.iter().all(|s| {
+                        s.scenario.name != scenario.name
+                            && !s
+                                .scenario
+                                .processes
+                                .iter()
+                                .any(|proc| scenario.processes.contains(proc))
+                    });
+                if fits {
+                    wave.push(scenario_to_execute);
+                } else {
+                    deferred.push(scenario_to_execute);
+                }
+            }
+            waves.push(wave);
+            pending = deferred;
+        }
+        waves
+    }
+
+    /// Runs the scenarios one iteration at a time, each iteration in a random order. Scenarios
+    /// still run after the scenarios they depend on.
+    ///
+    /// # Arguments
+    /// * seed - the seed of the shuffle, the same seed gives the same order
+    pub fn shuffle(&mut self, seed: u64) {
+        let mut rounds: BTreeMap<u32, Vec<ScenarioToExecute<'a>>> = BTreeMap::new();
+        for scenario_to_execute in std::mem::take(&mut self.scenarios_to_execute) {
+            rounds
+                .entry(scenario_to_execute.iteration)
+                .or_default()
+                .push(scenario_to_execute);
+        }
+
+        let mut rng = shuffle::Rng::new(seed);
+        for (_, mut round) in rounds {
+            rng.shuffle(&mut round);
+            while !round.is_empty() {
+                let next = round
+                    .iter()
+                    .position(|s| {
+                        !round
+                            .iter()
+                            .any(|other| s.scenario.depends_on.contains(&other.scenario.name))
+                    })
+                    .unwrap_or(0);
+                self.scenarios_to_execute.push(round.remove(next));
+            }
+        }
+        self.shuffle_seed = Some(seed);
+    }
+
+    /// # Returns
+    /// The order the scenarios run in, one line per iteration, None if they weren't shuffled
+    pub fn scenario_order(&self) -> Option<String> {
+        self.shuffle_seed?;
+        let order = self
+            .scenarios_to_execute
+            .iter()
+            .chunk_by(|s| s.iteration)
+            .into_iter()
+            .map(|(_, round)| round.map(|s| s.name.as_str()).join(", "))
+            .join("\n");
+        Some(order)
+    }
+
+    /// Adds a process that has not been started by Cardamon to this execution plan for observation.
+    ///
+    /// # Arguments
+    /// * process_to_observe - A process which has been started externally to Cardamon.
+    pub fn observe_external_process(&mut self, process_to_observe: ProcessToObserve) {
+        self.external_processes_to_observe.push(process_to_observe);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use itertools::Itertools;
+
+    use super::*;
+    use std::path::Path;
+
+    #[test]
+    fn can_load_config_file() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.success.toml"))?;
+        assert_eq!(cfg.debug_level, Some("info".to_string()));
+        Ok(())
+    }
+
+    #[test]
+    fn can_load_blend_config() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.blend.toml"))?;
+        assert_eq!(cfg.cpu.and_then(|cpu| cpu.tdp), Some(15.0));
+
+        let blend = cfg.blend.expect("blend should be configured");
+        assert_eq!(blend.weights(), (0.25, 0.75));
+        Ok(())
+    }
+
+    #[test]
+    fn invalid_blend_confidences_are_rejected() {
+        let blend = Blend {
+            estimate_confidence: -1.0,
+            measurement_confidence: 2.0,
+        };
+        assert!(blend.validate().is_err());
+
+        let blend = Blend {
+            estimate_confidence: 0.0,
+            measurement_confidence: 0.0,
+        };
+        assert!(blend.validate().is_err());
+    }
+
+    #[test]
+    fn can_load_container_lifecycle_scenario() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.container.toml"))?;
+        assert_eq!(cfg.container_runtime, ContainerRuntime::Podman);
+        assert_eq!(cfg.container_stats, ContainerStats::Cgroup);
+        let scenario = cfg.find_scenario("cold_start").unwrap();
+
+        let container = scenario
+            .container
+            .as_ref()
+            .expect("container should be configured");
+        assert_eq!(container.image, "python:3-alpine");
+        assert_eq!(container.ports, ["8000:8000"]);
+        assert_eq!(container.env, ["PYTHONUNBUFFERED=1"]);
+        assert_eq!(container.stop_timeout, Duration::from_secs(10));
+        Ok(())
+    }
+
+    #[test]
+    fn can_load_replay_scenario() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.replay.toml"))?;
+        let scenario = cfg.find_scenario("production_traffic").unwrap();
+        assert_eq!(scenario.command, None);
+
+        let replay = scenario
+            .replay
+            .as_ref()
+            .expect("replay should be configured");
+        assert_eq!(replay.trace, "./fixtures/trace.log");
+        assert_eq!(replay.base_url.as_deref(), Some("http://localhost:8080"));
+        assert_eq!(replay.speed, 2.0);
+        assert!(scenario.validate().is_ok());
+
+        // only a command can be run in a cgroup
+        let scenario = Scenario {
+            cgroup: true,
+            ..toml::from_str(&format!(
+                "name = \"replay\"\ndesc = \"\"\niterations = 1\nprocesses = []\nreplay.trace = \"{}\"",
+                replay.trace
+            ))?
+        };
+        assert!(scenario.validate().is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn can_load_carbon_config() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.carbon.toml"))?;
+        let carbon = cfg.carbon.expect("carbon should be configured");
+        assert_eq!(carbon.intensity, Some(300.0));
+
+        let embodied = carbon
+            .embodied
+            .expect("embodied carbon should be configured");
+        assert_eq!(embodied.carbon, 1200.0);
+        assert_eq!(embodied.lifetime, Duration::from_secs(4 * 31_557_600));
+
+        let embodied = Embodied {
+            carbon: 1200.0,
+            lifetime: Duration::ZERO,
+            share: None,
+        };
+        assert!(embodied.validate().is_err());
+        let embodied = Embodied {
+            carbon: 1200.0,
+            lifetime: Duration::from_secs(1),
+            share: Some(1.5),
+        };
+        assert!(embodied.validate().is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn static_carbon_intensity_works_offline() -> anyhow::Result<()> {
+        let carbon = |toml: &str| toml::from_str::<Carbon>(toml);
+        let regional = carbon("region = \"gb\"")?;
+        regional.validate()?;
+        assert_eq!(
+            regional.static_intensity(0),
+            Some((238.0, String::from("region gb")))
+        );
+        assert!(carbon("region = \"atlantis\"")?.validate().is_err());
+
+        // the profile is used over the fixed intensity for the hour the run started in
+        let mut hourly = (0..24).map(|hour| (hour * 10).to_string()).join(", ");
+        let profiled = carbon(&format!("intensity = 300.0\nhourly = [{hourly}]"))?;
+        profiled.validate()?;
+        let half_past_two = (2 * 60 + 30) * 60 * 1000;
+        assert_eq!(
+            profiled.static_intensity(half_past_two),
+            Some((20.0, String::from("hourly profile 02:00 UTC")))
+        );
+
+        hourly.push_str(", 250");
+        assert!(carbon(&format!("hourly = [{hourly}]"))?.validate().is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn electricity_is_priced_by_the_hour_on_time_of_use_tariffs() -> anyhow::Result<()> {
+        let cost = |toml: &str| toml::from_str::<Cost>(toml);
+        let flat = cost("price_per_kwh = 0.25")?;
+        flat.validate()?;
+        assert_eq!(flat.price_per_kwh(0), Some(0.25));
+        assert_eq!(flat.currency, "EUR");
+
+        let hourly = (0..24)
+            .map(|hour| (hour as f64 / 100.0).to_string())
+            .join(", ");
+        let tariff = cost(&format!("hourly = [{hourly}]\ncurrency = \"GBP\""))?;
+        tariff.validate()?;
+        let half_past_two = (2 * 60 + 30) * 60 * 1000;
+        assert_eq!(tariff.price_per_kwh(half_past_two), Some(0.02));
+
+        assert!(cost("currency = \"EUR\"")?.validate().is_err());
+        assert!(cost("hourly = [0.1, 0.2]")?.validate().is_err());
+        assert!(cost("price_per_kwh = -1.0")?.validate().is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn runs_can_be_saved_to_a_shared_database() -> anyhow::Result<()> {
+        let global = toml::from_str::<GlobalConfig>(
+            "[database]\nurl = \"postgres://cardamon@db.internal/cardamon\"\n\n[[scenarios]]\nname = 1",
+        )?;
+        let database = global.database.expect("the database should be configured");
+        database.validate()?;
+        assert_eq!(
+            DatabaseBackend::of(&database.url()?)?,
+            DatabaseBackend::Postgres
+        );
+        assert_eq!(database.max_connections(), 4);
+        assert_eq!(global.units, Units::default());
+
+        assert_eq!(
+            DatabaseBackend::of("sqlite://cardamon.db")?,
+            DatabaseBackend::Sqlite
+        );
+        assert!(DatabaseBackend::of("mysql://db.internal/cardamon").is_err());
+        let no_connections = Database {
+            url: None,
+            max_connections: Some(0),
+        };
+        assert!(no_connections.validate().is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn runs_are_saved_under_the_project() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.success.toml"))?;
+        assert_eq!(cfg.project, None);
+
+        let cfg = cfg.with_project(Some(String::from("shop")));
+        let exec_plan = cfg.create_execution_plan("checkout")?;
+        assert_eq!(exec_plan.project.as_deref(), Some("shop"));
+        let cfg = cfg.with_project(None);
+        assert_eq!(cfg.project.as_deref(), Some("shop"));
+        Ok(())
+    }
+
+    #[test]
+    fn old_samples_are_pruned_by_the_retention_policy() -> anyhow::Result<()> {
+        let global = toml::from_str::<GlobalConfig>(
+            "[retention]\nkeep_last = 100\nolder_than = \"90d\"\n\n[[scenarios]]\nname = 1",
+        )?;
+        let retention = global.retention.expect("retention should be configured");
+        retention.validate()?;
+        assert_eq!(retention.keep_last, Some(100));
+        assert_eq!(
+            retention.older_than,
+            Some(Duration::from_secs(90 * 24 * 60 * 60))
+        );
+        assert!(retention.keep_summaries());
+
+        assert!(Retention::default().validate().is_err());
+        let keep_none = Retention {
+            keep_last: Some(0),
+            ..Retention::default()
+        };
+        assert!(keep_none.validate().is_err());
+
+        let global = toml::from_str::<GlobalConfig>(
+            "[retention]\ndownsample_after = \"7d\"\n\n[[scenarios]]\nname = 1",
+        )?;
+        let retention = global.retention.expect("retention should be configured");
+        retention.validate()?;
+        assert_eq!(retention.downsample_interval(), 60_000);
+        let downsample_only = Retention {
+            downsample_to: Some(Duration::from_secs(10)),
+            ..Retention::default()
+        };
+        assert!(downsample_only.validate().is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn server_tokens_are_read_from_the_environment() -> anyhow::Result<()> {
+        let global = toml::from_str::<GlobalConfig>(
+            "[[server.tokens]]\nname = \"ci\"\nenv = \"CARDAMON_TEST_CI_TOKEN\"\nscope = \"write\"\n\n[[server.tokens]]\nname = \"pm\"\nenv = \"CARDAMON_TEST_PM_TOKEN\"",
+        )?;
+        let server = global.server.expect("server should be configured");
+        server.validate()?;
+        assert_eq!(server.tokens[0].scope, TokenScope::Write);
+        assert_eq!(server.tokens[1].scope, TokenScope::Read);
+        assert!(TokenScope::Write > TokenScope::Read);
+        assert!(server.tokens[1]
+            .secret()
+            .is_err_and(|err| err.to_string().contains("$CARDAMON_TEST_PM_TOKEN")));
+
+        let duplicated = Server {
+            tokens: vec![server.tokens[0].clone(), server.tokens[0].clone()],
+        };
+        assert!(duplicated.validate().is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn can_load_io_config() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.io.toml"))?;
+        let network = cfg.network.expect("network should be configured");
+        assert_eq!(network.kwh_per_gb, 0.06);
+
+        let network = Network { kwh_per_gb: -1.0 };
+        assert!(network.validate().is_err());
+
+        let storage = cfg.storage.expect("storage should be configured");
+        assert_eq!(storage.device, StorageDevice::Hdd);
+        assert_eq!(storage.coefficients(), (45.0, 0.08));
+        Ok(())
+    }
+
+    #[test]
+    fn can_load_power_sources() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.power.toml"))?;
+        assert_eq!(
+            cfg.power_sources,
+            [
+                PowerSource::Rapl {
+                    interface: RaplInterface::Powercap
+                },
+                PowerSource::Rapl {
+                    interface: RaplInterface::Msr
+                },
+                PowerSource::Nvml,
+                PowerSource::Rocm {
+                    interface: RocmInterface::RocmSmi
+                },
+                PowerSource::Powermetrics,
+                PowerSource::Ipmi {
+                    host: None,
+                    username: None,
+                    password: None,
+                },
+                PowerSource::Redfish {
+                    url: String::from("https://10.0.0.2"),
+                    username: Some(String::from("admin")),
+                    password: Some(String::from("secret")),
+                    chassis: String::from("1"),
+                    insecure: true,
+                },
+                PowerSource::Meter {
+                    device: MeterDevice::Shelly,
+                    host: String::from("192.168.1.20"),
+                },
+                PowerSource::Kepler {
+                    url: String::from("http://prometheus.monitoring:9090"),
+                    namespace: Some(String::from("shop")),
+                    pod: Some(String::from("checkout-.*")),
+                },
+            ]
+        );
+
+        let exec_plan = cfg.create_execution_plan("checkout")?;
+        assert_eq!(exec_plan.power_sources.len(), 9);
+        assert_eq!(
+            exec_plan.baseline,
+            Some(&Baseline {
+                duration: Duration::from_secs(30)
+            })
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn can_attach_to_processes_by_name() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.attach.toml"))?;
+        assert_eq!(cfg.cpu_accounting, CpuAccounting::Ebpf);
+        let process = cfg.find_process("db").expect("process should exist");
+        assert_eq!(process.up, None);
+        assert_eq!(process.match_name.as_deref(), Some("postgres.*"));
+
+        let process = |up: Option<&str>, match_name: Option<&str>| ProcessToExecute {
+            name: String::from("db"),
+            up: up.map(String::from),
+            down: None,
+            redirect: None,
+            process: ProcessType::BareMetal,
+            match_name: match_name.map(String::from),
+            match_port: None,
+            sample_interval_ms: None,
+            cgroup: false,
+            cpus: None,
+            access_log: None,
+        };
+        assert!(process(None, None).validate().is_err());
+        assert!(process(None, Some("postgres(")).validate().is_err());
+        assert!(process(Some("pg_ctl start"), Some("postgres"))
+            .validate()
+            .is_ok());
+        Ok(())
+    }
+
+    #[test]
+    fn scenarios_with_separate_processes_run_in_parallel() -> anyhow::Result<()> {
+        let cfg = toml::from_str::<Config>(
+            r#"
+            parallelism = 2
+
+            [[scenarios]]
+            name = "checkout"
+            desc = ""
+            command = "sleep 1"
+            iterations = 2
+            processes = ["shop"]
+
+            [[scenarios]]
+            name = "search"
+            desc = ""
+            command = "sleep 1"
+            iterations = 1
+            processes = ["search"]
+
+            [[scenarios]]
+            name = "basket"
+            desc = ""
+            command = "sleep 1"
+            iterations = 1
+            processes = ["shop"]
+
+            [[observations]]
+            name = "nightly"
+            scenarios = ["checkout", "search", "basket"]
+            "#,
+        )?;
+        let exec_plan = cfg.create_execution_plan_external_only("nightly")?;
+
+        let waves = exec_plan
+            .waves()
+            .iter()
+            .map(|wave| {
+                wave.iter()
+                    .map(|s| (s.scenario.name.as_str(), s.iteration))
+                    .collect::<Vec<_>>()
+            })
+            .collect::<Vec<_>>();
+        assert_eq!(
+            waves,
+            vec![
+                vec![("checkout", 0), ("search", 0)],
+                vec![("checkout", 1)],
+                vec![("basket", 0)],
+            ]
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn dependencies_run_first_and_independent_branches_in_parallel() -> anyhow::Result<()> {
+        let cfg = toml::from_str::<Config>(
+            r#"
+            parallelism = 2
+
+            [[scenarios]]
+            name = "query-heavy"
+            desc = ""
+            command = "sleep 1"
+            iterations = 1
+            processes = ["db"]
+            depends_on = ["seed-data"]
+
+            [[scenarios]]
+            name = "seed-data"
+            desc = ""
+            command = "sleep 1"
+            iterations = 2
+            processes = ["db"]
+
+            [[scenarios]]
+            name = "search"
+            desc = ""
+            command = "sleep 1"
+            iterations = 1
+            processes = ["search"]
+
+            [[observations]]
+            name = "nightly"
+            scenarios = ["query-heavy", "search"]
+            "#,
+        )?;
+        let exec_plan = cfg.create_execution_plan_external_only("nightly")?;
+
+        let waves = exec_plan
+            .waves()
+            .iter()
+            .map(|wave| {
+                wave.iter()
+                    .map(|s| (s.scenario.name.as_str(), s.iteration))
+                    .collect::<Vec<_>>()
+            })
+            .collect::<Vec<_>>();
+        assert_eq!(
+            waves,
+            vec![
+                vec![("seed-data", 0), ("search", 0)],
+                vec![("seed-data", 1)],
+                vec![("query-heavy", 0)],
+            ]
+        );
+
+        let cfg = toml::from_str::<Config>(
+            r#"
+            [[scenarios]]
+            name = "a"
+            desc = ""
+            command = "sleep 1"
+            iterations = 1
+            processes = []
+            depends_on = ["b"]
+
+            [[scenarios]]
+            name = "b"
+            desc = ""
+            command = "sleep 1"
+            iterations = 1
+            processes = []
+            depends_on = ["a"]
+
+            [[observations]]
+            name = "cycle"
+            scenarios = ["a"]
+            "#,
+        )?;
+        assert!(cfg.create_execution_plan_external_only("cycle").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn scenarios_are_selected_by_tags() -> anyhow::Result<()> {
+        let cfg = toml::from_str::<Config>(
+            r#"
+            [[processes]]
+            name = "db"
+            up = "postgres"
+            process.type = "baremetal"
+
+            [[processes]]
+            name = "browser"
+            up = "chromium"
+            process.type = "baremetal"
+
+            [[scenarios]]
+            name = "seed-data"
+            desc = ""
+            command = "sleep 1"
+            iterations = 1
+            processes = ["db"]
+
+            [[scenarios]]
+            name = "query"
+            desc = ""
+            command = "sleep 1"
+            iterations = 1
+            processes = ["db"]
+            depends_on = ["seed-data"]
+            tags = ["api"]
+
+            [[scenarios]]
+            name = "report"
+            desc = ""
+            command = "sleep 1"
+            iterations = 1
+            processes = ["db"]
+            tags = ["api", "slow"]
+
+            [[scenarios]]
+            name = "checkout"
+            desc = ""
+            command = "sleep 1"
+            iterations = 1
+            processes = ["browser"]
+            tags = ["ui"]
+
+            [[observations]]
+            name = "all"
+            scenarios = ["query", "report", "checkout"]
+            "#,
+        )?;
+
+        let tags = TagFilter::new(&[String::from("api"), String::from("!slow")]);
+        let mut exec_plan = cfg.create_execution_plan("all")?;
+        exec_plan.filter_by_tags(&tags)?;
+        assert_eq!(exec_plan.scenario_names(), vec!["seed-data", "query"]);
+        assert_eq!(exec_plan.processes_to_execute.len(), 1);
+        assert_eq!(exec_plan.processes_to_execute[0].name, "db");
+
+        let mut exec_plan = cfg.create_execution_plan("all")?;
+        assert!(exec_plan
+            .filter_by_tags(&TagFilter::new(&[String::from("nope")]))
+            .is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn scenarios_are_selected_by_glob() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.multiple_scenarios.toml"))?;
+
+        let exec_plan = cfg.create_execution_plan("*_*")?;
+        assert_eq!(exec_plan.scenario_names(), vec!["basket_10", "user_signup"]);
+
+        let exec_plan = cfg.create_execution_plan("basket_1?")?;
+        assert_eq!(exec_plan.scenario_names(), vec!["basket_10"]);
+        assert_eq!(exec_plan.processes_to_execute.len(), 2);
+
+        assert!(cfg.create_execution_plan("signup-*").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn processes_are_pinned_to_their_cpus() -> anyhow::Result<()> {
+        let cfg = toml::from_str::<Config>(
+            r#"
+            [pinning]
+            cardamon = "0"
+            processes = "2-3"
+
+            [[processes]]
+            name = "api"
+            up = "node api.js"
+            process.type = "baremetal"
+
+            [[processes]]
+            name = "db"
+            up = "postgres"
+            cpus = "4"
+            process.type = "baremetal"
+
+            [[processes]]
+            name = "cache"
+            up = "docker compose up -d"
+            process.type = "docker"
+            process.containers = ["redis"]
+
+            [[scenarios]]
+            name = "checkout"
+            desc = ""
+            command = "sleep 1"
+            iterations = 1
+            processes = ["api", "db", "cache"]
+
+            [[observations]]
+            name = "all"
+            scenarios = ["checkout"]
+            "#,
+        )?;
+        cfg.pinning
+            .as_ref()
+            .map(|pinning| pinning.validate())
+            .transpose()?;
+
+        let exec_plan = cfg.create_execution_plan("checkout")?;
+        let cpus = |name: &str| {
+            cfg.find_process(name)
+                .and_then(|proc| exec_plan.cpus_for(proc))
+        };
+        assert_eq!(cpus("api"), Some("2-3"));
+        assert_eq!(cpus("db"), Some("4"));
+        assert_eq!(cpus("cache"), None);
+
+        let shared = Pinning {
+            cardamon: Some(String::from("0-2")),
+            processes: Some(String::from("2-3")),
+        };
+        assert!(shared.validate().is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn cold_scenarios_need_to_be_able_to_stop_their_processes() -> anyhow::Result<()> {
+        let cfg = toml::from_str::<Config>(
+            r#"
+            [[processes]]
+            name = "api"
+            up = "node api.js"
+            down = "kill {pid}"
+            process.type = "baremetal"
+
+            [[processes]]
+            name = "worker"
+            up = "node worker.js"
+            process.type = "baremetal"
+
+            [[scenarios]]
+            name = "cold-api"
+            desc = ""
+            command = "sleep 1"
+            iterations = 3
+            processes = ["api"]
+            start = "cold"
+
+            [[scenarios]]
+            name = "cold-worker"
+            desc = ""
+            command = "sleep 1"
+            iterations = 3
+            processes = ["worker"]
+            start = "cold"
+
+            [[scenarios]]
+            name = "warm-worker"
+            desc = ""
+            command = "sleep 1"
+            iterations = 3
+            processes = ["worker"]
+
+            [[observations]]
+            name = "all"
+            scenarios = ["cold-api"]
+            "#,
+        )?;
+
+        let validate = |name: &str| {
+            cfg.find_scenario(name)
+                .map(|scenario| scenario.validate_start(&cfg.processes))
+        };
+        assert!(validate("cold-api").is_some_and(|res| res.is_ok()));
+        assert!(validate("cold-worker").is_some_and(|res| res.is_err()));
+        assert!(validate("warm-worker").is_some_and(|res| res.is_ok()));
+        Ok(())
+    }
+
+    #[test]
+    fn ab_plans_alternate_the_base_and_candidate() -> anyhow::Result<()> {
+        let mut cfg = Config::from_path(Path::new("./fixtures/cardamon.multiple_scenarios.toml"))?;
+        let base = cfg.scenario_or_command("base", "basket_10");
+        let candidate = cfg.scenario_or_command("candidate", "sleep 2");
+        assert_eq!(base, "basket_10");
+        assert_eq!(candidate, "candidate");
+
+        let exec_plan = cfg.create_ab_plan(&base, &candidate, 2, false)?;
+        let order = exec_plan
+            .scenarios_to_execute
+            .iter()
+            .map(|s| (s.name.as_str(), s.iteration))
+            .collect_vec();
+        assert_eq!(
+            order,
+            vec![
+                ("basket_10", 0),
+                ("candidate", 0),
+                ("basket_10", 1),
+                ("candidate", 1)
+            ]
+        );
+        // the command observes every process
+        assert_eq!(exec_plan.processes_to_execute.len(), cfg.processes.len());
+
+        assert!(cfg.create_ab_plan(&base, &base, 2, false).is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn observe_plan_starts_every_process_without_scenarios() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.multiple_scenarios.toml"))?;
+
+        let exec_plan = cfg.create_observe_plan(false);
+        assert!(exec_plan.scenarios_to_execute.is_empty());
+        assert_eq!(exec_plan.processes_to_execute.len(), cfg.processes.len());
+
+        let exec_plan = cfg.create_observe_plan(true);
+        assert!(exec_plan.processes_to_execute.is_empty());
+        Ok(())
+    }
+
+    #[test]
+    fn shuffled_scenarios_run_one_iteration_at_a_time() -> anyhow::Result<()> {
+        let cfg = toml::from_str::<Config>(
+            r#"
+            shuffle = true
+
+            [[scenarios]]
+            name = "checkout"
+            desc = ""
+            command = "sleep 1"
+            iterations = 3
+            processes = []
+            depends_on = ["login"]
+
+            [[scenarios]]
+            name = "login"
+            desc = ""
+            command = "sleep 1"
+            iterations = 3
+            processes = []
+
+            [[scenarios]]
+            name = "search"
+            desc = ""
+            command = "sleep 1"
+            iterations = 2
+            processes = []
+
+            [[observations]]
+            name = "nightly"
+            scenarios = ["checkout", "search"]
+            "#,
+        )?;
+
+        let exec_plan = cfg.create_execution_plan_external_only("nightly")?;
+        assert_eq!(exec_plan.scenario_order(), None);
+
+        let shuffled = |seed| -> anyhow::Result<_> {
+            let mut exec_plan = cfg.create_execution_plan_external_only("nightly")?;
+            exec_plan.shuffle(seed);
+            Ok(exec_plan
+                .scenarios_to_execute
+                .iter()
+                .map(|s| (s.name.clone(), s.iteration))
+                .collect_vec())
+        };
+        for seed in 0..20 {
+            let order = shuffled(seed)?;
+            assert_eq!(order, shuffled(seed)?);
+            assert!(order.windows(2).all(|pair| pair[0].1 <= pair[1].1));
+            for iteration in 0..3 {
+                let position =
+                    |name: &str| order.iter().position(|s| s == &(name.into(), iteration));
+                assert!(position("login") < position("checkout"));
+            }
+        }
+        assert!((0..20).any(|seed| shuffled(seed).ok() != shuffled(0).ok()));
+
+        let mut exec_plan = cfg.create_execution_plan_external_only("nightly")?;
+        exec_plan.shuffle(7);
+        let order = exec_plan.scenario_order().unwrap_or_default();
+        assert_eq!(order.lines().count(), 3);
+        assert_eq!(
+            order.lines().last().map(|line| line.split(", ").count()),
+            Some(2)
+        );
+
+        Ok(())
+    }
+
+    #[test]
+    fn observations_run_for_every_matrix_combination() -> anyhow::Result<()> {
+        let cfg = toml::from_str::<Config>(
+            r#"
+            [[scenarios]]
+            name = "checkout"
+            desc = ""
+            command = "sleep 1"
+            iterations = 1
+            processes = []
+
+            [[observations]]
+            name = "tradeoffs"
+            scenarios = ["checkout"]
+            matrix = { WORKERS = ["1", "4"], NODE_ENV = ["dev", "prod"] }
+            "#,
+        )?;
+
+        let combinations = cfg.matrix_combinations("tradeoffs");
+        assert_eq!(combinations.len(), 4);
+        assert_eq!(
+            combinations[1],
+            vec![
+                (String::from("NODE_ENV"), String::from("dev")),
+                (String::from("WORKERS"), String::from("4"))
+            ]
+        );
+        assert_eq!(cfg.matrix_combinations("checkout"), vec![vec![]]);
+
+        let mut exec_plan = cfg.create_execution_plan_external_only("tradeoffs")?;
+        exec_plan.apply_matrix(combinations[1].clone());
+        assert_eq!(
+            exec_plan.scenario_names(),
+            vec!["checkout[NODE_ENV=dev,WORKERS=4]"]
+        );
+        assert_eq!(exec_plan.env, combinations[1]);
+        Ok(())
+    }
+
+    #[test]
+    fn cgroups_need_a_baremetal_up_command() {
+        let process = |up: Option<&str>, process: ProcessType| ProcessToExecute {
+            name: String::from("browser"),
+            up: up.map(String::from),
+            down: None,
+            redirect: None,
+            process,
+            match_name: Some(String::from("chrome")),
+            match_port: None,
+            sample_interval_ms: None,
+            cgroup: true,
+            cpus: None,
+            access_log: None,
+        };
+        assert!(process(Some("npm run e2e"), ProcessType::BareMetal)
+            .validate()
+            .is_ok());
+        assert!(process(None, ProcessType::BareMetal).validate().is_err());
+        let docker = ProcessType::Docker {
+            containers: vec![String::from("browser")],
+            project: None,
+        };
+        assert!(process(Some("docker compose up -d"), docker)
+            .validate()
+            .is_err());
+    }
+
+    #[test]
+    fn processes_can_set_their_own_sample_interval() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.attach.toml"))?;
+        let default = cfg.sample_interval();
+        assert_eq!(default, Duration::from_millis(500));
+
+        let db = cfg.find_process("db").expect("process should exist");
+        assert_eq!(db.sample_interval(default), Duration::from_secs(10));
+        let web = cfg.find_process("web").expect("process should exist");
+        assert_eq!(web.sample_interval(default), default);
+
+        assert!(validate_sample_interval(Some(50)).is_err());
+        assert!(validate_sample_interval(None).is_ok());
+        Ok(())
+    }
+
+    #[test]
+    fn can_attach_to_processes_by_port() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.attach.toml"))?;
+        let process = cfg.find_process("web").expect("process should exist");
+        assert_eq!(process.match_port, Some(5800));
+
+        let process = ProcessToExecute {
+            name: String::from("web"),
+            up: None,
+            down: None,
+            redirect: None,
+            process: ProcessType::Docker {
+                containers: vec![],
+                project: None,
+            },
+            match_name: None,
+            match_port: Some(5800),
+            sample_interval_ms: None,
+            cgroup: false,
+            cpus: None,
+            access_log: None,
+        };
+        assert!(process.validate().is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn can_load_k8s_process() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.k8s.toml"))?;
+        let process = cfg.find_process("shop").expect("process should exist");
+        assert_eq!(
+            process.process,
+            ProcessType::K8s {
+                namespace: Some(String::from("shop")),
+                selector: String::from("app=checkout")
+            }
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn can_load_metrics_sources() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.prometheus.toml"))?;
+        let MetricsSource::Prometheus { url, queries } = &cfg.metrics_sources[0] else {
+            panic!("expected a prometheus metrics source");
+        };
+        assert_eq!(url, "http://localhost:9090");
+
+        let fields = queries
+            .iter()
+            .map(|q| (q.field, q.process.as_deref(), q.component, q.core_count))
+            .collect::<Vec<_>>();
+        assert_eq!(
+            fields,
+            [
+                (PrometheusField::CpuUsage, Some("job"), None, 6),
+                (PrometheusField::Power, None, None, 1),
+                (PrometheusField::Power, None, Some(PowerComponent::Gpu), 1),
+            ]
+        );
+
+        assert_eq!(
+            cfg.metrics_sources[1],
+            MetricsSource::Agent {
+                host: String::from("db"),
+                url: String::from("http://10.0.0.12:7420"),
+                names: vec![String::from("^postgres$")],
+                ports: vec![],
+                containers: vec![],
+                sample_interval_ms: Some(500),
+            }
+        );
+
+        let exec_plan = cfg.create_execution_plan("checkout")?;
+        assert_eq!(exec_plan.metrics_sources.len(), 2);
+        Ok(())
+    }
+
+    #[test]
+    fn can_load_scenario_timeouts() -> anyhow::Result<()> {
+        let cfg = Config::from_path(Path::new("./fixtures/cardamon.timeout.toml"))?;
+
+        let scenario = cfg.find_scenario("flush_server").unwrap();
+        assert_eq!(scenario.timeout, Some(Duration::from_secs(90)));
+        assert_eq!(scenario.stop_signal, StopSignal::Sigint);
+        assert_eq!(scenario.kill_grace_period, Duration::from_secs(30));
+        assert_eq!(scenario.warmup, Some(Duration::from_secs(10)));
+        assert_eq!(scenario.cooldown, Some(Duration::from_secs(5)));
+        assert_eq!(scenario.before.as_deref(), Some("node ./scenarios/seed.js"));
+        assert_eq!(
+            scenario.after.as_deref(),
+            Some("node ./scenarios/truncate.js")
+        );
+        assert_eq!(scenario.on_failure, OnFailure::Retry);
+        assert_eq!(scenario.max_retries(), 3);
+        assert_eq!(
+            scenario.budget,
+            Some(Budget {
+                joules: Some(500.0),
+                watts: None
+            })
+        );
+
+        let scenario = cfg.find_scenario("basket_10").unwrap();
+        assert_eq!(scenario.timeout, None);
+        assert_eq!(scenario.stop_signal, StopSignal::Sigterm);
+        assert_eq!(scenario.kill_grace_period, Duration::from_secs(10));
+        assert_eq!(scenario.warmup, None);
+        assert_eq!(scenario.on_failure, OnFailure::Abort);
+        assert_eq!(scenario.max_retries(), 0);
         Ok(())
     }
 
@@ -294,7 +3337,8 @@ mod tests {
             .into_iter()
             .map(|proc| match proc.process {
                 ProcessType::BareMetal => proc.name.as_str(),
-                ProcessType::Docker { containers: _ } => proc.name.as_str(),
+                ProcessType::Docker { .. } => proc.name.as_str(),
+                ProcessType::K8s { .. } => proc.name.as_str(),
             })
             .sorted()
             .collect::<Vec<_>>();
@@ -330,8 +3374,9 @@ mod tests {
             .processes_to_execute
             .into_iter()
             .map(|proc| match proc.process {
-                ProcessType::Docker { containers: _ } => proc.name.as_str(),
+                ProcessType::Docker { .. } => proc.name.as_str(),
                 ProcessType::BareMetal => proc.name.as_str(),
+                ProcessType::K8s { .. } => proc.name.as_str(),
             })
             .sorted()
             .collect();
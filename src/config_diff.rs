@@ -0,0 +1,220 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::Context;
+use std::collections::BTreeMap;
+use toml::Value;
+
+/// Config keys which don't change how anything is measured. Changing any other key could make
+/// the results of a new run incomparable with previous runs. `*` matches any scenario or
+/// process name and a key matches if it starts with one of these.
+const COSMETIC_KEYS: [&str; 7] = [
+    "debug_level",
+    "metrics_server_url",
+    "cpu.name",
+    "scenarios.*.desc",
+    "processes.*.redirect",
+    "processes.*.down",
+    "observations",
+];
+
+/// A single difference between two configs.
+#[derive(Debug, PartialEq)]
+pub struct ConfigChange {
+    /// Dotted path to the value, arrays of tables are indexed by name e.g. `scenarios.basket_10.command`.
+    pub key: String,
+    pub before: Option<String>,
+    pub after: Option<String>,
+    pub affects_measurement: bool,
+}
+
+/// Compares two cardamon configs value by value.
+///
+/// # Arguments
+/// * before - the TOML of the earlier config
+/// * after - the TOML of the later config
+///
+/// # Returns
+/// Every changed, added or removed value ordered by key
+pub fn diff(before: &str, after: &str) -> anyhow::Result<Vec<ConfigChange>> {
+    let before = flatten_toml(before).context("Error parsing previous config.")?;
+    let after = flatten_toml(after).context("Error parsing current config.")?;
+
+    let mut keys = before.keys().chain(after.keys()).collect::<Vec<_>>();
+    keys.sort();
+    keys.dedup();
+
+    Ok(keys
+        .into_iter()
+        .filter(|key| before.get(*key) != after.get(*key))
+        .map(|key| ConfigChange {
+            key: key.clone(),
+            before: before.get(key).cloned(),
+            after: after.get(key).cloned(),
+            affects_measurement: affects_measurement(key),
+        })
+        .collect())
+}
+
+fn flatten_toml(toml: &str) -> anyhow::Result<BTreeMap<String, String>> {
+    let value = toml::from_str::<Value>(toml)?;
+    let mut values = BTreeMap::new();
+    flatten("", &value, &mut values);
+    Ok(values)
+}
+
+fn flatten(prefix: &str, value: &Value, values: &mut BTreeMap<String, String>) {
+    let key = |name: &str| {
+        if prefix.is_empty() {
+            String::from(name)
+        } else {
+            format!("{prefix}.{name}")
+        }
+    };
+
+    match value {
+        Value::Table(table) => {
+            for (name, value) in table.iter() {
+                flatten(&key(name), value, values);
+            }
+        }
+
+        // index arrays of named tables (scenarios, processes, observations) by name so that
+        // reordering them isn't reported as a change.
+        Value::Array(array)
+            if !array.is_empty()
+                && array
+                    .iter()
+                    .all(|v| v.get("name").and_then(Value::as_str).is_some()) =>
+        {
+            for value in array.iter() {
+                let name = value
+                    .get("name")
+                    .and_then(Value::as_str)
+                    .unwrap_or_default();
+                flatten(&key(name), value, values);
+            }
+        }
+
+        _ => {
+            values.insert(String::from(prefix), value.to_string());
+        }
+    }
+}
+
+fn affects_measurement(key: &str) -> bool {
+    !COSMETIC_KEYS.iter().any(|pattern| {
+        let key = key.split('.').collect::<Vec<_>>();
+        let pattern = pattern.split('.').collect::<Vec<_>>();
+        key.len() >= pattern.len()
+            && pattern
+                .iter()
+                .zip(key.iter())
+                .all(|(p, k)| *p == "*" || p == k)
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const BEFORE: &str = r#"
+debug_level = "info"
+
+[cpu]
+name = "AMD Ryzen 7 PRO 6850U"
+tdp = 15.0
+
+[[scenarios]]
+name = "basket_10"
+desc = "Adds ten items to the basket"
+command = "node ./scenarios/basket_10.js"
+iterations = 1
+processes = ["server"]
+
+[[scenarios]]
+name = "user_signup"
+desc = "Signs up a user"
+command = "node ./scenarios/user_signup.js"
+iterations = 1
+processes = ["server"]
+"#;
+
+    #[test]
+    fn reordering_scenarios_is_not_a_change() -> anyhow::Result<()> {
+        let after = r#"
+debug_level = "info"
+
+[cpu]
+name = "AMD Ryzen 7 PRO 6850U"
+tdp = 15.0
+
+[[scenarios]]
+name = "user_signup"
+desc = "Signs up a user"
+command = "node ./scenarios/user_signup.js"
+iterations = 1
+processes = ["server"]
+
+[[scenarios]]
+name = "basket_10"
+desc = "Adds ten items to the basket"
+command = "node ./scenarios/basket_10.js"
+iterations = 1
+processes = ["server"]
+"#;
+
+        assert_eq!(diff(BEFORE, after)?, vec![]);
+        Ok(())
+    }
+
+    #[test]
+    fn changes_are_classified_by_whether_they_affect_measurement() -> anyhow::Result<()> {
+        let after = r#"
+debug_level = "debug"
+
+[cpu]
+name = "AMD Ryzen 7 PRO 6850U"
+tdp = 28.0
+
+[[scenarios]]
+name = "basket_10"
+desc = "Adds ten items to the basket"
+command = "node ./scenarios/basket_10.js"
+iterations = 3
+processes = ["server"]
+timeout = "30s"
+
+[[scenarios]]
+name = "user_signup"
+desc = "Signs up a new user"
+command = "node ./scenarios/user_signup.js"
+iterations = 1
+processes = ["server"]
+"#;
+
+        let changes = diff(BEFORE, after)?;
+        let classified = changes
+            .iter()
+            .map(|c| (c.key.as_str(), c.affects_measurement))
+            .collect::<Vec<_>>();
+        assert_eq!(
+            classified,
+            [
+                ("cpu.tdp", true),
+                ("debug_level", false),
+                ("scenarios.basket_10.iterations", true),
+                ("scenarios.basket_10.timeout", true),
+                ("scenarios.user_signup.desc", false),
+            ]
+        );
+
+        let timeout = &changes[3];
+        assert_eq!(timeout.before, None);
+        assert_eq!(timeout.after.as_deref(), Some("\"30s\""));
+        Ok(())
+    }
+}
@@ -0,0 +1,371 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::config::{ContainerRuntime, ScenarioContainer};
+use anyhow::{anyhow, Context};
+use bollard::{
+    container::{
+        Config, CreateContainerOptions, RemoveContainerOptions, StartContainerOptions,
+        StopContainerOptions,
+    },
+    errors::Error,
+    image::CreateImageOptions,
+    models::{HostConfig, PortBinding},
+    Docker, API_DEFAULT_VERSION,
+};
+use futures_util::TryStreamExt;
+use std::{collections::HashMap, path::Path};
+
+/// Seconds to wait for a response from the container engine.
+const CONNECT_TIMEOUT: u64 = 120;
+
+/// Connects to the Docker API of the given container runtime, containerd doesn't have one.
+///
+/// Docker is found using the usual `DOCKER_HOST` defaults. Podman's socket is taken from
+/// `CONTAINER_HOST` if it's set, otherwise the rootless socket in `XDG_RUNTIME_DIR` is used when
+/// it exists, falling back to the rootful socket.
+///
+/// # Arguments
+/// * runtime - the container runtime to connect to
+///
+/// # Returns
+/// A client for the runtime's Docker compatible API
+pub fn connect(runtime: ContainerRuntime) -> anyhow::Result<Docker> {
+    match runtime {
+        ContainerRuntime::Docker => {
+            Docker::connect_with_defaults().context("Unable to connect to docker")
+        }
+
+        ContainerRuntime::Podman => {
+            let socket = podman_socket(
+                std::env::var("CONTAINER_HOST").ok(),
+                std::env::var("XDG_RUNTIME_DIR").ok(),
+            );
+            Docker::connect_with_socket(&socket, CONNECT_TIMEOUT, API_DEFAULT_VERSION).context(
+                format!(
+                    "Unable to connect to podman at {socket}, is `podman system service` running?"
+                ),
+            )
+        }
+
+        ContainerRuntime::Containerd => Err(anyhow!(
+            "containerd doesn't serve the Docker API, scenario containers need docker or podman"
+        )),
+    }
+}
+
+fn podman_socket(container_host: Option<String>, runtime_dir: Option<String>) -> String {
+    if let Some(host) = container_host {
+        return host
+            .strip_prefix("unix://")
+            .or(host.strip_prefix("npipe://"))
+            .unwrap_or(&host)
+            .to_string();
+    }
+
+    if cfg!(windows) {
+        return String::from("//./pipe/podman-machine-default");
+    }
+
+    match runtime_dir {
+        Some(dir)
+            if std::path::Path::new(&dir)
+                .join("podman/podman.sock")
+                .exists() =>
+        {
+            format!("{dir}/podman/podman.sock")
+        }
+        _ => String::from("/run/podman/podman.sock"),
+    }
+}
+
+/// The label compose puts on every container of a project, docker compose, podman-compose and
+/// nerdctl compose all use it.
+pub const COMPOSE_PROJECT_LABEL: &str = "com.docker.compose.project";
+
+/// Works out the name of the compose project started by a process's `up` command, the same way
+/// compose does: `-p`/`--project-name`, then `COMPOSE_PROJECT_NAME`, then the directory of the
+/// compose file or the working directory.
+///
+/// # Arguments
+/// * up - the command which starts the process
+///
+/// # Returns
+/// The project name, None if the command doesn't run compose
+pub fn compose_project(up: &str) -> Option<String> {
+    let cwd = std::env::current_dir().ok()?;
+    compose_project_in(up, std::env::var("COMPOSE_PROJECT_NAME").ok(), &cwd)
+}
+
+fn compose_project_in(up: &str, env_project: Option<String>, cwd: &Path) -> Option<String> {
+    let args = up.split_whitespace().collect::<Vec<_>>();
+    let compose = args
+        .iter()
+        .position(|arg| *arg == "compose" || arg.ends_with("-compose"))?;
+    let args = &args[compose + 1..];
+
+    let option = |names: &[&str]| {
+        args.iter().enumerate().find_map(|(i, arg)| {
+            names.iter().find_map(|name| match arg.strip_prefix(name) {
+                Some("") => args.get(i + 1).copied(),
+                Some(value) if name.starts_with("--") => value.strip_prefix('='),
+                _ => None,
+            })
+        })
+    };
+
+    let project = match option(&["-p", "--project-name"])
+        .map(String::from)
+        .or(env_project)
+    {
+        Some(project) => project,
+        None => {
+            let dir = match option(&["--project-directory"]) {
+                Some(dir) => cwd.join(dir),
+                None => match option(&["-f", "--file"]) {
+                    Some(file) => cwd.join(file).parent()?.to_path_buf(),
+                    None => cwd.to_path_buf(),
+                },
+            };
+            dir.file_name()?.to_string_lossy().to_string()
+        }
+    };
+
+    // compose only allows lowercase letters, digits, dashes and underscores
+    Some(
+        project
+            .to_lowercase()
+            .chars()
+            .filter(|c| c.is_ascii_alphanumeric() || *c == '-' || *c == '_')
+            .collect(),
+    )
+}
+
+/// A container created by cardamon for a single iteration of a scenario.
+pub struct LifecycleContainer {
+    docker: Docker,
+    name: String,
+}
+impl LifecycleContainer {
+    /// Creates, but doesn't start, the container for a scenario. The image is pulled if it isn't
+    /// available locally and any container left over from a previous iteration is removed.
+    ///
+    /// # Arguments
+    /// * scenario_name - the name of the scenario the container belongs to
+    /// * config - the container config of the scenario
+    /// * runtime - the container runtime to create the container with
+    ///
+    /// # Returns
+    /// The created container
+    pub async fn create(
+        scenario_name: &str,
+        config: &ScenarioContainer,
+        runtime: ContainerRuntime,
+    ) -> anyhow::Result<Self> {
+        let docker = connect(runtime)?;
+        let name = container_name(scenario_name);
+
+        if docker.inspect_image(&config.image).await.is_err() {
+            tracing::info!("Pulling image {}", config.image);
+            std::pin::pin!(docker.create_image(
+                Some(CreateImageOptions {
+                    from_image: config.image.as_str(),
+                    ..Default::default()
+                }),
+                None,
+                None,
+            ))
+            .try_for_each(|_| async { Ok(()) })
+            .await
+            .context(format!("Failed to pull image {}", config.image))?;
+        }
+
+        let container = Self { docker, name };
+        container.remove().await?;
+
+        let mut exposed_ports = HashMap::new();
+        let mut port_bindings = HashMap::new();
+        for port in config.ports.iter() {
+            let (host_port, container_port) = parse_port(port)?;
+            exposed_ports.insert(container_port.clone(), HashMap::new());
+            port_bindings.insert(
+                container_port,
+                Some(vec![PortBinding {
+                    host_ip: None,
+                    host_port: Some(host_port),
+                }]),
+            );
+        }
+
+        container
+            .docker
+            .create_container(
+                Some(CreateContainerOptions {
+                    name: container.name.as_str(),
+                    platform: None,
+                }),
+                Config {
+                    image: Some(config.image.clone()),
+                    cmd: config.cmd.clone(),
+                    env: Some(config.env.clone()),
+                    exposed_ports: Some(exposed_ports),
+                    host_config: Some(HostConfig {
+                        port_bindings: Some(port_bindings),
+                        ..Default::default()
+                    }),
+                    ..Default::default()
+                },
+            )
+            .await
+            .context(format!("Failed to create container {}", container.name))?;
+
+        Ok(container)
+    }
+
+    pub fn name(&self) -> &str {
+        &self.name
+    }
+
+    pub async fn start(&self) -> anyhow::Result<()> {
+        self.docker
+            .start_container(&self.name, None::<StartContainerOptions<String>>)
+            .await
+            .context(format!("Failed to start container {}", self.name))
+    }
+
+    /// Stops the container, killing it if it hasn't stopped within the timeout.
+    pub async fn stop(&self, timeout: std::time::Duration) -> anyhow::Result<()> {
+        self.docker
+            .stop_container(
+                &self.name,
+                Some(StopContainerOptions {
+                    t: timeout.as_secs() as i64,
+                }),
+            )
+            .await
+            .context(format!("Failed to stop container {}", self.name))
+    }
+
+    /// Removes the container if it exists.
+    pub async fn remove(&self) -> anyhow::Result<()> {
+        let options = RemoveContainerOptions {
+            force: true,
+            ..Default::default()
+        };
+
+        match self
+            .docker
+            .remove_container(&self.name, Some(options))
+            .await
+        {
+            Ok(()) => Ok(()),
+            Err(Error::DockerResponseServerError {
+                status_code: 404, ..
+            }) => Ok(()),
+            Err(err) => Err(err).context(format!("Failed to remove container {}", self.name)),
+        }
+    }
+}
+
+/// Docker container names may only contain `[a-zA-Z0-9_.-]`.
+fn container_name(scenario_name: &str) -> String {
+    let scenario_name = scenario_name
+        .chars()
+        .map(|c| {
+            if c.is_ascii_alphanumeric() || c == '_' || c == '.' || c == '-' {
+                c
+            } else {
+                '-'
+            }
+        })
+        .collect::<String>();
+    format!("cardamon-{scenario_name}")
+}
+
+/// Parses a port mapping in the form `host:container`.
+///
+/// # Returns
+/// The host port and the container port with its protocol, e.g. `("8080", "80/tcp")`
+fn parse_port(port: &str) -> anyhow::Result<(String, String)> {
+    let (host_port, container_port) = port
+        .split_once(':')
+        .ok_or(anyhow!("Port {port} should be in the form host:container"))?;
+
+    let container_port = if container_port.contains('/') {
+        String::from(container_port)
+    } else {
+        format!("{container_port}/tcp")
+    };
+
+    Ok((String::from(host_port), container_port))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn ports_default_to_tcp() -> anyhow::Result<()> {
+        assert_eq!(
+            parse_port("8080:80")?,
+            (String::from("8080"), String::from("80/tcp"))
+        );
+        assert_eq!(
+            parse_port("5353:53/udp")?,
+            (String::from("5353"), String::from("53/udp"))
+        );
+        assert!(parse_port("8080").is_err());
+        Ok(())
+    }
+
+    #[test]
+    fn podman_socket_honours_container_host() {
+        assert_eq!(
+            podman_socket(
+                Some(String::from("unix:///run/user/1000/podman/podman.sock")),
+                None
+            ),
+            "/run/user/1000/podman/podman.sock"
+        );
+        #[cfg(unix)]
+        assert_eq!(
+            podman_socket(None, Some(String::from("/nonexistent"))),
+            "/run/podman/podman.sock"
+        );
+    }
+
+    #[test]
+    fn compose_projects_are_named_like_compose() {
+        let cwd = Path::new("/home/dev/My Shop");
+        assert_eq!(compose_project_in("yarn dev", None, cwd), None);
+        assert_eq!(
+            compose_project_in("docker compose up -d", None, cwd).as_deref(),
+            Some("myshop")
+        );
+        assert_eq!(
+            compose_project_in("docker compose -p shop up -d", None, cwd).as_deref(),
+            Some("shop")
+        );
+        assert_eq!(
+            compose_project_in("docker-compose --project-name=shop up", None, cwd).as_deref(),
+            Some("shop")
+        );
+        assert_eq!(
+            compose_project_in("docker compose -f deploy/compose.yml up", None, cwd).as_deref(),
+            Some("deploy")
+        );
+        assert_eq!(
+            compose_project_in("podman-compose up -d", Some(String::from("Staging")), cwd)
+                .as_deref(),
+            Some("staging")
+        );
+    }
+
+    #[test]
+    fn container_names_are_sanitised() {
+        assert_eq!(container_name("cold start #1"), "cardamon-cold-start--1");
+    }
+}
@@ -0,0 +1,434 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+//! The pages of `cardamon ui`, the same figures as the CLI tables for people who'd rather browse
+//! them. Pages link to each other and have no external resources.
+
+use crate::{
+    annotation,
+    compare::ScenarioComparison,
+    config::Blend,
+    data_access::{artifact::Artifact, run::Run},
+    dataset::ObservationDataset,
+    report::{self, escape, STYLE},
+    significance,
+    trend::{self, Break, Point},
+    units::Units,
+};
+use itertools::Itertools;
+use std::fmt::Write;
+
+const CHART_WIDTH: f64 = 760.0;
+const CHART_HEIGHT: f64 = 220.0;
+const CHART_MARGIN: f64 = 40.0;
+
+/// A run in the run history along with the scenarios it ran.
+pub struct RunRow<'a> {
+    pub run: &'a Run,
+    pub scenarios: Vec<String>,
+}
+
+fn page(title: &str, body: &str) -> String {
+    format!(
+        "<!DOCTYPE html><html><head><meta charset=\"utf-8\"><title>{title}</title><style>{STYLE}</style></head><body><nav><a href=\"/\">Runs</a></nav>{body}</body></html>\n",
+        title = escape(title)
+    )
+}
+
+/// # Returns
+/// The text escaped to be part of a path or query, e.g. `checkout%20flow`
+fn url_escape(text: &str) -> String {
+    text.bytes()
+        .map(|b| match b {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'_' | b'.' | b'~' => {
+                (b as char).to_string()
+            }
+            _ => format!("%{:02X}", b),
+        })
+        .collect()
+}
+
+fn started(start_time: i64) -> String {
+    chrono::DateTime::from_timestamp_millis(start_time)
+        .map(|start| start.format("%Y-%m-%d %H:%M").to_string())
+        .unwrap_or_default()
+}
+
+/// # Arguments
+/// * runs - the runs on this page, the latest first
+/// * project - the project the runs were filtered to, kept when paging
+/// * older - the offset of the next page of older runs, None if these are the oldest
+///
+/// # Returns
+/// The run history with links to each run, the trend of each scenario and a comparison form
+pub fn runs_page(runs: &[RunRow], project: Option<&str>, older: Option<usize>) -> String {
+    let mut body = String::from("<h1>Runs</h1>");
+    if runs.is_empty() {
+        body.push_str("<p>No runs were saved yet, run <code>cardamon run</code> first.</p>");
+        return page("Cardamon runs", &body);
+    }
+
+    body.push_str("<table><tr><th>Run</th><th>Started</th><th>Project</th><th>Label</th><th>Commit</th><th>Scenarios</th><th>Notes</th></tr>");
+    for RunRow { run, scenarios } in runs.iter() {
+        let scenarios = scenarios
+            .iter()
+            .map(|scenario| {
+                let project = run
+                    .project
+                    .as_deref()
+                    .map(|project| format!("?project={}", url_escape(project)))
+                    .unwrap_or_default();
+                format!(
+                    "<a href=\"/ui/scenarios/{}{}\">{}</a>",
+                    url_escape(scenario),
+                    project,
+                    escape(scenario)
+                )
+            })
+            .join(", ");
+        let _ = write!(
+            body,
+            "<tr><td><a href=\"/ui/runs/{}\">{}</a></td><td>{}</td><td>{}</td><td>{}</td><td>{}</td><td>{}</td><td>{}</td></tr>",
+            url_escape(&run.run_id),
+            escape(&run.run_id),
+            started(run.start_time),
+            escape(run.project.as_deref().unwrap_or("")),
+            escape(run.label.as_deref().unwrap_or("")),
+            run.git().map(|git| escape(&git.to_string())).unwrap_or_default(),
+            scenarios,
+            escape(&annotation::summary(&run.annotations()).unwrap_or_default())
+        );
+    }
+    body.push_str("</table>");
+    if let Some(older) = older {
+        let project = project
+            .map(|project| format!("&project={}", url_escape(project)))
+            .unwrap_or_default();
+        let _ = write!(
+            body,
+            "<p><a href=\"/?offset={}{}\">Older runs</a></p>",
+            older, project
+        );
+    }
+
+    // the latest run is compared with the one before it unless others are picked
+    let options = |selected: usize| {
+        runs.iter()
+            .enumerate()
+            .map(|(i, RunRow { run, .. })| {
+                format!(
+                    "<option value=\"{id}\"{}>{id}</option>",
+                    if i == selected { " selected" } else { "" },
+                    id = escape(&run.run_id)
+                )
+            })
+            .join("")
+    };
+    let _ = write!(
+        body,
+        "<h2>Compare runs</h2><form action=\"/ui/compare\" method=\"get\"><select name=\"a\">{}</select> with <select name=\"b\">{}</select> <button type=\"submit\">Compare</button></form>",
+        options(1.min(runs.len() - 1)),
+        options(0)
+    );
+    page("Cardamon runs", &body)
+}
+
+/// # Returns
+/// The report of a single run with a link back to the run history
+pub fn run_page(report: &str) -> String {
+    report.replacen("<body>", "<body><nav><a href=\"/\">Runs</a></nav>", 1)
+}
+
+/// # Arguments
+/// * points - the energy of the scenario in each run, oldest first
+///
+/// # Returns
+/// A chart and table of the scenario's energy over its runs, with where the trend broke
+pub fn scenario_page(scenario: &str, points: &[Point], breaks: &[Break], units: &Units) -> String {
+    let mut body = format!("<h1>Trend of {}</h1>", escape(scenario));
+    if points.is_empty() {
+        body.push_str("<p>The scenario has no runs with energy.</p>");
+        return page(&format!("Cardamon {scenario}"), &body);
+    }
+
+    body.push_str(&trend_chart(points, breaks, units));
+    body.push_str("<table><tr><th>Run</th><th>Started</th><th>Commit</th><th>Label</th><th>Iterations</th><th>Mean</th><th>Std dev</th><th>Trend</th><th>Notes</th></tr>");
+    for (index, point) in points.iter().enumerate().rev() {
+        let trend_break = breaks
+            .iter()
+            .find(|b| b.index == index)
+            .map(|b| {
+                format!(
+                    "break, {} -> {} ({:+.1}%)",
+                    units.energy(b.before),
+                    units.energy(b.after),
+                    b.change_pct()
+                )
+            })
+            .unwrap_or_default();
+        let _ = write!(
+            body,
+            "<tr><td><a href=\"/ui/runs/{}\">{}</a></td><td>{}</td><td>{}</td><td>{}</td><td>{}</td><td>{}</td><td>{}</td><td>{}</td><td>{}</td></tr>",
+            url_escape(&point.run_id),
+            escape(&point.run_id),
+            started(point.start_time),
+            point
+                .git
+                .as_ref()
+                .map(|git| escape(&git.short_commit()))
+                .unwrap_or_default(),
+            escape(point.label.as_deref().unwrap_or("")),
+            point.energy.iterations,
+            units.energy(point.energy.mean),
+            units.energy(point.energy.stddev),
+            escape(&trend_break),
+            escape(&annotation::summary(&point.annotations).unwrap_or_default())
+        );
+    }
+    body.push_str("</table>");
+    if breaks.is_empty() {
+        body.push_str(
+            "<p>No trend breaks, the energy of the scenario stayed at the same level.</p>",
+        );
+    }
+    page(&format!("Cardamon {scenario}"), &body)
+}
+
+/// # Returns
+/// The mean energy of each run as a line, with the runs the trend broke at marked
+fn trend_chart(points: &[Point], breaks: &[Break], units: &Units) -> String {
+    let means = points
+        .iter()
+        .map(|point| point.energy.mean)
+        .collect::<Vec<_>>();
+    let max_y = means.iter().copied().fold(0.0, f64::max).max(1e-9);
+    let plot_width = CHART_WIDTH - 2.0 * CHART_MARGIN;
+    let plot_height = CHART_HEIGHT - 2.0 * CHART_MARGIN;
+    let to_x = |i: usize| CHART_MARGIN + i as f64 / (points.len() - 1).max(1) as f64 * plot_width;
+    let to_y = |y: f64| CHART_MARGIN + plot_height - y / max_y * plot_height;
+
+    let mut svg = format!(
+        "<p>{}</p><svg xmlns=\"http://www.w3.org/2000/svg\" width=\"{w}\" height=\"{h}\" viewBox=\"0 0 {w} {h}\">",
+        trend::sparkline(&means),
+        w = CHART_WIDTH,
+        h = CHART_HEIGHT
+    );
+    let _ = write!(
+        svg,
+        "<polyline fill=\"none\" stroke=\"#999\" points=\"{l},{t} {l},{b} {r},{b}\"/><text x=\"{l}\" y=\"{}\">{}</text>",
+        CHART_MARGIN - 8.0,
+        escape(&units.energy(max_y)),
+        l = CHART_MARGIN,
+        t = CHART_MARGIN,
+        b = CHART_MARGIN + plot_height,
+        r = CHART_MARGIN + plot_width
+    );
+    for b in breaks.iter() {
+        let _ = write!(
+            svg,
+            "<line x1=\"{x:.1}\" y1=\"{}\" x2=\"{x:.1}\" y2=\"{}\" stroke=\"#d95f02\" stroke-dasharray=\"3,3\"/>",
+            CHART_MARGIN,
+            CHART_MARGIN + plot_height,
+            x = to_x(b.index)
+        );
+    }
+    let line = means
+        .iter()
+        .enumerate()
+        .map(|(i, mean)| format!("{:.1},{:.1}", to_x(i), to_y(*mean)))
+        .join(" ");
+    let _ = write!(
+        svg,
+        "<polyline fill=\"none\" stroke=\"#1b9e77\" stroke-width=\"1.5\" points=\"{}\"/>",
+        line
+    );
+    for (i, point) in points.iter().enumerate() {
+        let _ = write!(
+            svg,
+            "<a href=\"/ui/runs/{}\"><circle cx=\"{:.1}\" cy=\"{:.1}\" r=\"3\" fill=\"#1b9e77\"><title>{}: {}</title></circle></a>",
+            url_escape(&point.run_id),
+            to_x(i),
+            to_y(point.energy.mean),
+            escape(&point.run_id),
+            escape(&units.energy(point.energy.mean))
+        );
+    }
+    svg.push_str("</svg>");
+    svg
+}
+
+/// # Returns
+/// What changed in each scenario between the runs, as shown by `cardamon compare`
+pub fn comparison_page(
+    run_a: &Run,
+    run_b: &Run,
+    comparisons: &[ScenarioComparison],
+    units: &Units,
+) -> String {
+    let (run_a_id, run_b_id) = (run_a.run_id.as_str(), run_b.run_id.as_str());
+    let mut body = format!(
+        "<h1>Run <a href=\"/ui/runs/{}\">{}</a> compared with <a href=\"/ui/runs/{}\">{}</a></h1>",
+        url_escape(run_a_id),
+        escape(run_a_id),
+        url_escape(run_b_id),
+        escape(run_b_id)
+    );
+    // what changed between the runs is often only written down in their notes
+    for run in [run_a, run_b] {
+        let annotations = run.annotations();
+        if !annotations.is_empty() {
+            let _ = write!(body, "<h2>Notes on {}</h2>", escape(&run.run_id));
+            body.push_str(&report::notes(&annotations));
+        }
+    }
+    for comparison in comparisons.iter() {
+        match comparison {
+            ScenarioComparison::Both { scenario, changes } => {
+                let _ = write!(body, "<h2>{}</h2>", escape(scenario));
+                if changes.is_empty() {
+                    body.push_str("<p>Nothing was measured in both runs.</p>");
+                    continue;
+                }
+                body.push_str("<table><tr><th>Metric</th><th>Before</th><th>After</th><th>Change</th><th>p</th><th></th></tr>");
+                for change in changes.iter() {
+                    let _ = write!(
+                        body,
+                        "<tr><td>{}</td><td>{}</td><td>{}</td><td>{} ({:+.1}%)</td><td>{}</td><td>{}</td></tr>",
+                        change.metric,
+                        escape(&units.quantity(change.a.mean, change.unit)),
+                        escape(&units.quantity(change.b.mean, change.unit)),
+                        escape(&units.difference(change.difference(), change.unit)),
+                        change.relative_difference(),
+                        change
+                            .p_value()
+                            .map(|p_value| format!("{:.3}", p_value))
+                            .unwrap_or_default(),
+                        if change.is_significant() {
+                            "significant"
+                        } else {
+                            "no significant change"
+                        }
+                    );
+                }
+                body.push_str("</table>");
+            }
+            ScenarioComparison::OnlyInA(scenario) => {
+                let _ = write!(
+                    body,
+                    "<h2>{}</h2><p>Only ran in {}.</p>",
+                    escape(scenario),
+                    escape(run_a_id)
+                );
+            }
+            ScenarioComparison::OnlyInB(scenario) => {
+                let _ = write!(
+                    body,
+                    "<h2>{}</h2><p>Only ran in {}.</p>",
+                    escape(scenario),
+                    escape(run_b_id)
+                );
+            }
+        }
+    }
+    let _ = write!(
+        body,
+        "<p>Changes are significant if Welch's t-test of the iterations gives p &lt; {}.</p>",
+        significance::SIGNIFICANCE_LEVEL
+    );
+    page(&format!("Cardamon {run_a_id} vs {run_b_id}"), &body)
+}
+
+/// The same as [`report::html`] with a link back to the run history, see [`run_page`].
+pub fn run_report(
+    observation_dataset: &ObservationDataset,
+    blend: Option<&Blend>,
+    artifacts: &[Artifact],
+) -> String {
+    run_page(&report::html(observation_dataset, blend, artifacts))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{annotation::Annotation, dataset::Stats};
+
+    fn point(run_id: &str, mean: f64) -> Point {
+        Point {
+            run_id: String::from(run_id),
+            start_time: 1717507590000,
+            label: None,
+            git: None,
+            energy: Stats::of(&[mean]).unwrap(),
+            annotations: vec![],
+        }
+    }
+
+    #[test]
+    fn pages_link_to_each_other() {
+        let mut run = Run::new(
+            "abc12",
+            1717507590000,
+            1717507600000,
+            None,
+            "config",
+            None,
+            None,
+        );
+        run.project = Some(String::from("shop"));
+        let run = run
+            .with_annotation(Annotation::new(
+                1717507600000,
+                Some("switched to <jemalloc>"),
+                vec![],
+            ))
+            .unwrap();
+        let older = Run::new(
+            "abc11",
+            1717507490000,
+            1717507500000,
+            None,
+            "config",
+            None,
+            None,
+        );
+        let rows = [
+            RunRow {
+                run: &run,
+                scenarios: vec![String::from("checkout flow")],
+            },
+            RunRow {
+                run: &older,
+                scenarios: vec![],
+            },
+        ];
+
+        let runs = runs_page(&rows, Some("shop"), Some(50));
+        assert!(runs.contains("<a href=\"/ui/runs/abc12\">abc12</a>"));
+        assert!(runs.contains("/ui/scenarios/checkout%20flow?project=shop"));
+        assert!(runs.contains("/?offset=50&project=shop"));
+        assert!(runs.contains("<option value=\"abc11\" selected>"));
+        assert!(runs.contains("<td>switched to &lt;jemalloc&gt;</td>"));
+        assert!(runs_page(&[], None, None).contains("No runs were saved yet"));
+
+        let points = [point("abc11", 10.0), point("abc12", 20.0)];
+        let scenario = scenario_page("checkout <flow>", &points, &[], &Units::default());
+        assert!(scenario.contains("Trend of checkout &lt;flow&gt;"));
+        assert!(scenario.contains("20.000 J"));
+        let table = &scenario[scenario.find("<table").unwrap()..];
+        assert!(table.find("abc12") < table.find("abc11"));
+
+        let comparison = comparison_page(
+            &older,
+            &run,
+            &[ScenarioComparison::OnlyInB(String::from("search"))],
+            &Units::default(),
+        );
+        assert!(comparison.contains("Only ran in abc12."));
+        assert!(comparison.contains("<h2>Notes on abc12</h2>"));
+        assert!(!comparison.contains("Notes on abc11"));
+        assert!(run_page("<html><body><h1>").contains("<nav><a href=\"/\">Runs</a></nav><h1>"));
+    }
+}
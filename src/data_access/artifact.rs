@@ -0,0 +1,292 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::{anyhow, Context};
+use async_trait::async_trait;
+use std::path::{Component, Path};
+
+/// A file attached to a run, e.g. a flamegraph or chart, so that everything about an experiment
+/// is kept together.
+#[derive(PartialEq, Debug, serde::Deserialize, serde::Serialize, sqlx::FromRow)]
+pub struct Artifact {
+    pub run_id: String,
+    /// Label of the artifact, unique within a run.
+    pub name: String,
+    /// Name of the file the artifact was read from.
+    pub file_name: String,
+    pub content: Vec<u8>,
+    pub created_at: i64,
+}
+impl Artifact {
+    pub fn new(
+        run_id: &str,
+        name: &str,
+        file_name: &str,
+        content: Vec<u8>,
+        created_at: i64,
+    ) -> Self {
+        Self {
+            run_id: String::from(run_id),
+            name: String::from(name),
+            file_name: String::from(file_name),
+            content,
+            created_at,
+        }
+    }
+
+    /// # Returns
+    /// The lowercased extension of the file the artifact was read from, if it had one
+    pub fn extension(&self) -> Option<String> {
+        Path::new(&self.file_name)
+            .extension()
+            .map(|extension| extension.to_string_lossy().to_lowercase())
+    }
+
+    /// Artifacts are extracted under their label, so it has to be a file name rather than a path.
+    ///
+    /// # Returns
+    /// An error if the label contains a path separator or isn't a file name, e.g. `charts/cpu`
+    pub fn validate_name(name: &str) -> anyhow::Result<()> {
+        let path = Path::new(name);
+        let is_file_name = !name.contains(['/', '\\'])
+            && path
+                .components()
+                .all(|component| matches!(component, Component::Normal(_)))
+            && path.file_name().is_some();
+        if is_file_name {
+            Ok(())
+        } else {
+            Err(anyhow!(
+                "Artifact name {name} should be a file name without a path"
+            ))
+        }
+    }
+
+    /// # Returns
+    /// The name of the file the artifact is extracted to, its label with the original extension
+    /// appended unless it already ends with it, e.g. `flamegraph.svg`. An error if the label isn't
+    /// a file name, e.g. in a run imported or pushed from an older version
+    pub fn extracted_file_name(&self) -> anyhow::Result<String> {
+        Self::validate_name(&self.name)
+            .context(format!("Artifact {} can't be extracted", self.name))?;
+        Ok(match self.extension() {
+            Some(extension) if !self.name.to_lowercase().ends_with(&format!(".{extension}")) => {
+                format!("{}.{}", self.name, extension)
+            }
+            _ => self.name.clone(),
+        })
+    }
+}
+
+#[async_trait]
+pub trait ArtifactDao {
+    async fn fetch_by_run(&self, run_id: &str) -> anyhow::Result<Vec<Artifact>>;
+    async fn persist(&self, artifact: &Artifact) -> anyhow::Result<()>;
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<()>;
+}
+
+// //////////////////////////////////////
+// LocalDao
+
+pub struct LocalDao {
+    pub pool: sqlx::SqlitePool,
+}
+impl LocalDao {
+    pub fn new(pool: sqlx::SqlitePool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl ArtifactDao for LocalDao {
+    async fn fetch_by_run(&self, run_id: &str) -> anyhow::Result<Vec<Artifact>> {
+        sqlx::query_as!(
+            Artifact,
+            "SELECT * FROM artifact WHERE run_id = ?1 ORDER BY created_at, name",
+            run_id
+        )
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching artifacts from db.")
+    }
+
+    async fn persist(&self, artifact: &Artifact) -> anyhow::Result<()> {
+        sqlx::query!("INSERT INTO artifact (run_id, name, file_name, content, created_at) VALUES (?1, ?2, ?3, ?4, ?5)",
+            artifact.run_id,
+            artifact.name,
+            artifact.file_name,
+            artifact.content,
+            artifact.created_at)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error inserting artifact into db.")
+    }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<()> {
+        sqlx::query!("DELETE FROM artifact WHERE run_id = ?1", run_id)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error deleting artifacts from db.")
+    }
+}
+
+// //////////////////////////////////////
+// PostgresDao
+
+pub struct PostgresDao {
+    pub pool: sqlx::PgPool,
+}
+impl PostgresDao {
+    pub fn new(pool: sqlx::PgPool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl ArtifactDao for PostgresDao {
+    async fn fetch_by_run(&self, run_id: &str) -> anyhow::Result<Vec<Artifact>> {
+        sqlx::query_as::<_, Artifact>(
+            "SELECT * FROM artifact WHERE run_id = $1 ORDER BY created_at, name",
+        )
+        .bind(run_id)
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching artifacts from db.")
+    }
+
+    async fn persist(&self, artifact: &Artifact) -> anyhow::Result<()> {
+        sqlx::query("INSERT INTO artifact (run_id, name, file_name, content, created_at) VALUES ($1, $2, $3, $4, $5)")
+            .bind(&artifact.run_id)
+            .bind(&artifact.name)
+            .bind(&artifact.file_name)
+            .bind(&artifact.content)
+            .bind(artifact.created_at)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error inserting artifact into db.")
+    }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<()> {
+        sqlx::query("DELETE FROM artifact WHERE run_id = $1")
+            .bind(run_id)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error deleting artifacts from db.")
+    }
+}
+
+// //////////////////////////////////////
+// RemoteDao
+
+pub struct RemoteDao {
+    base_url: String,
+    client: reqwest::Client,
+}
+impl RemoteDao {
+    pub fn new(base_url: &str) -> Self {
+        Self::with_client(base_url, reqwest::Client::new())
+    }
+
+    /// The same as [`RemoteDao::new`] with a client which e.g. authenticates every request.
+    pub fn with_client(base_url: &str, client: reqwest::Client) -> Self {
+        let base_url = base_url.strip_suffix('/').unwrap_or(base_url);
+        Self {
+            base_url: String::from(base_url),
+            client,
+        }
+    }
+}
+#[async_trait]
+impl ArtifactDao for RemoteDao {
+    async fn fetch_by_run(&self, run_id: &str) -> anyhow::Result<Vec<Artifact>> {
+        self.client
+            .get(format!("{}/artifacts/{run_id}", self.base_url))
+            .send()
+            .await?
+            .json::<Vec<Artifact>>()
+            .await
+            .context("Error fetching artifacts from remote server")
+    }
+
+    async fn persist(&self, artifact: &Artifact) -> anyhow::Result<()> {
+        self.client
+            .post(format!("{}/artifact", self.base_url))
+            .json(artifact)
+            .send()
+            .await?
+            .error_for_status()
+            .map(|_| ())
+            .context("Error persisting artifact to remote server")
+    }
+
+    async fn delete_by_run(&self, _run_id: &str) -> anyhow::Result<()> {
+        Err(anyhow!(
+            "Artifacts can't be deleted from a remote server, prune it on the server instead"
+        ))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[sqlx::test(migrations = "./migrations", fixtures("../../fixtures/runs.sql"))]
+    async fn artifacts_are_scoped_to_a_run(pool: sqlx::SqlitePool) -> anyhow::Result<()> {
+        let artifact_service = LocalDao::new(pool.clone());
+
+        let flamegraph = Artifact::new("1", "flamegraph", "flamegraph.svg", b"<svg/>".to_vec(), 2);
+        let chart = Artifact::new("1", "chart", "cpu.png", vec![0x89, 0x50], 1);
+        artifact_service.persist(&flamegraph).await?;
+        artifact_service.persist(&chart).await?;
+
+        // names must be unique within a run
+        assert!(artifact_service.persist(&chart).await.is_err());
+
+        let artifacts = artifact_service.fetch_by_run("1").await?;
+        assert_eq!(artifacts, [chart, flamegraph]);
+        assert!(artifact_service.fetch_by_run("2").await?.is_empty());
+
+        pool.close().await;
+        Ok(())
+    }
+
+    #[test]
+    fn artifacts_are_extracted_under_their_label() {
+        let extracted = |name: &str, file_name: &str| {
+            Artifact::new("1", name, file_name, vec![], 1)
+                .extracted_file_name()
+                .ok()
+        };
+        assert_eq!(
+            extracted("flamegraph", "perf.SVG").as_deref(),
+            Some("flamegraph.svg")
+        );
+        assert_eq!(
+            extracted("v1.2-flame", "flame.svg").as_deref(),
+            Some("v1.2-flame.svg")
+        );
+        assert_eq!(extracted("notes", "NOTES").as_deref(), Some("notes"));
+        // `cardamon attach` labels artifacts with their file name by default
+        assert_eq!(
+            extracted("flame.svg", "flame.svg").as_deref(),
+            Some("flame.svg")
+        );
+        assert_eq!(
+            extracted("perf.SVG", "perf.SVG").as_deref(),
+            Some("perf.SVG")
+        );
+        assert_eq!(extracted("charts/cpu", "cpu.png"), None);
+        assert_eq!(extracted("charts\\cpu", "cpu.png"), None);
+        assert_eq!(extracted("../../.bashrc", "x.sh"), None);
+        assert_eq!(extracted("/etc/passwd", "x"), None);
+        assert_eq!(extracted("..", "x"), None);
+        assert_eq!(extracted("", "x"), None);
+        assert!(Artifact::validate_name("flame.svg").is_ok());
+        assert!(Artifact::validate_name("charts/cpu").is_err());
+    }
+}
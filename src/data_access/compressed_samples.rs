@@ -0,0 +1,255 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{
+    cpu_metrics::CpuMetrics, power_metrics::PowerMetrics, resource_metrics::ResourceMetrics,
+};
+use anyhow::{anyhow, Context};
+use async_trait::async_trait;
+use std::io::{Read, Write};
+
+/// The zstd level samples are compressed with, downsampling runs in the background so a higher
+/// ratio is worth the time.
+const COMPRESSION_LEVEL: i32 = 19;
+
+/// The CPU, power and resource samples of a run.
+#[derive(Debug, Default, PartialEq, serde::Deserialize, serde::Serialize)]
+pub struct Samples {
+    pub cpu_metrics: Vec<CpuMetrics>,
+    pub power_metrics: Vec<PowerMetrics>,
+    pub resource_metrics: Vec<ResourceMetrics>,
+}
+impl Samples {
+    pub fn len(&self) -> usize {
+        self.cpu_metrics.len() + self.power_metrics.len() + self.resource_metrics.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    /// # Returns
+    /// The samples taken between begin and end inclusive, like the `fetch_within` of each DAO
+    pub fn within(self, begin: i64, end: i64) -> Self {
+        let within = |timestamp: i64| (begin..=end).contains(&timestamp);
+        Self {
+            cpu_metrics: self
+                .cpu_metrics
+                .into_iter()
+                .filter(|metrics| within(metrics.timestamp))
+                .collect(),
+            power_metrics: self
+                .power_metrics
+                .into_iter()
+                .filter(|metrics| within(metrics.timestamp))
+                .collect(),
+            resource_metrics: self
+                .resource_metrics
+                .into_iter()
+                .filter(|metrics| within(metrics.timestamp))
+                .collect(),
+        }
+    }
+}
+
+/// The samples of a downsampled run, saved as a single zstd compressed JSON document rather than
+/// a row per sample. Once a run has them its rows in the metrics tables are ignored, they're only
+/// left if a downsample was stopped before it deleted them.
+#[derive(Debug, PartialEq, serde::Deserialize, serde::Serialize, sqlx::FromRow)]
+pub struct CompressedSamples {
+    pub run_id: String,
+    /// How many samples were compressed.
+    pub samples: i64,
+    pub content: Vec<u8>,
+}
+impl CompressedSamples {
+    pub fn compress(run_id: &str, samples: &Samples) -> anyhow::Result<Self> {
+        let mut encoder = zstd::Encoder::new(vec![], COMPRESSION_LEVEL)?;
+        encoder.write_all(&serde_json::to_vec(samples)?)?;
+        Ok(Self {
+            run_id: String::from(run_id),
+            samples: samples.len() as i64,
+            content: encoder.finish()?,
+        })
+    }
+
+    pub fn decompress(&self) -> anyhow::Result<Samples> {
+        let mut json = vec![];
+        zstd::Decoder::new(self.content.as_slice())?
+            .read_to_end(&mut json)
+            .context(format!(
+                "Unable to decompress the samples of run {}",
+                self.run_id
+            ))?;
+        serde_json::from_slice(&json)
+            .context(format!("Unable to read the samples of run {}", self.run_id))
+    }
+}
+
+#[async_trait]
+pub trait CompressedSamplesDao {
+    async fn fetch(&self, run_id: &str) -> anyhow::Result<Option<CompressedSamples>>;
+    async fn persist(&self, compressed_samples: &CompressedSamples) -> anyhow::Result<()>;
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<()>;
+}
+
+// //////////////////////////////////////
+// LocalDao
+
+pub struct LocalDao {
+    pub pool: sqlx::SqlitePool,
+}
+impl LocalDao {
+    pub fn new(pool: sqlx::SqlitePool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl CompressedSamplesDao for LocalDao {
+    async fn fetch(&self, run_id: &str) -> anyhow::Result<Option<CompressedSamples>> {
+        sqlx::query_as!(
+            CompressedSamples,
+            "SELECT * FROM compressed_samples WHERE run_id = ?1",
+            run_id
+        )
+        .fetch_optional(&self.pool)
+        .await
+        .context("Error fetching compressed samples from db.")
+    }
+
+    async fn persist(&self, compressed_samples: &CompressedSamples) -> anyhow::Result<()> {
+        sqlx::query!(
+            "INSERT INTO compressed_samples (run_id, samples, content) VALUES (?1, ?2, ?3)",
+            compressed_samples.run_id,
+            compressed_samples.samples,
+            compressed_samples.content
+        )
+        .execute(&self.pool)
+        .await
+        .map(|_| ())
+        .context("Error inserting compressed samples into db.")
+    }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<()> {
+        sqlx::query!("DELETE FROM compressed_samples WHERE run_id = ?1", run_id)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error deleting compressed samples from db.")
+    }
+}
+
+// //////////////////////////////////////
+// PostgresDao
+
+pub struct PostgresDao {
+    pub pool: sqlx::PgPool,
+}
+impl PostgresDao {
+    pub fn new(pool: sqlx::PgPool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl CompressedSamplesDao for PostgresDao {
+    async fn fetch(&self, run_id: &str) -> anyhow::Result<Option<CompressedSamples>> {
+        sqlx::query_as::<_, CompressedSamples>("SELECT * FROM compressed_samples WHERE run_id = $1")
+            .bind(run_id)
+            .fetch_optional(&self.pool)
+            .await
+            .context("Error fetching compressed samples from db.")
+    }
+
+    async fn persist(&self, compressed_samples: &CompressedSamples) -> anyhow::Result<()> {
+        sqlx::query("INSERT INTO compressed_samples (run_id, samples, content) VALUES ($1, $2, $3)")
+            .bind(&compressed_samples.run_id)
+            .bind(compressed_samples.samples)
+            .bind(&compressed_samples.content)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error inserting compressed samples into db.")
+    }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<()> {
+        sqlx::query("DELETE FROM compressed_samples WHERE run_id = $1")
+            .bind(run_id)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error deleting compressed samples from db.")
+    }
+}
+
+// //////////////////////////////////////
+// RemoteDao
+
+pub struct RemoteDao {
+    base_url: String,
+    client: reqwest::Client,
+}
+impl RemoteDao {
+    pub fn new(base_url: &str) -> Self {
+        Self::with_client(base_url, reqwest::Client::new())
+    }
+
+    /// The same as [`RemoteDao::new`] with a client which e.g. authenticates every request.
+    pub fn with_client(base_url: &str, client: reqwest::Client) -> Self {
+        let base_url = base_url.strip_suffix('/').unwrap_or(base_url);
+        Self {
+            base_url: String::from(base_url),
+            client,
+        }
+    }
+}
+#[async_trait]
+impl CompressedSamplesDao for RemoteDao {
+    async fn fetch(&self, run_id: &str) -> anyhow::Result<Option<CompressedSamples>> {
+        self.client
+            .get(format!("{}/compressed_samples/{run_id}", self.base_url))
+            .send()
+            .await?
+            .json::<Option<CompressedSamples>>()
+            .await
+            .context("Error fetching compressed samples from remote server")
+    }
+
+    async fn persist(&self, _compressed_samples: &CompressedSamples) -> anyhow::Result<()> {
+        Err(anyhow!(
+            "Runs can't be downsampled on a remote server, prune it on the server instead"
+        ))
+    }
+
+    async fn delete_by_run(&self, _run_id: &str) -> anyhow::Result<()> {
+        Err(anyhow!(
+            "Runs can't be downsampled on a remote server, prune it on the server instead"
+        ))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn samples_are_the_same_once_decompressed() -> anyhow::Result<()> {
+        let samples = Samples {
+            cpu_metrics: (0..100)
+                .map(|i| CpuMetrics::new("1", "10", "server", 50.0, 100.0, 4, i * 60_000))
+                .collect(),
+            power_metrics: vec![PowerMetrics::new("1", "rapl", "cpu", None, 12.0, 0)],
+            resource_metrics: vec![],
+        };
+        let compressed = CompressedSamples::compress("1", &samples)?;
+        assert_eq!(compressed.samples, 101);
+        assert_eq!(compressed.decompress()?, samples);
+
+        let within = compressed.decompress()?.within(60_000, 120_000);
+        assert_eq!(within.cpu_metrics.len(), 2);
+        assert!(within.power_metrics.is_empty());
+        Ok(())
+    }
+}
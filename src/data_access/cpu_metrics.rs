@@ -4,7 +4,7 @@
  * file, You can obtain one at https://mozilla.org/MPL/2.0/.
  */
 
-use anyhow::Context;
+use anyhow::{anyhow, Context};
 use async_trait::async_trait;
 
 #[derive(Debug, PartialEq, serde::Deserialize, serde::Serialize, sqlx::FromRow)]
@@ -16,6 +16,9 @@ pub struct CpuMetrics {
     pub total_usage: f64,
     pub core_count: i64,
     pub timestamp: i64,
+    /// The scenario the process was observed for, None if it was observed for every scenario
+    /// running at the time.
+    pub scenario_name: Option<String>,
 }
 impl CpuMetrics {
     pub fn new(
@@ -35,6 +38,7 @@ impl CpuMetrics {
             total_usage,
             core_count,
             timestamp,
+            scenario_name: None,
         }
     }
 }
@@ -48,6 +52,11 @@ pub trait CpuMetricsDao {
         end: i64,
     ) -> anyhow::Result<Vec<CpuMetrics>>;
     async fn persist(&self, model: &CpuMetrics) -> anyhow::Result<()>;
+    /// Deletes every sample of a run.
+    ///
+    /// # Returns
+    /// How many samples were deleted
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<u64>;
 }
 
 // //////////////////////////////////////
@@ -84,21 +93,87 @@ impl CpuMetricsDao for LocalDao {
     }
 
     async fn persist(&self, metrics: &CpuMetrics) -> anyhow::Result<()> {
-        sqlx::query!("INSERT INTO cpu_metrics (run_id, process_id, process_name, cpu_usage, total_usage, core_count, timestamp) \
-                      VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7)", 
+        sqlx::query!("INSERT INTO cpu_metrics (run_id, process_id, process_name, cpu_usage, total_usage, core_count, timestamp, scenario_name) \
+                      VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)", 
             metrics.run_id,
             metrics.process_id,
             metrics.process_name,
             metrics.cpu_usage,
             metrics.total_usage,
             metrics.core_count,
-            metrics.timestamp
+            metrics.timestamp,
+            metrics.scenario_name
         )
             .execute(&self.pool)
             .await
             .map(|_| ())
             .context("Error inserting cpu metrics into db.")
     }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<u64> {
+        sqlx::query!("DELETE FROM cpu_metrics WHERE run_id = ?1", run_id)
+            .execute(&self.pool)
+            .await
+            .map(|res| res.rows_affected())
+            .context("Error deleting cpu metrics from db.")
+    }
+}
+
+// //////////////////////////////////////
+// PostgresDao
+
+pub struct PostgresDao {
+    pub pool: sqlx::PgPool,
+}
+impl PostgresDao {
+    pub fn new(pool: sqlx::PgPool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl CpuMetricsDao for PostgresDao {
+    async fn fetch_within(
+        &self,
+        run_id: &str,
+        begin: i64,
+        end: i64,
+    ) -> anyhow::Result<Vec<CpuMetrics>> {
+        sqlx::query_as::<_, CpuMetrics>(
+            "SELECT * FROM cpu_metrics WHERE run_id = $1 AND timestamp >= $2 AND timestamp <= $3",
+        )
+        .bind(run_id)
+        .bind(begin)
+        .bind(end)
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching cpu metrics from db.")
+    }
+
+    async fn persist(&self, metrics: &CpuMetrics) -> anyhow::Result<()> {
+        sqlx::query("INSERT INTO cpu_metrics (run_id, process_id, process_name, cpu_usage, total_usage, core_count, timestamp, scenario_name) \
+                     VALUES ($1, $2, $3, $4, $5, $6, $7, $8)")
+            .bind(&metrics.run_id)
+            .bind(&metrics.process_id)
+            .bind(&metrics.process_name)
+            .bind(metrics.cpu_usage)
+            .bind(metrics.total_usage)
+            .bind(metrics.core_count)
+            .bind(metrics.timestamp)
+            .bind(&metrics.scenario_name)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error inserting cpu metrics into db.")
+    }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<u64> {
+        sqlx::query("DELETE FROM cpu_metrics WHERE run_id = $1")
+            .bind(run_id)
+            .execute(&self.pool)
+            .await
+            .map(|res| res.rows_affected())
+            .context("Error deleting cpu metrics from db.")
+    }
 }
 
 // //////////////////////////////////////
@@ -110,10 +185,15 @@ pub struct RemoteDao {
 }
 impl RemoteDao {
     pub fn new(base_url: &str) -> Self {
+        Self::with_client(base_url, reqwest::Client::new())
+    }
+
+    /// The same as [`RemoteDao::new`] with a client which e.g. authenticates every request.
+    pub fn with_client(base_url: &str, client: reqwest::Client) -> Self {
         let base_url = base_url.strip_suffix('/').unwrap_or(base_url);
         Self {
             base_url: String::from(base_url),
-            client: reqwest::Client::new(),
+            client,
         }
     }
 }
@@ -147,6 +227,12 @@ impl CpuMetricsDao for RemoteDao {
             .map(|_| ())
             .context("Error persisting cpu metrics to remote server")
     }
+
+    async fn delete_by_run(&self, _run_id: &str) -> anyhow::Result<u64> {
+        Err(anyhow!(
+            "Cpu metrics can't be deleted from a remote server, prune it on the server instead"
+        ))
+    }
 }
 
 #[cfg(test)]
@@ -0,0 +1,227 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::{anyhow, Context};
+use async_trait::async_trait;
+
+/// The energy of a process apportioned to the requests it served for a route during a scenario
+/// iteration, see [crate::access_log].
+#[derive(Debug, Clone, PartialEq, serde::Deserialize, serde::Serialize, sqlx::FromRow)]
+pub struct EndpointEnergy {
+    pub run_id: String,
+    pub scenario_name: String,
+    pub iteration: i64,
+    pub process_name: String,
+    /// The method and path of the route, e.g. `GET /notes/:id`.
+    pub route: String,
+    pub requests: i64,
+    pub joules: f64,
+}
+impl EndpointEnergy {
+    pub fn new(
+        run_id: &str,
+        scenario_name: &str,
+        iteration: i64,
+        process_name: &str,
+        route: &str,
+        requests: i64,
+        joules: f64,
+    ) -> Self {
+        Self {
+            run_id: String::from(run_id),
+            scenario_name: String::from(scenario_name),
+            iteration,
+            process_name: String::from(process_name),
+            route: String::from(route),
+            requests,
+            joules,
+        }
+    }
+}
+
+#[async_trait]
+pub trait EndpointEnergyDao {
+    async fn fetch_by_run(&self, run_id: &str) -> anyhow::Result<Vec<EndpointEnergy>>;
+    async fn persist(&self, endpoint_energy: &EndpointEnergy) -> anyhow::Result<()>;
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<()>;
+}
+
+// //////////////////////////////////////
+// LocalDao
+
+pub struct LocalDao {
+    pub pool: sqlx::SqlitePool,
+}
+impl LocalDao {
+    pub fn new(pool: sqlx::SqlitePool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl EndpointEnergyDao for LocalDao {
+    async fn fetch_by_run(&self, run_id: &str) -> anyhow::Result<Vec<EndpointEnergy>> {
+        sqlx::query_as!(
+            EndpointEnergy,
+            "SELECT * FROM endpoint_energy WHERE run_id = ?1 ORDER BY scenario_name, iteration, route",
+            run_id
+        )
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching endpoint energy from db.")
+    }
+
+    async fn persist(&self, endpoint_energy: &EndpointEnergy) -> anyhow::Result<()> {
+        sqlx::query!(
+            "INSERT INTO endpoint_energy (run_id, scenario_name, iteration, process_name, route, requests, joules) \
+                      VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7)",
+            endpoint_energy.run_id,
+            endpoint_energy.scenario_name,
+            endpoint_energy.iteration,
+            endpoint_energy.process_name,
+            endpoint_energy.route,
+            endpoint_energy.requests,
+            endpoint_energy.joules
+        )
+        .execute(&self.pool)
+        .await
+        .map(|_| ())
+        .context("Error inserting endpoint energy into db.")
+    }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<()> {
+        sqlx::query!("DELETE FROM endpoint_energy WHERE run_id = ?1", run_id)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error deleting endpoint energy from db.")
+    }
+}
+
+// //////////////////////////////////////
+// PostgresDao
+
+pub struct PostgresDao {
+    pub pool: sqlx::PgPool,
+}
+impl PostgresDao {
+    pub fn new(pool: sqlx::PgPool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl EndpointEnergyDao for PostgresDao {
+    async fn fetch_by_run(&self, run_id: &str) -> anyhow::Result<Vec<EndpointEnergy>> {
+        sqlx::query_as::<_, EndpointEnergy>(
+            "SELECT * FROM endpoint_energy WHERE run_id = $1 ORDER BY scenario_name, iteration, route",
+        )
+        .bind(run_id)
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching endpoint energy from db.")
+    }
+
+    async fn persist(&self, endpoint_energy: &EndpointEnergy) -> anyhow::Result<()> {
+        sqlx::query(
+            "INSERT INTO endpoint_energy (run_id, scenario_name, iteration, process_name, route, requests, joules) \
+                      VALUES ($1, $2, $3, $4, $5, $6, $7)",
+        )
+        .bind(&endpoint_energy.run_id)
+        .bind(&endpoint_energy.scenario_name)
+        .bind(endpoint_energy.iteration)
+        .bind(&endpoint_energy.process_name)
+        .bind(&endpoint_energy.route)
+        .bind(endpoint_energy.requests)
+        .bind(endpoint_energy.joules)
+        .execute(&self.pool)
+        .await
+        .map(|_| ())
+        .context("Error inserting endpoint energy into db.")
+    }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<()> {
+        sqlx::query("DELETE FROM endpoint_energy WHERE run_id = $1")
+            .bind(run_id)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error deleting endpoint energy from db.")
+    }
+}
+
+// //////////////////////////////////////
+// RemoteDao
+
+pub struct RemoteDao {
+    base_url: String,
+    client: reqwest::Client,
+}
+impl RemoteDao {
+    pub fn new(base_url: &str) -> Self {
+        Self::with_client(base_url, reqwest::Client::new())
+    }
+
+    /// The same as [`RemoteDao::new`] with a client which e.g. authenticates every request.
+    pub fn with_client(base_url: &str, client: reqwest::Client) -> Self {
+        let base_url = base_url.strip_suffix('/').unwrap_or(base_url);
+        Self {
+            base_url: String::from(base_url),
+            client,
+        }
+    }
+}
+#[async_trait]
+impl EndpointEnergyDao for RemoteDao {
+    async fn fetch_by_run(&self, run_id: &str) -> anyhow::Result<Vec<EndpointEnergy>> {
+        self.client
+            .get(format!("{}/endpoint_energy/{run_id}", self.base_url))
+            .send()
+            .await?
+            .json::<Vec<EndpointEnergy>>()
+            .await
+            .context("Error fetching endpoint energy from remote server")
+    }
+
+    async fn persist(&self, endpoint_energy: &EndpointEnergy) -> anyhow::Result<()> {
+        self.client
+            .post(format!("{}/endpoint_energy", self.base_url))
+            .json(endpoint_energy)
+            .send()
+            .await?
+            .error_for_status()
+            .map(|_| ())
+            .context("Error persisting endpoint energy to remote server")
+    }
+
+    async fn delete_by_run(&self, _run_id: &str) -> anyhow::Result<()> {
+        Err(anyhow!(
+            "Endpoint energy can't be deleted from a remote server, prune it on the server instead"
+        ))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[sqlx::test(migrations = "./migrations")]
+    async fn endpoint_energy_is_scoped_to_a_run(pool: sqlx::SqlitePool) -> anyhow::Result<()> {
+        let endpoint_energy_service = LocalDao::new(pool.clone());
+
+        let notes = EndpointEnergy::new("1", "basket_10", 0, "server", "GET /notes", 30, 3.0);
+        let login = EndpointEnergy::new("1", "basket_10", 0, "server", "POST /login", 10, 3.0);
+        endpoint_energy_service.persist(&notes).await?;
+        endpoint_energy_service.persist(&login).await?;
+        // a route only has one row per process and iteration
+        assert!(endpoint_energy_service.persist(&login).await.is_err());
+
+        let endpoint_energy = endpoint_energy_service.fetch_by_run("1").await?;
+        assert_eq!(endpoint_energy, [notes, login]);
+        assert!(endpoint_energy_service.fetch_by_run("2").await?.is_empty());
+
+        pool.close().await;
+        Ok(())
+    }
+}
@@ -0,0 +1,254 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::{anyhow, Context};
+use async_trait::async_trait;
+
+/// A single reading from a power source.
+#[derive(Debug, PartialEq, serde::Deserialize, serde::Serialize, sqlx::FromRow)]
+pub struct PowerMetrics {
+    pub run_id: String,
+    pub source: String,
+    pub component: String,
+    /// Set if the power has already been attributed to a process by the power source.
+    pub process_id: Option<String>,
+    /// Mean power in watts since the previous reading from the same source.
+    pub power: f64,
+    pub timestamp: i64,
+}
+impl PowerMetrics {
+    pub fn new(
+        run_id: &str,
+        source: &str,
+        component: &str,
+        process_id: Option<&str>,
+        power: f64,
+        timestamp: i64,
+    ) -> Self {
+        PowerMetrics {
+            run_id: String::from(run_id),
+            source: String::from(source),
+            component: String::from(component),
+            process_id: process_id.map(String::from),
+            power,
+            timestamp,
+        }
+    }
+}
+
+#[async_trait]
+pub trait PowerMetricsDao {
+    async fn fetch_within(
+        &self,
+        run_id: &str,
+        begin: i64,
+        end: i64,
+    ) -> anyhow::Result<Vec<PowerMetrics>>;
+    async fn persist(&self, model: &PowerMetrics) -> anyhow::Result<()>;
+    /// Deletes every sample of a run.
+    ///
+    /// # Returns
+    /// How many samples were deleted
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<u64>;
+}
+
+// //////////////////////////////////////
+// LocalDao
+
+pub struct LocalDao {
+    pub pool: sqlx::SqlitePool,
+}
+impl LocalDao {
+    pub fn new(pool: sqlx::SqlitePool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl PowerMetricsDao for LocalDao {
+    async fn fetch_within(
+        &self,
+        run_id: &str,
+        begin: i64,
+        end: i64,
+    ) -> anyhow::Result<Vec<PowerMetrics>> {
+        sqlx::query_as!(
+            PowerMetrics,
+            r#"
+            SELECT * FROM power_metrics WHERE run_id = ?1 AND timestamp >= ?2 AND timestamp <= ?3
+            "#,
+            run_id,
+            begin,
+            end
+        )
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching power metrics from db.")
+    }
+
+    async fn persist(&self, metrics: &PowerMetrics) -> anyhow::Result<()> {
+        sqlx::query!(
+            "INSERT INTO power_metrics (run_id, source, component, process_id, power, timestamp) \
+                      VALUES (?1, ?2, ?3, ?4, ?5, ?6)",
+            metrics.run_id,
+            metrics.source,
+            metrics.component,
+            metrics.process_id,
+            metrics.power,
+            metrics.timestamp
+        )
+        .execute(&self.pool)
+        .await
+        .map(|_| ())
+        .context("Error inserting power metrics into db.")
+    }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<u64> {
+        sqlx::query!("DELETE FROM power_metrics WHERE run_id = ?1", run_id)
+            .execute(&self.pool)
+            .await
+            .map(|res| res.rows_affected())
+            .context("Error deleting power metrics from db.")
+    }
+}
+
+// //////////////////////////////////////
+// PostgresDao
+
+pub struct PostgresDao {
+    pub pool: sqlx::PgPool,
+}
+impl PostgresDao {
+    pub fn new(pool: sqlx::PgPool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl PowerMetricsDao for PostgresDao {
+    async fn fetch_within(
+        &self,
+        run_id: &str,
+        begin: i64,
+        end: i64,
+    ) -> anyhow::Result<Vec<PowerMetrics>> {
+        sqlx::query_as::<_, PowerMetrics>(
+            "SELECT * FROM power_metrics WHERE run_id = $1 AND timestamp >= $2 AND timestamp <= $3",
+        )
+        .bind(run_id)
+        .bind(begin)
+        .bind(end)
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching power metrics from db.")
+    }
+
+    async fn persist(&self, metrics: &PowerMetrics) -> anyhow::Result<()> {
+        sqlx::query(
+            "INSERT INTO power_metrics (run_id, source, component, process_id, power, timestamp) \
+                      VALUES ($1, $2, $3, $4, $5, $6)",
+        )
+        .bind(&metrics.run_id)
+        .bind(&metrics.source)
+        .bind(&metrics.component)
+        .bind(&metrics.process_id)
+        .bind(metrics.power)
+        .bind(metrics.timestamp)
+        .execute(&self.pool)
+        .await
+        .map(|_| ())
+        .context("Error inserting power metrics into db.")
+    }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<u64> {
+        sqlx::query("DELETE FROM power_metrics WHERE run_id = $1")
+            .bind(run_id)
+            .execute(&self.pool)
+            .await
+            .map(|res| res.rows_affected())
+            .context("Error deleting power metrics from db.")
+    }
+}
+
+// //////////////////////////////////////
+// RemoteDao
+
+pub struct RemoteDao {
+    base_url: String,
+    client: reqwest::Client,
+}
+impl RemoteDao {
+    pub fn new(base_url: &str) -> Self {
+        Self::with_client(base_url, reqwest::Client::new())
+    }
+
+    /// The same as [`RemoteDao::new`] with a client which e.g. authenticates every request.
+    pub fn with_client(base_url: &str, client: reqwest::Client) -> Self {
+        let base_url = base_url.strip_suffix('/').unwrap_or(base_url);
+        Self {
+            base_url: String::from(base_url),
+            client,
+        }
+    }
+}
+#[async_trait]
+impl PowerMetricsDao for RemoteDao {
+    async fn fetch_within(
+        &self,
+        run_id: &str,
+        begin: i64,
+        end: i64,
+    ) -> anyhow::Result<Vec<PowerMetrics>> {
+        self.client
+            .get(format!(
+                "{}/power_metrics/{run_id}?begin={begin}&end={end}",
+                self.base_url
+            ))
+            .send()
+            .await?
+            .json::<Vec<PowerMetrics>>()
+            .await
+            .context("Error fetching power metrics from remote server")
+    }
+
+    async fn persist(&self, metrics: &PowerMetrics) -> anyhow::Result<()> {
+        self.client
+            .post(format!("{}/power_metrics", self.base_url))
+            .json(metrics)
+            .send()
+            .await?
+            .error_for_status()
+            .map(|_| ())
+            .context("Error persisting power metrics to remote server")
+    }
+
+    async fn delete_by_run(&self, _run_id: &str) -> anyhow::Result<u64> {
+        Err(anyhow!(
+            "Power metrics can't be deleted from a remote server, prune it on the server instead"
+        ))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[sqlx::test(
+        migrations = "./migrations",
+        fixtures("../../fixtures/power_metrics.sql")
+    )]
+    async fn local_power_metrics_fetch_within(pool: sqlx::SqlitePool) -> anyhow::Result<()> {
+        let metrics_service = LocalDao::new(pool.clone());
+
+        let metrics = metrics_service
+            .fetch_within("1", 1717507590000, 1717507590400)
+            .await?;
+
+        assert_eq!(metrics.len(), 3);
+        assert!(metrics.iter().all(|m| m.process_id.is_none()));
+
+        pool.close().await;
+        Ok(())
+    }
+}
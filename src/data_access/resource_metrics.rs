@@ -0,0 +1,288 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::{anyhow, Context};
+use async_trait::async_trait;
+
+/// Usage of resources other than the CPU by a single process or container. Values are counters
+/// read at the time of the sample and are None if they couldn't be read for the process.
+#[derive(Debug, Default, PartialEq, serde::Deserialize, serde::Serialize, sqlx::FromRow)]
+pub struct ResourceMetrics {
+    pub run_id: String,
+    pub process_id: String,
+    /// Total bytes sent over the network.
+    pub bytes_sent: Option<i64>,
+    /// Total bytes received over the network.
+    pub bytes_received: Option<i64>,
+    /// Total bytes read from storage.
+    pub read_bytes: Option<i64>,
+    /// Total bytes written to storage.
+    pub write_bytes: Option<i64>,
+    /// Total read operations.
+    pub read_ops: Option<i64>,
+    /// Total write operations.
+    pub write_ops: Option<i64>,
+    /// Memory in use by the process, its resident set size.
+    pub memory_bytes: Option<i64>,
+    /// Total memory of the host the process ran on.
+    pub memory_total: Option<i64>,
+    /// Total CPU quota enforcement periods that have elapsed.
+    pub cpu_periods: Option<i64>,
+    /// Total periods in which the process used its whole CPU quota and was throttled.
+    pub throttled_periods: Option<i64>,
+    /// Total time the process spent throttled in nanoseconds.
+    pub throttled_ns: Option<i64>,
+    pub timestamp: i64,
+    /// The scenario the process was observed for, None if it was observed for every scenario
+    /// running at the time.
+    pub scenario_name: Option<String>,
+    /// How busy the process kept the streaming multiprocessors of an NVIDIA GPU, as a percentage.
+    pub gpu_utilisation: Option<f64>,
+}
+impl ResourceMetrics {
+    pub fn new(run_id: &str, process_id: &str, timestamp: i64) -> Self {
+        ResourceMetrics {
+            run_id: String::from(run_id),
+            process_id: String::from(process_id),
+            timestamp,
+            ..Default::default()
+        }
+    }
+}
+
+#[async_trait]
+pub trait ResourceMetricsDao {
+    async fn fetch_within(
+        &self,
+        run_id: &str,
+        begin: i64,
+        end: i64,
+    ) -> anyhow::Result<Vec<ResourceMetrics>>;
+    async fn persist(&self, model: &ResourceMetrics) -> anyhow::Result<()>;
+    /// Deletes every sample of a run.
+    ///
+    /// # Returns
+    /// How many samples were deleted
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<u64>;
+}
+
+// //////////////////////////////////////
+// LocalDao
+
+pub struct LocalDao {
+    pub pool: sqlx::SqlitePool,
+}
+impl LocalDao {
+    pub fn new(pool: sqlx::SqlitePool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl ResourceMetricsDao for LocalDao {
+    async fn fetch_within(
+        &self,
+        run_id: &str,
+        begin: i64,
+        end: i64,
+    ) -> anyhow::Result<Vec<ResourceMetrics>> {
+        sqlx::query_as!(
+            ResourceMetrics,
+            r#"
+            SELECT * FROM resource_metrics WHERE run_id = ?1 AND timestamp >= ?2 AND timestamp <= ?3
+            "#,
+            run_id,
+            begin,
+            end
+        )
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching resource metrics from db.")
+    }
+
+    async fn persist(&self, metrics: &ResourceMetrics) -> anyhow::Result<()> {
+        sqlx::query!(
+            "INSERT INTO resource_metrics (run_id, process_id, bytes_sent, bytes_received, read_bytes, write_bytes, read_ops, write_ops, memory_bytes, memory_total, cpu_periods, throttled_periods, throttled_ns, timestamp, scenario_name, gpu_utilisation) \
+                      VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15, ?16)",
+            metrics.run_id,
+            metrics.process_id,
+            metrics.bytes_sent,
+            metrics.bytes_received,
+            metrics.read_bytes,
+            metrics.write_bytes,
+            metrics.read_ops,
+            metrics.write_ops,
+            metrics.memory_bytes,
+            metrics.memory_total,
+            metrics.cpu_periods,
+            metrics.throttled_periods,
+            metrics.throttled_ns,
+            metrics.timestamp,
+            metrics.scenario_name,
+            metrics.gpu_utilisation
+        )
+        .execute(&self.pool)
+        .await
+        .map(|_| ())
+        .context("Error inserting resource metrics into db.")
+    }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<u64> {
+        sqlx::query!("DELETE FROM resource_metrics WHERE run_id = ?1", run_id)
+            .execute(&self.pool)
+            .await
+            .map(|res| res.rows_affected())
+            .context("Error deleting resource metrics from db.")
+    }
+}
+
+// //////////////////////////////////////
+// PostgresDao
+
+pub struct PostgresDao {
+    pub pool: sqlx::PgPool,
+}
+impl PostgresDao {
+    pub fn new(pool: sqlx::PgPool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl ResourceMetricsDao for PostgresDao {
+    async fn fetch_within(
+        &self,
+        run_id: &str,
+        begin: i64,
+        end: i64,
+    ) -> anyhow::Result<Vec<ResourceMetrics>> {
+        sqlx::query_as::<_, ResourceMetrics>(
+            "SELECT * FROM resource_metrics WHERE run_id = $1 AND timestamp >= $2 AND timestamp <= $3",
+        )
+        .bind(run_id)
+        .bind(begin)
+        .bind(end)
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching resource metrics from db.")
+    }
+
+    async fn persist(&self, metrics: &ResourceMetrics) -> anyhow::Result<()> {
+        sqlx::query(
+            "INSERT INTO resource_metrics (run_id, process_id, bytes_sent, bytes_received, read_bytes, write_bytes, read_ops, write_ops, memory_bytes, memory_total, cpu_periods, throttled_periods, throttled_ns, timestamp, scenario_name, gpu_utilisation) \
+                      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)",
+        )
+        .bind(&metrics.run_id)
+        .bind(&metrics.process_id)
+        .bind(metrics.bytes_sent)
+        .bind(metrics.bytes_received)
+        .bind(metrics.read_bytes)
+        .bind(metrics.write_bytes)
+        .bind(metrics.read_ops)
+        .bind(metrics.write_ops)
+        .bind(metrics.memory_bytes)
+        .bind(metrics.memory_total)
+        .bind(metrics.cpu_periods)
+        .bind(metrics.throttled_periods)
+        .bind(metrics.throttled_ns)
+        .bind(metrics.timestamp)
+        .bind(&metrics.scenario_name)
+        .bind(metrics.gpu_utilisation)
+        .execute(&self.pool)
+        .await
+        .map(|_| ())
+        .context("Error inserting resource metrics into db.")
+    }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<u64> {
+        sqlx::query("DELETE FROM resource_metrics WHERE run_id = $1")
+            .bind(run_id)
+            .execute(&self.pool)
+            .await
+            .map(|res| res.rows_affected())
+            .context("Error deleting resource metrics from db.")
+    }
+}
+
+// //////////////////////////////////////
+// RemoteDao
+
+pub struct RemoteDao {
+    base_url: String,
+    client: reqwest::Client,
+}
+impl RemoteDao {
+    pub fn new(base_url: &str) -> Self {
+        Self::with_client(base_url, reqwest::Client::new())
+    }
+
+    /// The same as [`RemoteDao::new`] with a client which e.g. authenticates every request.
+    pub fn with_client(base_url: &str, client: reqwest::Client) -> Self {
+        let base_url = base_url.strip_suffix('/').unwrap_or(base_url);
+        Self {
+            base_url: String::from(base_url),
+            client,
+        }
+    }
+}
+#[async_trait]
+impl ResourceMetricsDao for RemoteDao {
+    async fn fetch_within(
+        &self,
+        run_id: &str,
+        begin: i64,
+        end: i64,
+    ) -> anyhow::Result<Vec<ResourceMetrics>> {
+        self.client
+            .get(format!(
+                "{}/resource_metrics/{run_id}?begin={begin}&end={end}",
+                self.base_url
+            ))
+            .send()
+            .await?
+            .json::<Vec<ResourceMetrics>>()
+            .await
+            .context("Error fetching resource metrics from remote server")
+    }
+
+    async fn persist(&self, metrics: &ResourceMetrics) -> anyhow::Result<()> {
+        self.client
+            .post(format!("{}/resource_metrics", self.base_url))
+            .json(metrics)
+            .send()
+            .await?
+            .error_for_status()
+            .map(|_| ())
+            .context("Error persisting resource metrics to remote server")
+    }
+
+    async fn delete_by_run(&self, _run_id: &str) -> anyhow::Result<u64> {
+        Err(anyhow!(
+            "Resource metrics can't be deleted from a remote server, prune it on the server instead"
+        ))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[sqlx::test(
+        migrations = "./migrations",
+        fixtures("../../fixtures/resource_metrics.sql")
+    )]
+    async fn local_resource_metrics_fetch_within(pool: sqlx::SqlitePool) -> anyhow::Result<()> {
+        let metrics_service = LocalDao::new(pool.clone());
+
+        let metrics = metrics_service
+            .fetch_within("1", 1717507590000, 1717507590400)
+            .await?;
+
+        assert_eq!(metrics.len(), 3);
+        assert_eq!(metrics[2].bytes_sent, Some(4000));
+
+        pool.close().await;
+        Ok(())
+    }
+}
@@ -0,0 +1,447 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{annotation::Annotation, git::Git};
+use anyhow::{anyhow, Context};
+use async_trait::async_trait;
+
+/// Provenance of a single cardamon run, i.e. how the results of the run were produced.
+#[derive(PartialEq, Debug, serde::Deserialize, serde::Serialize, sqlx::FromRow)]
+pub struct Run {
+    pub run_id: String,
+    pub start_time: i64,
+    pub stop_time: i64,
+    pub tdp: Option<f64>,
+    pub tdp_source: String,
+    pub energy_unavailable: Option<String>,
+    /// The cardamon.toml the run was started with.
+    pub config: Option<String>,
+    /// When the idle baseline of the run started being measured, None if it wasn't measured.
+    pub baseline_start: Option<i64>,
+    pub baseline_stop: Option<i64>,
+    /// How many times failed scenario iterations were run again, only the attempts which
+    /// succeeded are saved.
+    #[serde(default)]
+    pub retries: i64,
+    /// The seed the scenarios were shuffled with, None if they ran in the order they're
+    /// configured.
+    pub shuffle_seed: Option<i64>,
+    /// The order the shuffled scenarios ran in, one line per iteration.
+    pub scenario_order: Option<String>,
+    /// When the run was paused between scenarios, one `start-stop` in milliseconds per line.
+    pub pauses: Option<String>,
+    /// The state of the machine when the run started as JSON, see
+    /// [crate::environment::Environment].
+    pub environment: Option<String>,
+    /// The grams of CO2e emitted per kWh of electricity looked up when the run started, None if
+    /// it wasn't looked up.
+    pub carbon_intensity: Option<f64>,
+    /// Where the carbon intensity came from, e.g. `electricitymaps GB`.
+    pub carbon_intensity_source: Option<String>,
+    /// The Power Usage Effectiveness of the facility the run was measured in, None if it wasn't
+    /// configured.
+    pub pue: Option<f64>,
+    /// The name the run was given with `--label`, e.g. the branch it measured, so it can be used
+    /// as a baseline.
+    pub label: Option<String>,
+    /// The commit checked out when the run started, see [crate::git::Git]. None if it wasn't
+    /// started in a git repository.
+    pub git_commit: Option<String>,
+    pub git_branch: Option<String>,
+    pub git_dirty: Option<bool>,
+    pub git_tag: Option<String>,
+    /// The project the run belongs to, so a database shared by many repositories can tell apart
+    /// scenarios with the same name. None for runs without a project.
+    pub project: Option<String>,
+    /// The notes added to the run after it finished as JSON, see [crate::annotation::Annotation].
+    pub annotations: Option<String>,
+    /// The id the run had in the database it was imported from with `cardamon db import`, so it's
+    /// only imported once even if it was given a new id. None if it wasn't imported.
+    #[serde(default)]
+    pub imported_from: Option<String>,
+    /// Why the run stopped before all of its scenarios ran, e.g. a scenario with
+    /// `on_failure = "abort"` failed. None if it ran to the end.
+    #[serde(default)]
+    pub aborted: Option<String>,
+}
+impl Run {
+    pub fn new(
+        run_id: &str,
+        start_time: i64,
+        stop_time: i64,
+        tdp: Option<f64>,
+        tdp_source: &str,
+        energy_unavailable: Option<&str>,
+        config: Option<&str>,
+    ) -> Self {
+        Self {
+            run_id: String::from(run_id),
+            start_time,
+            stop_time,
+            tdp,
+            tdp_source: String::from(tdp_source),
+            energy_unavailable: energy_unavailable.map(String::from),
+            config: config.map(String::from),
+            baseline_start: None,
+            baseline_stop: None,
+            retries: 0,
+            shuffle_seed: None,
+            scenario_order: None,
+            pauses: None,
+            environment: None,
+            carbon_intensity: None,
+            carbon_intensity_source: None,
+            pue: None,
+            label: None,
+            git_commit: None,
+            git_branch: None,
+            git_dirty: None,
+            git_tag: None,
+            project: None,
+            annotations: None,
+            imported_from: None,
+            aborted: None,
+        }
+    }
+
+    /// # Returns
+    /// The commit the run measured, None if it wasn't started in a git repository
+    pub fn git(&self) -> Option<Git> {
+        Some(Git {
+            commit: self.git_commit.clone()?,
+            branch: self.git_branch.clone(),
+            dirty: self.git_dirty.unwrap_or_default(),
+            tag: self.git_tag.clone(),
+        })
+    }
+
+    pub fn with_git(self, git: Option<Git>) -> Self {
+        match git {
+            Some(git) => Self {
+                git_commit: Some(git.commit),
+                git_branch: git.branch,
+                git_dirty: Some(git.dirty),
+                git_tag: git.tag,
+                ..self
+            },
+            None => self,
+        }
+    }
+
+    /// # Returns
+    /// The notes added to the run, oldest first
+    pub fn annotations(&self) -> Vec<Annotation> {
+        self.annotations
+            .as_deref()
+            .and_then(|annotations| serde_json::from_str(annotations).ok())
+            .unwrap_or_default()
+    }
+
+    pub fn with_annotation(self, annotation: Annotation) -> anyhow::Result<Self> {
+        let mut annotations = self.annotations();
+        annotations.push(annotation);
+        Ok(Self {
+            annotations: Some(serde_json::to_string(&annotations)?),
+            ..self
+        })
+    }
+}
+
+#[async_trait]
+pub trait RunDao {
+    async fn fetch(&self, run_id: &str) -> anyhow::Result<Option<Run>>;
+    async fn fetch_since(&self, begin: i64) -> anyhow::Result<Vec<Run>>;
+    async fn persist(&self, run: &Run) -> anyhow::Result<()>;
+    async fn delete(&self, run_id: &str) -> anyhow::Result<()>;
+    /// Saves the annotations of a run which has already been persisted.
+    async fn annotate(&self, run: &Run) -> anyhow::Result<()>;
+}
+
+// //////////////////////////////////////
+// LocalDao
+
+pub struct LocalDao {
+    pub pool: sqlx::SqlitePool,
+}
+impl LocalDao {
+    pub fn new(pool: sqlx::SqlitePool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl RunDao for LocalDao {
+    async fn fetch(&self, run_id: &str) -> anyhow::Result<Option<Run>> {
+        sqlx::query_as!(Run, "SELECT * FROM run WHERE run_id = ?1", run_id)
+            .fetch_optional(&self.pool)
+            .await
+            .context("Error fetching run from db.")
+    }
+
+    async fn fetch_since(&self, begin: i64) -> anyhow::Result<Vec<Run>> {
+        sqlx::query_as!(
+            Run,
+            "SELECT * FROM run WHERE start_time >= ?1 ORDER BY start_time",
+            begin
+        )
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching runs from db.")
+    }
+
+    async fn persist(&self, run: &Run) -> anyhow::Result<()> {
+        sqlx::query!("INSERT INTO run (run_id, start_time, stop_time, tdp, tdp_source, energy_unavailable, config, baseline_start, baseline_stop, retries, shuffle_seed, scenario_order, pauses, environment, carbon_intensity, carbon_intensity_source, pue, label, git_commit, git_branch, git_dirty, git_tag, project, annotations, imported_from, aborted) VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15, ?16, ?17, ?18, ?19, ?20, ?21, ?22, ?23, ?24, ?25, ?26)",
+            run.run_id,
+            run.start_time,
+            run.stop_time,
+            run.tdp,
+            run.tdp_source,
+            run.energy_unavailable,
+            run.config,
+            run.baseline_start,
+            run.baseline_stop,
+            run.retries,
+            run.shuffle_seed,
+            run.scenario_order,
+            run.pauses,
+            run.environment,
+            run.carbon_intensity,
+            run.carbon_intensity_source,
+            run.pue,
+            run.label,
+            run.git_commit,
+            run.git_branch,
+            run.git_dirty,
+            run.git_tag,
+            run.project,
+            run.annotations,
+            run.imported_from,
+            run.aborted)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error inserting run into db.")
+    }
+
+    async fn delete(&self, run_id: &str) -> anyhow::Result<()> {
+        sqlx::query!("DELETE FROM run WHERE run_id = ?1", run_id)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error deleting run from db.")
+    }
+
+    async fn annotate(&self, run: &Run) -> anyhow::Result<()> {
+        sqlx::query!(
+            "UPDATE run SET annotations = ?1 WHERE run_id = ?2",
+            run.annotations,
+            run.run_id
+        )
+        .execute(&self.pool)
+        .await
+        .map(|_| ())
+        .context("Error annotating run in db.")
+    }
+}
+
+// //////////////////////////////////////
+// PostgresDao
+
+pub struct PostgresDao {
+    pub pool: sqlx::PgPool,
+}
+impl PostgresDao {
+    pub fn new(pool: sqlx::PgPool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl RunDao for PostgresDao {
+    async fn fetch(&self, run_id: &str) -> anyhow::Result<Option<Run>> {
+        sqlx::query_as::<_, Run>("SELECT * FROM run WHERE run_id = $1")
+            .bind(run_id)
+            .fetch_optional(&self.pool)
+            .await
+            .context("Error fetching run from db.")
+    }
+
+    async fn fetch_since(&self, begin: i64) -> anyhow::Result<Vec<Run>> {
+        sqlx::query_as::<_, Run>("SELECT * FROM run WHERE start_time >= $1 ORDER BY start_time")
+            .bind(begin)
+            .fetch_all(&self.pool)
+            .await
+            .context("Error fetching runs from db.")
+    }
+
+    async fn persist(&self, run: &Run) -> anyhow::Result<()> {
+        sqlx::query("INSERT INTO run (run_id, start_time, stop_time, tdp, tdp_source, energy_unavailable, config, baseline_start, baseline_stop, retries, shuffle_seed, scenario_order, pauses, environment, carbon_intensity, carbon_intensity_source, pue, label, git_commit, git_branch, git_dirty, git_tag, project, annotations, imported_from, aborted) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26)")
+            .bind(&run.run_id)
+            .bind(run.start_time)
+            .bind(run.stop_time)
+            .bind(run.tdp)
+            .bind(&run.tdp_source)
+            .bind(&run.energy_unavailable)
+            .bind(&run.config)
+            .bind(run.baseline_start)
+            .bind(run.baseline_stop)
+            .bind(run.retries)
+            .bind(run.shuffle_seed)
+            .bind(&run.scenario_order)
+            .bind(&run.pauses)
+            .bind(&run.environment)
+            .bind(run.carbon_intensity)
+            .bind(&run.carbon_intensity_source)
+            .bind(run.pue)
+            .bind(&run.label)
+            .bind(&run.git_commit)
+            .bind(&run.git_branch)
+            .bind(run.git_dirty)
+            .bind(&run.git_tag)
+            .bind(&run.project)
+            .bind(&run.annotations)
+            .bind(&run.imported_from)
+            .bind(&run.aborted)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error inserting run into db.")
+    }
+
+    async fn delete(&self, run_id: &str) -> anyhow::Result<()> {
+        sqlx::query("DELETE FROM run WHERE run_id = $1")
+            .bind(run_id)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error deleting run from db.")
+    }
+
+    async fn annotate(&self, run: &Run) -> anyhow::Result<()> {
+        sqlx::query("UPDATE run SET annotations = $1 WHERE run_id = $2")
+            .bind(&run.annotations)
+            .bind(&run.run_id)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error annotating run in db.")
+    }
+}
+
+// //////////////////////////////////////
+// RemoteDao
+
+pub struct RemoteDao {
+    base_url: String,
+    client: reqwest::Client,
+}
+impl RemoteDao {
+    pub fn new(base_url: &str) -> Self {
+        Self::with_client(base_url, reqwest::Client::new())
+    }
+
+    /// The same as [`RemoteDao::new`] with a client which e.g. authenticates every request.
+    pub fn with_client(base_url: &str, client: reqwest::Client) -> Self {
+        let base_url = base_url.strip_suffix('/').unwrap_or(base_url);
+        Self {
+            base_url: String::from(base_url),
+            client,
+        }
+    }
+}
+#[async_trait]
+impl RunDao for RemoteDao {
+    async fn fetch(&self, run_id: &str) -> anyhow::Result<Option<Run>> {
+        self.client
+            .get(format!("{}/run/{run_id}", self.base_url))
+            .send()
+            .await?
+            .json::<Option<Run>>()
+            .await
+            .context("Error fetching run from remote server")
+    }
+
+    async fn fetch_since(&self, begin: i64) -> anyhow::Result<Vec<Run>> {
+        self.client
+            .get(format!("{}/runs?since={begin}", self.base_url))
+            .send()
+            .await?
+            .json::<Vec<Run>>()
+            .await
+            .context("Error fetching runs from remote server")
+    }
+
+    async fn persist(&self, run: &Run) -> anyhow::Result<()> {
+        self.client
+            .post(format!("{}/run", self.base_url))
+            .json(run)
+            .send()
+            .await?
+            .error_for_status()
+            .map(|_| ())
+            .context("Error persisting run to remote server")
+    }
+
+    async fn delete(&self, _run_id: &str) -> anyhow::Result<()> {
+        Err(anyhow!(
+            "Runs can't be deleted from a remote server, prune it on the server instead"
+        ))
+    }
+
+    async fn annotate(&self, _run: &Run) -> anyhow::Result<()> {
+        Err(anyhow!(
+            "Runs can't be annotated on a remote server, annotate them before they're pushed"
+        ))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[sqlx::test(migrations = "./migrations", fixtures("../../fixtures/runs.sql"))]
+    async fn fetch_should_return_run_provenance(pool: sqlx::SqlitePool) -> anyhow::Result<()> {
+        let run_service = LocalDao::new(pool.clone());
+
+        let run = run_service.fetch("2").await?.expect("run 2 should exist");
+        assert_eq!(run.tdp, Some(28.0));
+        assert_eq!(run.tdp_source, "detected");
+
+        let run = run_service.fetch("3").await?.expect("run 3 should exist");
+        assert_eq!(run.tdp, None);
+        assert!(run.energy_unavailable.is_some());
+
+        assert!(run_service.fetch("nope").await?.is_none());
+
+        let runs = run_service.fetch_since(1717507690000).await?;
+        let run_ids = runs
+            .iter()
+            .map(|run| run.run_id.as_str())
+            .collect::<Vec<_>>();
+        assert_eq!(run_ids, ["2", "3"]);
+
+        pool.close().await;
+        Ok(())
+    }
+
+    #[sqlx::test(migrations = "./migrations", fixtures("../../fixtures/runs.sql"))]
+    async fn runs_keep_their_annotations(pool: sqlx::SqlitePool) -> anyhow::Result<()> {
+        let run_service = LocalDao::new(pool.clone());
+
+        let run = run_service.fetch("2").await?.expect("run 2 should exist");
+        assert!(run.annotations().is_empty());
+        let note = Annotation::new(1, Some("switched to jemalloc"), vec![]);
+        let labels = Annotation::new(2, None, vec![(String::from("pool"), String::from("8"))]);
+        let run = run
+            .with_annotation(note.clone())?
+            .with_annotation(labels.clone())?;
+        run_service.annotate(&run).await?;
+
+        let run = run_service.fetch("2").await?.expect("run 2 should exist");
+        assert_eq!(run.annotations(), [note, labels]);
+
+        pool.close().await;
+        Ok(())
+    }
+}
@@ -4,16 +4,50 @@
  * file, You can obtain one at https://mozilla.org/MPL/2.0/.
  */
 
-use anyhow::Context;
+use anyhow::{anyhow, Context};
 use async_trait::async_trait;
 
-#[derive(PartialEq, Debug, serde::Deserialize, serde::Serialize, sqlx::FromRow)]
+#[derive(PartialEq, Debug, Clone, serde::Deserialize, serde::Serialize, sqlx::FromRow)]
 pub struct ScenarioIteration {
     pub run_id: String,
     pub scenario_name: String,
     pub iteration: i64,
     pub start_time: i64,
     pub stop_time: i64,
+    /// Number of requests which succeeded when the scenario replays a recorded trace, energy per
+    /// request is over these.
+    pub requests: Option<i64>,
+    /// True if the iteration was stopped early because it went over its energy or power budget.
+    #[serde(default)]
+    pub budget_exceeded: bool,
+    /// True if the scenario's processes were restarted before the iteration, rather than kept
+    /// running from the previous one.
+    #[serde(default)]
+    pub cold_start: bool,
+    /// How many of the scenario's functional unit, e.g. requests or jobs, the iteration served.
+    /// Used to calculate its Software Carbon Intensity.
+    #[serde(default)]
+    pub functional_units: Option<f64>,
+    /// The energy of the iteration in joules, saved when its samples are pruned so it can still
+    /// be compared. None while the samples are kept.
+    #[serde(default)]
+    pub joules: Option<f64>,
+    /// The end of what the scenario's command printed, None if it was replayed.
+    #[serde(default)]
+    pub stdout: Option<String>,
+    #[serde(default)]
+    pub stderr: Option<String>,
+    /// None if the command was stopped, e.g. for going over budget, or the scenario was replayed.
+    #[serde(default)]
+    pub exit_code: Option<i64>,
+    /// True if the command failed or timed out. Only its output is kept, it's left out of the
+    /// energy stats.
+    #[serde(default)]
+    pub failed: bool,
+    /// Number of replayed requests which failed or got an error status, None unless the scenario
+    /// replays a recorded trace.
+    #[serde(default)]
+    pub failed_requests: Option<i64>,
 }
 impl ScenarioIteration {
     pub fn new(
@@ -22,6 +56,7 @@ impl ScenarioIteration {
         iteration: i64,
         start_time: i64,
         stop_time: i64,
+        requests: Option<i64>,
     ) -> Self {
         Self {
             run_id: String::from(run_id),
@@ -29,18 +64,35 @@ impl ScenarioIteration {
             iteration,
             start_time,
             stop_time,
+            requests,
+            budget_exceeded: false,
+            cold_start: false,
+            functional_units: None,
+            joules: None,
+            stdout: None,
+            stderr: None,
+            exit_code: None,
+            failed: false,
+            failed_requests: None,
         }
     }
 }
 
 #[async_trait]
 pub trait ScenarioIterationDao {
+    /// Fetches every iteration of the last `n` runs of a scenario in a project, runs of other
+    /// projects are left out. Iterations of runs which are still going are included.
     async fn fetch_last(
         &self,
         scenario_name: &str,
+        project: Option<&str>,
         n: u32,
     ) -> anyhow::Result<Vec<ScenarioIteration>>;
+    async fn fetch_by_run(&self, run_id: &str) -> anyhow::Result<Vec<ScenarioIteration>>;
     async fn persist(&self, scenario_iteration: &ScenarioIteration) -> anyhow::Result<()>;
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<()>;
+    /// Saves the energy of an iteration over the saved one, before its samples are pruned.
+    async fn summarise(&self, scenario_iteration: &ScenarioIteration) -> anyhow::Result<()>;
 }
 
 // //////////////////////////////////////
@@ -59,6 +111,7 @@ impl ScenarioIterationDao for LocalDao {
     async fn fetch_last(
         &self,
         scenario_name: &str,
+        project: Option<&str>,
         n: u32,
     ) -> anyhow::Result<Vec<ScenarioIteration>> {
         sqlx::query_as!(
@@ -69,14 +122,28 @@ impl ScenarioIterationDao for LocalDao {
             WHERE scenario_name = ?1 AND run_id in (
                 SELECT run_id 
                 FROM scenario_iteration 
-                WHERE scenario_name = ?1 
+                WHERE scenario_name = ?1 AND run_id NOT IN (
+                    SELECT run_id FROM run WHERE project IS NOT ?3
+                )
                 GROUP BY run_id 
                 ORDER BY start_time DESC
                 LIMIT ?2
             )
             "#,
             scenario_name,
-            n
+            n,
+            project
+        )
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching scenarios")
+    }
+
+    async fn fetch_by_run(&self, run_id: &str) -> anyhow::Result<Vec<ScenarioIteration>> {
+        sqlx::query_as!(
+            ScenarioIteration,
+            "SELECT * FROM scenario_iteration WHERE run_id = ?1 ORDER BY start_time",
+            run_id
         )
         .fetch_all(&self.pool)
         .await
@@ -84,17 +151,150 @@ impl ScenarioIterationDao for LocalDao {
     }
 
     async fn persist(&self, scenario_iteration: &ScenarioIteration) -> anyhow::Result<()> {
-        sqlx::query!("INSERT INTO scenario_iteration (run_id, scenario_name, iteration, start_time, stop_time) VALUES (?1, ?2, ?3, ?4, ?5)", 
+        sqlx::query!("INSERT INTO scenario_iteration (run_id, scenario_name, iteration, start_time, stop_time, requests, budget_exceeded, cold_start, functional_units, joules, stdout, stderr, exit_code, failed, failed_requests) VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15)",
             scenario_iteration.run_id,
             scenario_iteration.scenario_name,
             scenario_iteration.iteration,
             scenario_iteration.start_time,
-            scenario_iteration.stop_time)
+            scenario_iteration.stop_time,
+            scenario_iteration.requests,
+            scenario_iteration.budget_exceeded,
+            scenario_iteration.cold_start,
+            scenario_iteration.functional_units,
+            scenario_iteration.joules,
+            scenario_iteration.stdout,
+            scenario_iteration.stderr,
+            scenario_iteration.exit_code,
+            scenario_iteration.failed,
+            scenario_iteration.failed_requests)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error inserting scenario into db.")
+    }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<()> {
+        sqlx::query!("DELETE FROM scenario_iteration WHERE run_id = ?1", run_id)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error deleting scenarios from db.")
+    }
+
+    async fn summarise(&self, scenario_iteration: &ScenarioIteration) -> anyhow::Result<()> {
+        sqlx::query!(
+            "UPDATE scenario_iteration SET joules = ?1 WHERE run_id = ?2 AND scenario_name = ?3 AND iteration = ?4",
+            scenario_iteration.joules,
+            scenario_iteration.run_id,
+            scenario_iteration.scenario_name,
+            scenario_iteration.iteration
+        )
+        .execute(&self.pool)
+        .await
+        .map(|_| ())
+        .context("Error summarising scenario in db.")
+    }
+}
+
+// //////////////////////////////////////
+// PostgresDao
+
+pub struct PostgresDao {
+    pub pool: sqlx::PgPool,
+}
+impl PostgresDao {
+    pub fn new(pool: sqlx::PgPool) -> Self {
+        Self { pool }
+    }
+}
+#[async_trait]
+impl ScenarioIterationDao for PostgresDao {
+    async fn fetch_last(
+        &self,
+        scenario_name: &str,
+        project: Option<&str>,
+        n: u32,
+    ) -> anyhow::Result<Vec<ScenarioIteration>> {
+        // Postgres can't order the grouped runs by a column which isn't aggregated
+        sqlx::query_as::<_, ScenarioIteration>(
+            r#"
+            SELECT *
+            FROM scenario_iteration
+            WHERE scenario_name = $1 AND run_id in (
+                SELECT run_id
+                FROM scenario_iteration
+                WHERE scenario_name = $1 AND run_id NOT IN (
+                    SELECT run_id FROM run WHERE project IS DISTINCT FROM $3
+                )
+                GROUP BY run_id
+                ORDER BY MAX(start_time) DESC
+                LIMIT $2
+            )
+            "#,
+        )
+        .bind(scenario_name)
+        .bind(n as i64)
+        .bind(project)
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching scenarios")
+    }
+
+    async fn fetch_by_run(&self, run_id: &str) -> anyhow::Result<Vec<ScenarioIteration>> {
+        sqlx::query_as::<_, ScenarioIteration>(
+            "SELECT * FROM scenario_iteration WHERE run_id = $1 ORDER BY start_time",
+        )
+        .bind(run_id)
+        .fetch_all(&self.pool)
+        .await
+        .context("Error fetching scenarios")
+    }
+
+    async fn persist(&self, scenario_iteration: &ScenarioIteration) -> anyhow::Result<()> {
+        sqlx::query("INSERT INTO scenario_iteration (run_id, scenario_name, iteration, start_time, stop_time, requests, budget_exceeded, cold_start, functional_units, joules, stdout, stderr, exit_code, failed, failed_requests) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)")
+            .bind(&scenario_iteration.run_id)
+            .bind(&scenario_iteration.scenario_name)
+            .bind(scenario_iteration.iteration)
+            .bind(scenario_iteration.start_time)
+            .bind(scenario_iteration.stop_time)
+            .bind(scenario_iteration.requests)
+            .bind(scenario_iteration.budget_exceeded)
+            .bind(scenario_iteration.cold_start)
+            .bind(scenario_iteration.functional_units)
+            .bind(scenario_iteration.joules)
+            .bind(&scenario_iteration.stdout)
+            .bind(&scenario_iteration.stderr)
+            .bind(scenario_iteration.exit_code)
+            .bind(scenario_iteration.failed)
+            .bind(scenario_iteration.failed_requests)
             .execute(&self.pool)
             .await
             .map(|_| ())
             .context("Error inserting scenario into db.")
     }
+
+    async fn delete_by_run(&self, run_id: &str) -> anyhow::Result<()> {
+        sqlx::query("DELETE FROM scenario_iteration WHERE run_id = $1")
+            .bind(run_id)
+            .execute(&self.pool)
+            .await
+            .map(|_| ())
+            .context("Error deleting scenarios from db.")
+    }
+
+    async fn summarise(&self, scenario_iteration: &ScenarioIteration) -> anyhow::Result<()> {
+        sqlx::query(
+            "UPDATE scenario_iteration SET joules = $1 WHERE run_id = $2 AND scenario_name = $3 AND iteration = $4",
+        )
+        .bind(scenario_iteration.joules)
+        .bind(&scenario_iteration.run_id)
+        .bind(&scenario_iteration.scenario_name)
+        .bind(scenario_iteration.iteration)
+        .execute(&self.pool)
+        .await
+        .map(|_| ())
+        .context("Error summarising scenario in db.")
+    }
 }
 
 // //////////////////////////////////////
@@ -106,10 +306,15 @@ pub struct RemoteDao {
 }
 impl RemoteDao {
     pub fn new(base_url: &str) -> Self {
+        Self::with_client(base_url, reqwest::Client::new())
+    }
+
+    /// The same as [`RemoteDao::new`] with a client which e.g. authenticates every request.
+    pub fn with_client(base_url: &str, client: reqwest::Client) -> Self {
         let base_url = base_url.strip_suffix('/').unwrap_or(base_url);
         Self {
             base_url: String::from(base_url),
-            client: reqwest::Client::new(),
+            client,
         }
     }
 }
@@ -118,11 +323,22 @@ impl ScenarioIterationDao for RemoteDao {
     async fn fetch_last(
         &self,
         _scenario_name: &str,
+        _project: Option<&str>,
         _n: u32,
     ) -> anyhow::Result<Vec<ScenarioIteration>> {
         todo!()
     }
 
+    async fn fetch_by_run(&self, run_id: &str) -> anyhow::Result<Vec<ScenarioIteration>> {
+        self.client
+            .get(format!("{}/scenario/{run_id}", self.base_url))
+            .send()
+            .await?
+            .json::<Vec<ScenarioIteration>>()
+            .await
+            .context("Error fetching scenarios from remote server")
+    }
+
     async fn persist(&self, scenario_iteration: &ScenarioIteration) -> anyhow::Result<()> {
         self.client
             .post(format!("{}/scenario", self.base_url))
@@ -133,6 +349,18 @@ impl ScenarioIterationDao for RemoteDao {
             .map(|_| ())
             .context("Error persisting scenario to remote server")
     }
+
+    async fn delete_by_run(&self, _run_id: &str) -> anyhow::Result<()> {
+        Err(anyhow!(
+            "Scenarios can't be deleted from a remote server, prune it on the server instead"
+        ))
+    }
+
+    async fn summarise(&self, _scenario_iteration: &ScenarioIteration) -> anyhow::Result<()> {
+        Err(anyhow!(
+            "Scenarios can't be summarised on a remote server, prune it on the server instead"
+        ))
+    }
 }
 
 #[cfg(test)]
@@ -147,7 +375,7 @@ mod tests {
         let scenario_service = LocalDao::new(pool.clone());
 
         // fetch the latest scenario_1 run
-        let scenario_iterations = scenario_service.fetch_last("scenario_1", 1).await?;
+        let scenario_iterations = scenario_service.fetch_last("scenario_1", None, 1).await?;
 
         let run_ids = scenario_iterations
             .iter()
@@ -162,7 +390,7 @@ mod tests {
         assert_eq!(iterations, vec![1]);
 
         // fetch the last 2 scenario_3 runs
-        let scenario_iterations = scenario_service.fetch_last("scenario_3", 2).await?;
+        let scenario_iterations = scenario_service.fetch_last("scenario_3", None, 2).await?;
 
         let run_ids = scenario_iterations
             .iter()
@@ -178,4 +406,22 @@ mod tests {
 
         Ok(())
     }
+
+    #[sqlx::test(migrations = "./migrations")]
+    async fn iterations_keep_their_output(pool: sqlx::SqlitePool) -> anyhow::Result<()> {
+        let scenario_service = LocalDao::new(pool.clone());
+        let scenario_iteration = ScenarioIteration {
+            stdout: Some(String::from("served 250 requests\n")),
+            stderr: Some(String::new()),
+            exit_code: Some(0),
+            ..ScenarioIteration::new("1", "checkout", 0, 1000, 2000, None)
+        };
+        scenario_service.persist(&scenario_iteration).await?;
+
+        assert_eq!(
+            scenario_service.fetch_by_run("1").await?,
+            [scenario_iteration]
+        );
+        Ok(())
+    }
 }
@@ -1,20 +1,45 @@
-use crate::data_access::{cpu_metrics::CpuMetrics, scenario_iteration::ScenarioIteration};
+use crate::{
+    carbon,
+    config::{Blend, Cost},
+    data_access::{
+        cpu_metrics::CpuMetrics, power_metrics::PowerMetrics, resource_metrics::ResourceMetrics,
+        run::Run, scenario_iteration::ScenarioIteration,
+    },
+    energy::{self, Energy},
+    metrics::PowerComponent,
+};
 use itertools::{Itertools, MinMaxResult};
-use std::collections::{hash_map::Entry, HashMap};
+use std::{
+    collections::{hash_map::Entry, BTreeMap, HashMap},
+    time::Duration,
+};
 
 /// Read-only struct containing metrics for a single process.
 #[derive(Debug)]
 pub struct ProcessMetrics {
     process_id: String,
+    process_name: String,
     cpu_usage_minmax: MinMaxResult<f64>,
     cpu_usage_mean: f64,
     cpu_usage_total: f64,
+    cpu_seconds: f64,
+    cpu_share_seconds: f64,
+    measured_joules: BTreeMap<String, f64>,
+    network_bytes: Option<f64>,
+    disk_io: Option<(f64, f64)>,
+    peak_memory_bytes: Option<f64>,
+    throttled_secs: Option<f64>,
 }
 impl ProcessMetrics {
     pub fn process_id(&self) -> &str {
         &self.process_id
     }
 
+    /// The name the process was observed with, shared by every pod of a deployment.
+    pub fn process_name(&self) -> &str {
+        &self.process_name
+    }
+
     pub fn cpu_usage_minmax(&self) -> &MinMaxResult<f64> {
         &self.cpu_usage_minmax
     }
@@ -26,6 +51,83 @@ impl ProcessMetrics {
     pub fn cpu_usage_total(&self) -> f64 {
         self.cpu_usage_total
     }
+
+    pub fn cpu_seconds(&self) -> f64 {
+        self.cpu_seconds
+    }
+
+    pub fn cpu_share_seconds(&self) -> f64 {
+        self.cpu_share_seconds
+    }
+
+    /// Energy measured by power sources and attributed to this process, keyed by component.
+    pub fn measured_joules(&self) -> &BTreeMap<String, f64> {
+        &self.measured_joules
+    }
+
+    /// # Arguments
+    /// * component - the component to get the energy for, e.g. `cpu`
+    ///
+    /// # Returns
+    /// The measured energy in joules, None if no power source measured the component
+    pub fn measured_joules_for(&self, component: &str) -> Option<f64> {
+        self.measured_joules.get(component).copied()
+    }
+
+    /// The bytes sent and received over the network, None if the process's network traffic
+    /// wasn't observed.
+    pub fn network_bytes(&self) -> Option<f64> {
+        self.network_bytes
+    }
+
+    /// The bytes read from and written to storage along with the number of operations, None if
+    /// the process's storage I/O wasn't observed.
+    pub fn disk_io(&self) -> Option<(f64, f64)> {
+        self.disk_io
+    }
+
+    /// The component whose measurement is reported as the process's energy. Whole machine power
+    /// includes the CPU and every other component so it takes the place of the CPU measurement
+    /// when available.
+    pub fn headline_component(&self) -> PowerComponent {
+        match self.measured_joules_for(PowerComponent::Machine.as_str()) {
+            Some(_) => PowerComponent::Machine,
+            None => PowerComponent::Cpu,
+        }
+    }
+
+    /// # Arguments
+    /// * tdp - the TDP of the CPU the process ran on
+    ///
+    /// # Returns
+    /// The energy of the process estimated by the TDP model, None if the TDP is unknown
+    pub fn estimated_joules(&self, tdp: Option<f64>) -> Option<f64> {
+        tdp.map(|tdp| energy::estimate_joules(self.cpu_share_seconds, tdp))
+    }
+
+    /// Combines the estimated and measured energy of the process, see [`energy::combine`].
+    ///
+    /// # Arguments
+    /// * tdp - the TDP of the CPU the process ran on
+    /// * blend - confidence in estimates and measurements
+    ///
+    /// # Returns
+    /// The energy of the process, None if it could neither be estimated nor measured
+    pub fn energy(&self, tdp: Option<f64>, blend: Option<&Blend>) -> Option<Energy> {
+        let measured = self.measured_joules_for(self.headline_component().as_str());
+        energy::combine(self.estimated_joules(tdp), measured, blend)
+    }
+
+    /// The most memory the process used in bytes, None if its memory wasn't observed.
+    pub fn peak_memory_bytes(&self) -> Option<f64> {
+        self.peak_memory_bytes
+    }
+
+    /// The time the process spent throttled by its CPU quota in seconds, None if the process has
+    /// no quota of its own.
+    pub fn throttled_secs(&self) -> Option<f64> {
+        self.throttled_secs
+    }
 }
 
 /// Associates a single ScenarioIteration with all the metrics captured for it.
@@ -33,12 +135,21 @@ impl ProcessMetrics {
 pub struct IterationWithMetrics {
     scenario_iteration: ScenarioIteration,
     cpu_metrics: Vec<CpuMetrics>,
+    power_metrics: Vec<PowerMetrics>,
+    resource_metrics: Vec<ResourceMetrics>,
 }
 impl IterationWithMetrics {
-    pub fn new(scenario_it: ScenarioIteration, cpu_metrics: Vec<CpuMetrics>) -> Self {
+    pub fn new(
+        scenario_it: ScenarioIteration,
+        cpu_metrics: Vec<CpuMetrics>,
+        power_metrics: Vec<PowerMetrics>,
+        resource_metrics: Vec<ResourceMetrics>,
+    ) -> Self {
         Self {
             scenario_iteration: scenario_it,
             cpu_metrics,
+            power_metrics,
+            resource_metrics,
         }
     }
 
@@ -46,10 +157,158 @@ impl IterationWithMetrics {
         &self.scenario_iteration
     }
 
+    /// The wall-clock time of the iteration.
+    pub fn duration(&self) -> Duration {
+        let millis = self.scenario_iteration.stop_time - self.scenario_iteration.start_time;
+        Duration::from_millis(millis.max(0) as u64)
+    }
+
     pub fn cpu_metrics(&self) -> &[CpuMetrics] {
         &self.cpu_metrics
     }
 
+    pub fn power_metrics(&self) -> &[PowerMetrics] {
+        &self.power_metrics
+    }
+
+    pub fn resource_metrics(&self) -> &[ResourceMetrics] {
+        &self.resource_metrics
+    }
+
+    /// # Arguments
+    /// * tdp - the TDP of the run, if there is one
+    /// * blend - confidence in estimates and measurements
+    ///
+    /// # Returns
+    /// The energy saved when the iteration's samples were pruned or downsampled, otherwise the
+    /// energy of every process in the iteration in joules. None if the energy of no process
+    /// could be worked out
+    pub fn joules(&self, tdp: Option<f64>, blend: Option<&Blend>) -> Option<f64> {
+        self.scenario_iteration.joules.or_else(|| {
+            self.accumulate_by_process()
+                .iter()
+                .filter_map(|metrics| metrics.energy(tdp, blend))
+                .map(|energy| energy.joules())
+                .reduce(|a, b| a + b)
+        })
+    }
+
+    /// # Returns
+    /// The bytes sent and received by a process over the iteration, None if its network traffic
+    /// wasn't observed
+    fn network_bytes(&self, process_id: &str) -> Option<f64> {
+        let resource_metrics = self
+            .resource_metrics
+            .iter()
+            .filter(|m| m.process_id == process_id)
+            .sorted_by_key(|m| m.timestamp)
+            .collect::<Vec<_>>();
+
+        let sent = counter_increase(resource_metrics.iter().filter_map(|m| m.bytes_sent));
+        let received = counter_increase(resource_metrics.iter().filter_map(|m| m.bytes_received));
+        match (sent, received) {
+            (None, None) => None,
+            (sent, received) => Some((sent.unwrap_or(0) + received.unwrap_or(0)) as f64),
+        }
+    }
+
+    /// # Returns
+    /// The bytes and operations a process read and wrote over the iteration, None if its storage
+    /// I/O wasn't observed
+    fn disk_io(&self, process_id: &str) -> Option<(f64, f64)> {
+        let resource_metrics = self
+            .resource_metrics
+            .iter()
+            .filter(|m| m.process_id == process_id)
+            .sorted_by_key(|m| m.timestamp)
+            .collect::<Vec<_>>();
+
+        let increase = |counter: fn(&ResourceMetrics) -> Option<i64>| {
+            counter_increase(resource_metrics.iter().filter_map(|m| counter(m)))
+        };
+        let read_bytes = increase(|m| m.read_bytes)?;
+        let write_bytes = increase(|m| m.write_bytes)?;
+        let read_ops = increase(|m| m.read_ops)?;
+        let write_ops = increase(|m| m.write_ops)?;
+        Some((
+            (read_bytes + write_bytes) as f64,
+            (read_ops + write_ops) as f64,
+        ))
+    }
+
+    /// # Returns
+    /// The most memory a process used over the iteration in bytes, None if its memory wasn't
+    /// observed
+    fn peak_memory_bytes(&self, process_id: &str) -> Option<f64> {
+        self.resource_metrics
+            .iter()
+            .filter(|m| m.process_id == process_id)
+            .filter_map(|m| m.memory_bytes)
+            .max()
+            .map(|bytes| bytes as f64)
+    }
+
+    /// # Returns
+    /// The time a process spent throttled over the iteration in seconds, None if it wasn't
+    /// throttled by a CPU quota of its own
+    fn throttled_secs(&self, process_id: &str) -> Option<f64> {
+        let throttled_ns = counter_increase(
+            self.resource_metrics
+                .iter()
+                .filter(|m| m.process_id == process_id)
+                .sorted_by_key(|m| m.timestamp)
+                .filter_map(|m| m.throttled_ns),
+        )?;
+        Some(throttled_ns as f64 / 1_000_000_000.0)
+    }
+
+    /// Works out how much of the measured energy of each component belongs to a process. Power
+    /// sources which attribute power to processes themselves are used as is, otherwise the power
+    /// of each device is attributed by the process's share of the CPU. Memory power is attributed
+    /// by the process's share of the host's memory when its memory was observed.
+    fn measured_joules(
+        &self,
+        process_id: &str,
+        cpu_metrics: &[&CpuMetrics],
+    ) -> BTreeMap<String, f64> {
+        let mut measured_joules = BTreeMap::new();
+        let resource_metrics = self
+            .resource_metrics
+            .iter()
+            .filter(|m| m.process_id == process_id)
+            .collect::<Vec<_>>();
+
+        let by_component = self
+            .power_metrics
+            .iter()
+            .into_group_map_by(|m| m.component.as_str());
+        for (component, power_metrics) in by_component.into_iter() {
+            let attributed_by_source = power_metrics.iter().any(|m| m.process_id.is_some());
+
+            let by_source = power_metrics
+                .into_iter()
+                .filter(|m| !attributed_by_source || m.process_id.as_deref() == Some(process_id))
+                .into_group_map_by(|m| m.source.as_str());
+            let joules = by_source
+                .values()
+                .filter_map(|power_metrics| {
+                    if attributed_by_source {
+                        Some(energy::integrate_joules(power_metrics))
+                    } else if component == PowerComponent::Dram.as_str() {
+                        energy::attribute_memory_joules(&resource_metrics, power_metrics)
+                            .or_else(|| energy::attribute_joules(cpu_metrics, power_metrics))
+                    } else {
+                        energy::attribute_joules(cpu_metrics, power_metrics)
+                    }
+                })
+                .sum::<f64>();
+
+            measured_joules.insert(String::from(component), joules);
+        }
+
+        measured_joules
+    }
+
     pub fn accumulate_by_process(&self) -> Vec<ProcessMetrics> {
         let mut metrics_by_process: HashMap<String, Vec<&CpuMetrics>> = HashMap::new();
         for metric in self.cpu_metrics.iter() {
@@ -60,18 +319,48 @@ impl IterationWithMetrics {
                 .or_insert(vec![metric]); // if entry doesn't exist then create a new vec
         }
 
+        // some power sources, e.g. Kepler, measure processes which cardamon can't observe itself
+        for metric in self.power_metrics.iter() {
+            if let Some(proc_id) = &metric.process_id {
+                metrics_by_process.entry(proc_id.clone()).or_default();
+            }
+        }
+
         metrics_by_process
             .into_iter()
             .map(|(process_id, cpu_metrics)| {
                 let cpu_usage_minmax = cpu_metrics.iter().map(|m| m.cpu_usage).minmax();
                 let cpu_usage_total = cpu_metrics.iter().fold(0.0, |acc, m| acc + m.cpu_usage);
-                let cpu_usage_mean = cpu_usage_total / cpu_metrics.len() as f64;
+                let cpu_usage_mean = if cpu_metrics.is_empty() {
+                    0.0
+                } else {
+                    cpu_usage_total / cpu_metrics.len() as f64
+                };
+                let cpu_seconds = energy::cpu_seconds(&cpu_metrics);
+                let cpu_share_seconds = energy::cpu_share_seconds(&cpu_metrics);
+                let measured_joules = self.measured_joules(&process_id, &cpu_metrics);
+                let network_bytes = self.network_bytes(&process_id);
+                let disk_io = self.disk_io(&process_id);
+                let peak_memory_bytes = self.peak_memory_bytes(&process_id);
+                let throttled_secs = self.throttled_secs(&process_id);
+                let process_name = cpu_metrics
+                    .first()
+                    .map(|m| m.process_name.clone())
+                    .unwrap_or(process_id.clone());
 
                 ProcessMetrics {
                     process_id,
+                    process_name,
                     cpu_usage_minmax,
                     cpu_usage_mean,
                     cpu_usage_total,
+                    cpu_seconds,
+                    cpu_share_seconds,
+                    measured_joules,
+                    network_bytes,
+                    disk_io,
+                    peak_memory_bytes,
+                    throttled_secs,
                 }
             })
             .collect()
@@ -82,16 +371,32 @@ impl IterationWithMetrics {
 /// cardamon runs.
 pub struct ObservationDataset {
     data: Vec<IterationWithMetrics>,
+    runs: Vec<Run>,
+    /// The metrics captured while measuring the idle baseline of each run.
+    baselines: Vec<IterationWithMetrics>,
 }
 impl<'a> ObservationDataset {
-    pub fn new(data: Vec<IterationWithMetrics>) -> Self {
-        Self { data }
+    pub fn new(
+        data: Vec<IterationWithMetrics>,
+        runs: Vec<Run>,
+        baselines: Vec<IterationWithMetrics>,
+    ) -> Self {
+        Self {
+            data,
+            runs,
+            baselines,
+        }
     }
 
     pub fn data(&'a self) -> &'a [IterationWithMetrics] {
         &self.data
     }
 
+    /// The provenance of the runs in the dataset.
+    pub fn runs(&'a self) -> &'a [Run] {
+        &self.runs
+    }
+
     pub fn by_scenario(&'a self) -> Vec<ScenarioDataset<'a>> {
         // get all the scenarios in the observation
         let scenario_names = self
@@ -113,6 +418,8 @@ impl<'a> ObservationDataset {
                 ScenarioDataset {
                     scenario_name,
                     data,
+                    runs: &self.runs,
+                    baselines: &self.baselines,
                 }
             })
             .collect::<Vec<_>>()
@@ -127,6 +434,8 @@ impl<'a> ObservationDataset {
 pub struct ScenarioDataset<'a> {
     scenario_name: &'a str,
     data: Vec<&'a IterationWithMetrics>,
+    runs: &'a [Run],
+    baselines: &'a [IterationWithMetrics],
 }
 impl<'a> ScenarioDataset<'a> {
     pub fn scenario_name(&'a self) -> &'a str {
@@ -157,6 +466,11 @@ impl<'a> ScenarioDataset<'a> {
                 RunDataset {
                     scenario_name: self.scenario_name,
                     run_id,
+                    run: self.runs.iter().find(|run| &run.run_id == run_id),
+                    baseline: self
+                        .baselines
+                        .iter()
+                        .find(|x| &x.scenario_iteration.run_id == run_id),
                     data,
                 }
             })
@@ -172,6 +486,8 @@ impl<'a> ScenarioDataset<'a> {
 pub struct RunDataset<'a> {
     scenario_name: &'a str,
     run_id: &'a str,
+    run: Option<&'a Run>,
+    baseline: Option<&'a IterationWithMetrics>,
     data: Vec<&'a IterationWithMetrics>,
 }
 impl<'a> RunDataset<'a> {
@@ -183,10 +499,124 @@ impl<'a> RunDataset<'a> {
         self.run_id
     }
 
+    /// The provenance of this run. Runs recorded by older versions of cardamon have none.
+    pub fn run(&'a self) -> Option<&'a Run> {
+        self.run
+    }
+
     pub fn by_iterations(&'a self) -> &'a [&'a IterationWithMetrics] {
         &self.data
     }
 
+    /// The metrics captured while measuring the run's idle baseline, None if it wasn't measured.
+    pub fn baseline(&'a self) -> Option<&'a IterationWithMetrics> {
+        self.baseline
+    }
+
+    /// The idle power of each process, worked out from the energy it used during the run's
+    /// baseline in the same way as the energy of a scenario.
+    ///
+    /// # Arguments
+    /// * tdp - the TDP of the run, if there is one
+    /// * blend - confidence in estimates and measurements
+    ///
+    /// # Returns
+    /// The idle power in watts keyed by process id, empty if no baseline was measured
+    pub fn baseline_watts(
+        &'a self,
+        tdp: Option<f64>,
+        blend: Option<&Blend>,
+    ) -> HashMap<String, f64> {
+        let Some(baseline) = self.baseline else {
+            return HashMap::new();
+        };
+        let secs = baseline.duration().as_secs_f64();
+        if secs == 0.0 {
+            return HashMap::new();
+        }
+
+        baseline
+            .accumulate_by_process()
+            .into_iter()
+            .filter_map(|metrics| {
+                let joules = metrics.energy(tdp, blend)?.joules();
+                Some((metrics.process_id, joules / secs))
+            })
+            .collect()
+    }
+
+    /// The mean wall-clock time of an iteration in this run in seconds.
+    pub fn mean_iteration_secs(&'a self) -> f64 {
+        if self.data.is_empty() {
+            0.0
+        } else {
+            self.wall_clock().as_secs_f64() / self.data.len() as f64
+        }
+    }
+
+    /// The mean number of requests which succeeded per iteration, only available for scenarios
+    /// which replay a recorded trace.
+    pub fn requests_per_iteration(&'a self) -> Option<f64> {
+        let requests = self
+            .data
+            .iter()
+            .filter_map(|x| x.scenario_iteration.requests)
+            .collect::<Vec<_>>();
+
+        if requests.is_empty() {
+            None
+        } else {
+            Some(requests.iter().sum::<i64>() as f64 / requests.len() as f64)
+        }
+    }
+
+    /// The mean number of replayed requests which failed per iteration, only available for
+    /// scenarios which replay a recorded trace.
+    pub fn failed_requests_per_iteration(&'a self) -> Option<f64> {
+        let failed = self
+            .data
+            .iter()
+            .filter_map(|x| x.scenario_iteration.failed_requests)
+            .collect::<Vec<_>>();
+
+        if failed.is_empty() {
+            None
+        } else {
+            Some(failed.iter().sum::<i64>() as f64 / failed.len() as f64)
+        }
+    }
+
+    /// The mean number of functional units served per iteration, only available for scenarios
+    /// with a functional unit.
+    pub fn functional_units_per_iteration(&'a self) -> Option<f64> {
+        let units = self
+            .data
+            .iter()
+            .filter_map(|x| x.scenario_iteration.functional_units)
+            .collect::<Vec<_>>();
+
+        if units.is_empty() {
+            None
+        } else {
+            Some(units.iter().sum::<f64>() / units.len() as f64)
+        }
+    }
+
+    /// True if any power source took readings during this run.
+    pub fn has_power_metrics(&'a self) -> bool {
+        self.data.iter().any(|x| !x.power_metrics.is_empty())
+    }
+
+    /// The total wall-clock time of every iteration in this run.
+    pub fn wall_clock(&'a self) -> Duration {
+        let millis = self
+            .data
+            .iter()
+            .map(|x| x.scenario_iteration.stop_time - x.scenario_iteration.start_time)
+            .sum::<i64>();
+        Duration::from_millis(millis.max(0) as u64)
+    }
+
     pub fn averaged(&'a self) -> Vec<ProcessMetrics> {
         let all_process_metrics = self
             .data
@@ -211,53 +641,909 @@ impl<'a> RunDataset<'a> {
 
         // average across iterations
         process_metrics_to_iterations
+            .into_values()
+            .filter_map(average_iterations)
+            .collect::<Vec<_>>()
+    }
+
+    /// The energy of every process summed for each iteration of this run. Iterations in which
+    /// the energy of no process could be worked out are left out.
+    ///
+    /// # Arguments
+    /// * tdp - the TDP of the run, if there is one
+    /// * blend - confidence in estimates and measurements
+    ///
+    /// # Returns
+    /// The energy of each iteration in joules, in the order they ran
+    pub fn iteration_joules(&'a self, tdp: Option<f64>, blend: Option<&Blend>) -> Vec<f64> {
+        self.data
+            .iter()
+            .filter_map(|iteration| iteration.joules(tdp, blend))
+            .collect()
+    }
+
+    /// # Arguments
+    /// * tdp - the TDP of the run, if there is one
+    /// * blend - confidence in estimates and measurements
+    ///
+    /// * outlier_threshold - iterations with a modified z-score above this are left out
+    ///
+    /// # Returns
+    /// Statistics of the energy of the iterations of this run, None if no iteration has any
+    pub fn energy_stats(
+        &'a self,
+        tdp: Option<f64>,
+        blend: Option<&Blend>,
+        outlier_threshold: Option<f64>,
+    ) -> Option<Stats> {
+        Stats::excluding_outliers(&self.iteration_joules(tdp, blend), outlier_threshold)
+    }
+
+    /// # Returns
+    /// The iterations left out of the energy stats as outliers, in the order they ran
+    pub fn outlier_iterations(
+        &'a self,
+        tdp: Option<f64>,
+        blend: Option<&Blend>,
+        outlier_threshold: f64,
+    ) -> Vec<i64> {
+        let (iterations, joules): (Vec<_>, Vec<_>) = self
+            .data
+            .iter()
+            .filter_map(|it| Some((it.scenario_iteration().iteration, it.joules(tdp, blend)?)))
+            .unzip();
+        iterations
             .into_iter()
-            .flat_map(|(_, process_metrics)| {
-                process_metrics.into_iter().reduce(|a, b| {
-                    let a_minmax = match a.cpu_usage_minmax {
-                        MinMaxResult::NoElements => None,
-                        MinMaxResult::OneElement(val) => Some((val, val)),
-                        MinMaxResult::MinMax(min, max) => Some((min, max)),
-                    };
-                    let b_minmax = match b.cpu_usage_minmax {
-                        MinMaxResult::NoElements => None,
-                        MinMaxResult::OneElement(val) => Some((val, val)),
-                        MinMaxResult::MinMax(min, max) => Some((min, max)),
-                    };
-
-                    let cpu_usage_minmax = if a_minmax.is_some() && b_minmax.is_some() {
-                        let (a_min, a_max) = a_minmax.unwrap();
-                        let (b_min, b_max) = b_minmax.unwrap();
-                        MinMaxResult::MinMax(a_min + b_min / 2.0, a_max + b_max / 2.0)
-                    } else {
-                        MinMaxResult::NoElements
-                    };
-
-                    ProcessMetrics {
-                        process_id: a.process_id,
-                        cpu_usage_minmax,
-                        cpu_usage_mean: a.cpu_usage_mean + b.cpu_usage_mean / 2.0,
-                        cpu_usage_total: a.cpu_usage_total + b.cpu_usage_total / 2.0,
+            .zip(outliers(&joules, outlier_threshold))
+            .filter_map(|(iteration, outlier)| outlier.then_some(iteration))
+            .collect()
+    }
+
+    /// # Arguments
+    /// * tdp - the TDP of the run, if there is one
+    /// * blend - confidence in estimates and measurements
+    /// * pue - the overhead of the facility, which is paid for along with the machine
+    /// * cost - the price of electricity
+    ///
+    /// # Returns
+    /// What the electricity of each iteration cost at the price when it started, iterations
+    /// without energy or a price are left out
+    pub fn iteration_costs(
+        &'a self,
+        tdp: Option<f64>,
+        blend: Option<&Blend>,
+        pue: Option<f64>,
+        cost: &Cost,
+    ) -> Vec<f64> {
+        self.data
+            .iter()
+            .filter_map(|iteration| {
+                let joules = carbon::facility_joules(iteration.joules(tdp, blend)?, pue);
+                let price = cost.price_per_kwh(iteration.scenario_iteration.start_time)?;
+                Some(carbon::electricity_cost(joules, price))
+            })
+            .collect()
+    }
+
+    /// The statistics of how long each iteration took in seconds, None if there are none.
+    pub fn duration_stats(&'a self) -> Option<Stats> {
+        let secs = self
+            .data
+            .iter()
+            .map(|it| it.duration().as_secs_f64())
+            .collect::<Vec<_>>();
+        Stats::of(&secs)
+    }
+}
+
+/// Summary statistics of something measured once per iteration, e.g. energy. A single iteration
+/// is noisy so comparisons should be made between means and take the spread into account.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Stats {
+    pub iterations: usize,
+    pub mean: f64,
+    /// The 50th percentile.
+    pub median: f64,
+    /// The 90th and 99th percentiles show the tail, e.g. iterations slowed by garbage collection.
+    pub p90: f64,
+    pub p99: f64,
+    /// The sample standard deviation, 0 for a single iteration.
+    pub stddev: f64,
+    pub min: f64,
+    pub max: f64,
+    /// How many values were left out as outliers, they're still in the raw data.
+    pub outliers: usize,
+}
+impl Stats {
+    /// # Returns
+    /// The statistics of the values, None if there are none
+    pub fn of(values: &[f64]) -> Option<Self> {
+        if values.is_empty() {
+            return None;
+        }
+
+        let sorted = values
+            .iter()
+            .copied()
+            .sorted_by(|a, b| a.total_cmp(b))
+            .collect::<Vec<_>>();
+        let n = sorted.len();
+        let mean = sorted.iter().sum::<f64>() / n as f64;
+        // interpolated between the closest ranks, so the median of an even count is the mean of
+        // the middle two
+        let percentile = |p: f64| {
+            let rank = p / 100.0 * (n - 1) as f64;
+            let (lower, upper) = (rank.floor() as usize, rank.ceil() as usize);
+            sorted[lower] + (sorted[upper] - sorted[lower]) * (rank - lower as f64)
+        };
+        let stddev = if n > 1 {
+            let variance = sorted.iter().map(|x| (x - mean).powi(2)).sum::<f64>() / (n - 1) as f64;
+            variance.sqrt()
+        } else {
+            0.0
+        };
+
+        Some(Self {
+            iterations: n,
+            mean,
+            median: percentile(50.0),
+            p90: percentile(90.0),
+            p99: percentile(99.0),
+            stddev,
+            min: sorted[0],
+            max: sorted[n - 1],
+            outliers: 0,
+        })
+    }
+
+    /// # Arguments
+    /// * threshold - values with a modified z-score above this are left out, none are if it's
+    ///   None
+    ///
+    /// # Returns
+    /// The statistics of the values which aren't outliers, None if there are none
+    pub fn excluding_outliers(values: &[f64], threshold: Option<f64>) -> Option<Self> {
+        let Some(threshold) = threshold else {
+            return Self::of(values);
+        };
+        let kept = values
+            .iter()
+            .zip(outliers(values, threshold))
+            .filter_map(|(value, outlier)| (!outlier).then_some(*value))
+            .collect::<Vec<_>>();
+        Some(Self {
+            outliers: values.len() - kept.len(),
+            ..Self::of(&kept)?
+        })
+    }
+
+    /// The standard deviation as a percentage of the mean.
+    pub fn relative_stddev(&self) -> f64 {
+        if self.mean == 0.0 {
+            0.0
+        } else {
+            self.stddev / self.mean * 100.0
+        }
+    }
+}
+
+/// Flags values far from the rest, e.g. an iteration slowed down by a background OS update. The
+/// modified z-score of a value is its distance from the median in median absolute deviations,
+/// scaled to be comparable with a z-score. Unlike the mean and standard deviation the median and
+/// its absolute deviation aren't dragged along by the outliers themselves.
+///
+/// # Arguments
+/// * values - something measured once per iteration
+/// * threshold - the modified z-score above which a value is an outlier
+///
+/// # Returns
+/// Whether each value is an outlier, none are unless there are at least 3 values
+pub fn outliers(values: &[f64], threshold: f64) -> Vec<bool> {
+    let median = |values: &[f64]| Stats::of(values).map(|stats| stats.median);
+    let Some(centre) = median(values).filter(|_| values.len() > 2) else {
+        return vec![false; values.len()];
+    };
+    let deviations = values
+        .iter()
+        .map(|value| (value - centre).abs())
+        .collect::<Vec<_>>();
+    let mad = median(&deviations).unwrap_or_default();
+    // more than half the values are the same, the mean absolute deviation is used instead
+    let scale = if mad > 0.0 {
+        1.4826 * mad
+    } else {
+        1.2533 * deviations.iter().sum::<f64>() / deviations.len() as f64
+    };
+    deviations
+        .iter()
+        .map(|deviation| scale > 0.0 && deviation / scale > threshold)
+        .collect()
+}
+
+/// Groups processes observed under the same name, e.g. the pods of a deployment.
+///
+/// # Arguments
+/// * process_metrics - the metrics of each process
+///
+/// # Returns
+/// The processes sharing each name, ordered by name
+pub fn by_process_name(process_metrics: &[ProcessMetrics]) -> Vec<(&str, Vec<&ProcessMetrics>)> {
+    process_metrics
+        .iter()
+        .into_group_map_by(|m| m.process_name.as_str())
+        .into_iter()
+        .sorted_by_key(|(name, _)| *name)
+        .collect()
+}
+
+/// Averages the metrics of a process over the iterations it was observed in. Metrics which
+/// were only observed in some iterations, e.g. a component only measured in one of them, are
+/// averaged over those iterations. The range of the CPU usage spans every iteration.
+///
+/// # Returns
+/// The averaged metrics, None if there are no iterations
+fn average_iterations(iterations: Vec<ProcessMetrics>) -> Option<ProcessMetrics> {
+    let first = iterations.first()?;
+
+    let cpu_usage_minmax = iterations
+        .iter()
+        .flat_map(|metrics| match metrics.cpu_usage_minmax {
+            MinMaxResult::NoElements => vec![],
+            MinMaxResult::OneElement(val) => vec![val],
+            MinMaxResult::MinMax(min, max) => vec![min, max],
+        })
+        .minmax_by(|a, b| a.total_cmp(b));
+
+    let mut measured_joules: BTreeMap<String, Vec<f64>> = BTreeMap::new();
+    for metrics in iterations.iter() {
+        for (component, joules) in metrics.measured_joules.iter() {
+            measured_joules
+                .entry(component.clone())
+                .or_default()
+                .push(*joules);
+        }
+    }
+
+    Some(ProcessMetrics {
+        process_id: first.process_id.clone(),
+        process_name: first.process_name.clone(),
+        cpu_usage_minmax,
+        cpu_usage_mean: mean(iterations.iter().map(|m| m.cpu_usage_mean))?,
+        cpu_usage_total: mean(iterations.iter().map(|m| m.cpu_usage_total))?,
+        cpu_seconds: mean(iterations.iter().map(|m| m.cpu_seconds))?,
+        cpu_share_seconds: mean(iterations.iter().map(|m| m.cpu_share_seconds))?,
+        measured_joules: measured_joules
+            .into_iter()
+            .filter_map(|(component, joules)| Some((component, mean(joules.into_iter())?)))
+            .collect(),
+        network_bytes: mean(iterations.iter().filter_map(|m| m.network_bytes)),
+        disk_io: mean(
+            iterations
+                .iter()
+                .filter_map(|m| m.disk_io.map(|(bytes, _)| bytes)),
+        )
+        .zip(mean(
+            iterations
+                .iter()
+                .filter_map(|m| m.disk_io.map(|(_, ops)| ops)),
+        )),
+        peak_memory_bytes: mean(iterations.iter().filter_map(|m| m.peak_memory_bytes)),
+        throttled_secs: mean(iterations.iter().filter_map(|m| m.throttled_secs)),
+    })
+}
+
+/// # Returns
+/// The mean of the values, None if there are none
+fn mean(values: impl Iterator<Item = f64>) -> Option<f64> {
+    let (sum, n) = values.fold((0.0, 0), |(sum, n), value| (sum + value, n + 1));
+    if n == 0 {
+        None
+    } else {
+        Some(sum / n as f64)
+    }
+}
+
+/// Works out how much a counter, e.g. total bytes sent, increased over a series of samples. A
+/// counter which goes down has been reset, e.g. by the container restarting, so counting starts
+/// again from zero.
+///
+/// # Returns
+/// The increase, None if there are no samples
+fn counter_increase(samples: impl Iterator<Item = i64>) -> Option<i64> {
+    let mut increase = None;
+    let mut previous = None;
+    for sample in samples {
+        let delta = match previous {
+            Some(previous) if sample >= previous => sample - previous,
+            Some(_) => sample,
+            None => 0,
+        };
+        *increase.get_or_insert(0) += delta;
+        previous = Some(sample);
+    }
+    increase
+}
+
+/// How the runs in a [`FleetDataset`] are grouped when rolled up.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum GroupBy {
+    Scenario,
+    Process,
+}
+
+/// Total resource usage of a single scenario or process across every run in a [`FleetDataset`].
+#[derive(Debug, PartialEq)]
+pub struct FleetEntry {
+    pub name: String,
+    pub runs: usize,
+    pub cpu_seconds: f64,
+    pub joules: f64,
+    pub runs_without_energy: usize,
+}
+impl FleetEntry {
+    pub fn kwh(&self) -> f64 {
+        self.joules / 3_600_000.0
+    }
+
+    /// # Arguments
+    /// * carbon_intensity - grams of CO2e emitted per kWh of electricity
+    ///
+    /// # Returns
+    /// The carbon emitted in grams CO2e
+    pub fn carbon_grams(&self, carbon_intensity: f64) -> f64 {
+        carbon::operational_grams(self.joules, carbon_intensity)
+    }
+}
+
+/// Dataset containing every run recorded over a period, used for reporting on all the software
+/// measured by cardamon rather than a single observation.
+pub struct FleetDataset {
+    data: Vec<IterationWithMetrics>,
+    runs: Vec<Run>,
+}
+impl FleetDataset {
+    pub fn new(data: Vec<IterationWithMetrics>, runs: Vec<Run>) -> Self {
+        Self { data, runs }
+    }
+
+    pub fn runs(&self) -> &[Run] {
+        &self.runs
+    }
+
+    /// Sums the cpu time and estimated energy of every iteration of every run, unlike
+    /// [`RunDataset::averaged`] iterations are totalled rather than averaged. Runs without a TDP
+    /// contribute cpu time but no energy and are counted separately.
+    ///
+    /// # Arguments
+    /// * group_by - whether to total by scenario or by process name
+    ///
+    /// # Returns
+    /// One entry per scenario or process ordered by energy, most energy intensive first
+    pub fn rollup(&self, group_by: GroupBy) -> Vec<FleetEntry> {
+        let mut entries: HashMap<&str, (FleetEntry, Vec<&str>, Vec<&str>)> = HashMap::new();
+
+        for iteration in self.data.iter() {
+            let run_id = iteration.scenario_iteration.run_id.as_str();
+            let tdp = self
+                .runs
+                .iter()
+                .find(|run| run.run_id == run_id)
+                .and_then(|run| run.tdp);
+
+            let mut metrics_by_process: HashMap<&str, Vec<&CpuMetrics>> = HashMap::new();
+            for metric in iteration.cpu_metrics.iter() {
+                metrics_by_process
+                    .entry(&metric.process_id)
+                    .or_default()
+                    .push(metric);
+            }
+
+            for cpu_metrics in metrics_by_process.values() {
+                let name = match group_by {
+                    GroupBy::Scenario => iteration.scenario_iteration.scenario_name.as_str(),
+                    GroupBy::Process => cpu_metrics[0].process_name.as_str(),
+                };
+
+                let (entry, run_ids, runs_without_energy) =
+                    entries.entry(name).or_insert_with(|| {
+                        let entry = FleetEntry {
+                            name: String::from(name),
+                            runs: 0,
+                            cpu_seconds: 0.0,
+                            joules: 0.0,
+                            runs_without_energy: 0,
+                        };
+                        (entry, vec![], vec![])
+                    });
+
+                entry.cpu_seconds += energy::cpu_seconds(cpu_metrics);
+                match tdp {
+                    Some(tdp) => {
+                        let share_seconds = energy::cpu_share_seconds(cpu_metrics);
+                        entry.joules += energy::estimate_joules(share_seconds, tdp);
                     }
-                })
+                    None if !runs_without_energy.contains(&run_id) => {
+                        runs_without_energy.push(run_id)
+                    }
+                    None => {}
+                }
+                if !run_ids.contains(&run_id) {
+                    run_ids.push(run_id);
+                }
+            }
+        }
+
+        entries
+            .into_values()
+            .map(|(entry, run_ids, runs_without_energy)| FleetEntry {
+                runs: run_ids.len(),
+                runs_without_energy: runs_without_energy.len(),
+                ..entry
             })
-            .collect::<Vec<_>>()
+            .sorted_by(|a, b| b.joules.total_cmp(&a.joules))
+            .collect()
     }
 }
 
 #[cfg(test)]
 mod tests {
+    use super::*;
     use crate::data_access::{DataAccessService, LocalDataAccessService};
     use sqlx::SqlitePool;
 
+    #[test]
+    fn fleet_rollup_totals_iterations_and_ranks_by_energy() {
+        let cpu_metrics = |run_id, process_id, process_name, cpu_usage, timestamp| {
+            CpuMetrics::new(
+                run_id,
+                process_id,
+                process_name,
+                cpu_usage,
+                100.0,
+                4,
+                timestamp,
+            )
+        };
+        let data = vec![
+            IterationWithMetrics::new(
+                ScenarioIteration::new("1", "basket_10", 1, 0, 2000, None),
+                vec![
+                    cpu_metrics("1", "10", "server", 100.0, 0),
+                    cpu_metrics("1", "10", "server", 100.0, 2000),
+                    cpu_metrics("1", "20", "db", 400.0, 0),
+                    cpu_metrics("1", "20", "db", 400.0, 2000),
+                ],
+                vec![],
+                vec![],
+            ),
+            IterationWithMetrics::new(
+                ScenarioIteration::new("2", "basket_10", 1, 5000, 6000, None),
+                vec![
+                    cpu_metrics("2", "30", "server", 200.0, 5000),
+                    cpu_metrics("2", "30", "server", 200.0, 6000),
+                ],
+                vec![],
+                vec![],
+            ),
+        ];
+        let runs = vec![
+            Run::new("1", 0, 2000, Some(10.0), "config", None, None),
+            Run::new("2", 5000, 6000, None, "unavailable", Some("no tdp"), None),
+        ];
+        let fleet_dataset = FleetDataset::new(data, runs);
+
+        let entries = fleet_dataset.rollup(GroupBy::Process);
+        let names = entries.iter().map(|e| e.name.as_str()).collect::<Vec<_>>();
+        assert_eq!(names, ["db", "server"]);
+
+        // db: whole cpu for 2s at 10W
+        assert_eq!(entries[0].joules, 20.0);
+
+        // server: a quarter of the cpu for 2s in run 1, run 2 has no tdp
+        assert_eq!(entries[1].joules, 5.0);
+        assert_eq!(entries[1].cpu_seconds, 4.0);
+        assert_eq!(entries[1].runs, 2);
+        assert_eq!(entries[1].runs_without_energy, 1);
+
+        let entries = fleet_dataset.rollup(GroupBy::Scenario);
+        assert_eq!(entries.len(), 1);
+        assert_eq!(entries[0].joules, 25.0);
+        assert_eq!(entries[0].runs, 2);
+    }
+
+    #[test]
+    fn measured_power_is_attributed_to_processes() {
+        let cpu_metrics = |process_id, cpu_usage, timestamp| {
+            CpuMetrics::new("1", process_id, "server", cpu_usage, 100.0, 4, timestamp)
+        };
+        let power_metrics = |source, process_id, power, timestamp| {
+            PowerMetrics::new("1", source, "cpu", process_id, power, timestamp)
+        };
+        let iteration = IterationWithMetrics::new(
+            ScenarioIteration::new("1", "basket_10", 1, 0, 2000, None),
+            vec![cpu_metrics("10", 200.0, 0), cpu_metrics("10", 200.0, 2000)],
+            vec![
+                power_metrics("rapl:package-0", None, 20.0, 0),
+                power_metrics("rapl:package-0", None, 20.0, 2000),
+                power_metrics("rapl:package-1", None, 10.0, 0),
+                power_metrics("rapl:package-1", None, 10.0, 2000),
+            ],
+            vec![],
+        );
+
+        // half of both packages for 2s
+        let process_metrics = iteration.accumulate_by_process();
+        assert_eq!(process_metrics[0].measured_joules_for("cpu"), Some(30.0));
+        assert_eq!(process_metrics[0].measured_joules_for("gpu"), None);
+    }
+
+    #[test]
+    fn memory_power_is_attributed_by_memory_share() {
+        let resource_metrics = |process_id, memory_bytes, timestamp| ResourceMetrics {
+            memory_bytes,
+            memory_total: Some(8_000),
+            ..ResourceMetrics::new("1", process_id, timestamp)
+        };
+        let iteration = IterationWithMetrics::new(
+            ScenarioIteration::new("1", "basket_10", 1, 0, 2000, None),
+            vec![
+                CpuMetrics::new("1", "10", "db", 100.0, 100.0, 4, 0),
+                CpuMetrics::new("1", "10", "db", 100.0, 100.0, 4, 2000),
+                CpuMetrics::new("1", "11", "web", 100.0, 100.0, 4, 0),
+                CpuMetrics::new("1", "11", "web", 100.0, 100.0, 4, 2000),
+            ],
+            vec![
+                PowerMetrics::new("1", "rapl:dram-0", "dram", None, 4.0, 0),
+                PowerMetrics::new("1", "rapl:dram-0", "dram", None, 4.0, 2000),
+            ],
+            vec![
+                resource_metrics("10", Some(4_000), 0),
+                resource_metrics("10", Some(4_000), 2000),
+                resource_metrics("11", None, 0),
+                resource_metrics("11", None, 2000),
+            ],
+        );
+
+        // half the memory for 2s, a process without memory samples falls back to its CPU share
+        let process_metrics = iteration.accumulate_by_process();
+        let joules = |process_id| {
+            process_metrics
+                .iter()
+                .find(|m| m.process_id() == process_id)
+                .and_then(|m| m.measured_joules_for("dram"))
+        };
+        assert_eq!(joules("10"), Some(4.0));
+        assert_eq!(joules("11"), Some(2.0));
+    }
+
+    #[test]
+    fn idle_power_is_worked_out_from_the_baseline() {
+        let cpu_metrics = |cpu_usage, timestamp| {
+            CpuMetrics::new("1", "10", "server", cpu_usage, 100.0, 4, timestamp)
+        };
+        let scenario = IterationWithMetrics::new(
+            ScenarioIteration::new("1", "basket_10", 1, 10000, 14000, None),
+            vec![cpu_metrics(200.0, 10000), cpu_metrics(200.0, 14000)],
+            vec![],
+            vec![],
+        );
+        let baseline = IterationWithMetrics::new(
+            ScenarioIteration::new("1", "baseline", 0, 0, 5000, None),
+            vec![cpu_metrics(40.0, 0), cpu_metrics(40.0, 5000)],
+            vec![],
+            vec![],
+        );
+        let runs = vec![Run::new("1", 0, 14000, Some(10.0), "config", None, None)];
+        let dataset = ObservationDataset::new(vec![scenario], runs, vec![baseline]);
+
+        // 10% of a 10W TDP while idle
+        let scenario_dataset = &dataset.by_scenario()[0];
+        let run_dataset = &scenario_dataset.by_run()[0];
+        let baseline_watts = run_dataset.baseline_watts(Some(10.0), None);
+        assert_eq!(baseline_watts.get("10"), Some(&1.0));
+        assert_eq!(run_dataset.mean_iteration_secs(), 4.0);
+        assert!(run_dataset.baseline_watts(None, None).is_empty());
+    }
+
+    #[test]
+    fn failed_requests_are_counted_apart_from_served_requests() {
+        let iteration = |iteration, requests, failed_requests| {
+            let start = iteration * 10000;
+            IterationWithMetrics::new(
+                ScenarioIteration {
+                    failed_requests,
+                    ..ScenarioIteration::new(
+                        "1",
+                        "replay",
+                        iteration,
+                        start,
+                        start + 2000,
+                        requests,
+                    )
+                },
+                vec![CpuMetrics::new("1", "10", "server", 50.0, 100.0, 4, start)],
+                vec![],
+                vec![],
+            )
+        };
+        let data = vec![
+            iteration(0, Some(90), Some(10)),
+            iteration(1, Some(70), Some(30)),
+        ];
+        let runs = vec![Run::new("1", 0, 12000, Some(10.0), "config", None, None)];
+        let dataset = ObservationDataset::new(data, runs, vec![]);
+        let scenario_dataset = &dataset.by_scenario()[0];
+        let run_dataset = &scenario_dataset.by_run()[0];
+        assert_eq!(run_dataset.requests_per_iteration(), Some(80.0));
+        assert_eq!(run_dataset.failed_requests_per_iteration(), Some(20.0));
+
+        let data = vec![iteration(0, None, None)];
+        let runs = vec![Run::new("1", 0, 2000, Some(10.0), "config", None, None)];
+        let dataset = ObservationDataset::new(data, runs, vec![]);
+        let scenario_dataset = &dataset.by_scenario()[0];
+        let run_dataset = &scenario_dataset.by_run()[0];
+        assert_eq!(run_dataset.failed_requests_per_iteration(), None);
+    }
+
+    #[test]
+    fn iterations_are_averaged_and_summarised() {
+        let cpu_metrics = |cpu_usage, timestamp| {
+            CpuMetrics::new("1", "10", "server", cpu_usage, 100.0, 4, timestamp)
+        };
+        let iteration = |iteration, cpu_usage: f64| {
+            let start = iteration * 10000;
+            IterationWithMetrics::new(
+                ScenarioIteration::new("1", "basket_10", iteration, start, start + 2000, None),
+                vec![
+                    cpu_metrics(cpu_usage, start),
+                    cpu_metrics(cpu_usage, start + 2000),
+                ],
+                vec![],
+                vec![],
+            )
+        };
+        let data = vec![
+            iteration(0, 100.0),
+            iteration(1, 200.0),
+            iteration(2, 300.0),
+        ];
+        let runs = vec![Run::new("1", 0, 22000, Some(10.0), "config", None, None)];
+        let dataset = ObservationDataset::new(data, runs, vec![]);
+        let scenario_dataset = &dataset.by_scenario()[0];
+        let run_dataset = &scenario_dataset.by_run()[0];
+
+        // each iteration weighs the same
+        let averaged = run_dataset.averaged();
+        assert_eq!(averaged[0].cpu_usage_mean(), 200.0);
+        assert_eq!(averaged[0].cpu_seconds(), 4.0);
+        assert_eq!(
+            averaged[0].cpu_usage_minmax(),
+            &MinMaxResult::MinMax(100.0, 300.0)
+        );
+
+        // a quarter, half and three quarters of a 10W TDP for 2s
+        let stats = run_dataset
+            .energy_stats(Some(10.0), None, None)
+            .expect("energy should be available");
+        assert_eq!(stats.iterations, 3);
+        assert_eq!(stats.mean, 10.0);
+        assert_eq!(stats.median, 10.0);
+        assert_eq!(stats.stddev, 5.0);
+        assert_eq!((stats.min, stats.max), (5.0, 15.0));
+        assert_eq!(stats.relative_stddev(), 50.0);
+        assert!((stats.p90 - 14.0).abs() < 1e-9);
+        assert!((stats.p99 - 14.9).abs() < 1e-9);
+        assert_eq!(run_dataset.energy_stats(None, None, None), None);
+
+        let duration = run_dataset
+            .duration_stats()
+            .expect("every iteration has a duration");
+        assert_eq!((duration.median, duration.p99), (2.0, 2.0));
+        assert_eq!(
+            Stats::of(&[4.0, 1.0, 3.0, 2.0]).map(|stats| stats.median),
+            Some(2.5)
+        );
+    }
+
+    #[test]
+    fn outlying_iterations_are_left_out_of_the_stats() {
+        // the fourth iteration ran during an OS update
+        let cpu_usage = [50.0, 52.0, 49.0, 200.0, 51.0, 50.0];
+        let data = cpu_usage
+            .iter()
+            .enumerate()
+            .map(|(iteration, cpu_usage)| {
+                let start = iteration as i64 * 5000;
+                IterationWithMetrics::new(
+                    ScenarioIteration::new("1", "s1", iteration as i64, start, start + 2000, None),
+                    vec![
+                        CpuMetrics::new("1", "10", "server", *cpu_usage, 100.0, 4, start),
+                        CpuMetrics::new("1", "10", "server", *cpu_usage, 100.0, 4, start + 2000),
+                    ],
+                    vec![],
+                    vec![],
+                )
+            })
+            .collect();
+        let runs = vec![Run::new("1", 0, 30000, Some(40.0), "config", None, None)];
+        let dataset = ObservationDataset::new(data, runs, vec![]);
+        let scenario_dataset = &dataset.by_scenario()[0];
+        let run_dataset = &scenario_dataset.by_run()[0];
+
+        let all = run_dataset
+            .energy_stats(Some(40.0), None, None)
+            .expect("energy should be available");
+        let stats = run_dataset
+            .energy_stats(Some(40.0), None, Some(3.5))
+            .expect("energy should be available");
+        assert_eq!((all.iterations, all.outliers), (6, 0));
+        assert_eq!((stats.iterations, stats.outliers), (5, 1));
+        assert!(stats.max < 11.0);
+        assert_eq!(
+            run_dataset.outlier_iterations(Some(40.0), None, 3.5),
+            vec![3]
+        );
+
+        // identical values have no spread to deviate from, except the odd one out
+        assert_eq!(
+            outliers(&[10.0, 10.0, 10.0, 10.0, 50.0], 3.5),
+            vec![false, false, false, false, true]
+        );
+        assert_eq!(outliers(&[10.0, 50.0], 3.5), vec![false, false]);
+        assert!(outliers(&[5.0, 5.0, 5.0], 3.5)
+            .iter()
+            .all(|outlier| !outlier));
+    }
+
+    #[test]
+    fn processes_only_measured_by_a_power_source_are_reported() {
+        let iteration = IterationWithMetrics::new(
+            ScenarioIteration::new("1", "basket_10", 1, 0, 2000, None),
+            vec![],
+            vec![
+                PowerMetrics::new("1", "kepler", "cpu", Some("shop/checkout"), 5.0, 0),
+                PowerMetrics::new("1", "kepler", "cpu", Some("shop/checkout"), 5.0, 2000),
+            ],
+            vec![],
+        );
+
+        let process_metrics = iteration.accumulate_by_process();
+        assert_eq!(process_metrics.len(), 1);
+        assert_eq!(process_metrics[0].process_id(), "shop/checkout");
+        assert_eq!(process_metrics[0].process_name(), "shop/checkout");
+        assert_eq!(process_metrics[0].cpu_usage_mean(), 0.0);
+        assert_eq!(process_metrics[0].measured_joules_for("cpu"), Some(10.0));
+    }
+
+    #[test]
+    fn pods_are_grouped_by_deployment() {
+        let cpu_metrics = |process_id, process_name, timestamp| {
+            CpuMetrics::new("1", process_id, process_name, 100.0, 100.0, 4, timestamp)
+        };
+        let iteration = IterationWithMetrics::new(
+            ScenarioIteration::new("1", "basket_10", 1, 0, 2000, None),
+            vec![
+                cpu_metrics("shop/checkout-1", "shop/checkout", 0),
+                cpu_metrics("shop/checkout-1", "shop/checkout", 2000),
+                cpu_metrics("shop/checkout-2", "shop/checkout", 0),
+                cpu_metrics("shop/checkout-2", "shop/checkout", 2000),
+                cpu_metrics("shop/cart-1", "shop/cart", 0),
+                cpu_metrics("shop/cart-1", "shop/cart", 2000),
+            ],
+            vec![],
+            vec![],
+        );
+
+        let process_metrics = iteration.accumulate_by_process();
+        let groups = by_process_name(&process_metrics);
+        let sizes = groups
+            .iter()
+            .map(|(name, members)| (*name, members.len()))
+            .collect::<Vec<_>>();
+        assert_eq!(sizes, [("shop/cart", 1), ("shop/checkout", 2)]);
+    }
+
+    #[test]
+    fn network_traffic_survives_counter_resets() {
+        let resource_metrics = |bytes_sent, bytes_received, timestamp| ResourceMetrics {
+            bytes_sent,
+            bytes_received,
+            ..ResourceMetrics::new("1", "abc123", timestamp)
+        };
+        let iteration = IterationWithMetrics::new(
+            ScenarioIteration::new("1", "basket_10", 1, 0, 3000, None),
+            vec![
+                CpuMetrics::new("1", "abc123", "api", 50.0, 100.0, 4, 0),
+                CpuMetrics::new("1", "abc123", "api", 50.0, 100.0, 4, 3000),
+                CpuMetrics::new("1", "42", "worker", 50.0, 100.0, 4, 0),
+            ],
+            vec![],
+            vec![
+                resource_metrics(Some(1000), Some(4000), 2000),
+                resource_metrics(Some(500), Some(1000), 1000),
+                resource_metrics(Some(200), Some(500), 3000),
+                resource_metrics(Some(100), Some(0), 0),
+            ],
+        );
+
+        let process_metrics = iteration.accumulate_by_process();
+        let network_bytes = |process_id| {
+            process_metrics
+                .iter()
+                .find(|m| m.process_id() == process_id)
+                .and_then(|m| m.network_bytes())
+        };
+
+        // sent 400 + 500 then restarted with 200, received 1000 + 3000 then restarted with 500
+        assert_eq!(network_bytes("abc123"), Some(5600.0));
+        assert_eq!(network_bytes("42"), None);
+    }
+
+    #[test]
+    fn peak_memory_and_throttling_are_reported() {
+        let resource_metrics = |memory_bytes, throttled_ns, timestamp| ResourceMetrics {
+            memory_bytes: Some(memory_bytes),
+            throttled_ns,
+            ..ResourceMetrics::new("1", "abc123", timestamp)
+        };
+        let iteration = IterationWithMetrics::new(
+            ScenarioIteration::new("1", "basket_10", 1, 0, 2000, None),
+            vec![
+                CpuMetrics::new("1", "abc123", "api", 50.0, 100.0, 4, 0),
+                CpuMetrics::new("1", "abc123", "api", 50.0, 100.0, 4, 2000),
+            ],
+            vec![],
+            vec![
+                resource_metrics(2_000_000, Some(500_000_000), 0),
+                resource_metrics(6_000_000, Some(750_000_000), 1000),
+                resource_metrics(4_000_000, Some(2_000_000_000), 2000),
+            ],
+        );
+
+        let process_metrics = iteration.accumulate_by_process();
+        assert_eq!(process_metrics[0].peak_memory_bytes(), Some(6_000_000.0));
+        assert_eq!(process_metrics[0].throttled_secs(), Some(1.5));
+    }
+
+    #[test]
+    fn disk_io_is_totalled_over_the_iteration() {
+        let resource_metrics = |bytes, ops, timestamp| ResourceMetrics {
+            read_bytes: Some(bytes),
+            write_bytes: Some(bytes * 2),
+            read_ops: Some(ops),
+            write_ops: Some(ops),
+            ..ResourceMetrics::new("1", "42", timestamp)
+        };
+        let iteration = IterationWithMetrics::new(
+            ScenarioIteration::new("1", "basket_10", 1, 0, 2000, None),
+            vec![
+                CpuMetrics::new("1", "42", "db", 50.0, 100.0, 4, 0),
+                CpuMetrics::new("1", "42", "db", 50.0, 100.0, 4, 2000),
+            ],
+            vec![],
+            vec![
+                resource_metrics(1000, 10, 0),
+                resource_metrics(5000, 30, 2000),
+            ],
+        );
+
+        let process_metrics = iteration.accumulate_by_process();
+        assert_eq!(process_metrics[0].disk_io(), Some((12000.0, 40.0)));
+        assert_eq!(process_metrics[0].network_bytes(), None);
+    }
+
     #[sqlx::test(
         migrations = "./migrations",
-        fixtures("../fixtures/scenario_iterations.sql", "../fixtures/cpu_metrics.sql")
+        fixtures(
+            "../fixtures/scenario_iterations.sql",
+            "../fixtures/cpu_metrics.sql",
+            "../fixtures/runs.sql"
+        )
     )]
     async fn datasets_work(pool: SqlitePool) -> anyhow::Result<()> {
         let data_access_service = LocalDataAccessService::new(pool.clone());
         let observation_dataset = data_access_service
-            .fetch_observation_dataset(vec!["scenario_2"], 2)
+            .fetch_observation_dataset(vec!["scenario_2"], None, 2)
             .await?;
 
         assert_eq!(observation_dataset.data().len(), 4);
@@ -274,6 +1560,7 @@ mod tests {
                 // println!("{:?}", run_dataset);
                 let avg = run_dataset.averaged();
                 assert_eq!(avg.len(), 2);
+                assert!(run_dataset.run().is_some());
             }
         }
 
@@ -0,0 +1,504 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    config::{Blend, Cpu},
+    data_access::{
+        cpu_metrics::CpuMetrics, power_metrics::PowerMetrics, resource_metrics::ResourceMetrics,
+    },
+    units::Units,
+};
+use itertools::Itertools;
+use std::{fmt, fs, path::Path};
+
+/// Explanation given to the user when energy can't be calculated because the TDP is unknown.
+pub const MISSING_TDP: &str = "No TDP configured and it could not be detected automatically. \
+Add `tdp = <watts>` to the [cpu] section of cardamon.toml, the TDP of your CPU can be found on the \
+manufacturer's spec sheet.";
+
+/// Where the TDP used by a run came from.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum TdpSource {
+    Config,
+    Detected,
+    Unavailable,
+}
+impl TdpSource {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            TdpSource::Config => "config",
+            TdpSource::Detected => "detected",
+            TdpSource::Unavailable => "unavailable",
+        }
+    }
+}
+
+/// Finds the TDP to use for a run. A TDP given in the config always takes precedence over one
+/// detected from the hardware.
+///
+/// # Arguments
+/// * cpu - the `[cpu]` section of the config, if there is one
+///
+/// # Returns
+/// The TDP in watts (if it could be found) and where it came from
+pub fn resolve_tdp(cpu: Option<&Cpu>) -> (Option<f64>, TdpSource) {
+    if let Some(tdp) = cpu.and_then(|cpu| cpu.tdp) {
+        return (Some(tdp), TdpSource::Config);
+    }
+
+    match detect_tdp() {
+        Some(tdp) => (Some(tdp), TdpSource::Detected),
+        None => (None, TdpSource::Unavailable),
+    }
+}
+
+/// Attempts to detect the TDP of the CPU. On Linux machines with RAPL support the long term power
+/// limit of the CPU package is set to its TDP by default.
+///
+/// # Returns
+/// The TDP in watts or None if it can't be detected on this machine
+pub fn detect_tdp() -> Option<f64> {
+    let path = Path::new("/sys/class/powercap/intel-rapl:0/constraint_0_max_power_uw");
+    let micro_watts = fs::read_to_string(path).ok()?.trim().parse::<f64>().ok()?;
+
+    if micro_watts > 0.0 {
+        Some(micro_watts / 1_000_000.0)
+    } else {
+        None
+    }
+}
+
+/// Integrates the CPU utilisation of a single process over time, giving the number of seconds of
+/// CPU time the process used across all cores.
+///
+/// See [`cpu_share_seconds`] for how samples are weighted.
+///
+/// # Arguments
+/// * cpu_metrics - all the samples captured for a single process, in any order
+///
+/// # Returns
+/// The CPU time in seconds
+pub fn cpu_seconds(cpu_metrics: &[&CpuMetrics]) -> f64 {
+    cpu_metrics
+        .iter()
+        .sorted_by_key(|metrics| metrics.timestamp)
+        .tuple_windows()
+        .map(|(prev, curr)| {
+            let secs = (curr.timestamp - prev.timestamp) as f64 / 1000.0;
+            curr.cpu_usage / 100.0 * secs
+        })
+        .sum()
+}
+
+/// Integrates the CPU utilisation of a single process over time, giving the fraction of the whole
+/// CPU that the process used multiplied by the number of seconds it was used for.
+///
+/// `cpu_usage` is reported as a percentage of a single core over the interval since the previous
+/// sample, therefore each sample is weighted by the time elapsed since the sample before it. The
+/// first sample has nothing preceding it and is skipped.
+///
+/// # Arguments
+/// * cpu_metrics - all the samples captured for a single process, in any order
+///
+/// # Returns
+/// The CPU share multiplied by seconds
+pub fn cpu_share_seconds(cpu_metrics: &[&CpuMetrics]) -> f64 {
+    cpu_metrics
+        .iter()
+        .sorted_by_key(|metrics| metrics.timestamp)
+        .tuple_windows()
+        .map(|(prev, curr)| {
+            let secs = (curr.timestamp - prev.timestamp) as f64 / 1000.0;
+            let share = curr.cpu_usage / 100.0 / curr.core_count.max(1) as f64;
+            share.min(1.0) * secs
+        })
+        .sum()
+}
+
+/// Estimates energy using the TDP power model. The model assumes the CPU draws its full thermal
+/// design power when completely utilised and that power scales linearly with utilisation.
+///
+/// # Arguments
+/// * cpu_share_seconds - see [`cpu_share_seconds`]
+/// * tdp - the thermal design power of the CPU in watts
+///
+/// # Returns
+/// The estimated energy in joules
+pub fn estimate_joules(cpu_share_seconds: f64, tdp: f64) -> f64 {
+    cpu_share_seconds * tdp
+}
+
+/// Integrates power readings over time. Each reading is the mean power since the previous
+/// reading so, like CPU samples, the first reading is skipped.
+///
+/// # Arguments
+/// * power_metrics - the readings from a single power source, in any order
+///
+/// # Returns
+/// The energy in joules
+pub fn integrate_joules(power_metrics: &[&PowerMetrics]) -> f64 {
+    power_metrics
+        .iter()
+        .sorted_by_key(|metrics| metrics.timestamp)
+        .tuple_windows()
+        .map(|(prev, curr)| {
+            let secs = (curr.timestamp - prev.timestamp) as f64 / 1000.0;
+            curr.power * secs
+        })
+        .sum()
+}
+
+/// Attributes power measured for a whole device to a single process in proportion to the
+/// process's share of the CPU. This is the TDP model with the TDP replaced by the measured power
+/// at the time of each CPU sample, so power drawn while the CPU is idle isn't attributed to any
+/// process.
+///
+/// # Arguments
+/// * cpu_metrics - all the samples captured for a single process, in any order
+/// * power_metrics - the readings from a single power source, in any order
+///
+/// # Returns
+/// The energy attributed to the process in joules, None if there are no power readings
+pub fn attribute_joules(
+    cpu_metrics: &[&CpuMetrics],
+    power_metrics: &[&PowerMetrics],
+) -> Option<f64> {
+    if power_metrics.is_empty() {
+        return None;
+    }
+
+    let joules = cpu_metrics
+        .iter()
+        .sorted_by_key(|metrics| metrics.timestamp)
+        .tuple_windows()
+        .map(|(prev, curr)| {
+            let secs = (curr.timestamp - prev.timestamp) as f64 / 1000.0;
+            let share = curr.cpu_usage / 100.0 / curr.core_count.max(1) as f64;
+
+            // power sources and cpu loggers sample independently, use the closest reading
+            let power = power_metrics
+                .iter()
+                .min_by_key(|power| (power.timestamp - curr.timestamp).abs())
+                .map(|power| power.power)
+                .unwrap_or_default();
+
+            share.min(1.0) * secs * power
+        })
+        .sum();
+
+    Some(joules)
+}
+
+/// Attributes power measured for memory to a single process in proportion to the process's share
+/// of the host's memory. Memory draws power to hold data whether or not it's being accessed, so
+/// its resident size is a better measure than CPU share. Power drawn by unused memory isn't
+/// attributed to any process.
+///
+/// # Arguments
+/// * resource_metrics - all the samples captured for a single process, in any order
+/// * power_metrics - the readings from a single power source, in any order
+///
+/// # Returns
+/// The energy attributed to the process in joules, None if there are no power readings or the
+/// memory of the process wasn't observed
+pub fn attribute_memory_joules(
+    resource_metrics: &[&ResourceMetrics],
+    power_metrics: &[&PowerMetrics],
+) -> Option<f64> {
+    let samples = resource_metrics
+        .iter()
+        .filter_map(|m| Some((m.memory_bytes?, m.memory_total?, m.timestamp)))
+        .sorted_by_key(|(_, _, timestamp)| *timestamp)
+        .collect::<Vec<_>>();
+    if power_metrics.is_empty() || samples.is_empty() {
+        return None;
+    }
+
+    let joules = samples
+        .into_iter()
+        .tuple_windows()
+        .map(
+            |((_, _, prev_timestamp), (memory_bytes, memory_total, timestamp))| {
+                let secs = (timestamp - prev_timestamp) as f64 / 1000.0;
+                let share = memory_bytes as f64 / memory_total.max(1) as f64;
+
+                let power = power_metrics
+                    .iter()
+                    .min_by_key(|power| (power.timestamp - timestamp).abs())
+                    .map(|power| power.power)
+                    .unwrap_or_default();
+
+                share.min(1.0) * secs * power
+            },
+        )
+        .sum();
+
+    Some(joules)
+}
+
+/// Subtracts the energy a process would have used idling from the energy it used during a
+/// scenario, leaving the energy the scenario caused.
+///
+/// # Arguments
+/// * gross - the energy used during the scenario in joules
+/// * baseline_watts - the idle power of the process
+/// * secs - the duration of the scenario
+///
+/// # Returns
+/// The marginal energy in joules, never less than 0 as idle power varies between measurements
+pub fn marginal_joules(gross: f64, baseline_watts: f64, secs: f64) -> f64 {
+    (gross - baseline_watts * secs).max(0.0)
+}
+
+/// Estimates the energy used moving data over the network using a fixed energy intensity per GB.
+///
+/// # Arguments
+/// * bytes - the bytes sent and received
+/// * kwh_per_gb - the energy intensity of the network in kWh per GB
+///
+/// # Returns
+/// The estimated energy in joules
+pub fn network_joules(bytes: f64, kwh_per_gb: f64) -> f64 {
+    bytes / 1_000_000_000.0 * kwh_per_gb * 3_600_000.0
+}
+
+/// Estimates the energy used by storage I/O from the bytes transferred and the number of
+/// operations, so random access to a spinning disk costs more than streaming the same bytes.
+///
+/// # Arguments
+/// * bytes - the bytes read and written
+/// * ops - the number of read and write operations
+/// * coefficients - joules per GB and joules per operation of the device
+///
+/// # Returns
+/// The estimated energy in joules
+pub fn storage_joules(bytes: f64, ops: f64, (joules_per_gb, joules_per_op): (f64, f64)) -> f64 {
+    bytes / 1_000_000_000.0 * joules_per_gb + ops * joules_per_op
+}
+
+/// An energy figure along with where it came from.
+#[derive(Debug, Clone, PartialEq)]
+pub enum Energy {
+    /// Calculated from a power model.
+    Estimated { joules: f64 },
+
+    /// Read directly from a power source.
+    Measured { joules: f64 },
+
+    /// A combination of an estimate and a measurement weighted by the configured confidence in
+    /// each. Both constituent values are kept so they can be reported alongside the result.
+    Blended {
+        joules: f64,
+        estimated: f64,
+        measured: f64,
+        estimate_weight: f64,
+        measurement_weight: f64,
+    },
+}
+impl Energy {
+    pub fn joules(&self) -> f64 {
+        match self {
+            Energy::Estimated { joules } => *joules,
+            Energy::Measured { joules } => *joules,
+            Energy::Blended { joules, .. } => *joules,
+        }
+    }
+
+    pub fn label(&self) -> &'static str {
+        match self {
+            Energy::Estimated { .. } => "estimated",
+            Energy::Measured { .. } => "measured",
+            Energy::Blended { .. } => "blended estimate",
+        }
+    }
+
+    /// # Returns
+    /// The energy in the given units with how it was arrived at
+    pub fn display(&self, units: &Units) -> String {
+        match self {
+            Energy::Blended {
+                joules,
+                estimated,
+                measured,
+                estimate_weight,
+                measurement_weight,
+            } => format!(
+                "{} ({}: {} estimated x {estimate_weight:.2}, {} measured x {measurement_weight:.2})",
+                units.energy(*joules),
+                self.label(),
+                units.energy(*estimated),
+                units.energy(*measured)
+            ),
+            _ => format!("{} ({})", units.energy(self.joules()), self.label()),
+        }
+    }
+}
+impl fmt::Display for Energy {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.display(&Units::default()))
+    }
+}
+
+/// Combines the energy figures available for a process into a single figure.
+///
+/// If both an estimate and a measurement are available and a blend has been configured then the
+/// result is the weighted mean of the two. Without a blend a measurement is always preferred over
+/// an estimate.
+///
+/// # Arguments
+/// * estimated - energy calculated from a power model, in joules
+/// * measured - energy read from a power source, in joules
+/// * blend - confidence in each source
+///
+/// # Returns
+/// Some energy figure, or None if neither an estimate nor a measurement is available
+pub fn combine(
+    estimated: Option<f64>,
+    measured: Option<f64>,
+    blend: Option<&Blend>,
+) -> Option<Energy> {
+    match (estimated, measured, blend) {
+        (Some(estimated), Some(measured), Some(blend)) => {
+            let (estimate_weight, measurement_weight) = blend.weights();
+            Some(Energy::Blended {
+                joules: estimated * estimate_weight + measured * measurement_weight,
+                estimated,
+                measured,
+                estimate_weight,
+                measurement_weight,
+            })
+        }
+        (_, Some(joules), _) => Some(Energy::Measured { joules }),
+        (Some(joules), None, _) => Some(Energy::Estimated { joules }),
+        (None, None, _) => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn cpu_metrics(cpu_usage: f64, timestamp: i64) -> CpuMetrics {
+        CpuMetrics::new("1", "1337", "yarn", cpu_usage, 100_f64, 4, timestamp)
+    }
+
+    #[test]
+    fn cpu_share_seconds_weights_samples_by_elapsed_time() {
+        let metrics = [
+            cpu_metrics(400.0, 1000),
+            cpu_metrics(200.0, 2000),
+            cpu_metrics(100.0, 4000),
+        ];
+        let metrics = metrics.iter().collect::<Vec<_>>();
+
+        // first sample skipped, 50% for 1s then 25% for 2s
+        assert_eq!(cpu_share_seconds(&metrics), 1.0);
+
+        // first sample skipped, 2 cores for 1s then 1 core for 2s
+        assert_eq!(cpu_seconds(&metrics), 4.0);
+    }
+
+    #[test]
+    fn measured_power_is_attributed_by_cpu_share() {
+        let power_metrics = |power, timestamp| {
+            PowerMetrics::new("1", "rapl:package-0", "cpu", None, power, timestamp)
+        };
+        let metrics = [
+            cpu_metrics(400.0, 1000),
+            cpu_metrics(200.0, 2000),
+            cpu_metrics(100.0, 4000),
+        ];
+        let metrics = metrics.iter().collect::<Vec<_>>();
+        let power = [
+            power_metrics(30.0, 1000),
+            power_metrics(20.0, 2010),
+            power_metrics(10.0, 3990),
+        ];
+        let power = power.iter().collect::<Vec<_>>();
+
+        // 50% of 20W for 1s then 25% of 10W for 2s
+        assert_eq!(attribute_joules(&metrics, &power), Some(15.0));
+        assert_eq!(attribute_joules(&metrics, &[]), None);
+
+        // 20W for 1.01s then 10W for 1.98s
+        assert!((integrate_joules(&power) - 40.0).abs() < 1e-9);
+    }
+
+    #[test]
+    fn memory_power_is_attributed_by_resident_share() {
+        let resource_metrics = |memory_bytes, timestamp| ResourceMetrics {
+            memory_bytes: Some(memory_bytes),
+            memory_total: Some(16_000),
+            ..ResourceMetrics::new("1", "1337", timestamp)
+        };
+        let metrics = [
+            resource_metrics(8_000, 1000),
+            resource_metrics(4_000, 2000),
+            resource_metrics(2_000, 4000),
+            ResourceMetrics::new("1", "1337", 5000),
+        ];
+        let metrics = metrics.iter().collect::<Vec<_>>();
+        let power = [
+            PowerMetrics::new("1", "rapl:dram-0", "dram", None, 8.0, 2000),
+            PowerMetrics::new("1", "rapl:dram-0", "dram", None, 4.0, 4000),
+        ];
+        let power = power.iter().collect::<Vec<_>>();
+
+        // 25% of 8W for 1s then 12.5% of 4W for 2s, the sample without memory is skipped
+        assert_eq!(attribute_memory_joules(&metrics, &power), Some(3.0));
+        assert_eq!(attribute_memory_joules(&metrics, &[]), None);
+        assert_eq!(attribute_memory_joules(&metrics[3..], &power), None);
+    }
+
+    #[test]
+    fn idle_energy_is_subtracted() {
+        assert_eq!(marginal_joules(50.0, 2.0, 10.0), 30.0);
+        assert_eq!(marginal_joules(15.0, 2.0, 10.0), 0.0);
+    }
+
+    #[test]
+    fn network_energy_scales_with_bytes() {
+        // 0.5 GB at 0.06 kWh/GB is 0.03 kWh
+        assert!((network_joules(500_000_000.0, 0.06) - 108_000.0).abs() < 1e-6);
+        assert_eq!(network_joules(0.0, 0.06), 0.0);
+    }
+
+    #[test]
+    fn storage_energy_includes_operations() {
+        assert_eq!(storage_joules(2_000_000_000.0, 0.0, (10.0, 0.5)), 20.0);
+        assert_eq!(storage_joules(0.0, 100.0, (10.0, 0.5)), 50.0);
+    }
+
+    #[test]
+    fn configured_tdp_takes_precedence() {
+        let cpu = Cpu {
+            name: None,
+            tdp: Some(35.0),
+            host_processors: None,
+        };
+        assert_eq!(resolve_tdp(Some(&cpu)), (Some(35.0), TdpSource::Config));
+    }
+
+    #[test]
+    fn combine_prefers_blend_then_measurement() {
+        let blend = Blend {
+            estimate_confidence: 1.0,
+            measurement_confidence: 3.0,
+        };
+
+        let energy = combine(Some(10.0), Some(20.0), Some(&blend)).unwrap();
+        assert_eq!(energy.joules(), 17.5);
+        assert_eq!(energy.label(), "blended estimate");
+
+        let energy = combine(Some(10.0), Some(20.0), None).unwrap();
+        assert_eq!(energy, Energy::Measured { joules: 20.0 });
+
+        let energy = combine(Some(10.0), None, Some(&blend)).unwrap();
+        assert_eq!(energy, Energy::Estimated { joules: 10.0 });
+
+        assert!(combine(None, None, Some(&blend)).is_none());
+    }
+}
@@ -0,0 +1,202 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::config::Checks;
+use itertools::Itertools;
+use serde::{Deserialize, Serialize};
+use std::{fmt, fs, path::Path};
+
+/// The state of the machine when a run started, saved with the run so noisy runs can be spotted
+/// when results are compared. Anything which can't be read on this machine is None.
+#[derive(Debug, Default, PartialEq, Serialize, Deserialize)]
+pub struct Environment {
+    /// The CPU frequency governors of the cores, comma separated if they differ.
+    pub governor: Option<String>,
+    pub turbo: Option<bool>,
+    /// The 1 minute load average per core.
+    pub load: Option<f64>,
+    /// False if the machine is running on battery, None if it has no battery.
+    pub ac_power: Option<bool>,
+}
+
+impl fmt::Display for Environment {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let mut parts = vec![];
+        if let Some(governor) = &self.governor {
+            parts.push(format!("{governor} governor"));
+        }
+        if let Some(turbo) = self.turbo {
+            parts.push(format!("turbo {}", if turbo { "on" } else { "off" }));
+        }
+        if let Some(load) = self.load {
+            parts.push(format!("load {load:.2} per core"));
+        }
+        match self.ac_power {
+            Some(true) => parts.push(String::from("on AC power")),
+            Some(false) => parts.push(String::from("on battery")),
+            None => {}
+        }
+        if parts.is_empty() {
+            write!(f, "unknown")
+        } else {
+            write!(f, "{}", parts.join(", "))
+        }
+    }
+}
+
+/// Reads the state of the machine from `/sys` and `/proc`, on other platforms nothing can be read.
+pub fn snapshot() -> Environment {
+    let cores = std::thread::available_parallelism()
+        .map(|cores| cores.get())
+        .unwrap_or(1);
+    let governors = fs::read_dir("/sys/devices/system/cpu")
+        .map(|entries| {
+            entries
+                .flatten()
+                .map(|entry| entry.path().join("cpufreq/scaling_governor"))
+                .filter_map(|path| fs::read_to_string(path).ok())
+                .map(|governor| governor.trim().to_string())
+                .collect::<Vec<_>>()
+        })
+        .unwrap_or_default();
+
+    Environment {
+        governor: parse_governors(&governors),
+        turbo: read_turbo(),
+        load: fs::read_to_string("/proc/loadavg")
+            .ok()
+            .and_then(|loadavg| parse_load(&loadavg, cores)),
+        ac_power: read_ac_power(Path::new("/sys/class/power_supply")),
+    }
+}
+
+fn parse_governors(governors: &[String]) -> Option<String> {
+    if governors.is_empty() {
+        return None;
+    }
+    Some(governors.iter().sorted().dedup().join(","))
+}
+
+fn read_turbo() -> Option<bool> {
+    // intel_pstate reports whether turbo is disabled, acpi-cpufreq whether boost is enabled
+    let read = |path: &str| {
+        fs::read_to_string(path)
+            .ok()
+            .map(|value| value.trim() == "1")
+    };
+    read("/sys/devices/system/cpu/intel_pstate/no_turbo")
+        .map(|no_turbo| !no_turbo)
+        .or_else(|| read("/sys/devices/system/cpu/cpufreq/boost"))
+}
+
+fn parse_load(loadavg: &str, cores: usize) -> Option<f64> {
+    let load = loadavg.split_whitespace().next()?.parse::<f64>().ok()?;
+    Some(load / cores.max(1) as f64)
+}
+
+fn read_ac_power(power_supplies: &Path) -> Option<bool> {
+    let read = |path: &Path, file: &str| {
+        fs::read_to_string(path.join(file))
+            .map(|value| value.trim().to_string())
+            .ok()
+    };
+    let supplies = fs::read_dir(power_supplies)
+        .ok()?
+        .flatten()
+        .map(|entry| entry.path())
+        .collect::<Vec<_>>();
+    let has_battery = supplies
+        .iter()
+        .any(|path| read(path, "type").as_deref() == Some("Battery"));
+    if !has_battery {
+        return None;
+    }
+    Some(supplies.iter().any(|path| {
+        read(path, "type").as_deref() == Some("Mains")
+            && read(path, "online").as_deref() == Some("1")
+    }))
+}
+
+/// # Returns
+/// Why the machine isn't fit to measure on, empty if every check passed or couldn't be made
+pub fn check(environment: &Environment, checks: &Checks) -> Vec<String> {
+    let mut problems = vec![];
+    if let Some(governor) = &environment.governor {
+        if governor != checks.governor() {
+            problems.push(format!(
+                "the CPU governor is {governor} rather than {}",
+                checks.governor()
+            ));
+        }
+    }
+    if let (Some(turbo), Some(expected)) = (environment.turbo, checks.turbo) {
+        if turbo != expected {
+            let state = |on| if on { "on" } else { "off" };
+            problems.push(format!(
+                "turbo boost is {} rather than {}",
+                state(turbo),
+                state(expected)
+            ));
+        }
+    }
+    if let Some(load) = environment.load {
+        if load > checks.max_load() {
+            problems.push(format!(
+                "the load average is {load:.2} per core, over the limit of {:.2}",
+                checks.max_load()
+            ));
+        }
+    }
+    if environment.ac_power == Some(false) && checks.ac_power() {
+        problems.push(String::from("the machine is running on battery"));
+    }
+    problems
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn environments_are_checked_before_measuring() {
+        assert_eq!(
+            parse_governors(&[
+                String::from("powersave"),
+                String::from("performance"),
+                String::from("powersave")
+            ]),
+            Some(String::from("performance,powersave"))
+        );
+        assert_eq!(parse_load("2.00 1.50 1.00 2/345 6789\n", 8), Some(0.25));
+
+        let quiet = Environment {
+            governor: Some(String::from("performance")),
+            turbo: Some(false),
+            load: Some(0.05),
+            ac_power: Some(true),
+        };
+        assert!(check(&quiet, &Checks::default()).is_empty());
+        assert_eq!(
+            quiet.to_string(),
+            "performance governor, turbo off, load 0.05 per core, on AC power"
+        );
+
+        let noisy = Environment {
+            governor: Some(String::from("powersave")),
+            turbo: Some(true),
+            load: Some(0.5),
+            ac_power: Some(false),
+        };
+        let checks = Checks {
+            turbo: Some(false),
+            ..Default::default()
+        };
+        assert_eq!(check(&noisy, &checks).len(), 4);
+
+        // nothing can be checked if nothing could be read
+        assert!(check(&Environment::default(), &checks).is_empty());
+    }
+}
@@ -0,0 +1,629 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+//! The schema of runs exported with `cardamon export`. Every field is documented here and fields
+//! which may be missing are null. The schema version only changes when a field is removed or its
+//! meaning changes, fields may be added without changing it.
+
+use crate::{
+    annotation::Annotation,
+    carbon,
+    config::{Blend, Config},
+    data_access::{cpu_metrics::CpuMetrics, run::Run, scenario_iteration::ScenarioIteration},
+    dataset::{ObservationDataset, ProcessMetrics, RunDataset, Stats},
+    environment::Environment,
+    git::Git,
+};
+use itertools::Itertools;
+use serde::Serialize;
+use std::time::Duration;
+
+/// The version of the schema below.
+pub const SCHEMA_VERSION: u32 = 1;
+
+#[derive(Debug, Serialize)]
+pub struct RunExport {
+    pub schema_version: u32,
+    pub run: RunMetadata,
+    pub scenarios: Vec<ScenarioExport>,
+}
+
+/// How the run was measured. Times are milliseconds since the unix epoch.
+#[derive(Debug, Serialize)]
+pub struct RunMetadata {
+    pub run_id: String,
+    pub start_time: i64,
+    pub stop_time: i64,
+    /// The TDP of the CPU in watts, null if energy couldn't be estimated.
+    pub tdp: Option<f64>,
+    /// Where the TDP came from, e.g. `config` or `detected`.
+    pub tdp_source: String,
+    /// Why energy couldn't be estimated, null if it could.
+    pub energy_unavailable: Option<String>,
+    /// Why the run stopped before all of its scenarios ran, null if it ran to the end.
+    pub aborted: Option<String>,
+    pub baseline_start: Option<i64>,
+    pub baseline_stop: Option<i64>,
+    /// How many failed scenario iterations were run again.
+    pub retries: i64,
+    /// The seed the scenarios were shuffled with, null if they weren't.
+    pub shuffle_seed: Option<i64>,
+    /// The state of the machine when the run started, null if it wasn't saved.
+    pub environment: Option<Environment>,
+    /// The grams of CO2e per kWh of the grid when the run started, null if it wasn't looked up.
+    pub carbon_intensity: Option<f64>,
+    /// Where the carbon intensity came from, e.g. `electricitymaps GB`.
+    pub carbon_intensity_source: Option<String>,
+    /// The Power Usage Effectiveness included in carbon, null if the run didn't have one.
+    pub pue: Option<f64>,
+    /// What the electricity of every scenario cost, null unless the run's config has a price.
+    pub cost: Option<f64>,
+    /// The currency of costs, e.g. `EUR`.
+    pub currency: Option<String>,
+    /// The commit the run measured, null if it wasn't started in a git repository.
+    pub git: Option<Git>,
+    /// The project the run belongs to, null if it doesn't belong to one.
+    pub project: Option<String>,
+    /// The notes added to the run with `cardamon annotate`, oldest first.
+    pub annotations: Vec<Annotation>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct ScenarioExport {
+    pub name: String,
+    /// The energy of the scenario's iterations in joules, null if the energy of no iteration is
+    /// known.
+    pub energy: Option<EnergyStats>,
+    /// How long the scenario's iterations took in seconds.
+    pub duration: Option<EnergyStats>,
+    /// Every process averaged over the iterations.
+    pub processes: Vec<ProcessExport>,
+    pub iterations: Vec<IterationExport>,
+    /// The embodied carbon of the hardware amortised over the mean iteration in grams CO2e, null
+    /// unless the run's config has embodied carbon.
+    pub embodied_carbon: Option<f64>,
+    /// The energy and carbon per functional unit, null unless the scenario has a functional unit
+    /// and served some.
+    pub per_unit: Option<PerUnitExport>,
+    /// What the electricity of the scenario cost, null unless the run's config has a price.
+    pub cost: Option<CostExport>,
+    /// The Software Carbon Intensity of the scenario, null unless it has a functional unit and the
+    /// run had a carbon intensity.
+    pub sci: Option<SciExport>,
+}
+
+/// The mean iteration divided by the functional units it served, so runs which did different
+/// amounts of work can be compared.
+#[derive(Debug, Serialize)]
+pub struct PerUnitExport {
+    /// What's counted, e.g. `request`.
+    pub functional_unit: String,
+    /// The mean number of functional units served per iteration.
+    pub functional_units: f64,
+    /// The joules per functional unit.
+    pub joules_per_unit: f64,
+    /// The operational grams CO2e per functional unit, null if the run had no carbon intensity.
+    pub grams_per_unit: Option<f64>,
+}
+
+/// Costs are in the currency of the run.
+#[derive(Debug, Serialize)]
+pub struct CostExport {
+    /// The mean cost of an iteration.
+    pub per_iteration: f64,
+    /// The cost of every iteration.
+    pub total: f64,
+}
+
+#[derive(Debug, Serialize)]
+pub struct SciExport {
+    /// What's counted, e.g. `request`.
+    pub functional_unit: String,
+    /// The mean number of functional units served per iteration.
+    pub functional_units: f64,
+    /// The grams CO2e per functional unit.
+    pub grams_per_unit: f64,
+}
+
+/// Statistics of the iterations of a scenario, of their energy in joules or duration in seconds.
+#[derive(Debug, Serialize)]
+pub struct EnergyStats {
+    pub iterations: usize,
+    pub mean: f64,
+    pub median: f64,
+    pub p90: f64,
+    pub p99: f64,
+    /// The sample standard deviation.
+    pub stddev: f64,
+    pub min: f64,
+    pub max: f64,
+    /// How many iterations were left out as outliers, they're still in the scenario's iterations.
+    pub outliers: usize,
+}
+impl From<Stats> for EnergyStats {
+    fn from(stats: Stats) -> Self {
+        Self {
+            iterations: stats.iterations,
+            mean: stats.mean,
+            median: stats.median,
+            p90: stats.p90,
+            p99: stats.p99,
+            stddev: stats.stddev,
+            min: stats.min,
+            max: stats.max,
+            outliers: stats.outliers,
+        }
+    }
+}
+
+#[derive(Debug, Serialize)]
+pub struct IterationExport {
+    pub iteration: i64,
+    pub start_time: i64,
+    pub stop_time: i64,
+    /// The energy of every process in the iteration in joules, null if none is known.
+    pub joules: Option<f64>,
+    /// The requests which succeeded when the scenario replays a trace, null otherwise.
+    pub requests: Option<i64>,
+    /// The replayed requests which failed, null unless the scenario replays a trace.
+    pub failed_requests: Option<i64>,
+    /// The functional units served, null if the scenario has no functional unit.
+    pub functional_units: Option<f64>,
+    pub budget_exceeded: bool,
+    pub cold_start: bool,
+    /// Whether the energy of the iteration was left out of the scenario's statistics as an
+    /// outlier.
+    pub outlier: bool,
+    pub processes: Vec<ProcessExport>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct ProcessExport {
+    pub process_id: String,
+    pub process_name: String,
+    /// The mean CPU usage as a percentage of a single core.
+    pub cpu_usage_mean: f64,
+    pub cpu_seconds: f64,
+    /// The energy of the process in joules, null if it could neither be estimated nor measured.
+    pub joules: Option<f64>,
+    /// Where the energy came from, `estimated`, `measured` or `blended estimate`.
+    pub energy_source: Option<String>,
+    /// Energy measured by power sources keyed by component, e.g. `cpu`.
+    pub measured_joules: std::collections::BTreeMap<String, f64>,
+    pub network_bytes: Option<f64>,
+    pub disk_bytes: Option<f64>,
+    pub disk_ops: Option<f64>,
+    pub peak_memory_bytes: Option<f64>,
+    pub throttled_secs: Option<f64>,
+}
+impl ProcessExport {
+    fn new(metrics: &ProcessMetrics, tdp: Option<f64>, blend: Option<&Blend>) -> Self {
+        let energy = metrics.energy(tdp, blend);
+        Self {
+            process_id: String::from(metrics.process_id()),
+            process_name: String::from(metrics.process_name()),
+            cpu_usage_mean: metrics.cpu_usage_mean(),
+            cpu_seconds: metrics.cpu_seconds(),
+            joules: energy.as_ref().map(|energy| energy.joules()),
+            energy_source: energy.as_ref().map(|energy| String::from(energy.label())),
+            measured_joules: metrics.measured_joules().clone(),
+            network_bytes: metrics.network_bytes(),
+            disk_bytes: metrics.disk_io().map(|(bytes, _)| bytes),
+            disk_ops: metrics.disk_io().map(|(_, ops)| ops),
+            peak_memory_bytes: metrics.peak_memory_bytes(),
+            throttled_secs: metrics.throttled_secs(),
+        }
+    }
+}
+
+/// Processes are sorted so exports of the same run are identical.
+fn processes(
+    process_metrics: Vec<ProcessMetrics>,
+    tdp: Option<f64>,
+    blend: Option<&Blend>,
+) -> Vec<ProcessExport> {
+    process_metrics
+        .iter()
+        .sorted_by(|a, b| {
+            (a.process_name(), a.process_id()).cmp(&(b.process_name(), b.process_id()))
+        })
+        .map(|metrics| ProcessExport::new(metrics, tdp, blend))
+        .collect()
+}
+
+fn scenario(
+    run_dataset: &RunDataset,
+    run: &Run,
+    blend: Option<&Blend>,
+    config: Option<&Config>,
+) -> ScenarioExport {
+    let tdp = run.tdp;
+    let outlier_threshold = config.and_then(|config| config.outlier_threshold);
+    let outliers = outlier_threshold
+        .map(|threshold| run_dataset.outlier_iterations(tdp, blend, threshold))
+        .unwrap_or_default();
+    let iterations = run_dataset
+        .by_iterations()
+        .iter()
+        .map(|it| {
+            let scenario_iteration = it.scenario_iteration();
+            IterationExport {
+                iteration: scenario_iteration.iteration,
+                start_time: scenario_iteration.start_time,
+                stop_time: scenario_iteration.stop_time,
+                joules: it.joules(tdp, blend),
+                requests: scenario_iteration.requests,
+                failed_requests: scenario_iteration.failed_requests,
+                functional_units: scenario_iteration.functional_units,
+                budget_exceeded: scenario_iteration.budget_exceeded,
+                cold_start: scenario_iteration.cold_start,
+                outlier: outliers.contains(&scenario_iteration.iteration),
+                processes: processes(it.accumulate_by_process(), tdp, blend),
+            }
+        })
+        .sorted_by_key(|it| it.iteration)
+        .collect();
+
+    let energy = run_dataset
+        .energy_stats(tdp, blend, outlier_threshold)
+        .map(EnergyStats::from);
+    let wall_clock = Duration::from_secs_f64(run_dataset.mean_iteration_secs());
+    let embodied = config
+        .and_then(|config| config.carbon.as_ref())
+        .and_then(|carbon| carbon.embodied.as_ref());
+    let functional_unit = config.and_then(|config| {
+        config
+            .scenarios
+            .iter()
+            .find(|scenario| scenario.name == run_dataset.scenario_name())?
+            .functional_unit
+            .as_ref()
+    });
+    let intensity = run.carbon_intensity.or_else(|| {
+        let carbon = config?.carbon.as_ref();
+        let (intensity, _) = carbon?.static_intensity(run.start_time)?;
+        Some(intensity)
+    });
+    let per_unit = functional_unit.and_then(|functional_unit| {
+        let functional_units = run_dataset
+            .functional_units_per_iteration()
+            .filter(|units| *units > 0.0)?;
+        let joules = energy.as_ref()?.mean;
+        Some(PerUnitExport {
+            functional_unit: functional_unit.name.clone(),
+            functional_units,
+            joules_per_unit: joules / functional_units,
+            grams_per_unit: intensity.map(|intensity| {
+                carbon::operational_grams(carbon::facility_joules(joules, run.pue), intensity)
+                    / functional_units
+            }),
+        })
+    });
+    let sci = functional_unit.and_then(|functional_unit| {
+        let functional_units = run_dataset.functional_units_per_iteration()?;
+        let grams_per_unit = carbon::sci(
+            carbon::facility_joules(energy.as_ref()?.mean, run.pue),
+            intensity?,
+            embodied,
+            wall_clock,
+            functional_units,
+        )?;
+        Some(SciExport {
+            functional_unit: functional_unit.name.clone(),
+            functional_units,
+            grams_per_unit,
+        })
+    });
+
+    let cost = config
+        .and_then(|config| config.cost.as_ref())
+        .map(|cost| run_dataset.iteration_costs(tdp, blend, run.pue, cost))
+        .filter(|costs| !costs.is_empty())
+        .map(|costs| CostExport {
+            per_iteration: costs.iter().sum::<f64>() / costs.len() as f64,
+            total: costs.iter().sum(),
+        });
+
+    ScenarioExport {
+        name: String::from(run_dataset.scenario_name()),
+        energy,
+        duration: run_dataset.duration_stats().map(EnergyStats::from),
+        processes: processes(run_dataset.averaged(), tdp, blend),
+        iterations,
+        embodied_carbon: embodied.map(|embodied| carbon::embodied_grams(embodied, wall_clock)),
+        per_unit,
+        cost,
+        sci,
+    }
+}
+
+/// # Returns
+/// The export of the run in the dataset, None if the dataset has no run
+pub fn export(
+    observation_dataset: &ObservationDataset,
+    blend: Option<&Blend>,
+) -> Option<RunExport> {
+    let run: &Run = observation_dataset.runs().first()?;
+    // functional units and carbon intensity come from the config the run was started with
+    let config = run
+        .config
+        .as_deref()
+        .and_then(|config| toml::from_str::<Config>(config).ok());
+    let scenarios = observation_dataset
+        .by_scenario()
+        .iter()
+        .flat_map(|scenario_dataset| scenario_dataset.by_run())
+        .map(|run_dataset| scenario(&run_dataset, run, blend, config.as_ref()))
+        .collect::<Vec<_>>();
+    let currency = config
+        .as_ref()
+        .and_then(|config| config.cost.as_ref())
+        .map(|cost| cost.currency.clone());
+    let cost = currency.as_ref().map(|_| {
+        scenarios
+            .iter()
+            .filter_map(|scenario| scenario.cost.as_ref())
+            .map(|cost| cost.total)
+            .sum()
+    });
+
+    Some(RunExport {
+        schema_version: SCHEMA_VERSION,
+        run: RunMetadata {
+            run_id: run.run_id.clone(),
+            start_time: run.start_time,
+            stop_time: run.stop_time,
+            tdp: run.tdp,
+            tdp_source: run.tdp_source.clone(),
+            energy_unavailable: run.energy_unavailable.clone(),
+            aborted: run.aborted.clone(),
+            baseline_start: run.baseline_start,
+            baseline_stop: run.baseline_stop,
+            retries: run.retries,
+            shuffle_seed: run.shuffle_seed,
+            environment: run
+                .environment
+                .as_deref()
+                .and_then(|json| serde_json::from_str(json).ok()),
+            carbon_intensity: run.carbon_intensity,
+            carbon_intensity_source: run.carbon_intensity_source.clone(),
+            pue: run.pue,
+            cost,
+            currency,
+            git: run.git(),
+            project: run.project.clone(),
+            annotations: run.annotations(),
+        },
+        scenarios,
+    })
+}
+
+/// A single CPU sample, as exported with `cardamon export --raw`.
+#[derive(Debug, Serialize)]
+pub struct RawSample {
+    /// Milliseconds since the unix epoch.
+    pub timestamp: i64,
+    /// The scenario running when the sample was taken, null if none was.
+    pub scenario: Option<String>,
+    pub iteration: Option<i64>,
+    /// The pid or container id of the process.
+    pub process_id: String,
+    pub process_name: String,
+    /// The CPU usage as a percentage of a single core since the previous sample.
+    pub cpu_usage: f64,
+    pub core_count: i64,
+    /// The power of the process estimated with the TDP, null if the TDP is unknown.
+    pub power_watts: Option<f64>,
+}
+
+/// # Arguments
+/// * run - the run the samples were taken in
+/// * cpu_metrics - every sample taken during the run
+/// * scenario_iterations - the scenario iterations of the run
+///
+/// # Returns
+/// The samples in the order they were taken, along with the scenario iteration running at the
+/// time
+pub fn raw_samples(
+    run: &Run,
+    cpu_metrics: &[CpuMetrics],
+    scenario_iterations: &[ScenarioIteration],
+) -> Vec<RawSample> {
+    cpu_metrics
+        .iter()
+        .sorted_by_key(|metrics| (metrics.timestamp, &metrics.process_id))
+        .map(|metrics| {
+            // scenarios running in parallel overlap, the scenario a process was observed for wins
+            let scenario_iteration = scenario_iterations
+                .iter()
+                .filter(|it| {
+                    it.start_time <= metrics.timestamp && metrics.timestamp <= it.stop_time
+                })
+                .find(|it| {
+                    metrics
+                        .scenario_name
+                        .as_ref()
+                        .map_or(true, |name| name == &it.scenario_name)
+                });
+            let power_watts = run.tdp.map(|tdp| {
+                let share = metrics.cpu_usage / 100.0 / metrics.core_count.max(1) as f64;
+                share.min(1.0) * tdp
+            });
+
+            RawSample {
+                timestamp: metrics.timestamp,
+                scenario: scenario_iteration
+                    .map(|it| it.scenario_name.clone())
+                    .or(metrics.scenario_name.clone()),
+                iteration: scenario_iteration.map(|it| it.iteration),
+                process_id: metrics.process_id.clone(),
+                process_name: metrics.process_name.clone(),
+                cpu_usage: metrics.cpu_usage,
+                core_count: metrics.core_count,
+                power_watts,
+            }
+        })
+        .collect()
+}
+
+/// # Returns
+/// The samples as CSV with a header row, missing values are left empty
+pub fn raw_csv(samples: &[RawSample]) -> String {
+    let mut csv = String::from(
+        "timestamp,scenario,iteration,process_id,process_name,cpu_usage,core_count,power_watts\n",
+    );
+    for sample in samples.iter() {
+        let row = [
+            sample.timestamp.to_string(),
+            csv_field(sample.scenario.as_deref().unwrap_or_default()),
+            sample
+                .iteration
+                .map(|iteration| iteration.to_string())
+                .unwrap_or_default(),
+            csv_field(&sample.process_id),
+            csv_field(&sample.process_name),
+            sample.cpu_usage.to_string(),
+            sample.core_count.to_string(),
+            sample
+                .power_watts
+                .map(|watts| watts.to_string())
+                .unwrap_or_default(),
+        ];
+        csv.push_str(&row.join(","));
+        csv.push('\n');
+    }
+    csv
+}
+
+/// Quotes a field if it contains anything with a meaning in CSV.
+fn csv_field(field: &str) -> String {
+    if field.contains([',', '"', '\n', '\r']) {
+        format!("\"{}\"", field.replace('"', "\"\""))
+    } else {
+        String::from(field)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::dataset::IterationWithMetrics;
+
+    #[test]
+    fn runs_are_exported_with_their_schema_version() -> anyhow::Result<()> {
+        let iteration = |iteration, start: i64| {
+            IterationWithMetrics::new(
+                ScenarioIteration::new("1", "basket_10", iteration, start, start + 2000, None),
+                vec![
+                    CpuMetrics::new("1", "10", "server", 100.0, 100.0, 4, start),
+                    CpuMetrics::new("1", "10", "server", 100.0, 100.0, 4, start + 2000),
+                ],
+                vec![],
+                vec![],
+            )
+        };
+        let runs = vec![Run::new("1", 0, 10000, Some(40.0), "config", None, None)];
+        let observation_dataset =
+            ObservationDataset::new(vec![iteration(1, 5000), iteration(0, 0)], runs, vec![]);
+
+        let export = export(&observation_dataset, None).expect("the run should be exported");
+        let json = serde_json::to_value(&export)?;
+        assert_eq!(json["schema_version"], SCHEMA_VERSION);
+        assert_eq!(json["run"]["run_id"], "1");
+        assert!(json["run"]["environment"].is_null());
+
+        let scenario = &json["scenarios"][0];
+        assert_eq!(scenario["name"], "basket_10");
+        assert_eq!(scenario["energy"]["iterations"], 2);
+        assert_eq!(scenario["iterations"][0]["iteration"], 0);
+        // a quarter of the CPU for 2 seconds at 40 W
+        assert_eq!(scenario["iterations"][0]["joules"], 20.0);
+        assert_eq!(scenario["processes"][0]["process_name"], "server");
+        assert_eq!(scenario["processes"][0]["energy_source"], "estimated");
+
+        let empty = ObservationDataset::new(vec![], vec![], vec![]);
+        assert!(super::export(&empty, None).is_none());
+        Ok(())
+    }
+
+    #[test]
+    fn energy_is_divided_by_the_work_done() -> anyhow::Result<()> {
+        let config = r#"
+            [[scenarios]]
+            name = "basket_10"
+            desc = ""
+            command = "node basket.js"
+            iterations = 1
+            processes = ["server"]
+            functional_unit = { name = "request" }
+
+            [[observations]]
+            name = "checkout"
+            scenarios = ["basket_10"]
+            "#;
+        let scenario_iteration = ScenarioIteration {
+            functional_units: Some(40.0),
+            ..ScenarioIteration::new("1", "basket_10", 0, 0, 2000, None)
+        };
+        let iterations = vec![IterationWithMetrics::new(
+            scenario_iteration,
+            vec![
+                CpuMetrics::new("1", "10", "server", 100.0, 100.0, 4, 0),
+                CpuMetrics::new("1", "10", "server", 100.0, 100.0, 4, 2000),
+            ],
+            vec![],
+            vec![],
+        )];
+        let runs = vec![Run {
+            carbon_intensity: Some(360.0),
+            ..Run::new("1", 0, 10000, Some(40.0), "config", None, Some(config))
+        }];
+        let observation_dataset = ObservationDataset::new(iterations, runs, vec![]);
+
+        let export = export(&observation_dataset, None).expect("the run should be exported");
+        let json = serde_json::to_value(&export)?;
+        assert!(json["run"]["cost"].is_null());
+        let per_unit = &json["scenarios"][0]["per_unit"];
+        assert_eq!(per_unit["functional_unit"], "request");
+        // 20 J over 40 requests, at 360 g/kWh a joule is 0.0001 g
+        assert_eq!(per_unit["joules_per_unit"], 0.5);
+        let grams = per_unit["grams_per_unit"].as_f64().unwrap_or_default();
+        assert!((grams - 0.00005).abs() < 1e-12);
+        Ok(())
+    }
+
+    #[test]
+    fn raw_samples_are_exported_as_csv() {
+        let run = Run::new("1", 0, 10000, Some(40.0), "config", None, None);
+        let cpu_metrics = vec![
+            CpuMetrics::new("1", "10", "server, api", 50.0, 100.0, 4, 2000),
+            CpuMetrics::new("1", "10", "server, api", 100.0, 100.0, 4, 1000),
+            CpuMetrics::new("1", "10", "server, api", 100.0, 100.0, 4, 8000),
+        ];
+        let scenario_iterations = vec![ScenarioIteration::new(
+            "1",
+            "basket_10",
+            0,
+            1000,
+            3000,
+            None,
+        )];
+
+        let samples = raw_samples(&run, &cpu_metrics, &scenario_iterations);
+        assert_eq!(
+            samples.iter().map(|s| s.timestamp).collect::<Vec<_>>(),
+            vec![1000, 2000, 8000]
+        );
+        assert_eq!(samples[0].power_watts, Some(10.0));
+
+        let csv = raw_csv(&samples);
+        let lines = csv.lines().collect::<Vec<_>>();
+        assert_eq!(lines.len(), 4);
+        assert_eq!(lines[1], "1000,basket_10,0,10,\"server, api\",100,4,10");
+        // samples taken between scenarios don't belong to one
+        assert_eq!(lines[3], "8000,,,10,\"server, api\",100,4,10");
+    }
+}
@@ -0,0 +1,450 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{metrics::CpuMetrics, metrics_logger::StopHandle};
+use anyhow::Context;
+use axum::{
+    extract::{
+        ws::{Message, WebSocket, WebSocketUpgrade},
+        State,
+    },
+    http::header,
+    response::IntoResponse,
+    routing::get,
+    Router,
+};
+use serde::Serialize;
+use std::{
+    collections::BTreeMap,
+    fmt::Write,
+    sync::{Arc, Mutex},
+};
+use tokio::time::Duration;
+use tokio_util::sync::CancellationToken;
+
+/// The port `/metrics` is served on unless the config sets one.
+pub const DEFAULT_PORT: u16 = 9464;
+
+/// How often the samples logged for a scenario are added to the live metrics, and how often they're
+/// streamed on `/live`.
+pub const UPDATE_INTERVAL: Duration = Duration::from_secs(1);
+
+#[derive(Debug, Default, PartialEq)]
+struct ProcessGauges {
+    process_name: String,
+    cpu_usage: f64,
+    /// The power of the process at its latest sample, None without a TDP.
+    watts: Option<f64>,
+    joules: f64,
+    last_timestamp: i64,
+}
+
+/// Keyed by the scenario the process was observed for and the process's id.
+type ProcessKey = (String, String);
+
+#[derive(Debug, Default)]
+struct Live {
+    run_id: Option<String>,
+    running: Vec<String>,
+    processes: BTreeMap<ProcessKey, ProcessGauges>,
+    /// How many scenario iterations the run does, None while observing.
+    iterations: Option<usize>,
+    finished_iterations: usize,
+}
+
+/// The live metrics of the run at a point in time, streamed as JSON on `/live`.
+#[derive(Debug, Serialize, PartialEq)]
+pub struct Snapshot {
+    pub run_id: Option<String>,
+    /// Milliseconds since the unix epoch.
+    pub timestamp: i64,
+    /// The scenarios running, more than one if they run in parallel.
+    pub running: Vec<String>,
+    /// How many scenario iterations have finished or were skipped.
+    pub finished_iterations: usize,
+    /// How many scenario iterations the run does, null while observing.
+    pub iterations: Option<usize>,
+    /// The power of every process, null without a TDP.
+    pub watts: Option<f64>,
+    pub processes: Vec<ProcessSnapshot>,
+}
+
+#[derive(Debug, Serialize, PartialEq)]
+pub struct ProcessSnapshot {
+    /// The scenario the process was observed for.
+    pub scenario: String,
+    pub process_id: String,
+    pub process_name: String,
+    /// The CPU usage as a percentage of a single core.
+    pub cpu_usage: f64,
+    /// The power at the latest sample, null without a TDP.
+    pub watts: Option<f64>,
+    /// The energy since the run started, null without a TDP.
+    pub joules: Option<f64>,
+}
+
+/// The metrics of the run in progress in the form Prometheus scrapes. Clones share the same
+/// metrics, so the run can update them while the server reads them.
+#[derive(Debug, Clone, Default)]
+pub struct Exporter {
+    live: Arc<Mutex<Live>>,
+    tdp: Option<f64>,
+}
+impl Exporter {
+    /// # Arguments
+    /// * tdp - the TDP of the run, the power of processes is only exported if it's known
+    pub fn new(tdp: Option<f64>) -> Self {
+        Self {
+            live: Arc::default(),
+            tdp,
+        }
+    }
+
+    /// # Arguments
+    /// * run_id - the run the metrics are of
+    /// * iterations - how many scenario iterations the run does, None while observing
+    pub fn planned(&self, run_id: &str, iterations: Option<usize>) {
+        let mut live = self.live.lock().expect("exporter lock poisoned");
+        live.run_id = Some(String::from(run_id));
+        live.iterations = iterations;
+    }
+
+    pub fn scenario_started(&self, scenario: &str) {
+        let mut live = self.live.lock().expect("exporter lock poisoned");
+        live.running.push(String::from(scenario));
+    }
+
+    /// The scenario's processes keep their energy but no longer draw any power for it.
+    pub fn scenario_finished(&self, scenario: &str) {
+        let mut live = self.live.lock().expect("exporter lock poisoned");
+        live.running.retain(|running| running != scenario);
+        for ((process_scenario, _), gauges) in live.processes.iter_mut() {
+            if process_scenario == scenario {
+                gauges.cpu_usage = 0.0;
+                gauges.watts = gauges.watts.map(|_| 0.0);
+            }
+        }
+    }
+
+    /// Counts a scenario iteration towards the progress of the run, whether it ran or was skipped.
+    pub fn iteration_finished(&self) {
+        let mut live = self.live.lock().expect("exporter lock poisoned");
+        live.finished_iterations += 1;
+    }
+
+    /// Adds the samples taken since the previous call, samples seen before are ignored so the
+    /// whole log of a scenario can be passed in each time.
+    pub fn record(&self, scenario: &str, cpu_metrics: &[CpuMetrics]) {
+        let mut live = self.live.lock().expect("exporter lock poisoned");
+        let mut samples = cpu_metrics.iter().collect::<Vec<_>>();
+        samples.sort_by_key(|metrics| metrics.timestamp);
+        for metrics in samples {
+            let key = (String::from(scenario), metrics.process_id.clone());
+            let gauges = live.processes.entry(key).or_default();
+            if metrics.timestamp <= gauges.last_timestamp {
+                continue;
+            }
+
+            let share = (metrics.cpu_usage / 100.0 / metrics.core_count.max(1) as f64).min(1.0);
+            let watts = self.tdp.map(|tdp| share * tdp);
+            // like the saved samples, the first one has nothing to measure the time since
+            if let (Some(watts), true) = (watts, gauges.last_timestamp > 0) {
+                let secs = (metrics.timestamp - gauges.last_timestamp) as f64 / 1000.0;
+                gauges.joules += watts * secs;
+            }
+            gauges.process_name = metrics.process_name.clone();
+            gauges.cpu_usage = metrics.cpu_usage;
+            gauges.watts = watts;
+            gauges.last_timestamp = metrics.timestamp;
+        }
+    }
+
+    /// # Returns
+    /// The metrics in the Prometheus text exposition format
+    pub fn render(&self) -> String {
+        let live = self.live.lock().expect("exporter lock poisoned");
+        let mut text = String::new();
+
+        let _ = writeln!(
+            text,
+            "# HELP cardamon_scenario_running Whether the scenario is running.\n# TYPE cardamon_scenario_running gauge"
+        );
+        for scenario in live.running.iter() {
+            let _ = writeln!(
+                text,
+                "cardamon_scenario_running{{scenario=\"{}\"}} 1",
+                escape(scenario)
+            );
+        }
+
+        let labels = |(scenario, process_id): &ProcessKey, gauges: &ProcessGauges| {
+            format!(
+                "process=\"{}\",process_id=\"{}\",scenario=\"{}\"",
+                escape(&gauges.process_name),
+                escape(process_id),
+                escape(scenario)
+            )
+        };
+        let _ = writeln!(
+            text,
+            "# HELP cardamon_process_cpu_usage_percent CPU usage of the process as a percentage of a single core.\n# TYPE cardamon_process_cpu_usage_percent gauge"
+        );
+        for (key, gauges) in live.processes.iter() {
+            let _ = writeln!(
+                text,
+                "cardamon_process_cpu_usage_percent{{{}}} {}",
+                labels(key, gauges),
+                gauges.cpu_usage
+            );
+        }
+        if self.tdp.is_some() {
+            let _ = writeln!(
+                text,
+                "# HELP cardamon_process_power_watts Power of the process estimated with the TDP.\n# TYPE cardamon_process_power_watts gauge"
+            );
+            for (key, gauges) in live.processes.iter() {
+                if let Some(watts) = gauges.watts {
+                    let _ = writeln!(
+                        text,
+                        "cardamon_process_power_watts{{{}}} {}",
+                        labels(key, gauges),
+                        watts
+                    );
+                }
+            }
+            let _ = writeln!(
+                text,
+                "# HELP cardamon_process_energy_joules_total Energy of the process estimated with the TDP since the run started.\n# TYPE cardamon_process_energy_joules_total counter"
+            );
+            for (key, gauges) in live.processes.iter() {
+                let _ = writeln!(
+                    text,
+                    "cardamon_process_energy_joules_total{{{}}} {}",
+                    labels(key, gauges),
+                    gauges.joules
+                );
+            }
+        }
+        text
+    }
+
+    /// # Returns
+    /// The live metrics as they are now
+    pub fn snapshot(&self) -> Snapshot {
+        let live = self.live.lock().expect("exporter lock poisoned");
+        let processes = live
+            .processes
+            .iter()
+            .map(|((scenario, process_id), gauges)| ProcessSnapshot {
+                scenario: scenario.clone(),
+                process_id: process_id.clone(),
+                process_name: gauges.process_name.clone(),
+                cpu_usage: gauges.cpu_usage,
+                watts: gauges.watts,
+                joules: self.tdp.map(|_| gauges.joules),
+            })
+            .collect::<Vec<_>>();
+        let watts = self.tdp.map(|_| {
+            processes
+                .iter()
+                .filter_map(|process| process.watts)
+                .sum::<f64>()
+        });
+
+        Snapshot {
+            run_id: live.run_id.clone(),
+            timestamp: chrono::Utc::now().timestamp_millis(),
+            running: live.running.clone(),
+            finished_iterations: live.finished_iterations,
+            iterations: live.iterations,
+            watts,
+            processes,
+        }
+    }
+
+    /// Adds the samples logged for a scenario to the live metrics until it finishes.
+    ///
+    /// # Arguments
+    /// * `scenario` - The name of the scenario the samples are labelled with
+    /// * `stop_handle` - The loggers of the scenario
+    /// * `finished` - Cancelled once the scenario has finished
+    pub async fn watch(
+        &self,
+        scenario: &str,
+        stop_handle: &StopHandle,
+        finished: &CancellationToken,
+    ) {
+        self.scenario_started(scenario);
+        loop {
+            let done = tokio::select! {
+                _ = finished.cancelled() => true,
+                _ = tokio::time::sleep(UPDATE_INTERVAL) => false,
+            };
+            stop_handle.with_log(|log| self.record(scenario, log.get_metrics()));
+            if done {
+                break;
+            }
+        }
+        self.scenario_finished(scenario);
+    }
+}
+
+fn escape(label: &str) -> String {
+    label
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+/// Serves `/metrics` and `/live` in the background, the server stops when it's dropped.
+pub struct Server {
+    handle: tokio::task::JoinHandle<()>,
+}
+impl Drop for Server {
+    fn drop(&mut self) {
+        self.handle.abort();
+    }
+}
+
+/// Starts serving `/metrics`, and streaming the same metrics over a WebSocket on `/live`.
+///
+/// # Arguments
+///
+/// * `port` - The port to listen on
+/// * `exporter` - The metrics to serve
+///
+/// # Returns
+///
+/// The running server, an error if the port can't be listened on
+pub async fn serve(port: u16, exporter: Exporter) -> anyhow::Result<Server> {
+    let app = Router::new()
+        .route("/metrics", get(metrics))
+        .route("/live", get(live))
+        .with_state(exporter);
+
+    let listener = tokio::net::TcpListener::bind(format!("0.0.0.0:{port}"))
+        .await
+        .context(format!("Unable to serve metrics on port {port}"))?;
+    tracing::info!("Serving Prometheus metrics on port {port}");
+    let handle = tokio::spawn(async move {
+        if let Err(err) = axum::serve(listener, app).await {
+            tracing::warn!("Metrics server stopped unexpectedly: {}", err);
+        }
+    });
+    Ok(Server { handle })
+}
+
+async fn metrics(State(exporter): State<Exporter>) -> impl IntoResponse {
+    (
+        [(header::CONTENT_TYPE, "text/plain; version=0.0.4")],
+        exporter.render(),
+    )
+}
+
+async fn live(ws: WebSocketUpgrade, State(exporter): State<Exporter>) -> impl IntoResponse {
+    ws.on_upgrade(|socket| stream(socket, exporter))
+}
+
+/// Sends a snapshot of the live metrics every UPDATE_INTERVAL until the client goes away.
+async fn stream(mut socket: WebSocket, exporter: Exporter) {
+    let mut update = tokio::time::interval(UPDATE_INTERVAL);
+    loop {
+        update.tick().await;
+        let snapshot = match serde_json::to_string(&exporter.snapshot()) {
+            Ok(snapshot) => snapshot,
+            Err(err) => {
+                tracing::warn!("Unable to stream live metrics: {}", err);
+                break;
+            }
+        };
+        if socket.send(Message::Text(snapshot)).await.is_err() {
+            break;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn sample(cpu_usage: f64, timestamp: i64) -> CpuMetrics {
+        CpuMetrics {
+            process_id: String::from("10"),
+            process_name: String::from("server"),
+            cpu_usage,
+            core_count: 4,
+            timestamp,
+        }
+    }
+
+    #[test]
+    fn live_metrics_are_rendered_for_prometheus() {
+        let exporter = Exporter::new(Some(40.0));
+        exporter.scenario_started("basket_10");
+        exporter.record("basket_10", &[sample(100.0, 1000), sample(200.0, 2000)]);
+        // the whole log is passed in again with a new sample
+        exporter.record(
+            "basket_10",
+            &[
+                sample(100.0, 1000),
+                sample(200.0, 2000),
+                sample(400.0, 3000),
+            ],
+        );
+
+        let text = exporter.render();
+        let labels = "process=\"server\",process_id=\"10\",scenario=\"basket_10\"";
+        assert!(text.contains("cardamon_scenario_running{scenario=\"basket_10\"} 1"));
+        assert!(text.contains(&format!("cardamon_process_power_watts{{{labels}}} 40")));
+        // half the CPU for a second then all of it for a second at 40 W
+        assert!(text.contains(&format!(
+            "cardamon_process_energy_joules_total{{{labels}}} 60"
+        )));
+
+        exporter.scenario_finished("basket_10");
+        let text = exporter.render();
+        assert!(!text.contains("cardamon_scenario_running{"));
+        assert!(text.contains(&format!("cardamon_process_power_watts{{{labels}}} 0")));
+        assert!(text.contains(&format!(
+            "cardamon_process_energy_joules_total{{{labels}}} 60"
+        )));
+
+        // without a TDP only the CPU usage is known
+        let exporter = Exporter::new(None);
+        exporter.record("basket_10", &[sample(100.0, 1000)]);
+        assert!(!exporter.render().contains("watts"));
+    }
+
+    #[test]
+    fn snapshots_show_the_progress_of_the_run() {
+        let exporter = Exporter::new(Some(40.0));
+        exporter.planned("abc12", Some(4));
+        exporter.scenario_started("basket_10");
+        exporter.record("basket_10", &[sample(100.0, 1000), sample(200.0, 2000)]);
+        exporter.iteration_finished();
+
+        let snapshot = exporter.snapshot();
+        assert_eq!(snapshot.run_id.as_deref(), Some("abc12"));
+        assert_eq!(snapshot.running, ["basket_10"]);
+        assert_eq!(
+            (snapshot.finished_iterations, snapshot.iterations),
+            (1, Some(4))
+        );
+        assert_eq!(snapshot.watts, Some(20.0));
+        assert_eq!(snapshot.processes[0].joules, Some(20.0));
+
+        exporter.scenario_finished("basket_10");
+        let snapshot = exporter.snapshot();
+        assert!(snapshot.running.is_empty());
+        assert_eq!(snapshot.watts, Some(0.0));
+
+        let exporter = Exporter::new(None);
+        exporter.record("basket_10", &[sample(100.0, 1000)]);
+        let snapshot = exporter.snapshot();
+        assert_eq!(snapshot.watts, None);
+        assert_eq!(snapshot.processes[0].joules, None);
+    }
+}
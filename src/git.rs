@@ -0,0 +1,116 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use serde::{Deserialize, Serialize};
+use std::{fmt, path::Path, process::Command};
+
+/// The shortest commit prefix a run can be looked up by, so it can't be mistaken for a run id.
+pub const MIN_COMMIT_PREFIX: usize = 7;
+
+/// The commit of the git repository a run was started in, saved with the run so its results can
+/// be traced back to the code they measured.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Git {
+    pub commit: String,
+    /// None if HEAD was detached, e.g. in CI jobs which check out a commit.
+    pub branch: Option<String>,
+    /// True if there were uncommitted changes, so the commit isn't all the run measured.
+    pub dirty: bool,
+    /// The tag pointing at the commit, if there is one.
+    pub tag: Option<String>,
+}
+impl Git {
+    pub fn short_commit(&self) -> &str {
+        &self.commit[..self.commit.len().min(MIN_COMMIT_PREFIX)]
+    }
+
+    /// True if the commit starts with the given prefix and it's long enough to be a commit
+    /// rather than a run id.
+    pub fn is_commit(&self, prefix: &str) -> bool {
+        prefix.len() >= MIN_COMMIT_PREFIX && self.commit.starts_with(&prefix.to_lowercase())
+    }
+}
+
+impl fmt::Display for Git {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}", self.short_commit())?;
+        if self.dirty {
+            write!(f, "-dirty")?;
+        }
+        let names = [self.branch.as_deref(), self.tag.as_deref()]
+            .into_iter()
+            .flatten()
+            .collect::<Vec<_>>();
+        if !names.is_empty() {
+            write!(f, " ({})", names.join(", "))?;
+        }
+        Ok(())
+    }
+}
+
+/// Reads the commit checked out in the git repository containing the directory.
+///
+/// # Returns
+/// The commit, None if the directory isn't in a git repository or git isn't installed
+pub fn read(dir: &Path) -> Option<Git> {
+    let commit = git(dir, &["rev-parse", "HEAD"])?;
+    let branch = git(dir, &["rev-parse", "--abbrev-ref", "HEAD"]).filter(|branch| branch != "HEAD");
+    let dirty = git(dir, &["status", "--porcelain", "--untracked-files=no"]).is_some();
+    let tag = git(dir, &["describe", "--tags", "--exact-match", "HEAD"]);
+
+    Some(Git {
+        commit,
+        branch,
+        dirty,
+        tag,
+    })
+}
+
+/// # Returns
+/// What git printed, None if it failed or printed nothing
+fn git(dir: &Path, args: &[&str]) -> Option<String> {
+    let output = Command::new("git")
+        .args(args)
+        .current_dir(dir)
+        .output()
+        .ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    let stdout = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    if stdout.is_empty() {
+        None
+    } else {
+        Some(stdout)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn commits_are_shown_with_their_branch_and_tag() {
+        let git = Git {
+            commit: String::from("3f9a2c1d8e7b6a5f4e3d2c1b0a9f8e7d6c5b4a39"),
+            branch: Some(String::from("main")),
+            dirty: true,
+            tag: Some(String::from("v1.2.0")),
+        };
+        assert_eq!(git.to_string(), "3f9a2c1-dirty (main, v1.2.0)");
+        assert!(git.is_commit("3F9A2C1D"));
+        assert!(!git.is_commit("3f9a2"));
+        assert!(!git.is_commit("3f9a2c2"));
+
+        let detached = Git {
+            branch: None,
+            dirty: false,
+            tag: None,
+            ..git
+        };
+        assert_eq!(detached.to_string(), "3f9a2c1");
+    }
+}
@@ -0,0 +1,300 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+//! The Grafana JSON datasource served under `/grafana` by `cardamon server` and `cardamon ui`,
+//! and the dashboards `cardamon grafana-dashboard` writes for it. Requests follow the protocol of
+//! the `simpod-json-datasource` plugin: each target is a scenario, charted as its mean energy per
+//! run in joules, and the notes added to runs are annotations.
+
+use crate::{data_access::run::Run, trend::Point};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use serde_json::{json, Value};
+
+/// The plugin id of the Grafana datasource the dashboards query.
+pub const DATASOURCE_TYPE: &str = "simpod-json-datasource";
+
+/// The time range of the dashboard a request came from.
+#[derive(Debug, Clone, Deserialize)]
+pub struct Range {
+    pub from: DateTime<Utc>,
+    pub to: DateTime<Utc>,
+}
+impl Range {
+    /// # Arguments
+    /// * timestamp - unix timestamp in milliseconds
+    pub fn contains(&self, timestamp: i64) -> bool {
+        (self.from.timestamp_millis()..=self.to.timestamp_millis()).contains(&timestamp)
+    }
+}
+
+/// Asks for the scenarios containing the text, to pick the target of a panel.
+#[derive(Debug, Default, Deserialize)]
+pub struct SearchRequest {
+    #[serde(default)]
+    pub target: String,
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct QueryRequest {
+    pub range: Range,
+    pub targets: Vec<Target>,
+    /// The most points a series should have, the latest runs are kept if there are more.
+    pub max_data_points: Option<usize>,
+}
+
+/// A query of a panel.
+#[derive(Debug, Deserialize)]
+pub struct Target {
+    /// The name of the scenario.
+    pub target: String,
+    #[serde(default)]
+    pub hide: bool,
+    /// e.g. `{"project": "shop"}` to only chart the runs of a project.
+    #[serde(default)]
+    pub payload: Value,
+}
+impl Target {
+    pub fn project(&self) -> Option<&str> {
+        self.payload.get("project")?.as_str()
+    }
+}
+
+/// A line on a panel, each data point is a value and a unix timestamp in milliseconds.
+#[derive(Debug, PartialEq, Serialize)]
+pub struct TimeSeries {
+    pub target: String,
+    pub datapoints: Vec<(f64, i64)>,
+}
+
+/// # Arguments
+/// * target - the name of the series
+/// * points - the energy of the scenario in each run, oldest first
+/// * range - runs started outside it are left out
+/// * max_data_points - the most points the series has
+///
+/// # Returns
+/// The mean energy of the scenario in each run in joules, at the time the run started
+pub fn time_series(
+    target: &str,
+    points: &[Point],
+    range: &Range,
+    max_data_points: Option<usize>,
+) -> TimeSeries {
+    let mut datapoints = points
+        .iter()
+        .filter(|point| range.contains(point.start_time))
+        .map(|point| (point.energy.mean, point.start_time))
+        .collect::<Vec<_>>();
+    if let Some(max) = max_data_points {
+        datapoints.drain(..datapoints.len().saturating_sub(max));
+    }
+    TimeSeries {
+        target: String::from(target),
+        datapoints,
+    }
+}
+
+#[derive(Debug, Deserialize)]
+pub struct AnnotationRequest {
+    pub range: Range,
+    #[serde(default)]
+    pub annotation: AnnotationQuery,
+}
+
+/// The annotation query of a dashboard.
+#[derive(Debug, Default, Deserialize)]
+pub struct AnnotationQuery {
+    /// A project to only show the notes of its runs, every run's notes if it's empty.
+    pub query: Option<String>,
+}
+impl AnnotationQuery {
+    pub fn project(&self) -> Option<&str> {
+        self.query
+            .as_deref()
+            .filter(|query| !query.trim().is_empty())
+    }
+}
+
+/// A note added to a run, shown as a marker at the time the run started.
+#[derive(Debug, PartialEq, Serialize)]
+pub struct AnnotationEvent {
+    /// Unix timestamp in milliseconds.
+    pub time: i64,
+    pub title: String,
+    pub text: String,
+    pub tags: Vec<String>,
+}
+
+/// # Returns
+/// The notes of the runs started in the range, tagged with the run's label and the note's labels
+pub fn annotation_events(runs: &[Run], range: &Range) -> Vec<AnnotationEvent> {
+    runs.iter()
+        .filter(|run| range.contains(run.start_time))
+        .flat_map(|run| {
+            run.annotations()
+                .into_iter()
+                .map(move |annotation| AnnotationEvent {
+                    time: run.start_time,
+                    title: format!("Run {}", run.run_id),
+                    text: annotation.to_string(),
+                    tags: run
+                        .label
+                        .iter()
+                        .cloned()
+                        .chain(
+                            annotation
+                                .labels
+                                .iter()
+                                .map(|(key, value)| format!("{}={}", key, value)),
+                        )
+                        .collect(),
+                })
+        })
+        .collect()
+}
+
+/// # Arguments
+/// * title - the title of the dashboard
+/// * scenarios - a panel is made for each one
+/// * datasource_uid - the uid given to the JSON datasource pointed at `<server>/grafana`
+/// * project - only the runs of the project are charted, every run if it's None
+///
+/// # Returns
+/// A dashboard to import into Grafana, charting the energy of each scenario over time with the
+/// notes of the runs as annotations
+pub fn dashboard(
+    title: &str,
+    scenarios: &[String],
+    datasource_uid: &str,
+    project: Option<&str>,
+) -> Value {
+    let datasource = json!({ "type": DATASOURCE_TYPE, "uid": datasource_uid });
+    let payload = match project {
+        Some(project) => json!({ "project": project }),
+        None => json!({}),
+    };
+    let panels = scenarios
+        .iter()
+        .enumerate()
+        .map(|(i, scenario)| {
+            json!({
+                "id": i + 1,
+                "type": "timeseries",
+                "title": scenario,
+                "datasource": datasource,
+                "gridPos": { "h": 8, "w": 12, "x": (i % 2) * 12, "y": (i / 2) * 8 },
+                "fieldConfig": {
+                    "defaults": {
+                        "unit": "joule",
+                        "custom": { "drawStyle": "line", "showPoints": "always" }
+                    },
+                    "overrides": []
+                },
+                "targets": [{
+                    "refId": "A",
+                    "datasource": datasource,
+                    "target": scenario,
+                    "payload": payload
+                }]
+            })
+        })
+        .collect::<Vec<_>>();
+
+    json!({
+        "title": title,
+        "tags": ["cardamon"],
+        "timezone": "browser",
+        "schemaVersion": 39,
+        "time": { "from": "now-90d", "to": "now" },
+        "annotations": {
+            "list": [{
+                "name": "Run notes",
+                "datasource": datasource,
+                "enable": true,
+                "iconColor": "rgba(0, 211, 255, 1)",
+                "query": project.unwrap_or_default()
+            }]
+        },
+        "panels": panels
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{annotation::Annotation, dataset::Stats};
+
+    fn point(start_time: i64, mean: f64) -> Point {
+        Point {
+            run_id: start_time.to_string(),
+            start_time,
+            label: None,
+            git: None,
+            energy: Stats::of(&[mean]).unwrap(),
+            annotations: vec![],
+        }
+    }
+
+    #[test]
+    fn scenarios_are_charted_within_the_range() -> anyhow::Result<()> {
+        let query = serde_json::from_str::<QueryRequest>(
+            r#"{"range": {"from": "1970-01-01T00:00:01Z", "to": "1970-01-01T00:00:04Z"},
+                "targets": [{"refId": "A", "target": "checkout", "payload": {"project": "shop"}}],
+                "maxDataPoints": 2}"#,
+        )?;
+        assert_eq!(query.targets[0].project(), Some("shop"));
+
+        let points = (0..5)
+            .map(|s| point(s * 1000, s as f64))
+            .collect::<Vec<_>>();
+        let series = time_series("checkout", &points, &query.range, query.max_data_points);
+        assert_eq!(series.datapoints, [(3.0, 3000), (4.0, 4000)]);
+        assert_eq!(
+            serde_json::to_value(&series)?,
+            json!({ "target": "checkout", "datapoints": [[3.0, 3000], [4.0, 4000]] })
+        );
+
+        let run = Run {
+            label: Some(String::from("main")),
+            ..Run::new("abc12", 2000, 3000, None, "", None, None)
+        }
+        .with_annotation(Annotation::new(
+            3000,
+            Some("switched to jemalloc"),
+            vec![(String::from("allocator"), String::from("jemalloc"))],
+        ))?;
+        let events = annotation_events(&[run], &query.range);
+        assert_eq!(
+            events,
+            [AnnotationEvent {
+                time: 2000,
+                title: String::from("Run abc12"),
+                text: String::from("switched to jemalloc (allocator=jemalloc)"),
+                tags: vec![String::from("main"), String::from("allocator=jemalloc")],
+            }]
+        );
+
+        let dashboard = dashboard(
+            "Cardamon shop",
+            &[String::from("checkout"), String::from("search")],
+            "cardamon",
+            Some("shop"),
+        );
+        assert_eq!(dashboard["panels"][1]["gridPos"]["x"], 12);
+        assert_eq!(dashboard["panels"][1]["targets"][0]["target"], "search");
+        assert_eq!(
+            dashboard["panels"][0]["targets"][0]["payload"]["project"],
+            "shop"
+        );
+        assert_eq!(
+            dashboard["panels"][0]["datasource"]["type"],
+            DATASOURCE_TYPE
+        );
+        Ok(())
+    }
+}
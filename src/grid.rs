@@ -0,0 +1,135 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::config::Grid;
+use anyhow::{anyhow, Context};
+use serde_json::Value;
+
+const ELECTRICITY_MAPS_URL: &str = "https://api.electricitymap.org/v3/carbon-intensity/latest";
+const WATTTIME_LOGIN_URL: &str = "https://api.watttime.org/login";
+const WATTTIME_FORECAST_URL: &str = "https://api.watttime.org/v3/forecast";
+
+/// WattTime reports pounds of CO2 per MWh.
+const GRAMS_PER_KWH_PER_LBS_PER_MWH: f64 = 0.453_592;
+
+/// Looks up the carbon intensity of the grid right now.
+///
+/// # Returns
+/// The grams of CO2e emitted per kWh of electricity and where it came from, e.g.
+/// `electricitymaps GB`
+pub async fn intensity(grid: &Grid) -> anyhow::Result<(f64, String)> {
+    let client = reqwest::Client::new();
+    match grid {
+        Grid::ElectricityMaps { api_key, zone } => {
+            let api_key = secret(api_key.as_deref(), "ELECTRICITYMAPS_API_KEY")?;
+            let body = client
+                .get(ELECTRICITY_MAPS_URL)
+                .query(&[("zone", zone)])
+                .header("auth-token", api_key)
+                .send()
+                .await
+                .and_then(|res| res.error_for_status())
+                .context("Unable to fetch carbon intensity from Electricity Maps")?
+                .json::<Value>()
+                .await?;
+            Ok((
+                electricity_maps_intensity(&body)?,
+                format!("electricitymaps {zone}"),
+            ))
+        }
+
+        Grid::WattTime {
+            username,
+            password,
+            zone,
+        } => {
+            let password = secret(password.as_deref(), "WATTTIME_PASSWORD")?;
+            let login = client
+                .get(WATTTIME_LOGIN_URL)
+                .basic_auth(username, Some(password))
+                .send()
+                .await
+                .and_then(|res| res.error_for_status())
+                .context("Unable to log in to WattTime")?
+                .json::<Value>()
+                .await?;
+            let token = login["token"]
+                .as_str()
+                .context("WattTime didn't return a token")?;
+
+            let body = client
+                .get(WATTTIME_FORECAST_URL)
+                .query(&[
+                    ("region", zone.as_str()),
+                    ("signal_type", "co2_moer"),
+                    ("horizon_hours", "0"),
+                ])
+                .bearer_auth(token)
+                .send()
+                .await
+                .and_then(|res| res.error_for_status())
+                .context("Unable to fetch carbon intensity from WattTime")?
+                .json::<Value>()
+                .await?;
+            Ok((watttime_intensity(&body)?, format!("watttime {zone}")))
+        }
+    }
+}
+
+/// Secrets can be left out of cardamon.toml, which is saved with every run, and set in the
+/// environment instead.
+fn secret(configured: Option<&str>, var: &str) -> anyhow::Result<String> {
+    configured
+        .map(String::from)
+        .or_else(|| std::env::var(var).ok())
+        .context(format!(
+            "No credentials for the grid, set them in [carbon.grid] or ${var}"
+        ))
+}
+
+fn electricity_maps_intensity(body: &Value) -> anyhow::Result<f64> {
+    body["carbonIntensity"]
+        .as_f64()
+        .context("Electricity Maps didn't return a carbon intensity")
+}
+
+fn watttime_intensity(body: &Value) -> anyhow::Result<f64> {
+    let value = body["data"][0]["value"]
+        .as_f64()
+        .context("WattTime didn't return a carbon intensity")?;
+    match body["meta"]["units"].as_str() {
+        Some("lbs_co2_per_mwh") | None => Ok(value * GRAMS_PER_KWH_PER_LBS_PER_MWH),
+        Some(units) => Err(anyhow!(
+            "WattTime returned intensity in unknown units {units}"
+        )),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn provider_responses_are_converted_to_grams_per_kwh() -> anyhow::Result<()> {
+        let body =
+            json!({ "zone": "GB", "carbonIntensity": 182, "datetime": "2026-10-14T12:00:00.000Z" });
+        assert_eq!(electricity_maps_intensity(&body)?, 182.0);
+        assert!(electricity_maps_intensity(&json!({ "zone": "GB" })).is_err());
+
+        let body = json!({
+            "data": [{ "point_time": "2026-10-14T12:00:00+00:00", "value": 1000.0 }],
+            "meta": { "region": "CAISO_NORTH", "units": "lbs_co2_per_mwh" },
+        });
+        assert_eq!(watttime_intensity(&body)?, 453.592);
+        let body = json!({
+            "data": [{ "value": 40.0 }],
+            "meta": { "units": "percentile" },
+        });
+        assert!(watttime_intensity(&body).is_err());
+        Ok(())
+    }
+}
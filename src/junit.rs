@@ -0,0 +1,256 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    config::Config,
+    data_access::run::Run,
+    export::{RunExport, ScenarioExport},
+    units::Units,
+};
+use std::{collections::BTreeMap, fmt::Write};
+
+/// # Returns
+/// The energy budget in joules of each scenario in the config the run was started with,
+/// scenarios without a budget in joules are left out
+pub fn joule_budgets(run: &Run) -> BTreeMap<String, f64> {
+    let Some(config) = run
+        .config
+        .as_deref()
+        .and_then(|config| toml::from_str::<Config>(config).ok())
+    else {
+        return BTreeMap::new();
+    };
+
+    config
+        .scenarios
+        .iter()
+        .filter_map(|scenario| {
+            let budget = scenario.budget.as_ref().or(config.budget.as_ref())?;
+            Some((scenario.name.clone(), budget.joules?))
+        })
+        .collect()
+}
+
+/// # Returns
+/// Why the scenario failed, empty if it's within its budget
+fn failures(scenario: &ScenarioExport, budget: Option<f64>, units: &Units) -> Vec<String> {
+    let mut failures = vec![];
+    let over_budget = scenario
+        .iterations
+        .iter()
+        .filter(|it| it.budget_exceeded)
+        .count();
+    if over_budget > 0 {
+        failures.push(format!(
+            "{} of {} iterations went over budget and were stopped early",
+            over_budget,
+            scenario.iterations.len()
+        ));
+    }
+    if let (Some(energy), Some(budget)) = (&scenario.energy, budget) {
+        if energy.mean > budget {
+            failures.push(format!(
+                "used {} per iteration, over its budget of {}",
+                units.energy(energy.mean),
+                units.energy(budget)
+            ));
+        }
+    }
+    failures
+}
+
+/// # Arguments
+/// * export - the run to report
+/// * budgets - the energy budget of each scenario in joules, see [`joule_budgets`]
+/// * units - the units of the properties, which are named after them, e.g. `energy.mean_wh`
+///
+/// # Returns
+/// The run as a JUnit XML test suite with a test case for each scenario. The energy of a scenario
+/// is reported in the properties of its test case and it fails if it went over its budget.
+pub fn junit(export: &RunExport, budgets: &BTreeMap<String, f64>, units: &Units) -> String {
+    let run_id = &export.run.run_id;
+    let energy_unit = units.energy.name();
+    let mut cases = String::new();
+    let mut failed = 0;
+    for scenario in export.scenarios.iter() {
+        let secs = scenario
+            .iterations
+            .iter()
+            .map(|it| (it.stop_time - it.start_time).max(0) as f64 / 1000.0)
+            .sum::<f64>()
+            / scenario.iterations.len().max(1) as f64;
+
+        let mut properties = vec![(
+            String::from("iterations"),
+            scenario.iterations.len().to_string(),
+        )];
+        if let Some(energy) = &scenario.energy {
+            for (stat, joules) in [
+                ("mean", energy.mean),
+                ("stddev", energy.stddev),
+                ("min", energy.min),
+                ("max", energy.max),
+            ] {
+                properties.push((
+                    format!("energy.{stat}_{energy_unit}"),
+                    units.energy_value(joules),
+                ));
+            }
+        }
+        if let Some(sci) = &scenario.sci {
+            properties.push((
+                format!("sci.{}_per_{}", units.carbon.name(), sci.functional_unit),
+                units.carbon_value(sci.grams_per_unit),
+            ));
+        }
+        if let Some(budget) = budgets.get(&scenario.name) {
+            properties.push((format!("budget.{energy_unit}"), units.energy_value(*budget)));
+        }
+        for process in scenario.processes.iter() {
+            if let Some(joules) = process.joules {
+                properties.push((
+                    format!("process.{}.{energy_unit}", process.process_name),
+                    units.energy_value(joules),
+                ));
+            }
+        }
+
+        let _ = write!(
+            cases,
+            "    <testcase classname=\"cardamon.{}\" name=\"{}\" time=\"{:.3}\">\n      <properties>\n",
+            escape(run_id),
+            escape(&scenario.name),
+            secs
+        );
+        for (name, value) in properties.iter() {
+            let _ = writeln!(
+                cases,
+                "        <property name=\"{}\" value=\"{}\"/>",
+                escape(name),
+                escape(value)
+            );
+        }
+        cases.push_str("      </properties>\n");
+
+        let failures = failures(scenario, budgets.get(&scenario.name).copied(), units);
+        if !failures.is_empty() {
+            failed += 1;
+            let _ = writeln!(
+                cases,
+                "      <failure message=\"{}\" type=\"budget\">{}</failure>",
+                escape(&failures[0]),
+                escape(&failures.join("\n"))
+            );
+        }
+        if scenario.energy.is_none() {
+            let reason = export
+                .run
+                .energy_unavailable
+                .as_deref()
+                .unwrap_or("energy is unavailable");
+            let _ = writeln!(cases, "      <system-out>{}</system-out>", escape(reason));
+        }
+        cases.push_str("    </testcase>\n");
+    }
+
+    let secs = (export.run.stop_time - export.run.start_time).max(0) as f64 / 1000.0;
+    let timestamp = chrono::DateTime::from_timestamp_millis(export.run.start_time)
+        .map(|start| start.format("%Y-%m-%dT%H:%M:%S").to_string())
+        .unwrap_or_default();
+    let tests = export.scenarios.len();
+    format!(
+        "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<testsuites name=\"cardamon\" tests=\"{tests}\" failures=\"{failed}\" time=\"{secs:.3}\">\n  <testsuite name=\"cardamon run {}\" tests=\"{tests}\" failures=\"{failed}\" errors=\"0\" time=\"{secs:.3}\" timestamp=\"{timestamp}\">\n{cases}  </testsuite>\n</testsuites>\n",
+        escape(run_id)
+    )
+}
+
+fn escape(text: &str) -> String {
+    text.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+        .replace('\'', "&apos;")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        data_access::{cpu_metrics::CpuMetrics, scenario_iteration::ScenarioIteration},
+        dataset::{IterationWithMetrics, ObservationDataset},
+        export,
+    };
+
+    #[test]
+    fn scenarios_over_budget_fail() {
+        let iteration = |scenario, iteration, start: i64| {
+            IterationWithMetrics::new(
+                ScenarioIteration::new("1", scenario, iteration, start, start + 2000, None),
+                vec![
+                    CpuMetrics::new("1", "10", "server", 100.0, 100.0, 4, start),
+                    CpuMetrics::new("1", "10", "server", 100.0, 100.0, 4, start + 2000),
+                ],
+                vec![],
+                vec![],
+            )
+        };
+        let config = r#"
+            [[scenarios]]
+            name = "basket_10"
+            desc = ""
+            command = "node basket.js"
+            iterations = 1
+            processes = ["server"]
+            budget.joules = 15.0
+
+            [[scenarios]]
+            name = "checkout"
+            desc = ""
+            command = "node checkout.js"
+            iterations = 1
+            processes = ["server"]
+            budget.joules = 25.0
+
+            [[observations]]
+            name = "checkout"
+            scenarios = ["basket_10", "checkout"]
+        "#;
+        let runs = vec![Run::new(
+            "1",
+            0,
+            10000,
+            Some(40.0),
+            "config",
+            None,
+            Some(config),
+        )];
+        let observation_dataset = ObservationDataset::new(
+            vec![iteration("basket_10", 0, 0), iteration("checkout", 0, 4000)],
+            runs,
+            vec![],
+        );
+        let export = export::export(&observation_dataset, None).expect("the run should export");
+        let budgets = joule_budgets(&observation_dataset.runs()[0]);
+
+        let xml = junit(&export, &budgets, &Units::default());
+        assert!(xml.contains("tests=\"2\" failures=\"1\""));
+        assert!(
+            xml.contains("<testcase classname=\"cardamon.1\" name=\"basket_10\" time=\"2.000\">")
+        );
+        assert!(xml.contains("<property name=\"energy.mean_joules\" value=\"20.000\"/>"));
+        assert!(xml.contains("<property name=\"process.server.joules\" value=\"20.000\"/>"));
+        assert_eq!(xml.matches("<failure").count(), 1);
+        assert!(xml.contains("over its budget of 15.000 J"));
+
+        let units = Units {
+            energy: crate::units::EnergyUnit::Wh,
+            ..Units::default()
+        };
+        let xml = junit(&export, &budgets, &units);
+        assert!(xml.contains("<property name=\"energy.mean_wh\" value=\"0.005556\"/>"));
+        assert!(xml.contains("over its budget of 0.004167 Wh"));
+    }
+}
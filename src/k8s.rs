@@ -0,0 +1,242 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::{anyhow, Context};
+use serde::Deserialize;
+use std::{collections::HashMap, process::Command, time::Duration};
+
+/// How long to wait for the pods of a `k8s` process to be running after its `up` command.
+const POD_WAIT: Duration = Duration::from_secs(30);
+
+/// A pod matched by the selector of a `k8s` process.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Pod {
+    pub namespace: String,
+    pub name: String,
+    /// The deployment, statefulset etc. the pod belongs to, or the pod itself if it has no owner.
+    pub owner: String,
+    /// The number of cores of the node the pod is scheduled on.
+    pub core_count: i32,
+}
+impl Pod {
+    /// The id of the pod in the metrics log, `<namespace>/<pod>`. Kepler uses the same id so
+    /// power it attributes to the pod is matched up with the pod's CPU usage.
+    pub fn process_id(&self) -> String {
+        format!("{}/{}", self.namespace, self.name)
+    }
+
+    /// The name of the pod in the metrics log, `<namespace>/<owner>`, so pods of the same
+    /// deployment are grouped together in the results.
+    pub fn process_name(&self) -> String {
+        format!("{}/{}", self.namespace, self.owner)
+    }
+}
+
+#[derive(Debug, Deserialize)]
+struct List<T> {
+    items: Vec<T>,
+}
+
+#[derive(Debug, Deserialize)]
+struct PodResource {
+    metadata: Metadata,
+    spec: PodSpec,
+    status: PodStatus,
+}
+
+#[derive(Debug, Deserialize)]
+struct Metadata {
+    name: String,
+    namespace: Option<String>,
+    #[serde(default)]
+    labels: HashMap<String, String>,
+    #[serde(default, rename = "ownerReferences")]
+    owner_references: Vec<OwnerReference>,
+}
+
+#[derive(Debug, Deserialize)]
+struct OwnerReference {
+    kind: String,
+    name: String,
+}
+
+#[derive(Debug, Deserialize)]
+struct PodSpec {
+    #[serde(rename = "nodeName")]
+    node_name: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct PodStatus {
+    phase: Option<String>,
+}
+
+/// Finds the running pods matching a label selector, waiting for them to start if none are
+/// running yet.
+///
+/// # Arguments
+/// * namespace - the namespace to search, the namespace of the current context if None
+/// * selector - a label selector, e.g. `app=checkout,tier!=cache`
+///
+/// # Returns
+/// Every running pod matching the selector
+pub fn resolve_pods(namespace: Option<&str>, selector: &str) -> anyhow::Result<Vec<Pod>> {
+    let started = std::time::Instant::now();
+    loop {
+        let pods = running_pods(namespace, selector)?;
+        if !pods.is_empty() {
+            return with_core_counts(pods);
+        }
+        if started.elapsed() > POD_WAIT {
+            return Err(anyhow!("No running pods match the selector {selector}"));
+        }
+        std::thread::sleep(Duration::from_secs(1));
+    }
+}
+
+fn running_pods(namespace: Option<&str>, selector: &str) -> anyhow::Result<Vec<PodResource>> {
+    let mut args = vec!["get", "pods", "--selector", selector, "--output", "json"];
+    if let Some(namespace) = namespace {
+        args.extend(["--namespace", namespace]);
+    }
+
+    let pods = serde_json::from_slice::<List<PodResource>>(&kubectl(&args)?)
+        .context("Unexpected pod list from kubectl")?;
+    Ok(pods
+        .items
+        .into_iter()
+        .filter(|pod| pod.status.phase.as_deref() == Some("Running"))
+        .collect())
+}
+
+fn with_core_counts(pods: Vec<PodResource>) -> anyhow::Result<Vec<Pod>> {
+    let mut core_counts = HashMap::new();
+    let mut resolved = vec![];
+    for pod in pods.into_iter() {
+        let core_count = match &pod.spec.node_name {
+            Some(node) => match core_counts.get(node) {
+                Some(core_count) => *core_count,
+                None => {
+                    let capacity = kubectl(&[
+                        "get",
+                        "node",
+                        node,
+                        "--output",
+                        "jsonpath={.status.capacity.cpu}",
+                    ])?;
+                    let core_count = cpu_cores(String::from_utf8_lossy(&capacity).trim())
+                        .map(|cores| cores.round() as i32)
+                        .unwrap_or(0);
+                    core_counts.insert(node.clone(), core_count);
+                    core_count
+                }
+            },
+            None => 0,
+        };
+
+        resolved.push(Pod {
+            namespace: pod
+                .metadata
+                .namespace
+                .clone()
+                .unwrap_or(String::from("default")),
+            name: pod.metadata.name.clone(),
+            owner: owner(&pod.metadata),
+            core_count,
+        });
+    }
+
+    Ok(resolved)
+}
+
+/// Pods of a deployment are owned by one of its replica sets, named `<deployment>-<hash>`, so the
+/// hash is removed to group pods across rollouts.
+fn owner(metadata: &Metadata) -> String {
+    match metadata.owner_references.first() {
+        Some(owner) if owner.kind == "ReplicaSet" => metadata
+            .labels
+            .get("pod-template-hash")
+            .and_then(|hash| owner.name.strip_suffix(&format!("-{hash}")))
+            .unwrap_or(&owner.name)
+            .to_string(),
+        Some(owner) => owner.name.clone(),
+        None => metadata.name.clone(),
+    }
+}
+
+/// Runs kubectl against the current context.
+///
+/// # Returns
+/// The standard output of kubectl
+pub fn kubectl(args: &[&str]) -> anyhow::Result<Vec<u8>> {
+    let output = Command::new("kubectl")
+        .args(args)
+        .output()
+        .context("Unable to run kubectl, is it installed?")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "kubectl failed: {}",
+            String::from_utf8_lossy(&output.stderr)
+        ));
+    }
+    Ok(output.stdout)
+}
+
+/// Parses a Kubernetes CPU quantity, e.g. `2`, `250m` or `1234567n`.
+///
+/// # Returns
+/// The number of cores, None if the quantity isn't a CPU quantity
+pub fn cpu_cores(quantity: &str) -> Option<f64> {
+    let (value, scale) = match quantity.char_indices().last()? {
+        (i, 'n') => (&quantity[..i], 1e-9),
+        (i, 'u') => (&quantity[..i], 1e-6),
+        (i, 'm') => (&quantity[..i], 1e-3),
+        _ => (quantity, 1.0),
+    };
+    value.parse::<f64>().ok().map(|value| value * scale)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn cpu_quantities_are_parsed() {
+        assert_eq!(cpu_cores("2"), Some(2.0));
+        assert_eq!(cpu_cores("250m"), Some(0.25));
+        assert_eq!(cpu_cores("1500000n"), Some(0.0015));
+        assert_eq!(cpu_cores(""), None);
+    }
+
+    #[test]
+    fn pods_are_grouped_by_deployment() -> anyhow::Result<()> {
+        let pods = serde_json::from_str::<List<PodResource>>(
+            r#"{"items": [
+                {
+                    "metadata": {
+                        "name": "checkout-7d9f8b6c5-x2k4q",
+                        "namespace": "shop",
+                        "labels": {"app": "checkout", "pod-template-hash": "7d9f8b6c5"},
+                        "ownerReferences": [{"kind": "ReplicaSet", "name": "checkout-7d9f8b6c5"}]
+                    },
+                    "spec": {},
+                    "status": {"phase": "Running"}
+                },
+                {
+                    "metadata": {"name": "debug", "namespace": "shop"},
+                    "spec": {},
+                    "status": {"phase": "Running"}
+                }
+            ]}"#,
+        )?;
+
+        let pods = with_core_counts(pods.items)?;
+        assert_eq!(pods[0].process_id(), "shop/checkout-7d9f8b6c5-x2k4q");
+        assert_eq!(pods[0].process_name(), "shop/checkout");
+        assert_eq!(pods[1].process_name(), "shop/debug");
+        Ok(())
+    }
+}
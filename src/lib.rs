@@ -1,15 +1,81 @@
+pub mod ab;
+pub mod access_log;
+pub mod agent;
+pub mod annotation;
+pub mod archive;
+pub mod badge;
+pub mod budget;
+pub mod carbon;
+pub mod compare;
 pub mod config;
+pub mod config_diff;
+pub mod container;
+pub mod dashboard;
 pub mod data_access;
 pub mod dataset;
+pub mod energy;
+pub mod environment;
+pub mod export;
+pub mod exporter;
+pub mod git;
+pub mod grafana;
+pub mod grid;
+pub mod junit;
+pub mod k8s;
 pub mod metrics;
 pub mod metrics_logger;
+pub mod otlp;
+pub mod pause;
+pub mod pinning;
+pub mod prune;
+pub mod push;
+pub mod regression;
+pub mod replay;
+pub mod report;
+pub mod reproducibility;
+pub mod schedule;
+pub mod shuffle;
+pub mod significance;
+pub mod sync;
+pub mod template;
+pub mod trend;
+pub mod units;
+pub mod wsl;
 
 use anyhow::{anyhow, Context};
-use config::{ExecutionPlan, ProcessToObserve, ProcessType, Redirect, ScenarioToExecute};
-use data_access::{scenario_iteration::ScenarioIteration, DataAccessService};
-use dataset::ObservationDataset;
-use std::{fs::File, path::Path, time};
+use config::{
+    Baseline, ExecutionPlan, MetricsSource, OnFailure, ProcessToExecute, ProcessToObserve,
+    ProcessType, Redirect, Scenario, ScenarioToExecute, Start,
+};
+use container::LifecycleContainer;
+use data_access::{run::Run, scenario_iteration::ScenarioIteration, DataAccessService};
+use dataset::{IterationWithMetrics, ObservationDataset};
+use itertools::Itertools;
+use metrics::MetricsLog;
+use metrics_logger::{cgroup, scope::Scope, StopHandle};
+use std::{
+    collections::BTreeMap,
+    fs::{self, File},
+    path::Path,
+    process::Stdio,
+    time::{self, Duration},
+};
 use subprocess::{Exec, NullFile, Redirection};
+use tokio::{
+    io::{AsyncBufReadExt, AsyncRead, BufReader},
+    process::Child,
+};
+use tokio_util::sync::CancellationToken;
+
+/// Starts a line a scenario prints to report the functional units it served, e.g.
+/// `CARDAMON_FUNCTIONAL_UNITS=250`, for scenarios which can't write to a file.
+const FUNCTIONAL_UNITS_MARKER: &str = "CARDAMON_FUNCTIONAL_UNITS=";
+
+/// How often metrics are saved while observing without scenarios.
+const OBSERVE_FLUSH_INTERVAL: Duration = Duration::from_secs(60);
+
+/// How much of the end of a scenario's stdout and of its stderr is saved with each iteration.
+const MAX_OUTPUT_BYTES: usize = 64 * 1024;
 
 /// Runs the given command as a detached processes. This function does not block because the
 /// process is managed by the OS and running separately from this thread.
@@ -17,11 +83,16 @@ use subprocess::{Exec, NullFile, Redirection};
 /// # Arguments
 ///
 /// * command - The command to run.
+/// * env - Environment variables set for the command.
 ///
 /// # Returns
 ///
 /// The PID returned by the operating system
-fn run_command_detached(command: &str, redirect: &Option<Redirect>) -> anyhow::Result<u32> {
+fn run_command_detached(
+    command: &str,
+    redirect: &Option<Redirect>,
+    env: &[(String, String)],
+) -> anyhow::Result<u32> {
     let redirect = redirect.unwrap_or(Redirect::File);
 
     // break command string into POSIX words
@@ -30,7 +101,11 @@ fn run_command_detached(command: &str, redirect: &Option<Redirect>) -> anyhow::R
     // split command string into command and args
     match &words[..] {
         [command, args @ ..] => {
-            let exec = Exec::cmd(command).args(args);
+            let exec = env
+                .iter()
+                .fold(Exec::cmd(command).args(args), |exec, (key, value)| {
+                    exec.env(key, value)
+                });
             // for arg in args {
             //     exec = exec.arg(arg);
             // }
@@ -58,35 +133,202 @@ fn run_command_detached(command: &str, redirect: &Option<Redirect>) -> anyhow::R
     }
 }
 
+/// Runs the given command as a detached process in a transient systemd scope, so it and
+/// everything it starts share a cgroup of their own. Processes which detach from the process
+/// tree can't leave the cgroup, which makes it possible to measure daemons and double forked
+/// children.
+///
+/// # Arguments
+///
+/// * name - The name of the process, used to name the scope.
+/// * command - The command to run.
+/// * env - Environment variables set for the command.
+/// * cpus - The CPUs the cgroup is limited to, if it's pinned.
+///
+/// # Returns
+///
+/// The process and the cgroup it was started in
+async fn run_command_in_cgroup(
+    name: &str,
+    command: &str,
+    redirect: &Option<Redirect>,
+    env: &[(String, String)],
+    cpus: Option<&str>,
+) -> anyhow::Result<Scope> {
+    let unit = scope_unit(name);
+    let pid = run_command_detached(
+        &format!("{} {command}", systemd_run(&unit, cpus)),
+        redirect,
+        env,
+    )
+    .context("Unable to run the process in a cgroup, is systemd-run installed?")?;
+    wait_for_scope(name, &unit, pid).await
+}
+
+/// # Returns
+/// A unique name for the transient scope of a process or scenario
+fn scope_unit(name: &str) -> String {
+    let unit_name = name
+        .chars()
+        .map(|c| if c.is_ascii_alphanumeric() { c } else { '-' })
+        .collect::<String>();
+    format!("cardamon-{unit_name}-{}.scope", nanoid::nanoid!(5))
+}
+
+/// # Returns
+/// The systemd-run command a command is prefixed with to run it in the given scope
+fn systemd_run(unit: &str, cpus: Option<&str>) -> String {
+    // root can create scopes in the system manager, everyone else needs their user manager
+    let user = if is_root() { "" } else { "--user " };
+    let cpuset = cpus
+        .map(|cpus| format!("--property=AllowedCPUs={cpus} "))
+        .unwrap_or_default();
+    format!("systemd-run {user}--scope --quiet --collect {cpuset}--unit={unit} --")
+}
+
+/// Waits for systemd-run to move itself into the scope, it does so before it execs the command.
+///
+/// # Returns
+/// The scope the process was started in
+async fn wait_for_scope(name: &str, unit: &str, pid: u32) -> anyhow::Result<Scope> {
+    let scope = format!("/{unit}");
+    for _ in 0..50 {
+        if let Ok(path) = cgroup::unified_path(pid) {
+            if path.ends_with(&scope) {
+                return Ok(Scope {
+                    name: String::from(name),
+                    pid,
+                    path,
+                    unit: String::from(unit),
+                    user: !is_root(),
+                });
+            }
+        }
+        tokio::time::sleep(Duration::from_millis(20)).await;
+    }
+    Err(anyhow!(
+        "Process {name} wasn't moved into the cgroup of {unit}, is cgroup v2 enabled?"
+    ))
+}
+
+#[cfg(unix)]
+fn is_root() -> bool {
+    use std::os::unix::fs::MetadataExt;
+    std::fs::metadata("/proc/self")
+        .map(|metadata| metadata.uid() == 0)
+        .unwrap_or(false)
+}
+
+#[cfg(not(unix))]
+fn is_root() -> bool {
+    false
+}
+
 /// Run the given process as a detached process and return a list of all things to observe (in
 /// Docker it's possible to have a single docker compose process which starts multiple containers).
 ///
 /// # Arguments
 ///
 /// * proc - The Process to run
+/// * env - Environment variables set for the process's up command
+/// * variables - Values of the placeholders in the process's up command
+/// * cpus - The CPUs a bare-metal process is pinned to, if it's pinned
 ///
 /// # Returns
 ///
 /// A list of all the processes to observe
-fn run_process(proc: &config::ProcessToExecute) -> anyhow::Result<Vec<ProcessToObserve>> {
+async fn run_process(
+    proc: &config::ProcessToExecute,
+    env: &[(String, String)],
+    variables: &BTreeMap<String, String>,
+    cpus: Option<&str>,
+) -> anyhow::Result<Vec<ProcessToObserve>> {
+    let up = proc
+        .up
+        .as_deref()
+        .map(|up| template::render(up, variables))
+        .transpose()
+        .context(format!("Invalid up command of process {}", proc.name))?;
+
     match &proc.process {
-        config::ProcessType::Docker { containers } => {
+        config::ProcessType::Docker {
+            containers,
+            project,
+        } => {
             // run the command
-            run_command_detached(&proc.up, &proc.redirect)?;
+            if let Some(up) = &up {
+                run_command_detached(up, &proc.redirect, env)?;
+            }
 
             // return the containers as vector of ProcessToObserve
-            Ok(containers
+            let mut processes_to_observe = containers
                 .iter()
                 .map(|name| ProcessToObserve::ContainerName(name.clone()))
-                .collect())
+                .collect::<Vec<_>>();
+
+            // the containers of a compose project are found while logging, so services scaled
+            // up during a scenario are observed too
+            let project = match project {
+                Some(project) => Some(project.clone()),
+                None if containers.is_empty() => up.as_deref().and_then(container::compose_project),
+                None => None,
+            };
+            if let Some(project) = project {
+                processes_to_observe.push(ProcessToObserve::ComposeProject(project));
+            }
+
+            if processes_to_observe.is_empty() {
+                return Err(anyhow!(
+                    "Process {} has no containers to observe, list them in process.containers or start them with docker compose",
+                    proc.name
+                ));
+            }
+            Ok(processes_to_observe)
         }
 
         config::ProcessType::BareMetal => {
+            let mut processes_to_observe = vec![];
+
             // run the command
-            let pid = run_command_detached(&proc.up, &proc.redirect)?;
+            if let Some(up) = &up {
+                if proc.cgroup {
+                    let scope =
+                        run_command_in_cgroup(&proc.name, up, &proc.redirect, env, cpus).await?;
+                    processes_to_observe.push(ProcessToObserve::Cgroup(scope));
+                } else {
+                    // taskset execs the command so the pid is the process's own
+                    let up = match cpus {
+                        Some(cpus) => pinning::pinned_command(up, cpus),
+                        None => up.clone(),
+                    };
+                    let pid = run_command_detached(&up, &proc.redirect, env)?;
+                    processes_to_observe.push(ProcessToObserve::Pid(Some(proc.name.clone()), pid));
+                }
+            }
 
-            // return the pid as a ProcessToObserve
-            Ok(vec![ProcessToObserve::Pid(Some(proc.name.clone()), pid)])
+            // processes which are already running are found by name while logging
+            if let Some(match_name) = &proc.match_name {
+                processes_to_observe.push(ProcessToObserve::NameMatch(match_name.clone()));
+            }
+            if let Some(port) = proc.match_port {
+                processes_to_observe.push(ProcessToObserve::PortMatch(port));
+            }
+
+            Ok(processes_to_observe)
+        }
+
+        config::ProcessType::K8s {
+            namespace,
+            selector,
+        } => {
+            // run the command, e.g. `kubectl apply`, then find the pods it started
+            if let Some(up) = &up {
+                run_command_detached(up, &proc.redirect, env)?;
+            }
+
+            let pods = k8s::resolve_pods(namespace.as_deref(), selector)
+                .context(format!("Unable to find the pods of process {}", proc.name))?;
+            Ok(pods.into_iter().map(ProcessToObserve::Pod).collect())
         }
     }
 }
@@ -94,17 +336,279 @@ fn run_process(proc: &config::ProcessToExecute) -> anyhow::Result<Vec<ProcessToO
 async fn run_scenario<'a>(
     run_id: &str,
     scenario_to_execute: &ScenarioToExecute<'a>,
+    container: Option<&LifecycleContainer>,
+    env: &[(String, String)],
+    variables: &BTreeMap<String, String>,
+    budget_exceeded: &CancellationToken,
+    cgroup: Option<(&StopHandle, Duration)>,
 ) -> anyhow::Result<ScenarioIteration> {
-    let start = time::SystemTime::now()
+    let scenario = scenario_to_execute.scenario;
+
+    // run scenario ...
+    println!(
+        "Running scenario {} iteration {}",
+        scenario_to_execute.name,
+        scenario_to_execute.iteration + 1
+    );
+    let (start, summary, reported_units, output) = match &scenario.replay {
+        Some(replay) => {
+            // load the trace before starting the clock so that parsing it isn't measured
+            let trace = replay::load_trace(replay)?;
+
+            let start = time::SystemTime::now()
+                .duration_since(time::UNIX_EPOCH)?
+                .as_millis();
+            if let Some(container) = container {
+                container.start().await?;
+            }
+
+            let replaying = async {
+                match scenario.timeout {
+                    Some(timeout) => {
+                        tokio::time::timeout(timeout, replay::replay(&trace, replay.speed))
+                            .await
+                            .map_err(|_| {
+                                anyhow!("Scenario {} timed out after {:?}", scenario.name, timeout)
+                            })?
+                    }
+                    None => replay::replay(&trace, replay.speed).await,
+                }
+            };
+            // an iteration over budget stops sending requests part way through the trace
+            let summary = tokio::select! {
+                summary = replaying => Some(summary?),
+                _ = budget_exceeded.cancelled() => None,
+            };
+            if let Some(summary) = summary.as_ref().filter(|summary| summary.failures > 0) {
+                tracing::warn!(
+                    "{} of {} replayed requests failed",
+                    summary.failures,
+                    summary.requests
+                );
+            }
+
+            (start, summary, None, None)
+        }
+
+        None => {
+            let command = scenario
+                .command
+                .as_deref()
+                .context("Scenario should have a command")?;
+            let command = template::render(command, variables)
+                .context(format!("Invalid command of scenario {}", scenario.name))?;
+
+            // a scenario without a fixed count of functional units reports how many it served
+            let units_file = scenario
+                .functional_unit
+                .as_ref()
+                .filter(|unit| unit.count.is_none())
+                .map(|_| {
+                    std::env::temp_dir().join(format!(
+                        "cardamon-{}-{}-{}.units",
+                        run_id, scenario_to_execute.name, scenario_to_execute.iteration
+                    ))
+                });
+            let mut env = env.to_vec();
+            if let Some(units_file) = &units_file {
+                let _ = fs::remove_file(units_file);
+                env.push((
+                    String::from("CARDAMON_FUNCTIONAL_UNITS"),
+                    units_file.to_string_lossy().to_string(),
+                ));
+            }
+
+            let start = time::SystemTime::now()
+                .duration_since(time::UNIX_EPOCH)?
+                .as_millis();
+            if let Some(container) = container {
+                container.start().await?;
+            }
+
+            let output = run_scenario_command(
+                &command,
+                scenario,
+                &env,
+                budget_exceeded,
+                units_file.is_some(),
+                cgroup,
+            )
+            .await?;
+
+            let reported_units = units_file.and_then(|units_file| {
+                read_functional_units(
+                    &units_file,
+                    output.printed_units.as_deref(),
+                    &scenario_to_execute.name,
+                )
+            });
+            (start, None, reported_units, Some(output))
+        }
+    };
+    let failure = output.as_ref().and_then(|output| output.failure.clone());
+
+    // stopping the container is part of its lifecycle so it's measured as part of the scenario
+    if let (Some(container), Some(config)) = (container, &scenario.container) {
+        container.stop(config.stop_timeout).await?;
+    }
+
+    // the loggers keep running during the cooldown so trailing work is measured
+    if let Some(cooldown) = scenario.cooldown {
+        tokio::time::sleep(cooldown).await;
+    }
+
+    let stop = time::SystemTime::now()
         .duration_since(time::UNIX_EPOCH)?
         .as_millis();
 
+    // the warmup is excluded by starting the measured window once it's over
+    let start = match scenario.warmup {
+        // a failed iteration isn't measured so its whole window is kept with its output
+        Some(warmup) if failure.is_none() => {
+            let start = start + warmup.as_millis();
+            let finished = stop - scenario.cooldown.map_or(0, |cooldown| cooldown.as_millis());
+            if start >= finished {
+                return Err(anyhow!(
+                    "Scenario {} finished before its warmup of {} was over",
+                    scenario.name,
+                    humantime::format_duration(warmup)
+                ));
+            }
+            start
+        }
+        _ => start,
+    };
+
+    // failed requests weren't served so they're left out of the energy per request
+    let requests = summary
+        .as_ref()
+        .map(|summary| (summary.requests - summary.failures) as i64);
+    let functional_units = scenario.functional_unit.as_ref().and_then(|unit| {
+        unit.count
+            .or(reported_units)
+            .or(requests.map(|requests| requests as f64))
+    });
+
+    let scenario_iteration = ScenarioIteration {
+        budget_exceeded: budget_exceeded.is_cancelled(),
+        functional_units,
+        stdout: output.as_ref().map(|output| output.stdout.clone()),
+        stderr: output.as_ref().map(|output| output.stderr.clone()),
+        exit_code: output.and_then(|output| output.exit_code),
+        failed: failure.is_some(),
+        failed_requests: summary.map(|summary| summary.failures as i64),
+        ..ScenarioIteration::new(
+            run_id,
+            &scenario_to_execute.name,
+            scenario_to_execute.iteration as i64,
+            start as i64,
+            stop as i64,
+            requests,
+        )
+    };
+    match failure {
+        Some(reason) => Err(FailedIteration {
+            reason,
+            scenario_iteration,
+        }
+        .into()),
+        None => Ok(scenario_iteration),
+    }
+}
+
+/// Reads the number of functional units a scenario reported serving and removes the file it was
+/// written to, falling back to the count it printed. A missing or invalid count is logged and
+/// left out rather than failing the run.
+fn read_functional_units(
+    units_file: &Path,
+    printed_units: Option<&str>,
+    scenario_name: &str,
+) -> Option<f64> {
+    let contents = fs::read_to_string(units_file)
+        .ok()
+        .or(printed_units.map(String::from));
+    let _ = fs::remove_file(units_file);
+    match contents.map(|contents| contents.trim().parse::<f64>()) {
+        Some(Ok(units)) if units.is_finite() && units >= 0.0 => Some(units),
+        Some(_) => {
+            tracing::warn!(
+                "Scenario {} reported an invalid number of functional units",
+                scenario_name
+            );
+            None
+        }
+        None => {
+            tracing::warn!(
+                "Scenario {} didn't report its functional units to $CARDAMON_FUNCTIONAL_UNITS or print a {} line",
+                scenario_name,
+                FUNCTIONAL_UNITS_MARKER
+            );
+            None
+        }
+    }
+}
+
+/// What the command of a scenario printed and how it exited.
+#[derive(Debug, Default, PartialEq)]
+struct ScenarioOutput {
+    /// The functional units the scenario printed last, if it printed any.
+    printed_units: Option<String>,
+    /// The last MAX_OUTPUT_BYTES the scenario printed.
+    stdout: String,
+    stderr: String,
+    /// None if the command was stopped for going over budget or timing out.
+    exit_code: Option<i64>,
+    /// Why the command failed or timed out, None if it succeeded or went over budget.
+    failure: Option<String>,
+}
+
+/// The error of a scenario iteration which failed or timed out. It carries the iteration so what
+/// the scenario printed can still be saved.
+#[derive(Debug)]
+struct FailedIteration {
+    reason: String,
+    scenario_iteration: ScenarioIteration,
+}
+impl std::fmt::Display for FailedIteration {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}", self.reason)
+    }
+}
+impl std::error::Error for FailedIteration {}
+
+/// Runs the command of a scenario and waits for it to finish, stopping it if it exceeds the
+/// scenario's timeout or budget. Going over budget isn't a failure, the iteration is saved as
+/// over budget.
+///
+/// # Arguments
+///
+/// * command - The scenario command
+/// * scenario - The scenario's config
+/// * env - Environment variables set for the command
+/// * budget_exceeded - Cancelled if the iteration goes over its budget
+/// * reports_units - Whether the scenario may print its functional units to stdout
+/// * cgroup - The loggers the scenario's cgroup is observed by and how often it's sampled, if it
+///   runs in one
+///
+/// # Returns
+/// What the scenario printed and its exit code, along with why if it failed or timed out. An
+/// error if it couldn't be run
+async fn run_scenario_command(
+    command: &str,
+    scenario: &Scenario,
+    env: &[(String, String)],
+    budget_exceeded: &CancellationToken,
+    reports_units: bool,
+    cgroup: Option<(&StopHandle, Duration)>,
+) -> anyhow::Result<ScenarioOutput> {
+    let unit = cgroup.map(|_| scope_unit(&scenario.name));
+    let command = match &unit {
+        Some(unit) => format!("{} {command}", systemd_run(unit, None)),
+        None => String::from(command),
+    };
+
     // Split the scenario_command into a vector
-    let command_parts: Vec<&str> = scenario_to_execute
-        .scenario
-        .command
-        .split_whitespace()
-        .collect();
+    let command_parts: Vec<&str> = command.split_whitespace().collect();
 
     // Get the command and arguments
     let command = command_parts
@@ -112,62 +616,751 @@ async fn run_scenario<'a>(
         .ok_or_else(|| anyhow::anyhow!("Empty command"))?;
     let args = &command_parts[1..];
 
-    // run scenario ...
-    println!(
-        "Running scenario {} iteration {}",
-        scenario_to_execute.scenario.name,
-        scenario_to_execute.iteration + 1
-    );
-    let output = tokio::process::Command::new(command)
+    let mut command = tokio::process::Command::new(command);
+    command
         .args(args)
-        .kill_on_drop(true)
+        .envs(env.iter().map(|(key, value)| (key, value)))
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .kill_on_drop(true);
+
+    // run the scenario in its own process group so that on timeout the stop signal reaches any
+    // children it has spawned as well as the scenario itself.
+    #[cfg(unix)]
+    command.process_group(0);
+
+    let mut child = command.spawn().context("Failed to spawn scenario")?;
+    // the output is read as it's written so a chatty scenario can't fill a pipe and block
+    let stdout = child
+        .stdout
+        .take()
+        .context("Scenario should have a stdout")?;
+    let stdout = tokio::spawn(read_output(stdout, reports_units));
+    let stderr = child
+        .stderr
+        .take()
+        .context("Scenario should have a stderr")?;
+    let stderr = tokio::spawn(read_output(stderr, false));
+    let scope = match (&unit, cgroup) {
+        (Some(unit), Some((stop_handle, sample_interval))) => {
+            let pid = child.id().context("Scenario should have a PID")?;
+            let scope = wait_for_scope(&scenario.name, unit, pid).await?;
+            stop_handle.observe_scope(scope.clone(), sample_interval);
+            Some(scope)
+        }
+        _ => None,
+    };
+
+    let exited = {
+        let waiting = async {
+            match scenario.timeout {
+                Some(timeout) => tokio::time::timeout(timeout, child.wait()).await.ok(),
+                None => Some(child.wait().await),
+            }
+        };
+        tokio::select! {
+            status = waiting => Some(status),
+            _ = budget_exceeded.cancelled() => None,
+        }
+    };
+    let (status, timed_out) = match exited {
+        Some(Some(status)) => (Some(status?), None),
+        Some(None) => {
+            tracing::warn!("Scenario {} timed out", scenario.name);
+            stop_scenario(&mut child, scenario).await?;
+            let timed_out = format!(
+                "Scenario {} timed out after {:?}",
+                scenario.name,
+                scenario.timeout.unwrap_or_default()
+            );
+            (None, Some(timed_out))
+        }
+        None => {
+            stop_scenario(&mut child, scenario).await?;
+            (None, None)
+        }
+    };
+    // whatever the scenario detached into its cgroup doesn't outlive it
+    if let Some(scope) = &scope {
+        scope.stop().await?;
+    }
+
+    // the pipes close once the scenario has stopped, so what it printed before failing is kept
+    let (stdout, printed_units) = stdout.await??;
+    let (stderr, _) = stderr.await??;
+    let failure = timed_out.or_else(|| {
+        status
+            .filter(|status| !status.success())
+            .map(|_| format!("Scenario execution failed: {}", stderr))
+    });
+    Ok(ScenarioOutput {
+        printed_units,
+        stdout,
+        stderr,
+        exit_code: status.and_then(|status| status.code()).map(i64::from),
+        failure,
+    })
+}
+
+/// Reads what a scenario printed to a pipe until it's closed.
+///
+/// # Arguments
+///
+/// * pipe - The scenario's stdout or stderr
+/// * reports_units - Whether the scenario may print its functional units to it
+///
+/// # Returns
+/// The last MAX_OUTPUT_BYTES printed and the functional units printed last
+async fn read_output(
+    pipe: impl AsyncRead + Unpin,
+    reports_units: bool,
+) -> std::io::Result<(String, Option<String>)> {
+    let mut reader = BufReader::new(pipe);
+    let (mut output, mut line, mut units) = (vec![], vec![], None);
+    while reader.read_until(b'\n', &mut line).await? > 0 {
+        if reports_units {
+            units = printed_units(&String::from_utf8_lossy(&line))
+                .map(String::from)
+                .or(units);
+        }
+        output.append(&mut line);
+        // trimmed once it's twice the limit rather than on every line
+        if output.len() > 2 * MAX_OUTPUT_BYTES {
+            output.drain(..output.len() - MAX_OUTPUT_BYTES);
+        }
+    }
+    output.drain(..output.len().saturating_sub(MAX_OUTPUT_BYTES));
+    Ok((String::from_utf8_lossy(&output).to_string(), units))
+}
+
+/// # Returns
+/// The functional units on a line of a scenario's stdout, if it's a FUNCTIONAL_UNITS_MARKER line
+fn printed_units(line: &str) -> Option<&str> {
+    line.trim().strip_prefix(FUNCTIONAL_UNITS_MARKER)
+}
+
+/// Runs a scenario's setup or teardown command and waits for it to finish. Hooks run while
+/// nothing is being logged so they aren't measured.
+///
+/// # Arguments
+///
+/// * command - The hook's command
+/// * scenario_name - The name of the scenario the hook belongs to
+/// * env - Environment variables set for the command
+async fn run_hook(
+    command: &str,
+    scenario_name: &str,
+    env: &[(String, String)],
+) -> anyhow::Result<()> {
+    let words = shlex::split(command).context("Command string is not POSIX compliant.")?;
+    let (program, args) = words
+        .split_first()
+        .ok_or(anyhow!("Scenario {scenario_name} has an empty hook"))?;
+
+    let output = tokio::process::Command::new(program)
+        .args(args)
+        .envs(env.iter().map(|(key, value)| (key, value)))
+        .stdout(Stdio::null())
         .output()
-        .await?;
+        .await
+        .context(format!("Failed to run hook of scenario {scenario_name}"))?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "Hook `{command}` of scenario {scenario_name} failed: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    Ok(())
+}
 
-    if output.status.success() {
-        let stop = time::SystemTime::now()
-            .duration_since(time::UNIX_EPOCH)?
-            .as_millis();
+/// Stops a scenario which has exceeded its timeout or budget. The scenario's stop signal is sent
+/// to its process group, anything still running in the group after the kill grace period is
+/// killed.
+///
+/// # Arguments
+///
+/// * child - The running scenario
+/// * scenario - The scenario's config
+#[cfg(unix)]
+async fn stop_scenario(child: &mut Child, scenario: &Scenario) -> anyhow::Result<()> {
+    use config::StopSignal;
+    use nix::{
+        errno::Errno,
+        sys::signal::{killpg, Signal},
+        unistd::Pid,
+    };
 
-        let scenario_iteration = ScenarioIteration::new(
-            run_id,
-            &scenario_to_execute.scenario.name,
-            scenario_to_execute.iteration as i64,
-            start as i64,
-            stop as i64,
+    let Some(pid) = child.id() else {
+        // the scenario has already been reaped
+        return Ok(());
+    };
+    let pgid = Pid::from_raw(pid as i32);
+
+    let signal = match scenario.stop_signal {
+        StopSignal::Sigterm => Signal::SIGTERM,
+        StopSignal::Sigint => Signal::SIGINT,
+        StopSignal::Sighup => Signal::SIGHUP,
+        StopSignal::Sigquit => Signal::SIGQUIT,
+        StopSignal::Sigkill => Signal::SIGKILL,
+    };
+    tracing::warn!(
+        "Stopping scenario {}, sending {}",
+        scenario.name,
+        signal.as_str()
+    );
+    killpg(pgid, signal).context("Failed to signal scenario process group")?;
+
+    if signal != Signal::SIGKILL
+        && tokio::time::timeout(scenario.kill_grace_period, child.wait())
+            .await
+            .is_err()
+    {
+        tracing::warn!(
+            "Scenario {} still running after {:?}, sending SIGKILL",
+            scenario.name,
+            scenario.kill_grace_period
         );
-        Ok(scenario_iteration)
+    }
+
+    // make sure nothing in the group outlives the scenario. ESRCH means the group has already
+    // exited.
+    match killpg(pgid, Signal::SIGKILL) {
+        Ok(()) | Err(Errno::ESRCH) => {}
+        Err(err) => return Err(err).context("Failed to kill scenario process group"),
+    }
+    child.wait().await?;
+
+    Ok(())
+}
+
+/// Stops a scenario which has exceeded its timeout or budget. Signals are only available on unix so the
+/// scenario is killed immediately. On Windows the whole process tree is killed because scenarios
+/// run through `cmd` or `powershell` leave their children running if only the shell is killed.
+///
+/// # Arguments
+///
+/// * child - The running scenario
+/// * scenario - The scenario's config
+#[cfg(not(unix))]
+async fn stop_scenario(child: &mut Child, scenario: &Scenario) -> anyhow::Result<()> {
+    tracing::warn!("Stopping scenario {}, killing it", scenario.name);
+
+    #[cfg(windows)]
+    if let Some(pid) = child.id() {
+        match kill_process_tree(pid).await {
+            Ok(()) => {
+                child.wait().await?;
+                return Ok(());
+            }
+            Err(err) => tracing::warn!("Unable to kill scenario process tree: {err}"),
+        }
+    }
+
+    child.kill().await.context("Failed to kill scenario")
+}
+
+/// Kills a process and every process it has started.
+///
+/// # Arguments
+///
+/// * pid - The root of the process tree
+#[cfg(windows)]
+async fn kill_process_tree(pid: u32) -> anyhow::Result<()> {
+    let status = tokio::process::Command::new("taskkill")
+        .args(["/T", "/F", "/PID", &pid.to_string()])
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .status()
+        .await
+        .context("Failed to run taskkill")?;
+
+    if status.success() {
+        Ok(())
     } else {
-        let error_message = String::from_utf8_lossy(&output.stderr).to_string();
-        Err(anyhow::anyhow!(
-            "Scenario execution failed: {}",
-            error_message
-        ))
+        Err(anyhow!("taskkill exited with {status}"))
+    }
+}
+
+/// Observes the processes and reads the power sources while nothing but the processes' idle work
+/// is running. The metrics are stored with the run like a scenario's so the idle power can be
+/// worked out when the run is summarised.
+///
+/// # Returns
+///
+/// When the baseline started and stopped being measured
+async fn measure_baseline(
+    run_id: &str,
+    exec_plan: &ExecutionPlan<'_>,
+    baseline: &Baseline,
+    processes_to_observe: &[(ProcessToObserve, Duration)],
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<(i64, i64)> {
+    tracing::info!(
+        "Measuring idle baseline for {}",
+        humantime::format_duration(baseline.duration)
+    );
+    let start = time::SystemTime::now()
+        .duration_since(time::UNIX_EPOCH)?
+        .as_millis() as i64;
+    let stop_handle = metrics_logger::start_logging(
+        processes_to_observe,
+        exec_plan.power_sources,
+        exec_plan.metrics_sources,
+        exec_plan.hosts,
+        exec_plan.container_runtime,
+        exec_plan.container_stats,
+        exec_plan.cpu_accounting,
+    )?;
+    tokio::time::sleep(baseline.duration).await;
+    let metrics_log = stop_handle.stop().await?;
+    let stop = time::SystemTime::now()
+        .duration_since(time::UNIX_EPOCH)?
+        .as_millis() as i64;
+
+    persist_metrics_log(run_id, None, &metrics_log, data_access_service).await?;
+    Ok((start, stop))
+}
+
+/// # Arguments
+///
+/// * scenario_name - The scenario the processes in the log were observed for, None if they were
+///   observed for every scenario running at the time.
+async fn persist_metrics_log(
+    run_id: &str,
+    scenario_name: Option<&str>,
+    metrics_log: &MetricsLog,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<()> {
+    let scenario_name = scenario_name.map(String::from);
+    for metrics in metrics_log.get_metrics() {
+        let metrics = data_access::cpu_metrics::CpuMetrics {
+            scenario_name: scenario_name.clone(),
+            ..metrics.into_data_access(run_id)
+        };
+        data_access_service
+            .cpu_metrics_dao()
+            .persist(&metrics)
+            .await?;
+    }
+    for metrics in metrics_log.get_power_metrics() {
+        data_access_service
+            .power_metrics_dao()
+            .persist(&metrics.into_data_access(run_id))
+            .await?;
+    }
+    for metrics in metrics_log.get_resource_metrics() {
+        let metrics = data_access::resource_metrics::ResourceMetrics {
+            scenario_name: scenario_name.clone(),
+            ..metrics.into_data_access(run_id)
+        };
+        data_access_service
+            .resource_metrics_dao()
+            .persist(&metrics)
+            .await?;
+    }
+    Ok(())
+}
+
+/// Runs a single scenario iteration while its processes are logged.
+///
+/// # Arguments
+///
+/// * processes_to_observe - The processes to log while the scenario runs.
+/// * log_machine - Whether the machine wide power and metrics sources are logged too, they're
+///   logged separately when scenarios run in parallel.
+///
+/// # Returns
+///
+/// The scenario iteration and everything logged while it ran
+async fn run_lane(
+    run_id: &str,
+    exec_plan: &ExecutionPlan<'_>,
+    scenario_to_execute: &ScenarioToExecute<'_>,
+    mut processes_to_observe: Vec<(ProcessToObserve, Duration)>,
+    log_machine: bool,
+    tdp: Option<f64>,
+    exporter: Option<&exporter::Exporter>,
+) -> anyhow::Result<(ScenarioIteration, MetricsLog)> {
+    // create the scenario's container before logging starts so that it can be tracked from
+    // the moment it's started.
+    let scenario = scenario_to_execute.scenario;
+    let container = match &scenario.container {
+        Some(config) => Some(
+            LifecycleContainer::create(&scenario.name, config, exec_plan.container_runtime).await?,
+        ),
+        None => None,
+    };
+    if let Some(container) = &container {
+        processes_to_observe.push((
+            ProcessToObserve::ContainerName(String::from(container.name())),
+            exec_plan.sample_interval,
+        ));
+    }
+
+    // setup isn't part of the scenario so it runs before the loggers start
+    let variables = exec_plan.scenario_variables(scenario_to_execute);
+    if let Some(before) = &scenario.before {
+        let before = template::render(before, &variables)?;
+        run_hook(&before, &scenario.name, &exec_plan.env).await?;
+    }
+
+    // start the metrics loggers
+    let (power_sources, metrics_sources, hosts) = if log_machine {
+        (
+            exec_plan.power_sources,
+            exec_plan.metrics_sources,
+            exec_plan.hosts,
+        )
+    } else {
+        (&[][..], &[][..], &[][..])
+    };
+    let stop_handle = metrics_logger::start_logging(
+        &processes_to_observe,
+        power_sources,
+        metrics_sources,
+        hosts,
+        exec_plan.container_runtime,
+        exec_plan.container_stats,
+        exec_plan.cpu_accounting,
+    )?;
+
+    // run the scenario, stopping it early if it goes over budget
+    let budget_exceeded = CancellationToken::new();
+    let finished = CancellationToken::new();
+    let running = async {
+        let scenario_iteration = run_scenario(
+            run_id,
+            scenario_to_execute,
+            container.as_ref(),
+            &exec_plan.env,
+            &variables,
+            &budget_exceeded,
+            scenario
+                .cgroup
+                .then_some((&stop_handle, exec_plan.sample_interval)),
+        )
+        .await;
+        finished.cancel();
+        scenario_iteration
+    };
+    let watching = async {
+        match (exec_plan.budget_for(scenario), tdp) {
+            (Some(budget), Some(tdp)) => {
+                budget::watch(
+                    &scenario_to_execute.name,
+                    &stop_handle,
+                    budget,
+                    tdp,
+                    &budget_exceeded,
+                    &finished,
+                )
+                .await
+            }
+            (Some(_), None) => tracing::warn!(
+                "The budget of scenario {} can't be enforced without a TDP",
+                scenario.name
+            ),
+            _ => {}
+        }
+    };
+    let exporting = async {
+        if let Some(exporter) = exporter {
+            exporter
+                .watch(&scenario_to_execute.name, &stop_handle, &finished)
+                .await
+        }
+    };
+    let (scenario_iteration, _, _) = tokio::join!(running, watching, exporting);
+
+    // stop the metrics loggers
+    let metrics_log = stop_handle.stop().await;
+
+    // always clean up the container, even if the scenario failed
+    if let Some(container) = &container {
+        if let Err(err) = container.remove().await {
+            tracing::warn!("{}", err);
+        }
+    }
+    if let Some(after) = &scenario.after {
+        let after = template::render(after, &variables);
+        let res = match after {
+            Ok(after) => run_hook(&after, &scenario.name, &exec_plan.env).await,
+            Err(err) => Err(err),
+        };
+        if let Err(err) = res {
+            tracing::warn!("{}", err);
+        }
+    }
+    Ok((scenario_iteration?, metrics_log?))
+}
+
+/// If metrics log contains errors then display them to the user so nothing is saved.
+fn check_metrics_log(metrics_log: &MetricsLog) -> anyhow::Result<()> {
+    if metrics_log.has_errors() {
+        // log all the errors
+        for err in metrics_log.get_errors() {
+            tracing::error!("{}", err);
+        }
+        return Err(anyhow!("Metric log contained errors, please see logs."));
     }
+    Ok(())
+}
+
+/// Lets the user know what can't be measured in isolation when scenarios run in parallel.
+fn warn_about_isolation(exec_plan: &ExecutionPlan, waves: &[Vec<&ScenarioToExecute>]) {
+    if !exec_plan.external_processes_to_observe.is_empty() {
+        tracing::warn!(
+            "Scenarios will run one at a time, externally started processes can't be attributed \
+             to a single scenario"
+        );
+        return;
+    }
+    if waves.iter().all(|wave| wave.len() == 1) {
+        tracing::warn!(
+            "Scenarios will run one at a time, scenarios only run in parallel if they observe \
+             separate processes"
+        );
+        return;
+    }
+
+    tracing::warn!(
+        "Scenarios running in parallel compete for the CPU, their usage may differ from running \
+         them one at a time"
+    );
+    if !exec_plan.power_sources.is_empty()
+        || !exec_plan.metrics_sources.is_empty()
+        || !exec_plan.hosts.is_empty()
+    {
+        tracing::warn!(
+            "Power, metrics sources and hosts are shared by scenarios running in parallel, each \
+             scenario is attributed everything they read while it ran"
+        );
+    }
+}
+
+/// Runs the down command of every process, stops the cgroups processes were started in and tells
+/// agents to stop observing their hosts.
+async fn stop_application(
+    exec_plan: &ExecutionPlan<'_>,
+    running_processes: &[(ProcessToObserve, Duration)],
+) -> anyhow::Result<()> {
+    shutdown_application(exec_plan, running_processes)?;
+    // the down command may only stop the process that was started, stopping its cgroup stops
+    // everything it detached too
+    for (process, _) in running_processes.iter() {
+        if let ProcessToObserve::Cgroup(scope) = process {
+            if let Err(err) = scope.stop().await {
+                tracing::warn!("Failed to stop cgroup of process {}\n{}", scope.name, err);
+            }
+        }
+    }
+    for metrics_source in exec_plan.metrics_sources.iter() {
+        if let MetricsSource::Agent { host, url, .. } = metrics_source {
+            if let Err(err) = metrics_logger::agent::stop(url).await {
+                tracing::warn!("Failed to stop agent {}\n{}", host, err);
+            }
+        }
+    }
+    Ok(())
+}
+
+/// # Returns
+/// The pid of a bare-metal process cardamon started, None if it wasn't started by cardamon
+fn pid_of(
+    proc: &ProcessToExecute,
+    running_processes: &[(ProcessToObserve, Duration)],
+) -> Option<u32> {
+    running_processes.iter().find_map(|(p, _)| match p {
+        ProcessToObserve::Pid(Some(name), pid) if name == &proc.name => Some(*pid),
+        ProcessToObserve::Cgroup(scope) if scope.name == proc.name => Some(scope.pid),
+        _ => None,
+    })
+}
+
+/// # Returns
+/// The ids the samples of a process cardamon started were logged with. Processes matched by name
+/// or port are logged with the names they run with so they're matched by the process's name.
+fn process_ids(
+    proc: &ProcessToExecute,
+    running_processes: &[(ProcessToObserve, Duration)],
+    iteration: &IterationWithMetrics,
+) -> Vec<String> {
+    let mut ids = running_processes
+        .iter()
+        .filter_map(|(p, _)| match p {
+            ProcessToObserve::Pid(_, pid) => Some(pid.to_string()),
+            ProcessToObserve::Cgroup(scope) => Some(scope.pid.to_string()),
+            _ => None,
+        })
+        .collect::<Vec<_>>();
+    let names = running_processes
+        .iter()
+        .filter_map(|(p, _)| match p {
+            ProcessToObserve::ContainerName(name) => Some(name.as_str()),
+            _ => None,
+        })
+        .chain([proc.name.as_str()])
+        .collect::<Vec<_>>();
+    for metrics in iteration.cpu_metrics().iter() {
+        if names.contains(&metrics.process_name.as_str()) && !ids.contains(&metrics.process_id) {
+            ids.push(metrics.process_id.clone());
+        }
+    }
+    ids
+}
+
+/// Apportions the energy of the scenario's processes which have an access log between the
+/// routes they served during the iteration. An access log which can't be read shouldn't fail the
+/// run, so it's logged as a warning instead.
+async fn persist_endpoint_energy(
+    exec_plan: &ExecutionPlan<'_>,
+    scenario: &Scenario,
+    iteration: &IterationWithMetrics,
+    processes_by_name: &[(&str, Vec<(ProcessToObserve, Duration)>)],
+    tdp: Option<f64>,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<()> {
+    for proc in exec_plan
+        .processes_to_execute
+        .iter()
+        .filter(|proc| scenario.processes.contains(&proc.name))
+    {
+        let Some(access_log) = &proc.access_log else {
+            continue;
+        };
+        let requests = match access_log::read(access_log) {
+            Ok(requests) => requests,
+            Err(err) => {
+                tracing::warn!("{:?}", err);
+                continue;
+            }
+        };
+        let running = processes_by_name
+            .iter()
+            .find(|(name, _)| *name == proc.name)
+            .map(|(_, running)| running.as_slice())
+            .unwrap_or_default();
+        let process_ids = process_ids(proc, running, iteration);
+        for endpoint_energy in access_log::apportion(
+            iteration,
+            &proc.name,
+            &process_ids,
+            &requests,
+            tdp,
+            exec_plan.blend,
+        ) {
+            data_access_service
+                .endpoint_energy_dao()
+                .persist(&endpoint_energy)
+                .await?;
+        }
+    }
+    Ok(())
+}
+
+/// Runs a process of the application, see [run_process].
+///
+/// # Returns
+/// Everything to observe for the process and how often it's sampled
+async fn start_process(
+    exec_plan: &ExecutionPlan<'_>,
+    proc: &ProcessToExecute,
+) -> anyhow::Result<Vec<(ProcessToObserve, Duration)>> {
+    let sample_interval = proc.sample_interval(exec_plan.sample_interval);
+    let cpus = exec_plan.cpus_for(proc);
+    Ok(
+        run_process(proc, &exec_plan.env, &exec_plan.variables, cpus)
+            .await?
+            .into_iter()
+            .map(|process| (process, sample_interval))
+            .collect(),
+    )
+}
+
+/// # Returns
+/// The processes of a scenario which cardamon starts, so can restart for a cold start
+fn restartable_processes<'a>(
+    exec_plan: &'a ExecutionPlan,
+    scenario: &'a Scenario,
+) -> impl Iterator<Item = &'a ProcessToExecute> {
+    exec_plan
+        .processes_to_execute
+        .iter()
+        .copied()
+        .filter(|proc| proc.up.is_some() && scenario.processes.contains(&proc.name))
+}
+
+/// Stops a process with its down command, waiting for the command to finish, then starts it
+/// again so the next iteration of a cold scenario observes it starting up.
+///
+/// # Arguments
+///
+/// * proc - The process to restart
+/// * scenario - The cold scenario the process is restarted for
+/// * running - What's being observed for the process now
+///
+/// # Returns
+///
+/// What to observe for the restarted process
+async fn restart_process(
+    exec_plan: &ExecutionPlan<'_>,
+    proc: &ProcessToExecute,
+    scenario: &Scenario,
+    running: &[(ProcessToObserve, Duration)],
+) -> anyhow::Result<Vec<(ProcessToObserve, Duration)>> {
+    tracing::info!("Restarting process {} for a cold start", proc.name);
+    if let Some(down) = &proc.down {
+        let mut down = template::render(down, &exec_plan.variables)?;
+        if let Some(pid) = pid_of(proc, running) {
+            down = down.replace("{pid}", &pid.to_string());
+        }
+        run_hook(&down, &scenario.name, &exec_plan.env)
+            .await
+            .context(format!("Unable to stop process {}", proc.name))?;
+    }
+    // anything the process detached into its cgroup is stopped with it
+    for (process, _) in running {
+        if let ProcessToObserve::Cgroup(scope) = process {
+            scope
+                .stop()
+                .await
+                .context(format!("Unable to stop process {}", proc.name))?;
+        }
+    }
+    start_process(exec_plan, proc).await
 }
 
 fn shutdown_application(
     exec_plan: &ExecutionPlan,
-    running_processes: &[ProcessToObserve],
+    running_processes: &[(ProcessToObserve, Duration)],
 ) -> anyhow::Result<()> {
     // for each process in the execution plan that has a "down" command, attempt to run that
     // command.
     for proc in exec_plan.processes_to_execute.iter() {
         if let Some(down_command) = &proc.down {
+            let down_command = match template::render(down_command, &exec_plan.variables) {
+                Ok(down_command) => down_command,
+                Err(err) => {
+                    tracing::warn!(
+                        "Failed to shutdown process with name {}\n{}",
+                        proc.name,
+                        err
+                    );
+                    continue;
+                }
+            };
             match proc.process {
                 ProcessType::BareMetal => {
                     // find the pid associated with this process
-                    let pid = running_processes.iter().find_map(|p| match p {
-                        ProcessToObserve::Pid(Some(name), pid) if name == &proc.name => Some(*pid),
-                        _ => None,
-                    });
+                    let pid = pid_of(proc, running_processes);
 
                     // if pid can't be found then log an error
                     if let Some(pid) = pid {
                         // replace {pid} with the actual PID in the down command
                         let down_command = down_command.replace("{pid}", &pid.to_string());
 
-                        let res = run_command_detached(&down_command, &proc.redirect);
+                        let res =
+                            run_command_detached(&down_command, &proc.redirect, &exec_plan.env);
                         if res.is_err() {
                             let err = res.unwrap_err();
                             tracing::warn!(
@@ -183,8 +1376,8 @@ fn shutdown_application(
                         );
                     }
                 }
-                ProcessType::Docker { containers: _ } => {
-                    let res = run_command_detached(down_command, &proc.redirect);
+                ProcessType::Docker { .. } | ProcessType::K8s { .. } => {
+                    let res = run_command_detached(&down_command, &proc.redirect, &exec_plan.env);
                     if res.is_err() {
                         let err = res.unwrap_err();
                         tracing::warn!(
@@ -201,94 +1394,774 @@ fn shutdown_application(
     Ok(())
 }
 
+/// Checks the machine is fit to measure on before anything starts.
+///
+/// # Returns
+/// The state of the machine to save with the run, an error if a check failed and the checks are
+/// strict
+fn check_environment(exec_plan: &ExecutionPlan) -> anyhow::Result<environment::Environment> {
+    let environment = environment::snapshot();
+    let problems = environment::check(&environment, exec_plan.checks);
+    if !problems.is_empty() && exec_plan.checks.strict {
+        return Err(anyhow!(
+            "Refusing to run, {}. Fix the machine or remove strict from [checks].",
+            problems.join(", ")
+        ));
+    }
+    for problem in problems.iter() {
+        tracing::warn!("Results may be noisy, {}", problem);
+    }
+    Ok(environment)
+}
+
+/// Pins cardamon to its CPUs before it starts the processes, if it's configured to.
+fn pin_cardamon(exec_plan: &ExecutionPlan) -> anyhow::Result<()> {
+    if let Some(cpus) = exec_plan
+        .pinning
+        .and_then(|pinning| pinning.cardamon.as_deref())
+    {
+        pinning::pin_self(cpus)?;
+    }
+    Ok(())
+}
+
+/// Starts serving the live metrics of the run if the config asks for them.
+///
+/// # Returns
+///
+/// The metrics the run updates and the server, None if they aren't served
+async fn start_exporter(
+    exec_plan: &ExecutionPlan<'_>,
+    run_id: &str,
+    tdp: Option<f64>,
+) -> anyhow::Result<Option<(exporter::Exporter, exporter::Server)>> {
+    let Some(prometheus) = exec_plan.prometheus else {
+        return Ok(None);
+    };
+    let exporter = exporter::Exporter::new(tdp);
+    let iterations = exec_plan.scenarios_to_execute.len();
+    exporter.planned(run_id, (iterations > 0).then_some(iterations));
+    let server = exporter::serve(prometheus.port(), exporter.clone()).await?;
+    Ok(Some((exporter, server)))
+}
+
+/// Looks up the live carbon intensity of the grid if the config has a provider. A failed lookup
+/// doesn't stop the run, the configured intensity is used instead.
+///
+/// # Arguments
+/// * exec_plan - the plan of the run
+/// * run_start - when the run started in milliseconds since the unix epoch
+///
+/// # Returns
+/// The grams of CO2e per kWh and where they came from, None if no intensity is configured
+async fn lookup_carbon_intensity(
+    exec_plan: &ExecutionPlan<'_>,
+    run_start: i64,
+) -> Option<(f64, String)> {
+    let carbon = exec_plan.carbon?;
+    if let Some(grid) = &carbon.grid {
+        match grid::intensity(grid).await {
+            Ok((intensity, source)) => {
+                tracing::info!("Grid carbon intensity is {intensity:.0} gCO2e/kWh ({source})");
+                return Some((intensity, source));
+            }
+            Err(err) => tracing::warn!("{:?}", err),
+        }
+    }
+    carbon.static_intensity(run_start)
+}
+
+/// Sets the built-in variables which are the same for the whole run, unless they've been set
+/// already.
+fn set_run_variables(exec_plan: &mut ExecutionPlan, run_id: &str) -> anyhow::Result<()> {
+    exec_plan
+        .variables
+        .entry(String::from("run_id"))
+        .or_insert(String::from(run_id));
+    if !exec_plan.variables.contains_key("port") {
+        let port = template::free_port()?;
+        exec_plan
+            .variables
+            .insert(String::from("port"), port.to_string());
+    }
+    Ok(())
+}
+
+/// Finds the TDP of the cpu. If it can't be found then carry on collecting cpu utilisation but
+/// let the user know that energy won't be available for this run.
+///
+/// # Returns
+/// The TDP in watts, where it came from and why energy is unavailable if it couldn't be found
+fn resolve_tdp(
+    exec_plan: &ExecutionPlan,
+) -> (Option<f64>, energy::TdpSource, Option<&'static str>) {
+    let (tdp, tdp_source) = energy::resolve_tdp(exec_plan.cpu);
+    let tdp =
+        tdp.map(|tdp| wsl::corrected_tdp(tdp, exec_plan.cpu.and_then(|cpu| cpu.host_processors)));
+    let energy_unavailable = if tdp.is_none() {
+        tracing::warn!(
+            "Energy will be unavailable for this run. {}",
+            energy::MISSING_TDP
+        );
+        Some(energy::MISSING_TDP)
+    } else {
+        None
+    };
+    (tdp, tdp_source, energy_unavailable)
+}
+
 pub async fn run<'a>(
-    exec_plan: ExecutionPlan<'a>,
+    mut exec_plan: ExecutionPlan<'a>,
     data_access_service: &dyn DataAccessService,
 ) -> anyhow::Result<ObservationDataset> {
     // create a unique cardamon run id
     let run_id = nanoid::nanoid!(5);
+    set_run_variables(&mut exec_plan, &run_id)?;
+    let run_start = time::SystemTime::now()
+        .duration_since(time::UNIX_EPOCH)?
+        .as_millis();
 
-    let mut processes_to_observe = exec_plan.external_processes_to_observe.to_vec(); // external procs to observe are cloned here.
+    let (tdp, tdp_source, energy_unavailable) = resolve_tdp(&exec_plan);
+    let carbon_intensity = lookup_carbon_intensity(&exec_plan, run_start as i64).await;
+    let environment = check_environment(&exec_plan)?;
+    let git = git::read(Path::new("."));
+    pin_cardamon(&exec_plan)?;
+    let (exporter, _server) = start_exporter(&exec_plan, &run_id, tdp).await?.unzip();
+    let otlp = exec_plan
+        .otlp
+        .map(|otlp| otlp::OtlpExporter::new(otlp, &run_id));
 
-    // run the application if there is anything to run
-    if !exec_plan.processes_to_execute.is_empty() {
-        for proc in exec_plan.processes_to_execute.iter() {
-            let process_to_observe = run_process(proc)?;
-            processes_to_observe.extend(process_to_observe);
+    // external procs to observe are cloned here, they're sampled at the default interval
+    let external_processes = exec_plan
+        .external_processes_to_observe
+        .iter()
+        .map(|proc| (proc.clone(), exec_plan.sample_interval))
+        .collect::<Vec<_>>();
+    let mut processes_to_observe = external_processes.clone();
+
+    // run the application if there is anything to run, keeping track of which process each
+    // thing to observe belongs to so scenarios run in parallel only observe their own
+    let mut processes_by_name = vec![];
+    let mut baseline = None;
+    let mut retries = 0;
+    let mut pauses = vec![];
+    let mut aborted = None;
+    // anything which goes wrong once the application has started aborts the run, so the
+    // application is still stopped and what ran before is saved
+    let running: anyhow::Result<()> = async {
+        if !exec_plan.processes_to_execute.is_empty() {
+            for proc in exec_plan.processes_to_execute.iter() {
+                let process_to_observe = start_process(&exec_plan, proc).await?;
+                processes_to_observe.extend(process_to_observe.iter().cloned());
+                processes_by_name.push((proc.name.as_str(), process_to_observe));
+            }
+        }
+        for scenario in exec_plan
+            .scenarios_to_execute
+            .iter()
+            .map(|s| s.scenario)
+            .filter(|scenario| scenario.start == Start::Cold)
+            .unique_by(|scenario| scenario.name.as_str())
+        {
+            if restartable_processes(&exec_plan, scenario).next().is_none() {
+                tracing::warn!(
+                    "Scenario {} starts cold but cardamon doesn't start any of its processes, they \
+                     can't be restarted",
+                    scenario.name
+                );
+            }
         }
-    }
 
-    // ---- for each scenario ----
-    for scenario_to_execute in exec_plan.scenarios_to_execute.iter() {
-        // start the metrics loggers
-        let stop_handle = metrics_logger::start_logging(&processes_to_observe)?;
+        // measure the idle power of the machine and the processes before any scenario runs
+        baseline = match exec_plan.baseline {
+            Some(baseline) => Some(
+                measure_baseline(
+                    &run_id,
+                    &exec_plan,
+                    baseline,
+                    &processes_to_observe,
+                    data_access_service,
+                )
+                .await?,
+            ),
+            None => None,
+        };
 
-        // run the scenario
-        let scenario_iteration = run_scenario(&run_id, scenario_to_execute).await?;
+        let waves = exec_plan.waves();
+        if exec_plan.parallelism > 1 {
+            warn_about_isolation(&exec_plan, &waves);
+        }
 
-        // stop the metrics loggers
-        let metrics_log = stop_handle.stop().await?;
+        // ---- for each wave of scenarios ----
+        let mut failed_scenarios: Vec<&str> = vec![];
+        let mut pause_control = pause::PauseControl::new()?;
+        let mut used_processes: Vec<&str> = vec![];
+        for wave in waves.iter() {
+            // nothing is running between waves so the run can be paused without losing data
+            if let Some(pause) = pause_control.wait_if_paused().await? {
+                pauses.push(pause);
+            }
 
-        // if metrics log contains errors then display them to the user and don't save anything
-        if metrics_log.has_errors() {
-            // log all the errors
-            for err in metrics_log.get_errors() {
-                tracing::error!("{}", err);
+            // there's nothing to measure if a scenario it depends on didn't run
+            let wave = wave
+                .iter()
+                .filter(|scenario_to_execute| {
+                    let skip = scenario_to_execute
+                        .scenario
+                        .depends_on
+                        .iter()
+                        .any(|dependency| failed_scenarios.contains(&dependency.as_str()));
+                    if skip {
+                        tracing::error!(
+                            "Skipping scenario {} iteration {}, a scenario it depends on failed",
+                            scenario_to_execute.name,
+                            scenario_to_execute.iteration + 1
+                        );
+                        if let Some(exporter) = &exporter {
+                            exporter.iteration_finished();
+                        }
+                    }
+                    !skip
+                })
+                .collect::<Vec<_>>();
+            if wave.is_empty() {
+                continue;
             }
-            return Err(anyhow!("Metric log contained errors, please see logs."));
-        }
+            let in_parallel = wave.len() > 1;
 
-        // write scenario and metrics to db
-        data_access_service
-            .scenario_iteration_dao()
-            .persist(&scenario_iteration)
-            .await?;
+            // cold starts restart the processes before each iteration so it's measured starting up
+            for scenario_to_execute in wave.iter() {
+                let scenario = scenario_to_execute.scenario;
+                if scenario.start != Start::Cold {
+                    continue;
+                }
+                for proc in restartable_processes(&exec_plan, scenario) {
+                    if !used_processes.contains(&proc.name.as_str()) {
+                        continue;
+                    }
+                    let Some((_, running)) = processes_by_name
+                        .iter_mut()
+                        .find(|(name, _)| *name == proc.name)
+                    else {
+                        continue;
+                    };
+                    *running = restart_process(&exec_plan, proc, scenario, running).await?;
+                }
+            }
+            processes_to_observe = external_processes
+                .iter()
+                .chain(
+                    processes_by_name
+                        .iter()
+                        .flat_map(|(_, processes)| processes.iter()),
+                )
+                .cloned()
+                .collect();
+            used_processes.extend(
+                wave.iter()
+                    .flat_map(|s| s.scenario.processes.iter().map(String::as_str)),
+            );
 
-        for metrics in metrics_log.get_metrics() {
-            data_access_service
-                .cpu_metrics_dao()
-                .persist(&metrics.into_data_access(&run_id))
+            // machine wide sources can't be split between the scenarios of a wave, they're logged
+            // once for all of them
+            let machine_stop_handle = if in_parallel {
+                Some(metrics_logger::start_logging(
+                    &[],
+                    exec_plan.power_sources,
+                    exec_plan.metrics_sources,
+                    exec_plan.hosts,
+                    exec_plan.container_runtime,
+                    exec_plan.container_stats,
+                    exec_plan.cpu_accounting,
+                )?)
+            } else {
+                None
+            };
+
+            let lanes = wave.iter().map(|scenario_to_execute| {
+                let processes_to_observe = if in_parallel {
+                    processes_by_name
+                        .iter()
+                        .filter(|(name, _)| {
+                            scenario_to_execute
+                                .scenario
+                                .processes
+                                .iter()
+                                .any(|proc| proc == name)
+                        })
+                        .flat_map(|(_, processes)| processes.iter().cloned())
+                        .collect::<Vec<_>>()
+                } else {
+                    processes_to_observe.clone()
+                };
+                run_lane(
+                    &run_id,
+                    &exec_plan,
+                    scenario_to_execute,
+                    processes_to_observe,
+                    !in_parallel,
+                    tdp,
+                    exporter.as_ref(),
+                )
+            });
+            let lanes = futures_util::future::join_all(lanes).await;
+            let machine_metrics_log = match machine_stop_handle {
+                Some(stop_handle) => Some(stop_handle.stop().await?),
+                None => None,
+            };
+
+            for (scenario_to_execute, lane) in wave.iter().zip(lanes) {
+                let scenario = scenario_to_execute.scenario;
+                // retries run on their own so they observe every process, like a serial run
+                let mut lane = lane;
+                let mut attempts = 0;
+                while let Err(err) = &lane {
+                    if attempts == scenario.max_retries() {
+                        break;
+                    }
+                    attempts += 1;
+                    tracing::warn!(
+                        "Scenario {} iteration {} failed, retrying ({}/{})\n{}",
+                        scenario_to_execute.name,
+                        scenario_to_execute.iteration + 1,
+                        attempts,
+                        scenario.max_retries(),
+                        err
+                    );
+                    lane = run_lane(
+                        &run_id,
+                        &exec_plan,
+                        scenario_to_execute,
+                        processes_to_observe.clone(),
+                        true,
+                        tdp,
+                        exporter.as_ref(),
+                    )
+                    .await;
+                }
+                retries += attempts;
+                if let Some(exporter) = &exporter {
+                    exporter.iteration_finished();
+                }
+
+                // a failed iteration is saved with what it printed but without its metrics, so it's
+                // left out of the stats
+                if let Some(failed) = lane
+                    .as_ref()
+                    .err()
+                    .and_then(|err| err.downcast_ref::<FailedIteration>())
+                {
+                    data_access_service
+                        .scenario_iteration_dao()
+                        .persist(&failed.scenario_iteration)
+                        .await?;
+                }
+
+                let (mut scenario_iteration, metrics_log) = match lane {
+                    Ok(lane) => lane,
+                    // the rest of the wave has already run so it's saved before the run is stopped
+                    Err(err) if scenario.on_failure == OnFailure::Abort => {
+                        failed_scenarios.push(&scenario.name);
+                        aborted.get_or_insert(err);
+                        continue;
+                    }
+                    Err(err) => {
+                        tracing::error!(
+                            "Scenario {} iteration {} failed, its metrics won't be saved\n{}",
+                            scenario_to_execute.name,
+                            scenario_to_execute.iteration + 1,
+                            err
+                        );
+                        failed_scenarios.push(&scenario.name);
+                        continue;
+                    }
+                };
+                check_metrics_log(&metrics_log)?;
+                scenario_iteration.cold_start = scenario.start == Start::Cold
+                    && restartable_processes(&exec_plan, scenario).next().is_some();
+
+                // write scenario and metrics to db
+                data_access_service
+                    .scenario_iteration_dao()
+                    .persist(&scenario_iteration)
+                    .await?;
+
+                persist_metrics_log(
+                    &run_id,
+                    Some(&scenario_iteration.scenario_name),
+                    &metrics_log,
+                    data_access_service,
+                )
                 .await?;
+                let logs_requests = exec_plan.processes_to_execute.iter().any(|proc| {
+                    proc.access_log.is_some() && scenario.processes.contains(&proc.name)
+                });
+                if otlp.is_some() || logs_requests {
+                    let iteration = data_access_service
+                        .fetch_iteration_with_metrics(scenario_iteration)
+                        .await?;
+                    persist_endpoint_energy(
+                        &exec_plan,
+                        scenario,
+                        &iteration,
+                        &processes_by_name,
+                        tdp,
+                        data_access_service,
+                    )
+                    .await?;
+                    if let Some(otlp) = &otlp {
+                        otlp.push(&iteration, tdp, exec_plan.blend).await;
+                    }
+                }
+            }
+            if let Some(metrics_log) = machine_metrics_log {
+                check_metrics_log(&metrics_log)?;
+                persist_metrics_log(&run_id, None, &metrics_log, data_access_service).await?;
+            }
+            if aborted.is_some() {
+                break;
+            }
         }
+        // ---- end for ----
+
+        Ok(())
+    }
+    .await;
+    if let Err(err) = running {
+        aborted.get_or_insert(err);
     }
-    // ---- end for ----
 
     // stop the application
-    shutdown_application(&exec_plan, &processes_to_observe)?;
+    if let Err(err) = stop_application(&exec_plan, &processes_to_observe).await {
+        tracing::warn!("{:#}", err);
+    }
+
+    // record the provenance of this run
+    let run_stop = time::SystemTime::now()
+        .duration_since(time::UNIX_EPOCH)?
+        .as_millis();
+    let run = Run {
+        baseline_start: baseline.map(|(start, _)| start),
+        baseline_stop: baseline.map(|(_, stop)| stop),
+        retries: retries as i64,
+        shuffle_seed: exec_plan.shuffle_seed.map(|seed| seed as i64),
+        scenario_order: exec_plan.scenario_order(),
+        pauses: pause::format(&pauses),
+        environment: serde_json::to_string(&environment).ok(),
+        carbon_intensity: carbon_intensity.as_ref().map(|(intensity, _)| *intensity),
+        carbon_intensity_source: carbon_intensity.map(|(_, source)| source),
+        pue: exec_plan.carbon.and_then(|carbon| carbon.pue),
+        label: exec_plan.label.clone(),
+        project: exec_plan.project.clone(),
+        aborted: aborted.as_ref().map(|err| format!("{:#}", err)),
+        ..Run::new(
+            &run_id,
+            run_start as i64,
+            run_stop as i64,
+            tdp,
+            tdp_source.as_str(),
+            energy_unavailable,
+            Some(exec_plan.config_source),
+        )
+    }
+    .with_git(git);
+    data_access_service.run_dao().persist(&run).await?;
+    // what ran before the failure is kept with the run, so it can still be looked at
+    if let Some(err) = aborted {
+        return Err(err.context(format!("Run {} was aborted", run_id)));
+    }
 
     // create a summary to return to the user
     let scenario_names = exec_plan.scenario_names();
     let previous_runs = 3;
     let observation_dataset = data_access_service
-        .fetch_observation_dataset(scenario_names, previous_runs)
+        .fetch_observation_dataset(scenario_names, exec_plan.project.as_deref(), previous_runs)
         .await?;
 
     Ok(observation_dataset)
 }
 
+/// Meters the application without running any scenarios. The configured processes are started
+/// and observed until the duration has passed or the user presses Ctrl-C, the metrics are saved
+/// as a run with a single iteration covering the whole observation.
+///
+/// # Arguments
+///
+/// * exec_plan - The processes to start and observe, any scenarios in it are ignored
+/// * name - The name the observation is saved under, as if it were a scenario
+/// * duration - How long to observe for, None to observe until Ctrl-C
+/// * data_access_service - Where the run is saved
+///
+/// # Returns
+///
+/// The dataset of this observation and the previous ones saved under the same name
+pub async fn observe<'a>(
+    mut exec_plan: ExecutionPlan<'a>,
+    name: &str,
+    duration: Option<Duration>,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<ObservationDataset> {
+    let run_id = nanoid::nanoid!(5);
+    set_run_variables(&mut exec_plan, &run_id)?;
+    let run_start = time::SystemTime::now()
+        .duration_since(time::UNIX_EPOCH)?
+        .as_millis();
+    let (tdp, tdp_source, energy_unavailable) = resolve_tdp(&exec_plan);
+    let carbon_intensity = lookup_carbon_intensity(&exec_plan, run_start as i64).await;
+    let environment = check_environment(&exec_plan)?;
+    let git = git::read(Path::new("."));
+    pin_cardamon(&exec_plan)?;
+    let (exporter, _server) = start_exporter(&exec_plan, &run_id, tdp).await?.unzip();
+    let otlp = exec_plan
+        .otlp
+        .map(|otlp| otlp::OtlpExporter::new(otlp, &run_id));
+    let mut pushed_until = run_start as i64;
+
+    let mut processes_to_observe = exec_plan
+        .external_processes_to_observe
+        .iter()
+        .map(|proc| (proc.clone(), exec_plan.sample_interval))
+        .collect::<Vec<_>>();
+    if processes_to_observe.is_empty() && exec_plan.processes_to_execute.is_empty() {
+        return Err(anyhow!(
+            "Nothing to observe, configure processes or pass --pids or --containers"
+        ));
+    }
+
+    // anything which goes wrong once the application has started aborts the observation, so
+    // the application is still stopped and what was observed is saved
+    let observing: anyhow::Result<()> = async {
+        for proc in exec_plan.processes_to_execute.iter() {
+            processes_to_observe.extend(start_process(&exec_plan, proc).await?);
+        }
+
+        match duration {
+            Some(duration) => tracing::info!(
+                "Observing for {}, press Ctrl-C to stop early",
+                humantime::format_duration(duration)
+            ),
+            None => tracing::info!("Observing until Ctrl-C is pressed"),
+        }
+        let stop_handle = metrics_logger::start_logging(
+            &processes_to_observe,
+            exec_plan.power_sources,
+            exec_plan.metrics_sources,
+            exec_plan.hosts,
+            exec_plan.container_runtime,
+            exec_plan.container_stats,
+            exec_plan.cpu_accounting,
+        )?;
+
+        // save what's been logged every so often so long observations don't build up in memory
+        let deadline = duration.map(|duration| tokio::time::Instant::now() + duration);
+        let mut flush = tokio::time::interval(OBSERVE_FLUSH_INTERVAL);
+        flush.tick().await;
+        let mut export = tokio::time::interval(exporter::UPDATE_INTERVAL);
+        if let Some(exporter) = &exporter {
+            exporter.scenario_started(name);
+        }
+        let export_log = |metrics_log: &MetricsLog| {
+            if let Some(exporter) = &exporter {
+                exporter.record(name, metrics_log.get_metrics());
+            }
+        };
+        loop {
+            let finished = async {
+                match deadline {
+                    Some(deadline) => tokio::time::sleep_until(deadline).await,
+                    None => std::future::pending().await,
+                }
+            };
+            tokio::select! {
+                _ = flush.tick() => {
+                    let metrics_log = stop_handle.drain();
+                    export_log(&metrics_log);
+                    persist_observed(&run_id, &metrics_log, data_access_service).await?;
+                    if let Some(otlp) = &otlp {
+                        pushed_until = push_observed(otlp, &exec_plan, &run_id, name, pushed_until, tdp, data_access_service).await?;
+                    }
+                }
+                _ = export.tick(), if exporter.is_some() => stop_handle.with_log(export_log),
+                _ = tokio::signal::ctrl_c() => {
+                    tracing::info!("Stopping observation");
+                    break;
+                }
+                _ = finished => break,
+            }
+        }
+        let metrics_log = stop_handle.drain();
+        stop_handle.stop().await?;
+        persist_observed(&run_id, &metrics_log, data_access_service).await?;
+        if let Some(otlp) = &otlp {
+            push_observed(
+                otlp,
+                &exec_plan,
+                &run_id,
+                name,
+                pushed_until,
+                tdp,
+                data_access_service,
+            )
+            .await?;
+        }
+        Ok(())
+    }
+    .await;
+    let run_stop = time::SystemTime::now()
+        .duration_since(time::UNIX_EPOCH)?
+        .as_millis();
+
+    if let Err(err) = stop_application(&exec_plan, &processes_to_observe).await {
+        tracing::warn!("{:#}", err);
+    }
+
+    let scenario_iteration =
+        ScenarioIteration::new(&run_id, name, 0, run_start as i64, run_stop as i64, None);
+    data_access_service
+        .scenario_iteration_dao()
+        .persist(&scenario_iteration)
+        .await?;
+    let run = Run {
+        environment: serde_json::to_string(&environment).ok(),
+        carbon_intensity: carbon_intensity.as_ref().map(|(intensity, _)| *intensity),
+        carbon_intensity_source: carbon_intensity.map(|(_, source)| source),
+        pue: exec_plan.carbon.and_then(|carbon| carbon.pue),
+        label: exec_plan.label.clone(),
+        project: exec_plan.project.clone(),
+        aborted: observing.as_ref().err().map(|err| format!("{:#}", err)),
+        ..Run::new(
+            &run_id,
+            run_start as i64,
+            run_stop as i64,
+            tdp,
+            tdp_source.as_str(),
+            energy_unavailable,
+            Some(exec_plan.config_source),
+        )
+    }
+    .with_git(git);
+    data_access_service.run_dao().persist(&run).await?;
+    if let Err(err) = observing {
+        return Err(err.context(format!("Observation {} was aborted", run_id)));
+    }
+
+    data_access_service
+        .fetch_observation_dataset(vec![name], exec_plan.project.as_deref(), 3)
+        .await
+}
+
+/// Pushes what's been observed since the previous push to the OpenTelemetry collector, as if it
+/// were a scenario iteration.
+///
+/// # Returns
+///
+/// Where the next push starts
+async fn push_observed(
+    otlp: &otlp::OtlpExporter,
+    exec_plan: &ExecutionPlan<'_>,
+    run_id: &str,
+    name: &str,
+    since: i64,
+    tdp: Option<f64>,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<i64> {
+    let now = time::SystemTime::now()
+        .duration_since(time::UNIX_EPOCH)?
+        .as_millis() as i64;
+    let window = ScenarioIteration::new(run_id, name, 0, since, now, None);
+    let iteration = data_access_service
+        .fetch_iteration_with_metrics(window)
+        .await?;
+    otlp.push(&iteration, tdp, exec_plan.blend).await;
+    Ok(now + 1)
+}
+
+/// Saves metrics logged while observing. A long observation shouldn't be thrown away because a
+/// sample failed, errors are logged as warnings instead.
+async fn persist_observed(
+    run_id: &str,
+    metrics_log: &MetricsLog,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<()> {
+    for err in metrics_log.get_errors() {
+        tracing::warn!("{}", err);
+    }
+    persist_metrics_log(run_id, None, metrics_log, data_access_service).await
+}
+
 #[cfg(test)]
 mod tests {
     use crate::{
-        config::{ProcessToExecute, ProcessType},
-        metrics_logger, run_process, ProcessToObserve,
+        config::{ContainerRuntime, ContainerStats, CpuAccounting, ProcessToExecute, ProcessType},
+        metrics_logger, printed_units, read_functional_units, read_output, run_process,
+        run_scenario_command, ProcessToObserve, MAX_OUTPUT_BYTES,
     };
-    use std::time::Duration;
+    use std::{collections::BTreeMap, time::Duration};
     use sysinfo::{Pid, System};
+    use tokio_util::sync::CancellationToken;
+
+    #[test]
+    fn scenarios_can_report_functional_units_in_a_file_or_on_stdout() -> anyhow::Result<()> {
+        assert_eq!(
+            printed_units("CARDAMON_FUNCTIONAL_UNITS=250\n"),
+            Some("250")
+        );
+        assert_eq!(printed_units("served 250 requests"), None);
+
+        let units_file = std::env::temp_dir().join("cardamon-test-functional-units.units");
+        let _ = std::fs::remove_file(&units_file);
+        assert_eq!(
+            read_functional_units(&units_file, Some(" 250 "), "s"),
+            Some(250.0)
+        );
+        assert_eq!(read_functional_units(&units_file, Some("lots"), "s"), None);
+        assert_eq!(read_functional_units(&units_file, None, "s"), None);
+
+        // the file wins over stdout and is cleaned up
+        std::fs::write(&units_file, "100")?;
+        assert_eq!(
+            read_functional_units(&units_file, Some("250"), "s"),
+            Some(100.0)
+        );
+        assert!(!units_file.exists());
+        Ok(())
+    }
+
+    #[tokio::test]
+    async fn only_the_end_of_a_scenarios_output_is_kept() -> anyhow::Result<()> {
+        let printed = "CARDAMON_FUNCTIONAL_UNITS=250\nserved\n";
+        let (output, units) = read_output(printed.as_bytes(), true).await?;
+        assert_eq!(output, printed);
+        assert_eq!(units.as_deref(), Some("250"));
+        assert_eq!(read_output(printed.as_bytes(), false).await?.1, None);
+
+        let chatty = format!("{}\nlast line", "x".repeat(3 * MAX_OUTPUT_BYTES));
+        let (output, _) = read_output(chatty.as_bytes(), false).await?;
+        assert_eq!(output.len(), MAX_OUTPUT_BYTES);
+        assert!(output.ends_with("x\nlast line"));
+        Ok(())
+    }
 
     #[cfg(target_family = "windows")]
     mod windows {
         use super::*;
 
-        #[test]
-        fn can_run_a_bare_metal_process() -> anyhow::Result<()> {
+        #[tokio::test]
+        async fn can_run_a_bare_metal_process() -> anyhow::Result<()> {
             let process = ProcessToExecute {
                 name: "sleep".to_string(),
-                up: "powershell sleep 15".to_string(),
+                up: Some("powershell sleep 15".to_string()),
                 down: None,
                 redirect: None,
+                match_name: None,
+                match_port: None,
+                sample_interval_ms: None,
+                cgroup: false,
+                cpus: None,
+                access_log: None,
                 process: ProcessType::BareMetal,
             };
-            let processes_to_observe = run_process(&process)?;
+            let processes_to_observe = run_process(&process, &[], &BTreeMap::new(), None).await?;
 
             assert_eq!(processes_to_observe.len(), 1);
 
@@ -310,13 +2183,31 @@ mod tests {
         async fn log_scenario_should_return_metrics_log_without_errors() -> anyhow::Result<()> {
             let process = ProcessToExecute {
                 name: "sleep".to_string(),
-                up: "powershell sleep 20".to_string(),
+                up: Some("powershell sleep 20".to_string()),
                 down: None,
                 redirect: None,
+                match_name: None,
+                match_port: None,
+                sample_interval_ms: None,
+                cgroup: false,
+                cpus: None,
+                access_log: None,
                 process: ProcessType::BareMetal,
             };
-            let processes_to_observe = run_process(&process)?;
-            let stop_handle = metrics_logger::start_logging(&processes_to_observe)?;
+            let processes_to_observe = run_process(&process, &[], &BTreeMap::new(), None)
+                .await?
+                .into_iter()
+                .map(|process| (process, Duration::from_secs(1)))
+                .collect::<Vec<_>>();
+            let stop_handle = metrics_logger::start_logging(
+                &processes_to_observe,
+                &[],
+                &[],
+                &[],
+                ContainerRuntime::Docker,
+                ContainerStats::Api,
+                CpuAccounting::Proc,
+            )?;
 
             tokio::time::sleep(Duration::from_secs(10)).await;
 
@@ -334,16 +2225,22 @@ mod tests {
         use super::*;
         use crate::config::Redirect;
 
-        #[test]
-        fn can_run_a_bare_metal_process() -> anyhow::Result<()> {
+        #[tokio::test]
+        async fn can_run_a_bare_metal_process() -> anyhow::Result<()> {
             let process = ProcessToExecute {
                 name: "sleep".to_string(),
-                up: "sleep 15".to_string(),
+                up: Some("sleep 15".to_string()),
                 down: None,
                 redirect: Some(Redirect::Null),
+                match_name: None,
+                match_port: None,
+                sample_interval_ms: None,
+                cgroup: false,
+                cpus: None,
+                access_log: None,
                 process_type: ProcessType::BareMetal,
             };
-            let processes_to_observe = run_process(&process)?;
+            let processes_to_observe = run_process(&process, &[], &BTreeMap::new(), None).await?;
 
             assert_eq!(processes_to_observe.len(), 1);
 
@@ -365,13 +2262,31 @@ mod tests {
         async fn log_scenario_should_return_metrics_log_without_errors() -> anyhow::Result<()> {
             let process = ProcessToExecute {
                 name: "sleep".to_string(),
-                up: "sleep 20".to_string(),
+                up: Some("sleep 20".to_string()),
                 down: None,
                 redirect: Some(Redirect::Null),
+                match_name: None,
+                match_port: None,
+                sample_interval_ms: None,
+                cgroup: false,
+                cpus: None,
+                access_log: None,
                 process_type: ProcessType::BareMetal,
             };
-            let processes_to_observe = run_process(&process)?;
-            let stop_handle = metrics_logger::start_logging(&processes_to_observe)?;
+            let processes_to_observe = run_process(&process, &[], &BTreeMap::new(), None)
+                .await?
+                .into_iter()
+                .map(|process| (process, Duration::from_secs(1)))
+                .collect::<Vec<_>>();
+            let stop_handle = metrics_logger::start_logging(
+                &processes_to_observe,
+                &[],
+                &[],
+                &[],
+                ContainerRuntime::Docker,
+                ContainerStats::Api,
+                CpuAccounting::Proc,
+            )?;
 
             tokio::time::sleep(Duration::from_secs(10)).await;
 
@@ -382,5 +2297,166 @@ mod tests {
 
             Ok(())
         }
+
+        #[tokio::test]
+        async fn failed_scenarios_keep_their_output() -> anyhow::Result<()> {
+            let config = toml::from_str::<crate::config::Config>(
+                r#"
+                [[scenarios]]
+                name = "fails"
+                desc = ""
+                command = "ls /cardamon-missing"
+                iterations = 1
+                processes = []
+
+                [[observations]]
+                name = "fails"
+                scenarios = ["fails"]
+                "#,
+            )?;
+            let output = run_scenario_command(
+                "ls /cardamon-missing",
+                &config.scenarios[0],
+                &[],
+                &CancellationToken::new(),
+                false,
+                None,
+            )
+            .await?;
+
+            assert!(output.exit_code.is_some_and(|exit_code| exit_code != 0));
+            assert!(output.stderr.contains("cardamon-missing"));
+            assert!(output
+                .failure
+                .is_some_and(|failure| failure.contains("cardamon-missing")));
+            Ok(())
+        }
+
+        #[sqlx::test(migrations = "./migrations")]
+        async fn aborted_runs_are_saved_with_what_ran_before(
+            pool: sqlx::SqlitePool,
+        ) -> anyhow::Result<()> {
+            use crate::data_access::{DataAccessService, LocalDataAccessService};
+
+            let config = toml::from_str::<crate::config::Config>(
+                r#"
+                [[scenarios]]
+                name = "passes"
+                desc = ""
+                command = "echo served"
+                iterations = 1
+                processes = []
+
+                [[scenarios]]
+                name = "fails"
+                desc = ""
+                command = "ls /cardamon-missing"
+                iterations = 1
+                processes = []
+
+                [[scenarios]]
+                name = "never_runs"
+                desc = ""
+                command = "echo unreachable"
+                iterations = 1
+                processes = []
+
+                [[observations]]
+                name = "all"
+                scenarios = ["passes", "fails", "never_runs"]
+                "#,
+            )?;
+            let data_access_service = LocalDataAccessService::new(pool.clone());
+            let exec_plan = config.create_execution_plan("all")?;
+            assert!(crate::run(exec_plan, &data_access_service).await.is_err());
+
+            let runs = data_access_service.run_dao().fetch_since(0).await?;
+            assert_eq!(runs.len(), 1);
+            assert!(runs[0]
+                .aborted
+                .as_ref()
+                .is_some_and(|reason| !reason.is_empty()));
+            let scenario_iterations = data_access_service
+                .scenario_iteration_dao()
+                .fetch_by_run(&runs[0].run_id)
+                .await?;
+            let scenarios = scenario_iterations
+                .iter()
+                .map(|scenario_iteration| scenario_iteration.scenario_name.as_str())
+                .collect::<Vec<_>>();
+            assert_eq!(scenarios, ["passes", "fails"]);
+
+            // the failed iteration keeps its output but is left out of the stats
+            let failed = &scenario_iterations[1];
+            assert!(failed.failed);
+            assert!(failed.exit_code.is_some_and(|exit_code| exit_code != 0));
+            assert!(failed
+                .stderr
+                .as_ref()
+                .is_some_and(|stderr| stderr.contains("cardamon-missing")));
+            let run_dataset = data_access_service
+                .fetch_run_dataset(&runs[0].run_id)
+                .await?;
+            assert_eq!(run_dataset.data().len(), 1);
+
+            pool.close().await;
+            Ok(())
+        }
+
+        #[sqlx::test(migrations = "./migrations")]
+        async fn runs_are_saved_when_a_logger_fails(pool: sqlx::SqlitePool) -> anyhow::Result<()> {
+            use crate::data_access::{DataAccessService, LocalDataAccessService};
+
+            // scenarios run in parallel share a logger for the metrics sources, nothing listens
+            // on port 1 so it logs an error
+            let config = toml::from_str::<crate::config::Config>(
+                r#"
+                parallelism = 2
+
+                [[metrics_sources]]
+                type = "prometheus"
+                url = "http://127.0.0.1:1"
+
+                [[metrics_sources.queries]]
+                query = "up"
+                field = "power"
+
+                [[scenarios]]
+                name = "first"
+                desc = ""
+                command = "echo served"
+                iterations = 1
+                processes = []
+                cooldown = "1s"
+
+                [[scenarios]]
+                name = "second"
+                desc = ""
+                command = "echo served"
+                iterations = 1
+                processes = []
+                cooldown = "1s"
+
+                [[observations]]
+                name = "both"
+                scenarios = ["first", "second"]
+                "#,
+            )?;
+            let data_access_service = LocalDataAccessService::new(pool.clone());
+            let exec_plan = config.create_execution_plan("both")?;
+            assert!(crate::run(exec_plan, &data_access_service).await.is_err());
+
+            let runs = data_access_service.run_dao().fetch_since(0).await?;
+            assert_eq!(runs.len(), 1);
+            assert!(runs[0].aborted.is_some());
+            let scenario_iterations = data_access_service
+                .scenario_iteration_dao()
+                .fetch_by_run(&runs[0].run_id)
+                .await?;
+            assert_eq!(scenario_iterations.len(), 2);
+
+            pool.close().await;
+            Ok(())
+        }
     }
 }
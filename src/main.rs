@@ -1,11 +1,28 @@
-use std::path::Path;
+mod server;
 
+use std::{collections::BTreeMap, fs, path::Path, time};
+
+use anyhow::Context;
 use cardamon::{
+    ab, access_log, agent,
+    annotation::{self, Annotation},
+    archive, badge, carbon,
+    compare::{self, ScenarioComparison},
     config::{self, ProcessToObserve},
-    data_access::LocalDataAccessService,
-    run,
+    config_diff,
+    data_access::{
+        self, artifact::Artifact, DataAccessService, LocalDataAccessService,
+        PostgresDataAccessService, RemoteDataAccessService,
+    },
+    dataset::{self, GroupBy, ObservationDataset},
+    energy, environment, export, grafana, junit,
+    metrics::PowerComponent,
+    observe, pause, prune, push, regression, report, reproducibility, run, shuffle, significance,
+    sync, template, trend,
+    units::{CarbonUnit, EnergyUnit, Units},
 };
-use clap::{Parser, Subcommand};
+use clap::{Args, Parser, Subcommand, ValueEnum};
+use itertools::Itertools;
 use sqlx::{migrate::MigrateDatabase, SqlitePool};
 use tracing::Level;
 
@@ -18,13 +35,282 @@ pub struct Cli {
     #[arg(short, long)]
     pub file: Option<String>,
 
+    /// The project runs are saved under and looked up in, replacing project in the config
+    #[arg(long, global = true)]
+    pub project: Option<String>,
+
+    #[command(flatten)]
+    pub units: UnitArgs,
+
     #[command(subcommand)]
     pub command: Commands,
 }
 
+#[derive(Args, Debug, Clone, Copy)]
+pub struct UnitArgs {
+    /// The unit energy is shown in, overrides units.energy in the config
+    #[arg(long, value_enum, global = true)]
+    pub energy_unit: Option<EnergyUnit>,
+
+    /// The unit carbon is shown in, overrides units.carbon in the config
+    #[arg(long, value_enum, global = true)]
+    pub carbon_unit: Option<CarbonUnit>,
+
+    /// Round figures to this many significant digits, overrides units.significant_digits in the
+    /// config
+    #[arg(long, global = true)]
+    pub significant_digits: Option<usize>,
+}
+impl UnitArgs {
+    /// # Returns
+    /// The configured units with any set on the command line instead
+    fn over(&self, configured: Units) -> Units {
+        Units {
+            energy: self.energy_unit.unwrap_or(configured.energy),
+            carbon: self.carbon_unit.unwrap_or(configured.carbon),
+            significant_digits: self.significant_digits.or(configured.significant_digits),
+        }
+    }
+}
+
 #[derive(Subcommand, Debug)]
 pub enum Commands {
     Run {
+        /// An observation, a scenario or a pattern matching scenarios, e.g. "checkout-*"
+        name: String,
+
+        #[arg(value_name = "EXTERNAL PIDs", short, long, value_delimiter = ',')]
+        pids: Option<Vec<String>>,
+
+        #[arg(
+            value_name = "EXTERNAL CONTAINER NAMES",
+            short,
+            long,
+            value_delimiter = ','
+        )]
+        containers: Option<Vec<String>>,
+
+        #[arg(long)]
+        external_only: bool,
+
+        /// Only run scenarios with these tags, tags starting with ! are excluded
+        #[arg(long, value_delimiter = ',')]
+        tags: Option<Vec<String>>,
+
+        /// Set a variable used in commands, replacing the value in the config
+        #[arg(long, value_name = "NAME=VALUE")]
+        set: Vec<String>,
+
+        /// Save the run with a name, e.g. the branch it measured, so later runs can use it as
+        /// their baseline
+        #[arg(long)]
+        label: Option<String>,
+
+        /// Fail if a scenario used more energy than its max_regression_pct allows over the
+        /// baseline run
+        #[arg(long)]
+        check: bool,
+
+        /// The run id, label, branch or commit of the baseline, replacing regression_baseline in
+        /// the config
+        #[arg(long)]
+        baseline: Option<String>,
+    },
+
+    /// Total energy used by everything cardamon has measured over a period
+    Fleet {
+        #[arg(long, default_value = "30d", value_parser = humantime::parse_duration)]
+        since: time::Duration,
+
+        #[arg(long, value_enum, default_value_t = FleetGroup::Process)]
+        by: FleetGroup,
+
+        #[arg(value_name = "gCO2e/kWh", long)]
+        carbon_intensity: Option<f64>,
+    },
+
+    /// Attach a file, e.g. a flamegraph or chart, to a run
+    Attach {
+        #[arg(long)]
+        run: String,
+
+        #[arg(long)]
+        file: String,
+
+        /// Defaults to the file name, it has to be a file name without a path
+        #[arg(long)]
+        name: Option<String>,
+    },
+
+    /// List the files attached to a run
+    Artifacts {
+        #[arg(long)]
+        run: String,
+
+        /// Write every artifact into this directory
+        #[arg(long, value_name = "DIR")]
+        extract: Option<String>,
+    },
+
+    /// Add a note to a run, e.g. what changed since the previous run, shown in its report and in
+    /// trends and comparisons
+    Annotate {
+        /// The run id, label or commit of the run
+        run: String,
+
+        /// e.g. "switched to jemalloc"
+        note: Option<String>,
+
+        /// A label to add to the run, e.g. allocator=jemalloc
+        #[arg(long, value_name = "KEY=VALUE")]
+        label: Vec<String>,
+    },
+
+    /// Show what each iteration of a scenario printed in a run and how its command exited
+    Logs {
+        /// The run id, label or commit of the run
+        run: String,
+
+        scenario: String,
+
+        /// Only show this iteration, counting from 1
+        #[arg(long)]
+        iteration: Option<i64>,
+    },
+
+    /// Write a report of a run
+    Report {
+        run_id: String,
+
+        #[arg(long, value_enum, default_value_t = ReportFormat::Html)]
+        format: ReportFormat,
+
+        /// Write the report as a single HTML file which can be shared without cardamon
+        #[arg(long, value_name = "FILE", conflicts_with = "output")]
+        html: Option<String>,
+
+        /// Defaults to stdout
+        #[arg(short, long, value_name = "FILE")]
+        output: Option<String>,
+
+        /// The run id, label, branch or commit of the run to compare with in a markdown report,
+        /// defaults to regression_baseline in the config of the run
+        #[arg(long)]
+        baseline: Option<String>,
+    },
+
+    /// Export a run for other tools, see the export module for its schema
+    Export {
+        run_id: String,
+
+        #[arg(long, value_enum, default_value_t = ExportFormat::Json)]
+        format: ExportFormat,
+
+        /// Export every CPU sample taken during the run rather than the results
+        #[arg(long)]
+        raw: bool,
+
+        /// Defaults to stdout
+        #[arg(short, long, value_name = "FILE")]
+        output: Option<String>,
+    },
+
+    /// Compare the scenarios of two runs, e.g. from before and after a code change
+    Compare {
+        /// The run compared against, its id, label or commit
+        run_a: String,
+        /// The run being compared, its id, label or commit
+        run_b: String,
+    },
+
+    /// Write a badge of the latest energy or carbon of a scenario, e.g. for a dashboard
+    Badge {
+        scenario: String,
+
+        #[arg(long, value_enum, default_value_t = BadgeMetric::Energy)]
+        metric: BadgeMetric,
+
+        #[arg(long, value_name = "FILE")]
+        out: String,
+    },
+
+    /// Write a Grafana dashboard charting the energy of scenarios over time, for a JSON datasource
+    /// pointed at <server>/grafana of `cardamon server` or `cardamon ui`
+    GrafanaDashboard {
+        /// The uid given to the datasource in Grafana
+        #[arg(long, default_value = "cardamon")]
+        datasource_uid: String,
+
+        /// The scenarios to chart, defaults to every scenario in the config
+        #[arg(long, value_delimiter = ',')]
+        scenario: Vec<String>,
+
+        /// Defaults to stdout
+        #[arg(short, long, value_name = "FILE")]
+        output: Option<String>,
+    },
+
+    /// Show how the energy of a scenario changed across its previous runs
+    Trend {
+        scenario: String,
+
+        /// How many of the latest runs of the scenario to look at
+        #[arg(long, default_value_t = 30)]
+        last: u32,
+    },
+
+    /// Show how the current config differs from the config a previous run used
+    DiffConfig {
+        /// Defaults to the most recent run
+        run_id: Option<String>,
+    },
+
+    /// Run an observation on the schedule in its config until cardamon is stopped
+    Schedule {
+        name: String,
+
+        #[arg(long)]
+        external_only: bool,
+
+        /// Only run scenarios with these tags, tags starting with ! are excluded
+        #[arg(long, value_delimiter = ',')]
+        tags: Option<Vec<String>>,
+
+        /// Set a variable used in commands, replacing the value in the config
+        #[arg(long, value_name = "NAME=VALUE")]
+        set: Vec<String>,
+    },
+
+    /// Compare two scenarios or commands by running them alternately on this machine
+    Ab {
+        /// The scenario or command being compared against
+        #[arg(long)]
+        base: String,
+
+        /// The scenario or command being compared
+        #[arg(long)]
+        candidate: String,
+
+        /// How many times each of them runs
+        #[arg(short = 'n', long, default_value_t = 10)]
+        iterations: u32,
+
+        #[arg(long)]
+        external_only: bool,
+
+        /// Set a variable used in commands, replacing the value in the config
+        #[arg(long, value_name = "NAME=VALUE")]
+        set: Vec<String>,
+    },
+
+    /// Meter the configured processes without running any scenarios, until Ctrl-C is pressed
+    Observe {
+        /// Stop observing after this long, e.g. "30m"
+        #[arg(long = "for", value_parser = humantime::parse_duration)]
+        duration: Option<time::Duration>,
+
+        /// The name the observation is saved under
+        #[arg(long, default_value = "observe")]
         name: String,
 
         #[arg(value_name = "EXTERNAL PIDs", short, long, value_delimiter = ',')]
@@ -40,7 +326,164 @@ pub enum Commands {
 
         #[arg(long)]
         external_only: bool,
+
+        /// Set a variable used in commands, replacing the value in the config
+        #[arg(long, value_name = "NAME=VALUE")]
+        set: Vec<String>,
+    },
+
+    /// Pause running observations once their current scenarios finish
+    Pause,
+
+    /// Carry on with paused observations
+    Resume,
+
+    /// Store and serve the runs pushed by other cardamon instances, e.g. CI machines, so the
+    /// team's history is in one place. Runs are kept in the local cardamon.db
+    Server {
+        #[arg(long, default_value_t = server::DEFAULT_PORT)]
+        port: u16,
+    },
+
+    /// Serve a dashboard of the run history, scenario trends, runs and comparisons of the runs in
+    /// the local cardamon.db, along with the read API
+    Ui {
+        #[arg(long, default_value_t = server::DEFAULT_UI_PORT)]
+        port: u16,
     },
+
+    /// Upload a completed run to a `cardamon server`, e.g. before a CI machine is thrown away
+    Push {
+        run_id: String,
+
+        /// The url of the server, e.g. https://cardamon.internal:7421
+        #[arg(long)]
+        to: String,
+
+        /// A write token of the server, otherwise $CARDAMON_TOKEN if it's set
+        #[arg(long)]
+        token: Option<String>,
+    },
+
+    /// Upload the export, HTML report and artifacts of runs to object storage, the latest run
+    /// unless some are chosen. Credentials are read from the AWS_ environment variables
+    Sync {
+        /// The ids of the runs to upload
+        #[arg(long, value_delimiter = ',')]
+        run: Vec<String>,
+
+        /// Where the runs are uploaded, e.g. s3://ci-reports/cardamon, replacing sync.to in the
+        /// config
+        #[arg(long)]
+        to: Option<String>,
+    },
+
+    /// Delete the samples of old runs, keeping the energy of each iteration unless --delete-runs
+    /// is given, and downsample the runs which are kept. Replaces the limits of the retention
+    /// policy in the config
+    Prune {
+        /// Keep the samples of this many of the latest runs of each project
+        #[arg(long)]
+        keep_last: Option<usize>,
+
+        /// Keep the samples of runs started less than this long ago, e.g. "90d"
+        #[arg(long, value_parser = humantime::parse_duration)]
+        older_than: Option<time::Duration>,
+
+        /// Replace the samples of runs started longer ago than this with averages, e.g. "7d"
+        #[arg(long, value_parser = humantime::parse_duration)]
+        downsample_after: Option<time::Duration>,
+
+        /// Delete everything saved for the pruned runs
+        #[arg(long)]
+        delete_runs: bool,
+
+        /// List the runs which would be pruned without deleting anything
+        #[arg(long)]
+        dry_run: bool,
+    },
+
+    /// Move runs between the databases of different machines, e.g. from a lab box to a laptop
+    Db {
+        #[command(subcommand)]
+        command: DbCommands,
+    },
+
+    /// Observe processes on this host for a cardamon instance running on another host
+    Agent {
+        /// The address to listen on, e.g. 0.0.0.0 to be reachable from other hosts. Requests
+        /// aren't authenticated so only do that on a trusted network
+        #[arg(long, default_value = agent::DEFAULT_BIND)]
+        bind: String,
+
+        #[arg(long, default_value_t = agent::DEFAULT_PORT)]
+        port: u16,
+
+        #[arg(long, value_enum, default_value_t = config::ContainerRuntime::Docker)]
+        container_runtime: config::ContainerRuntime,
+    },
+}
+
+#[derive(Subcommand, Debug)]
+pub enum DbCommands {
+    /// Write runs to a compressed tarball, every run unless some are chosen
+    Export {
+        #[arg(value_name = "FILE")]
+        out: String,
+
+        /// The ids of the runs to export
+        #[arg(long, value_delimiter = ',')]
+        run: Vec<String>,
+
+        /// Export the runs with this label
+        #[arg(long)]
+        label: Option<String>,
+
+        /// Export the runs of this commit, at least 7 characters of it
+        #[arg(long)]
+        commit: Option<String>,
+
+        /// Export the runs started this long ago or since, e.g. "30d"
+        #[arg(long, value_parser = humantime::parse_duration)]
+        since: Option<time::Duration>,
+    },
+
+    /// Save the runs in an export, giving new ids to runs whose ids are already taken
+    Import {
+        #[arg(value_name = "FILE")]
+        file: String,
+    },
+}
+
+#[derive(ValueEnum, Clone, Copy, Debug)]
+pub enum FleetGroup {
+    Scenario,
+    Process,
+}
+
+#[derive(ValueEnum, Clone, Copy, Debug)]
+pub enum BadgeMetric {
+    /// The mean energy of an iteration
+    Energy,
+    /// The mean operational carbon of an iteration, runs need a carbon intensity
+    Carbon,
+}
+
+#[derive(ValueEnum, Clone, Copy, Debug)]
+pub enum ReportFormat {
+    /// A single page with no external resources, with charts of power over time
+    Html,
+    /// A compact table of each scenario's energy and change since the baseline, for pull request
+    /// comments
+    Markdown,
+}
+
+#[derive(ValueEnum, Clone, Copy, Debug)]
+pub enum ExportFormat {
+    Json,
+    Csv,
+    /// A JUnit test suite with a test case for each scenario, failing if it went over budget
+    Junit,
 }
 
 #[tokio::main]
@@ -57,16 +500,27 @@ async fn main() -> anyhow::Result<()> {
     let subscriber = tracing_subscriber::fmt().with_max_level(level).finish();
     tracing::subscriber::set_global_default(subscriber)?;
 
+    let global = config::Config::global_from_path(Path::new(
+        args.file.as_deref().unwrap_or("./cardamon.toml"),
+    ))?;
+    let units = args.units.over(global.units);
+    units.validate()?;
+    let project = args.project.clone().or(global.project.clone());
+
     match args.command {
         Commands::Run {
             name,
             pids,
             containers,
             external_only,
+            tags,
+            set,
+            label,
+            check,
+            baseline,
         } => {
             // set up local data access
-            let pool = create_db().await?;
-            let data_access_service = LocalDataAccessService::new(pool);
+            let data_access_service = open_database(global.database.as_ref()).await?;
 
             // open config file
             let path = match &args.file {
@@ -74,45 +528,1817 @@ async fn main() -> anyhow::Result<()> {
                 None => Path::new("./cardamon.toml"),
             };
 
-            // create an execution plan
-            let config = config::Config::from_path(path)?;
-            let mut execution_plan = if external_only {
-                config.create_execution_plan_external_only(&name)
-            } else {
-                config.create_execution_plan(&name)
-            }?;
+            let config = config::Config::from_path(path)?.with_project(project.clone());
+            let pids = pids
+                .unwrap_or(vec![])
+                .iter()
+                .map(|pid| pid.parse::<u32>())
+                .collect::<Result<Vec<_>, _>>()?;
+            let containers = containers.unwrap_or(vec![]);
+            let tags = config::TagFilter::new(&tags.unwrap_or(vec![]));
+            let variables = set
+                .iter()
+                .map(|assignment| template::parse_assignment(assignment))
+                .collect::<anyhow::Result<Vec<_>>>()?;
+
+            // run it!
+            let started = time::SystemTime::now()
+                .duration_since(time::UNIX_EPOCH)?
+                .as_millis() as i64;
+            let observation_dataset = run_observation(
+                &config,
+                &name,
+                &pids,
+                &containers,
+                external_only,
+                &tags,
+                &variables,
+                label.as_deref(),
+                &*data_access_service,
+            )
+            .await?;
+
+            print_observation_dataset(&config, &observation_dataset, &units);
+            print_endpoint_energy(started, &observation_dataset, &units, &*data_access_service)
+                .await?;
+
+            // uploaded before checking for regressions, so the reports of failing runs are kept
+            if let Some(storage) = &global.sync {
+                let destination = storage.destination()?;
+                for run in observation_dataset.runs().iter() {
+                    let synced = sync::sync(&run.run_id, &*data_access_service, &destination)
+                        .await
+                        .context(format!("Run {} was saved but not uploaded", run.run_id))?;
+                    println!(
+                        "Uploaded {} files of run {} to {}",
+                        synced.files, run.run_id, destination
+                    );
+                }
+            }
+            downsample_due(global.retention.as_ref(), &*data_access_service).await;
+
+            if check {
+                let baseline = baseline
+                    .or(config.regression_baseline.clone())
+                    .context("--check needs a baseline, set --baseline or regression_baseline")?;
+                check_regressions(&config, &baseline, started, &units, &*data_access_service)
+                    .await?;
+            }
+        }
+
+        Commands::Ab {
+            base,
+            candidate,
+            iterations,
+            external_only,
+            set,
+        } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
 
-            // add external processes to observe.
-            for pid in pids.unwrap_or(vec![]) {
-                let pid = pid.parse::<u32>()?;
-                execution_plan.observe_external_process(ProcessToObserve::Pid(None, pid));
+            let path = match &args.file {
+                Some(path) => Path::new(path),
+                None => Path::new("./cardamon.toml"),
+            };
+            let mut config = config::Config::from_path(path)?.with_project(project.clone());
+            let base = config.scenario_or_command("base", &base);
+            let candidate = config.scenario_or_command("candidate", &candidate);
+
+            let mut execution_plan =
+                config.create_ab_plan(&base, &candidate, iterations, external_only)?;
+            for assignment in set.iter() {
+                let (name, value) = template::parse_assignment(assignment)?;
+                execution_plan.set_variable(&name, &value);
+            }
+            let observation_dataset = run(execution_plan, &*data_access_service).await?;
+            print_comparison(&config, &observation_dataset, &base, &candidate, &units)?;
+        }
+
+        Commands::Observe {
+            duration,
+            name,
+            pids,
+            containers,
+            external_only,
+            set,
+        } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            let path = match &args.file {
+                Some(path) => Path::new(path),
+                None => Path::new("./cardamon.toml"),
+            };
+            let config = config::Config::from_path(path)?.with_project(project.clone());
+
+            let mut execution_plan = config.create_observe_plan(external_only);
+            for assignment in set.iter() {
+                let (name, value) = template::parse_assignment(assignment)?;
+                execution_plan.set_variable(&name, &value);
+            }
+            for pid in pids.unwrap_or(vec![]).iter() {
+                execution_plan.observe_external_process(ProcessToObserve::Pid(None, pid.parse()?));
             }
             for container_name in containers.unwrap_or(vec![]) {
                 execution_plan
                     .observe_external_process(ProcessToObserve::ContainerName(container_name));
             }
 
-            // run it!
-            let observation_dataset = run(execution_plan, &data_access_service).await?;
+            let observation_dataset =
+                observe(execution_plan, &name, duration, &*data_access_service).await?;
+            print_observation_dataset(&config, &observation_dataset, &units);
+        }
+
+        Commands::Pause => {
+            pause::request()?;
+            println!("Runs will pause once their current scenarios finish.");
+        }
+
+        Commands::Resume => {
+            if pause::release()? {
+                println!("Paused runs will carry on.");
+            } else {
+                println!("Nothing is paused.");
+            }
+        }
+
+        Commands::Attach { run, file, name } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            if data_access_service.run_dao().fetch(&run).await?.is_none() {
+                return Err(anyhow::anyhow!("Unable to find run {}", run));
+            }
+
+            let path = Path::new(&file);
+            let content = fs::read(path).context(format!("Unable to read file: {}", file))?;
+            let file_name = path
+                .file_name()
+                .map(|file_name| file_name.to_string_lossy().to_string())
+                .unwrap_or(file);
+            let name = name.unwrap_or(file_name.clone());
+            Artifact::validate_name(&name)?;
+            let created_at = time::SystemTime::now()
+                .duration_since(time::UNIX_EPOCH)?
+                .as_millis();
+
+            let artifact = Artifact::new(&run, &name, &file_name, content, created_at as i64);
+            data_access_service
+                .artifact_dao()
+                .persist(&artifact)
+                .await
+                .context(format!(
+                    "Run {} may already have an artifact named {}",
+                    run, name
+                ))?;
+            println!("Attached {} to run {} as {}", file_name, run, name);
+        }
+
+        Commands::Artifacts { run, extract } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            let artifacts = data_access_service
+                .artifact_dao()
+                .fetch_by_run(&run)
+                .await?;
+            if artifacts.is_empty() {
+                println!("Run {} has no artifacts.", run);
+            }
+
+            for artifact in artifacts.iter() {
+                println!(
+                    "{}: {} ({} bytes)",
+                    artifact.name,
+                    artifact.file_name,
+                    artifact.content.len()
+                );
+            }
+
+            if let Some(dir) = extract {
+                let dir = Path::new(&dir);
+                fs::create_dir_all(dir)?;
+                for artifact in artifacts.iter() {
+                    let path = dir.join(artifact.extracted_file_name()?);
+                    fs::write(&path, &artifact.content)
+                        .context(format!("Unable to write artifact to {}", path.display()))?;
+                    println!("Extracted {} to {}", artifact.name, path.display());
+                }
+            }
+        }
+
+        Commands::Annotate { run, note, label } => {
+            if note.is_none() && label.is_empty() {
+                return Err(anyhow::anyhow!("Pass a note or at least one --label"));
+            }
+            let labels = label
+                .iter()
+                .map(|label| template::parse_assignment(label))
+                .collect::<anyhow::Result<Vec<_>>>()?;
+
+            let data_access_service = open_database(global.database.as_ref()).await?;
+            let runs = data_access_service.run_dao().fetch_since(0).await?;
+            let run_id = regression::find_run(&runs, &run)
+                .map(|run| run.run_id.clone())
+                .context(format!("Unable to find run {}", run))?;
+            let created_at = time::SystemTime::now()
+                .duration_since(time::UNIX_EPOCH)?
+                .as_millis() as i64;
+            let annotation = Annotation::new(created_at, note.as_deref(), labels);
+
+            let annotated = data_access_service
+                .run_dao()
+                .fetch(&run_id)
+                .await?
+                .context(format!("Unable to find run {}", run_id))?
+                .with_annotation(annotation.clone())?;
+            data_access_service.run_dao().annotate(&annotated).await?;
+            println!("Annotated run {}: {}", run_id, annotation);
+        }
+
+        Commands::Logs {
+            run,
+            scenario,
+            iteration,
+        } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+            let runs = data_access_service.run_dao().fetch_since(0).await?;
+            let run_id = regression::find_run(&runs, &run)
+                .map(|run| run.run_id.clone())
+                .context(format!("Unable to find run {}", run))?;
+
+            let scenario_iterations = data_access_service
+                .scenario_iteration_dao()
+                .fetch_by_run(&run_id)
+                .await?
+                .into_iter()
+                .filter(|scenario_iteration| scenario_iteration.scenario_name == scenario)
+                .filter(|scenario_iteration| {
+                    iteration.map_or(true, |iteration| {
+                        scenario_iteration.iteration + 1 == iteration
+                    })
+                })
+                .sorted_by_key(|scenario_iteration| scenario_iteration.iteration)
+                .collect::<Vec<_>>();
+            if scenario_iterations.is_empty() {
+                return Err(anyhow::anyhow!(
+                    "Run {} has no iterations of scenario {}",
+                    run_id,
+                    scenario
+                ));
+            }
+            print_logs(&scenario_iterations);
+        }
+
+        Commands::Report {
+            run_id,
+            format,
+            html,
+            output,
+            baseline,
+        } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            let observation_dataset = data_access_service.fetch_run_dataset(&run_id).await?;
+            let run = observation_dataset.runs().first();
+            let blend = run.and_then(report::run_blend);
+            let (format, output) = match html {
+                Some(html) => (ReportFormat::Html, Some(html)),
+                None => (format, output),
+            };
+            let content = match format {
+                ReportFormat::Html => {
+                    let artifacts = data_access_service
+                        .artifact_dao()
+                        .fetch_by_run(&run_id)
+                        .await?;
+                    report::html(&observation_dataset, blend.as_ref(), &artifacts)
+                }
+                ReportFormat::Markdown => {
+                    let baseline = baseline.or(run
+                        .and_then(report::run_config)
+                        .and_then(|config| config.regression_baseline));
+                    let baseline_dataset = match baseline {
+                        Some(baseline) => {
+                            // the baseline is looked up in the project of the run
+                            let mut runs = data_access_service.run_dao().fetch_since(0).await?;
+                            runs.retain(|r| r.project == run.and_then(|run| run.project.clone()));
+                            let baseline_run =
+                                regression::find_baseline(&runs, &baseline, &[run_id.as_str()])
+                                    .context(format!("Unable to find baseline run {}", baseline))?;
+                            Some(
+                                data_access_service
+                                    .fetch_run_dataset(&baseline_run.run_id)
+                                    .await?,
+                            )
+                        }
+                        None => None,
+                    };
+                    report::markdown(
+                        &observation_dataset,
+                        blend.as_ref(),
+                        baseline_dataset.as_ref(),
+                    )
+                }
+            };
+            match output {
+                Some(output) => {
+                    fs::write(&output, content)
+                        .context(format!("Unable to write report to {}", output))?;
+                    println!("Wrote report of run {} to {}", run_id, output);
+                }
+                None => print!("{}", content),
+            }
+        }
+
+        Commands::Export {
+            run_id,
+            format,
+            raw,
+            output,
+        } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            let exported = if raw {
+                let run = data_access_service
+                    .run_dao()
+                    .fetch(&run_id)
+                    .await?
+                    .context(format!("Unable to find run {}", run_id))?;
+                let cpu_metrics = data_access_service
+                    .fetch_samples_within(&run_id, run.start_time, run.stop_time)
+                    .await?
+                    .cpu_metrics;
+                let scenario_iterations = data_access_service
+                    .scenario_iteration_dao()
+                    .fetch_by_run(&run_id)
+                    .await?;
+                let samples = export::raw_samples(&run, &cpu_metrics, &scenario_iterations);
+                match format {
+                    ExportFormat::Json => serde_json::to_string_pretty(&samples)?,
+                    ExportFormat::Csv => export::raw_csv(&samples),
+                    ExportFormat::Junit => {
+                        return Err(anyhow::anyhow!(
+                            "Raw samples can only be exported as JSON or CSV"
+                        ))
+                    }
+                }
+            } else {
+                let observation_dataset = data_access_service.fetch_run_dataset(&run_id).await?;
+                let blend = observation_dataset
+                    .runs()
+                    .first()
+                    .and_then(report::run_blend);
+                match format {
+                    ExportFormat::Json => {
+                        let export = export::export(&observation_dataset, blend.as_ref())
+                            .context(format!("Unable to find run {}", run_id))?;
+                        serde_json::to_string_pretty(&export)?
+                    }
+                    ExportFormat::Junit => {
+                        let export = export::export(&observation_dataset, blend.as_ref())
+                            .context(format!("Unable to find run {}", run_id))?;
+                        let budgets = observation_dataset
+                            .runs()
+                            .first()
+                            .map(junit::joule_budgets)
+                            .unwrap_or_default();
+                        junit::junit(&export, &budgets, &units)
+                    }
+                    ExportFormat::Csv => {
+                        return Err(anyhow::anyhow!(
+                            "Only raw samples can be exported as CSV, add --raw"
+                        ))
+                    }
+                }
+            };
+            match output {
+                Some(output) => fs::write(&output, exported)
+                    .context(format!("Unable to write export to {}", output))?,
+                None => println!("{}", exported.trim_end()),
+            }
+        }
+
+        Commands::Compare { run_a, run_b } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            let mut runs = data_access_service.run_dao().fetch_since(0).await?;
+            if let Some(project) = &project {
+                runs.retain(|run| run.project.as_ref() == Some(project));
+            }
+            let find = |run: &str| {
+                regression::find_run(&runs, run).context(format!("Unable to find run {}", run))
+            };
+            let (run_a, run_b) = (find(&run_a)?, find(&run_b)?);
+            let a = data_access_service.fetch_run_dataset(&run_a.run_id).await?;
+            let b = data_access_service.fetch_run_dataset(&run_b.run_id).await?;
+            print_run_comparison(run_a, run_b, &compare::compare(&a, &b), &units);
+        }
+
+        Commands::Badge {
+            scenario,
+            metric,
+            out,
+        } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            // the latest run and the one before it for the trend
+            let observation_dataset = data_access_service
+                .fetch_observation_dataset(vec![&scenario], project.as_deref(), 2)
+                .await?;
+            let scenario_datasets = observation_dataset.by_scenario();
+            let mut runs = scenario_datasets
+                .iter()
+                .flat_map(|scenario_dataset| scenario_dataset.by_run())
+                .collect::<Vec<_>>();
+            runs.sort_by_key(|run_dataset| run_dataset.run().map(|run| run.start_time));
+
+            let (metric, label) = match metric {
+                BadgeMetric::Energy => ("energy", format!("{scenario} energy")),
+                BadgeMetric::Carbon => ("emissions", format!("{scenario} CO2e")),
+            };
+            let (stats, unit, trend) = badge::latest(&runs, metric).context(format!(
+                "No {metric} of scenario {scenario} was saved, run it first"
+            ))?;
+            fs::write(&out, badge::svg(&label, stats.mean, unit, trend))
+                .context(format!("Unable to write badge to {}", out))?;
+            println!("Wrote badge of {} to {}", scenario, out);
+        }
+
+        Commands::GrafanaDashboard {
+            datasource_uid,
+            scenario,
+            output,
+        } => {
+            let scenarios = if scenario.is_empty() {
+                let path = match &args.file {
+                    Some(path) => Path::new(path),
+                    None => Path::new("./cardamon.toml"),
+                };
+                config::Config::from_path(path)?
+                    .scenarios
+                    .into_iter()
+                    .map(|scenario| scenario.name)
+                    .collect()
+            } else {
+                scenario
+            };
+            let title = match &project {
+                Some(project) => format!("Cardamon {}", project),
+                None => String::from("Cardamon"),
+            };
+            let dashboard =
+                grafana::dashboard(&title, &scenarios, &datasource_uid, project.as_deref());
+            let json = serde_json::to_string_pretty(&dashboard)?;
+            match output {
+                Some(output) => {
+                    fs::write(&output, json)
+                        .context(format!("Unable to write dashboard to {}", output))?;
+                    println!(
+                        "Wrote a dashboard of {} scenarios to {}",
+                        scenarios.len(),
+                        output
+                    );
+                }
+                None => println!("{}", json),
+            }
+        }
+
+        Commands::Trend { scenario, last } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            let observation_dataset = data_access_service
+                .fetch_observation_dataset(vec![&scenario], project.as_deref(), last)
+                .await?;
+            let scenario_datasets = observation_dataset.by_scenario();
+            let mut runs = scenario_datasets
+                .iter()
+                .flat_map(|scenario_dataset| scenario_dataset.by_run())
+                .collect::<Vec<_>>();
+            runs.sort_by_key(|run_dataset| run_dataset.run().map(|run| run.start_time));
+
+            let points = trend::points(&runs);
+            if points.is_empty() {
+                return Err(anyhow::anyhow!(
+                    "No energy of scenario {scenario} was saved, run it first"
+                ));
+            }
+            print_trend(&scenario, &points, &trend::breaks(&points), &units);
+        }
+
+        Commands::DiffConfig { run_id } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            let path = match &args.file {
+                Some(path) => Path::new(path),
+                None => Path::new("./cardamon.toml"),
+            };
+            let config = config::Config::from_path(path)?.with_project(project.clone());
+
+            let run = match &run_id {
+                Some(run_id) => data_access_service.run_dao().fetch(run_id).await?,
+                None => data_access_service
+                    .run_dao()
+                    .fetch_since(0)
+                    .await?
+                    .into_iter()
+                    .filter(|run| run.project == config.project)
+                    .max_by_key(|run| run.start_time),
+            };
+            let Some(run) = run else {
+                return Err(anyhow::anyhow!(
+                    "Unable to find a previous run to compare with."
+                ));
+            };
+            let Some(previous_config) = &run.config else {
+                return Err(anyhow::anyhow!(
+                    "Run {} has no stored config, it was recorded by an older version of cardamon.",
+                    run.run_id
+                ));
+            };
+
+            let changes = config_diff::diff(previous_config, &config.source)?;
+            println!("Comparing {} with run {}", path.display(), run.run_id);
+            println!("--------------------------------");
+            for change in changes.iter() {
+                let marker = if change.affects_measurement { "!" } else { " " };
+                println!(
+                    "{} {}: {} -> {}",
+                    marker,
+                    change.key,
+                    change.before.as_deref().unwrap_or("(unset)"),
+                    change.after.as_deref().unwrap_or("(unset)")
+                );
+            }
+
+            let methodology_changes = changes.iter().filter(|c| c.affects_measurement).count();
+            if changes.is_empty() {
+                println!("No changes.");
+            } else if methodology_changes == 0 {
+                println!(
+                    "Only cosmetic changes, results are comparable with run {}.",
+                    run.run_id
+                );
+            } else {
+                println!(
+                    "{} change(s) marked ! affect measurement, results will not be directly comparable with run {}.",
+                    methodology_changes, run.run_id
+                );
+            }
+        }
+
+        Commands::Agent {
+            bind,
+            port,
+            container_runtime,
+        } => {
+            agent::serve(&bind, port, container_runtime).await?;
+        }
+
+        Commands::Server { port } => {
+            let tokens = server::Tokens::from_config(global.server.as_ref())?;
+            println!("Serving runs on port {}", port);
+            if tokens.is_empty() {
+                println!("No tokens are configured, anyone who can reach the port can use it");
+            }
+            server::serve(port, create_db().await?, units, tokens).await?;
+        }
+
+        Commands::Ui { port } => {
+            let tokens = server::Tokens::from_config(global.server.as_ref())?;
+            println!("Serving the dashboard on http://localhost:{}", port);
+            server::serve_ui(port, create_db().await?, units, tokens).await?;
+        }
+
+        Commands::Push { run_id, to, token } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            let token = token.or_else(|| std::env::var("CARDAMON_TOKEN").ok());
+            let remote = RemoteDataAccessService::with_token(&to, token.as_deref())?;
+            let pushed = push::push(&run_id, &*data_access_service, &remote).await?;
+            println!(
+                "Pushed run {:?} to {}: {} iterations, {} samples, {} artifacts",
+                run_id, to, pushed.iterations, pushed.samples, pushed.artifacts
+            );
+        }
+
+        Commands::Sync { run, to } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            let destination = match to {
+                Some(to) => sync::Destination::parse(&to)?,
+                None => global
+                    .sync
+                    .as_ref()
+                    .context("Pass --to or set sync.to in the config")?
+                    .destination()?,
+            };
+            let run_ids = if run.is_empty() {
+                let runs = data_access_service.run_dao().fetch_since(0).await?;
+                let latest = runs
+                    .iter()
+                    .filter(|r| project.is_none() || r.project == project)
+                    .max_by_key(|r| r.start_time)
+                    .context("There are no runs to upload")?;
+                vec![latest.run_id.clone()]
+            } else {
+                run
+            };
+
+            for run_id in run_ids.iter() {
+                let synced = sync::sync(run_id, &*data_access_service, &destination).await?;
+                println!(
+                    "Uploaded {} files ({} bytes) of run {} to {}",
+                    synced.files, synced.bytes, run_id, destination
+                );
+            }
+        }
 
-            for scenario_dataset in observation_dataset.by_scenario().iter() {
-                println!("Scenario: {:?}", scenario_dataset.scenario_name());
-                println!("--------------------------------");
+        Commands::Prune {
+            keep_last,
+            older_than,
+            downsample_after,
+            delete_runs,
+            dry_run,
+        } => {
+            // limits given on the command line replace all of the configured ones
+            let configured = global.retention.clone().unwrap_or_default();
+            let (keep_last, older_than, downsample_after) =
+                match (keep_last, older_than, downsample_after) {
+                    (None, None, None) => (
+                        configured.keep_last,
+                        configured.older_than,
+                        configured.downsample_after,
+                    ),
+                    limits => limits,
+                };
+            let retention = config::Retention {
+                keep_last,
+                older_than,
+                keep_summaries: if delete_runs {
+                    Some(false)
+                } else {
+                    configured.keep_summaries
+                },
+                downsample_to: downsample_after.and(configured.downsample_to),
+                downsample_after,
+            };
+            retention.validate().context(
+                "Pass --keep-last, --older-than or --downsample-after, or set a [retention] policy.",
+            )?;
+
+            let data_access_service = open_database(global.database.as_ref()).await?;
+            let runs = data_access_service.run_dao().fetch_since(0).await?;
+            let now = chrono::Utc::now().timestamp_millis();
+            let expired = prune::expired(&runs, &retention, now);
+            let to_downsample = prune::to_downsample(&runs, &retention, now);
+            if dry_run {
+                for run in expired.iter() {
+                    println!(
+                        "{}\t{}",
+                        run.run_id,
+                        chrono::DateTime::from_timestamp_millis(run.start_time)
+                            .map(|start| start.format("%Y-%m-%d %H:%M").to_string())
+                            .unwrap_or_default()
+                    );
+                }
+                println!("{} of {} runs would be pruned", expired.len(), runs.len());
+                if retention.downsample_after.is_some() {
+                    println!(
+                        "{} of {} runs would be downsampled, unless they already are",
+                        to_downsample.len(),
+                        runs.len()
+                    );
+                }
+            } else {
+                let pruned = prune::prune(&expired, &retention, &*data_access_service).await?;
+                println!(
+                    "Pruned {} runs, deleting {} samples",
+                    pruned.runs, pruned.samples
+                );
+                if retention.downsample_after.is_some() {
+                    let downsampled =
+                        prune::downsample(&to_downsample, &retention, &*data_access_service)
+                            .await?;
+                    println!(
+                        "Downsampled {} runs, replacing {} samples with {} averages",
+                        downsampled.runs, downsampled.samples, downsampled.averages
+                    );
+                }
+            }
+        }
 
-                for run_dataset in scenario_dataset.by_run().iter() {
-                    println!("Run: {:?}", run_dataset.run_id());
+        Commands::Db {
+            command:
+                DbCommands::Export {
+                    out,
+                    run,
+                    label,
+                    commit,
+                    since,
+                },
+        } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
 
-                    for avged_dataset in run_dataset.averaged().iter() {
-                        println!("\t{:?}", avged_dataset);
+            let since = match since {
+                Some(since) => time::SystemTime::now()
+                    .checked_sub(since)
+                    .unwrap_or(time::UNIX_EPOCH)
+                    .duration_since(time::UNIX_EPOCH)?
+                    .as_millis() as i64,
+                None => 0,
+            };
+            let runs = data_access_service.run_dao().fetch_since(since).await?;
+            if let Some(missing) = run
+                .iter()
+                .find(|run_id| !runs.iter().any(|run| &run.run_id == *run_id))
+            {
+                return Err(anyhow::anyhow!("Unable to find run {}", missing));
+            }
+            let run_ids = runs
+                .iter()
+                .filter(|r| run.is_empty() || run.contains(&r.run_id))
+                .filter(|r| label.is_none() || r.label == label)
+                .filter(|r| project.is_none() || r.project == project)
+                .filter(|r| {
+                    commit.as_ref().map_or(true, |commit| {
+                        r.git().is_some_and(|git| git.is_commit(commit))
+                    })
+                })
+                .map(|r| r.run_id.as_str())
+                .collect::<Vec<_>>();
+
+            archive::export(Path::new(&out), &run_ids, &*data_access_service).await?;
+            println!("Exported {} runs to {}", run_ids.len(), out);
+        }
+
+        Commands::Db {
+            command: DbCommands::Import { file },
+        } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            let imported = archive::import(Path::new(&file), &*data_access_service).await?;
+            for run in imported.iter() {
+                match &run.imported_as {
+                    Some(run_id) if run_id == &run.run_id => println!("Imported run {}", run_id),
+                    Some(run_id) => {
+                        println!(
+                            "Imported run {} as {}, its id was taken",
+                            run.run_id, run_id
+                        )
                     }
+                    None => println!("Skipped run {}, it was already imported", run.run_id),
                 }
             }
         }
+
+        Commands::Schedule {
+            name,
+            external_only,
+            tags,
+            set,
+        } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            let path = match &args.file {
+                Some(path) => Path::new(path),
+                None => Path::new("./cardamon.toml"),
+            };
+            let config = config::Config::from_path(path)?.with_project(project.clone());
+            let schedule = config.schedule(&name)?;
+            let tags = config::TagFilter::new(&tags.unwrap_or(vec![]));
+            let variables = set
+                .iter()
+                .map(|assignment| template::parse_assignment(assignment))
+                .collect::<anyhow::Result<Vec<_>>>()?;
+
+            loop {
+                let now = chrono::Local::now();
+                let next = schedule
+                    .next_after(&now)
+                    .context(format!("The schedule of observation {name} never runs"))?;
+                println!("Next run of {name} at {}", next.format("%Y-%m-%d %H:%M"));
+                tokio::time::sleep((next - now).to_std()?).await;
+
+                // a failed run shouldn't stop the runs that follow it
+                match run_observation(
+                    &config,
+                    &name,
+                    &[],
+                    &[],
+                    external_only,
+                    &tags,
+                    &variables,
+                    None,
+                    &*data_access_service,
+                )
+                .await
+                {
+                    Ok(_) => println!("Finished run of {name}"),
+                    Err(err) => tracing::error!("Run of {name} failed\n{:?}", err),
+                }
+                downsample_due(global.retention.as_ref(), &*data_access_service).await;
+            }
+        }
+
+        Commands::Fleet {
+            since,
+            by,
+            carbon_intensity,
+        } => {
+            let data_access_service = open_database(global.database.as_ref()).await?;
+
+            let since = time::SystemTime::now()
+                .checked_sub(since)
+                .unwrap_or(time::UNIX_EPOCH)
+                .duration_since(time::UNIX_EPOCH)?
+                .as_millis();
+            let fleet_dataset = data_access_service
+                .fetch_fleet_dataset(since as i64, project.as_deref())
+                .await?;
+
+            let group_by = match by {
+                FleetGroup::Scenario => GroupBy::Scenario,
+                FleetGroup::Process => GroupBy::Process,
+            };
+            let entries = fleet_dataset.rollup(group_by);
+
+            println!("Fleet: {} runs", fleet_dataset.runs().len());
+            println!("--------------------------------");
+            for (rank, entry) in entries.iter().enumerate() {
+                print!(
+                    "{:>3}. {}: {}, {:.3} cpu-seconds over {} runs",
+                    rank + 1,
+                    entry.name,
+                    units.energy(entry.joules),
+                    entry.cpu_seconds,
+                    entry.runs
+                );
+                if let Some(carbon_intensity) = carbon_intensity {
+                    print!(", {}", units.carbon(entry.carbon_grams(carbon_intensity)));
+                }
+                println!();
+
+                if entry.runs_without_energy > 0 {
+                    println!(
+                        "     {} of these runs had no TDP, their energy is not included",
+                        entry.runs_without_energy
+                    );
+                }
+            }
+
+            let total_joules = entries.iter().map(|entry| entry.joules).sum::<f64>();
+            println!("--------------------------------");
+            print!("Total: {}", units.energy(total_joules));
+            if let Some(carbon_intensity) = carbon_intensity {
+                let total_carbon = entries
+                    .iter()
+                    .map(|entry| entry.carbon_grams(carbon_intensity))
+                    .sum::<f64>();
+                print!(", {}", units.carbon(total_carbon));
+            }
+            println!();
+        }
     }
 
     Ok(())
 }
 
+/// Prints the energy, carbon and reproducibility of every run in the dataset, scenario by
+/// scenario.
+///
+/// # Arguments
+///
+/// * `config` - The config the runs were started with
+/// * `observation_dataset` - The runs to report
+fn print_observation_dataset(
+    config: &config::Config,
+    observation_dataset: &ObservationDataset,
+    units: &Units,
+) {
+    let embodied = config.carbon.as_ref().and_then(|c| c.embodied.as_ref());
+    let mut run_costs = BTreeMap::<String, f64>::new();
+
+    for scenario_dataset in observation_dataset.by_scenario().iter() {
+        println!("Scenario: {:?}", scenario_dataset.scenario_name());
+        println!("--------------------------------");
+
+        for run_dataset in scenario_dataset.by_run().iter() {
+            println!("Run: {:?}", run_dataset.run_id());
+            // the intensity recorded when the run started, runs from before it was recorded
+            // use the configured one
+            let run = run_dataset.run();
+            let carbon_intensity = run.and_then(|run| {
+                run.carbon_intensity
+                    .zip(run.carbon_intensity_source.clone())
+                    .or_else(|| config.carbon.as_ref()?.static_intensity(run.start_time))
+            });
+            if let Some((intensity, source)) = &carbon_intensity {
+                println!(
+                    "\tcarbon intensity: {:.0} gCO2e/kWh ({})",
+                    intensity, source
+                );
+            }
+            let carbon_intensity = carbon_intensity.map(|(intensity, _)| intensity);
+            let pue = run
+                .and_then(|run| run.pue)
+                .or(config.carbon.as_ref().and_then(|c| c.pue));
+            if let (Some(pue), Some(_)) = (pue, carbon_intensity) {
+                println!("\tPUE: {:.2}, included in operational carbon", pue);
+            }
+            let over_budget = run_dataset
+                .by_iterations()
+                .iter()
+                .filter(|it| it.scenario_iteration().budget_exceeded)
+                .count();
+            if over_budget > 0 {
+                println!(
+                    "\tbudget exceeded: {} of {} iterations were stopped early",
+                    over_budget,
+                    run_dataset.by_iterations().len()
+                );
+            }
+            let cold_starts = run_dataset
+                .by_iterations()
+                .iter()
+                .filter(|it| it.scenario_iteration().cold_start)
+                .count();
+            if cold_starts > 0 {
+                println!(
+                    "\tcold starts: {} of {} iterations restarted the processes first",
+                    cold_starts,
+                    run_dataset.by_iterations().len()
+                );
+            }
+            if let Some(seed) = run_dataset.run().and_then(|run| run.shuffle_seed) {
+                println!("\tshuffled with seed {} (set shuffle_seed to repeat)", seed);
+            }
+            if let Some(environment) = run_dataset
+                .run()
+                .and_then(|run| run.environment.as_deref())
+                .and_then(|json| serde_json::from_str::<environment::Environment>(json).ok())
+            {
+                println!("\tenvironment: {}", environment);
+            }
+            if let Some(pauses) = run_dataset.run().and_then(|run| run.pauses.as_deref()) {
+                let pauses = pause::parse(pauses);
+                let paused = pauses
+                    .iter()
+                    .map(|pause| pause.duration())
+                    .sum::<time::Duration>();
+                println!(
+                    "\tpaused: {} times for {}",
+                    pauses.len(),
+                    humantime::format_duration(time::Duration::from_secs(paused.as_secs()))
+                );
+            }
+            if let Some(run) = run_dataset.run().filter(|run| run.retries > 0) {
+                println!(
+                    "\tretries: {} (only successful attempts are saved)",
+                    run.retries
+                );
+            }
+
+            let reproducibility =
+                reproducibility::score(run_dataset, run_dataset.has_power_metrics());
+            println!("\treproducibility: {}", reproducibility);
+            for factor in reproducibility.factors.iter().filter(|f| f.penalty > 0.0) {
+                println!(
+                    "\t\t-{:.0} {}: {}",
+                    factor.penalty, factor.name, factor.detail
+                );
+            }
+
+            let tdp = run_dataset.run().and_then(|run| run.tdp);
+            let baseline_watts = run_dataset.baseline_watts(tdp, config.blend.as_ref());
+            let iteration_secs = run_dataset.mean_iteration_secs();
+            let mut run_joules = None;
+            let mut run_idle_joules = None;
+            // spent outside the facility so PUE doesn't apply to it
+            let mut run_network_joules = 0.0;
+            let averaged = run_dataset.averaged();
+            for avged_dataset in averaged.iter() {
+                println!("\t{:?}", avged_dataset);
+                println!(
+                    "\t\tcpu: {:.2}% mean, {:.3} cpu-seconds",
+                    avged_dataset.cpu_usage_mean(),
+                    avged_dataset.cpu_seconds()
+                );
+
+                let estimated = avged_dataset.estimated_joules(tdp);
+                let machine = avged_dataset.measured_joules_for(PowerComponent::Machine.as_str());
+                let headline = avged_dataset.headline_component();
+                let energy = avged_dataset.energy(tdp, config.blend.as_ref());
+                match energy {
+                    Some(energy) => {
+                        println!("\t\tenergy: {}", energy.display(units));
+                        // reconcile the model against the measurement
+                        match (estimated, &energy) {
+                            (Some(estimated), energy::Energy::Measured { joules })
+                                if *joules > 0.0 =>
+                            {
+                                println!(
+                                    "\t\testimated energy: {} ({:.0}% of measured)",
+                                    units.energy(estimated),
+                                    estimated / joules * 100.0
+                                )
+                            }
+                            _ => {}
+                        }
+                        *run_joules.get_or_insert(0.0) += energy.joules();
+                        if let Some(intensity) = carbon_intensity {
+                            println!(
+                                "\t\toperational carbon: {}",
+                                units.carbon(carbon::operational_grams(
+                                    carbon::facility_joules(energy.joules(), pue),
+                                    intensity
+                                ))
+                            );
+                        }
+
+                        // what the scenario caused, rather than the process idling
+                        if let Some(watts) = baseline_watts.get(avged_dataset.process_id()) {
+                            let idle_joules = watts * iteration_secs;
+                            println!(
+                                "\t\tmarginal energy: {} ({:.3} W idle baseline)",
+                                units.energy(energy::marginal_joules(
+                                    energy.joules(),
+                                    *watts,
+                                    iteration_secs
+                                )),
+                                watts
+                            );
+                            *run_idle_joules.get_or_insert(0.0) += idle_joules;
+                        }
+                    }
+                    None => println!("\t\tenergy: unavailable (utilisation only)"),
+                }
+
+                // other components can only be measured, there's no model to blend with.
+                // They're a breakdown of the machine's energy if it was measured.
+                for (component, joules) in avged_dataset
+                    .measured_joules()
+                    .iter()
+                    .filter(|(component, _)| *component != headline.as_str())
+                {
+                    let energy = energy::Energy::Measured { joules: *joules };
+                    println!("\t\t{component} energy: {}", energy.display(units));
+                    if machine.is_some() {
+                        continue;
+                    }
+                    *run_joules.get_or_insert(0.0) += energy.joules();
+                    if let Some(intensity) = carbon_intensity {
+                        println!(
+                            "\t\t{component} operational carbon: {}",
+                            units.carbon(carbon::operational_grams(
+                                carbon::facility_joules(energy.joules(), pue),
+                                intensity
+                            ))
+                        );
+                    }
+                }
+
+                // network energy is spent outside the machine so it's never part of a
+                // machine measurement
+                if let Some(bytes) = avged_dataset.network_bytes() {
+                    let megabytes = bytes / 1_000_000.0;
+                    match &config.network {
+                        Some(network) => {
+                            let energy = energy::Energy::Estimated {
+                                joules: energy::network_joules(bytes, network.kwh_per_gb),
+                            };
+                            println!(
+                                "\t\tnetwork energy: {} ({:.3} MB transferred)",
+                                energy.display(units),
+                                megabytes
+                            );
+                            *run_joules.get_or_insert(0.0) += energy.joules();
+                            run_network_joules += energy.joules();
+                            if let Some(intensity) = carbon_intensity {
+                                println!(
+                                    "\t\tnetwork operational carbon: {}",
+                                    units.carbon(carbon::operational_grams(
+                                        energy.joules(),
+                                        intensity
+                                    ))
+                                );
+                            }
+                        }
+                        None => println!("\t\tnetwork: {:.3} MB transferred", megabytes),
+                    }
+                }
+
+                if let Some((bytes, ops)) = avged_dataset.disk_io() {
+                    let megabytes = bytes / 1_000_000.0;
+                    match &config.storage {
+                        Some(storage) => {
+                            let energy = energy::Energy::Estimated {
+                                joules: energy::storage_joules(bytes, ops, storage.coefficients()),
+                            };
+                            println!(
+                                "\t\tstorage energy: {} ({:.3} MB, {:.0} ops)",
+                                energy.display(units),
+                                megabytes,
+                                ops
+                            );
+                            // storage is part of a machine measurement
+                            if machine.is_none() {
+                                *run_joules.get_or_insert(0.0) += energy.joules();
+                                if let Some(intensity) = carbon_intensity {
+                                    println!(
+                                        "\t\tstorage operational carbon: {}",
+                                        units.carbon(carbon::operational_grams(
+                                            carbon::facility_joules(energy.joules(), pue),
+                                            intensity
+                                        ))
+                                    );
+                                }
+                            }
+                        }
+                        None => {
+                            println!("\t\tstorage: {:.3} MB, {:.0} ops", megabytes, ops)
+                        }
+                    }
+                }
+
+                // not part of the power model but explains differences between runs
+                if let Some(bytes) = avged_dataset.peak_memory_bytes() {
+                    println!("\t\tpeak memory: {:.3} MB", bytes / 1_000_000.0);
+                }
+                if let Some(secs) = avged_dataset.throttled_secs() {
+                    println!("\t\tcpu throttled: {:.3} s", secs);
+                }
+            }
+
+            // processes observed under the same name, e.g. the pods of a deployment,
+            // are also reported together
+            for (name, members) in dataset::by_process_name(&averaged)
+                .iter()
+                .filter(|(_, members)| members.len() > 1)
+            {
+                let cpu_seconds = members.iter().map(|m| m.cpu_seconds()).sum::<f64>();
+                let estimated = tdp.map(|tdp| {
+                    let share_seconds = members.iter().map(|m| m.cpu_share_seconds()).sum::<f64>();
+                    energy::estimate_joules(share_seconds, tdp)
+                });
+                let headline = if members.iter().any(|m| {
+                    m.measured_joules_for(PowerComponent::Machine.as_str())
+                        .is_some()
+                }) {
+                    PowerComponent::Machine
+                } else {
+                    PowerComponent::Cpu
+                };
+                let measured = members
+                    .iter()
+                    .filter_map(|m| m.measured_joules_for(headline.as_str()))
+                    .reduce(|a, b| a + b);
+                let energy = energy::combine(estimated, measured, config.blend.as_ref());
+                println!(
+                    "\t{} ({} processes): {:.3} cpu-seconds, energy: {}",
+                    name,
+                    members.len(),
+                    cpu_seconds,
+                    energy
+                        .map(|energy| energy.display(units))
+                        .unwrap_or(String::from("unavailable"))
+                );
+            }
+
+            // a single iteration is noisy, the spread shows how far it can be trusted
+            if let Some(stats) = run_dataset
+                .energy_stats(tdp, config.blend.as_ref(), config.outlier_threshold)
+                .filter(|stats| stats.iterations > 1)
+            {
+                println!(
+                    "\tenergy over {} iterations: {} mean, {} median, {} stddev ({:.1}%), {} min, {} max",
+                    stats.iterations,
+                    units.energy(stats.mean),
+                    units.energy(stats.median),
+                    units.energy(stats.stddev),
+                    stats.relative_stddev(),
+                    units.energy(stats.min),
+                    units.energy(stats.max)
+                );
+                println!(
+                    "\tenergy percentiles: {} p50, {} p90, {} p99",
+                    units.energy(stats.median),
+                    units.energy(stats.p90),
+                    units.energy(stats.p99)
+                );
+                if let Some(threshold) = config.outlier_threshold.filter(|_| stats.outliers > 0) {
+                    println!(
+                        "\texcluded {} outlier iterations from the energy: {}",
+                        stats.outliers,
+                        run_dataset
+                            .outlier_iterations(tdp, config.blend.as_ref(), threshold)
+                            .iter()
+                            .join(", ")
+                    );
+                }
+            }
+            if let Some(stats) = run_dataset
+                .duration_stats()
+                .filter(|stats| stats.iterations > 1)
+            {
+                println!(
+                    "\tduration percentiles: {:.3} s p50, {:.3} s p90, {:.3} s p99",
+                    stats.median, stats.p90, stats.p99
+                );
+            }
+
+            if let (Some(joules), Some(idle_joules)) = (run_joules, run_idle_joules) {
+                println!(
+                    "\tenergy: {} gross, {} marginal over the idle baseline",
+                    units.energy(joules),
+                    units.energy((joules - idle_joules).max(0.0))
+                );
+            }
+
+            if let Some(requests) = run_dataset.requests_per_iteration() {
+                match run_joules {
+                    Some(joules) if requests > 0.0 => println!(
+                        "\tenergy per request: {} ({} total over {} requests)",
+                        units.energy_per(joules / requests),
+                        units.energy(joules),
+                        requests
+                    ),
+                    _ => println!("\t{} requests replayed", requests),
+                }
+            }
+            if let Some(failed) = run_dataset
+                .failed_requests_per_iteration()
+                .filter(|failed| *failed > 0.0)
+            {
+                println!(
+                    "\t{} failed requests per iteration, left out of the energy per request",
+                    failed
+                );
+            }
+
+            // SCI is carbon per functional unit, e.g. per request, so it's comparable between
+            // scenarios and runs of any length
+            let functional_unit = config
+                .scenarios
+                .iter()
+                .find(|scenario| scenario.name == scenario_dataset.scenario_name())
+                .and_then(|scenario| scenario.functional_unit.as_ref());
+
+            // versions which do different amounts of work are compared by the energy of each unit
+            if let (Some(functional_unit), Some(joules), Some(work)) = (
+                functional_unit,
+                run_joules,
+                run_dataset
+                    .functional_units_per_iteration()
+                    .filter(|work| *work > 0.0),
+            ) {
+                let carbon = carbon_intensity
+                    .map(|intensity| {
+                        let joules = carbon::facility_joules(joules - run_network_joules, pue)
+                            + run_network_joules;
+                        carbon::operational_grams(joules, intensity) / work
+                    })
+                    .map(|grams| format!(", {}", units.carbon(grams)))
+                    .unwrap_or_default();
+                println!(
+                    "\tper {}: {}{} ({} per iteration)",
+                    functional_unit.name,
+                    units.energy_per(joules / work),
+                    carbon,
+                    work
+                );
+            }
+            if let (Some(functional_unit), Some(intensity), Some(joules), Some(work)) = (
+                functional_unit,
+                carbon_intensity,
+                run_joules,
+                run_dataset.functional_units_per_iteration(),
+            ) {
+                let wall_clock = time::Duration::from_secs_f64(run_dataset.mean_iteration_secs());
+                let joules =
+                    carbon::facility_joules(joules - run_network_joules, pue) + run_network_joules;
+                if let Some(sci) = carbon::sci(joules, intensity, embodied, wall_clock, work) {
+                    println!(
+                        "\tSCI: {} per {} ({} per iteration)",
+                        units.carbon(sci),
+                        functional_unit.name,
+                        work
+                    );
+                }
+            }
+
+            // embodied carbon is attributed to the hardware rather than any one process
+            // so it's reported once per run and kept apart from operational figures.
+            if let Some(embodied) = embodied {
+                let wall_clock = run_dataset.wall_clock();
+                let share = embodied
+                    .share
+                    .map(|share| format!(", {:.0}% of the hardware", share * 100.0))
+                    .unwrap_or_default();
+                println!(
+                    "\tembodied carbon: {} ({:.3}s of {} hardware lifetime{})",
+                    units.carbon(carbon::embodied_grams(embodied, wall_clock)),
+                    wall_clock.as_secs_f64(),
+                    humantime::format_duration(embodied.lifetime),
+                    share
+                );
+            }
+
+            // priced when each iteration started, so time-of-use tariffs are taken into account
+            if let Some(cost) = &config.cost {
+                let costs = run_dataset.iteration_costs(tdp, config.blend.as_ref(), pue, cost);
+                if !costs.is_empty() {
+                    let total = costs.iter().sum::<f64>();
+                    println!(
+                        "\tcost: {:.6} {currency} per iteration, {:.6} {currency} over {} iterations",
+                        total / costs.len() as f64,
+                        total,
+                        costs.len(),
+                        currency = cost.currency
+                    );
+                    *run_costs
+                        .entry(String::from(run_dataset.run_id()))
+                        .or_default() += total;
+                }
+            }
+
+            if tdp.is_none() {
+                let reason = run_dataset
+                    .run()
+                    .and_then(|run| run.energy_unavailable.as_deref())
+                    .unwrap_or("This run has no provenance recorded.");
+                println!("\tEnergy unavailable: {}", reason);
+            }
+        }
+    }
+
+    if let Some(cost) = &config.cost {
+        for (run_id, total) in run_costs.iter() {
+            println!(
+                "Run {:?} cost: {:.6} {} over every scenario",
+                run_id, total, cost.currency
+            );
+        }
+    }
+}
+
+/// Prints the paired difference between the base and the candidate of the latest A/B run.
+fn print_comparison(
+    config: &config::Config,
+    observation_dataset: &ObservationDataset,
+    base: &str,
+    candidate: &str,
+    units: &Units,
+) -> anyhow::Result<()> {
+    let scenario_datasets = observation_dataset.by_scenario();
+    let runs_of = |name: &str| {
+        scenario_datasets
+            .iter()
+            .find(|scenario_dataset| scenario_dataset.scenario_name() == name)
+            .map(|scenario_dataset| scenario_dataset.by_run())
+            .unwrap_or_default()
+    };
+    let base_runs = runs_of(base);
+    let candidate_runs = runs_of(candidate);
+
+    // the dataset includes previous runs, only the latest is compared
+    let base_run = base_runs
+        .iter()
+        .max_by_key(|run_dataset| run_dataset.run().map(|run| run.start_time))
+        .context(format!("No iterations of {base} were saved"))?;
+    let candidate_run = candidate_runs
+        .iter()
+        .find(|run_dataset| run_dataset.run_id() == base_run.run_id())
+        .context(format!("No iterations of {candidate} were saved"))?;
+
+    println!("A/B run: {:?}", base_run.run_id());
+    println!("--------------------------------");
+    let Some(comparison) = ab::compare(base_run, candidate_run, config.blend.as_ref()) else {
+        println!("\tenergy: unavailable (utilisation only)");
+        return Ok(());
+    };
+    println!(
+        "\tbase ({}): {} ± {}",
+        base,
+        units.energy(comparison.base.mean),
+        units.energy(comparison.base.stddev)
+    );
+    println!(
+        "\tcandidate ({}): {} ± {}",
+        candidate,
+        units.energy(comparison.candidate.mean),
+        units.energy(comparison.candidate.stddev)
+    );
+    println!(
+        "\tpaired difference: {} ({:+.1}%) over {} pairs",
+        units.difference(comparison.difference.mean, "J"),
+        comparison.relative_difference(),
+        comparison.difference.iterations
+    );
+    // the variance is in squared units so it's converted twice
+    let energy_unit = units.energy.from_joules(1.0);
+    println!(
+        "\tvariance: {:.3} {}², standard error: {}",
+        comparison.variance() * energy_unit * energy_unit,
+        units.energy.symbol(),
+        units.energy(comparison.standard_error())
+    );
+    if let Some(p_value) = comparison.p_value() {
+        println!("\tp-value: {:.3}", p_value);
+    }
+    if comparison.is_significant() {
+        println!("\tthe difference is larger than the noise between pairs");
+    } else {
+        println!("\tthe difference is within the noise between pairs, run more iterations");
+    }
+    Ok(())
+}
+
+/// Prints the output of each iteration of a scenario, stdout then stderr.
+fn print_logs(scenario_iterations: &[data_access::scenario_iteration::ScenarioIteration]) {
+    for scenario_iteration in scenario_iterations.iter() {
+        let exit = match scenario_iteration.exit_code {
+            Some(exit_code) if scenario_iteration.failed => format!("failed with {}", exit_code),
+            Some(exit_code) => format!("exited with {}", exit_code),
+            None if scenario_iteration.failed => String::from("failed or timed out"),
+            None if scenario_iteration.budget_exceeded => String::from("stopped over budget"),
+            None => String::from("no exit code"),
+        };
+        println!(
+            "{} iteration {} ({})",
+            scenario_iteration.scenario_name,
+            scenario_iteration.iteration + 1,
+            exit
+        );
+        println!("--------------------------------");
+        match (&scenario_iteration.stdout, &scenario_iteration.stderr) {
+            (None, None) => println!("No output was saved"),
+            (stdout, stderr) => {
+                for (name, output) in [("stdout", stdout), ("stderr", stderr)] {
+                    let output = output.as_deref().unwrap_or_default().trim_end();
+                    if !output.is_empty() {
+                        println!("[{}]\n{}", name, output);
+                    }
+                }
+            }
+        }
+        println!();
+    }
+}
+
+/// Prints what changed in each scenario between two runs.
+fn print_trend(scenario: &str, points: &[trend::Point], breaks: &[trend::Break], units: &Units) {
+    let means = points
+        .iter()
+        .map(|point| point.energy.mean)
+        .collect::<Vec<_>>();
+    println!("Trend of {:?} over {} runs", scenario, points.len());
+    println!("--------------------------------");
+    println!("\t{}", trend::sparkline(&means));
+    println!("--------------------------------");
+    for (index, point) in points.iter().enumerate() {
+        let started = chrono::DateTime::from_timestamp_millis(point.start_time)
+            .map(|start| start.format("%Y-%m-%d %H:%M").to_string())
+            .unwrap_or_default();
+        let label = point
+            .label
+            .as_deref()
+            .map(|label| format!(" ({label})"))
+            .unwrap_or_default();
+        let commit = point
+            .git
+            .as_ref()
+            .map(|git| format!(" {}", git.short_commit()))
+            .unwrap_or_default();
+        print!(
+            "\t{}  {}{}{}: {} ± {}",
+            started,
+            point.run_id,
+            commit,
+            label,
+            units.energy(point.energy.mean),
+            units.energy(point.energy.stddev)
+        );
+        if let Some(summary) = annotation::summary(&point.annotations) {
+            print!("  \"{}\"", summary);
+        }
+        match breaks.iter().find(|b| b.index == index) {
+            Some(b) => println!(
+                "  <- trend break, {} -> {} ({:+.1}%)",
+                units.energy(b.before),
+                units.energy(b.after),
+                b.change_pct()
+            ),
+            None => println!(),
+        }
+    }
+    println!("--------------------------------");
+    if breaks.is_empty() {
+        println!("No trend breaks, the energy of the scenario stayed at the same level.");
+    }
+}
+
+fn print_run_comparison(
+    run_a: &data_access::run::Run,
+    run_b: &data_access::run::Run,
+    comparisons: &[ScenarioComparison],
+    units: &Units,
+) {
+    println!(
+        "Comparing run {:?} with run {:?}",
+        run_a.run_id, run_b.run_id
+    );
+    for run in [run_a, run_b] {
+        for annotation in run.annotations().iter() {
+            println!("\t{}: {}", run.run_id, annotation);
+        }
+    }
+    println!("--------------------------------");
+    for comparison in comparisons.iter() {
+        match comparison {
+            ScenarioComparison::Both { scenario, changes } => {
+                println!("Scenario: {:?}", scenario);
+                for change in changes.iter() {
+                    let confidence = change
+                        .p_value()
+                        .zip(change.confidence_interval())
+                        .map(|(p_value, (low, high))| {
+                            format!(
+                                ", p = {:.3}, 95% CI [{}, {}]",
+                                p_value,
+                                units.difference(low, change.unit),
+                                units.difference(high, change.unit)
+                            )
+                        })
+                        .unwrap_or_default();
+                    println!(
+                        "\t{}: {} -> {}, {} ({:+.1}%){}, {}",
+                        change.metric,
+                        units.quantity(change.a.mean, change.unit),
+                        units.quantity(change.b.mean, change.unit),
+                        units.difference(change.difference(), change.unit),
+                        change.relative_difference(),
+                        confidence,
+                        if change.is_significant() {
+                            "significant"
+                        } else {
+                            "no significant change"
+                        }
+                    );
+                }
+                if changes
+                    .first()
+                    .map_or(true, |change| change.metric != "energy")
+                {
+                    println!("\tenergy: unavailable in one of the runs");
+                }
+            }
+            ScenarioComparison::OnlyInA(scenario) => {
+                println!("Scenario: {:?} only ran in {:?}", scenario, run_a.run_id)
+            }
+            ScenarioComparison::OnlyInB(scenario) => {
+                println!("Scenario: {:?} only ran in {:?}", scenario, run_b.run_id)
+            }
+        }
+    }
+    println!("--------------------------------");
+    println!(
+        "Changes are significant if Welch's t-test of the iterations gives p < {}, the CI is the range the true change is within with 95% confidence.",
+        significance::SIGNIFICANCE_LEVEL
+    );
+}
+
+/// Runs an observation once for every combination of its matrix.
+///
+/// # Arguments
+///
+/// * `config` - The config the observation is in
+/// * `name` - The name of the observation or scenario to run
+/// * `pids` - Externally started processes to observe
+/// * `containers` - Externally started containers to observe
+/// * `external_only` - Only observe external processes, don't start any
+/// * `tags` - Selects the scenarios to run
+/// * `variables` - Variables set on the command line
+/// * `data_access_service` - Where runs are saved
+///
+/// # Returns
+///
+/// The dataset of every combination that ran
+async fn run_observation(
+    config: &config::Config,
+    name: &str,
+    pids: &[u32],
+    containers: &[String],
+    external_only: bool,
+    tags: &config::TagFilter,
+    variables: &[(String, String)],
+    label: Option<&str>,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<ObservationDataset> {
+    let combinations = config.matrix_combinations(name);
+    let mut scenario_names = vec![];
+    let mut observation_dataset = None;
+    for env in combinations.iter() {
+        let mut execution_plan = if external_only {
+            config.create_execution_plan_external_only(name)
+        } else {
+            config.create_execution_plan(name)
+        }?;
+        execution_plan.filter_by_tags(tags)?;
+        if config.shuffle {
+            execution_plan.shuffle(config.shuffle_seed.unwrap_or_else(shuffle::seed));
+        }
+        execution_plan.apply_matrix(env.clone());
+        for (name, value) in variables.iter() {
+            execution_plan.set_variable(name, value);
+        }
+        execution_plan.label = label.map(String::from);
+
+        // add external processes to observe.
+        for pid in pids.iter() {
+            execution_plan.observe_external_process(ProcessToObserve::Pid(None, *pid));
+        }
+        for container_name in containers.iter() {
+            execution_plan
+                .observe_external_process(ProcessToObserve::ContainerName(container_name.clone()));
+        }
+        scenario_names.extend(
+            execution_plan
+                .scenario_names()
+                .into_iter()
+                .map(String::from),
+        );
+
+        observation_dataset = Some(run(execution_plan, data_access_service).await?);
+    }
+
+    // every combination is reported together so they can be compared
+    match observation_dataset {
+        Some(observation_dataset) if combinations.len() == 1 => Ok(observation_dataset),
+        _ => {
+            data_access_service
+                .fetch_observation_dataset(
+                    scenario_names.iter().map(String::as_str).collect(),
+                    config.project.as_deref(),
+                    3,
+                )
+                .await
+        }
+    }
+}
+
+/// Downsamples the runs which are due once a run has been saved, see
+/// [`prune::downsample_due`]. A failure is only logged, the run itself was saved.
+async fn downsample_due(
+    retention: Option<&config::Retention>,
+    data_access_service: &dyn DataAccessService,
+) {
+    let now = chrono::Utc::now().timestamp_millis();
+    match prune::downsample_due(retention, now, data_access_service).await {
+        Ok(downsampled) if downsampled.runs > 0 => println!(
+            "Downsampled {} runs, replacing {} samples with {} averages",
+            downsampled.runs, downsampled.samples, downsampled.averages
+        ),
+        Ok(_) => {}
+        Err(err) => tracing::warn!("Unable to downsample old runs\n{:?}", err),
+    }
+}
+
+/// Prints the energy per request of each route served by processes with an access log, for the
+/// runs started since `started`.
+async fn print_endpoint_energy(
+    started: i64,
+    observation_dataset: &ObservationDataset,
+    units: &Units,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<()> {
+    for run in observation_dataset
+        .runs()
+        .iter()
+        .filter(|run| run.start_time >= started)
+    {
+        let endpoint_energy = data_access_service
+            .endpoint_energy_dao()
+            .fetch_by_run(&run.run_id)
+            .await?;
+        if endpoint_energy.is_empty() {
+            continue;
+        }
+
+        println!("Energy per endpoint of run {:?}", run.run_id);
+        println!("--------------------------------");
+        let scenarios = endpoint_energy
+            .iter()
+            .map(|endpoint| endpoint.scenario_name.as_str())
+            .unique();
+        for scenario in scenarios {
+            println!("Scenario: {:?}", scenario);
+            let routes = access_log::summarise(&endpoint_energy, scenario);
+            let cheapest = routes
+                .iter()
+                .map(|route| route.joules_per_request())
+                .filter(|joules| *joules > 0.0)
+                .fold(f64::INFINITY, f64::min);
+            for route in routes.iter() {
+                let joules = route.joules_per_request();
+                print!(
+                    "\t{} {}: {} per request ({} requests)",
+                    route.process_name,
+                    route.route,
+                    units.energy(joules),
+                    route.requests
+                );
+                if cheapest.is_finite() && joules > cheapest {
+                    println!(", {:.1}x the cheapest route", joules / cheapest);
+                } else {
+                    println!();
+                }
+            }
+        }
+        println!("--------------------------------");
+    }
+    Ok(())
+}
+
+/// Compares the runs started since `started` against the baseline and fails if any scenario
+/// regressed by more than it allows, so a CI pipeline fails.
+///
+/// # Arguments
+///
+/// * `config` - The config with each scenario's max_regression_pct
+/// * `baseline` - The run id, label or commit of the baseline run, in the config's project
+/// * `started` - When the runs being checked started, in milliseconds since the unix epoch
+/// * `units` - The units energy is printed in
+/// * `data_access_service` - Where the runs are saved
+async fn check_regressions(
+    config: &config::Config,
+    baseline: &str,
+    started: i64,
+    units: &Units,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<()> {
+    let mut runs = data_access_service.run_dao().fetch_since(0).await?;
+    runs.retain(|run| run.project == config.project);
+    let checked = runs
+        .iter()
+        .filter(|run| run.start_time >= started)
+        .map(|run| run.run_id.as_str())
+        .collect::<Vec<_>>();
+    let baseline_run = regression::find_baseline(&runs, baseline, &checked)
+        .context(format!("Unable to find baseline run {}", baseline))?;
+    let baseline_dataset = data_access_service
+        .fetch_run_dataset(&baseline_run.run_id)
+        .await?;
+
+    println!("Checking against baseline run {:?}", baseline_run.run_id);
+    println!("--------------------------------");
+    let mut violations = vec![];
+    for run_id in checked.iter() {
+        let observation_dataset = data_access_service.fetch_run_dataset(run_id).await?;
+        violations.extend(regression::violations(
+            config,
+            &baseline_dataset,
+            &observation_dataset,
+        ));
+    }
+    for violation in violations.iter() {
+        println!(
+            "\t{}: {} -> {}, {:+.1}% is over its max regression of {}%",
+            violation.scenario,
+            units.energy(violation.baseline_joules),
+            units.energy(violation.joules),
+            violation.regression_pct,
+            violation.max_regression_pct
+        );
+    }
+    if violations.is_empty() {
+        println!("\tno scenario regressed by more than it allows");
+        Ok(())
+    } else {
+        Err(anyhow::anyhow!(
+            "{} scenarios regressed by more than they allow",
+            violations.len()
+        ))
+    }
+}
+
+/// Opens the database runs are saved to, the local cardamon.db unless the config has a database.
+async fn open_database(
+    database: Option<&config::Database>,
+) -> anyhow::Result<Box<dyn DataAccessService>> {
+    let Some(database) = database else {
+        return Ok(Box::new(LocalDataAccessService::new(create_db().await?)));
+    };
+    let url = database.url()?;
+    match config::DatabaseBackend::of(&url)? {
+        config::DatabaseBackend::Postgres => {
+            let pool = data_access::connect_postgres(&url, database.max_connections()).await?;
+            Ok(Box::new(PostgresDataAccessService::new(pool)))
+        }
+        config::DatabaseBackend::Sqlite => {
+            let pool = data_access::connect(&url).await?;
+            sqlx::migrate!().run(&pool).await?;
+            Ok(Box::new(LocalDataAccessService::new(pool)))
+        }
+    }
+}
+
 async fn create_db() -> anyhow::Result<SqlitePool> {
     let db_url = "sqlite://cardamon.db";
     if !sqlx::Sqlite::database_exists(db_url).await? {
@@ -9,12 +9,16 @@ use crate::data_access;
 #[derive(Debug)]
 pub struct MetricsLog {
     log: Vec<CpuMetrics>,
+    power_log: Vec<PowerMetrics>,
+    resource_log: Vec<ResourceMetrics>,
     err: Vec<anyhow::Error>,
 }
 impl MetricsLog {
     pub fn new() -> Self {
         Self {
             log: vec![],
+            power_log: vec![],
+            resource_log: vec![],
             err: vec![],
         }
     }
@@ -23,6 +27,14 @@ impl MetricsLog {
         self.log.push(metrics);
     }
 
+    pub fn push_power_metrics(&mut self, metrics: PowerMetrics) {
+        self.power_log.push(metrics);
+    }
+
+    pub fn push_resource_metrics(&mut self, metrics: ResourceMetrics) {
+        self.resource_log.push(metrics);
+    }
+
     pub fn push_error(&mut self, err: anyhow::Error) {
         self.err.push(err);
     }
@@ -31,6 +43,14 @@ impl MetricsLog {
         &self.log
     }
 
+    pub fn get_power_metrics(&self) -> &Vec<PowerMetrics> {
+        &self.power_log
+    }
+
+    pub fn get_resource_metrics(&self) -> &Vec<ResourceMetrics> {
+        &self.resource_log
+    }
+
     pub fn get_errors(&self) -> &Vec<anyhow::Error> {
         &self.err
     }
@@ -45,7 +65,7 @@ impl Default for MetricsLog {
     }
 }
 
-#[derive(Debug)]
+#[derive(Debug, Clone, serde::Deserialize, serde::Serialize)]
 pub struct CpuMetrics {
     pub process_id: String,
     pub process_name: String,
@@ -66,3 +86,133 @@ impl CpuMetrics {
         )
     }
 }
+
+/// The part of the machine a power measurement was taken from. Energy is reported separately for
+/// each component.
+#[derive(Debug, Clone, Copy, PartialEq, serde::Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum PowerComponent {
+    Cpu,
+    Gpu,
+    /// The Apple Neural Engine.
+    Ane,
+    /// Main memory, measured by the RAPL DRAM domain.
+    Dram,
+    /// The whole machine as measured at the wall or by the BMC, includes every other component.
+    Machine,
+}
+impl PowerComponent {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            PowerComponent::Cpu => "cpu",
+            PowerComponent::Gpu => "gpu",
+            PowerComponent::Ane => "ane",
+            PowerComponent::Dram => "dram",
+            PowerComponent::Machine => "machine",
+        }
+    }
+}
+
+#[derive(Debug)]
+pub struct PowerMetrics {
+    /// The power source and device the measurement was read from, e.g. `rapl:package-0`.
+    pub source: String,
+    pub component: PowerComponent,
+    /// The process this power has already been attributed to. None if the power was measured for
+    /// the whole device and still needs to be attributed.
+    pub process_id: Option<String>,
+    /// Mean power in watts since the previous measurement from the same source.
+    pub power: f64,
+    pub timestamp: i64,
+}
+impl PowerMetrics {
+    pub fn into_data_access(&self, run_id: &str) -> data_access::power_metrics::PowerMetrics {
+        data_access::power_metrics::PowerMetrics::new(
+            run_id,
+            &self.source,
+            self.component.as_str(),
+            self.process_id.as_deref(),
+            self.power,
+            self.timestamp,
+        )
+    }
+}
+
+/// Usage of resources other than the CPU, read from the same sample as a process's `CpuMetrics`.
+#[derive(Debug, Default, Clone, serde::Deserialize, serde::Serialize)]
+pub struct ResourceMetrics {
+    pub process_id: String,
+    /// Total bytes sent over the network, None if the process's traffic can't be separated from
+    /// the rest of the host's.
+    pub bytes_sent: Option<u64>,
+    /// Total bytes received over the network.
+    pub bytes_received: Option<u64>,
+    /// Total storage I/O, None if it couldn't be read for the process.
+    pub disk_io: Option<DiskIo>,
+    /// Memory in use by the process in bytes.
+    pub memory_bytes: Option<u64>,
+    /// Total memory of the host in bytes, memory energy is attributed by each process's share.
+    pub memory_total: Option<u64>,
+    /// CPU throttling counters, None if the process doesn't have a CPU quota of its own, e.g. it
+    /// isn't running in a container.
+    pub throttling: Option<Throttling>,
+    /// Percentage of an NVIDIA GPU's streaming multiprocessors the process kept busy, None if
+    /// the GPU isn't read with NVML.
+    pub gpu_utilisation: Option<f64>,
+    pub timestamp: i64,
+}
+impl ResourceMetrics {
+    pub fn into_data_access(&self, run_id: &str) -> data_access::resource_metrics::ResourceMetrics {
+        data_access::resource_metrics::ResourceMetrics {
+            bytes_sent: self.bytes_sent.map(|bytes| bytes as i64),
+            bytes_received: self.bytes_received.map(|bytes| bytes as i64),
+            read_bytes: self.disk_io.map(|io| io.read_bytes as i64),
+            write_bytes: self.disk_io.map(|io| io.write_bytes as i64),
+            read_ops: self.disk_io.map(|io| io.read_ops as i64),
+            write_ops: self.disk_io.map(|io| io.write_ops as i64),
+            memory_bytes: self.memory_bytes.map(|bytes| bytes as i64),
+            memory_total: self.memory_total.map(|bytes| bytes as i64),
+            cpu_periods: self.throttling.map(|t| t.periods as i64),
+            throttled_periods: self.throttling.map(|t| t.throttled_periods as i64),
+            throttled_ns: self.throttling.map(|t| t.throttled_ns as i64),
+            gpu_utilisation: self.gpu_utilisation,
+            ..data_access::resource_metrics::ResourceMetrics::new(
+                run_id,
+                &self.process_id,
+                self.timestamp,
+            )
+        }
+    }
+}
+
+/// Counters of the bytes and operations a process or container has read from and written to
+/// storage.
+#[derive(Debug, Default, Clone, Copy, PartialEq, serde::Deserialize, serde::Serialize)]
+pub struct DiskIo {
+    pub read_bytes: u64,
+    pub write_bytes: u64,
+    pub read_ops: u64,
+    pub write_ops: u64,
+}
+impl std::ops::Add for DiskIo {
+    type Output = DiskIo;
+
+    fn add(self, other: DiskIo) -> DiskIo {
+        DiskIo {
+            read_bytes: self.read_bytes + other.read_bytes,
+            write_bytes: self.write_bytes + other.write_bytes,
+            read_ops: self.read_ops + other.read_ops,
+            write_ops: self.write_ops + other.write_ops,
+        }
+    }
+}
+
+/// Counters of how often the CPU quota of a container was enforced. A container which is
+/// throttled takes longer to do the same work, so runs can use more energy without using more
+/// CPU.
+#[derive(Debug, Default, Clone, Copy, PartialEq, serde::Deserialize, serde::Serialize)]
+pub struct Throttling {
+    pub periods: u64,
+    pub throttled_periods: u64,
+    pub throttled_ns: u64,
+}
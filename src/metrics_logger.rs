@@ -4,18 +4,104 @@
  * file, You can obtain one at https://mozilla.org/MPL/2.0/.
  */
 
+pub mod agent;
 pub mod bare_metal;
+pub mod battery;
+pub mod board;
+pub mod cgroup;
+pub mod containerd;
 pub mod docker;
+pub mod ebpf;
+pub mod ipmi;
+pub mod k8s;
+pub mod kepler;
+pub mod meter;
+#[cfg(feature = "nvml")]
+pub mod nvml;
+pub mod pmic;
+pub mod port;
+pub mod powermetrics;
+pub mod prometheus;
+pub mod rapl;
+pub mod redfish;
+pub mod rocm;
+pub mod scope;
+pub mod ssh;
 
-use crate::{metrics::MetricsLog, ProcessToObserve};
-use itertools::Itertools;
-use std::sync::{Arc, Mutex};
+use crate::{
+    agent::Observe,
+    config::{
+        self, ContainerRuntime, ContainerStats, CpuAccounting, Host, MetricsSource, PowerSource,
+    },
+    k8s::Pod,
+    metrics::{CpuMetrics, MetricsLog, PowerMetrics, ResourceMetrics},
+    ProcessToObserve,
+};
+use std::{
+    collections::BTreeMap,
+    sync::{Arc, Mutex},
+    time::Duration,
+};
 use tokio::task::JoinSet;
 use tokio_util::sync::CancellationToken;
 
+/// Metrics read by a logger which can be pushed to the metrics log.
+pub trait Logged {
+    fn push_to(self, metrics_log: &mut MetricsLog);
+}
+impl Logged for CpuMetrics {
+    fn push_to(self, metrics_log: &mut MetricsLog) {
+        metrics_log.push_metrics(self);
+    }
+}
+impl Logged for PowerMetrics {
+    fn push_to(self, metrics_log: &mut MetricsLog) {
+        metrics_log.push_power_metrics(self);
+    }
+}
+impl Logged for ResourceMetrics {
+    fn push_to(self, metrics_log: &mut MetricsLog) {
+        metrics_log.push_resource_metrics(self);
+    }
+}
+impl<T: Logged> Logged for Vec<T> {
+    fn push_to(self, metrics_log: &mut MetricsLog) {
+        self.into_iter()
+            .for_each(|metrics| metrics.push_to(metrics_log));
+    }
+}
+impl<A: Logged, B: Logged> Logged for (A, B) {
+    fn push_to(self, metrics_log: &mut MetricsLog) {
+        self.0.push_to(metrics_log);
+        self.1.push_to(metrics_log);
+    }
+}
+
+/// Pushes the metrics a logger read, or the error it got reading them, to the metrics log.
+pub fn update_metrics_log<T: Logged>(
+    metrics: anyhow::Result<T>,
+    metrics_log: &Arc<Mutex<MetricsLog>>,
+) {
+    match metrics {
+        Ok(metrics) => metrics.push_to(
+            &mut metrics_log
+                .lock()
+                .expect("Should be able to acquire lock on metrics log"),
+        ),
+        Err(error) => push_error(error, metrics_log),
+    }
+}
+
+pub fn push_error(error: anyhow::Error, metrics_log: &Arc<Mutex<MetricsLog>>) {
+    metrics_log
+        .lock()
+        .expect("Should be able to acquire lock on metrics err")
+        .push_error(error)
+}
+
 pub struct StopHandle {
     token: CancellationToken,
-    join_set: JoinSet<()>,
+    join_set: Mutex<JoinSet<()>>,
     shared_metrics_log: Arc<Mutex<MetricsLog>>,
 }
 impl StopHandle {
@@ -26,16 +112,55 @@ impl StopHandle {
     ) -> Self {
         Self {
             token,
-            join_set,
+            join_set: Mutex::new(join_set),
             shared_metrics_log,
         }
     }
 
-    pub async fn stop(mut self) -> anyhow::Result<MetricsLog> {
+    /// Starts logging a cgroup created after the loggers started, e.g. the cgroup a scenario's
+    /// command runs in. It's logged to the same log until the loggers are stopped.
+    pub fn observe_scope(&self, scope: scope::Scope, sample_interval: Duration) {
+        let token = self.token.clone();
+        let shared_metrics_log = self.shared_metrics_log.clone();
+        self.join_set
+            .lock()
+            .expect("Should be able to acquire lock on loggers")
+            .spawn(async move {
+                tracing::info!("Logging cgroup: {:?} every {:?}", scope, sample_interval);
+                tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = scope::keep_logging(vec![scope], sample_interval, shared_metrics_log) => {}
+                }
+            });
+    }
+
+    /// Takes everything logged so far without stopping the loggers.
+    pub fn drain(&self) -> MetricsLog {
+        std::mem::take(
+            &mut *self
+                .shared_metrics_log
+                .lock()
+                .expect("Should be able to acquire lock on metrics log"),
+        )
+    }
+
+    /// Looks at everything logged so far without taking it or stopping the loggers.
+    pub fn with_log<T>(&self, f: impl FnOnce(&MetricsLog) -> T) -> T {
+        f(&self
+            .shared_metrics_log
+            .lock()
+            .expect("Should be able to acquire lock on metrics log"))
+    }
+
+    pub async fn stop(self) -> anyhow::Result<MetricsLog> {
         // cancel loggers
         self.token.cancel();
+        let mut join_set = self
+            .join_set
+            .into_inner()
+            .expect("Should be able to take ownership of loggers");
         loop {
-            if self.join_set.join_next().await.is_none() {
+            if join_set.join_next().await.is_none() {
                 break;
             }
         }
@@ -57,63 +182,314 @@ impl StopHandle {
     }
 }
 
+/// The processes sampled at the same interval, each kind of process shares a logger.
+#[derive(Default)]
+struct ProcessGroup {
+    pids: Vec<u32>,
+    name_patterns: Vec<String>,
+    ports: Vec<u16>,
+    container_names: Vec<String>,
+    compose_projects: Vec<String>,
+    pods: Vec<Pod>,
+    scopes: Vec<scope::Scope>,
+}
+
 /// Logs a single scenario run
 ///
 /// # Arguments
 ///
-/// * `processes` - The processes you wish to observe during the scenario run
+/// * `processes` - The processes you wish to observe during the scenario run, along with how
+/// often each is sampled
+/// * `power_sources` - The power sources to read during the scenario run
+/// * `metrics_sources` - Other sources of metrics to read during the scenario run
+/// * `hosts` - Hosts to observe processes on over SSH
+/// * `container_runtime` - The runtime the observed containers are running in
+/// * `container_stats` - Where the CPU usage of the observed containers is read from
+/// * `cpu_accounting` - How the CPU usage of the observed baremetal processes is measured
 ///
 /// # Returns
 ///
 /// A `Result` containing the metrics log for the given scenario or an `Error` if either
 /// the scenario failed to complete successfully or any of the loggers contained errors.
-pub fn start_logging(processes_to_observe: &[ProcessToObserve]) -> anyhow::Result<StopHandle> {
+pub fn start_logging(
+    processes_to_observe: &[(ProcessToObserve, Duration)],
+    power_sources: &[PowerSource],
+    metrics_sources: &[MetricsSource],
+    hosts: &[Host],
+    container_runtime: ContainerRuntime,
+    container_stats: ContainerStats,
+    cpu_accounting: CpuAccounting,
+) -> anyhow::Result<StopHandle> {
     let metrics_log = MetricsLog::new();
     let metrics_log_mutex = Mutex::new(metrics_log);
     let shared_metrics_log = Arc::new(metrics_log_mutex);
 
-    // split processes into bare metal & docker processes
-    let (pids, container_names): (Vec<_>, Vec<_>) =
-        processes_to_observe
-            .iter()
-            .partition_map(|proc| match proc {
-                ProcessToObserve::Pid(_, id) => itertools::Either::Left(id),
-                ProcessToObserve::ContainerName(name) => itertools::Either::Right(name.clone()),
-            });
+    // split processes into bare metal, docker & kubernetes processes, processes sampled at
+    // different intervals need loggers of their own
+    let mut groups: BTreeMap<Duration, ProcessGroup> = BTreeMap::new();
+    for (proc, sample_interval) in processes_to_observe.iter() {
+        let group = groups.entry(*sample_interval).or_default();
+        match proc {
+            ProcessToObserve::Pid(_, id) => group.pids.push(*id),
+            ProcessToObserve::Cgroup(scope) => group.scopes.push(scope.clone()),
+            ProcessToObserve::NameMatch(pattern) => group.name_patterns.push(pattern.clone()),
+            ProcessToObserve::PortMatch(port) => group.ports.push(*port),
+            ProcessToObserve::ContainerName(name) => group.container_names.push(name.clone()),
+            ProcessToObserve::ComposeProject(project) => {
+                group.compose_projects.push(project.clone())
+            }
+            ProcessToObserve::Pod(pod) => group.pods.push(pod.clone()),
+        }
+    }
+    let pids = groups
+        .values()
+        .flat_map(|group| {
+            let scopes = group.scopes.iter().map(|scope| scope.pid);
+            group.pids.iter().copied().chain(scopes)
+        })
+        .collect::<Vec<_>>();
 
     // create a new cancellation token
     let token = CancellationToken::new();
 
     // start threads to collect metrics
     let mut join_set = JoinSet::new();
-    if !pids.is_empty() {
+    for (sample_interval, group) in groups.into_iter() {
+        let ProcessGroup {
+            pids,
+            name_patterns,
+            ports,
+            container_names,
+            compose_projects,
+            pods,
+            scopes,
+        } = group;
+
+        if !pids.is_empty() || !name_patterns.is_empty() || !ports.is_empty() {
+            let token = token.clone();
+            let shared_metrics_log = shared_metrics_log.clone();
+
+            join_set.spawn(async move {
+                tracing::info!(
+                    "Logging PIDs: {:?}, names matching: {:?}, listening on ports: {:?} every {:?}",
+                    pids,
+                    name_patterns,
+                    ports,
+                    sample_interval
+                );
+                tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = bare_metal::keep_logging(
+                            pids,
+                            name_patterns,
+                            ports,
+                            cpu_accounting,
+                            sample_interval,
+                            shared_metrics_log,
+                        ) => {}
+                }
+            });
+        }
+
+        if !container_names.is_empty() || !compose_projects.is_empty() {
+            let token = token.clone();
+            let shared_metrics_log = shared_metrics_log.clone();
+
+            join_set.spawn(async move {
+                tracing::info!(
+                    "Logging containers: {:?}, compose projects: {:?} every {:?}",
+                    container_names,
+                    compose_projects,
+                    sample_interval
+                );
+                match container_runtime {
+                    ContainerRuntime::Containerd => tokio::select! {
+                        _ = token.cancelled() => {}
+                        _ = containerd::keep_logging(
+                                container_names,
+                                compose_projects,
+                                sample_interval,
+                                shared_metrics_log,
+                            ) => {}
+                    },
+                    runtime => tokio::select! {
+                        _ = token.cancelled() => {}
+                        _ = docker::keep_logging(
+                                runtime,
+                                container_stats,
+                                container_names,
+                                compose_projects,
+                                sample_interval,
+                                shared_metrics_log,
+                            ) => {}
+                    },
+                }
+            });
+        }
+
+        if !pods.is_empty() {
+            let token = token.clone();
+            let shared_metrics_log = shared_metrics_log.clone();
+
+            join_set.spawn(async move {
+                tracing::info!("Logging pods: {:?} every {:?}", pods, sample_interval);
+                tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = k8s::keep_logging(pods, sample_interval, shared_metrics_log) => {}
+                }
+            });
+        }
+
+        if !scopes.is_empty() {
+            let token = token.clone();
+            let shared_metrics_log = shared_metrics_log.clone();
+
+            join_set.spawn(async move {
+                tracing::info!("Logging cgroups: {:?} every {:?}", scopes, sample_interval);
+                tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = scope::keep_logging(scopes, sample_interval, shared_metrics_log) => {}
+                }
+            });
+        }
+    }
+
+    for power_source in power_sources.iter().cloned() {
+        let pids = pids.clone();
         let token = token.clone();
         let shared_metrics_log = shared_metrics_log.clone();
 
         join_set.spawn(async move {
-            tracing::info!("Logging PIDs: {:?}", pids);
-            tokio::select! {
-                _ = token.cancelled() => {}
-                _ = bare_metal::keep_logging(
-                        pids,
-                        shared_metrics_log,
-                    ) => {}
+            tracing::info!("Reading power source: {:?}", power_source);
+            match power_source {
+                PowerSource::Rapl { interface } => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = rapl::keep_logging(interface, shared_metrics_log) => {}
+                },
+                #[cfg(feature = "nvml")]
+                PowerSource::Nvml => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = nvml::keep_logging(pids, shared_metrics_log) => {}
+                },
+                #[cfg(not(feature = "nvml"))]
+                PowerSource::Nvml => shared_metrics_log
+                    .lock()
+                    .expect("Should be able to acquire lock on metrics log")
+                    .push_error(anyhow::anyhow!(
+                        "Cardamon was built without NVML support, rebuild it with the nvml feature"
+                    )),
+                PowerSource::Rocm { interface } => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = rocm::keep_logging(interface, pids, shared_metrics_log) => {}
+                },
+                PowerSource::Powermetrics => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = powermetrics::keep_logging(shared_metrics_log) => {}
+                },
+                PowerSource::Ipmi {
+                    host,
+                    username,
+                    password,
+                } => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = ipmi::keep_logging(host, username, password, shared_metrics_log) => {}
+                },
+                PowerSource::Redfish {
+                    url,
+                    username,
+                    password,
+                    chassis,
+                    insecure,
+                } => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = redfish::keep_logging(
+                            url,
+                            username,
+                            password,
+                            chassis,
+                            insecure,
+                            shared_metrics_log,
+                        ) => {}
+                },
+                PowerSource::Meter { device, host } => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = meter::keep_logging(device, host, shared_metrics_log) => {}
+                },
+                PowerSource::Kepler {
+                    url,
+                    namespace,
+                    pod,
+                } => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = kepler::keep_logging(url, namespace, pod, shared_metrics_log) => {}
+                },
+                PowerSource::Board { model } => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = board::keep_logging(model, shared_metrics_log) => {}
+                },
+                PowerSource::Pmic => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = pmic::keep_logging(shared_metrics_log) => {}
+                },
+                PowerSource::Battery => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = battery::keep_logging(shared_metrics_log) => {}
+                },
+            }
+        });
+    }
+
+    for metrics_source in metrics_sources.iter().cloned() {
+        let token = token.clone();
+        let shared_metrics_log = shared_metrics_log.clone();
+
+        join_set.spawn(async move {
+            tracing::info!("Reading metrics source: {:?}", metrics_source);
+            match metrics_source {
+                MetricsSource::Prometheus { url, queries } => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = prometheus::keep_logging(url, queries, shared_metrics_log) => {}
+                },
+                MetricsSource::Agent {
+                    host,
+                    url,
+                    names,
+                    ports,
+                    containers,
+                    sample_interval_ms,
+                } => tokio::select! {
+                    _ = token.cancelled() => {}
+                    _ = agent::keep_logging(
+                            host,
+                            url,
+                            Observe {
+                                names,
+                                ports,
+                                containers,
+                                sample_interval_ms: sample_interval_ms
+                                    .unwrap_or(config::DEFAULT_SAMPLE_INTERVAL_MS),
+                            },
+                            shared_metrics_log,
+                        ) => {}
+                },
             }
         });
     }
 
-    if !container_names.is_empty() {
+    for host in hosts.iter().cloned() {
         let token = token.clone();
         let shared_metrics_log = shared_metrics_log.clone();
 
         join_set.spawn(async move {
-            tracing::info!("Logging containers: {:?}", container_names);
+            tracing::info!(
+                "Logging processes {:?} on {} over ssh",
+                host.processes,
+                host.ssh
+            );
+            let sample_interval = host.sample_interval();
             tokio::select! {
                 _ = token.cancelled() => {}
-                _ = docker::keep_logging(
-                        container_names,
-                        shared_metrics_log,
-                    ) => {}
+                _ = ssh::keep_logging(host, sample_interval, shared_metrics_log) => {}
             }
         });
     }
@@ -0,0 +1,108 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{push_error, update_metrics_log, Logged};
+use crate::{
+    agent::{Batch, Observe},
+    metrics::MetricsLog,
+};
+use anyhow::{anyhow, Context};
+use std::sync::{Arc, Mutex};
+use tokio::time::Duration;
+
+/// Enters an infinite loop draining the metrics a `cardamon agent` logs on another host into the
+/// metrics log. The agent is told which processes to observe when logging starts, every process
+/// it observes is prefixed with the host so they can be told apart from local processes.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `host` - The name of the host the agent is running on
+/// * `url` - The base url of the agent
+/// * `observe` - The processes the agent should observe
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(
+    host: String,
+    url: String,
+    observe: Observe,
+    metrics_log: Arc<Mutex<MetricsLog>>,
+) {
+    let client = reqwest::Client::new();
+    let base_url = url.strip_suffix('/').unwrap_or(&url);
+    if let Err(err) = start(&client, base_url, &observe).await {
+        push_error(err.context(format!("Agent {host}")), &metrics_log);
+        return;
+    }
+
+    let sample_interval = Duration::from_millis(observe.sample_interval_ms);
+    loop {
+        tokio::time::sleep(sample_interval).await;
+        let batch = drain(&client, base_url)
+            .await
+            .map(|batch| batch.keyed_by(&host))
+            .map_err(|err| err.context(format!("Agent {host}")));
+        update_metrics_log(batch, &metrics_log);
+    }
+}
+
+impl Logged for Batch {
+    fn push_to(self, metrics_log: &mut MetricsLog) {
+        self.cpu_metrics.push_to(metrics_log);
+        self.resource_metrics.push_to(metrics_log);
+        self.errors
+            .into_iter()
+            .for_each(|err| metrics_log.push_error(anyhow!(err)));
+    }
+}
+
+async fn start(client: &reqwest::Client, base_url: &str, observe: &Observe) -> anyhow::Result<()> {
+    client
+        .post(format!("{base_url}/observe"))
+        .json(observe)
+        .send()
+        .await
+        .context("Unable to reach agent")?
+        .error_for_status()
+        .map(|_| ())
+        .context("Agent is unable to observe processes")
+}
+
+async fn drain(client: &reqwest::Client, base_url: &str) -> anyhow::Result<Batch> {
+    client
+        .get(format!("{base_url}/metrics"))
+        .send()
+        .await
+        .context("Unable to reach agent")?
+        .json::<Batch>()
+        .await
+        .context("Unexpected response from agent")
+}
+
+/// Tells an agent to stop observing once cardamon has finished with it.
+///
+/// # Arguments
+///
+/// * `url` - The base url of the agent
+pub async fn stop(url: &str) -> anyhow::Result<()> {
+    let base_url = url.strip_suffix('/').unwrap_or(url);
+    reqwest::Client::new()
+        .post(format!("{base_url}/stop"))
+        .send()
+        .await
+        .context("Unable to reach agent")?
+        .error_for_status()
+        .map(|_| ())
+        .context("Agent is unable to stop observing")
+}
@@ -4,10 +4,21 @@
  * file, You can obtain one at https://mozilla.org/MPL/2.0/.
  */
 
-use crate::metrics::{CpuMetrics, MetricsLog};
-use std::sync::{Arc, Mutex};
-use sysinfo::{Pid, System};
-use tokio::time::Duration;
+use super::{
+    ebpf::{CpuTimes, EbpfSampler},
+    port, push_error, update_metrics_log,
+};
+use crate::{
+    config::CpuAccounting,
+    metrics::{CpuMetrics, DiskIo, MetricsLog, ResourceMetrics},
+};
+use regex::Regex;
+use std::{
+    collections::{HashMap, HashSet},
+    sync::{Arc, Mutex},
+};
+use sysinfo::{Pid, Process, System};
+use tokio::time::{Duration, Instant};
 
 /// Enters an infinite loop logging metrics for each process to the metrics log. This function is
 /// intended to be called from `metrics_logger::log_scenario` or `metrics_logger::log_live`
@@ -20,43 +31,162 @@ use tokio::time::Duration;
 /// # Arguments
 ///
 /// * `pids` - The process ids to observe
+/// * `name_patterns` - Regexes matched against the names of running processes, every matching
+/// process is observed. They're matched every sample so restarted processes are picked up.
+/// * `ports` - TCP ports, the process listening on each is observed. The listener is looked up
+/// again whenever it exits.
+/// * `cpu_accounting` - How the CPU time of the processes is measured
+/// * `sample_interval` - How long to wait between samples
 /// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
 /// flush this shared log.
 ///
 /// # Returns
 ///
 /// This function does not return, it requires that it's thread is cancelled.
-pub async fn keep_logging(pids: Vec<u32>, metrics_log: Arc<Mutex<MetricsLog>>) {
+pub async fn keep_logging(
+    pids: Vec<u32>,
+    name_patterns: Vec<String>,
+    ports: Vec<u16>,
+    cpu_accounting: CpuAccounting,
+    sample_interval: Duration,
+    metrics_log: Arc<Mutex<MetricsLog>>,
+) {
     let mut system = System::new_all();
+    let mut descendants: HashMap<u32, HashSet<Pid>> = HashMap::new();
+    let mut listeners: HashMap<u16, u32> = HashMap::new();
+
+    let mut sampler = match cpu_accounting {
+        CpuAccounting::Proc => None,
+        CpuAccounting::Ebpf => match EbpfSampler::start() {
+            Ok(sampler) => Some(sampler),
+            Err(err) => {
+                push_error(err, &metrics_log);
+                None
+            }
+        },
+    };
+    let mut sampled_at = Instant::now();
+
+    let mut name_regexes = vec![];
+    for pattern in name_patterns.iter() {
+        match Regex::new(pattern) {
+            Ok(regex) => name_regexes.push(regex),
+            Err(err) => push_error(
+                anyhow::anyhow!("Invalid process name pattern {pattern}: {err}"),
+                &metrics_log,
+            ),
+        }
+    }
 
     loop {
-        tokio::time::sleep(Duration::from_millis(1000)).await;
+        tokio::time::sleep(sample_interval).await;
+        system.refresh_all();
+
+        let mut pids = pids.clone();
+        for regex in name_regexes.iter() {
+            let matches = matching_roots(&system, regex);
+            if matches.is_empty() {
+                tracing::warn!("No running processes match {}", regex);
+            }
+            pids.extend(
+                matches
+                    .into_iter()
+                    .filter(|pid| !pids.contains(pid))
+                    .collect::<Vec<_>>(),
+            );
+        }
+
+        for port in ports.iter() {
+            match listener(&system, *port, &mut listeners) {
+                Ok(Some(pid)) if !pids.contains(&pid) => pids.push(pid),
+                Ok(Some(_)) => {}
+                Ok(None) => tracing::warn!("No process is listening on port {}", port),
+                Err(err) => push_error(err, &metrics_log),
+            }
+        }
+
+        let cpu_times = match sampler.as_mut().map(|sampler| sampler.take()) {
+            Some(Ok(cpu_times)) => Some(cpu_times),
+            Some(Err(err)) => {
+                push_error(err, &metrics_log);
+                continue;
+            }
+            None => None,
+        };
+        let wall_time = sampled_at.elapsed();
+        sampled_at = Instant::now();
+
         for pid in pids.iter() {
-            let metrics = get_metrics(&mut system, *pid).await;
+            let metrics = measure(
+                &system,
+                *pid,
+                descendants.entry(*pid).or_default(),
+                cpu_times.as_ref().map(|cpu_times| (cpu_times, wall_time)),
+            );
+            if let Ok(metrics) = &metrics {
+                let resource_metrics = ResourceMetrics {
+                    process_id: metrics.process_id.clone(),
+                    disk_io: disk_io(*pid, &descendants[pid]),
+                    memory_bytes: memory_bytes(&system, *pid, &descendants[pid]),
+                    memory_total: Some(system.total_memory()),
+                    timestamp: metrics.timestamp,
+                    ..Default::default()
+                };
+                metrics_log
+                    .lock()
+                    .expect("Should be able to acquire lock on metrics log")
+                    .push_resource_metrics(resource_metrics);
+            }
             update_metrics_log(metrics, &metrics_log);
         }
     }
 }
 
-fn update_metrics_log(metrics: anyhow::Result<CpuMetrics>, metrics_log: &Arc<Mutex<MetricsLog>>) {
-    match metrics {
-        Ok(metrics) => metrics_log
-            .lock()
-            .expect("Should be able to acquire lock on metrics log")
-            .push_metrics(metrics),
-        Err(error) => metrics_log
-            .lock()
-            .expect("Should be able to acquire lock on metrics err")
-            .push_error(error),
-    }
-}
-
-async fn get_metrics(system: &mut System, pid: u32) -> anyhow::Result<CpuMetrics> {
+/// Gathers the CPU usage of a process along with every process it has started. Commands run
+/// through a shell, e.g. `cmd /C` or `powershell` on Windows, return the PID of the shell which
+/// does little work itself, so without its descendants the workload would be missed. The same
+/// goes for servers which fork workers, e.g. gunicorn or node's cluster module.
+///
+/// Descendants seen in earlier samples are remembered so workers which are re-parented, e.g. to
+/// init when the process which forked them exits, are still measured.
+async fn get_metrics(
+    system: &mut System,
+    pid: u32,
+    descendants: &mut HashSet<Pid>,
+) -> anyhow::Result<CpuMetrics> {
     // refresh system information
     system.refresh_all();
+    measure(system, pid, descendants, None)
+}
 
+/// Measures a process and its descendants using already refreshed system information. If the
+/// CPU time of every process has been accounted with eBPF over the wall time since the last
+/// sample, it's used in place of the usage sampled from the system.
+fn measure(
+    system: &System,
+    pid: u32,
+    descendants: &mut HashSet<Pid>,
+    cpu_times: Option<(&CpuTimes, Duration)>,
+) -> anyhow::Result<CpuMetrics> {
     if let Some(process) = system.process(Pid::from_u32(pid)) {
-        let cpu_usage = process.cpu_usage() as f64;
+        let tree = process_tree(system, process, descendants);
+        descendants.clear();
+        descendants.extend(tree.iter().skip(1).map(|process| process.pid()));
+
+        // cpu_usage = (cpu_time / wall_time) * 100.0
+        let cpu_usage = match cpu_times {
+            Some((cpu_times, wall_time)) if !wall_time.is_zero() => {
+                let tree = tree
+                    .iter()
+                    .map(|process| process.pid().as_u32())
+                    .collect::<Vec<_>>();
+                cpu_times.tree_ns(pid, &tree) as f64 / wall_time.as_nanos() as f64 * 100.0
+            }
+            _ => tree
+                .iter()
+                .map(|process| process.cpu_usage() as f64)
+                .sum::<f64>(),
+        };
         let core_count = system.physical_core_count().unwrap_or(0) as i32;
         let timestamp = std::time::SystemTime::now()
             .duration_since(std::time::UNIX_EPOCH)?
@@ -76,6 +206,149 @@ async fn get_metrics(system: &mut System, pid: u32) -> anyhow::Result<CpuMetrics
     }
 }
 
+/// Finds the running processes with names matching a regex. Processes started by another
+/// matching process, e.g. the workers of a postgres server, are left out as they're measured as
+/// part of their parent's tree.
+///
+/// # Returns
+///
+/// The pids of the matching processes
+fn matching_roots(system: &System, regex: &Regex) -> Vec<u32> {
+    let is_match = |process: &Process| regex.is_match(process.name());
+    system
+        .processes()
+        .values()
+        .filter(|process| is_match(process))
+        .filter(|process| {
+            !process
+                .parent()
+                .and_then(|parent| system.process(parent))
+                .is_some_and(is_match)
+        })
+        .map(|process| process.pid().as_u32())
+        .collect()
+}
+
+/// Sums the storage I/O of a process and its descendants from `/proc/<pid>/io`. The counters of
+/// a process include those of its children once they've exited and been waited for, so the total
+/// keeps growing as workers come and go. Ops are counted as read and write syscalls.
+///
+/// # Returns
+///
+/// The storage I/O, None if it can't be read for the process, e.g. it belongs to another user or
+/// the host isn't running Linux
+fn disk_io(pid: u32, descendants: &HashSet<Pid>) -> Option<DiskIo> {
+    let read = |pid: u32| {
+        std::fs::read_to_string(format!("/proc/{pid}/io"))
+            .ok()
+            .and_then(|io| parse_proc_io(&io))
+    };
+
+    let disk_io = read(pid)?;
+    Some(
+        descendants
+            .iter()
+            .filter_map(|pid| read(pid.as_u32()))
+            .fold(disk_io, |total, disk_io| total + disk_io),
+    )
+}
+
+/// # Returns
+///
+/// The resident memory of a process and its descendants in bytes, None if the process has exited
+fn memory_bytes(system: &System, pid: u32, descendants: &HashSet<Pid>) -> Option<u64> {
+    let memory = system.process(Pid::from_u32(pid))?.memory();
+    Some(
+        descendants
+            .iter()
+            .filter_map(|pid| system.process(*pid))
+            .fold(memory, |total, process| total + process.memory()),
+    )
+}
+
+fn parse_proc_io(io: &str) -> Option<DiskIo> {
+    let fields = io
+        .lines()
+        .filter_map(|line| line.split_once(':'))
+        .map(|(key, value)| (key, value.trim().parse::<u64>().unwrap_or(0)))
+        .collect::<HashMap<_, _>>();
+
+    Some(DiskIo {
+        read_bytes: *fields.get("read_bytes")?,
+        write_bytes: *fields.get("write_bytes")?,
+        read_ops: *fields.get("syscr")?,
+        write_ops: *fields.get("syscw")?,
+    })
+}
+
+/// Finds the process listening on a port. Looking up the owner of a socket means scanning the
+/// open files of every process, so the listener is only looked up again once it has exited.
+fn listener(
+    system: &System,
+    port: u16,
+    listeners: &mut HashMap<u16, u32>,
+) -> anyhow::Result<Option<u32>> {
+    if let Some(pid) = listeners.get(&port) {
+        if system.process(Pid::from_u32(*pid)).is_some() {
+            return Ok(Some(*pid));
+        }
+    }
+
+    let pid = port::listening_pid(port)?;
+    match pid {
+        Some(pid) => listeners.insert(port, pid),
+        None => listeners.remove(&port),
+    };
+    Ok(pid)
+}
+
+/// # Arguments
+///
+/// * `system` - A refreshed view of all processes
+/// * `root` - The process at the root of the tree
+/// * `known` - Descendants of the root found by earlier samples
+///
+/// # Returns
+///
+/// The root followed by all of its descendants. Threads are left out, sysinfo lists each thread of
+/// a process as a child of it on Linux but its CPU time is already counted in the process's.
+fn process_tree<'a>(
+    system: &'a System,
+    root: &'a Process,
+    known: &HashSet<Pid>,
+) -> Vec<&'a Process> {
+    let mut tree = vec![root];
+    let mut seen = HashSet::from([root.pid()]);
+
+    // a pid started before the root can't be a descendant, it has been reused
+    for pid in known.iter() {
+        if let Some(process) = system.process(*pid) {
+            if process.thread_kind().is_none()
+                && process.start_time() >= root.start_time()
+                && seen.insert(*pid)
+            {
+                tree.push(process);
+            }
+        }
+    }
+
+    let mut i = 0;
+    while i < tree.len() {
+        let parent = tree[i].pid();
+        for process in system.processes().values() {
+            if process.parent() == Some(parent)
+                && process.thread_kind().is_none()
+                && seen.insert(process.pid())
+            {
+                tree.push(process);
+            }
+        }
+        i += 1;
+    }
+
+    tree
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -83,6 +356,22 @@ mod tests {
     use subprocess::Exec;
     use tokio::time::{sleep, Duration};
 
+    #[test]
+    fn disk_io_is_read_from_proc() {
+        let io = "rchar: 323934931\nwchar: 323929600\nsyscr: 632687\nsyscw: 632675\n\
+                  read_bytes: 4096\nwrite_bytes: 323932160\ncancelled_write_bytes: 0\n";
+        assert_eq!(
+            parse_proc_io(io),
+            Some(DiskIo {
+                read_bytes: 4096,
+                write_bytes: 323932160,
+                read_ops: 632687,
+                write_ops: 632675,
+            })
+        );
+        assert_eq!(parse_proc_io("rchar: 1\n"), None);
+    }
+
     #[tokio::test]
     #[cfg(target_family = "windows")]
     async fn metrics_can_be_gatered_using_process_id() -> anyhow::Result<()> {
@@ -102,7 +391,7 @@ mod tests {
         let mut metrics_log = vec![];
         let iterations = 50;
         for _ in 0..iterations {
-            let metrics = get_metrics(&mut system, pid).await?;
+            let metrics = get_metrics(&mut system, pid, &mut HashSet::new()).await?;
             metrics_log.push(metrics);
             sleep(Duration::from_millis(200)).await;
         }
@@ -121,6 +410,42 @@ mod tests {
         Ok(())
     }
 
+    #[tokio::test]
+    #[cfg(target_family = "windows")]
+    async fn metrics_include_processes_started_by_a_shell() -> anyhow::Result<()> {
+        // cmd does no work itself, the busy loop runs in the powershell process it starts
+        let mut proc = Exec::cmd("cmd")
+            .arg("/C")
+            .arg("powershell")
+            .arg("-Command")
+            .arg(r#"while($true) {get-random | out-null}"#)
+            .detached()
+            .popen()
+            .context("Failed to spawn detached process")?;
+        let pid = proc.pid().context("Process should have a pid")?;
+
+        let mut system = System::new_all();
+        let mut metrics_log = vec![];
+        let iterations = 20;
+        for _ in 0..iterations {
+            let metrics = get_metrics(&mut system, pid, &mut HashSet::new()).await?;
+            metrics_log.push(metrics);
+            sleep(Duration::from_millis(200)).await;
+        }
+        std::process::Command::new("taskkill")
+            .args(["/T", "/F", "/PID", &pid.to_string()])
+            .status()
+            .context("Failed to kill process tree")?;
+        proc.wait().context("Failed to wait for process")?;
+
+        let cpu_usage = metrics_log.iter().fold(0_f64, |acc, metrics| {
+            acc + metrics.cpu_usage / metrics.core_count as f64
+        }) / iterations as f64;
+        assert!(cpu_usage > 0_f64);
+
+        Ok(())
+    }
+
     #[tokio::test]
     #[cfg(target_family = "windows")]
     async fn should_return_err_if_wrong_pid() {
@@ -140,7 +465,7 @@ mod tests {
         }
 
         // attempt to gather metrics
-        let res = get_metrics(&mut system, rand_pid).await;
+        let res = get_metrics(&mut system, rand_pid, &mut HashSet::new()).await;
         assert!(res.is_err());
     }
 
@@ -166,7 +491,7 @@ mod tests {
         let mut metrics_log = vec![];
         let iterations = 50;
         for _ in 0..iterations {
-            let metrics = get_metrics(&mut system, pid).await?;
+            let metrics = get_metrics(&mut system, pid, &mut HashSet::new()).await?;
             metrics_log.push(metrics);
             sleep(Duration::from_millis(200)).await;
         }
@@ -184,4 +509,80 @@ mod tests {
 
         Ok(())
     }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn threads_are_counted_as_part_of_their_process() -> anyhow::Result<()> {
+        let stop = Arc::new(std::sync::atomic::AtomicBool::new(false));
+        let threads = (0..3)
+            .map(|_| {
+                let stop = stop.clone();
+                std::thread::spawn(move || {
+                    while !stop.load(std::sync::atomic::Ordering::Relaxed) {
+                        std::hint::spin_loop();
+                    }
+                })
+            })
+            .collect::<Vec<_>>();
+
+        let pid = std::process::id();
+        let tids = std::fs::read_dir("/proc/self/task")?
+            .filter_map(|task| task.ok()?.file_name().to_str()?.parse::<u32>().ok())
+            .filter(|tid| *tid != pid)
+            .collect::<Vec<_>>();
+        let mut system = System::new_all();
+        system.refresh_all();
+        let process = system
+            .process(Pid::from_u32(pid))
+            .context("The test should be running")?;
+        let tree = process_tree(&system, process, &HashSet::new());
+
+        stop.store(true, std::sync::atomic::Ordering::Relaxed);
+        for thread in threads {
+            let _ = thread.join();
+        }
+        assert!(tids.len() >= 3);
+        // the threads' CPU time is in the process's, counting them too would count it again
+        assert!(tree
+            .iter()
+            .all(|process| !tids.contains(&process.pid().as_u32())));
+        Ok(())
+    }
+
+    #[tokio::test]
+    #[cfg(target_family = "unix")]
+    async fn metrics_include_forked_workers() -> anyhow::Result<()> {
+        // bash only waits, the busy loop runs in the worker it forks
+        let mut proc = Exec::cmd("bash")
+            .arg("-c")
+            .arg("sh -c 'while true; do :; done' & wait")
+            .detached()
+            .popen()
+            .context("Failed to spawn detached process")?;
+        let pid = proc.pid().context("Process should have a pid")?;
+
+        let mut system = System::new_all();
+        let mut descendants = HashSet::new();
+        let mut metrics_log = vec![];
+        let iterations = 20;
+        for _ in 0..iterations {
+            let metrics = get_metrics(&mut system, pid, &mut descendants).await?;
+            metrics_log.push(metrics);
+            sleep(Duration::from_millis(200)).await;
+        }
+        for worker in descendants.iter() {
+            if let Some(process) = system.process(*worker) {
+                process.kill();
+            }
+        }
+        proc.kill().context("Failed to kill process")?;
+
+        assert!(!descendants.is_empty());
+        let cpu_usage = metrics_log.iter().fold(0_f64, |acc, metrics| {
+            acc + metrics.cpu_usage / metrics.core_count as f64
+        }) / iterations as f64;
+        assert!(cpu_usage > 0_f64);
+
+        Ok(())
+    }
 }
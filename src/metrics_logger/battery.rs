@@ -0,0 +1,149 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::update_metrics_log;
+use crate::metrics::{MetricsLog, PowerComponent, PowerMetrics};
+use anyhow::{anyhow, Context};
+use std::{
+    fs,
+    path::Path,
+    sync::{Arc, Mutex},
+};
+use tokio::time::Duration;
+
+const POWER_SUPPLY_PATH: &str = "/sys/class/power_supply";
+
+/// Enters an infinite loop reading how quickly the laptop's batteries are discharging and logging
+/// it to the metrics log as the power of the whole machine. The power is attributed to processes
+/// by their CPU share when the run is summarised. The laptop has to stay unplugged for the whole
+/// run, a battery which isn't discharging is logged as an error.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(metrics_log: Arc<Mutex<MetricsLog>>) {
+    loop {
+        let metrics = get_metrics(Path::new(POWER_SUPPLY_PATH));
+        update_metrics_log(metrics, &metrics_log);
+        tokio::time::sleep(Duration::from_millis(1000)).await;
+    }
+}
+
+/// Sums the discharge rate of every battery. Most batteries report `power_now` in microwatts,
+/// some only report `current_now` in microamps and `voltage_now` in microvolts.
+fn get_metrics(power_supply_path: &Path) -> anyhow::Result<PowerMetrics> {
+    let entries = fs::read_dir(power_supply_path).context(format!(
+        "Unable to read {}, battery power is only available on Linux",
+        power_supply_path.display()
+    ))?;
+
+    let mut power = None;
+    for entry in entries.flatten() {
+        let supply_path = entry.path();
+        if read(&supply_path, "type").as_deref() != Some("Battery") {
+            continue;
+        }
+        let name = entry.file_name().to_string_lossy().to_string();
+        let status = read(&supply_path, "status").unwrap_or_default();
+        if status != "Discharging" {
+            return Err(anyhow!(
+                "Battery {name} is {}, unplug the laptop to measure its power",
+                status.to_lowercase()
+            ));
+        }
+
+        let micro_watts = match read_number(&supply_path, "power_now") {
+            Some(micro_watts) => micro_watts,
+            None => {
+                let micro_amps = read_number(&supply_path, "current_now");
+                let micro_volts = read_number(&supply_path, "voltage_now");
+                match (micro_amps, micro_volts) {
+                    (Some(micro_amps), Some(micro_volts)) => micro_amps * micro_volts / 1e6,
+                    _ => return Err(anyhow!("Battery {name} doesn't report its discharge rate")),
+                }
+            }
+        };
+        *power.get_or_insert(0.0) += micro_watts.abs() / 1e6;
+    }
+
+    let timestamp = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)?
+        .as_millis() as i64;
+    Ok(PowerMetrics {
+        source: String::from("battery"),
+        component: PowerComponent::Machine,
+        process_id: None,
+        power: power.ok_or(anyhow!("No batteries found"))?,
+        timestamp,
+    })
+}
+
+fn read(supply_path: &Path, file: &str) -> Option<String> {
+    fs::read_to_string(supply_path.join(file))
+        .ok()
+        .map(|contents| contents.trim().to_string())
+}
+
+fn read_number(supply_path: &Path, file: &str) -> Option<f64> {
+    read(supply_path, file)?.parse::<f64>().ok()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn discharge_rate_of_every_battery_is_summed() -> anyhow::Result<()> {
+        let power_supply_path =
+            std::env::temp_dir().join(format!("cardamon-battery-{}", nanoid::nanoid!(5)));
+        for (supply, files) in [
+            ("AC", vec![("type", "Mains"), ("online", "0")]),
+            (
+                "BAT0",
+                vec![
+                    ("type", "Battery"),
+                    ("status", "Discharging"),
+                    ("power_now", "9500000"),
+                ],
+            ),
+            (
+                "BAT1",
+                vec![
+                    ("type", "Battery"),
+                    ("status", "Discharging"),
+                    ("current_now", "500000"),
+                    ("voltage_now", "11000000"),
+                ],
+            ),
+        ] {
+            let supply_path = power_supply_path.join(supply);
+            fs::create_dir_all(&supply_path)?;
+            for (file, contents) in files {
+                fs::write(supply_path.join(file), format!("{contents}\n"))?;
+            }
+        }
+
+        let metrics = get_metrics(&power_supply_path)?;
+        assert_eq!(metrics.component, PowerComponent::Machine);
+        assert_eq!(metrics.power, 15.0);
+
+        fs::write(power_supply_path.join("BAT1/status"), "Charging\n")?;
+        assert!(get_metrics(&power_supply_path).is_err());
+
+        fs::remove_dir_all(&power_supply_path)?;
+        Ok(())
+    }
+}
@@ -0,0 +1,116 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{push_error, update_metrics_log};
+use crate::{
+    config::Board,
+    metrics::{MetricsLog, PowerComponent, PowerMetrics},
+};
+use std::sync::{Arc, Mutex};
+use sysinfo::System;
+use tokio::time::Duration;
+
+/// Whole board power in watts at 0%, 25%, 50%, 75% and 100% utilisation of all cores, from
+/// published measurements of each board at its default clocks without peripherals attached.
+///
+/// # Returns
+///
+/// The points of the board's power curve as (utilisation between 0 and 1, watts)
+fn curve(board: Board) -> &'static [(f64, f64)] {
+    match board {
+        Board::RaspberryPi4 => &[(0.0, 2.7), (0.25, 3.9), (0.5, 4.8), (0.75, 5.6), (1.0, 6.4)],
+        Board::RaspberryPi5 => &[(0.0, 2.7), (0.25, 4.1), (0.5, 5.2), (0.75, 6.2), (1.0, 7.1)],
+        Board::JetsonNano => &[(0.0, 1.9), (0.25, 2.8), (0.5, 3.7), (0.75, 4.6), (1.0, 5.5)],
+        Board::JetsonOrinNano => &[(0.0, 4.5), (0.25, 5.8), (0.5, 7.0), (0.75, 8.0), (1.0, 9.0)],
+    }
+}
+
+/// Enters an infinite loop working out the power of the whole board from the utilisation of all
+/// its cores and logging it to the metrics log. The power is attributed to processes by their CPU
+/// share when the run is summarised.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `board` - The board cardamon is running on
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(board: Board, metrics_log: Arc<Mutex<MetricsLog>>) {
+    let source = format!("board:{}", board.as_str());
+    let mut system = System::new();
+
+    // usage is worked out between refreshes, the first refresh only gives a starting point
+    system.refresh_cpu_usage();
+    loop {
+        tokio::time::sleep(Duration::from_millis(1000)).await;
+        system.refresh_cpu_usage();
+        let utilisation = system.global_cpu_info().cpu_usage() as f64 / 100.0;
+        let timestamp = match std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH) {
+            Ok(now) => now.as_millis() as i64,
+            Err(err) => {
+                push_error(err.into(), &metrics_log);
+                continue;
+            }
+        };
+
+        let metrics = PowerMetrics {
+            source: source.clone(),
+            component: PowerComponent::Machine,
+            process_id: None,
+            power: power(curve(board), utilisation),
+            timestamp,
+        };
+        update_metrics_log(Ok(metrics), &metrics_log);
+    }
+}
+
+/// Interpolates linearly between the points of a power curve.
+///
+/// # Arguments
+///
+/// * `curve` - Points of (utilisation, watts) ordered by utilisation
+/// * `utilisation` - The utilisation of all cores between 0 and 1
+///
+/// # Returns
+///
+/// The power in watts
+fn power(curve: &[(f64, f64)], utilisation: f64) -> f64 {
+    let utilisation = utilisation.clamp(0.0, 1.0);
+    curve
+        .windows(2)
+        .find(|points| utilisation <= points[1].0)
+        .map(|points| {
+            let ((u0, w0), (u1, w1)) = (points[0], points[1]);
+            w0 + (w1 - w0) * (utilisation - u0) / (u1 - u0)
+        })
+        .or(curve.last().map(|(_, watts)| *watts))
+        .unwrap_or_default()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn power_is_interpolated_along_the_curve() {
+        let curve = curve(Board::RaspberryPi5);
+
+        assert_eq!(power(curve, 0.0), 2.7);
+        assert_eq!(power(curve, 0.25), 4.1);
+        assert!((power(curve, 0.375) - 4.65).abs() < 1e-9);
+        assert_eq!(power(curve, 1.0), 7.1);
+        // sysinfo can report slightly over 100% while cores are being brought online
+        assert_eq!(power(curve, 1.2), 7.1);
+    }
+}
@@ -0,0 +1,471 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::metrics::{DiskIo, Throttling};
+use anyhow::{anyhow, Context};
+use std::{collections::HashMap, time::Instant};
+
+/// The CPU time a container had used at a point in time.
+struct Sample {
+    usage_ns: u64,
+    instant: Instant,
+}
+
+/// Reads the CPU usage of containers straight from their cgroups on the host, so no stats API or
+/// monitoring container is needed. Usage is worked out from the change in CPU time between
+/// samples so the sampler keeps the previous sample of every container.
+#[derive(Default)]
+pub struct CgroupSampler {
+    previous_samples: HashMap<String, Sample>,
+}
+impl CgroupSampler {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// # Arguments
+    ///
+    /// * `id` - The id of the container
+    /// * `pid` - The host pid of any process in the container
+    ///
+    /// # Returns
+    ///
+    /// The CPU usage of the container since it was last sampled, as a percentage of one core
+    pub fn cpu_usage(&mut self, id: &str, pid: u32) -> anyhow::Result<f64> {
+        let usage_ns = cpu_usage_ns(&read_cgroup(pid)?)?;
+        Ok(self.usage_since_last_sample(id, usage_ns))
+    }
+
+    /// # Arguments
+    ///
+    /// * `path` - The path of a cgroup in the unified hierarchy
+    ///
+    /// # Returns
+    ///
+    /// The CPU usage of everything in the cgroup since it was last sampled, as a percentage of
+    /// one core
+    pub fn unified_cpu_usage(&mut self, path: &str) -> anyhow::Result<f64> {
+        let cpu_stat = read_unified(path, "cpu.stat")?;
+        let usage_ns = parse_usage_usec(&cpu_stat)
+            .map(|usec| usec * 1000)
+            .ok_or(anyhow!("cpu.stat of cgroup {path} has no usage_usec"))?;
+        Ok(self.usage_since_last_sample(path, usage_ns))
+    }
+
+    fn usage_since_last_sample(&mut self, id: &str, usage_ns: u64) -> f64 {
+        let sample = Sample {
+            usage_ns,
+            instant: Instant::now(),
+        };
+
+        // cpu_usage = (usage_delta / wall_delta) * 100.0
+        // The first sample of a cgroup has nothing to compare against and reports no usage
+        match self.previous_samples.insert(String::from(id), sample) {
+            Some(previous) => {
+                let wall_ns = previous.instant.elapsed().as_nanos() as f64;
+                let usage_delta = usage_ns.saturating_sub(previous.usage_ns) as f64;
+                if wall_ns == 0.0 {
+                    0.0
+                } else {
+                    usage_delta / wall_ns * 100.0
+                }
+            }
+            None => 0.0,
+        }
+    }
+}
+
+/// # Arguments
+///
+/// * `pid` - The host pid of any process in the container
+///
+/// # Returns
+///
+/// The memory currently used by the container's cgroup in bytes
+pub fn memory_bytes(pid: u32) -> anyhow::Result<u64> {
+    let cgroup = read_cgroup(pid)?;
+    let (path, file) = match cgroup_path(&cgroup, "memory") {
+        Some(CgroupPath::V2(path)) => (format!("/sys/fs/cgroup{path}"), "memory.current"),
+        Some(CgroupPath::V1(path)) => (
+            format!("/sys/fs/cgroup/memory{path}"),
+            "memory.usage_in_bytes",
+        ),
+        None => return Err(anyhow!("Unable to find the memory cgroup of pid {pid}")),
+    };
+
+    std::fs::read_to_string(format!("{path}/{file}"))?
+        .trim()
+        .parse::<u64>()
+        .context(format!("Unable to read {file} of cgroup {path}"))
+}
+
+/// # Arguments
+///
+/// * `pid` - The host pid of any process in the container
+///
+/// # Returns
+///
+/// The CPU throttling counters of the container's cgroup
+pub fn throttling(pid: u32) -> anyhow::Result<Throttling> {
+    let cgroup = read_cgroup(pid)?;
+    let path = match cgroup_path(&cgroup, "cpu") {
+        Some(CgroupPath::V2(path)) => format!("/sys/fs/cgroup{path}"),
+        Some(CgroupPath::V1(path)) => format!("/sys/fs/cgroup/cpu,cpuacct{path}"),
+        None => return Err(anyhow!("Unable to find the cpu cgroup of pid {pid}")),
+    };
+
+    let cpu_stat = std::fs::read_to_string(format!("{path}/cpu.stat"))
+        .context(format!("Unable to read cpu.stat of cgroup {path}"))?;
+    parse_throttling(&cpu_stat).ok_or(anyhow!("cpu.stat of cgroup {path} has no throttling"))
+}
+
+/// # Returns
+///
+/// The total memory of the host in bytes, None if `/proc/meminfo` can't be read
+pub fn host_memory_bytes() -> Option<u64> {
+    let meminfo = std::fs::read_to_string("/proc/meminfo").ok()?;
+    parse_mem_total(&meminfo)
+}
+
+/// Containers have their own network namespace so the interfaces listed in `/proc/<pid>/net/dev`
+/// only carry the container's traffic.
+///
+/// # Arguments
+///
+/// * `pid` - The host pid of any process in the container
+///
+/// # Returns
+///
+/// The total bytes received and sent by the container
+pub fn network_bytes(pid: u32) -> anyhow::Result<(u64, u64)> {
+    let net_dev = std::fs::read_to_string(format!("/proc/{pid}/net/dev")).context(format!(
+        "Unable to read the network interfaces of pid {pid}"
+    ))?;
+    Ok(parse_net_dev(&net_dev))
+}
+
+/// # Arguments
+///
+/// * `pid` - The host pid of any process in the container
+///
+/// # Returns
+///
+/// The storage I/O of the container's cgroup across every block device
+pub fn disk_io(pid: u32) -> anyhow::Result<DiskIo> {
+    let cgroup = read_cgroup(pid)?;
+    match cgroup_path(&cgroup, "blkio") {
+        Some(CgroupPath::V2(path)) => {
+            let io_stat = std::fs::read_to_string(format!("/sys/fs/cgroup{path}/io.stat"))
+                .context(format!("Unable to read io.stat of cgroup {path}"))?;
+            Ok(parse_io_stat(&io_stat))
+        }
+
+        Some(CgroupPath::V1(path)) => {
+            let read = |file: &str| {
+                std::fs::read_to_string(format!("/sys/fs/cgroup/blkio{path}/{file}"))
+                    .context(format!("Unable to read {file} of cgroup {path}"))
+            };
+            let (read_bytes, write_bytes) =
+                parse_blkio(&read("blkio.throttle.io_service_bytes_recursive")?);
+            let (read_ops, write_ops) = parse_blkio(&read("blkio.throttle.io_serviced_recursive")?);
+            Ok(DiskIo {
+                read_bytes,
+                write_bytes,
+                read_ops,
+                write_ops,
+            })
+        }
+
+        None => Err(anyhow!("Unable to find the blkio cgroup of pid {pid}")),
+    }
+}
+
+/// # Arguments
+///
+/// * `pid` - The pid of any process in the cgroup
+///
+/// # Returns
+///
+/// The path of the process's cgroup in the unified hierarchy, e.g.
+/// `/user.slice/user-1000.slice/user@1000.service/app.slice/cardamon-db.scope`
+pub fn unified_path(pid: u32) -> anyhow::Result<String> {
+    read_cgroup(pid)?
+        .lines()
+        .find_map(|line| line.strip_prefix("0::"))
+        .map(String::from)
+        .ok_or(anyhow!("pid {pid} isn't in the unified cgroup hierarchy"))
+}
+
+/// # Arguments
+///
+/// * `path` - The path of a cgroup in the unified hierarchy
+///
+/// # Returns
+///
+/// The memory currently used by everything in the cgroup in bytes
+pub fn unified_memory_bytes(path: &str) -> anyhow::Result<u64> {
+    read_unified(path, "memory.current")?
+        .trim()
+        .parse::<u64>()
+        .context(format!("Unable to read memory.current of cgroup {path}"))
+}
+
+/// # Arguments
+///
+/// * `path` - The path of a cgroup in the unified hierarchy
+///
+/// # Returns
+///
+/// The storage I/O of everything in the cgroup across every block device
+pub fn unified_disk_io(path: &str) -> anyhow::Result<DiskIo> {
+    Ok(parse_io_stat(&read_unified(path, "io.stat")?))
+}
+
+/// # Arguments
+///
+/// * `path` - The path of a cgroup in the unified hierarchy
+///
+/// # Returns
+///
+/// The CPU throttling counters of the cgroup
+pub fn unified_throttling(path: &str) -> anyhow::Result<Throttling> {
+    parse_throttling(&read_unified(path, "cpu.stat")?)
+        .ok_or(anyhow!("cpu.stat of cgroup {path} has no throttling"))
+}
+
+fn read_unified(path: &str, file: &str) -> anyhow::Result<String> {
+    std::fs::read_to_string(format!("/sys/fs/cgroup{path}/{file}"))
+        .context(format!("Unable to read {file} of cgroup {path}"))
+}
+
+fn read_cgroup(pid: u32) -> anyhow::Result<String> {
+    std::fs::read_to_string(format!("/proc/{pid}/cgroup"))
+        .context(format!("Unable to read the cgroup of pid {pid}"))
+}
+
+/// Reads the total CPU time used by the cgroup described by the contents of `/proc/<pid>/cgroup`.
+///
+/// # Returns
+///
+/// The CPU time in nanoseconds
+fn cpu_usage_ns(cgroup: &str) -> anyhow::Result<u64> {
+    match cgroup_path(cgroup, "cpuacct") {
+        Some(CgroupPath::V2(path)) => {
+            let cpu_stat = std::fs::read_to_string(format!("/sys/fs/cgroup{path}/cpu.stat"))?;
+            parse_usage_usec(&cpu_stat)
+                .map(|usec| usec * 1000)
+                .ok_or(anyhow!("cpu.stat of cgroup {path} has no usage_usec"))
+        }
+
+        Some(CgroupPath::V1(path)) => {
+            std::fs::read_to_string(format!("/sys/fs/cgroup/cpu,cpuacct{path}/cpuacct.usage"))?
+                .trim()
+                .parse::<u64>()
+                .context(format!("Unable to read cpuacct.usage of cgroup {path}"))
+        }
+
+        None => Err(anyhow!("Unable to find the cpu cgroup of the container")),
+    }
+}
+
+#[derive(Debug, PartialEq)]
+enum CgroupPath<'a> {
+    V1(&'a str),
+    V2(&'a str),
+}
+
+/// Finds the cgroup of a v1 controller, falling back to the unified hierarchy. The v1 controller
+/// is preferred as hybrid hosts only account resources in v1.
+fn cgroup_path<'a>(cgroup: &'a str, controller: &str) -> Option<CgroupPath<'a>> {
+    let mut unified = None;
+    for line in cgroup.lines() {
+        let mut fields = line.splitn(3, ':');
+        let (Some(_), Some(controllers), Some(path)) =
+            (fields.next(), fields.next(), fields.next())
+        else {
+            continue;
+        };
+
+        if controllers.is_empty() {
+            unified = Some(CgroupPath::V2(path));
+        } else if controllers.split(',').any(|c| c == controller) {
+            return Some(CgroupPath::V1(path));
+        }
+    }
+    unified
+}
+
+fn parse_usage_usec(cpu_stat: &str) -> Option<u64> {
+    cpu_stat.lines().find_map(|line| {
+        let (name, value) = line.split_once(' ')?;
+        if name != "usage_usec" {
+            return None;
+        }
+        value.trim().parse::<u64>().ok()
+    })
+}
+
+/// v2 reports the throttled time as `throttled_usec`, v1 as `throttled_time` in nanoseconds.
+fn parse_throttling(cpu_stat: &str) -> Option<Throttling> {
+    let fields = cpu_stat
+        .lines()
+        .filter_map(|line| line.split_once(' '))
+        .filter_map(|(key, value)| Some((key, value.trim().parse::<u64>().ok()?)))
+        .collect::<HashMap<_, _>>();
+
+    let throttled_ns = match (fields.get("throttled_usec"), fields.get("throttled_time")) {
+        (Some(usec), _) => usec * 1000,
+        (None, Some(ns)) => *ns,
+        (None, None) => return None,
+    };
+    Some(Throttling {
+        periods: *fields.get("nr_periods")?,
+        throttled_periods: *fields.get("nr_throttled")?,
+        throttled_ns,
+    })
+}
+
+/// Reads `MemTotal`, which `/proc/meminfo` reports in kB, e.g. `MemTotal:       16303424 kB`.
+fn parse_mem_total(meminfo: &str) -> Option<u64> {
+    meminfo.lines().find_map(|line| {
+        let kb = line.strip_prefix("MemTotal:")?.trim().strip_suffix("kB")?;
+        kb.trim().parse::<u64>().ok().map(|kb| kb * 1024)
+    })
+}
+
+/// Sums the bytes received and sent over every interface except loopback, which never leaves the
+/// container.
+fn parse_net_dev(net_dev: &str) -> (u64, u64) {
+    // interface: rx_bytes rx_packets rx_errs rx_drop rx_fifo rx_frame rx_compressed rx_multicast
+    //            tx_bytes ...
+    net_dev
+        .lines()
+        .skip(2)
+        .filter_map(|line| {
+            let (interface, counters) = line.split_once(':')?;
+            if interface.trim() == "lo" {
+                return None;
+            }
+            let counters = counters.split_whitespace().collect::<Vec<_>>();
+            let received = counters.first()?.parse::<u64>().ok()?;
+            let sent = counters.get(8)?.parse::<u64>().ok()?;
+            Some((received, sent))
+        })
+        .fold((0, 0), |(received, sent), (rx, tx)| {
+            (received + rx, sent + tx)
+        })
+}
+
+/// Sums the counters of every device in a v2 `io.stat`, e.g.
+/// `8:0 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0`.
+fn parse_io_stat(io_stat: &str) -> DiskIo {
+    let mut disk_io = DiskIo::default();
+    for (key, value) in io_stat
+        .split_whitespace()
+        .filter_map(|field| field.split_once('='))
+    {
+        let value = value.parse::<u64>().unwrap_or(0);
+        match key {
+            "rbytes" => disk_io.read_bytes += value,
+            "wbytes" => disk_io.write_bytes += value,
+            "rios" => disk_io.read_ops += value,
+            "wios" => disk_io.write_ops += value,
+            _ => {}
+        }
+    }
+    disk_io
+}
+
+/// Sums the reads and writes of every device in a v1 blkio file, e.g. `8:0 Read 4096`.
+fn parse_blkio(blkio: &str) -> (u64, u64) {
+    blkio.lines().fold((0, 0), |(read, write), line| {
+        let fields = line.split_whitespace().collect::<Vec<_>>();
+        match fields[..] {
+            [_, "Read", value] => (read + value.parse::<u64>().unwrap_or(0), write),
+            [_, "Write", value] => (read, write + value.parse::<u64>().unwrap_or(0)),
+            _ => (read, write),
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn cgroups_are_found() {
+        let v2 = "0::/default/3f1a9c\n";
+        assert_eq!(
+            cgroup_path(v2, "cpuacct"),
+            Some(CgroupPath::V2("/default/3f1a9c"))
+        );
+
+        let v1 = "12:memory:/default/3f1a9c\n4:cpu,cpuacct:/default/3f1a9c\n0::/\n";
+        assert_eq!(
+            cgroup_path(v1, "cpuacct"),
+            Some(CgroupPath::V1("/default/3f1a9c"))
+        );
+        assert_eq!(
+            cgroup_path(v1, "memory"),
+            Some(CgroupPath::V1("/default/3f1a9c"))
+        );
+    }
+
+    #[test]
+    fn cpu_usage_is_parsed() {
+        let cpu_stat = "usage_usec 1500\nuser_usec 1000\nsystem_usec 500\n";
+        assert_eq!(parse_usage_usec(cpu_stat), Some(1500));
+        assert_eq!(parse_usage_usec("nr_periods 0\n"), None);
+    }
+
+    #[test]
+    fn throttling_is_parsed() {
+        let v2 = "usage_usec 1500\nnr_periods 20\nnr_throttled 4\nthrottled_usec 3000\n";
+        let v1 = "nr_periods 20\nnr_throttled 4\nthrottled_time 3000000\n";
+        let throttling = Some(Throttling {
+            periods: 20,
+            throttled_periods: 4,
+            throttled_ns: 3_000_000,
+        });
+        assert_eq!(parse_throttling(v2), throttling);
+        assert_eq!(parse_throttling(v1), throttling);
+        assert_eq!(parse_throttling("usage_usec 1500\n"), None);
+    }
+
+    #[test]
+    fn host_memory_is_parsed() {
+        let meminfo = "MemTotal:       16303424 kB\nMemFree:         1571328 kB\n";
+        assert_eq!(parse_mem_total(meminfo), Some(16303424 * 1024));
+        assert_eq!(parse_mem_total("MemFree: 1571328 kB\n"), None);
+    }
+
+    #[test]
+    fn network_usage_excludes_loopback() {
+        let net_dev = "Inter-|   Receive                                                |  Transmit\n \
+                       face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n \
+                       \x20   lo:    4000      40    0    0    0     0          0         0     4000      40    0    0    0     0       0          0\n \
+                       \x20 eth0:  120000     300    0    0    0     0          0         0    35000     250    0    0    0     0       0          0\n";
+        assert_eq!(parse_net_dev(net_dev), (120000, 35000));
+    }
+
+    #[test]
+    fn disk_io_is_summed_over_devices() {
+        let io_stat = "8:0 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n\
+                       259:0 rbytes=1024 wbytes=0 rios=3 wios=0 dbytes=0 dios=0\n";
+        assert_eq!(
+            parse_io_stat(io_stat),
+            DiskIo {
+                read_bytes: 5120,
+                write_bytes: 8192,
+                read_ops: 4,
+                write_ops: 2
+            }
+        );
+
+        let blkio = "8:0 Read 4096\n8:0 Write 8192\n8:0 Sync 0\n8:0 Total 12288\nTotal 12288\n";
+        assert_eq!(parse_blkio(blkio), (4096, 8192));
+    }
+}
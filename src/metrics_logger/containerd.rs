@@ -0,0 +1,170 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{
+    cgroup::{self, CgroupSampler},
+    push_error, update_metrics_log,
+};
+use crate::{
+    container,
+    metrics::{CpuMetrics, MetricsLog, ResourceMetrics},
+};
+use anyhow::{anyhow, Context};
+use std::sync::{Arc, Mutex};
+use tokio::time::Duration;
+
+/// Enters an infinite loop logging metrics for each container to the metrics log. Containers are
+/// found through containerd using `nerdctl`, which honours `CONTAINERD_NAMESPACE` and
+/// `CONTAINERD_ADDRESS`, and their CPU usage is read from the container's cgroup.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `container_names` - The names or ids of the containers to observe
+/// * `compose_projects` - Compose projects whose running containers are all observed, they're
+/// listed every sample so containers started part way through a scenario are picked up
+/// * `sample_interval` - How long to wait between samples
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(
+    container_names: Vec<String>,
+    compose_projects: Vec<String>,
+    sample_interval: Duration,
+    metrics_log: Arc<Mutex<MetricsLog>>,
+) {
+    let core_count = std::thread::available_parallelism()
+        .map(|cores| cores.get() as i32)
+        .unwrap_or(0);
+    let mut sampler = CgroupSampler::new();
+
+    loop {
+        tokio::time::sleep(sample_interval).await;
+        let mut container_names = container_names.clone();
+        for project in compose_projects.iter() {
+            match project_containers(project).await {
+                Ok(names) => container_names.extend(
+                    names
+                        .into_iter()
+                        .filter(|name| !container_names.contains(name))
+                        .collect::<Vec<_>>(),
+                ),
+                Err(err) => push_error(err, &metrics_log),
+            }
+        }
+
+        for container_name in container_names.iter() {
+            let metrics = get_metrics(container_name, core_count, &mut sampler).await;
+            update_metrics_log(metrics, &metrics_log);
+        }
+    }
+}
+
+async fn get_metrics(
+    container_name: &str,
+    core_count: i32,
+    sampler: &mut CgroupSampler,
+) -> anyhow::Result<(CpuMetrics, ResourceMetrics)> {
+    let (id, pid) = inspect(container_name).await?;
+    let cpu_usage = sampler.cpu_usage(&id, pid)?;
+    let timestamp = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)?
+        .as_millis() as i64;
+
+    let network_bytes = cgroup::network_bytes(pid).ok();
+    let resource_metrics = ResourceMetrics {
+        process_id: id.clone(),
+        bytes_sent: network_bytes.map(|(_, sent)| sent),
+        bytes_received: network_bytes.map(|(received, _)| received),
+        disk_io: cgroup::disk_io(pid).ok(),
+        memory_bytes: cgroup::memory_bytes(pid).ok(),
+        memory_total: cgroup::host_memory_bytes(),
+        throttling: cgroup::throttling(pid).ok(),
+        gpu_utilisation: None,
+        timestamp,
+    };
+    let metrics = CpuMetrics {
+        process_id: id,
+        process_name: String::from(container_name),
+        cpu_usage,
+        core_count,
+        timestamp,
+    };
+
+    Ok((metrics, resource_metrics))
+}
+
+/// # Returns
+///
+/// The id of the container and the host pid of its init process
+async fn inspect(container_name: &str) -> anyhow::Result<(String, u32)> {
+    let output = tokio::process::Command::new("nerdctl")
+        .args([
+            "inspect",
+            "--format",
+            "{{.Id}} {{.State.Pid}}",
+            container_name,
+        ])
+        .output()
+        .await
+        .context("Unable to run nerdctl, is it installed?")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "Unable to inspect container {container_name}: {}",
+            String::from_utf8_lossy(&output.stderr)
+        ));
+    }
+
+    let stdout = String::from_utf8_lossy(&output.stdout);
+    let (id, pid) = stdout
+        .trim()
+        .split_once(' ')
+        .ok_or(anyhow!("Unexpected output from nerdctl inspect: {stdout}"))?;
+    let pid = pid
+        .parse::<u32>()
+        .context(format!("Container {container_name} isn't running"))?;
+    if pid == 0 {
+        return Err(anyhow!("Container {container_name} isn't running"));
+    }
+
+    Ok((String::from(id), pid))
+}
+
+/// # Returns
+///
+/// The names of the running containers of a compose project
+async fn project_containers(project: &str) -> anyhow::Result<Vec<String>> {
+    let output = tokio::process::Command::new("nerdctl")
+        .args([
+            "ps",
+            "--filter",
+            &format!("label={}={project}", container::COMPOSE_PROJECT_LABEL),
+            "--format",
+            "{{.Names}}",
+        ])
+        .output()
+        .await
+        .context("Unable to run nerdctl, is it installed?")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "Unable to list containers of project {project}: {}",
+            String::from_utf8_lossy(&output.stderr)
+        ));
+    }
+
+    Ok(String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .map(|name| name.trim().to_string())
+        .filter(|name| !name.is_empty())
+        .collect())
+}
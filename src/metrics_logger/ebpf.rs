@@ -0,0 +1,271 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::{anyhow, Context};
+use std::{
+    collections::HashMap,
+    io::{BufRead, BufReader},
+    process::{Child, Command, Stdio},
+    sync::{Arc, Mutex},
+    thread,
+};
+
+/// Adds up the time each task spends on a CPU by watching the scheduler switch between tasks,
+/// and reports forks so processes which exit between samples can still be attributed to the
+/// process which started them. The totals are printed and cleared every second.
+///
+/// The scheduler switches between threads, `args.prev_pid` and `args.next_pid` are thread ids,
+/// so when each thread went on the CPU is kept per thread. The switch runs in the task being
+/// switched out, so its time is added to its process, the `pid` builtin, and threads which were
+/// started before the program are counted as part of their process. Forks run in the parent so
+/// they're reported against the parent's process rather than the thread which forked.
+const PROGRAM: &str = r#"
+tracepoint:sched:sched_switch {
+    if (@oncpu[args.prev_pid]) {
+        @ns[pid] += nsecs - @oncpu[args.prev_pid];
+    }
+    delete(@oncpu[args.prev_pid]);
+    @oncpu[args.next_pid] = nsecs;
+}
+
+tracepoint:sched:sched_process_fork {
+    printf("fork %d %d\n", pid, args.child_pid);
+}
+
+tracepoint:sched:sched_process_exit {
+    delete(@oncpu[args.pid]);
+}
+
+interval:s:1 {
+    print(@ns);
+    clear(@ns);
+    printf("sample\n");
+}
+"#;
+
+#[derive(Default)]
+struct Accounts {
+    /// CPU time per pid in nanoseconds since the accounts were last taken.
+    cpu_ns: HashMap<u32, u64>,
+    /// The parent of every process forked since the sampler started.
+    parents: HashMap<u32, u32>,
+    exited: bool,
+}
+
+/// Accounts the CPU time of every process using eBPF. `/proc` only shows processes which are
+/// running when it's read, so bursts and processes which live for less than a sample are missed,
+/// scheduler events catch every time slice. The program is run with `bpftrace`, which has to be
+/// installed and run as root.
+pub struct EbpfSampler {
+    bpftrace: Child,
+    accounts: Arc<Mutex<Accounts>>,
+}
+impl EbpfSampler {
+    pub fn start() -> anyhow::Result<Self> {
+        let mut bpftrace = Command::new("bpftrace")
+            .args(["-e", PROGRAM])
+            .stdout(Stdio::piped())
+            .stderr(Stdio::null())
+            .spawn()
+            .context("Unable to run bpftrace, is it installed?")?;
+        let stdout = bpftrace
+            .stdout
+            .take()
+            .ok_or(anyhow!("Unable to read the output of bpftrace"))?;
+
+        let accounts = Arc::new(Mutex::new(Accounts::default()));
+        let shared_accounts = accounts.clone();
+        thread::spawn(move || {
+            for line in BufReader::new(stdout).lines().map_while(Result::ok) {
+                let mut accounts = shared_accounts
+                    .lock()
+                    .expect("Should be able to acquire lock on eBPF accounts");
+                parse_line(&line, &mut accounts);
+            }
+            shared_accounts
+                .lock()
+                .expect("Should be able to acquire lock on eBPF accounts")
+                .exited = true;
+        });
+
+        Ok(Self { bpftrace, accounts })
+    }
+
+    /// Takes the CPU time accounted since the last call.
+    ///
+    /// # Returns
+    ///
+    /// The CPU time in nanoseconds of every process which ran
+    pub fn take(&mut self) -> anyhow::Result<CpuTimes> {
+        let mut accounts = self
+            .accounts
+            .lock()
+            .expect("Should be able to acquire lock on eBPF accounts");
+        if accounts.exited {
+            return Err(anyhow!(
+                "bpftrace exited, eBPF CPU accounting needs to be run as root"
+            ));
+        }
+
+        Ok(CpuTimes {
+            cpu_ns: std::mem::take(&mut accounts.cpu_ns),
+            parents: accounts.parents.clone(),
+        })
+    }
+}
+impl Drop for EbpfSampler {
+    fn drop(&mut self) {
+        let _ = self.bpftrace.kill();
+        let _ = self.bpftrace.wait();
+    }
+}
+
+/// The CPU time used by every process between two samples.
+pub struct CpuTimes {
+    cpu_ns: HashMap<u32, u64>,
+    parents: HashMap<u32, u32>,
+}
+impl CpuTimes {
+    /// # Arguments
+    ///
+    /// * `root` - The process at the root of the tree
+    /// * `tree` - Descendants of the root which are still running
+    ///
+    /// # Returns
+    ///
+    /// The CPU time in nanoseconds used by the root and every process it started, including
+    /// processes which have since exited
+    pub fn tree_ns(&self, root: u32, tree: &[u32]) -> u64 {
+        self.cpu_ns
+            .iter()
+            .filter(|(pid, _)| tree.contains(pid) || self.descends_from(**pid, root))
+            .map(|(_, ns)| ns)
+            .sum()
+    }
+
+    fn descends_from(&self, pid: u32, root: u32) -> bool {
+        let mut pid = pid;
+        // fork records can't form a cycle, the bound guards against reused pids
+        for _ in 0..self.parents.len() + 1 {
+            if pid == root {
+                return true;
+            }
+            match self.parents.get(&pid) {
+                Some(parent) => pid = *parent,
+                None => return false,
+            }
+        }
+        false
+    }
+}
+
+/// Parses the lines printed by the program, either `fork <parent> <child>` or a map entry
+/// `@ns[<pid>]: <ns>`. The ns are the CPU time of every thread of the process.
+fn parse_line(line: &str, accounts: &mut Accounts) {
+    if let Some(fork) = line.strip_prefix("fork ") {
+        if let Some((parent, child)) = fork.split_once(' ') {
+            if let (Ok(parent), Ok(child)) = (parent.parse(), child.trim().parse()) {
+                accounts.parents.insert(child, parent);
+            }
+        }
+    } else if let Some(entry) = line.strip_prefix("@ns[") {
+        if let Some((pid, ns)) = entry.split_once("]: ") {
+            if let (Ok(pid), Ok(ns)) = (pid.parse::<u32>(), ns.trim().parse::<u64>()) {
+                *accounts.cpu_ns.entry(pid).or_default() += ns;
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn exited_descendants_are_attributed_to_their_root() {
+        let mut accounts = Accounts::default();
+        for line in [
+            "Attaching 4 probes...",
+            "fork 100 101",
+            "fork 101 102",
+            "fork 1 200",
+            "@ns[100]: 1000",
+            "@ns[102]: 500",
+            "@ns[200]: 250",
+            "@ns[300]: 125",
+            "",
+            "sample",
+        ] {
+            parse_line(line, &mut accounts);
+        }
+
+        let times = CpuTimes {
+            cpu_ns: accounts.cpu_ns,
+            parents: accounts.parents,
+        };
+        assert_eq!(times.tree_ns(100, &[]), 1500);
+        assert_eq!(times.tree_ns(100, &[300]), 1625);
+        assert_eq!(times.tree_ns(200, &[]), 250);
+    }
+
+    #[test]
+    fn threads_started_before_sampling_are_part_of_their_process() {
+        // the program adds the time of every thread to its process, threads of process 100
+        // which were running before it started have no fork records. Process 100 then starts a
+        // thread, 103, which forks process 104.
+        let mut accounts = Accounts::default();
+        for line in [
+            "Attaching 4 probes...",
+            "fork 100 103",
+            "fork 100 104",
+            "@ns[100]: 3000",
+            "@ns[104]: 500",
+            "",
+            "sample",
+        ] {
+            parse_line(line, &mut accounts);
+        }
+
+        let times = CpuTimes {
+            cpu_ns: accounts.cpu_ns,
+            parents: accounts.parents,
+        };
+        assert_eq!(times.tree_ns(100, &[]), 3500);
+        assert_eq!(times.tree_ns(104, &[]), 500);
+    }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn threads_started_before_sampling_are_measured() -> anyhow::Result<()> {
+        use std::sync::atomic::{AtomicBool, Ordering};
+
+        let stop = Arc::new(AtomicBool::new(false));
+        let threads = (0..2)
+            .map(|_| {
+                let stop = stop.clone();
+                thread::spawn(move || while !stop.load(Ordering::Relaxed) {})
+            })
+            .collect::<Vec<_>>();
+
+        // bpftrace needs to be installed and run as root
+        let Ok(mut sampler) = EbpfSampler::start() else {
+            stop.store(true, Ordering::Relaxed);
+            return Ok(());
+        };
+        thread::sleep(std::time::Duration::from_millis(3500));
+        let times = sampler.take();
+        stop.store(true, Ordering::Relaxed);
+        for thread in threads {
+            thread.join().expect("thread should have spun");
+        }
+
+        if let Ok(times) = times {
+            // two spinning threads use at least a second of CPU time per second
+            assert!(times.tree_ns(std::process::id(), &[]) >= 1_000_000_000);
+        }
+        Ok(())
+    }
+}
@@ -0,0 +1,134 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::update_metrics_log;
+use crate::metrics::{MetricsLog, PowerComponent, PowerMetrics};
+use anyhow::{anyhow, Context};
+use std::sync::{Arc, Mutex};
+use tokio::time::Duration;
+
+/// Enters an infinite loop reading the power of the whole machine from its BMC using `ipmitool`
+/// and logging it to the metrics log. The power is attributed to processes by their CPU share
+/// when the run is summarised.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `host` - The BMC to query over the network, None for the local BMC
+/// * `username` - The BMC user
+/// * `password` - The BMC user's password, read from `IPMI_PASSWORD` if None
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(
+    host: Option<String>,
+    username: Option<String>,
+    password: Option<String>,
+    metrics_log: Arc<Mutex<MetricsLog>>,
+) {
+    let mut args = vec![];
+    if let Some(host) = &host {
+        args.extend([String::from("-I"), String::from("lanplus")]);
+        args.extend([String::from("-H"), host.clone()]);
+        if let Some(username) = username {
+            args.extend([String::from("-U"), username]);
+        }
+        // the password is passed in the environment, arguments can be read by anyone on the host
+        args.push(String::from("-E"));
+    }
+    args.extend(["dcmi", "power", "reading"].map(String::from));
+    let source = format!("ipmi:{}", host.as_deref().unwrap_or("local"));
+
+    loop {
+        let metrics = get_metrics(&args, password.as_deref(), &source).await;
+        update_metrics_log(metrics, &metrics_log);
+        tokio::time::sleep(Duration::from_millis(1000)).await;
+    }
+}
+
+async fn get_metrics(
+    args: &[String],
+    password: Option<&str>,
+    source: &str,
+) -> anyhow::Result<PowerMetrics> {
+    let mut command = tokio::process::Command::new("ipmitool");
+    command.args(args);
+    if let Some(password) = password {
+        command.env("IPMI_PASSWORD", password);
+    }
+    let output = command
+        .output()
+        .await
+        .context("Unable to run ipmitool, is it installed?")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "ipmitool failed: {}",
+            String::from_utf8_lossy(&output.stderr)
+        ));
+    }
+    let timestamp = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)?
+        .as_millis() as i64;
+
+    let power = parse_power_reading(&String::from_utf8_lossy(&output.stdout)).ok_or(anyhow!(
+        "ipmitool didn't report an instantaneous power reading"
+    ))?;
+
+    Ok(PowerMetrics {
+        source: String::from(source),
+        component: PowerComponent::Machine,
+        process_id: None,
+        power,
+        timestamp,
+    })
+}
+
+/// Reads the instantaneous power from the output of `ipmitool dcmi power reading`, e.g.
+/// `Instantaneous power reading:   220 Watts`.
+///
+/// # Returns
+///
+/// The power in watts, None if the output doesn't contain a reading
+fn parse_power_reading(output: &str) -> Option<f64> {
+    output.lines().find_map(|line| {
+        let (name, value) = line.split_once(':')?;
+        if name.trim() != "Instantaneous power reading" {
+            return None;
+        }
+        value
+            .trim()
+            .strip_suffix("Watts")?
+            .trim()
+            .parse::<f64>()
+            .ok()
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn instantaneous_power_is_parsed() {
+        let output = "\n    Instantaneous power reading:                   220 Watts\n\
+                      \x20   Minimum during sampling period:                150 Watts\n\
+                      \x20   Maximum during sampling period:                310 Watts\n\
+                      \x20   Power reading state is:                        activated\n";
+
+        assert_eq!(parse_power_reading(output), Some(220.0));
+        assert_eq!(
+            parse_power_reading("Power reading state is: deactivated"),
+            None
+        );
+    }
+}
@@ -0,0 +1,177 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{push_error, update_metrics_log};
+use crate::{
+    k8s::{self, Pod},
+    metrics::{CpuMetrics, MetricsLog},
+};
+use anyhow::{anyhow, Context};
+use itertools::Itertools;
+use serde::Deserialize;
+use std::sync::{Arc, Mutex};
+use tokio::time::Duration;
+
+#[derive(Debug, Deserialize)]
+struct PodMetricsList {
+    items: Vec<PodMetrics>,
+}
+
+#[derive(Debug, Deserialize)]
+struct PodMetrics {
+    metadata: PodMetricsMetadata,
+    containers: Vec<ContainerMetrics>,
+}
+
+#[derive(Debug, Deserialize)]
+struct PodMetricsMetadata {
+    name: String,
+}
+
+#[derive(Debug, Deserialize)]
+struct ContainerMetrics {
+    usage: ContainerUsage,
+}
+
+#[derive(Debug, Deserialize)]
+struct ContainerUsage {
+    cpu: String,
+}
+
+/// Enters an infinite loop logging the CPU usage of each pod to the metrics log. Usage is read
+/// from the metrics API, which is served by metrics-server or the kubelet's resource metrics, so
+/// it's an average over the API's scrape window rather than an instantaneous value.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `pods` - The pods to observe
+/// * `sample_interval` - How long to wait between samples
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(
+    pods: Vec<Pod>,
+    sample_interval: Duration,
+    metrics_log: Arc<Mutex<MetricsLog>>,
+) {
+    let pods_by_namespace = pods
+        .into_iter()
+        .into_group_map_by(|pod| pod.namespace.clone());
+
+    loop {
+        tokio::time::sleep(sample_interval).await;
+        for (namespace, pods) in pods_by_namespace.iter() {
+            match get_metrics(namespace, pods).await {
+                Ok(metrics) => metrics
+                    .into_iter()
+                    .for_each(|metrics| update_metrics_log(Ok(metrics), &metrics_log)),
+                Err(err) => push_error(err, &metrics_log),
+            }
+        }
+    }
+}
+
+async fn get_metrics(namespace: &str, pods: &[Pod]) -> anyhow::Result<Vec<CpuMetrics>> {
+    let path = format!("/apis/metrics.k8s.io/v1beta1/namespaces/{namespace}/pods");
+    let output =
+        tokio::task::spawn_blocking(move || k8s::kubectl(&["get", "--raw", &path])).await??;
+    let pod_metrics = serde_json::from_slice::<PodMetricsList>(&output)
+        .context("Unexpected response from the metrics API, is metrics-server installed?")?;
+
+    let timestamp = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)?
+        .as_millis() as i64;
+    to_cpu_metrics(pods, &pod_metrics, timestamp)
+}
+
+// cpu_usage = cores * 100.0
+// Pods which have only just started may not have been scraped yet and are skipped
+fn to_cpu_metrics(
+    pods: &[Pod],
+    pod_metrics: &PodMetricsList,
+    timestamp: i64,
+) -> anyhow::Result<Vec<CpuMetrics>> {
+    let mut metrics = vec![];
+    for pod in pods.iter() {
+        let Some(usage) = pod_metrics
+            .items
+            .iter()
+            .find(|metrics| metrics.metadata.name == pod.name)
+        else {
+            tracing::debug!("No metrics for pod {} yet", pod.process_id());
+            continue;
+        };
+
+        let mut cores = 0.0;
+        for container in usage.containers.iter() {
+            cores += k8s::cpu_cores(&container.usage.cpu).ok_or(anyhow!(
+                "Unexpected CPU usage {} for pod {}",
+                container.usage.cpu,
+                pod.process_id()
+            ))?;
+        }
+
+        metrics.push(CpuMetrics {
+            process_id: pod.process_id(),
+            process_name: pod.process_name(),
+            cpu_usage: cores * 100.0,
+            core_count: pod.core_count,
+            timestamp,
+        });
+    }
+
+    Ok(metrics)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn pod_usage_is_summed_over_containers() -> anyhow::Result<()> {
+        let pods = vec![
+            Pod {
+                namespace: String::from("shop"),
+                name: String::from("checkout-1"),
+                owner: String::from("checkout"),
+                core_count: 8,
+            },
+            Pod {
+                namespace: String::from("shop"),
+                name: String::from("checkout-2"),
+                owner: String::from("checkout"),
+                core_count: 8,
+            },
+        ];
+        let pod_metrics = serde_json::from_str::<PodMetricsList>(
+            r#"{"items": [{
+                "metadata": {"name": "checkout-1", "namespace": "shop"},
+                "timestamp": "2026-10-14T10:00:00Z",
+                "window": "15s",
+                "containers": [
+                    {"name": "app", "usage": {"cpu": "250m", "memory": "64Mi"}},
+                    {"name": "proxy", "usage": {"cpu": "50000000n", "memory": "16Mi"}}
+                ]
+            }]}"#,
+        )?;
+
+        let metrics = to_cpu_metrics(&pods, &pod_metrics, 1000)?;
+        assert_eq!(metrics.len(), 1);
+        assert_eq!(metrics[0].process_id, "shop/checkout-1");
+        assert_eq!(metrics[0].process_name, "shop/checkout");
+        assert!((metrics[0].cpu_usage - 30.0).abs() < 1e-9);
+        assert_eq!(metrics[0].core_count, 8);
+        Ok(())
+    }
+}
@@ -0,0 +1,143 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{
+    prometheus::{self, Sample},
+    push_error, update_metrics_log,
+};
+use crate::metrics::{MetricsLog, PowerComponent, PowerMetrics};
+use std::sync::{Arc, Mutex};
+use tokio::time::Duration;
+
+/// Kepler's per container energy counters and the component each one measures.
+const KEPLER_COUNTERS: [(&str, PowerComponent); 2] = [
+    ("kepler_container_package_joules_total", PowerComponent::Cpu),
+    ("kepler_container_gpu_joules_total", PowerComponent::Gpu),
+];
+
+/// Enters an infinite loop querying the Prometheus server Kepler exports to for the power of
+/// every selected pod and logging it to the metrics log. Kepler has already attributed the power
+/// to each pod so every pod is reported as a process of its own, `<namespace>/<pod>`.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `url` - The base url of the Prometheus server
+/// * `namespace` - Only measure pods in this namespace
+/// * `pod` - Only measure pods with names matching this regex
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(
+    url: String,
+    namespace: Option<String>,
+    pod: Option<String>,
+    metrics_log: Arc<Mutex<MetricsLog>>,
+) {
+    let client = match prometheus::client() {
+        Ok(client) => client,
+        Err(err) => {
+            push_error(err, &metrics_log);
+            return;
+        }
+    };
+    let base_url = url.strip_suffix('/').unwrap_or(&url);
+    let selector = selector(namespace.as_deref(), pod.as_deref());
+
+    loop {
+        for (counter, component) in KEPLER_COUNTERS {
+            // irate gives the power between the two most recent scrapes of the counter
+            let query =
+                format!("sum by (container_namespace, pod_name) (irate({counter}{selector}[1m]))");
+            let metrics = prometheus::instant_query(&client, base_url, &query)
+                .await
+                .and_then(|samples| pod_power(&samples, component));
+            match metrics {
+                Ok(metrics) => metrics
+                    .into_iter()
+                    .for_each(|metrics| update_metrics_log(Ok(metrics), &metrics_log)),
+                Err(err) => push_error(err, &metrics_log),
+            }
+        }
+        tokio::time::sleep(Duration::from_millis(1000)).await;
+    }
+}
+
+fn pod_power(samples: &[Sample], component: PowerComponent) -> anyhow::Result<Vec<PowerMetrics>> {
+    let mut metrics = vec![];
+    for sample in samples.iter() {
+        let (Some(namespace), Some(pod)) = (
+            sample.metric.get("container_namespace"),
+            sample.metric.get("pod_name"),
+        ) else {
+            continue;
+        };
+
+        metrics.push(PowerMetrics {
+            source: String::from("kepler"),
+            component,
+            process_id: Some(format!("{namespace}/{pod}")),
+            power: sample.value()?,
+            timestamp: sample.timestamp(),
+        });
+    }
+
+    Ok(metrics)
+}
+
+/// Builds the PromQL label selector for the configured namespace and pod name regex.
+fn selector(namespace: Option<&str>, pod: Option<&str>) -> String {
+    let quote = |value: &str| value.replace('\\', "\\\\").replace('"', "\\\"");
+    let mut matchers = vec![];
+    if let Some(namespace) = namespace {
+        matchers.push(format!("container_namespace=\"{}\"", quote(namespace)));
+    }
+    if let Some(pod) = pod {
+        matchers.push(format!("pod_name=~\"{}\"", quote(pod)));
+    }
+    format!("{{{}}}", matchers.join(","))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn pods_are_selected_by_namespace_and_name() {
+        assert_eq!(selector(None, None), "{}");
+        assert_eq!(
+            selector(Some("shop"), Some("checkout-.*")),
+            r#"{container_namespace="shop",pod_name=~"checkout-.*"}"#
+        );
+    }
+
+    #[test]
+    fn pod_power_is_read_from_query_results() -> anyhow::Result<()> {
+        let samples = serde_json::from_str::<Vec<Sample>>(
+            r#"[
+                {
+                    "metric": {"container_namespace": "shop", "pod_name": "checkout-1"},
+                    "value": [1717507590.5, "12.25"]
+                },
+                {"metric": {}, "value": [1717507590.5, "3.5"]}
+            ]"#,
+        )?;
+
+        let metrics = pod_power(&samples, PowerComponent::Cpu)?;
+        assert_eq!(metrics.len(), 1);
+        assert_eq!(metrics[0].process_id.as_deref(), Some("shop/checkout-1"));
+        assert_eq!(metrics[0].power, 12.25);
+        assert_eq!(metrics[0].timestamp, 1717507590500);
+        Ok(())
+    }
+}
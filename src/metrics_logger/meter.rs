@@ -0,0 +1,258 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{push_error, update_metrics_log};
+use crate::{
+    config::MeterDevice,
+    metrics::{MetricsLog, PowerComponent, PowerMetrics},
+};
+use anyhow::{anyhow, Context};
+use std::sync::{Arc, Mutex};
+use tokio::{
+    io::{AsyncReadExt, AsyncWriteExt},
+    net::TcpStream,
+    time::Duration,
+};
+
+/// Kasa plugs don't speak HTTP, they take XOR "encrypted" JSON over TCP on this port.
+const KASA_PORT: u16 = 9999;
+
+/// The longest response read from a Kasa plug, `get_realtime` responses are a few hundred bytes
+/// so anything longer than this isn't a Kasa plug.
+const MAX_KASA_RESPONSE: usize = 64 * 1024;
+
+/// Enters an infinite loop reading the wall power from a smart plug or external power meter and
+/// logging it to the metrics log. The power is attributed to processes by their CPU share when
+/// the run is summarised.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `device` - The kind of meter, each has a different local API
+/// * `host` - The meter's hostname or IP address on the local network
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(device: MeterDevice, host: String, metrics_log: Arc<Mutex<MetricsLog>>) {
+    let client = match reqwest::Client::builder()
+        .timeout(Duration::from_millis(1000))
+        .build()
+    {
+        Ok(client) => client,
+        Err(err) => {
+            push_error(anyhow!("Unable to create HTTP client: {err}"), &metrics_log);
+            return;
+        }
+    };
+    let source = format!("{}:{host}", device.as_str());
+
+    loop {
+        let power = match device {
+            MeterDevice::Tasmota => read_tasmota(&client, &host).await,
+            MeterDevice::Shelly => read_shelly(&client, &host).await,
+            MeterDevice::Kasa => read_kasa(&host).await,
+        };
+        let metrics = power.and_then(|power| {
+            let timestamp = std::time::SystemTime::now()
+                .duration_since(std::time::UNIX_EPOCH)?
+                .as_millis() as i64;
+
+            Ok(PowerMetrics {
+                source: source.clone(),
+                component: PowerComponent::Machine,
+                process_id: None,
+                power,
+                timestamp,
+            })
+        });
+        update_metrics_log(metrics, &metrics_log);
+        tokio::time::sleep(Duration::from_millis(1000)).await;
+    }
+}
+
+async fn read_tasmota(client: &reqwest::Client, host: &str) -> anyhow::Result<f64> {
+    let status = client
+        .get(format!("http://{host}/cm?cmnd=Status%208"))
+        .send()
+        .await?
+        .error_for_status()?
+        .json::<serde_json::Value>()
+        .await
+        .context("Error reading power from Tasmota")?;
+
+    tasmota_power(&status).ok_or(anyhow!("Tasmota didn't report power, is it a power meter?"))
+}
+
+async fn read_shelly(client: &reqwest::Client, host: &str) -> anyhow::Result<f64> {
+    // gen 2+ devices have an RPC API, gen 1 devices only the status endpoint
+    let status = match client
+        .get(format!("http://{host}/rpc/Switch.GetStatus?id=0"))
+        .send()
+        .await
+        .and_then(|res| res.error_for_status())
+    {
+        Ok(res) => res.json::<serde_json::Value>().await?,
+        Err(_) => client
+            .get(format!("http://{host}/status"))
+            .send()
+            .await?
+            .error_for_status()?
+            .json::<serde_json::Value>()
+            .await
+            .context("Error reading power from Shelly")?,
+    };
+
+    shelly_power(&status).ok_or(anyhow!("Shelly didn't report power, is it a power meter?"))
+}
+
+async fn read_kasa(host: &str) -> anyhow::Result<f64> {
+    let timeout = Duration::from_millis(1000);
+    let mut stream = tokio::time::timeout(timeout, TcpStream::connect((host, KASA_PORT)))
+        .await
+        .map_err(|_| anyhow!("Timed out connecting to Kasa plug at {host}"))?
+        .context(format!("Unable to connect to Kasa plug at {host}"))?;
+
+    let request = kasa_encrypt(r#"{"emeter":{"get_realtime":{}}}"#);
+    stream
+        .write_all(&(request.len() as u32).to_be_bytes())
+        .await?;
+    stream.write_all(&request).await?;
+
+    let mut len = [0_u8; 4];
+    tokio::time::timeout(timeout, stream.read_exact(&mut len))
+        .await
+        .map_err(|_| anyhow!("Timed out waiting for Kasa plug at {host}"))??;
+    let len = u32::from_be_bytes(len) as usize;
+    if len > MAX_KASA_RESPONSE {
+        return Err(anyhow!(
+            "Kasa plug at {host} sent a {len} byte response, is it a Kasa plug?"
+        ));
+    }
+    let mut response = vec![0_u8; len];
+    tokio::time::timeout(timeout, stream.read_exact(&mut response))
+        .await
+        .map_err(|_| anyhow!("Timed out waiting for Kasa plug at {host}"))??;
+
+    let realtime = serde_json::from_slice::<serde_json::Value>(&kasa_decrypt(&response))
+        .context("Error parsing Kasa response.")?;
+    kasa_power(&realtime).ok_or(anyhow!(
+        "Kasa plug didn't report power, does it support energy monitoring?"
+    ))
+}
+
+/// # Returns
+///
+/// The power in watts from the response to Tasmota's `Status 8` command
+fn tasmota_power(status: &serde_json::Value) -> Option<f64> {
+    status["StatusSNS"]["ENERGY"]["Power"].as_f64()
+}
+
+/// # Returns
+///
+/// The power in watts from a gen 2 `Switch.GetStatus` or a gen 1 `/status` response
+fn shelly_power(status: &serde_json::Value) -> Option<f64> {
+    status["apower"]
+        .as_f64()
+        .or(status["meters"][0]["power"].as_f64())
+}
+
+/// # Returns
+///
+/// The power in watts from the response to `emeter.get_realtime`, older firmware reports watts
+/// and newer firmware milliwatts
+fn kasa_power(realtime: &serde_json::Value) -> Option<f64> {
+    let realtime = &realtime["emeter"]["get_realtime"];
+    realtime["power"]
+        .as_f64()
+        .or(realtime["power_mw"].as_f64().map(|mw| mw / 1000.0))
+}
+
+/// Kasa's autokey cipher, each byte is XORed with the previous byte of cipher text.
+fn kasa_encrypt(plain: &str) -> Vec<u8> {
+    let mut key = 171_u8;
+    plain
+        .bytes()
+        .map(|byte| {
+            key ^= byte;
+            key
+        })
+        .collect()
+}
+
+fn kasa_decrypt(cipher: &[u8]) -> Vec<u8> {
+    let mut key = 171_u8;
+    cipher
+        .iter()
+        .map(|byte| {
+            let plain = key ^ byte;
+            key = *byte;
+            plain
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn meter_responses_are_parsed() {
+        let tasmota =
+            json!({"StatusSNS": {"Time": "2026-10-14T10:00:00", "ENERGY": {"Power": 42}}});
+        assert_eq!(tasmota_power(&tasmota), Some(42.0));
+
+        let shelly_gen1 = json!({"meters": [{"power": 12.5, "is_valid": true}]});
+        let shelly_gen2 = json!({"id": 0, "output": true, "apower": 30.2});
+        assert_eq!(shelly_power(&shelly_gen1), Some(12.5));
+        assert_eq!(shelly_power(&shelly_gen2), Some(30.2));
+
+        let kasa_old = json!({"emeter": {"get_realtime": {"power": 7.5, "err_code": 0}}});
+        let kasa_new = json!({"emeter": {"get_realtime": {"power_mw": 7500, "err_code": 0}}});
+        assert_eq!(kasa_power(&kasa_old), Some(7.5));
+        assert_eq!(kasa_power(&kasa_new), Some(7.5));
+    }
+
+    #[test]
+    fn kasa_cipher_round_trips() {
+        let plain = r#"{"emeter":{"get_realtime":{}}}"#;
+        let cipher = kasa_encrypt(plain);
+        assert_eq!(cipher[0], b'{' ^ 171);
+        assert_eq!(kasa_decrypt(&cipher), plain.as_bytes());
+    }
+
+    #[tokio::test]
+    async fn kasa_plugs_which_misbehave_are_given_up_on() -> anyhow::Result<()> {
+        // the plug's port is fixed, skip if something else on this host already has it
+        let Ok(listener) = tokio::net::TcpListener::bind(("127.0.0.1", KASA_PORT)).await else {
+            return Ok(());
+        };
+        let plug = tokio::spawn(async move {
+            // a plug which claims a 4GB response
+            let (mut stream, _) = listener.accept().await?;
+            stream.write_all(&u32::MAX.to_be_bytes()).await?;
+            // a plug which never responds
+            let (_stream, _) = listener.accept().await?;
+            tokio::time::sleep(Duration::from_secs(5)).await;
+            Ok::<_, anyhow::Error>(())
+        });
+
+        let err = read_kasa("127.0.0.1").await.unwrap_err();
+        assert!(err.to_string().contains("byte response"), "{err}");
+        let err = read_kasa("127.0.0.1").await.unwrap_err();
+        assert!(err.to_string().contains("Timed out"), "{err}");
+
+        plug.abort();
+        Ok(())
+    }
+}
@@ -0,0 +1,181 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{push_error, update_metrics_log};
+use crate::metrics::{MetricsLog, PowerComponent, PowerMetrics, ResourceMetrics};
+use anyhow::Context;
+use nvml_wrapper::{error::NvmlError, Device, Nvml};
+use std::sync::{Arc, Mutex};
+use tokio::time::{Duration, Instant};
+
+/// Enters an infinite loop reading the power draw of every NVIDIA GPU and logging it to the
+/// metrics log. Each GPU's power is attributed to the observed processes by their share of the
+/// GPU's streaming multiprocessors, as reported by NVML, and that share is logged alongside the
+/// processes' other resource usage.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `pids` - The processes to attribute GPU power to
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(pids: Vec<u32>, metrics_log: Arc<Mutex<MetricsLog>>) {
+    let nvml =
+        match Nvml::init().context("Unable to initialise NVML, is the NVIDIA driver installed?") {
+            Ok(nvml) => nvml,
+            Err(err) => {
+                push_error(err, &metrics_log);
+                return;
+            }
+        };
+    let device_count = match nvml.device_count() {
+        Ok(count) => count,
+        Err(err) => {
+            push_error(
+                anyhow::anyhow!("Unable to count NVIDIA GPUs: {err}"),
+                &metrics_log,
+            );
+            return;
+        }
+    };
+
+    let mut gpus = vec![Gpu::default(); device_count as usize];
+    loop {
+        for (index, gpu) in gpus.iter_mut().enumerate() {
+            update_metrics_log(sample(&nvml, index as u32, &pids, gpu), &metrics_log);
+        }
+        tokio::time::sleep(Duration::from_millis(1000)).await;
+    }
+}
+
+/// What's remembered of a GPU between samples.
+#[derive(Clone, Default)]
+struct Gpu {
+    /// NVML returns utilisation samples newer than the last timestamp seen.
+    last_seen: u64,
+    /// The GPU's energy counter in mJ and when it was read, None until it's first read or if the
+    /// GPU doesn't have one.
+    last_energy: Option<(u64, Instant)>,
+}
+
+/// Reads the average power of a GPU since the last sample from its energy counter, which unlike
+/// `power_usage` doesn't miss the spikes between samples. Falls back to `power_usage` for the
+/// first sample and on GPUs older than Volta, which don't have the counter.
+fn read_power(
+    device: &Device,
+    index: u32,
+    last_energy: &mut Option<(u64, Instant)>,
+) -> anyhow::Result<f64> {
+    let energy = match device.total_energy_consumption() {
+        Ok(energy) => Some((energy, Instant::now())),
+        Err(NvmlError::NotSupported) => None,
+        Err(err) => {
+            return Err(anyhow::anyhow!(
+                "Unable to read the energy consumption of NVIDIA GPU {index}: {err}"
+            ))
+        }
+    };
+
+    let average = match (*last_energy, energy) {
+        (Some((last, last_read)), Some((energy, read))) if energy >= last => {
+            let secs = read.duration_since(last_read).as_secs_f64();
+            (secs > 0.0).then(|| (energy - last) as f64 / 1000.0 / secs)
+        }
+        _ => None,
+    };
+    *last_energy = energy;
+
+    match average {
+        Some(power) => Ok(power),
+        None => Ok(device.power_usage().context(format!(
+            "Unable to read the power usage of NVIDIA GPU {index}"
+        ))? as f64
+            / 1000.0),
+    }
+}
+
+/// Reads the power draw of a GPU along with the utilisation of each observed process.
+///
+/// # Returns
+///
+/// The power of the whole GPU followed by the power attributed to each observed process, and each
+/// observed process's utilisation of the GPU. Every process gets a reading, even when it isn't
+/// using the GPU, so there are no gaps when the readings are integrated.
+fn sample(
+    nvml: &Nvml,
+    index: u32,
+    pids: &[u32],
+    gpu: &mut Gpu,
+) -> anyhow::Result<(Vec<PowerMetrics>, Vec<ResourceMetrics>)> {
+    let device = nvml
+        .device_by_index(index)
+        .context(format!("Unable to open NVIDIA GPU {index}"))?;
+    let power = read_power(&device, index, &mut gpu.last_energy)?;
+
+    // NotFound means no process has used the GPU since the last sample
+    let samples = match device.process_utilization_stats(gpu.last_seen) {
+        Ok(samples) => samples,
+        Err(NvmlError::NotFound) => vec![],
+        Err(err) => {
+            return Err(anyhow::anyhow!(
+                "Unable to read process utilisation of NVIDIA GPU {index}: {err}"
+            ))
+        }
+    };
+    if let Some(timestamp) = samples.iter().map(|s| s.timestamp).max() {
+        gpu.last_seen = timestamp;
+    }
+
+    let timestamp = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)?
+        .as_millis() as i64;
+    let source = format!("nvml:gpu-{index}");
+
+    let mut resource_metrics = vec![];
+    let mut metrics = vec![PowerMetrics {
+        source: source.clone(),
+        component: PowerComponent::Gpu,
+        process_id: None,
+        power,
+        timestamp,
+    }];
+    for pid in pids {
+        let sm_utils = samples
+            .iter()
+            .filter(|s| s.pid == *pid)
+            .map(|s| s.sm_util as f64)
+            .collect::<Vec<_>>();
+        let sm_util = if sm_utils.is_empty() {
+            0.0
+        } else {
+            sm_utils.iter().sum::<f64>() / sm_utils.len() as f64
+        };
+
+        metrics.push(PowerMetrics {
+            source: source.clone(),
+            component: PowerComponent::Gpu,
+            process_id: Some(format!("{pid}")),
+            power: power * sm_util.min(100.0) / 100.0,
+            timestamp,
+        });
+        resource_metrics.push(ResourceMetrics {
+            process_id: format!("{pid}"),
+            gpu_utilisation: Some(sm_util.min(100.0)),
+            timestamp,
+            ..Default::default()
+        });
+    }
+
+    Ok((metrics, resource_metrics))
+}
@@ -0,0 +1,130 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::update_metrics_log;
+use crate::metrics::{MetricsLog, PowerComponent, PowerMetrics};
+use anyhow::{anyhow, Context};
+use std::{
+    collections::HashMap,
+    sync::{Arc, Mutex},
+};
+use tokio::time::Duration;
+
+/// Enters an infinite loop reading the power of a Raspberry Pi 5 from its PMIC using `vcgencmd`
+/// and logging it to the metrics log. The power is attributed to processes by their CPU share
+/// when the run is summarised.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(metrics_log: Arc<Mutex<MetricsLog>>) {
+    loop {
+        let metrics = get_metrics().await;
+        update_metrics_log(metrics, &metrics_log);
+        tokio::time::sleep(Duration::from_millis(1000)).await;
+    }
+}
+
+async fn get_metrics() -> anyhow::Result<PowerMetrics> {
+    let output = tokio::process::Command::new("vcgencmd")
+        .arg("pmic_read_adc")
+        .output()
+        .await
+        .context("Unable to run vcgencmd, is this a Raspberry Pi?")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "vcgencmd failed: {}",
+            String::from_utf8_lossy(&output.stderr)
+        ));
+    }
+    let timestamp = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)?
+        .as_millis() as i64;
+
+    let power = parse_rail_power(&String::from_utf8_lossy(&output.stdout)).ok_or(anyhow!(
+        "vcgencmd didn't report any PMIC rails, only the Pi 5 has a PMIC ADC"
+    ))?;
+
+    Ok(PowerMetrics {
+        source: String::from("pmic"),
+        component: PowerComponent::Machine,
+        process_id: None,
+        power,
+        timestamp,
+    })
+}
+
+/// Sums the power of every rail in the output of `vcgencmd pmic_read_adc`. Each rail is reported
+/// as a current, e.g. `3V3_SYS_A current(1)=0.05563518A`, and a voltage, e.g.
+/// `3V3_SYS_V volt(9)=3.31053400V`.
+///
+/// # Returns
+///
+/// The power in watts, None if the output doesn't contain a rail with both a current and voltage
+fn parse_rail_power(output: &str) -> Option<f64> {
+    let mut currents = HashMap::new();
+    let mut volts = HashMap::new();
+    for line in output.lines() {
+        let Some((name, reading)) = line.trim().split_once(' ') else {
+            continue;
+        };
+        let Some((_, value)) = reading.split_once('=') else {
+            continue;
+        };
+        if let Some(rail) = name.strip_suffix("_A") {
+            if let Some(amps) = value.strip_suffix('A').and_then(|v| v.parse::<f64>().ok()) {
+                currents.insert(rail, amps);
+            }
+        } else if let Some(rail) = name.strip_suffix("_V") {
+            if let Some(volt) = value.strip_suffix('V').and_then(|v| v.parse::<f64>().ok()) {
+                volts.insert(rail, volt);
+            }
+        }
+    }
+
+    let rails = currents
+        .iter()
+        .filter_map(|(rail, amps)| volts.get(rail).map(|volt| amps * volt))
+        .collect::<Vec<_>>();
+    if rails.is_empty() {
+        None
+    } else {
+        Some(rails.iter().sum())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn rail_power_is_summed() {
+        let output = "     3V7_WL_SW_A current(0)=0.10000000A\n\
+                      \x20    3V3_SYS_A current(1)=0.50000000A\n\
+                      \x20    VDD_CORE_A current(7)=2.00000000A\n\
+                      \x20    3V7_WL_SW_V volt(8)=3.70000000V\n\
+                      \x20    3V3_SYS_V volt(9)=3.30000000V\n\
+                      \x20    VDD_CORE_V volt(15)=0.80000000V\n\
+                      \x20    EXT5V_V volt(24)=5.10000000V\n";
+
+        let power = parse_rail_power(output).unwrap();
+        assert!((power - (0.37 + 1.65 + 1.6)).abs() < 1e-9);
+        assert_eq!(
+            parse_rail_power("error=2 error_msg=\"Command not registered\""),
+            None
+        );
+    }
+}
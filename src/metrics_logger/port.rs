@@ -0,0 +1,148 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::{anyhow, Context};
+
+/// Finds the process listening on a TCP port. Linux reads the sockets from `/proc/net`, macOS
+/// asks `lsof` and Windows asks `netstat`.
+///
+/// # Arguments
+///
+/// * `port` - The TCP port the process is listening on
+///
+/// # Returns
+///
+/// The pid of the listening process, None if nothing is listening on the port
+pub fn listening_pid(port: u16) -> anyhow::Result<Option<u32>> {
+    if cfg!(target_os = "linux") {
+        proc_listening_pid(port)
+    } else if cfg!(windows) {
+        let output = command_output("netstat", &["-ano", "-p", "TCP"])?;
+        Ok(netstat_pid(&output, port))
+    } else {
+        let output = command_output(
+            "lsof",
+            &["-nP", "-t", &format!("-iTCP:{port}"), "-sTCP:LISTEN"],
+        )?;
+        Ok(output
+            .lines()
+            .find_map(|line| line.trim().parse::<u32>().ok()))
+    }
+}
+
+fn command_output(command: &str, args: &[&str]) -> anyhow::Result<String> {
+    let output = std::process::Command::new(command)
+        .args(args)
+        .output()
+        .context(format!("Unable to run {command}"))?;
+
+    // lsof exits with 1 when there are no matching sockets
+    Ok(String::from_utf8_lossy(&output.stdout).to_string())
+}
+
+fn proc_listening_pid(port: u16) -> anyhow::Result<Option<u32>> {
+    let mut inodes = vec![];
+    for table in ["/proc/net/tcp", "/proc/net/tcp6"] {
+        if let Ok(contents) = std::fs::read_to_string(table) {
+            inodes.extend(listening_inodes(&contents, port));
+        }
+    }
+    if inodes.is_empty() {
+        return Ok(None);
+    }
+
+    let sockets = inodes
+        .iter()
+        .map(|inode| format!("socket:[{inode}]"))
+        .collect::<Vec<_>>();
+    for entry in std::fs::read_dir("/proc").map_err(|err| anyhow!("Unable to read /proc: {err}"))? {
+        let Ok(entry) = entry else {
+            continue;
+        };
+        let Ok(pid) = entry.file_name().to_string_lossy().parse::<u32>() else {
+            continue;
+        };
+
+        // processes owned by other users can't be inspected without root
+        let Ok(fds) = std::fs::read_dir(entry.path().join("fd")) else {
+            continue;
+        };
+        for fd in fds.flatten() {
+            if let Ok(target) = std::fs::read_link(fd.path()) {
+                if sockets
+                    .iter()
+                    .any(|socket| target.as_os_str() == socket.as_str())
+                {
+                    return Ok(Some(pid));
+                }
+            }
+        }
+    }
+
+    Ok(None)
+}
+
+/// # Returns
+///
+/// The inodes of the sockets listening on the port in a `/proc/net/tcp` table
+fn listening_inodes(table: &str, port: u16) -> Vec<u64> {
+    // sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+    const LISTEN: &str = "0A";
+
+    table
+        .lines()
+        .skip(1)
+        .filter_map(|line| {
+            let fields = line.split_whitespace().collect::<Vec<_>>();
+            let (_, local_port) = fields.get(1)?.rsplit_once(':')?;
+            if u16::from_str_radix(local_port, 16).ok()? != port || *fields.get(3)? != LISTEN {
+                return None;
+            }
+            fields.get(9)?.parse::<u64>().ok()
+        })
+        .collect()
+}
+
+/// # Returns
+///
+/// The pid listening on the port in the output of `netstat -ano`
+fn netstat_pid(output: &str, port: u16) -> Option<u32> {
+    let suffix = format!(":{port}");
+    output.lines().find_map(|line| {
+        let fields = line.split_whitespace().collect::<Vec<_>>();
+        match fields[..] {
+            [_, local, _, "LISTENING", pid] if local.ends_with(&suffix) => pid.parse().ok(),
+            _ => None,
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn listening_sockets_are_found_in_proc() {
+        let table = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n\
+                     \x20  0: 00000000:16A8 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 41235 1 0000000000000000 100 0 0 10 0\n\
+                     \x20  1: 0100007F:16A8 0100007F:D2F0 01 00000000:00000000 00:00000000 00000000  1000        0 41240 1 0000000000000000 20 4 30 10 -1\n\
+                     \x20  2: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 38021 1 0000000000000000 100 0 0 10 0\n";
+
+        assert_eq!(listening_inodes(table, 5800), [41235]);
+        assert_eq!(listening_inodes(table, 8080), [38021]);
+        assert!(listening_inodes(table, 3000).is_empty());
+    }
+
+    #[test]
+    fn listening_sockets_are_found_in_netstat() {
+        let output = "\nActive Connections\n\n  Proto  Local Address          Foreign Address        State           PID\n\
+                      \x20 TCP    0.0.0.0:5800           0.0.0.0:0              LISTENING       4242\n\
+                      \x20 TCP    127.0.0.1:58000        127.0.0.1:5800         ESTABLISHED     1337\n";
+
+        assert_eq!(netstat_pid(output, 5800), Some(4242));
+        assert_eq!(netstat_pid(output, 58000), None);
+    }
+}
@@ -0,0 +1,135 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{push_error, update_metrics_log};
+use crate::metrics::{MetricsLog, PowerComponent, PowerMetrics};
+use anyhow::{anyhow, Context};
+use std::{
+    process::Stdio,
+    sync::{Arc, Mutex},
+};
+use tokio::io::{AsyncBufReadExt, BufReader};
+
+/// Enters an infinite loop reading the CPU, GPU and Neural Engine power reported by macOS's
+/// `powermetrics` tool and logging it to the metrics log. The power is attributed to processes by
+/// their CPU share when the run is summarised.
+///
+/// `powermetrics` keeps running and prints a sample every second, it is killed when this
+/// function's task is cancelled.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(metrics_log: Arc<Mutex<MetricsLog>>) {
+    if let Err(err) = read_powermetrics(&metrics_log).await {
+        push_error(err, &metrics_log);
+    }
+}
+
+async fn read_powermetrics(metrics_log: &Arc<Mutex<MetricsLog>>) -> anyhow::Result<()> {
+    let mut child = tokio::process::Command::new("powermetrics")
+        .args([
+            "--samplers",
+            "cpu_power,gpu_power,ane_power",
+            "--sample-rate",
+            "1000",
+        ])
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .kill_on_drop(true)
+        .spawn()
+        .context("Unable to run powermetrics, it's only available on macOS")?;
+    let stdout = child
+        .stdout
+        .take()
+        .ok_or(anyhow!("Unable to read the output of powermetrics"))?;
+
+    let mut lines = BufReader::new(stdout).lines();
+    while let Some(line) = lines.next_line().await? {
+        let Some((component, power)) = parse_line(&line) else {
+            continue;
+        };
+        let timestamp = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)?
+            .as_millis() as i64;
+
+        update_metrics_log(
+            Ok(PowerMetrics {
+                source: format!("powermetrics:{}", component.as_str()),
+                component,
+                process_id: None,
+                power,
+                timestamp,
+            }),
+            metrics_log,
+        );
+    }
+
+    // powermetrics only exits early if it failed, most likely because it wasn't run as root
+    let status = child.wait().await?;
+    Err(anyhow!(
+        "powermetrics exited with {status}, it must be run as root"
+    ))
+}
+
+/// Reads the power of a component from a line of `powermetrics` output, e.g. `GPU Power: 20 mW`.
+/// Each sample reports the mean power over the sample interval.
+///
+/// # Returns
+///
+/// The component and its power in watts, None if the line isn't a component's power
+fn parse_line(line: &str) -> Option<(PowerComponent, f64)> {
+    let (name, value) = line.split_once(':')?;
+    let component = match name.trim() {
+        "CPU Power" => PowerComponent::Cpu,
+        "GPU Power" => PowerComponent::Gpu,
+        "ANE Power" => PowerComponent::Ane,
+        _ => return None,
+    };
+    let milli_watts = value
+        .trim()
+        .strip_suffix("mW")?
+        .trim()
+        .parse::<f64>()
+        .ok()?;
+
+    Some((component, milli_watts / 1000.0))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn component_power_is_parsed() {
+        let output = "*** Sampled system activity (Mon Oct 14 10:00:00 2026 +0100) (1003.55ms elapsed) ***\n\
+                      E-Cluster Power: 210 mW\n\
+                      CPU Power: 1234 mW\n\
+                      GPU Power: 56 mW\n\
+                      ANE Power: 0 mW\n\
+                      Combined Power (CPU + GPU + ANE): 1290 mW\n";
+
+        let powers = output.lines().filter_map(parse_line).collect::<Vec<_>>();
+        assert_eq!(
+            powers,
+            [
+                (PowerComponent::Cpu, 1.234),
+                (PowerComponent::Gpu, 0.056),
+                (PowerComponent::Ane, 0.0),
+            ]
+        );
+    }
+}
@@ -0,0 +1,248 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{push_error, update_metrics_log, Logged};
+use crate::{
+    config::{PrometheusField, PrometheusQuery},
+    metrics::{CpuMetrics, MetricsLog, PowerComponent, PowerMetrics},
+};
+use anyhow::{anyhow, Context};
+use serde::Deserialize;
+use std::{
+    collections::HashMap,
+    sync::{Arc, Mutex},
+};
+use tokio::time::Duration;
+
+#[derive(Debug, Deserialize)]
+struct QueryResponse {
+    status: String,
+    error: Option<String>,
+    data: Option<QueryData>,
+}
+
+#[derive(Debug, Deserialize)]
+struct QueryData {
+    result: Vec<Sample>,
+}
+
+/// A single series from the result of an instant query.
+#[derive(Debug, Deserialize)]
+pub struct Sample {
+    pub metric: HashMap<String, String>,
+    /// A timestamp in seconds and the sample's value as a string.
+    pub value: (f64, String),
+}
+impl Sample {
+    pub fn timestamp(&self) -> i64 {
+        (self.value.0 * 1000.0) as i64
+    }
+
+    pub fn value(&self) -> anyhow::Result<f64> {
+        self.value
+            .1
+            .parse::<f64>()
+            .context("Prometheus returned a value which isn't a number")
+    }
+}
+
+/// A metric logged from a Prometheus query.
+enum Metrics {
+    Cpu(CpuMetrics),
+    Power(PowerMetrics),
+}
+impl Logged for Metrics {
+    fn push_to(self, metrics_log: &mut MetricsLog) {
+        match self {
+            Metrics::Cpu(metrics) => metrics.push_to(metrics_log),
+            Metrics::Power(metrics) => metrics.push_to(metrics_log),
+        }
+    }
+}
+
+/// Enters an infinite loop running each query against a Prometheus server and logging the
+/// results to the metrics log. This lets cardamon read metrics from exporters which are already
+/// running, e.g. node_exporter or an application's own exporter.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `url` - The base url of the Prometheus server
+/// * `queries` - The queries to run and the metric each of them gives
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(
+    url: String,
+    queries: Vec<PrometheusQuery>,
+    metrics_log: Arc<Mutex<MetricsLog>>,
+) {
+    let client = match client() {
+        Ok(client) => client,
+        Err(err) => {
+            push_error(err, &metrics_log);
+            return;
+        }
+    };
+    let base_url = url.strip_suffix('/').unwrap_or(&url);
+
+    loop {
+        for query in queries.iter() {
+            match instant_query(&client, base_url, &query.query).await {
+                Ok(samples) => samples
+                    .iter()
+                    .for_each(|sample| update_metrics_log(to_metrics(query, sample), &metrics_log)),
+                Err(err) => push_error(err, &metrics_log),
+            }
+        }
+        tokio::time::sleep(Duration::from_millis(1000)).await;
+    }
+}
+
+/// # Returns
+///
+/// A client for querying Prometheus. Queries which take longer than the sample interval fail.
+pub fn client() -> anyhow::Result<reqwest::Client> {
+    reqwest::Client::builder()
+        .timeout(Duration::from_millis(1000))
+        .build()
+        .map_err(|err| anyhow!("Unable to create Prometheus client: {err}"))
+}
+
+/// Runs an instant query against the Prometheus HTTP API.
+///
+/// # Arguments
+///
+/// * `client` - The client to send the query with
+/// * `base_url` - The base url of the Prometheus server, without a trailing slash
+/// * `query` - PromQL which evaluates to an instant vector
+///
+/// # Returns
+///
+/// Every series in the result
+pub async fn instant_query(
+    client: &reqwest::Client,
+    base_url: &str,
+    query: &str,
+) -> anyhow::Result<Vec<Sample>> {
+    let response = client
+        .get(format!("{base_url}/api/v1/query"))
+        .query(&[("query", query)])
+        .send()
+        .await?
+        .json::<QueryResponse>()
+        .await
+        .context("Error querying Prometheus")?;
+
+    samples(response)
+}
+
+fn samples(response: QueryResponse) -> anyhow::Result<Vec<Sample>> {
+    if response.status != "success" {
+        return Err(anyhow!(
+            "Prometheus query failed: {}",
+            response.error.unwrap_or_default()
+        ));
+    }
+    Ok(response.data.map(|data| data.result).unwrap_or_default())
+}
+
+fn to_metrics(query: &PrometheusQuery, sample: &Sample) -> anyhow::Result<Metrics> {
+    let process = match &query.process {
+        Some(label) => Some(sample.metric.get(label).ok_or(anyhow!(
+            "Prometheus series is missing the {label} label of query {}",
+            query.query
+        ))?),
+        None => None,
+    };
+
+    match query.field {
+        PrometheusField::CpuUsage => {
+            let process = process.ok_or(anyhow!(
+                "cpu_usage queries must set the label which identifies the process"
+            ))?;
+            Ok(Metrics::Cpu(CpuMetrics {
+                process_id: process.clone(),
+                process_name: process.clone(),
+                cpu_usage: sample.value()?,
+                core_count: query.core_count,
+                timestamp: sample.timestamp(),
+            }))
+        }
+
+        PrometheusField::Power => Ok(Metrics::Power(PowerMetrics {
+            source: String::from("prometheus"),
+            component: query.component.unwrap_or(PowerComponent::Machine),
+            process_id: process.cloned(),
+            power: sample.value()?,
+            timestamp: sample.timestamp(),
+        })),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn query_results_map_to_metrics() -> anyhow::Result<()> {
+        let response = serde_json::from_str::<QueryResponse>(
+            r#"{
+                "status": "success",
+                "data": {
+                    "resultType": "vector",
+                    "result": [{"metric": {"job": "api"}, "value": [1717507590.5, "150"]}]
+                }
+            }"#,
+        )?;
+        let series = samples(response)?;
+        assert_eq!(series.len(), 1);
+
+        let cpu_query = PrometheusQuery {
+            query: String::from("rate(process_cpu_seconds_total[1m]) * 100"),
+            field: PrometheusField::CpuUsage,
+            process: Some(String::from("job")),
+            component: None,
+            core_count: 4,
+        };
+        match to_metrics(&cpu_query, &series[0])? {
+            Metrics::Cpu(metrics) => {
+                assert_eq!(metrics.process_id, "api");
+                assert_eq!(metrics.cpu_usage, 150.0);
+                assert_eq!(metrics.core_count, 4);
+                assert_eq!(metrics.timestamp, 1717507590500);
+            }
+            Metrics::Power(_) => panic!("expected cpu metrics"),
+        }
+
+        let power_query = PrometheusQuery {
+            field: PrometheusField::Power,
+            process: None,
+            ..cpu_query
+        };
+        match to_metrics(&power_query, &series[0])? {
+            Metrics::Power(metrics) => {
+                assert_eq!(metrics.component, PowerComponent::Machine);
+                assert_eq!(metrics.process_id, None);
+                assert_eq!(metrics.power, 150.0);
+            }
+            Metrics::Cpu(_) => panic!("expected power metrics"),
+        }
+
+        let error = serde_json::from_str::<QueryResponse>(
+            r#"{"status": "error", "errorType": "bad_data", "error": "parse error"}"#,
+        )?;
+        assert!(samples(error).is_err());
+        Ok(())
+    }
+}
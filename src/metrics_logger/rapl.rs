@@ -0,0 +1,379 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{push_error, update_metrics_log};
+use crate::{
+    config::RaplInterface,
+    metrics::{MetricsLog, PowerComponent, PowerMetrics},
+};
+use anyhow::{anyhow, Context};
+use std::{
+    fs,
+    path::{Path, PathBuf},
+    sync::{Arc, Mutex},
+};
+use tokio::time::Duration;
+
+const POWERCAP_PATH: &str = "/sys/class/powercap";
+
+/// Energy status MSRs are 32 bit counters.
+const MSR_COUNTER_RANGE: f64 = 4_294_967_296.0;
+
+/// Server CPUs, the only Intel CPUs with a DRAM domain, count DRAM energy in a fixed unit rather
+/// than the unit given by the power unit MSR.
+const DRAM_JOULES_PER_COUNT: f64 = 0.000_015_3;
+
+/// Where to find the RAPL MSRs, addresses differ between vendors.
+struct MsrRegisters {
+    power_unit: u64,
+    package_energy: u64,
+    /// AMD CPUs have no DRAM domain.
+    dram_energy: Option<u64>,
+}
+const INTEL_MSR_REGISTERS: MsrRegisters = MsrRegisters {
+    power_unit: 0x606,
+    package_energy: 0x611,
+    dram_energy: Some(0x619),
+};
+const AMD_MSR_REGISTERS: MsrRegisters = MsrRegisters {
+    power_unit: 0xC001_0299,
+    package_energy: 0xC001_029B,
+    dram_energy: None,
+};
+
+enum Reader {
+    /// A powercap zone, `energy_uj` counts microjoules.
+    Powercap { energy_path: PathBuf },
+
+    /// An energy MSR of one CPU in the package, counts in units of `joules_per_count`.
+    Msr {
+        msr_path: PathBuf,
+        register: u64,
+        joules_per_count: f64,
+    },
+}
+
+/// A single RAPL energy counter, e.g. the counter for CPU package 0 or the memory attached to it.
+struct Counter {
+    source: String,
+    component: PowerComponent,
+    reader: Reader,
+    /// The value at which the counter wraps back to 0, in joules.
+    range: f64,
+    previous: Option<(f64, i64)>,
+}
+impl Counter {
+    fn read_joules(&self) -> anyhow::Result<f64> {
+        match &self.reader {
+            Reader::Powercap { energy_path } => {
+                let micro_joules = fs::read_to_string(energy_path)
+                    .context(format!(
+                        "Unable to read {}, reading RAPL counters usually requires root",
+                        energy_path.display()
+                    ))?
+                    .trim()
+                    .parse::<f64>()?;
+                Ok(micro_joules / 1_000_000.0)
+            }
+
+            Reader::Msr {
+                msr_path,
+                register,
+                joules_per_count,
+            } => {
+                let counts = read_msr(msr_path, *register)? & 0xFFFF_FFFF;
+                Ok(counts as f64 * joules_per_count)
+            }
+        }
+    }
+
+    /// Reads the counter and works out the mean power since the previous reading.
+    ///
+    /// # Returns
+    /// The power since the previous reading, None if this is the first reading
+    fn sample(&mut self) -> anyhow::Result<Option<PowerMetrics>> {
+        let joules = self.read_joules()?;
+        let timestamp = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)?
+            .as_millis() as i64;
+
+        let metrics = self.previous.and_then(|(prev_joules, prev_timestamp)| {
+            let secs = (timestamp - prev_timestamp) as f64 / 1000.0;
+            if secs <= 0.0 {
+                return None;
+            }
+
+            // the counter wraps around once it reaches its range
+            let delta = if joules >= prev_joules {
+                joules - prev_joules
+            } else {
+                joules + self.range - prev_joules
+            };
+
+            Some(PowerMetrics {
+                source: self.source.clone(),
+                component: self.component,
+                process_id: None,
+                power: delta / secs,
+                timestamp,
+            })
+        });
+        self.previous = Some((joules, timestamp));
+
+        Ok(metrics)
+    }
+}
+
+/// Enters an infinite loop reading the RAPL package energy counters of every CPU package and
+/// logging the power of each package to the metrics log. The power is attributed to processes
+/// by their CPU share when the run is summarised. Where the CPU has a DRAM domain the power of
+/// the memory attached to each package is logged too, it's attributed by memory share instead.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `interface` - How to read the RAPL counters
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(interface: RaplInterface, metrics_log: Arc<Mutex<MetricsLog>>) {
+    let counters = match interface {
+        RaplInterface::Powercap => powercap_counters(Path::new(POWERCAP_PATH)),
+        RaplInterface::Msr => msr_counters(),
+    };
+    let mut counters = match counters {
+        Ok(counters) => counters,
+        Err(err) => {
+            push_error(err, &metrics_log);
+            return;
+        }
+    };
+
+    loop {
+        for counter in counters.iter_mut() {
+            if let Some(metrics) = counter.sample().transpose() {
+                update_metrics_log(metrics, &metrics_log);
+            }
+        }
+        tokio::time::sleep(Duration::from_millis(1000)).await;
+    }
+}
+
+/// Finds the package and DRAM zones exposed by the powercap framework. Top level zones are named
+/// `intel-rapl:<package>`, on AMD CPUs too. The DRAM zone is a sub-zone of its package, e.g.
+/// `intel-rapl:0:2` named `dram`, other sub-zones such as `core` are already counted by the
+/// package and are skipped.
+fn powercap_counters(powercap_path: &Path) -> anyhow::Result<Vec<Counter>> {
+    let mut counters = vec![];
+    let entries = fs::read_dir(powercap_path).context(format!(
+        "Unable to find RAPL counters in {}, is the intel_rapl kernel module loaded?",
+        powercap_path.display()
+    ))?;
+
+    for entry in entries {
+        let zone_path = entry?.path();
+        let Some(zone) = zone_path
+            .file_name()
+            .and_then(|name| name.to_str())
+            .and_then(|name| name.strip_prefix("intel-rapl:"))
+            .map(String::from)
+        else {
+            continue;
+        };
+
+        let name = fs::read_to_string(zone_path.join("name"))?;
+        let (source, component) = match zone.split_once(':') {
+            None => (format!("rapl:{}", name.trim()), PowerComponent::Cpu),
+            Some((package, _)) if name.trim() == "dram" => {
+                (format!("rapl:dram-{package}"), PowerComponent::Dram)
+            }
+            Some(_) => continue,
+        };
+        let range = fs::read_to_string(zone_path.join("max_energy_range_uj"))?
+            .trim()
+            .parse::<f64>()?;
+
+        counters.push(Counter {
+            source,
+            component,
+            reader: Reader::Powercap {
+                energy_path: zone_path.join("energy_uj"),
+            },
+            range: range / 1_000_000.0,
+            previous: None,
+        });
+    }
+
+    if counters.is_empty() {
+        return Err(anyhow!(
+            "No RAPL package zones found in {}",
+            powercap_path.display()
+        ));
+    }
+    counters.sort_by(|a, b| a.source.cmp(&b.source));
+
+    Ok(counters)
+}
+
+/// Finds one CPU in each package and creates a counter reading its package energy MSR, and its
+/// DRAM energy MSR if the CPU has one.
+fn msr_counters() -> anyhow::Result<Vec<Counter>> {
+    let cpuinfo = fs::read_to_string("/proc/cpuinfo").context("Unable to read /proc/cpuinfo")?;
+    let registers = if cpuinfo.contains("GenuineIntel") {
+        INTEL_MSR_REGISTERS
+    } else if cpuinfo.contains("AuthenticAMD") || cpuinfo.contains("HygonGenuine") {
+        AMD_MSR_REGISTERS
+    } else {
+        return Err(anyhow!(
+            "RAPL MSRs are only available on Intel and AMD CPUs"
+        ));
+    };
+
+    // the first cpu found in each package
+    let mut packages: Vec<(u32, u32)> = vec![];
+    for entry in fs::read_dir("/sys/devices/system/cpu")? {
+        let path = entry?.path();
+        let Some(cpu) = path
+            .file_name()
+            .and_then(|name| name.to_str())
+            .and_then(|name| name.strip_prefix("cpu"))
+            .and_then(|cpu| cpu.parse::<u32>().ok())
+        else {
+            continue;
+        };
+
+        // offline CPUs have no topology and hotplugged ones may lose it while it's read
+        let Some(package) = fs::read_to_string(path.join("topology/physical_package_id"))
+            .ok()
+            .and_then(|package| package.trim().parse::<u32>().ok())
+        else {
+            tracing::debug!("Skipping cpu{cpu}, its package can't be read");
+            continue;
+        };
+        match packages.iter_mut().find(|(p, _)| *p == package) {
+            Some((_, first_cpu)) => *first_cpu = cpu.min(*first_cpu),
+            None => packages.push((package, cpu)),
+        }
+    }
+    if packages.is_empty() {
+        return Err(anyhow!(
+            "Unable to read the package of any CPU from /sys/devices/system/cpu"
+        ));
+    }
+    packages.sort();
+
+    let mut counters = vec![];
+    for (package, cpu) in packages {
+        let msr_path = PathBuf::from(format!("/dev/cpu/{cpu}/msr"));
+        let power_unit = read_msr(&msr_path, registers.power_unit)?;
+
+        // bits 12:8 give the energy unit as 1 / 2^n joules
+        let joules_per_count = 1.0 / (1_u64 << ((power_unit >> 8) & 0x1F)) as f64;
+
+        counters.push(Counter {
+            source: format!("rapl:package-{package}"),
+            component: PowerComponent::Cpu,
+            reader: Reader::Msr {
+                msr_path: msr_path.clone(),
+                register: registers.package_energy,
+                joules_per_count,
+            },
+            range: MSR_COUNTER_RANGE * joules_per_count,
+            previous: None,
+        });
+
+        // client CPUs fail to read the DRAM MSR
+        if let Some(dram_energy) = registers.dram_energy {
+            if read_msr(&msr_path, dram_energy).is_ok() {
+                counters.push(Counter {
+                    source: format!("rapl:dram-{package}"),
+                    component: PowerComponent::Dram,
+                    reader: Reader::Msr {
+                        msr_path,
+                        register: dram_energy,
+                        joules_per_count: DRAM_JOULES_PER_COUNT,
+                    },
+                    range: MSR_COUNTER_RANGE * DRAM_JOULES_PER_COUNT,
+                    previous: None,
+                });
+            }
+        }
+    }
+
+    Ok(counters)
+}
+
+#[cfg(unix)]
+fn read_msr(msr_path: &Path, register: u64) -> anyhow::Result<u64> {
+    use std::os::unix::fs::FileExt;
+
+    let file = fs::File::open(msr_path).context(format!(
+        "Unable to open {}, is the msr kernel module loaded and is cardamon running as root?",
+        msr_path.display()
+    ))?;
+    let mut buf = [0_u8; 8];
+    file.read_exact_at(&mut buf, register)
+        .context(format!("Unable to read MSR {register:#x}"))?;
+
+    Ok(u64::from_le_bytes(buf))
+}
+
+#[cfg(not(unix))]
+fn read_msr(_msr_path: &Path, _register: u64) -> anyhow::Result<u64> {
+    Err(anyhow!("Reading RAPL MSRs is only supported on Linux"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn powercap_package_and_dram_zones_are_found_and_wrap() -> anyhow::Result<()> {
+        let powercap_path =
+            std::env::temp_dir().join(format!("cardamon-rapl-{}", nanoid::nanoid!(5)));
+        for (zone, name, energy) in [
+            ("intel-rapl:0", "package-0", "999000000"),
+            ("intel-rapl:0:0", "core", "1"),
+            ("intel-rapl:0:1", "dram", "2000000"),
+        ] {
+            let zone_path = powercap_path.join(zone);
+            fs::create_dir_all(&zone_path)?;
+            fs::write(zone_path.join("name"), format!("{name}\n"))?;
+            fs::write(zone_path.join("energy_uj"), energy)?;
+            fs::write(zone_path.join("max_energy_range_uj"), "1000000000")?;
+        }
+
+        let mut counters = powercap_counters(&powercap_path)?;
+        assert_eq!(counters.len(), 2);
+        assert_eq!(counters[0].source, "rapl:dram-0");
+        assert_eq!(counters[0].component, PowerComponent::Dram);
+        assert!(counters[0].sample()?.is_none());
+
+        let mut counters = counters.split_off(1);
+        assert_eq!(counters[0].source, "rapl:package-0");
+        assert_eq!(counters[0].component, PowerComponent::Cpu);
+        assert!(counters[0].sample()?.is_none());
+
+        // 999J -> 1000J (wraps to 0) -> 5J
+        fs::write(powercap_path.join("intel-rapl:0/energy_uj"), "5000000")?;
+        let (joules, timestamp) = counters[0].previous.unwrap();
+        counters[0].previous = Some((joules, timestamp - 2000));
+        let metrics = counters[0]
+            .sample()?
+            .expect("should have a previous reading");
+        assert!((metrics.power - 3.0).abs() < 0.1);
+
+        fs::remove_dir_all(powercap_path)?;
+        Ok(())
+    }
+}
@@ -0,0 +1,114 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{push_error, update_metrics_log};
+use crate::metrics::{MetricsLog, PowerComponent, PowerMetrics};
+use anyhow::{anyhow, Context};
+use serde::Deserialize;
+use std::sync::{Arc, Mutex};
+use tokio::time::Duration;
+
+#[derive(Debug, Deserialize)]
+struct Power {
+    #[serde(rename = "PowerControl", default)]
+    power_control: Vec<PowerControl>,
+}
+
+#[derive(Debug, Deserialize)]
+struct PowerControl {
+    #[serde(rename = "PowerConsumedWatts")]
+    power_consumed_watts: Option<f64>,
+}
+
+/// Enters an infinite loop reading the power of the whole machine from its BMC's Redfish API and
+/// logging it to the metrics log. The power is attributed to processes by their CPU share when
+/// the run is summarised.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `url` - The BMC's base url
+/// * `username` - The BMC user
+/// * `password` - The BMC user's password
+/// * `chassis` - The id of the chassis the machine is in
+/// * `insecure` - Accept invalid certificates
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(
+    url: String,
+    username: Option<String>,
+    password: Option<String>,
+    chassis: String,
+    insecure: bool,
+    metrics_log: Arc<Mutex<MetricsLog>>,
+) {
+    let client = match reqwest::Client::builder()
+        .timeout(Duration::from_millis(1000))
+        .danger_accept_invalid_certs(insecure)
+        .build()
+    {
+        Ok(client) => client,
+        Err(err) => {
+            push_error(
+                anyhow!("Unable to create Redfish client: {err}"),
+                &metrics_log,
+            );
+            return;
+        }
+    };
+    let base_url = url.strip_suffix('/').unwrap_or(&url);
+    let power_url = format!("{base_url}/redfish/v1/Chassis/{chassis}/Power");
+    let source = format!("redfish:{chassis}");
+
+    loop {
+        let mut request = client.get(&power_url);
+        if let Some(username) = &username {
+            request = request.basic_auth(username, password.as_ref());
+        }
+        let metrics = get_metrics(request, &source).await;
+        update_metrics_log(metrics, &metrics_log);
+        tokio::time::sleep(Duration::from_millis(1000)).await;
+    }
+}
+
+async fn get_metrics(
+    request: reqwest::RequestBuilder,
+    source: &str,
+) -> anyhow::Result<PowerMetrics> {
+    let power = request
+        .send()
+        .await?
+        .error_for_status()?
+        .json::<Power>()
+        .await
+        .context("Error fetching power from Redfish")?;
+    let timestamp = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)?
+        .as_millis() as i64;
+
+    // the first power control covers the whole chassis
+    let power = power
+        .power_control
+        .first()
+        .and_then(|control| control.power_consumed_watts)
+        .ok_or(anyhow!("Redfish didn't report the power consumed"))?;
+
+    Ok(PowerMetrics {
+        source: String::from(source),
+        component: PowerComponent::Machine,
+        process_id: None,
+        power,
+        timestamp,
+    })
+}
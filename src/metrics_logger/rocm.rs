@@ -0,0 +1,365 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{push_error, update_metrics_log};
+use crate::{
+    config::RocmInterface,
+    metrics::{MetricsLog, PowerComponent, PowerMetrics},
+};
+use anyhow::{anyhow, Context};
+use std::{
+    collections::HashMap,
+    fs,
+    path::{Path, PathBuf},
+    sync::{Arc, Mutex},
+};
+use tokio::time::Duration;
+
+const DRM_PATH: &str = "/sys/class/drm";
+
+const AMD_VENDOR_ID: &str = "0x1002";
+
+/// An AMD GPU along with the busy time of each observed process at the previous sample.
+struct Gpu {
+    /// The DRM card name, e.g. `card0`, rocm-smi uses the same names.
+    card: String,
+    /// The PCI address of the GPU, used to match the GPU to a process's DRM clients.
+    pci_address: String,
+    /// Average power in microwatts, None if hwmon doesn't report power for this GPU.
+    power_path: Option<PathBuf>,
+    previous: Option<(HashMap<u32, u64>, i64)>,
+}
+impl Gpu {
+    /// Works out the share of the GPU each process used since the previous sample and attributes
+    /// the GPU's power by that share.
+    ///
+    /// # Returns
+    ///
+    /// The power of the whole GPU followed by the power attributed to each observed process. The
+    /// processes are skipped on the first sample as there is nothing to compare their busy time to.
+    fn sample(&mut self, power: f64, pids: &[u32]) -> anyhow::Result<Vec<PowerMetrics>> {
+        let timestamp = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)?
+            .as_millis() as i64;
+        let source = format!("rocm:{}", self.card);
+        let busy = pids
+            .iter()
+            .map(|pid| (*pid, busy_ns(*pid, &self.pci_address)))
+            .collect::<HashMap<_, _>>();
+
+        let mut metrics = vec![PowerMetrics {
+            source: source.clone(),
+            component: PowerComponent::Gpu,
+            process_id: None,
+            power,
+            timestamp,
+        }];
+        if let Some((prev_busy, prev_timestamp)) = &self.previous {
+            let elapsed_ns = (timestamp - prev_timestamp) as f64 * 1_000_000.0;
+            for pid in pids {
+                let busy_ns = busy[pid].saturating_sub(prev_busy.get(pid).copied().unwrap_or(0));
+                let share = if elapsed_ns > 0.0 {
+                    (busy_ns as f64 / elapsed_ns).min(1.0)
+                } else {
+                    0.0
+                };
+
+                metrics.push(PowerMetrics {
+                    source: source.clone(),
+                    component: PowerComponent::Gpu,
+                    process_id: Some(format!("{pid}")),
+                    power: power * share,
+                    timestamp,
+                });
+            }
+        }
+        self.previous = Some((busy, timestamp));
+
+        Ok(metrics)
+    }
+}
+
+/// Enters an infinite loop reading the power draw of every AMD GPU and logging it to the metrics
+/// log. Each GPU's power is attributed to the observed processes by how long they kept the GPU's
+/// graphics and compute engines busy.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `interface` - How to read the GPU power
+/// * `pids` - The processes to attribute GPU power to
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(
+    interface: RocmInterface,
+    pids: Vec<u32>,
+    metrics_log: Arc<Mutex<MetricsLog>>,
+) {
+    let mut gpus = match find_gpus(Path::new(DRM_PATH)) {
+        Ok(gpus) => gpus,
+        Err(err) => {
+            push_error(err, &metrics_log);
+            return;
+        }
+    };
+
+    loop {
+        let powers = match interface {
+            RocmInterface::Hwmon => Ok(gpus
+                .iter()
+                .map(|gpu| read_hwmon_power(gpu))
+                .collect::<Vec<_>>()),
+            RocmInterface::RocmSmi => read_rocm_smi_power().await.map(|powers| {
+                gpus.iter()
+                    .map(|gpu| {
+                        powers
+                            .get(&gpu.card)
+                            .copied()
+                            .ok_or(anyhow!("rocm-smi didn't report power for {}", gpu.card))
+                    })
+                    .collect::<Vec<_>>()
+            }),
+        };
+
+        match powers {
+            Ok(powers) => {
+                for (gpu, power) in gpus.iter_mut().zip(powers) {
+                    match power.and_then(|power| gpu.sample(power, &pids)) {
+                        Ok(metrics) => metrics
+                            .into_iter()
+                            .for_each(|metrics| update_metrics_log(Ok(metrics), &metrics_log)),
+                        Err(err) => push_error(err, &metrics_log),
+                    }
+                }
+            }
+            Err(err) => push_error(err, &metrics_log),
+        }
+        tokio::time::sleep(Duration::from_millis(1000)).await;
+    }
+}
+
+/// Finds the AMD GPUs exposed by the DRM subsystem. Cards are named `card<n>`, connectors such
+/// as `card0-DP-1` are skipped.
+fn find_gpus(drm_path: &Path) -> anyhow::Result<Vec<Gpu>> {
+    let mut gpus = vec![];
+    let entries = fs::read_dir(drm_path).context(format!(
+        "Unable to find GPUs in {}, is the amdgpu kernel module loaded?",
+        drm_path.display()
+    ))?;
+
+    for entry in entries {
+        let card_path = entry?.path();
+        let Some(card) = card_path
+            .file_name()
+            .and_then(|name| name.to_str())
+            .filter(|name| {
+                name.strip_prefix("card")
+                    .is_some_and(|n| n.parse::<u32>().is_ok())
+            })
+            .map(String::from)
+        else {
+            continue;
+        };
+
+        let device_path = card_path.join("device");
+        let vendor = fs::read_to_string(device_path.join("vendor")).unwrap_or_default();
+        if vendor.trim() != AMD_VENDOR_ID {
+            continue;
+        }
+
+        // the device is a link to the GPU's directory on the PCI bus
+        let pci_address = fs::canonicalize(&device_path)?
+            .file_name()
+            .and_then(|name| name.to_str())
+            .map(String::from)
+            .ok_or(anyhow!("Unable to find the PCI address of {card}"))?;
+
+        let mut power_path = None;
+        if let Ok(hwmons) = fs::read_dir(device_path.join("hwmon")) {
+            for hwmon in hwmons {
+                let hwmon_path = hwmon?.path();
+                power_path = ["power1_average", "power1_input"]
+                    .iter()
+                    .map(|file| hwmon_path.join(file))
+                    .find(|path| path.exists());
+                if power_path.is_some() {
+                    break;
+                }
+            }
+        }
+
+        gpus.push(Gpu {
+            card,
+            pci_address,
+            power_path,
+            previous: None,
+        });
+    }
+
+    if gpus.is_empty() {
+        return Err(anyhow!("No AMD GPUs found in {}", drm_path.display()));
+    }
+    gpus.sort_by(|a, b| a.card.cmp(&b.card));
+
+    Ok(gpus)
+}
+
+fn read_hwmon_power(gpu: &Gpu) -> anyhow::Result<f64> {
+    let power_path = gpu.power_path.as_ref().ok_or(anyhow!(
+        "hwmon doesn't report power for {}, try the rocm-smi interface",
+        gpu.card
+    ))?;
+    let micro_watts = fs::read_to_string(power_path)
+        .context(format!("Unable to read {}", power_path.display()))?
+        .trim()
+        .parse::<f64>()?;
+
+    Ok(micro_watts / 1_000_000.0)
+}
+
+/// Runs `rocm-smi --showpower --json` and reads the power of each card.
+///
+/// # Returns
+///
+/// The power of each card in watts keyed by card name, e.g. `card0`
+async fn read_rocm_smi_power() -> anyhow::Result<HashMap<String, f64>> {
+    let output = tokio::process::Command::new("rocm-smi")
+        .args(["--showpower", "--json"])
+        .output()
+        .await
+        .context("Unable to run rocm-smi, is ROCm installed?")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "rocm-smi failed: {}",
+            String::from_utf8_lossy(&output.stderr)
+        ));
+    }
+
+    parse_rocm_smi_power(&String::from_utf8_lossy(&output.stdout))
+}
+
+/// The name of the power field differs between ROCm versions, e.g. "Average Graphics Package
+/// Power (W)" or "Current Socket Graphics Package Power (W)", so any power field in watts is used.
+fn parse_rocm_smi_power(json: &str) -> anyhow::Result<HashMap<String, f64>> {
+    let cards = serde_json::from_str::<HashMap<String, HashMap<String, serde_json::Value>>>(json)
+        .context("Error parsing rocm-smi output.")?;
+
+    let mut powers = HashMap::new();
+    for (card, fields) in cards {
+        let power = fields
+            .iter()
+            .filter(|(field, _)| field.contains("Power (W)"))
+            .find_map(|(_, value)| match value {
+                serde_json::Value::String(value) => value.trim().parse::<f64>().ok(),
+                value => value.as_f64(),
+            });
+        if let Some(power) = power {
+            powers.insert(card, power);
+        }
+    }
+
+    Ok(powers)
+}
+
+/// Sums the time a process has kept the graphics and compute engines of a GPU busy. The amdgpu
+/// driver reports this per DRM client in `/proc/<pid>/fdinfo`, a client can be open through
+/// several file descriptors so each client is only counted once.
+///
+/// # Returns
+///
+/// The busy time in nanoseconds, 0 if the process isn't using the GPU or can't be read
+fn busy_ns(pid: u32, pci_address: &str) -> u64 {
+    let Ok(entries) = fs::read_dir(format!("/proc/{pid}/fdinfo")) else {
+        return 0;
+    };
+
+    let mut busy_by_client = HashMap::new();
+    for entry in entries.flatten() {
+        let Ok(fdinfo) = fs::read_to_string(entry.path()) else {
+            continue;
+        };
+        if let Some((client_id, pdev, busy_ns)) = parse_fdinfo(&fdinfo) {
+            if pdev == pci_address {
+                busy_by_client.insert(client_id, busy_ns);
+            }
+        }
+    }
+
+    busy_by_client.values().sum()
+}
+
+/// # Returns
+///
+/// The client id, PCI address and busy time in nanoseconds of an amdgpu DRM client, None if the
+/// file descriptor isn't an amdgpu client
+fn parse_fdinfo(fdinfo: &str) -> Option<(String, String, u64)> {
+    let fields = fdinfo
+        .lines()
+        .filter_map(|line| line.split_once(':'))
+        .map(|(key, value)| (key.trim(), value.trim()))
+        .collect::<Vec<_>>();
+    let field = |name: &str| {
+        fields
+            .iter()
+            .find(|(key, _)| *key == name)
+            .map(|(_, value)| *value)
+    };
+
+    if field("drm-driver") != Some("amdgpu") {
+        return None;
+    }
+    let client_id = field("drm-client-id")?;
+    let pdev = field("drm-pdev")?;
+    let busy_ns = ["drm-engine-gfx", "drm-engine-compute"]
+        .iter()
+        .filter_map(|engine| field(engine))
+        .filter_map(|value| value.trim_end_matches("ns").trim().parse::<u64>().ok())
+        .sum();
+
+    Some((String::from(client_id), String::from(pdev), busy_ns))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn amdgpu_clients_are_parsed_from_fdinfo() {
+        let fdinfo = "pos:\t0\nflags:\t02100002\ndrm-driver:\tamdgpu\ndrm-pdev:\t0000:03:00.0\n\
+                      drm-client-id:\t42\ndrm-engine-gfx:\t1500 ns\ndrm-engine-compute:\t500 ns\n\
+                      drm-engine-dec:\t100 ns\n";
+        assert_eq!(
+            parse_fdinfo(fdinfo),
+            Some((String::from("42"), String::from("0000:03:00.0"), 2000))
+        );
+
+        let not_a_gpu = "pos:\t0\nflags:\t02100002\n";
+        assert_eq!(parse_fdinfo(not_a_gpu), None);
+    }
+
+    #[test]
+    fn rocm_smi_power_is_read_from_any_power_field() -> anyhow::Result<()> {
+        let json = r#"{
+            "card0": {"Average Graphics Package Power (W)": "35.0"},
+            "card1": {"Current Socket Graphics Package Power (W)": "120.5"},
+            "system": {"Driver version": "6.3.6"}
+        }"#;
+
+        let powers = parse_rocm_smi_power(json)?;
+        assert_eq!(powers.len(), 2);
+        assert_eq!(powers["card0"], 35.0);
+        assert_eq!(powers["card1"], 120.5);
+        Ok(())
+    }
+}
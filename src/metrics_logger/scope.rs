@@ -0,0 +1,127 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{
+    cgroup::{self, CgroupSampler},
+    update_metrics_log,
+};
+use crate::metrics::{CpuMetrics, MetricsLog, ResourceMetrics};
+use anyhow::Context;
+use std::{
+    process::Stdio,
+    sync::{Arc, Mutex},
+};
+use tokio::time::Duration;
+
+/// A process started in a cgroup of its own.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Scope {
+    pub name: String,
+    /// The pid of the process that was started, it may have exited and left its children in the
+    /// cgroup.
+    pub pid: u32,
+    /// The path of the cgroup in the unified hierarchy.
+    pub path: String,
+    /// The transient systemd unit of the cgroup, e.g. `cardamon-server-x1y2z.scope`.
+    pub unit: String,
+    /// Whether the unit belongs to the user's systemd manager rather than the system's.
+    pub user: bool,
+}
+impl Scope {
+    /// Stops the unit, which stops everything in the cgroup including processes that detached
+    /// from the one that was started. A unit that's already gone has nothing left to stop.
+    pub async fn stop(&self) -> anyhow::Result<()> {
+        let mut command = tokio::process::Command::new("systemctl");
+        if self.user {
+            command.arg("--user");
+        }
+        let output = command
+            .args(["stop", &self.unit])
+            .stdout(Stdio::null())
+            .output()
+            .await
+            .context("Failed to run systemctl, is systemd installed?")?;
+
+        // systemctl exits with 5 if the unit isn't loaded, a collected scope has already stopped
+        match output.status.code() {
+            Some(0) | Some(5) => Ok(()),
+            _ => Err(anyhow::anyhow!(
+                "Unable to stop {}: {}",
+                self.unit,
+                String::from_utf8_lossy(&output.stderr).trim()
+            )),
+        }
+    }
+}
+
+/// Enters an infinite loop logging metrics for each cgroup to the metrics log. Everything in
+/// the cgroup is accounted for, so processes which detach from the process tree, such as
+/// daemons and double forked browsers, are still observed. Metrics are logged against the pid
+/// of the process that was started even if it has exited.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `scopes` - The processes to observe and the cgroups they were started in
+/// * `sample_interval` - How long to wait between samples
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(
+    scopes: Vec<Scope>,
+    sample_interval: Duration,
+    metrics_log: Arc<Mutex<MetricsLog>>,
+) {
+    let core_count = std::thread::available_parallelism()
+        .map(|cores| cores.get() as i32)
+        .unwrap_or(0);
+    let mut sampler = CgroupSampler::new();
+
+    loop {
+        tokio::time::sleep(sample_interval).await;
+        for scope in scopes.iter() {
+            let metrics = get_metrics(scope, core_count, &mut sampler);
+            update_metrics_log(metrics, &metrics_log);
+        }
+    }
+}
+
+fn get_metrics(
+    scope: &Scope,
+    core_count: i32,
+    sampler: &mut CgroupSampler,
+) -> anyhow::Result<(CpuMetrics, ResourceMetrics)> {
+    let cpu_usage = sampler.unified_cpu_usage(&scope.path)?;
+    let timestamp = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)?
+        .as_millis() as i64;
+
+    let resource_metrics = ResourceMetrics {
+        process_id: scope.pid.to_string(),
+        disk_io: cgroup::unified_disk_io(&scope.path).ok(),
+        memory_bytes: cgroup::unified_memory_bytes(&scope.path).ok(),
+        memory_total: cgroup::host_memory_bytes(),
+        throttling: cgroup::unified_throttling(&scope.path).ok(),
+        timestamp,
+        ..Default::default()
+    };
+    let metrics = CpuMetrics {
+        process_id: scope.pid.to_string(),
+        process_name: scope.name.clone(),
+        cpu_usage,
+        core_count,
+        timestamp,
+    };
+
+    Ok((metrics, resource_metrics))
+}
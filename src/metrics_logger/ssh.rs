@@ -0,0 +1,254 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use super::{push_error, update_metrics_log};
+use crate::{
+    config::Host,
+    metrics::{CpuMetrics, MetricsLog},
+};
+use anyhow::{anyhow, Context};
+use regex::Regex;
+use std::{
+    collections::HashMap,
+    sync::{Arc, Mutex},
+};
+use tokio::time::{Duration, Instant};
+
+/// Run on the host every sample. Only needs a POSIX shell and `/proc`, so nothing has to be
+/// installed. Processes which exit while their stat is read are skipped.
+const STATS_COMMAND: &str = "getconf CLK_TCK; nproc; cat /proc/[0-9]*/stat 2>/dev/null";
+
+/// The CPU time of a process read from `/proc/<pid>/stat`.
+#[derive(Debug, PartialEq)]
+struct ProcStat {
+    pid: u32,
+    ppid: u32,
+    name: String,
+    /// User and system time in clock ticks.
+    ticks: u64,
+}
+
+/// Everything read from the host in a single sample.
+#[derive(Debug, PartialEq)]
+struct Stats {
+    ticks_per_sec: u64,
+    core_count: i32,
+    processes: Vec<ProcStat>,
+}
+
+/// Enters an infinite loop logging the CPU usage of processes on a host reached over SSH to the
+/// metrics log. Each sample runs a small stats command on the host, the CPU usage of a process
+/// and the processes it started is worked out from the CPU time they used since the last sample.
+/// Processes are prefixed with the host's name so they can be told apart from local processes.
+///
+/// `ssh` has to be able to log in without a password, e.g. with an agent or a key in the ssh
+/// config. The connection is shared between samples so only the first pays for the handshake.
+///
+/// **WARNING**
+///
+/// This function should only be called from within a task that can execute it on another thread
+/// otherwise it will block the main thread completely.
+///
+/// # Arguments
+///
+/// * `host` - The host to log into and the processes to observe on it
+/// * `sample_interval` - How long to wait between samples
+/// * `metrics_log` - A log of all observed metrics. Another thread should periodically save and
+/// flush this shared log.
+///
+/// # Returns
+///
+/// This function does not return, it requires that it's thread is cancelled.
+pub async fn keep_logging(
+    host: Host,
+    sample_interval: Duration,
+    metrics_log: Arc<Mutex<MetricsLog>>,
+) {
+    let mut regexes = vec![];
+    for pattern in host.processes.iter() {
+        match Regex::new(pattern) {
+            Ok(regex) => regexes.push(regex),
+            Err(err) => push_error(
+                anyhow!("Invalid process name pattern {pattern}: {err}"),
+                &metrics_log,
+            ),
+        }
+    }
+
+    let mut previous_ticks: HashMap<u32, u64> = HashMap::new();
+    let mut sampled_at = Instant::now();
+    loop {
+        tokio::time::sleep(sample_interval).await;
+        let stats = match read_stats(&host.ssh).await {
+            Ok(stats) => stats,
+            Err(err) => {
+                push_error(err, &metrics_log);
+                continue;
+            }
+        };
+        let elapsed = sampled_at.elapsed().as_secs_f64();
+        sampled_at = Instant::now();
+        let timestamp = match std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH) {
+            Ok(now) => now.as_millis() as i64,
+            Err(err) => {
+                push_error(err.into(), &metrics_log);
+                continue;
+            }
+        };
+
+        for regex in regexes.iter() {
+            for root in matching_roots(&stats.processes, regex) {
+                let ticks = tree_ticks(&stats.processes, root.pid);
+                // the first sample only gives a starting point
+                let Some(previous) = previous_ticks.insert(root.pid, ticks) else {
+                    continue;
+                };
+
+                // descendants which exit take their CPU time with them, so the total can drop
+                let cpu_secs = ticks.saturating_sub(previous) as f64 / stats.ticks_per_sec as f64;
+                let metrics = CpuMetrics {
+                    process_id: format!("{}/{}", host.name, root.pid),
+                    process_name: format!("{}/{}", host.name, root.name),
+                    cpu_usage: cpu_secs / elapsed * 100.0,
+                    core_count: stats.core_count,
+                    timestamp,
+                };
+                update_metrics_log(Ok(metrics), &metrics_log);
+            }
+        }
+    }
+}
+
+async fn read_stats(destination: &str) -> anyhow::Result<Stats> {
+    let output = tokio::process::Command::new("ssh")
+        .args([
+            "-o",
+            "BatchMode=yes",
+            "-o",
+            "ControlMaster=auto",
+            "-o",
+            "ControlPath=/tmp/cardamon-ssh-%C",
+            "-o",
+            "ControlPersist=60",
+            destination,
+            STATS_COMMAND,
+        ])
+        .output()
+        .await
+        .context("Unable to run ssh, is it installed?")?;
+
+    // ssh exits with 255 when it can't connect, cat fails when a process exits while it's read
+    if output.status.code() == Some(255) {
+        return Err(anyhow!(
+            "Unable to connect to {destination}: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    parse_stats(&String::from_utf8_lossy(&output.stdout))
+        .context(format!("Unexpected output from {destination}"))
+}
+
+fn parse_stats(output: &str) -> anyhow::Result<Stats> {
+    let mut lines = output.lines();
+    let ticks_per_sec = lines
+        .next()
+        .and_then(|line| line.trim().parse::<u64>().ok())
+        .filter(|ticks| *ticks > 0)
+        .ok_or(anyhow!("Expected the clock ticks per second"))?;
+    let core_count = lines
+        .next()
+        .and_then(|line| line.trim().parse::<i32>().ok())
+        .ok_or(anyhow!("Expected the number of cores"))?;
+
+    Ok(Stats {
+        ticks_per_sec,
+        core_count,
+        processes: lines.filter_map(parse_proc_stat).collect(),
+    })
+}
+
+/// Parses a line of `/proc/<pid>/stat`. The name is in brackets and can contain spaces and
+/// brackets of its own, so fields are counted from the last closing bracket.
+fn parse_proc_stat(line: &str) -> Option<ProcStat> {
+    let (pid, rest) = line.split_once(" (")?;
+    let (name, fields) = rest.rsplit_once(") ")?;
+    // state ppid pgrp session tty_nr tpgid flags minflt cminflt majflt cmajflt utime stime
+    let fields = fields.split_whitespace().collect::<Vec<_>>();
+    let utime = fields.get(11)?.parse::<u64>().ok()?;
+    let stime = fields.get(12)?.parse::<u64>().ok()?;
+
+    Some(ProcStat {
+        pid: pid.trim().parse().ok()?,
+        ppid: fields.get(1)?.parse().ok()?,
+        name: String::from(name),
+        ticks: utime + stime,
+    })
+}
+
+/// # Returns
+///
+/// The processes with a name matching the regex whose parent doesn't match, so a server which
+/// forks workers with the same name is observed once
+fn matching_roots<'a>(processes: &'a [ProcStat], regex: &Regex) -> Vec<&'a ProcStat> {
+    let is_match = |pid: u32| {
+        processes
+            .iter()
+            .any(|process| process.pid == pid && regex.is_match(&process.name))
+    };
+    processes
+        .iter()
+        .filter(|process| regex.is_match(&process.name) && !is_match(process.ppid))
+        .collect()
+}
+
+/// # Returns
+///
+/// The CPU time in clock ticks used by a process and every running process it started
+fn tree_ticks(processes: &[ProcStat], root: u32) -> u64 {
+    let mut tree = vec![root];
+    let mut ticks = 0;
+    while let Some(pid) = tree.pop() {
+        for process in processes.iter() {
+            if process.pid == pid {
+                ticks += process.ticks;
+            } else if process.ppid == pid {
+                tree.push(process.pid);
+            }
+        }
+    }
+    ticks
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn process_trees_are_found_in_proc_stat() -> anyhow::Result<()> {
+        let output = "100\n\
+                      8\n\
+                      1 (systemd) S 0 1 1 0 -1 4194560 1000 2000 10 20 50 30 5 5 20 0 1 0 10 0 0\n\
+                      400 (postgres) S 1 400 400 0 -1 4194560 100 0 0 0 120 40 0 0 20 0 1 0 500 0 0\n\
+                      401 (postgres) S 400 400 400 0 -1 4194624 10 0 0 0 30 10 0 0 20 0 1 0 510 0 0\n\
+                      402 (pg (worker) 1) R 401 400 400 0 -1 4194624 10 0 0 0 7 3 0 0 20 0 1 0 520 0 0\n\
+                      500 (nginx) S 1 500 500 0 -1 4194560 10 0 0 0 1 1 0 0 20 0 1 0 600 0 0\n";
+
+        let stats = parse_stats(output)?;
+        assert_eq!(stats.ticks_per_sec, 100);
+        assert_eq!(stats.core_count, 8);
+        assert_eq!(stats.processes.len(), 5);
+        assert_eq!(stats.processes[3].name, "pg (worker) 1");
+
+        let roots = matching_roots(&stats.processes, &Regex::new("^postgres$")?);
+        assert_eq!(roots.len(), 1);
+        assert_eq!(roots[0].pid, 400);
+        assert_eq!(tree_ticks(&stats.processes, 400), 210);
+        assert_eq!(tree_ticks(&stats.processes, 500), 2);
+
+        assert!(parse_stats("").is_err());
+        Ok(())
+    }
+}
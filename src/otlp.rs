@@ -0,0 +1,204 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    config::{Blend, Otlp},
+    dataset::IterationWithMetrics,
+};
+use anyhow::Context;
+use serde_json::{json, Value};
+
+/// Pushes the power and energy of each scenario iteration to an OpenTelemetry collector over
+/// OTLP/HTTP, so energy can be graphed next to the other metrics of the application.
+pub struct OtlpExporter {
+    client: reqwest::Client,
+    url: String,
+    headers: Vec<(String, String)>,
+    host: String,
+    run_id: String,
+}
+impl OtlpExporter {
+    pub fn new(otlp: &Otlp, run_id: &str) -> Self {
+        let endpoint = otlp.endpoint.strip_suffix('/').unwrap_or(&otlp.endpoint);
+        Self {
+            client: reqwest::Client::new(),
+            url: format!("{endpoint}/v1/metrics"),
+            headers: otlp
+                .headers
+                .iter()
+                .map(|(name, value)| (name.clone(), value.clone()))
+                .collect(),
+            host: sysinfo::System::host_name().unwrap_or(String::from("unknown")),
+            run_id: String::from(run_id),
+        }
+    }
+
+    /// # Arguments
+    /// * iteration - the scenario iteration and the metrics logged while it ran
+    /// * tdp - the TDP of the run, the power of each sample is only known if there is one
+    /// * blend - confidence in estimates and measurements
+    ///
+    /// # Returns
+    /// The iteration as an OTLP `ExportMetricsServiceRequest` in its JSON encoding
+    pub fn request(
+        &self,
+        iteration: &IterationWithMetrics,
+        tdp: Option<f64>,
+        blend: Option<&Blend>,
+    ) -> Value {
+        let scenario_iteration = iteration.scenario_iteration();
+        let nanos = |millis: i64| (millis.max(0) as u128 * 1_000_000).to_string();
+        let process_attributes = |process_id: &str, process_name: &str| {
+            json!([
+                attribute("process.name", process_name),
+                attribute("cardamon.process.id", process_id),
+            ])
+        };
+
+        let mut cpu_points = vec![];
+        let mut power_points = vec![];
+        for metrics in iteration.cpu_metrics().iter() {
+            let attributes = process_attributes(&metrics.process_id, &metrics.process_name);
+            cpu_points.push(json!({
+                "timeUnixNano": nanos(metrics.timestamp),
+                "asDouble": metrics.cpu_usage,
+                "attributes": attributes,
+            }));
+            if let Some(tdp) = tdp {
+                let share = metrics.cpu_usage / 100.0 / metrics.core_count.max(1) as f64;
+                power_points.push(json!({
+                    "timeUnixNano": nanos(metrics.timestamp),
+                    "asDouble": share.min(1.0) * tdp,
+                    "attributes": attributes,
+                }));
+            }
+        }
+
+        let mut metrics = vec![json!({
+            "name": "cardamon.process.cpu.usage",
+            "description": "CPU usage of the process as a percentage of a single core",
+            "unit": "%",
+            "gauge": { "dataPoints": cpu_points },
+        })];
+        if !power_points.is_empty() {
+            metrics.push(json!({
+                "name": "cardamon.process.power",
+                "description": "Power of the process estimated with the TDP",
+                "unit": "W",
+                "gauge": { "dataPoints": power_points },
+            }));
+        }
+        if let Some(joules) = iteration.joules(tdp, blend) {
+            metrics.push(json!({
+                "name": "cardamon.scenario.energy",
+                "description": "Energy of every process over the scenario iteration",
+                "unit": "J",
+                "gauge": { "dataPoints": [{
+                    "startTimeUnixNano": nanos(scenario_iteration.start_time),
+                    "timeUnixNano": nanos(scenario_iteration.stop_time),
+                    "asDouble": joules,
+                    "attributes": [json!({
+                        "key": "cardamon.iteration",
+                        "value": { "intValue": scenario_iteration.iteration.to_string() },
+                    })],
+                }]},
+            }));
+        }
+
+        json!({
+            "resourceMetrics": [{
+                "resource": {
+                    "attributes": [
+                        attribute("service.name", "cardamon"),
+                        attribute("host.name", &self.host),
+                        attribute("cardamon.run.id", &self.run_id),
+                        attribute("cardamon.scenario", &scenario_iteration.scenario_name),
+                    ],
+                },
+                "scopeMetrics": [{
+                    "scope": { "name": "cardamon", "version": env!("CARGO_PKG_VERSION") },
+                    "metrics": metrics,
+                }],
+            }],
+        })
+    }
+
+    /// Pushes the iteration to the collector. The collector being unavailable shouldn't fail a
+    /// run, so errors are logged as warnings.
+    pub async fn push(
+        &self,
+        iteration: &IterationWithMetrics,
+        tdp: Option<f64>,
+        blend: Option<&Blend>,
+    ) {
+        let mut request = self
+            .client
+            .post(&self.url)
+            .json(&self.request(iteration, tdp, blend));
+        for (name, value) in self.headers.iter() {
+            request = request.header(name, value);
+        }
+        let res = request
+            .send()
+            .await
+            .and_then(|res| res.error_for_status())
+            .context(format!("Unable to push metrics to {}", self.url));
+        if let Err(err) = res {
+            tracing::warn!("{:?}", err);
+        }
+    }
+}
+
+fn attribute(key: &str, value: &str) -> Value {
+    json!({ "key": key, "value": { "stringValue": value } })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::data_access::{cpu_metrics::CpuMetrics, scenario_iteration::ScenarioIteration};
+    use std::collections::BTreeMap;
+
+    #[test]
+    fn iterations_are_pushed_as_otlp_json() {
+        let otlp = Otlp {
+            endpoint: String::from("http://collector:4318/"),
+            headers: BTreeMap::new(),
+        };
+        let exporter = OtlpExporter::new(&otlp, "abc12");
+        assert_eq!(exporter.url, "http://collector:4318/v1/metrics");
+
+        let iteration = IterationWithMetrics::new(
+            ScenarioIteration::new("abc12", "basket_10", 0, 1000, 3000, None),
+            vec![
+                CpuMetrics::new("abc12", "10", "server", 100.0, 100.0, 4, 1000),
+                CpuMetrics::new("abc12", "10", "server", 100.0, 100.0, 4, 3000),
+            ],
+            vec![],
+            vec![],
+        );
+        let request = exporter.request(&iteration, Some(40.0), None);
+        let resource_metrics = &request["resourceMetrics"][0];
+        let attributes = resource_metrics["resource"]["attributes"]
+            .as_array()
+            .expect("the resource should have attributes");
+        assert!(attributes.contains(&attribute("cardamon.run.id", "abc12")));
+        assert!(attributes.contains(&attribute("cardamon.scenario", "basket_10")));
+
+        let metrics = &resource_metrics["scopeMetrics"][0]["metrics"];
+        assert_eq!(metrics[1]["name"], "cardamon.process.power");
+        let power = &metrics[1]["gauge"]["dataPoints"][0];
+        assert_eq!(power["timeUnixNano"], "1000000000");
+        assert_eq!(power["asDouble"], 10.0);
+        assert_eq!(metrics[2]["name"], "cardamon.scenario.energy");
+        assert_eq!(metrics[2]["gauge"]["dataPoints"][0]["asDouble"], 20.0);
+
+        // without a TDP there's nothing but the CPU usage
+        let request = exporter.request(&iteration, None, None);
+        let metrics = &request["resourceMetrics"][0]["scopeMetrics"][0]["metrics"];
+        assert_eq!(metrics.as_array().map(Vec::len), Some(1));
+    }
+}
@@ -0,0 +1,176 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::Context;
+use std::{fs, path::Path, time};
+use tokio::time::Duration;
+
+/// While this file exists in the directory cardamon runs in, runs don't start any more
+/// scenarios. `cardamon pause` creates it and `cardamon resume` removes it.
+pub const PAUSE_FILE: &str = "cardamon.pause";
+
+/// How often a paused run checks whether it's been resumed.
+const RESUME_CHECK_INTERVAL: Duration = Duration::from_secs(1);
+
+/// A time a run was paused for, in milliseconds since the epoch.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Pause {
+    pub start: i64,
+    pub stop: i64,
+}
+impl Pause {
+    pub fn duration(&self) -> Duration {
+        Duration::from_millis((self.stop - self.start).max(0) as u64)
+    }
+}
+
+/// Asks running observations to pause once their current scenarios finish.
+pub fn request() -> anyhow::Result<()> {
+    fs::write(PAUSE_FILE, b"").context("Unable to create the pause file")
+}
+
+/// Lets paused observations carry on.
+///
+/// # Returns
+/// False if nothing was paused
+pub fn release() -> anyhow::Result<bool> {
+    if !Path::new(PAUSE_FILE).exists() {
+        return Ok(false);
+    }
+    fs::remove_file(PAUSE_FILE).context("Unable to remove the pause file")?;
+    Ok(true)
+}
+
+fn is_requested() -> bool {
+    Path::new(PAUSE_FILE).exists()
+}
+
+fn now() -> i64 {
+    time::SystemTime::now()
+        .duration_since(time::UNIX_EPOCH)
+        .map(|since| since.as_millis() as i64)
+        .unwrap_or_default()
+}
+
+/// Pauses a run between scenarios. The run is paused by `cardamon pause` or, on unix, by
+/// sending it SIGUSR1 and resumed by `cardamon resume` or SIGUSR2.
+pub struct PauseControl {
+    #[cfg(unix)]
+    pause_signal: tokio::signal::unix::Signal,
+    #[cfg(unix)]
+    resume_signal: tokio::signal::unix::Signal,
+}
+impl PauseControl {
+    pub fn new() -> anyhow::Result<Self> {
+        // a pause left over from a previous run would stop this one before it starts
+        if release()? {
+            tracing::warn!("Removed {} left by a previous run", PAUSE_FILE);
+        }
+
+        #[cfg(unix)]
+        {
+            use tokio::signal::unix::{signal, SignalKind};
+            Ok(Self {
+                pause_signal: signal(SignalKind::user_defined1())?,
+                resume_signal: signal(SignalKind::user_defined2())?,
+            })
+        }
+        #[cfg(not(unix))]
+        Ok(Self {})
+    }
+
+    /// Waits until the run is resumed if a pause has been asked for.
+    ///
+    /// # Returns
+    /// When the run was paused, None if it wasn't
+    pub async fn wait_if_paused(&mut self) -> anyhow::Result<Option<Pause>> {
+        #[cfg(unix)]
+        {
+            use futures_util::FutureExt;
+            if self.pause_signal.recv().now_or_never().is_some() {
+                request()?;
+            }
+        }
+        if !is_requested() {
+            return Ok(None);
+        }
+
+        tracing::warn!("Run paused, run `cardamon resume` to carry on");
+        let start = now();
+        while is_requested() {
+            #[cfg(unix)]
+            tokio::select! {
+                _ = self.resume_signal.recv() => {
+                    release()?;
+                }
+                _ = tokio::time::sleep(RESUME_CHECK_INTERVAL) => {}
+            }
+            #[cfg(not(unix))]
+            tokio::time::sleep(RESUME_CHECK_INTERVAL).await;
+        }
+        let pause = Pause { start, stop: now() };
+        tracing::warn!(
+            "Run resumed after {}",
+            humantime::format_duration(Duration::from_secs(pause.duration().as_secs()))
+        );
+        Ok(Some(pause))
+    }
+}
+
+/// # Returns
+/// The pauses as they're saved with a run, one `start-stop` per line
+pub fn format(pauses: &[Pause]) -> Option<String> {
+    if pauses.is_empty() {
+        return None;
+    }
+    let lines = pauses
+        .iter()
+        .map(|pause| format!("{}-{}", pause.start, pause.stop))
+        .collect::<Vec<_>>();
+    Some(lines.join("\n"))
+}
+
+/// # Returns
+/// The pauses saved with a run, lines which can't be read are skipped
+pub fn parse(pauses: &str) -> Vec<Pause> {
+    pauses
+        .lines()
+        .filter_map(|line| {
+            let (start, stop) = line.split_once('-')?;
+            Some(Pause {
+                start: start.trim().parse().ok()?,
+                stop: stop.trim().parse().ok()?,
+            })
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn pauses_are_saved_with_the_run() {
+        let pauses = vec![
+            Pause {
+                start: 1000,
+                stop: 61000,
+            },
+            Pause {
+                start: 90000,
+                stop: 95000,
+            },
+        ];
+
+        let saved = format(&pauses).expect("pauses should be saved");
+        assert_eq!(saved, "1000-61000\n90000-95000");
+        assert_eq!(parse(&saved), pauses);
+        assert_eq!(pauses[0].duration(), Duration::from_secs(60));
+
+        assert_eq!(format(&[]), None);
+        assert!(parse("not a pause").is_empty());
+    }
+}
@@ -0,0 +1,87 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::{anyhow, Context};
+
+/// Parses a list of CPUs in the format used by taskset and cpusets, e.g. `0-3,6`.
+///
+/// # Returns
+/// The CPUs in the list in order, an error if it isn't a valid list
+pub fn parse_cpus(cpus: &str) -> anyhow::Result<Vec<u32>> {
+    let mut parsed = vec![];
+    for part in cpus.split(',').map(str::trim) {
+        let (start, end) = match part.split_once('-') {
+            Some((start, end)) => (start.trim().parse::<u32>()?, end.trim().parse::<u32>()?),
+            None => {
+                let cpu = part.parse::<u32>()?;
+                (cpu, cpu)
+            }
+        };
+        if start > end {
+            return Err(anyhow!("{part} is an empty range of CPUs"));
+        }
+        parsed.extend(start..=end);
+    }
+
+    parsed.sort();
+    parsed.dedup();
+    Ok(parsed)
+}
+
+/// # Returns
+/// The command run with its CPUs limited to the given list, on platforms without taskset the
+/// command is returned unchanged
+pub fn pinned_command(command: &str, cpus: &str) -> String {
+    if cfg!(target_os = "linux") {
+        format!("taskset -c {cpus} {command}")
+    } else {
+        tracing::warn!("Processes can only be pinned to CPUs on Linux, `{command}` isn't pinned");
+        String::from(command)
+    }
+}
+
+/// Pins every thread of cardamon to the given CPUs so it doesn't compete with the processes it's
+/// measuring. Threads started later inherit the pinning.
+pub fn pin_self(cpus: &str) -> anyhow::Result<()> {
+    if !cfg!(target_os = "linux") {
+        tracing::warn!("Cardamon can only be pinned to CPUs on Linux, it isn't pinned");
+        return Ok(());
+    }
+
+    let output = std::process::Command::new("taskset")
+        .args(["-a", "-p", "-c", cpus, &std::process::id().to_string()])
+        .output()
+        .context("Unable to pin cardamon to its CPUs, is taskset installed?")?;
+    if !output.status.success() {
+        return Err(anyhow!(
+            "Unable to pin cardamon to CPUs {cpus}: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        ));
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn cpu_lists_are_parsed() -> anyhow::Result<()> {
+        assert_eq!(parse_cpus("0-3,6")?, vec![0, 1, 2, 3, 6]);
+        assert_eq!(parse_cpus("4, 2-3, 3")?, vec![2, 3, 4]);
+        assert!(parse_cpus("3-1").is_err());
+        assert!(parse_cpus("all").is_err());
+        assert!(parse_cpus("").is_err());
+
+        if cfg!(target_os = "linux") {
+            assert_eq!(
+                pinned_command("node server.js", "2-3"),
+                "taskset -c 2-3 node server.js"
+            );
+        }
+        Ok(())
+    }
+}
@@ -0,0 +1,705 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    config::Retention,
+    data_access::{
+        compressed_samples::{CompressedSamples, Samples},
+        cpu_metrics::CpuMetrics,
+        power_metrics::PowerMetrics,
+        resource_metrics::ResourceMetrics,
+        run::Run,
+        scenario_iteration::ScenarioIteration,
+        DataAccessService,
+    },
+    report,
+};
+use itertools::Itertools;
+use std::{collections::HashMap, hash::Hash};
+
+/// What was deleted by a prune.
+#[derive(Debug, Default, Clone, Copy, PartialEq)]
+pub struct Pruned {
+    pub runs: usize,
+    /// CPU, power and resource samples.
+    pub samples: u64,
+}
+
+/// What was replaced by a downsample.
+#[derive(Debug, Default, Clone, Copy, PartialEq)]
+pub struct Downsampled {
+    pub runs: usize,
+    /// CPU, power and resource samples.
+    pub samples: u64,
+    /// The averages which replaced them.
+    pub averages: u64,
+}
+
+/// # Arguments
+/// * runs - every run in the database
+/// * retention - which runs keep their samples
+/// * now - unix timestamp in milliseconds
+///
+/// # Returns
+/// The runs outside the retention policy, oldest first. The latest runs are counted in each
+/// project so a busy project can't push out the runs of the others.
+pub fn expired<'a>(runs: &'a [Run], retention: &Retention, now: i64) -> Vec<&'a Run> {
+    // a policy which only downsamples never expires a run
+    if retention.keep_last.is_none() && retention.older_than.is_none() {
+        return vec![];
+    }
+    let kept_since = retention
+        .older_than
+        .map(|older_than| now - older_than.as_millis() as i64);
+
+    // count the runs of each project newer than a run, starting from the latest
+    let mut newer_runs: HashMap<Option<&str>, usize> = HashMap::new();
+    let mut expired = runs
+        .iter()
+        .sorted_by_key(|run| std::cmp::Reverse(run.start_time))
+        .filter(|run| {
+            let newer = newer_runs.entry(run.project.as_deref()).or_default();
+            let kept_by_count = retention.keep_last.is_some_and(|n| *newer < n);
+            *newer += 1;
+            let kept_by_age = kept_since.is_some_and(|since| run.start_time >= since);
+            !(kept_by_count || kept_by_age)
+        })
+        .collect::<Vec<_>>();
+    expired.reverse();
+    expired
+}
+
+/// # Arguments
+/// * runs - every run in the database
+/// * retention - which runs are downsampled
+/// * now - unix timestamp in milliseconds
+///
+/// # Returns
+/// The runs started longer ago than `downsample_after`, oldest first. Runs which are expired
+/// aren't downsampled, their samples are pruned instead
+pub fn to_downsample<'a>(runs: &'a [Run], retention: &Retention, now: i64) -> Vec<&'a Run> {
+    let Some(downsample_after) = retention.downsample_after else {
+        return vec![];
+    };
+    let started_before = now - downsample_after.as_millis() as i64;
+    let expired = expired(runs, retention, now);
+    runs.iter()
+        .filter(|run| run.start_time < started_before)
+        .filter(|run| !expired.iter().any(|expired| expired.run_id == run.run_id))
+        .sorted_by_key(|run| run.start_time)
+        .collect()
+}
+
+/// Saves the energy of each iteration of a run, so it's still known once the run's samples are
+/// pruned or downsampled.
+async fn summarise(run: &Run, data_access_service: &dyn DataAccessService) -> anyhow::Result<()> {
+    let blend = report::run_blend(run);
+    let dataset = data_access_service.fetch_run_dataset(&run.run_id).await?;
+    for iteration in dataset.data() {
+        let scenario_iteration = ScenarioIteration {
+            joules: iteration.joules(run.tdp, blend.as_ref()),
+            ..iteration.scenario_iteration().clone()
+        };
+        data_access_service
+            .scenario_iteration_dao()
+            .summarise(&scenario_iteration)
+            .await?;
+    }
+    Ok(())
+}
+
+/// Deletes the samples of runs. If the retention policy keeps summaries, the energy of each
+/// iteration is saved first so the runs can still be reported on and compared, otherwise
+/// everything saved for the runs is deleted.
+///
+/// # Returns
+/// What was deleted, runs which were already pruned aren't counted
+pub async fn prune(
+    runs: &[&Run],
+    retention: &Retention,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<Pruned> {
+    let mut pruned = Pruned::default();
+    for run in runs {
+        let run_id = run.run_id.as_str();
+        if retention.keep_summaries() {
+            summarise(run, data_access_service).await?;
+        }
+
+        let compressed = data_access_service
+            .compressed_samples_dao()
+            .fetch(run_id)
+            .await?
+            .map_or(0, |compressed_samples| compressed_samples.samples as u64);
+        data_access_service
+            .compressed_samples_dao()
+            .delete_by_run(run_id)
+            .await?;
+        let samples = compressed + delete_samples(run_id, data_access_service).await?;
+        pruned.samples += samples;
+
+        if retention.keep_summaries() {
+            if samples > 0 {
+                pruned.runs += 1;
+            }
+        } else {
+            data_access_service
+                .scenario_iteration_dao()
+                .delete_by_run(run_id)
+                .await?;
+            data_access_service
+                .endpoint_energy_dao()
+                .delete_by_run(run_id)
+                .await?;
+            data_access_service
+                .artifact_dao()
+                .delete_by_run(run_id)
+                .await?;
+            data_access_service.run_dao().delete(run_id).await?;
+            pruned.runs += 1;
+        }
+    }
+    Ok(pruned)
+}
+
+/// Replaces the samples of runs with averages over `downsample_to`, compressed together into a
+/// single row, so storage grows with the number of runs rather than how often they were sampled.
+/// The energy of each iteration is saved first, so it's the energy measured from every sample
+/// which is reported.
+///
+/// The compressed averages are saved before the samples are deleted, so a downsample which is
+/// stopped part way loses nothing. Rows left behind are ignored once a run has compressed samples,
+/// the next downsample deletes them.
+///
+/// # Returns
+/// What was replaced, runs which were already downsampled aren't counted
+pub async fn downsample(
+    runs: &[&Run],
+    retention: &Retention,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<Downsampled> {
+    let mut downsampled = Downsampled::default();
+    for run in runs {
+        let run_id = run.run_id.as_str();
+        if data_access_service
+            .compressed_samples_dao()
+            .fetch(run_id)
+            .await?
+            .is_some()
+        {
+            delete_samples(run_id, data_access_service).await?;
+            continue;
+        }
+
+        let scenario_iterations = data_access_service
+            .scenario_iteration_dao()
+            .fetch_by_run(run_id)
+            .await?;
+        let mut boundaries = vec![run.start_time, run.stop_time];
+        boundaries.extend(run.baseline_start.iter().chain(run.baseline_stop.iter()));
+        boundaries.extend(scenario_iterations.iter().flat_map(|scenario_iteration| {
+            [scenario_iteration.start_time, scenario_iteration.stop_time]
+        }));
+        let buckets = Buckets::new(boundaries, retention.downsample_interval());
+
+        let samples = data_access_service
+            .fetch_samples_within(run_id, i64::MIN, i64::MAX)
+            .await?;
+        // pruned runs have no samples left to downsample
+        if samples.is_empty() {
+            continue;
+        }
+        let sampled = samples.len() as u64;
+        let averages = Samples {
+            cpu_metrics: average_cpu(samples.cpu_metrics, &buckets),
+            power_metrics: average_power(samples.power_metrics, &buckets),
+            resource_metrics: bound_resources(samples.resource_metrics, &buckets),
+        };
+
+        summarise(run, data_access_service).await?;
+        data_access_service
+            .compressed_samples_dao()
+            .persist(&CompressedSamples::compress(run_id, &averages)?)
+            .await?;
+        delete_samples(run_id, data_access_service).await?;
+
+        downsampled.runs += 1;
+        downsampled.samples += sampled;
+        downsampled.averages += averages.len() as u64;
+    }
+    Ok(downsampled)
+}
+
+/// Deletes the rows of a run's CPU, power and resource samples.
+///
+/// # Returns
+/// How many samples were deleted
+async fn delete_samples(
+    run_id: &str,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<u64> {
+    Ok(data_access_service
+        .cpu_metrics_dao()
+        .delete_by_run(run_id)
+        .await?
+        + data_access_service
+            .power_metrics_dao()
+            .delete_by_run(run_id)
+            .await?
+        + data_access_service
+            .resource_metrics_dao()
+            .delete_by_run(run_id)
+            .await?)
+}
+
+/// Downsamples the runs which are due, done after each run is saved so the samples of old runs
+/// are replaced without waiting for `cardamon prune`. Nothing is deleted, runs are only expired
+/// by a prune.
+///
+/// # Arguments
+/// * retention - the configured retention policy, nothing is done unless it sets
+///   `downsample_after`
+/// * now - unix timestamp in milliseconds
+///
+/// # Returns
+/// What was replaced
+pub async fn downsample_due(
+    retention: Option<&Retention>,
+    now: i64,
+    data_access_service: &dyn DataAccessService,
+) -> anyhow::Result<Downsampled> {
+    let Some(retention) = retention.filter(|retention| retention.downsample_after.is_some()) else {
+        return Ok(Downsampled::default());
+    };
+    let runs = data_access_service.run_dao().fetch_since(0).await?;
+    let to_downsample = to_downsample(&runs, retention, now);
+    downsample(&to_downsample, retention, data_access_service).await
+}
+
+/// The spans of a run whose samples are averaged together. Spans never cross the start or end
+/// of an iteration, so each average is still counted in the iterations its samples were.
+struct Buckets {
+    boundaries: Vec<i64>,
+    interval: i64,
+}
+impl Buckets {
+    /// # Arguments
+    /// * boundaries - when the run, its baseline and its iterations started and stopped
+    /// * interval - how long a span lasts in milliseconds
+    fn new(mut boundaries: Vec<i64>, interval: i64) -> Self {
+        boundaries.sort();
+        boundaries.dedup();
+        Self {
+            boundaries,
+            interval,
+        }
+    }
+
+    fn of(&self, timestamp: i64) -> (usize, i64) {
+        let between = match self.boundaries.binary_search(&timestamp) {
+            // a sample taken just as an iteration starts or stops is in a different set of
+            // iterations to the samples either side of it
+            Ok(i) => 2 * i + 1,
+            Err(i) => 2 * i,
+        };
+        (between, timestamp.div_euclid(self.interval))
+    }
+
+    /// # Returns
+    /// The samples of each series in each span, in the order they were taken
+    fn group<T, K: Hash + Eq>(
+        &self,
+        samples: Vec<T>,
+        series: impl Fn(&T) -> K,
+        timestamp: impl Fn(&T) -> i64,
+    ) -> Vec<Vec<T>> {
+        samples
+            .into_iter()
+            .into_group_map_by(|sample| (series(sample), self.of(timestamp(sample))))
+            .into_values()
+            .map(|mut samples| {
+                samples.sort_by_key(&timestamp);
+                samples
+            })
+            .sorted_by_key(|samples| timestamp(&samples[0]))
+            .collect()
+    }
+}
+
+/// # Returns
+/// The mean usage of each process in each span, taken when the span's first sample was
+fn average_cpu(cpu_metrics: Vec<CpuMetrics>, buckets: &Buckets) -> Vec<CpuMetrics> {
+    buckets
+        .group(
+            cpu_metrics,
+            |m| (m.process_id.clone(), m.scenario_name.clone()),
+            |m| m.timestamp,
+        )
+        .into_iter()
+        .map(|mut samples| {
+            let count = samples.len() as f64;
+            let cpu_usage = samples.iter().map(|m| m.cpu_usage).sum::<f64>() / count;
+            let total_usage = samples.iter().map(|m| m.total_usage).sum::<f64>() / count;
+            CpuMetrics {
+                cpu_usage,
+                total_usage,
+                ..samples.remove(0)
+            }
+        })
+        .collect()
+}
+
+/// # Returns
+/// The mean power of each source in each span, taken when the span's first sample was
+fn average_power(power_metrics: Vec<PowerMetrics>, buckets: &Buckets) -> Vec<PowerMetrics> {
+    buckets
+        .group(
+            power_metrics,
+            |m| (m.source.clone(), m.component.clone(), m.process_id.clone()),
+            |m| m.timestamp,
+        )
+        .into_iter()
+        .map(|mut samples| {
+            let power = samples.iter().map(|m| m.power).sum::<f64>() / samples.len() as f64;
+            PowerMetrics {
+                power,
+                ..samples.remove(0)
+            }
+        })
+        .collect()
+}
+
+/// Resource samples are mostly running totals, which can't be averaged. The first and last
+/// sample of each span are kept so the increase over any iteration is unchanged.
+///
+/// # Returns
+/// The first and last resource sample of each process in each span
+fn bound_resources(
+    resource_metrics: Vec<ResourceMetrics>,
+    buckets: &Buckets,
+) -> Vec<ResourceMetrics> {
+    buckets
+        .group(resource_metrics, |m| m.process_id.clone(), |m| m.timestamp)
+        .into_iter()
+        .flat_map(|mut samples| {
+            let last = (samples.len() > 1).then(|| samples.pop()).flatten();
+            samples.truncate(1);
+            samples.extend(last);
+            samples
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::data_access::LocalDataAccessService;
+    use sqlx::SqlitePool;
+    use std::time::Duration;
+
+    const DAY: i64 = 24 * 60 * 60 * 1000;
+
+    #[test]
+    fn samples_are_averaged_within_iterations() {
+        // a sample a second for 2 minutes with an iteration from 30s to 90s
+        let buckets = Buckets::new(vec![0, 120_000, 30_000, 90_000], 60_000);
+        let cpu_metrics = (0..120)
+            .map(|s| CpuMetrics::new("1", "42", "db", s as f64, 100.0, 4, s * 1000))
+            .collect::<Vec<_>>();
+
+        let averages = average_cpu(cpu_metrics, &buckets);
+        let timestamps = averages.iter().map(|m| m.timestamp).collect::<Vec<_>>();
+        assert_eq!(
+            timestamps,
+            [0, 1000, 30_000, 31_000, 60_000, 90_000, 91_000]
+        );
+        // 1s to 29s
+        assert_eq!(averages[1].cpu_usage, 15.0);
+        assert_eq!(averages[1].total_usage, 100.0);
+
+        let resource_metrics = (0..120)
+            .map(|s| ResourceMetrics {
+                run_id: String::from("1"),
+                process_id: String::from("42"),
+                bytes_sent: Some(s * 10),
+                timestamp: s * 1000,
+                ..ResourceMetrics::default()
+            })
+            .collect::<Vec<_>>();
+        let bounds = bound_resources(resource_metrics, &buckets);
+        let sent = bounds
+            .iter()
+            .filter(|m| (30_000..=90_000).contains(&m.timestamp))
+            .filter_map(|m| m.bytes_sent)
+            .collect::<Vec<_>>();
+        assert_eq!(sent.first(), Some(&300));
+        assert_eq!(sent.last(), Some(&900));
+        assert_eq!(bounds.len(), 11);
+    }
+
+    #[test]
+    fn old_runs_are_downsampled_until_they_expire() {
+        let runs = (0..5)
+            .map(|day| {
+                Run::new(
+                    &day.to_string(),
+                    day * DAY,
+                    day * DAY + 1000,
+                    None,
+                    "",
+                    None,
+                    None,
+                )
+            })
+            .collect::<Vec<_>>();
+        let run_ids = |retention: &Retention| {
+            to_downsample(&runs, retention, 5 * DAY)
+                .iter()
+                .map(|run| run.run_id.as_str())
+                .collect::<Vec<_>>()
+        };
+
+        let downsample_after = Retention {
+            downsample_after: Some(Duration::from_millis(2 * DAY as u64)),
+            ..Retention::default()
+        };
+        assert_eq!(run_ids(&downsample_after), ["0", "1", "2"]);
+        assert!(expired(&runs, &downsample_after, 5 * DAY).is_empty());
+
+        let older_than = Retention {
+            older_than: Some(Duration::from_millis(4 * DAY as u64)),
+            ..downsample_after
+        };
+        assert_eq!(run_ids(&older_than), ["1", "2"]);
+        assert_eq!(run_ids(&Retention::default()), Vec::<&str>::new());
+    }
+
+    #[test]
+    fn runs_outside_every_limit_expire() {
+        let runs = (0..5)
+            .map(|day| {
+                Run::new(
+                    &day.to_string(),
+                    day * DAY,
+                    day * DAY + 1000,
+                    None,
+                    "",
+                    None,
+                    None,
+                )
+            })
+            .collect::<Vec<_>>();
+        let run_ids = |retention: &Retention| {
+            expired(&runs, retention, 5 * DAY)
+                .iter()
+                .map(|run| run.run_id.as_str())
+                .collect::<Vec<_>>()
+        };
+
+        let keep_last = Retention {
+            keep_last: Some(2),
+            ..Retention::default()
+        };
+        assert_eq!(run_ids(&keep_last), ["0", "1", "2"]);
+
+        let older_than = Retention {
+            older_than: Some(Duration::from_millis(3 * DAY as u64)),
+            ..Retention::default()
+        };
+        assert_eq!(run_ids(&older_than), ["0", "1"]);
+
+        // a run is kept if either limit keeps it
+        let both = Retention {
+            keep_last: Some(4),
+            ..older_than
+        };
+        assert_eq!(run_ids(&both), ["0"]);
+
+        // the latest runs are kept in each project
+        let runs = runs
+            .into_iter()
+            .map(|run| Run {
+                project: Some(String::from(if run.start_time < DAY { "a" } else { "b" })),
+                ..run
+            })
+            .collect::<Vec<_>>();
+        let kept = expired(&runs, &keep_last, 5 * DAY)
+            .iter()
+            .map(|run| run.run_id.as_str())
+            .collect::<Vec<_>>();
+        assert_eq!(kept, ["1", "2"]);
+    }
+
+    #[sqlx::test(
+        migrations = "./migrations",
+        fixtures(
+            "../fixtures/runs.sql",
+            "../fixtures/scenario_iterations.sql",
+            "../fixtures/cpu_metrics.sql"
+        )
+    )]
+    async fn pruned_runs_keep_their_energy(pool: SqlitePool) -> anyhow::Result<()> {
+        let data_access_service = LocalDataAccessService::new(pool.clone());
+        let run = data_access_service
+            .run_dao()
+            .fetch("2")
+            .await?
+            .expect("run 2 should exist");
+        let dataset = data_access_service.fetch_run_dataset("2").await?;
+        let joules = dataset
+            .data()
+            .iter()
+            .map(|it| it.joules(run.tdp, None))
+            .collect::<Vec<_>>();
+        assert!(joules.iter().all(Option::is_some));
+
+        prune(&[&run], &Retention::default(), &data_access_service).await?;
+        let dataset = data_access_service.fetch_run_dataset("2").await?;
+        assert!(dataset.data().iter().all(|it| it.cpu_metrics().is_empty()));
+        let pruned_joules = dataset
+            .data()
+            .iter()
+            .map(|it| it.joules(run.tdp, None))
+            .collect::<Vec<_>>();
+        assert_eq!(pruned_joules, joules);
+
+        let everything = Retention {
+            keep_summaries: Some(false),
+            ..Retention::default()
+        };
+        prune(&[&run], &everything, &data_access_service).await?;
+        assert!(data_access_service.run_dao().fetch("2").await?.is_none());
+
+        pool.close().await;
+        Ok(())
+    }
+
+    #[sqlx::test(
+        migrations = "./migrations",
+        fixtures(
+            "../fixtures/runs.sql",
+            "../fixtures/scenario_iterations.sql",
+            "../fixtures/cpu_metrics.sql"
+        )
+    )]
+    async fn downsampled_runs_keep_their_energy(pool: SqlitePool) -> anyhow::Result<()> {
+        let data_access_service = LocalDataAccessService::new(pool.clone());
+        let run = data_access_service
+            .run_dao()
+            .fetch("2")
+            .await?
+            .expect("run 2 should exist");
+        let joules = |dataset: &crate::dataset::ObservationDataset| {
+            dataset
+                .data()
+                .iter()
+                .map(|it| it.joules(run.tdp, None))
+                .collect::<Vec<_>>()
+        };
+        let dataset = data_access_service.fetch_run_dataset("2").await?;
+        let samples = dataset
+            .data()
+            .iter()
+            .map(|it| it.cpu_metrics().len())
+            .sum::<usize>();
+
+        let retention = Retention {
+            downsample_after: Some(Duration::from_secs(1)),
+            downsample_to: Some(Duration::from_secs(3600)),
+            ..Retention::default()
+        };
+        let downsampled = downsample(&[&run], &retention, &data_access_service).await?;
+        assert_eq!(downsampled.runs, 1);
+        let downsampled_dataset = data_access_service.fetch_run_dataset("2").await?;
+        let averages = downsampled_dataset
+            .data()
+            .iter()
+            .map(|it| it.cpu_metrics().len())
+            .sum::<usize>();
+        assert!(averages < samples);
+        assert_eq!(joules(&downsampled_dataset), joules(&dataset));
+        // the averages are compressed into a single row in place of the samples
+        assert!(data_access_service
+            .cpu_metrics_dao()
+            .fetch_within("2", i64::MIN, i64::MAX)
+            .await?
+            .is_empty());
+        let compressed_samples = data_access_service
+            .compressed_samples_dao()
+            .fetch("2")
+            .await?
+            .expect("the averages should be compressed");
+        assert_eq!(compressed_samples.samples as u64, downsampled.averages);
+
+        let again = downsample(&[&run], &retention, &data_access_service).await?;
+        assert_eq!(again, Downsampled::default());
+
+        // samples left by a downsample which was stopped before deleting them aren't counted
+        // twice, the next downsample deletes them
+        let leftover = CpuMetrics::new("2", "left", "over", 100.0, 100.0, 4, run.start_time);
+        data_access_service
+            .cpu_metrics_dao()
+            .persist(&leftover)
+            .await?;
+        let interrupted_dataset = data_access_service.fetch_run_dataset("2").await?;
+        assert_eq!(joules(&interrupted_dataset), joules(&dataset));
+        downsample(&[&run], &retention, &data_access_service).await?;
+        assert!(data_access_service
+            .cpu_metrics_dao()
+            .fetch_within("2", i64::MIN, i64::MAX)
+            .await?
+            .is_empty());
+
+        pool.close().await;
+        Ok(())
+    }
+
+    #[sqlx::test(
+        migrations = "./migrations",
+        fixtures(
+            "../fixtures/runs.sql",
+            "../fixtures/scenario_iterations.sql",
+            "../fixtures/cpu_metrics.sql"
+        )
+    )]
+    async fn runs_are_downsampled_once_due(pool: SqlitePool) -> anyhow::Result<()> {
+        let data_access_service = LocalDataAccessService::new(pool.clone());
+        let now = chrono::Utc::now().timestamp_millis();
+
+        // a policy which doesn't downsample leaves every sample
+        let keep_last = Retention {
+            keep_last: Some(1),
+            ..Retention::default()
+        };
+        assert_eq!(
+            downsample_due(Some(&keep_last), now, &data_access_service).await?,
+            Downsampled::default()
+        );
+        assert_eq!(
+            downsample_due(None, now, &data_access_service).await?,
+            Downsampled::default()
+        );
+
+        let retention = Retention {
+            downsample_after: Some(Duration::from_secs(1)),
+            downsample_to: Some(Duration::from_secs(3600)),
+            ..Retention::default()
+        };
+        let downsampled = downsample_due(Some(&retention), now, &data_access_service).await?;
+        assert!(downsampled.runs > 0);
+        assert!(downsampled.averages < downsampled.samples);
+        // the runs aren't expired, so they're all kept
+        let runs = data_access_service.run_dao().fetch_since(0).await?;
+        assert!(runs.iter().any(|run| run.run_id == "2"));
+        assert_eq!(
+            downsample_due(Some(&retention), now, &data_access_service).await?,
+            Downsampled::default()
+        );
+
+        pool.close().await;
+        Ok(())
+    }
+}
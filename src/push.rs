@@ -0,0 +1,65 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{archive::RunArchive, data_access::DataAccessService};
+use anyhow::anyhow;
+
+/// What was copied of a run pushed to another cardamon instance.
+#[derive(Debug, Default, Clone, Copy, PartialEq)]
+pub struct Pushed {
+    pub iterations: usize,
+    /// CPU, power and resource samples.
+    pub samples: usize,
+    pub artifacts: usize,
+}
+
+/// Copies a completed run with its iterations, metrics and artifacts, e.g. from the SQLite file
+/// of a CI machine which is about to be thrown away to a team-wide `cardamon server`.
+///
+/// # Arguments
+/// * run_id - the run to push
+/// * from - where the run was saved
+/// * to - where it's pushed, usually a `RemoteDataAccessService`
+///
+/// # Returns
+/// What was pushed, an error if the run is missing or was already pushed
+pub async fn push(
+    run_id: &str,
+    from: &dyn DataAccessService,
+    to: &dyn DataAccessService,
+) -> anyhow::Result<Pushed> {
+    let archive = RunArchive::fetch(run_id, from).await?;
+    if to.run_dao().fetch(run_id).await?.is_some() {
+        return Err(anyhow!("Run {} has already been pushed", run_id));
+    }
+
+    archive.persist(to).await?;
+    Ok(Pushed {
+        iterations: archive.scenario_iterations.len(),
+        samples: archive.samples(),
+        artifacts: archive.artifacts.len(),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::data_access::LocalDataAccessService;
+    use sqlx::SqlitePool;
+
+    #[sqlx::test(migrations = "./migrations", fixtures("../fixtures/runs.sql"))]
+    async fn runs_are_only_pushed_once(pool: SqlitePool) -> anyhow::Result<()> {
+        let data_access_service = LocalDataAccessService::new(pool.clone());
+
+        let pushed = push("2", &data_access_service, &data_access_service).await;
+        assert!(pushed.is_err_and(|err| err.to_string().contains("already been pushed")));
+        let pushed = push("nope", &data_access_service, &data_access_service).await;
+        assert!(pushed.is_err_and(|err| err.to_string().contains("Unable to find run")));
+
+        pool.close().await;
+        Ok(())
+    }
+}
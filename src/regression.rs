@@ -0,0 +1,216 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    compare::{self, ScenarioComparison},
+    config::Config,
+    data_access::run::Run,
+    dataset::ObservationDataset,
+};
+
+/// A scenario which used more energy than its `max_regression_pct` allows.
+#[derive(Debug, PartialEq)]
+pub struct Violation {
+    pub scenario: String,
+    pub max_regression_pct: f64,
+    pub regression_pct: f64,
+    pub baseline_joules: f64,
+    pub joules: f64,
+}
+
+/// # Arguments
+/// * runs - every saved run, oldest first
+/// * baseline - a run id, the label of a run, or the branch or commit it measured
+/// * exclude - runs which can't be the baseline, e.g. those being checked
+///
+/// # Returns
+/// The run with the id, otherwise the latest run with the label, branch or commit
+pub fn find_baseline<'a>(runs: &'a [Run], baseline: &str, exclude: &[&str]) -> Option<&'a Run> {
+    let candidates = runs
+        .iter()
+        .filter(|run| !exclude.contains(&run.run_id.as_str()))
+        .collect::<Vec<_>>();
+    candidates
+        .iter()
+        .find(|run| run.run_id == baseline)
+        .or_else(|| {
+            candidates
+                .iter()
+                .filter(|run| run.label.as_deref() == Some(baseline))
+                .max_by_key(|run| run.start_time)
+        })
+        .or_else(|| {
+            candidates
+                .iter()
+                .filter(|run| run.git_branch.as_deref() == Some(baseline))
+                .max_by_key(|run| run.start_time)
+        })
+        .or_else(|| {
+            candidates
+                .iter()
+                .filter(|run| run.git().is_some_and(|git| git.is_commit(baseline)))
+                .max_by_key(|run| run.start_time)
+        })
+        .copied()
+}
+
+/// The same as [`find_baseline`] for commands which look up any run, e.g. to compare it.
+pub fn find_run<'a>(runs: &'a [Run], run: &str) -> Option<&'a Run> {
+    find_baseline(runs, run, &[])
+}
+
+/// # Returns
+/// The scenarios with a `max_regression_pct` whose mean energy went up by more than it since the
+/// baseline, scenarios without energy in both runs can't be checked
+pub fn violations(
+    config: &Config,
+    baseline: &ObservationDataset,
+    observation_dataset: &ObservationDataset,
+) -> Vec<Violation> {
+    compare::compare(baseline, observation_dataset)
+        .into_iter()
+        .filter_map(|comparison| {
+            let ScenarioComparison::Both { scenario, changes } = comparison else {
+                return None;
+            };
+            let max_regression_pct = config
+                .scenarios
+                .iter()
+                .find(|s| s.name == scenario)?
+                .max_regression_pct?;
+            let energy = changes.iter().find(|change| change.metric == "energy")?;
+            let regression_pct = energy.relative_difference();
+            (regression_pct > max_regression_pct).then(|| Violation {
+                scenario,
+                max_regression_pct,
+                regression_pct,
+                baseline_joules: energy.a.mean,
+                joules: energy.b.mean,
+            })
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        data_access::{cpu_metrics::CpuMetrics, scenario_iteration::ScenarioIteration},
+        dataset::IterationWithMetrics,
+    };
+
+    fn run(run_id: &str, cpu_usage: f64) -> ObservationDataset {
+        let iterations = ["basket_10", "checkout"]
+            .iter()
+            .enumerate()
+            .map(|(i, scenario)| {
+                let start = i as i64 * 5000;
+                IterationWithMetrics::new(
+                    ScenarioIteration::new(run_id, scenario, 0, start, start + 2000, None),
+                    vec![
+                        CpuMetrics::new(run_id, "10", "server", cpu_usage, 100.0, 4, start),
+                        CpuMetrics::new(run_id, "10", "server", cpu_usage, 100.0, 4, start + 2000),
+                    ],
+                    vec![],
+                    vec![],
+                )
+            })
+            .collect();
+        let runs = vec![Run::new(run_id, 0, 10000, Some(40.0), "config", None, None)];
+        ObservationDataset::new(iterations, runs, vec![])
+    }
+
+    #[test]
+    fn scenarios_over_their_max_regression_are_violations() -> anyhow::Result<()> {
+        let config = toml::from_str::<Config>(
+            r#"
+            [[scenarios]]
+            name = "basket_10"
+            desc = ""
+            command = "node basket.js"
+            iterations = 1
+            processes = ["server"]
+            max_regression_pct = 5
+
+            [[scenarios]]
+            name = "checkout"
+            desc = ""
+            command = "node checkout.js"
+            iterations = 1
+            processes = ["server"]
+
+            [[observations]]
+            name = "checkout"
+            scenarios = ["basket_10", "checkout"]
+            "#,
+        )?;
+
+        // 10% more CPU for the same time is 10% more energy
+        let violations = violations(&config, &run("a", 100.0), &run("b", 110.0));
+        assert_eq!(violations.len(), 1);
+        assert_eq!(violations[0].scenario, "basket_10");
+        assert!((violations[0].regression_pct - 10.0).abs() < 1e-9);
+        assert!(super::violations(&config, &run("a", 100.0), &run("b", 104.0)).is_empty());
+
+        let labelled = |run_id: &str, start_time, label: &str| Run {
+            label: Some(String::from(label)),
+            ..Run::new(run_id, start_time, start_time + 1, None, "", None, None)
+        };
+        let runs = vec![
+            labelled("a", 0, "main"),
+            labelled("b", 10, "main"),
+            labelled("c", 20, "feature"),
+            labelled("d", 30, "main"),
+        ];
+        let run_id = |run: Option<&Run>| run.map(|run| run.run_id.clone());
+        assert_eq!(
+            run_id(find_baseline(&runs, "a", &[])),
+            Some(String::from("a"))
+        );
+        assert_eq!(
+            run_id(find_baseline(&runs, "main", &[])),
+            Some(String::from("d"))
+        );
+        // the run being checked isn't its own baseline
+        assert_eq!(
+            run_id(find_baseline(&runs, "main", &["d"])),
+            Some(String::from("b"))
+        );
+        assert_eq!(find_baseline(&runs, "release", &[]), None);
+
+        let runs = vec![Run {
+            git_commit: Some(String::from("3f9a2c1d8e7b6a5f4e3d2c1b0a9f8e7d6c5b4a39")),
+            ..Run::new("e", 40, 41, None, "", None, None)
+        }];
+        assert_eq!(run_id(find_run(&runs, "3f9a2c1")), Some(String::from("e")));
+        assert_eq!(find_run(&runs, "3f9a2"), None);
+
+        let on_branch = |run_id: &str, start_time, branch: &str| Run {
+            git_branch: Some(String::from(branch)),
+            ..Run::new(run_id, start_time, start_time + 1, None, "", None, None)
+        };
+        let runs = vec![
+            on_branch("f", 50, "main"),
+            on_branch("g", 60, "main"),
+            on_branch("h", 70, "feature"),
+            labelled("i", 40, "main"),
+        ];
+        // a label wins over a branch of the same name
+        assert_eq!(
+            run_id(find_baseline(&runs, "main", &[])),
+            Some(String::from("i"))
+        );
+        assert_eq!(
+            run_id(find_baseline(&runs, "main", &["i"])),
+            Some(String::from("g"))
+        );
+        assert_eq!(
+            run_id(find_baseline(&runs, "feature", &[])),
+            Some(String::from("h"))
+        );
+        Ok(())
+    }
+}
@@ -0,0 +1,332 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::config::Replay;
+use anyhow::{anyhow, Context};
+use chrono::DateTime;
+use serde::Deserialize;
+use std::{fs, path::Path, time::Duration};
+use tokio::{task::JoinSet, time::Instant};
+
+/// Headers recorded in a trace which describe the original connection rather than the request
+/// and so must not be replayed.
+const SKIPPED_HEADERS: [&str; 4] = ["host", "content-length", "connection", "transfer-encoding"];
+
+/// A single request read from a trace.
+#[derive(Debug, PartialEq)]
+pub struct TraceRequest {
+    /// Time between the start of the trace and this request being sent.
+    pub offset: Duration,
+    pub method: String,
+    pub url: String,
+    pub headers: Vec<(String, String)>,
+    pub body: Option<String>,
+}
+
+/// Result of replaying a trace.
+#[derive(Debug, PartialEq)]
+pub struct ReplaySummary {
+    pub requests: usize,
+    pub failures: usize,
+}
+
+#[derive(Deserialize)]
+struct Har {
+    log: HarLog,
+}
+
+#[derive(Deserialize)]
+struct HarLog {
+    entries: Vec<HarEntry>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct HarEntry {
+    started_date_time: String,
+    request: HarRequest,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct HarRequest {
+    method: String,
+    url: String,
+    #[serde(default)]
+    headers: Vec<HarHeader>,
+    post_data: Option<HarPostData>,
+}
+
+#[derive(Deserialize)]
+struct HarHeader {
+    name: String,
+    value: String,
+}
+
+#[derive(Deserialize)]
+struct HarPostData {
+    #[serde(default)]
+    text: String,
+}
+
+/// Reads the trace of a replay scenario. Files ending in `.har` are parsed as HAR, anything else
+/// is parsed as a request log.
+///
+/// # Arguments
+/// * replay - the replay config of the scenario
+///
+/// # Returns
+/// The requests in the trace ordered by offset, rebased onto the replay's base url if given
+pub fn load_trace(replay: &Replay) -> anyhow::Result<Vec<TraceRequest>> {
+    let path = Path::new(&replay.trace);
+    let trace =
+        fs::read_to_string(path).context(format!("Unable to read trace file: {}", replay.trace))?;
+
+    let is_har = path
+        .extension()
+        .is_some_and(|ext| ext.eq_ignore_ascii_case("har"));
+    let mut requests = if is_har {
+        parse_har(&trace)?
+    } else {
+        parse_request_log(&trace)?
+    };
+
+    if let Some(base_url) = &replay.base_url {
+        for request in requests.iter_mut() {
+            request.url = rebase(&request.url, base_url);
+        }
+    }
+    requests.sort_by_key(|request| request.offset);
+
+    Ok(requests)
+}
+
+fn parse_har(trace: &str) -> anyhow::Result<Vec<TraceRequest>> {
+    let har = serde_json::from_str::<Har>(trace).context("Error parsing HAR file.")?;
+
+    let mut started = vec![];
+    for entry in har.log.entries.iter() {
+        let time = DateTime::parse_from_rfc3339(&entry.started_date_time).context(format!(
+            "Invalid startedDateTime in HAR file: {}",
+            entry.started_date_time
+        ))?;
+        started.push(time);
+    }
+    let Some(first) = started.iter().min().cloned() else {
+        return Ok(vec![]);
+    };
+
+    Ok(har
+        .log
+        .entries
+        .into_iter()
+        .zip(started)
+        .map(|(entry, time)| {
+            let headers = entry
+                .request
+                .headers
+                .into_iter()
+                .filter(|header| {
+                    // HTTP/2 pseudo headers such as `:authority` can't be sent as headers
+                    !header.name.starts_with(':')
+                        && !SKIPPED_HEADERS.contains(&header.name.to_lowercase().as_str())
+                })
+                .map(|header| (header.name, header.value))
+                .collect();
+
+            TraceRequest {
+                offset: (time - first).to_std().unwrap_or_default(),
+                method: entry.request.method,
+                url: entry.request.url,
+                headers,
+                body: entry.request.post_data.map(|post_data| post_data.text),
+            }
+        })
+        .collect())
+}
+
+fn parse_request_log(trace: &str) -> anyhow::Result<Vec<TraceRequest>> {
+    let mut requests = vec![];
+    for (line_no, line) in trace.lines().enumerate() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+
+        match line.split_whitespace().collect::<Vec<_>>()[..] {
+            [offset, method, url] => {
+                let offset = offset.parse::<u64>().context(format!(
+                    "Invalid offset on line {} of request log: {offset}",
+                    line_no + 1
+                ))?;
+
+                requests.push(TraceRequest {
+                    offset: Duration::from_millis(offset),
+                    method: method.to_uppercase(),
+                    url: String::from(url),
+                    headers: vec![],
+                    body: None,
+                });
+            }
+            _ => {
+                return Err(anyhow!(
+                    "Line {} of request log should be `<offset ms> <METHOD> <URL>`",
+                    line_no + 1
+                ))
+            }
+        }
+    }
+
+    Ok(requests)
+}
+
+/// Replaces the scheme and host of a url with the given base url, keeping the path and query.
+fn rebase(url: &str, base_url: &str) -> String {
+    let base_url = base_url.strip_suffix('/').unwrap_or(base_url);
+    let path = url
+        .split_once("://")
+        .map(|(_, rest)| rest.find(['/', '?']).map_or("", |i| &rest[i..]))
+        .unwrap_or(url);
+
+    format!("{base_url}/{}", path.strip_prefix('/').unwrap_or(path))
+}
+
+/// Replays the requests of a trace, preserving the time between them. Requests are sent at their
+/// offset regardless of whether earlier requests have completed, so slow responses don't change
+/// the shape of the traffic.
+///
+/// # Arguments
+/// * requests - the requests to replay, see [`load_trace`]
+/// * speed - how much faster than recorded to replay the trace
+///
+/// # Returns
+/// The number of requests sent and how many of them failed
+pub async fn replay(requests: &[TraceRequest], speed: f64) -> anyhow::Result<ReplaySummary> {
+    let client = reqwest::Client::new();
+    let start = Instant::now();
+
+    let mut tasks = JoinSet::new();
+    for request in requests.iter() {
+        let method = reqwest::Method::from_bytes(request.method.as_bytes())
+            .context(format!("Invalid HTTP method in trace: {}", request.method))?;
+
+        let mut builder = client.request(method, &request.url);
+        for (name, value) in request.headers.iter() {
+            builder = builder.header(name, value);
+        }
+        if let Some(body) = &request.body {
+            builder = builder.body(body.clone());
+        }
+
+        tokio::time::sleep_until(start + request.offset.div_f64(speed)).await;
+
+        let url = request.url.clone();
+        tasks.spawn(async move {
+            match builder.send().await {
+                Ok(res) if res.status().is_client_error() || res.status().is_server_error() => {
+                    tracing::debug!("Replayed request to {} returned {}", url, res.status());
+                    false
+                }
+                Ok(_) => true,
+                Err(err) => {
+                    tracing::debug!("Replayed request to {} failed: {}", url, err);
+                    false
+                }
+            }
+        });
+    }
+
+    let mut failures = 0;
+    while let Some(succeeded) = tasks.join_next().await {
+        if !succeeded? {
+            failures += 1;
+        }
+    }
+
+    Ok(ReplaySummary {
+        requests: requests.len(),
+        failures,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn can_load_request_log() -> anyhow::Result<()> {
+        let replay = Replay {
+            trace: String::from("./fixtures/trace.log"),
+            base_url: Some(String::from("http://localhost:8080/")),
+            speed: 1.0,
+        };
+        let requests = load_trace(&replay)?;
+
+        let urls = requests.iter().map(|r| r.url.as_str()).collect::<Vec<_>>();
+        assert_eq!(
+            urls,
+            [
+                "http://localhost:8080/",
+                "http://localhost:8080/basket",
+                "http://localhost:8080/basket/items"
+            ]
+        );
+        assert_eq!(requests[2].method, "POST");
+        assert_eq!(requests[2].offset, Duration::from_millis(1200));
+        Ok(())
+    }
+
+    #[test]
+    fn har_offsets_are_relative_to_the_first_request() -> anyhow::Result<()> {
+        let har = r#"{
+            "log": {
+                "entries": [
+                    {
+                        "startedDateTime": "2024-06-04T13:00:01.500Z",
+                        "request": {
+                            "method": "POST",
+                            "url": "https://shop.example.com/basket/items?id=7",
+                            "headers": [
+                                { "name": ":authority", "value": "shop.example.com" },
+                                { "name": "Content-Type", "value": "application/json" },
+                                { "name": "Content-Length", "value": "9" }
+                            ],
+                            "postData": { "mimeType": "application/json", "text": "{\"qty\":1}" }
+                        }
+                    },
+                    {
+                        "startedDateTime": "2024-06-04T13:00:00.000Z",
+                        "request": { "method": "GET", "url": "https://shop.example.com/" }
+                    }
+                ]
+            }
+        }"#;
+
+        let requests = parse_har(har)?;
+        assert_eq!(requests[0].offset, Duration::from_millis(1500));
+        assert_eq!(
+            requests[0].headers,
+            [(
+                String::from("Content-Type"),
+                String::from("application/json")
+            )]
+        );
+        assert_eq!(requests[0].body.as_deref(), Some("{\"qty\":1}"));
+        assert_eq!(requests[1].offset, Duration::ZERO);
+
+        assert_eq!(
+            rebase(&requests[0].url, "http://localhost:3000"),
+            "http://localhost:3000/basket/items?id=7"
+        );
+        Ok(())
+    }
+
+    #[test]
+    fn malformed_request_log_is_rejected() {
+        assert!(parse_request_log("0 GET").is_err());
+        assert!(parse_request_log("soon GET http://localhost/").is_err());
+    }
+}
@@ -0,0 +1,1101 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    annotation::{self, Annotation},
+    carbon,
+    compare::{self, ScenarioComparison},
+    config::{Blend, Config, Cost, Embodied, ProcessType},
+    container,
+    data_access::{artifact::Artifact, run::Run},
+    dataset::{IterationWithMetrics, ObservationDataset, RunDataset},
+    environment::Environment,
+    regression,
+    reproducibility::{self, Reproducibility},
+};
+use itertools::Itertools;
+use std::{fmt::Write, time::Duration};
+
+/// Colours of the lines in charts, reused once there are more lines than colours.
+const PALETTE: [&str; 8] = [
+    "#1b9e77", "#d95f02", "#7570b3", "#e7298a", "#66a61e", "#e6ab02", "#a6761d", "#666666",
+];
+
+const CHART_WIDTH: f64 = 760.0;
+const CHART_HEIGHT: f64 = 220.0;
+const CHART_MARGIN: f64 = 40.0;
+
+/// Artifacts larger than this, or which aren't text, are listed in a report rather than embedded.
+const MAX_EMBEDDED_BYTES: usize = 256 * 1024;
+
+pub(crate) const STYLE: &str =
+    "body{font-family:sans-serif;margin:2em auto;max-width:860px;color:#222}\
+table{border-collapse:collapse;margin:1em 0;width:100%}\
+th,td{border-bottom:1px solid #ddd;padding:4px 8px;text-align:right}\
+th:first-child,td:first-child{text-align:left}\
+dt{font-weight:bold}dd{margin:0 0 .5em 0}\
+svg text{font-size:11px;fill:#444}\
+.legend{cursor:pointer}\
+.share{background:#1b9e77;height:10px}";
+
+/// Lets the series of a chart be hidden and shown again by clicking them in the legend, so the
+/// power of one process can be picked out.
+const SCRIPT: &str = "function toggleSeries(legend){\
+var series=document.getElementById(legend.getAttribute('data-series'));\
+var hidden=series.style.display==='none';\
+series.style.display=hidden?'':'none';\
+legend.style.opacity=hidden?1:0.4;}";
+
+/// The config a run was started with, None if it wasn't saved or can no longer be parsed.
+pub fn run_config(run: &Run) -> Option<Config> {
+    run.config
+        .as_deref()
+        .and_then(|config| toml::from_str::<Config>(config).ok())
+}
+
+/// The blend a run was measured with, taken from the config it was started with so a report
+/// shows the same energy the run printed.
+pub fn run_blend(run: &Run) -> Option<Blend> {
+    run_config(run).and_then(|config| config.blend)
+}
+
+/// The outlier threshold of the config a run was started with, so the statistics of a report
+/// leave out the iterations the run did.
+pub fn run_outlier_threshold(run: &Run) -> Option<f64> {
+    run_config(run).and_then(|config| config.outlier_threshold)
+}
+
+/// A line on a chart, broken into a segment per iteration so the gaps between iterations aren't
+/// drawn over.
+struct Series {
+    name: String,
+    /// Points of each segment as seconds since the run started and a value.
+    segments: Vec<Vec<(f64, f64)>>,
+}
+
+/// # Returns
+/// A single HTML page, with no external resources, reporting the energy and reproducibility of
+/// every scenario in the run along with a breakdown by process, charts of power over time and the
+/// files attached to the run
+pub fn html(
+    observation_dataset: &ObservationDataset,
+    blend: Option<&Blend>,
+    artifacts: &[Artifact],
+) -> String {
+    let run = observation_dataset.runs().first();
+    let run_id = run.map(|run| run.run_id.as_str()).unwrap_or("unknown");
+    let tdp = run.and_then(|run| run.tdp);
+    let outlier_threshold = run.and_then(run_outlier_threshold);
+    let intensity = run.and_then(|run| run.carbon_intensity);
+    let pue = run.and_then(|run| run.pue);
+    let embodied = run
+        .and_then(run_config)
+        .and_then(|config| config.carbon)
+        .and_then(|carbon| carbon.embodied);
+    let cost = run.and_then(run_config).and_then(|config| config.cost);
+    let projects = run
+        .and_then(run_config)
+        .map(|config| compose_projects(&config))
+        .unwrap_or_default();
+
+    let mut page = String::new();
+    let _ = write!(
+        page,
+        "<!DOCTYPE html><html><head><meta charset=\"utf-8\"><title>Cardamon run {}</title><style>{}</style><script>{}</script></head><body>",
+        escape(run_id),
+        STYLE,
+        SCRIPT
+    );
+    let _ = write!(page, "<h1>Cardamon run {}</h1>", escape(run_id));
+    if let Some(run) = run {
+        page.push_str(&provenance(run));
+        let annotations = run.annotations();
+        if !annotations.is_empty() {
+            page.push_str("<h2>Notes</h2>");
+            page.push_str(&notes(&annotations));
+        }
+    }
+
+    let scenario_datasets = observation_dataset.by_scenario();
+    let run_datasets = scenario_datasets
+        .iter()
+        .flat_map(|scenario_dataset| scenario_dataset.by_run())
+        .collect::<Vec<_>>();
+
+    page.push_str("<h2>Summary</h2>");
+    page.push_str(&summary_table(
+        &run_datasets,
+        tdp,
+        blend,
+        outlier_threshold,
+        intensity,
+        pue,
+        embodied.as_ref(),
+        cost.as_ref(),
+    ));
+    if let Some(cost) = &cost {
+        let total = run_datasets
+            .iter()
+            .flat_map(|run_dataset| run_dataset.iteration_costs(tdp, blend, pue, cost))
+            .sum::<f64>();
+        let _ = write!(
+            page,
+            "<p>The electricity of the run cost {:.6} {}.</p>",
+            total,
+            escape(&cost.currency)
+        );
+    }
+
+    for (index, run_dataset) in run_datasets.iter().enumerate() {
+        let _ = write!(page, "<h2>{}</h2>", escape(run_dataset.scenario_name()));
+        page.push_str("<h3>Reproducibility</h3>");
+        page.push_str(&reproducibility_list(&reproducibility::score(
+            run_dataset,
+            run_dataset.has_power_metrics(),
+        )));
+        page.push_str(&process_table(run_dataset, tdp, blend));
+        if let Some(breakdown) = breakdown_table(run_dataset, tdp, blend, &projects) {
+            page.push_str("<h3>Breakdown</h3>");
+            page.push_str(&breakdown);
+        }
+
+        let unit = if tdp.is_some() { "W" } else { "% CPU" };
+        let _ = write!(page, "<h3>Power over time ({})</h3>", unit);
+        page.push_str(&chart(
+            &format!("chart{index}"),
+            &power_series(run_dataset, tdp),
+            &iteration_spans(run_dataset),
+            unit,
+        ));
+    }
+
+    if !artifacts.is_empty() {
+        page.push_str("<h2>Artifacts</h2>");
+        page.push_str(&artifact_list(run_id, artifacts));
+    }
+
+    page.push_str("</body></html>\n");
+    page
+}
+
+/// # Arguments
+/// * observation_dataset - the run being reported
+/// * blend - confidence in estimates and measurements
+/// * baseline - the run to compare with, e.g. the latest run of the main branch
+///
+/// # Returns
+/// A compact Markdown table of the energy of every scenario in the run, meant to be posted as a
+/// comment on a pull request. Against a baseline each scenario is marked 🔴 if it used more
+/// energy, by more than the noise or its max_regression_pct, 🟢 if it used less and ⚪ otherwise
+pub fn markdown(
+    observation_dataset: &ObservationDataset,
+    blend: Option<&Blend>,
+    baseline: Option<&ObservationDataset>,
+) -> String {
+    let run = observation_dataset.runs().first();
+    let run_id = run.map(|run| run.run_id.as_str()).unwrap_or("unknown");
+    let tdp = run.and_then(|run| run.tdp);
+    let outlier_threshold = run.and_then(run_outlier_threshold);
+
+    let mut text = format!("### Cardamon run `{}`\n\n", run_id);
+    if let Some(summary) = run.and_then(|run| annotation::summary(&run.annotations())) {
+        let _ = write!(text, "_{}_\n\n", markdown_escape(&summary));
+    }
+    let comparisons = baseline
+        .map(|baseline| compare::compare(baseline, observation_dataset))
+        .unwrap_or_default();
+    let regressed = match (baseline, run.and_then(run_config)) {
+        (Some(baseline), Some(config)) => {
+            regression::violations(&config, baseline, observation_dataset)
+                .into_iter()
+                .map(|violation| violation.scenario)
+                .collect()
+        }
+        _ => vec![],
+    };
+    if let Some(baseline_run) = baseline.and_then(|baseline| baseline.runs().first()) {
+        let _ = write!(text, "Compared with run `{}`", baseline_run.run_id);
+        if let Some(label) = baseline_run.label.as_deref() {
+            let _ = write!(text, " ({})", markdown_escape(label));
+        }
+        if let Some(git) = baseline_run.git() {
+            let _ = write!(text, " at `{}`", git.short_commit());
+        }
+        text.push_str(": 🔴 more energy, 🟢 less energy, ⚪ within noise\n\n");
+        text.push_str("| | Scenario | Energy (J) | vs baseline |\n|---|---|---:|---:|\n");
+    } else {
+        text.push_str("| Scenario | Energy (J) |\n|---|---:|\n");
+    }
+
+    let scenario_datasets = observation_dataset.by_scenario();
+    for run_dataset in scenario_datasets
+        .iter()
+        .flat_map(|scenario_dataset| scenario_dataset.by_run())
+    {
+        let scenario = run_dataset.scenario_name();
+        let energy = match run_dataset.energy_stats(tdp, blend, outlier_threshold) {
+            Some(stats) if stats.iterations > 1 => {
+                format!("{:.3} ± {:.3}", stats.mean, stats.stddev)
+            }
+            Some(stats) => format!("{:.3}", stats.mean),
+            None => String::from("unavailable"),
+        };
+        if baseline.is_none() {
+            let _ = writeln!(text, "| {} | {} |", markdown_escape(scenario), energy);
+            continue;
+        }
+
+        let change = comparisons.iter().find_map(|comparison| match comparison {
+            ScenarioComparison::Both {
+                scenario: other,
+                changes,
+            } if other == scenario => Some(changes.iter().find(|change| change.metric == "energy")),
+            _ => None,
+        });
+        let (indicator, delta) = match change {
+            Some(Some(change)) => {
+                let worse = change.difference() > 0.0
+                    && (change.is_significant() || regressed.iter().any(|name| name == scenario));
+                let indicator = if worse {
+                    "🔴"
+                } else if change.difference() < 0.0 && change.is_significant() {
+                    "🟢"
+                } else {
+                    "⚪"
+                };
+                (indicator, format!("{:+.1}%", change.relative_difference()))
+            }
+            Some(None) => ("⚪", String::from("unavailable")),
+            None => ("🆕", String::from("new")),
+        };
+        let _ = writeln!(
+            text,
+            "| {} | {} | {} | {} |",
+            indicator,
+            markdown_escape(scenario),
+            energy,
+            delta
+        );
+    }
+    for comparison in comparisons.iter() {
+        if let ScenarioComparison::OnlyInA(scenario) = comparison {
+            let _ = writeln!(text, "| ➖ | {} | | removed |", markdown_escape(scenario));
+        }
+    }
+    text
+}
+
+/// # Returns
+/// A list of the notes added to a run, when each was added and what it said
+pub(crate) fn notes(annotations: &[Annotation]) -> String {
+    let mut list = String::from("<ul>");
+    for annotation in annotations.iter() {
+        let added = chrono::DateTime::from_timestamp_millis(annotation.created_at)
+            .map(|added| added.format("%Y-%m-%d %H:%M").to_string())
+            .unwrap_or_default();
+        let _ = write!(
+            list,
+            "<li>{}: {}</li>",
+            added,
+            escape(&annotation.to_string())
+        );
+    }
+    list.push_str("</ul>");
+    list
+}
+
+/// # Returns
+/// The score and each factor which took points off it, as `cardamon stats` prints them
+fn reproducibility_list(reproducibility: &Reproducibility) -> String {
+    let mut list = format!("<p>{}</p><ul>", escape(&reproducibility.to_string()));
+    for factor in reproducibility
+        .factors
+        .iter()
+        .filter(|factor| factor.penalty > 0.0)
+    {
+        let _ = write!(
+            list,
+            "<li>-{:.0} {}: {}</li>",
+            factor.penalty,
+            escape(factor.name),
+            escape(&factor.detail)
+        );
+    }
+    list.push_str("</ul>");
+    list
+}
+
+/// # Returns
+/// The files attached to a run. Text files are embedded so they can be read in the report,
+/// anything else is listed with how to extract it
+fn artifact_list(run_id: &str, artifacts: &[Artifact]) -> String {
+    let mut list = String::from("<ul>");
+    for artifact in artifacts.iter() {
+        let name = format!(
+            "{} ({}, {} bytes)",
+            artifact.name,
+            artifact.file_name,
+            artifact.content.len()
+        );
+        let text = std::str::from_utf8(&artifact.content)
+            .ok()
+            .filter(|_| artifact.content.len() <= MAX_EMBEDDED_BYTES);
+        match text {
+            Some(text) => {
+                let _ = write!(
+                    list,
+                    "<li><details><summary>{}</summary><pre>{}</pre></details></li>",
+                    escape(&name),
+                    escape(text)
+                );
+            }
+            None => {
+                let _ = write!(
+                    list,
+                    "<li>{}, extract it with <code>cardamon artifacts --run {} --extract DIR</code></li>",
+                    escape(&name),
+                    escape(run_id)
+                );
+            }
+        }
+    }
+    list.push_str("</ul>");
+    list
+}
+
+fn provenance(run: &Run) -> String {
+    let mut dl = String::from("<dl>");
+    let mut item = |term: &str, description: String| {
+        let _ = write!(dl, "<dt>{}</dt><dd>{}</dd>", term, escape(&description));
+    };
+
+    if let Some(start) = chrono::DateTime::from_timestamp_millis(run.start_time) {
+        item("Started", start.format("%Y-%m-%d %H:%M:%S UTC").to_string());
+    }
+    let secs = (run.stop_time - run.start_time).max(0) as f64 / 1000.0;
+    item("Duration", format!("{:.1} s", secs));
+    if let Some(aborted) = &run.aborted {
+        item("Aborted", aborted.clone());
+    }
+    match run.tdp {
+        Some(tdp) => item("TDP", format!("{:.1} W ({})", tdp, run.tdp_source)),
+        None => item(
+            "TDP",
+            run.energy_unavailable
+                .clone()
+                .unwrap_or(String::from("unknown, energy is unavailable")),
+        ),
+    }
+    if let Some(environment) = run
+        .environment
+        .as_deref()
+        .and_then(|json| serde_json::from_str::<Environment>(json).ok())
+    {
+        item("Environment", environment.to_string());
+    }
+    if let (Some(intensity), Some(source)) = (run.carbon_intensity, &run.carbon_intensity_source) {
+        item(
+            "Carbon intensity",
+            format!("{:.0} gCO2e/kWh ({})", intensity, source),
+        );
+    }
+    if let Some(pue) = run.pue {
+        item("PUE", format!("{:.2}", pue));
+    }
+    if let Some(seed) = run.shuffle_seed {
+        item("Shuffle seed", seed.to_string());
+    }
+
+    dl.push_str("</dl>");
+    dl
+}
+
+/// # Arguments
+/// * intensity - the carbon intensity of the run, the carbon of each scenario is only reported if
+///   it's known
+/// * pue - the Power Usage Effectiveness of the facility the run was measured in
+/// * embodied - the embodied carbon of the hardware, amortised over each scenario if it's known
+/// * cost - the price of electricity, the cost of each scenario is only reported if it's known
+fn summary_table(
+    run_datasets: &[RunDataset],
+    tdp: Option<f64>,
+    blend: Option<&Blend>,
+    outlier_threshold: Option<f64>,
+    intensity: Option<f64>,
+    pue: Option<f64>,
+    embodied: Option<&Embodied>,
+    cost: Option<&Cost>,
+) -> String {
+    let mut table = String::from(
+        "<table><tr><th>Scenario</th><th>Iterations</th><th>Mean duration (s)</th><th>Mean energy (J)</th><th>Stddev (J)</th><th>p90 (J)</th><th>p99 (J)</th><th>Min (J)</th><th>Max (J)</th>",
+    );
+    if intensity.is_some() {
+        table.push_str("<th>Mean carbon (gCO2e)</th>");
+    }
+    if embodied.is_some() {
+        table.push_str("<th>Mean embodied carbon (gCO2e)</th>");
+    }
+    if let Some(cost) = cost {
+        let _ = write!(table, "<th>Mean cost ({})</th>", escape(&cost.currency));
+    }
+    table.push_str("</tr>");
+    let columns = if intensity.is_some() { 7 } else { 6 };
+    for run_dataset in run_datasets.iter() {
+        let stats = run_dataset.energy_stats(tdp, blend, outlier_threshold);
+        let mut iterations = run_dataset.by_iterations().len().to_string();
+        if let Some(outliers) = stats.map(|stats| stats.outliers).filter(|n| *n > 0) {
+            let _ = write!(iterations, " ({} outliers excluded)", outliers);
+        }
+        let _ = write!(
+            table,
+            "<tr><td>{}</td><td>{}</td><td>{:.3}</td>",
+            escape(run_dataset.scenario_name()),
+            iterations,
+            run_dataset.mean_iteration_secs()
+        );
+        match stats {
+            Some(stats) => {
+                let _ = write!(
+                    table,
+                    "<td>{:.3}</td><td>{:.3}</td><td>{:.3}</td><td>{:.3}</td><td>{:.3}</td><td>{:.3}</td>",
+                    stats.mean, stats.stddev, stats.p90, stats.p99, stats.min, stats.max
+                );
+                if let Some(intensity) = intensity {
+                    let grams = carbon::operational_grams(
+                        carbon::facility_joules(stats.mean, pue),
+                        intensity,
+                    );
+                    let _ = write!(table, "<td>{:.6}</td>", grams);
+                }
+            }
+            None => {
+                let _ = write!(table, "<td colspan=\"{}\">unavailable</td>", columns);
+            }
+        }
+        // embodied carbon depends on time rather than energy so it's known either way
+        if let Some(embodied) = embodied {
+            let wall_clock = Duration::from_secs_f64(run_dataset.mean_iteration_secs());
+            let grams = carbon::embodied_grams(embodied, wall_clock);
+            let _ = write!(table, "<td>{:.6}</td>", grams);
+        }
+        if let Some(cost) = cost {
+            let costs = run_dataset.iteration_costs(tdp, blend, pue, cost);
+            if costs.is_empty() {
+                table.push_str("<td>unavailable</td>");
+            } else {
+                let mean = costs.iter().sum::<f64>() / costs.len() as f64;
+                let _ = write!(table, "<td>{:.6}</td>", mean);
+            }
+        }
+        table.push_str("</tr>");
+    }
+    table.push_str("</table>");
+    table
+}
+
+fn process_table(run_dataset: &RunDataset, tdp: Option<f64>, blend: Option<&Blend>) -> String {
+    let mut table = String::from(
+        "<table><tr><th>Process</th><th>Mean CPU (%)</th><th>CPU seconds</th><th>Energy (J)</th><th>Source</th><th>Peak memory (MB)</th></tr>",
+    );
+    let averaged = run_dataset.averaged();
+    for metrics in averaged
+        .iter()
+        .sorted_by(|a, b| a.process_name().cmp(b.process_name()))
+    {
+        let energy = metrics.energy(tdp, blend);
+        let _ = write!(
+            table,
+            "<tr><td>{}</td><td>{:.2}</td><td>{:.3}</td><td>{}</td><td>{}</td><td>{}</td></tr>",
+            escape(metrics.process_name()),
+            metrics.cpu_usage_mean(),
+            metrics.cpu_seconds(),
+            energy
+                .as_ref()
+                .map(|energy| format!("{:.3}", energy.joules()))
+                .unwrap_or(String::from("unavailable")),
+            energy.as_ref().map(|energy| energy.label()).unwrap_or("-"),
+            metrics
+                .peak_memory_bytes()
+                .map(|bytes| format!("{:.3}", bytes / 1_000_000.0))
+                .unwrap_or(String::from("-"))
+        );
+    }
+    table.push_str("</table>");
+    table
+}
+
+/// Processes grouped into what they're part of, e.g. the services of a compose project or the
+/// deployments of a namespace, with the energy of everything in the group.
+#[derive(Debug, PartialEq)]
+struct Component {
+    name: String,
+    joules: f64,
+    children: Vec<Component>,
+}
+impl Component {
+    fn insert(components: &mut Vec<Component>, path: &[String], joules: f64) {
+        let Some((name, rest)) = path.split_first() else {
+            return;
+        };
+        let index = match components.iter().position(|c| &c.name == name) {
+            Some(index) => index,
+            None => {
+                components.push(Component {
+                    name: name.clone(),
+                    joules: 0.0,
+                    children: vec![],
+                });
+                components.len() - 1
+            }
+        };
+        components[index].joules += joules;
+        Component::insert(&mut components[index].children, rest, joules);
+    }
+
+    /// Largest first, so the component which dominates is at the top.
+    fn sort(components: &mut [Component]) {
+        components.sort_by(|a, b| b.joules.total_cmp(&a.joules));
+        for component in components.iter_mut() {
+            Component::sort(&mut component.children);
+        }
+    }
+}
+
+/// # Returns
+/// The compose projects of the processes the run was started with, their containers are named
+/// after them
+fn compose_projects(config: &Config) -> Vec<String> {
+    config
+        .processes
+        .iter()
+        .filter_map(|process| match &process.process {
+            ProcessType::Docker { project, .. } => project
+                .clone()
+                .or_else(|| process.up.as_deref().and_then(container::compose_project)),
+            _ => None,
+        })
+        .collect()
+}
+
+/// # Returns
+/// Where a process belongs, e.g. `shop`, `web` for the container `shop-web-1` of the compose
+/// project `shop`, or `shop`, `checkout` for the pods of the deployment `shop/checkout`
+fn component_path(process_name: &str, projects: &[String]) -> Vec<String> {
+    for project in projects.iter() {
+        // compose names containers project-service-replica, or with underscores before v2
+        for separator in ['-', '_'] {
+            let Some(rest) = process_name.strip_prefix(&format!("{project}{separator}")) else {
+                continue;
+            };
+            let service = rest
+                .rsplit_once(separator)
+                .filter(|(_, replica)| replica.chars().all(|c| c.is_ascii_digit()))
+                .map_or(rest, |(service, _)| service);
+            return vec![project.clone(), String::from(service)];
+        }
+    }
+    process_name.split('/').map(String::from).collect()
+}
+
+/// # Returns
+/// A nested table of the energy of the processes grouped by what they're part of, with the
+/// share of the scenario's energy of each group, None unless there are several processes with
+/// energy
+fn breakdown_table(
+    run_dataset: &RunDataset,
+    tdp: Option<f64>,
+    blend: Option<&Blend>,
+    projects: &[String],
+) -> Option<String> {
+    let averaged = run_dataset.averaged();
+    let processes = averaged
+        .iter()
+        .filter_map(|metrics| {
+            let joules = metrics.energy(tdp, blend)?.joules();
+            let path = component_path(metrics.process_name(), projects);
+            Some((path, metrics, joules))
+        })
+        .collect::<Vec<_>>();
+    if processes.len() < 2 {
+        return None;
+    }
+
+    let mut components = vec![];
+    for (path, metrics, joules) in processes.iter() {
+        // processes sharing a place, e.g. the containers of a service, are listed under it by
+        // name, or by id if they share that too like the pods of a deployment
+        let sharing = |same_name: bool| {
+            processes
+                .iter()
+                .filter(|(other, other_metrics, _)| {
+                    other == path
+                        && (!same_name || other_metrics.process_name() == metrics.process_name())
+                })
+                .count()
+                > 1
+        };
+        let mut path = path.clone();
+        if sharing(true) {
+            path.push(String::from(metrics.process_id()));
+        } else if sharing(false) {
+            path.push(String::from(metrics.process_name()));
+        }
+        Component::insert(&mut components, &path, *joules);
+    }
+    Component::sort(&mut components);
+    let total = components.iter().map(|c| c.joules).sum::<f64>();
+
+    fn rows(table: &mut String, components: &[Component], depth: usize, total: f64) {
+        for component in components.iter() {
+            let share = if total > 0.0 {
+                component.joules / total * 100.0
+            } else {
+                0.0
+            };
+            let _ = write!(
+                table,
+                "<tr><td style=\"padding-left:{:.1}em\">{}</td><td>{:.3}</td><td>{:.1}</td><td><div class=\"share\" style=\"width:{:.1}%\"></div></td></tr>",
+                0.5 + 1.5 * depth as f64,
+                escape(&component.name),
+                component.joules,
+                share,
+                share
+            );
+            rows(table, &component.children, depth + 1, total);
+        }
+    }
+    let mut table = String::from(
+        "<table><tr><th>Component</th><th>Energy (J)</th><th>Share (%)</th><th></th></tr>",
+    );
+    rows(&mut table, &components, 0, total);
+    table.push_str("</table>");
+    Some(table)
+}
+
+/// An iteration on a chart, from and to seconds since the run started.
+struct Span {
+    iteration: i64,
+    from: f64,
+    to: f64,
+}
+
+/// # Returns
+/// When charts of the run start, the start of the run or of its first iteration
+fn chart_origin(run_dataset: &RunDataset) -> i64 {
+    run_dataset
+        .run()
+        .map(|run| run.start_time)
+        .or_else(|| {
+            run_dataset
+                .by_iterations()
+                .iter()
+                .map(|it| it.scenario_iteration().start_time)
+                .min()
+        })
+        .unwrap_or(0)
+}
+
+/// # Returns
+/// When each iteration of the run ran, so the power can be matched to what the scenario did
+fn iteration_spans(run_dataset: &RunDataset) -> Vec<Span> {
+    let start = chart_origin(run_dataset);
+    let secs = |timestamp: i64| (timestamp - start) as f64 / 1000.0;
+    run_dataset
+        .by_iterations()
+        .iter()
+        .map(|it| {
+            let scenario_iteration = it.scenario_iteration();
+            Span {
+                iteration: scenario_iteration.iteration,
+                from: secs(scenario_iteration.start_time),
+                to: secs(scenario_iteration.stop_time),
+            }
+        })
+        .sorted_by(|a, b| a.from.total_cmp(&b.from))
+        .collect()
+}
+
+/// The power of each process over the run's iterations, estimated from its CPU usage with the
+/// TDP, along with the readings of each power source. Without a TDP the CPU usage is charted.
+fn power_series(run_dataset: &RunDataset, tdp: Option<f64>) -> Vec<Series> {
+    let start = chart_origin(run_dataset);
+    let secs = |timestamp: i64| (timestamp - start) as f64 / 1000.0;
+
+    let mut series: Vec<Series> = vec![];
+    let mut push = |name: String, segment: Vec<(f64, f64)>| {
+        if segment.is_empty() {
+            return;
+        }
+        match series.iter_mut().find(|series| series.name == name) {
+            Some(series) => series.segments.push(segment),
+            None => series.push(Series {
+                name,
+                segments: vec![segment],
+            }),
+        }
+    };
+
+    for iteration in run_dataset.by_iterations().iter() {
+        for (name, samples) in cpu_samples(iteration) {
+            let segment = samples
+                .iter()
+                .map(|metrics| {
+                    let value = match tdp {
+                        Some(tdp) => {
+                            let share =
+                                metrics.cpu_usage / 100.0 / metrics.core_count.max(1) as f64;
+                            share.min(1.0) * tdp
+                        }
+                        None => metrics.cpu_usage,
+                    };
+                    (secs(metrics.timestamp), value)
+                })
+                .collect();
+            push(name, segment);
+        }
+
+        // readings already attributed to a process by the power source aren't totals
+        if tdp.is_some() {
+            let readings = iteration
+                .power_metrics()
+                .iter()
+                .filter(|metrics| metrics.process_id.is_none())
+                .sorted_by_key(|metrics| (&metrics.source, &metrics.component, metrics.timestamp))
+                .chunk_by(|metrics| format!("{} {}", metrics.source, metrics.component));
+            for (name, readings) in readings.into_iter() {
+                let segment = readings
+                    .map(|metrics| (secs(metrics.timestamp), metrics.power))
+                    .collect();
+                push(format!("{} (measured)", name), segment);
+            }
+        }
+    }
+
+    series
+}
+
+/// # Returns
+/// The CPU samples of each process in the iteration in the order they were taken, keyed by the
+/// name of the process
+fn cpu_samples(
+    iteration: &IterationWithMetrics,
+) -> Vec<(String, Vec<&crate::data_access::cpu_metrics::CpuMetrics>)> {
+    iteration
+        .cpu_metrics()
+        .iter()
+        .sorted_by_key(|metrics| {
+            (
+                &metrics.process_name,
+                &metrics.process_id,
+                metrics.timestamp,
+            )
+        })
+        .chunk_by(|metrics| (&metrics.process_name, &metrics.process_id))
+        .into_iter()
+        .map(|((name, _), samples)| (name.clone(), samples.collect()))
+        .collect()
+}
+
+/// # Arguments
+/// * id - unique to the chart in the page, its series are toggled by it
+/// * series - the lines of the chart
+/// * spans - the iterations, shaded behind the lines
+/// * unit - the unit of the y axis
+///
+/// # Returns
+/// An inline SVG line chart of the series. Hovering over a sample shows its value and when it
+/// was taken, clicking a series in the legend hides it.
+fn chart(id: &str, series: &[Series], spans: &[Span], unit: &str) -> String {
+    let points = series
+        .iter()
+        .flat_map(|series| series.segments.iter().flatten())
+        .collect::<Vec<_>>();
+    if points.is_empty() {
+        return String::from("<p>No samples were taken.</p>");
+    }
+
+    let max_x = points.iter().map(|(x, _)| *x).fold(0.0, f64::max).max(1.0);
+    let min_x = points
+        .iter()
+        .map(|(x, _)| *x)
+        .fold(max_x, f64::min)
+        .min(max_x);
+    let max_y = points.iter().map(|(_, y)| *y).fold(0.0, f64::max).max(1.0);
+    let plot_width = CHART_WIDTH - 2.0 * CHART_MARGIN;
+    let plot_height = CHART_HEIGHT - 2.0 * CHART_MARGIN;
+    let to_x = |x: f64| CHART_MARGIN + (x - min_x) / (max_x - min_x).max(1e-9) * plot_width;
+    let to_y = |y: f64| CHART_MARGIN + plot_height - y / max_y * plot_height;
+
+    let legend_height = 16.0 * series.len() as f64;
+    let mut svg = String::new();
+    let _ = write!(
+        svg,
+        "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"{w}\" height=\"{h}\" viewBox=\"0 0 {w} {h}\">",
+        w = CHART_WIDTH,
+        h = CHART_HEIGHT + legend_height
+    );
+
+    // axes with their extremes labelled
+    let _ = write!(
+        svg,
+        "<polyline fill=\"none\" stroke=\"#999\" points=\"{l},{t} {l},{b} {r},{b}\"/>",
+        l = CHART_MARGIN,
+        t = CHART_MARGIN,
+        b = CHART_MARGIN + plot_height,
+        r = CHART_MARGIN + plot_width
+    );
+    let _ = write!(
+        svg,
+        "<text x=\"{}\" y=\"{}\">{:.1} {}</text>",
+        CHART_MARGIN,
+        CHART_MARGIN - 8.0,
+        max_y,
+        escape(unit)
+    );
+    let _ = write!(
+        svg,
+        "<text x=\"{}\" y=\"{}\">{:.1} s</text><text x=\"{}\" y=\"{}\" text-anchor=\"end\">{:.1} s</text>",
+        CHART_MARGIN,
+        CHART_MARGIN + plot_height + 16.0,
+        min_x,
+        CHART_MARGIN + plot_width,
+        CHART_MARGIN + plot_height + 16.0,
+        max_x
+    );
+
+    // every other iteration is shaded so where one ends and the next starts is clear
+    for (i, span) in spans
+        .iter()
+        .enumerate()
+        .filter(|(_, span)| span.to > min_x && span.from < max_x)
+    {
+        let (from, to) = (to_x(span.from.max(min_x)), to_x(span.to.min(max_x)));
+        let _ = write!(
+            svg,
+            "<rect x=\"{:.1}\" y=\"{}\" width=\"{:.1}\" height=\"{}\" fill=\"{}\"><title>iteration {}: {:.1} s to {:.1} s</title></rect>",
+            from,
+            CHART_MARGIN,
+            (to - from).max(1.0),
+            plot_height,
+            if i % 2 == 0 { "#f2f2f2" } else { "#e8e8e8" },
+            span.iteration,
+            span.from,
+            span.to
+        );
+        let _ = write!(
+            svg,
+            "<line x1=\"{x:.1}\" y1=\"{}\" x2=\"{x:.1}\" y2=\"{}\" stroke=\"#bbb\" stroke-dasharray=\"3,3\"/><text x=\"{:.1}\" y=\"{}\">#{}</text>",
+            CHART_MARGIN,
+            CHART_MARGIN + plot_height,
+            from + 2.0,
+            CHART_MARGIN + 10.0,
+            span.iteration,
+            x = from
+        );
+    }
+
+    for (i, series) in series.iter().enumerate() {
+        let colour = PALETTE[i % PALETTE.len()];
+        let series_id = format!("{id}-series{i}");
+        let _ = write!(svg, "<g id=\"{}\">", series_id);
+        for segment in series.segments.iter() {
+            let points = segment
+                .iter()
+                .map(|(x, y)| format!("{:.1},{:.1}", to_x(*x), to_y(*y)))
+                .join(" ");
+            let _ = write!(
+                svg,
+                "<polyline fill=\"none\" stroke=\"{}\" stroke-width=\"1.5\" points=\"{}\"/>",
+                colour, points
+            );
+            for (x, y) in segment.iter() {
+                let _ = write!(
+                    svg,
+                    "<circle cx=\"{:.1}\" cy=\"{:.1}\" r=\"2.5\" fill=\"{}\"><title>{}: {:.2} {} at {:.1} s</title></circle>",
+                    to_x(*x),
+                    to_y(*y),
+                    colour,
+                    escape(&series.name),
+                    y,
+                    escape(unit),
+                    x
+                );
+            }
+        }
+        svg.push_str("</g>");
+
+        let y = CHART_HEIGHT + 16.0 * i as f64;
+        let _ = write!(
+            svg,
+            "<g class=\"legend\" data-series=\"{}\" onclick=\"toggleSeries(this)\"><rect x=\"{}\" y=\"{}\" width=\"10\" height=\"10\" fill=\"{}\"/><text x=\"{}\" y=\"{}\">{}</text></g>",
+            series_id,
+            CHART_MARGIN,
+            y - 9.0,
+            colour,
+            CHART_MARGIN + 16.0,
+            y,
+            escape(&series.name)
+        );
+    }
+
+    svg.push_str("</svg>");
+    svg
+}
+
+pub(crate) fn escape(text: &str) -> String {
+    text.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
+
+fn markdown_escape(text: &str) -> String {
+    text.replace('|', "\\|").replace('\n', " ")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::data_access::{
+        cpu_metrics::CpuMetrics, power_metrics::PowerMetrics, scenario_iteration::ScenarioIteration,
+    };
+
+    #[test]
+    fn reports_are_a_single_page() {
+        let iteration = IterationWithMetrics::new(
+            ScenarioIteration::new("1", "basket<10>", 0, 1000, 3000, None),
+            vec![
+                CpuMetrics::new("1", "10", "server", 50.0, 100.0, 4, 1000),
+                CpuMetrics::new("1", "10", "server", 50.0, 100.0, 4, 2000),
+                CpuMetrics::new("1", "10", "server", 80.0, 100.0, 4, 3000),
+            ],
+            vec![
+                PowerMetrics::new("1", "rapl", "cpu", None, 12.0, 1000),
+                PowerMetrics::new("1", "rapl", "cpu", None, 14.0, 3000),
+            ],
+            vec![],
+        );
+        let runs = vec![Run::new("1", 0, 4000, Some(40.0), "config", None, None)];
+        let observation_dataset = ObservationDataset::new(vec![iteration], runs, vec![]);
+
+        let artifacts = vec![
+            Artifact::new("1", "notes", "notes.txt", b"<b>cold cache</b>".to_vec(), 0),
+            Artifact::new("1", "flamegraph", "flame.png", vec![0x89, 0xff, 0x00], 0),
+        ];
+        let page = html(&observation_dataset, None, &artifacts);
+        assert!(page.starts_with("<!DOCTYPE html>"));
+        assert!(page.contains("<h2>basket&lt;10&gt;</h2>"));
+        assert!(page.contains("<td>server</td>"));
+        assert!(page.contains("rapl cpu (measured)"));
+        assert_eq!(page.matches("<svg").count(), 1);
+        // the iteration is marked and each sample can be hovered over
+        assert!(page.contains("<title>iteration 0: 1.0 s to 3.0 s</title>"));
+        assert!(page.contains("<title>server: 8.00 W at 3.0 s</title>"));
+        assert!(page.contains("data-series=\"chart0-series0\""));
+        // a single iteration can't show how much the scenario varies
+        assert!(page.contains("<li>-20 variation: only one iteration"));
+        assert!(page.contains("<pre>&lt;b&gt;cold cache&lt;/b&gt;</pre>"));
+        assert!(page.contains("flamegraph (flame.png, 3 bytes), extract it with"));
+        // nothing is loaded from anywhere else
+        assert!(!page.contains("src="));
+        assert!(!page.contains("href="));
+
+        let runs = vec![Run::new("2", 0, 4000, None, "unknown", None, None)];
+        let empty = ObservationDataset::new(vec![], runs, vec![]);
+        assert!(html(&empty, None, &[]).contains("Cardamon run 2"));
+    }
+
+    #[test]
+    fn processes_are_broken_down_by_what_they_are_part_of() {
+        let projects = vec![String::from("shop")];
+        assert_eq!(component_path("shop-web-1", &projects), ["shop", "web"]);
+        assert_eq!(component_path("shop_db_2", &projects), ["shop", "db"]);
+        assert_eq!(component_path("ns/checkout", &projects), ["ns", "checkout"]);
+        assert_eq!(component_path("worker", &projects), ["worker"]);
+
+        let samples = |id: &str, name: &str, cpu_usage: f64| {
+            vec![
+                CpuMetrics::new("1", id, name, cpu_usage, 100.0, 4, 0),
+                CpuMetrics::new("1", id, name, cpu_usage, 100.0, 4, 2000),
+            ]
+        };
+        let iteration = IterationWithMetrics::new(
+            ScenarioIteration::new("1", "checkout", 0, 0, 2000, None),
+            [
+                samples("a", "shop-web-1", 200.0),
+                samples("b", "shop-web-2", 100.0),
+                samples("c", "shop-db-1", 50.0),
+                samples("d", "worker", 50.0),
+            ]
+            .into_iter()
+            .flatten()
+            .collect(),
+            vec![],
+            vec![],
+        );
+        let runs = vec![Run::new("1", 0, 2000, Some(40.0), "config", None, None)];
+        let observation_dataset = ObservationDataset::new(vec![iteration], runs, vec![]);
+        let scenario_datasets = observation_dataset.by_scenario();
+        let run_dataset = &scenario_datasets[0].by_run()[0];
+
+        let table = breakdown_table(run_dataset, Some(40.0), None, &projects)
+            .expect("there are several processes");
+        // the web service of the project dominates, its containers are listed under it
+        let shop = table.find(">shop<").expect("the project is a component");
+        let web = table.find(">web<").expect("the service is a component");
+        let db = table.find(">db<").expect("the service is a component");
+        let worker = table.find(">worker<").expect("the process is a component");
+        assert!(shop < web && web < db && db < worker);
+        assert!(table.contains(">shop</td><td>70.000</td><td>87.5</td>"));
+        assert!(table.contains(">shop-web-1</td><td>40.000</td><td>50.0</td>"));
+    }
+
+    fn run(run_id: &str, scenarios: &[&str], cpu_usage: &[f64]) -> ObservationDataset {
+        let mut iterations = vec![];
+        let mut start = 0;
+        for scenario in scenarios.iter() {
+            for (iteration, cpu_usage) in cpu_usage.iter().enumerate() {
+                iterations.push(IterationWithMetrics::new(
+                    ScenarioIteration::new(
+                        run_id,
+                        scenario,
+                        iteration as i64,
+                        start,
+                        start + 2000,
+                        None,
+                    ),
+                    vec![
+                        CpuMetrics::new(run_id, "10", "server", *cpu_usage, 100.0, 4, start),
+                        CpuMetrics::new(run_id, "10", "server", *cpu_usage, 100.0, 4, start + 2000),
+                    ],
+                    vec![],
+                    vec![],
+                ));
+                start += 5000;
+            }
+        }
+        let runs = vec![Run::new(run_id, 0, start, Some(40.0), "config", None, None)];
+        ObservationDataset::new(iterations, runs, vec![])
+    }
+
+    #[test]
+    fn markdown_summaries_show_the_change_since_the_baseline() {
+        let baseline = run("a", &["basket_10", "checkout"], &[100.0, 102.0, 98.0]);
+        let current = run("b", &["basket_10", "search"], &[50.0, 51.0, 49.0]);
+
+        let text = markdown(&current, None, Some(&baseline));
+        assert!(text.starts_with("### Cardamon run `b`"));
+        assert!(text.contains("Compared with run `a`"));
+        // half the CPU for the same time at 40 W
+        assert!(text.contains("| 🟢 | basket_10 | 10.000 ± 0.200 | -50.0% |"));
+        assert!(text.contains("| 🆕 | search | 10.000 ± 0.200 | new |"));
+        assert!(text.contains("| ➖ | checkout | | removed |"));
+
+        let text = markdown(&current, None, None);
+        assert!(text.contains("| basket_10 | 10.000 ± 0.200 |"));
+        assert!(!text.contains("baseline"));
+    }
+}
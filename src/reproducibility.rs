@@ -0,0 +1,568 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    config::{self, Config},
+    data_access::cpu_metrics::CpuMetrics,
+    dataset::RunDataset,
+    energy,
+};
+use itertools::Itertools;
+use std::{collections::HashMap, fmt};
+
+/// Samples of a process further apart than this many of its sample intervals are a gap.
+const GAP_INTERVALS: i64 = 2;
+
+/// Combined CPU share above which the CPU is considered saturated. A saturated CPU is likely to
+/// be throttled and scheduling noise dominates the measurement.
+const SATURATED_SHARE: f64 = 0.95;
+
+/// Something which reduces how much a run's numbers can be trusted.
+#[derive(Debug, PartialEq)]
+pub struct Factor {
+    pub name: &'static str,
+    /// Points taken off the score, 0 if this factor didn't affect the run.
+    pub penalty: f64,
+    pub detail: String,
+}
+
+/// Summary of how much to trust the numbers of a single run of a scenario.
+#[derive(Debug, PartialEq)]
+pub struct Reproducibility {
+    /// 0 to 100, higher is more trustworthy.
+    pub score: f64,
+    pub factors: Vec<Factor>,
+}
+impl Reproducibility {
+    pub fn rating(&self) -> &'static str {
+        if self.score >= 80.0 {
+            "high"
+        } else if self.score >= 50.0 {
+            "medium"
+        } else {
+            "low"
+        }
+    }
+}
+impl fmt::Display for Reproducibility {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{:.0}/100 ({})", self.score, self.rating())
+    }
+}
+
+/// Scores the reproducibility of a run. The score starts at 100 and each factor takes points off:
+///
+/// * variation - the coefficient of variation of CPU usage across iterations, a single iteration
+///   can't show variation so is penalised instead
+/// * sample gaps - samples more than two sample intervals apart, or iterations with no samples at
+///   all
+/// * restarts - an observed process being replaced by a new PID during an iteration
+/// * saturation - samples where the observed processes used the whole CPU
+/// * measurement - whether energy was measured rather than estimated from the TDP
+///
+/// # Arguments
+/// * run_dataset - the run to score
+/// * measured - true if a ground-truth power measurement was available for the run
+///
+/// # Returns
+/// The score and every factor which contributed to it
+pub fn score(run_dataset: &RunDataset, measured: bool) -> Reproducibility {
+    let iterations = run_dataset.by_iterations();
+    let intervals = sample_intervals(
+        run_dataset
+            .run()
+            .and_then(|run| run.config.as_deref())
+            .and_then(|config| toml::from_str::<Config>(config).ok())
+            .as_ref(),
+        iterations.iter().flat_map(|it| it.cpu_metrics()),
+    );
+    let factors = vec![
+        variation(
+            &iterations
+                .iter()
+                .map(|it| {
+                    by_process(it.cpu_metrics())
+                        .values()
+                        .map(|metrics| energy::cpu_share_seconds(metrics))
+                        .sum::<f64>()
+                })
+                .collect::<Vec<_>>(),
+        ),
+        sample_gaps(iterations.iter().map(|it| it.cpu_metrics()), &intervals),
+        restarts(iterations.iter().map(|it| it.cpu_metrics())),
+        saturation(iterations.iter().map(|it| it.cpu_metrics()), &intervals),
+        measurement(
+            measured,
+            run_dataset.run().and_then(|run| run.tdp).is_some(),
+        ),
+    ];
+
+    let penalty = factors.iter().map(|factor| factor.penalty).sum::<f64>();
+    Reproducibility {
+        score: (100.0 - penalty).max(0.0),
+        factors,
+    }
+}
+
+fn by_process(cpu_metrics: &[CpuMetrics]) -> HashMap<&str, Vec<&CpuMetrics>> {
+    let mut metrics_by_process: HashMap<&str, Vec<&CpuMetrics>> = HashMap::new();
+    for metric in cpu_metrics.iter() {
+        metrics_by_process
+            .entry(&metric.process_id)
+            .or_default()
+            .push(metric);
+    }
+    metrics_by_process
+}
+
+/// Works out how often each process was sampled. That's the interval the run was configured with,
+/// unless the samples are further apart than that, e.g. because the run was downsampled or it was
+/// sampled by a source with an interval of its own.
+///
+/// # Arguments
+/// * config - the config the run was started with, None if it wasn't saved with the run
+/// * cpu_metrics - every sample of the run
+///
+/// # Returns
+/// The sample interval in milliseconds of every process by process id
+fn sample_intervals<'a>(
+    config: Option<&Config>,
+    cpu_metrics: impl Iterator<Item = &'a CpuMetrics>,
+) -> HashMap<&'a str, i64> {
+    let default =
+        config
+            .map(|config| config.sample_interval())
+            .unwrap_or(std::time::Duration::from_millis(
+                config::DEFAULT_SAMPLE_INTERVAL_MS,
+            ));
+    let configured = |process_name: &str| {
+        config
+            .and_then(|config| {
+                config
+                    .processes
+                    .iter()
+                    .find(|proc| proc.name == process_name)
+            })
+            .map(|proc| proc.sample_interval(default))
+            .unwrap_or(default)
+            .as_millis() as i64
+    };
+
+    cpu_metrics
+        .into_group_map_by(|m| m.process_id.as_str())
+        .into_iter()
+        .map(|(process_id, metrics)| {
+            let gaps = metrics
+                .iter()
+                .map(|m| m.timestamp)
+                .sorted()
+                .tuple_windows()
+                .map(|(prev, curr)| curr - prev)
+                .filter(|gap| *gap > 0)
+                .sorted()
+                .collect::<Vec<_>>();
+            // the median isn't thrown off by the gaps being looked for
+            let recorded = gaps
+                .get(gaps.len().saturating_sub(1) / 2)
+                .copied()
+                .unwrap_or_default();
+            (
+                process_id,
+                configured(&metrics[0].process_name).max(recorded),
+            )
+        })
+        .collect()
+}
+
+fn variation(share_seconds: &[f64]) -> Factor {
+    if share_seconds.len() < 2 {
+        return Factor {
+            name: "variation",
+            penalty: 20.0,
+            detail: String::from("only one iteration, run more iterations to measure variation"),
+        };
+    }
+
+    let n = share_seconds.len() as f64;
+    let mean = share_seconds.iter().sum::<f64>() / n;
+    let variance = share_seconds
+        .iter()
+        .map(|x| (x - mean).powi(2))
+        .sum::<f64>()
+        / n;
+    let cv = if mean > 0.0 {
+        variance.sqrt() / mean
+    } else {
+        0.0
+    };
+
+    Factor {
+        name: "variation",
+        penalty: (cv * 100.0).min(40.0),
+        detail: format!(
+            "cpu usage varied by {:.1}% across {} iterations",
+            cv * 100.0,
+            share_seconds.len()
+        ),
+    }
+}
+
+fn sample_gaps<'a>(
+    iterations: impl Iterator<Item = &'a [CpuMetrics]>,
+    intervals: &HashMap<&str, i64>,
+) -> Factor {
+    let mut gaps = 0;
+    for cpu_metrics in iterations {
+        if cpu_metrics.is_empty() {
+            gaps += 1;
+            continue;
+        }
+
+        for (process_id, metrics) in by_process(cpu_metrics) {
+            let max_gap = intervals
+                .get(process_id)
+                .copied()
+                .unwrap_or(config::DEFAULT_SAMPLE_INTERVAL_MS as i64)
+                * GAP_INTERVALS;
+            gaps += metrics
+                .iter()
+                .map(|m| m.timestamp)
+                .sorted()
+                .tuple_windows()
+                .filter(|(prev, curr)| curr - prev > max_gap)
+                .count();
+        }
+    }
+
+    Factor {
+        name: "sample gaps",
+        penalty: (gaps as f64 * 5.0).min(20.0),
+        detail: format!("{gaps} gap(s) in the cpu samples"),
+    }
+}
+
+/// A process restarted if one of its pids stopped being sampled and then a new pid with the same
+/// name started, pids with the same name which run at the same time are workers of one process.
+fn restarts<'a>(iterations: impl Iterator<Item = &'a [CpuMetrics]>) -> Factor {
+    let mut restarted = vec![];
+    for cpu_metrics in iterations {
+        // when each pid was first and last sampled, by name
+        let lifetimes_by_name = cpu_metrics
+            .iter()
+            .into_group_map_by(|m| (m.process_name.as_str(), m.process_id.as_str()))
+            .into_iter()
+            .map(|((name, _), metrics)| {
+                let (first, last) = metrics
+                    .iter()
+                    .map(|m| m.timestamp)
+                    .minmax()
+                    .into_option()
+                    .expect("a pid should have been sampled");
+                (name, (first, last))
+            })
+            .into_group_map();
+
+        for (name, lifetimes) in lifetimes_by_name {
+            let replaced = lifetimes
+                .iter()
+                .any(|(_, last)| lifetimes.iter().any(|(next_first, _)| next_first > last));
+            if replaced && !restarted.contains(&name) {
+                restarted.push(name);
+            }
+        }
+    }
+    restarted.sort();
+
+    let detail = if restarted.is_empty() {
+        String::from("no processes restarted")
+    } else {
+        format!("restarted during an iteration: {}", restarted.join(", "))
+    };
+    Factor {
+        name: "restarts",
+        penalty: (restarted.len() as f64 * 15.0).min(30.0),
+        detail,
+    }
+}
+
+fn saturation<'a>(
+    iterations: impl Iterator<Item = &'a [CpuMetrics]>,
+    intervals: &HashMap<&str, i64>,
+) -> Factor {
+    // the loggers don't sample at exactly the same instant, so the samples are grouped into
+    // buckets as long as the longest sample interval. A process sampled more often than that has
+    // its samples in a bucket averaged.
+    let bucket = intervals
+        .values()
+        .copied()
+        .max()
+        .unwrap_or(config::DEFAULT_SAMPLE_INTERVAL_MS as i64)
+        .max(1);
+    let mut samples = 0;
+    let mut saturated = 0;
+    for cpu_metrics in iterations {
+        let shares = cpu_metrics
+            .iter()
+            .into_group_map_by(|m| m.timestamp.div_euclid(bucket));
+        for metrics in shares.values() {
+            let share = metrics
+                .iter()
+                .into_group_map_by(|m| m.process_id.as_str())
+                .values()
+                .map(|metrics| {
+                    metrics
+                        .iter()
+                        .map(|m| m.cpu_usage / 100.0 / m.core_count.max(1) as f64)
+                        .sum::<f64>()
+                        / metrics.len() as f64
+                })
+                .sum::<f64>();
+            samples += 1;
+            if share >= SATURATED_SHARE {
+                saturated += 1;
+            }
+        }
+    }
+
+    let fraction = if samples > 0 {
+        saturated as f64 / samples as f64
+    } else {
+        0.0
+    };
+    Factor {
+        name: "saturation",
+        penalty: (fraction * 20.0).min(20.0),
+        detail: format!(
+            "cpu saturated (likely throttled) in {:.0}% of samples",
+            fraction * 100.0
+        ),
+    }
+}
+
+fn measurement(measured: bool, has_tdp: bool) -> Factor {
+    let (penalty, detail) = match (measured, has_tdp) {
+        (true, _) => (0.0, "energy was measured"),
+        (false, true) => (10.0, "energy was estimated from the TDP, not measured"),
+        (false, false) => (20.0, "energy is unavailable, no measurement or TDP"),
+    };
+    Factor {
+        name: "measurement",
+        penalty,
+        detail: String::from(detail),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        data_access::{run::Run, scenario_iteration::ScenarioIteration},
+        dataset::{IterationWithMetrics, ObservationDataset},
+    };
+
+    fn iteration(iteration: i64, samples: &[(&str, &str, f64, i64)]) -> IterationWithMetrics {
+        let start = samples.iter().map(|s| s.3).min().unwrap_or(0);
+        let stop = samples.iter().map(|s| s.3).max().unwrap_or(0);
+        IterationWithMetrics::new(
+            ScenarioIteration::new("1", "basket_10", iteration, start, stop, None),
+            samples
+                .iter()
+                .map(|(pid, name, cpu_usage, timestamp)| {
+                    CpuMetrics::new("1", pid, name, *cpu_usage, 100.0, 4, *timestamp)
+                })
+                .collect(),
+            vec![],
+            vec![],
+        )
+    }
+
+    fn score_of(data: Vec<IterationWithMetrics>) -> Reproducibility {
+        score_with_config(data, None)
+    }
+
+    fn score_with_config(data: Vec<IterationWithMetrics>, config: Option<&str>) -> Reproducibility {
+        let runs = vec![Run::new("1", 0, 10000, Some(15.0), "config", None, config)];
+        let observation_dataset = ObservationDataset::new(data, runs, vec![]);
+        let scenario_datasets = observation_dataset.by_scenario();
+        let run_datasets = scenario_datasets[0].by_run();
+        score(&run_datasets[0], false)
+    }
+
+    #[test]
+    fn consistent_iterations_score_highly() {
+        let samples = |offset| {
+            [
+                ("10", "server", 100.0, offset),
+                ("10", "server", 100.0, offset + 1000),
+                ("10", "server", 100.0, offset + 2000),
+            ]
+        };
+        let reproducibility = score_of(vec![
+            iteration(0, &samples(0)),
+            iteration(1, &samples(5000)),
+        ]);
+
+        // only penalised for estimating energy
+        assert_eq!(reproducibility.score, 90.0);
+        assert_eq!(reproducibility.rating(), "high");
+    }
+
+    #[test]
+    fn unreliable_runs_list_contributing_factors() {
+        let reproducibility = score_of(vec![
+            iteration(
+                0,
+                &[
+                    ("10", "server", 100.0, 0),
+                    ("10", "server", 100.0, 1000),
+                    ("10", "server", 100.0, 4000),
+                    ("11", "server", 400.0, 4500),
+                ],
+            ),
+            iteration(
+                1,
+                &[
+                    ("11", "server", 300.0, 5000),
+                    ("11", "server", 300.0, 6000),
+                    ("11", "server", 300.0, 7000),
+                    ("11", "server", 300.0, 8000),
+                    ("11", "server", 300.0, 9000),
+                ],
+            ),
+        ]);
+
+        let penalties = reproducibility
+            .factors
+            .iter()
+            .map(|factor| (factor.name, factor.penalty))
+            .collect::<Vec<_>>();
+        assert_eq!(
+            penalties,
+            [
+                ("variation", 40.0),
+                ("sample gaps", 5.0),
+                ("restarts", 15.0),
+                ("saturation", 2.5),
+                ("measurement", 10.0),
+            ]
+        );
+        assert_eq!(reproducibility.score, 27.5);
+        assert_eq!(reproducibility.rating(), "low");
+    }
+
+    fn gaps_of(reproducibility: &Reproducibility) -> f64 {
+        reproducibility
+            .factors
+            .iter()
+            .find(|factor| factor.name == "sample gaps")
+            .map(|factor| factor.penalty)
+            .unwrap_or_default()
+    }
+
+    #[test]
+    fn gaps_are_relative_to_the_configured_sample_interval() {
+        let config = r#"
+            sample_interval_ms = 10000
+            processes = []
+            scenarios = []
+            observations = []
+        "#;
+        let samples = |offsets: &[i64]| {
+            offsets
+                .iter()
+                .map(|offset| ("10", "server", 100.0, *offset))
+                .collect::<Vec<_>>()
+        };
+
+        // too few samples to tell how often they were taken
+        let parsed = toml::from_str::<Config>(config).expect("config should be valid");
+        let sample = CpuMetrics::new("1", "10", "server", 100.0, 100.0, 4, 0);
+        assert_eq!(
+            sample_intervals(Some(&parsed), [&sample].into_iter()),
+            HashMap::from([("10", 10_000)])
+        );
+
+        let reproducibility = score_with_config(
+            vec![
+                iteration(0, &samples(&[0, 10_000, 20_000])),
+                iteration(1, &samples(&[30_000, 40_000, 50_000])),
+            ],
+            Some(config),
+        );
+        assert_eq!(gaps_of(&reproducibility), 0.0);
+        assert_eq!(reproducibility.score, 90.0);
+
+        let reproducibility = score_with_config(
+            vec![
+                iteration(0, &samples(&[0, 10_000, 20_000, 50_000])),
+                iteration(1, &samples(&[60_000, 70_000, 80_000])),
+            ],
+            Some(config),
+        );
+        assert_eq!(gaps_of(&reproducibility), 5.0);
+    }
+
+    #[test]
+    fn workers_running_at_the_same_time_are_not_restarts() {
+        let workers = [
+            ("10", "worker", 50.0, 0),
+            ("11", "worker", 50.0, 0),
+            ("10", "worker", 50.0, 1000),
+            ("11", "worker", 50.0, 1000),
+            ("12", "worker", 50.0, 1000),
+            ("10", "worker", 50.0, 2000),
+            ("12", "worker", 50.0, 2000),
+        ];
+        let factor = restarts([iteration(0, &workers).cpu_metrics()].into_iter());
+        assert_eq!(factor.penalty, 0.0);
+
+        // worker 13 started after 10 and 12 stopped
+        let replaced = [&workers[..], &[("13", "worker", 50.0, 3000)]].concat();
+        let factor = restarts([iteration(0, &replaced).cpu_metrics()].into_iter());
+        assert_eq!(factor.penalty, 15.0);
+        assert_eq!(factor.detail, "restarted during an iteration: worker");
+    }
+
+    #[test]
+    fn downsampled_runs_have_no_gaps() {
+        // a downsampled run keeps an average a minute, configured to be sampled every second
+        let config = r#"
+            processes = []
+            scenarios = []
+            observations = []
+        "#;
+        let samples = |offset: i64| {
+            [
+                ("10", "server", 100.0, offset),
+                ("10", "server", 100.0, offset + 60_000),
+                ("10", "server", 100.0, offset + 120_000),
+                ("11", "worker", 300.0, offset),
+                ("11", "worker", 300.0, offset + 60_000),
+                ("11", "worker", 300.0, offset + 120_000),
+            ]
+        };
+        let reproducibility = score_with_config(
+            vec![iteration(0, &samples(0)), iteration(1, &samples(180_000))],
+            Some(config),
+        );
+
+        let penalties = reproducibility
+            .factors
+            .iter()
+            .map(|factor| (factor.name, factor.penalty))
+            .collect::<Vec<_>>();
+        assert_eq!(
+            penalties,
+            [
+                ("variation", 0.0),
+                ("sample gaps", 0.0),
+                ("restarts", 0.0),
+                ("saturation", 20.0),
+                ("measurement", 10.0),
+            ]
+        );
+    }
+}
@@ -0,0 +1,168 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::{anyhow, Context};
+use chrono::{DateTime, Datelike, Duration, TimeZone, Timelike};
+
+/// The furthest ahead the next run is looked for. Four years so runs on the 29th of February are
+/// found, a schedule such as `0 0 30 2 *` never runs.
+const MAX_MINUTES_AHEAD: i64 = 366 * 24 * 60 * 4;
+
+/// When an observation runs, parsed from a cron expression with five fields: minute, hour, day of
+/// month, month and day of week. Fields can be `*`, a number, a range `1-5`, a list `1,15` or a
+/// step `*/15` or `0-30/10`. Sunday is 0 or 7.
+#[derive(Debug, PartialEq)]
+pub struct Schedule {
+    minutes: Vec<u32>,
+    hours: Vec<u32>,
+    days_of_month: Vec<u32>,
+    months: Vec<u32>,
+    days_of_week: Vec<u32>,
+    /// Cron runs on days matching either field if both are restricted, not both.
+    any_day: bool,
+}
+impl Schedule {
+    /// # Arguments
+    /// * expression - the cron expression, e.g. `0 2 * * *` for 2am every day
+    ///
+    /// # Returns
+    /// The schedule, an error if the expression isn't valid
+    pub fn parse(expression: &str) -> anyhow::Result<Self> {
+        let fields = expression.split_whitespace().collect::<Vec<_>>();
+        let [minute, hour, day_of_month, month, day_of_week] = fields[..] else {
+            return Err(anyhow!(
+                "Expected 5 fields in schedule `{expression}`, minute hour day-of-month month \
+                 day-of-week"
+            ));
+        };
+
+        let days_of_week = parse_field(day_of_week, 0, 7)
+            .context(format!("Invalid day of week in schedule `{expression}`"))?
+            .into_iter()
+            .map(|day| day % 7)
+            .collect();
+        Ok(Self {
+            minutes: parse_field(minute, 0, 59)
+                .context(format!("Invalid minute in schedule `{expression}`"))?,
+            hours: parse_field(hour, 0, 23)
+                .context(format!("Invalid hour in schedule `{expression}`"))?,
+            days_of_month: parse_field(day_of_month, 1, 31)
+                .context(format!("Invalid day of month in schedule `{expression}`"))?,
+            months: parse_field(month, 1, 12)
+                .context(format!("Invalid month in schedule `{expression}`"))?,
+            days_of_week,
+            any_day: day_of_month != "*" && day_of_week != "*",
+        })
+    }
+
+    /// # Arguments
+    /// * after - the time to look for the next run after
+    ///
+    /// # Returns
+    /// The time of the next run strictly after the given time, None if the schedule never runs
+    pub fn next_after<Tz: TimeZone>(&self, after: &DateTime<Tz>) -> Option<DateTime<Tz>> {
+        let mut time = after.clone().with_second(0)?.with_nanosecond(0)?;
+        for _ in 0..MAX_MINUTES_AHEAD {
+            time = time + Duration::minutes(1);
+            if self.matches(&time) {
+                return Some(time);
+            }
+        }
+        None
+    }
+
+    fn matches<Tz: TimeZone>(&self, time: &DateTime<Tz>) -> bool {
+        let day_of_month = self.days_of_month.contains(&time.day());
+        let day_of_week = self
+            .days_of_week
+            .contains(&time.weekday().num_days_from_sunday());
+        let day = if self.any_day {
+            day_of_month || day_of_week
+        } else {
+            day_of_month && day_of_week
+        };
+
+        day && self.minutes.contains(&time.minute())
+            && self.hours.contains(&time.hour())
+            && self.months.contains(&time.month())
+    }
+}
+
+/// # Returns
+/// Every value the field matches, in order
+fn parse_field(field: &str, min: u32, max: u32) -> anyhow::Result<Vec<u32>> {
+    let mut values = vec![];
+    for part in field.split(',') {
+        let (range, step) = match part.split_once('/') {
+            Some((range, step)) => (range, step.parse::<u32>().context("Invalid step")?),
+            None => (part, 1),
+        };
+        if step == 0 {
+            return Err(anyhow!("Step can't be 0"));
+        }
+
+        let (start, end) = match range {
+            "*" => (min, max),
+            range => match range.split_once('-') {
+                Some((start, end)) => (start.parse::<u32>()?, end.parse::<u32>()?),
+                None => {
+                    let value = range.parse::<u32>()?;
+                    // `5/10` starts at 5 and steps to the end of the field
+                    (value, if part.contains('/') { max } else { value })
+                }
+            },
+        };
+        if start < min || end > max || start > end {
+            return Err(anyhow!("{range} is outside of {min}-{max}"));
+        }
+        values.extend((start..=end).step_by(step as usize));
+    }
+
+    values.sort();
+    values.dedup();
+    Ok(values)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use chrono::Utc;
+
+    #[test]
+    fn next_run_is_found_from_a_cron_expression() -> anyhow::Result<()> {
+        let at = |s: &str| DateTime::parse_from_rfc3339(s).map(|time| time.with_timezone(&Utc));
+
+        let nightly = Schedule::parse("0 2 * * *")?;
+        assert_eq!(
+            nightly.next_after(&at("2026-10-14T01:59:30Z")?),
+            Some(at("2026-10-14T02:00:00Z")?)
+        );
+        assert_eq!(
+            nightly.next_after(&at("2026-10-14T02:00:00Z")?),
+            Some(at("2026-10-15T02:00:00Z")?)
+        );
+
+        // 2026-10-14 is a Wednesday
+        let weekdays = Schedule::parse("*/15 9-17 * * 1-5")?;
+        assert_eq!(
+            weekdays.next_after(&at("2026-10-16T17:50:00Z")?),
+            Some(at("2026-10-19T09:00:00Z")?)
+        );
+
+        // either the first of the month or a Sunday
+        let either = Schedule::parse("0 0 1 * 0")?;
+        assert_eq!(
+            either.next_after(&at("2026-10-14T00:00:00Z")?),
+            Some(at("2026-10-18T00:00:00Z")?)
+        );
+
+        assert_eq!(Schedule::parse("0 0 30 2 *")?.next_after(&Utc::now()), None);
+        assert!(Schedule::parse("0 2 * *").is_err());
+        assert!(Schedule::parse("60 2 * * *").is_err());
+        assert!(Schedule::parse("*/0 2 * * *").is_err());
+        Ok(())
+    }
+}
@@ -1,16 +1,117 @@
+mod api;
+mod auth;
 mod errors;
+mod grafana;
+mod ui;
+use anyhow::Context;
 use chrono::Utc;
 
+pub use auth::Tokens;
+use axum::middleware;
 use axum::{
     extract::{Path, Query, State},
-    Json,
+    routing::{get, post},
+    Json, Router,
 };
-use cardamon::data_access::{cpu_metrics::CpuMetrics, scenario_iteration::ScenarioIteration};
+use cardamon::data_access::{
+    artifact::Artifact, compressed_samples::CompressedSamples, cpu_metrics::CpuMetrics,
+    endpoint_energy::EndpointEnergy, power_metrics::PowerMetrics,
+    resource_metrics::ResourceMetrics, run::Run, scenario_iteration::ScenarioIteration,
+};
+use cardamon::units::Units;
 use errors::ServerError;
 use serde::Deserialize;
 use sqlx::SqlitePool;
 use tracing::instrument;
 
+/// The port `cardamon server` listens on unless it's given another.
+pub const DEFAULT_PORT: u16 = 7421;
+
+/// The port `cardamon ui` listens on unless it's given another.
+pub const DEFAULT_UI_PORT: u16 = 7422;
+
+// Keep seperated for integraion tests
+pub fn create_app(pool: SqlitePool, units: Units, tokens: Tokens) -> Router {
+    // Middleware later
+    /*
+    let protected = Router::new()
+    .route("/user", get(routes::user::get_user))
+    .layer(middleware::from_fn_with_state(pool.clone(), api_key_auth));
+    */
+    Router::new()
+        .route("/cpu_metrics", post(persist_metrics))
+        .route("/cpu_metrics/:id", get(fetch_within))
+        //.route("/cpu_metrics/:id", delete(delete_metrics)) removed for now
+        .route("/power_metrics", post(power_metrics_persist))
+        .route("/power_metrics/:id", get(power_metrics_fetch_within))
+        .route("/resource_metrics", post(resource_metrics_persist))
+        .route("/resource_metrics/:id", get(resource_metrics_fetch_within))
+        .route("/scenario", post(scenario_iteration_persist))
+        .route("/scenario/:run_id", get(scenario_iteration_fetch_by_run))
+        .route("/run", post(run_persist))
+        .route("/run/:id", get(run_fetch))
+        .route("/runs", get(run_fetch_since))
+        .route("/artifact", post(artifact_persist))
+        .route("/artifacts/:run_id", get(artifact_fetch_by_run))
+        .route("/compressed_samples/:run_id", get(compressed_samples_fetch))
+        .route("/endpoint_energy", post(endpoint_energy_persist))
+        .route(
+            "/endpoint_energy/:run_id",
+            get(endpoint_energy_fetch_by_run),
+        )
+        .nest("/api/v1", api::router())
+        .nest("/grafana", grafana::router())
+        .merge(ui::router(pool.clone(), units))
+        .with_state(pool)
+        .layer(middleware::from_fn_with_state(tokens, auth::authorise))
+}
+
+/// The dashboard and read API without the routes runs are pushed to.
+pub fn create_ui(pool: SqlitePool, units: Units, tokens: Tokens) -> Router {
+    Router::new()
+        .nest("/api/v1", api::router())
+        .nest("/grafana", grafana::router())
+        .merge(ui::router(pool.clone(), units))
+        .with_state(pool)
+        .layer(middleware::from_fn_with_state(tokens, auth::authorise))
+}
+
+/// Stores the runs pushed by other cardamon instances, e.g. ephemeral CI machines, and serves
+/// them back so the whole team's history is in one place.
+///
+/// # Arguments
+/// * tokens - the tokens requests need, anyone who can reach the port can use the server if there
+///   are none
+pub async fn serve(
+    port: u16,
+    pool: SqlitePool,
+    units: Units,
+    tokens: Tokens,
+) -> anyhow::Result<()> {
+    listen(port, create_app(pool, units, tokens)).await
+}
+
+/// Serves the dashboard of the runs in the database, e.g. for people who'd rather not read the
+/// CLI tables.
+pub async fn serve_ui(
+    port: u16,
+    pool: SqlitePool,
+    units: Units,
+    tokens: Tokens,
+) -> anyhow::Result<()> {
+    listen(port, create_ui(pool, units, tokens)).await
+}
+
+async fn listen(port: u16, app: Router) -> anyhow::Result<()> {
+    let listener = tokio::net::TcpListener::bind(format!("0.0.0.0:{port}"))
+        .await
+        .context(format!("Unable to listen on port {port}"))?;
+    tracing::info!("Server listening on port {port}");
+    axum::serve(listener, app)
+        .await
+        .context("Server stopped unexpectedly")
+}
+
 // Must receive data from src/data_access/cpu_metrics.rs in this format:
 /*
 
@@ -122,13 +223,94 @@ async fn insert_metrics_into_db(
     metrics: &CpuMetrics,
 ) -> Result<(), sqlx::Error> {
     sqlx::query!(
-        "INSERT INTO cpu_metrics (run_id, process_id, process_name, cpu_usage, total_usage, core_count, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)",
+        "INSERT INTO cpu_metrics (run_id, process_id, process_name, cpu_usage, total_usage, core_count, timestamp, scenario_name) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
         metrics.run_id,
         metrics.process_id,
         metrics.process_name,
         metrics.cpu_usage,
         metrics.total_usage,
         metrics.core_count,
+        metrics.timestamp,
+        metrics.scenario_name
+    )
+    .execute(pool)
+    .await?;
+    Ok(())
+}
+
+// Below routes must conform to the routes found in src/data_access/power_metrics.rs
+#[instrument(name = "Fetch power metrics within a time range")]
+pub async fn power_metrics_fetch_within(
+    Path(run_id): Path<String>,
+    Query(params): Query<WithinParams>,
+    State(pool): State<SqlitePool>,
+) -> anyhow::Result<Json<Vec<PowerMetrics>>, ServerError> {
+    let begin = params.begin.unwrap_or(0);
+    let end = params.end.unwrap_or_else(|| Utc::now().timestamp());
+
+    tracing::debug!(
+        "Received request to fetch power metrics for run ID: {}, begin: {}, end: {}",
+        run_id,
+        begin,
+        end
+    );
+
+    let metrics = fetch_power_metrics_within_range(&pool, &run_id, begin, end)
+        .await
+        .map_err(|e| {
+            tracing::error!("Failed to fetch power metrics from database: {:?}", e);
+            ServerError::DatabaseError(e)
+        })?;
+
+    tracing::info!("Successfully fetched {} power metrics", metrics.len());
+    Ok(Json(metrics))
+}
+
+async fn fetch_power_metrics_within_range(
+    pool: &SqlitePool,
+    run_id: &str,
+    begin: i64,
+    end: i64,
+) -> Result<Vec<PowerMetrics>, sqlx::Error> {
+    let metrics = sqlx::query_as!(
+        PowerMetrics,
+        "SELECT * FROM power_metrics WHERE run_id = ? AND timestamp BETWEEN ? AND ?",
+        run_id,
+        begin,
+        end
+    )
+    .fetch_all(pool)
+    .await?;
+    Ok(metrics)
+}
+
+#[instrument(name = "Persist power metrics into database")]
+pub async fn power_metrics_persist(
+    State(pool): State<SqlitePool>,
+    Json(payload): Json<PowerMetrics>,
+) -> anyhow::Result<String, ServerError> {
+    tracing::debug!("Received payload: {:?}", payload);
+    insert_power_metrics_into_db(&pool, &payload)
+        .await
+        .map_err(|e| {
+            tracing::error!("Failed to persist power metrics: {:?}", e);
+            ServerError::DatabaseError(e)
+        })?;
+    tracing::info!("Power metrics persisted successfully");
+    Ok("Power metrics persisted".to_string())
+}
+
+async fn insert_power_metrics_into_db(
+    pool: &SqlitePool,
+    metrics: &PowerMetrics,
+) -> Result<(), sqlx::Error> {
+    sqlx::query!(
+        "INSERT INTO power_metrics (run_id, source, component, process_id, power, timestamp) VALUES (?, ?, ?, ?, ?, ?)",
+        metrics.run_id,
+        metrics.source,
+        metrics.component,
+        metrics.process_id,
+        metrics.power,
         metrics.timestamp
     )
     .execute(pool)
@@ -136,6 +318,96 @@ async fn insert_metrics_into_db(
     Ok(())
 }
 
+// Below routes must conform to the routes found in src/data_access/resource_metrics.rs
+#[instrument(name = "Fetch resource metrics within a time range")]
+pub async fn resource_metrics_fetch_within(
+    Path(run_id): Path<String>,
+    Query(params): Query<WithinParams>,
+    State(pool): State<SqlitePool>,
+) -> anyhow::Result<Json<Vec<ResourceMetrics>>, ServerError> {
+    let begin = params.begin.unwrap_or(0);
+    let end = params.end.unwrap_or_else(|| Utc::now().timestamp());
+
+    tracing::debug!(
+        "Received request to fetch resource metrics for run ID: {}, begin: {}, end: {}",
+        run_id,
+        begin,
+        end
+    );
+
+    let metrics = fetch_resource_metrics_within_range(&pool, &run_id, begin, end)
+        .await
+        .map_err(|e| {
+            tracing::error!("Failed to fetch resource metrics from database: {:?}", e);
+            ServerError::DatabaseError(e)
+        })?;
+
+    tracing::info!("Successfully fetched {} resource metrics", metrics.len());
+    Ok(Json(metrics))
+}
+
+async fn fetch_resource_metrics_within_range(
+    pool: &SqlitePool,
+    run_id: &str,
+    begin: i64,
+    end: i64,
+) -> Result<Vec<ResourceMetrics>, sqlx::Error> {
+    let metrics = sqlx::query_as!(
+        ResourceMetrics,
+        "SELECT * FROM resource_metrics WHERE run_id = ? AND timestamp BETWEEN ? AND ?",
+        run_id,
+        begin,
+        end
+    )
+    .fetch_all(pool)
+    .await?;
+    Ok(metrics)
+}
+
+#[instrument(name = "Persist resource metrics into database")]
+pub async fn resource_metrics_persist(
+    State(pool): State<SqlitePool>,
+    Json(payload): Json<ResourceMetrics>,
+) -> anyhow::Result<String, ServerError> {
+    tracing::debug!("Received payload: {:?}", payload);
+    insert_resource_metrics_into_db(&pool, &payload)
+        .await
+        .map_err(|e| {
+            tracing::error!("Failed to persist resource metrics: {:?}", e);
+            ServerError::DatabaseError(e)
+        })?;
+    tracing::info!("Resource metrics persisted successfully");
+    Ok("Resource metrics persisted".to_string())
+}
+
+async fn insert_resource_metrics_into_db(
+    pool: &SqlitePool,
+    metrics: &ResourceMetrics,
+) -> Result<(), sqlx::Error> {
+    sqlx::query!(
+        "INSERT INTO resource_metrics (run_id, process_id, bytes_sent, bytes_received, read_bytes, write_bytes, read_ops, write_ops, memory_bytes, memory_total, cpu_periods, throttled_periods, throttled_ns, timestamp, scenario_name, gpu_utilisation) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+        metrics.run_id,
+        metrics.process_id,
+        metrics.bytes_sent,
+        metrics.bytes_received,
+        metrics.read_bytes,
+        metrics.write_bytes,
+        metrics.read_ops,
+        metrics.write_ops,
+        metrics.memory_bytes,
+        metrics.memory_total,
+        metrics.cpu_periods,
+        metrics.throttled_periods,
+        metrics.throttled_ns,
+        metrics.timestamp,
+        metrics.scenario_name,
+        metrics.gpu_utilisation
+    )
+    .execute(pool)
+    .await?;
+    Ok(())
+}
+
 // Below routes must confirm to these routes found in src/data_access/scenario_iteration.rs
 /*
    async fn fetch_last(&self, _name: &str, _n: u32) -> anyhow::Result<Vec<ScenarioIteration>> {
@@ -206,6 +478,30 @@ pub async fn scenario_iteration_persist(
     Ok("Scenario run persisted".to_string())
 }
 
+#[instrument(name = "Fetch scenario iterations for a run")]
+pub async fn scenario_iteration_fetch_by_run(
+    Path(run_id): Path<String>,
+    State(pool): State<SqlitePool>,
+) -> anyhow::Result<Json<Vec<ScenarioIteration>>, ServerError> {
+    tracing::debug!(
+        "Received request to fetch scenario runs for run ID: {}",
+        run_id
+    );
+
+    let scenario_iterations = fetch_scenario_iterations_by_run(&pool, &run_id)
+        .await
+        .map_err(|e| {
+            tracing::error!("Failed to fetch scenario runs from database: {:?}", e);
+            ServerError::DatabaseError(e)
+        })?;
+
+    tracing::info!(
+        "Successfully fetched {} scenario runs",
+        scenario_iterations.len()
+    );
+    Ok(Json(scenario_iterations))
+}
+
 #[inline]
 async fn fetch_last_scenario_iteration(
     pool: &SqlitePool,
@@ -219,17 +515,329 @@ async fn fetch_last_scenario_iteration(
     Ok(scenario_iteration)
 }
 
+async fn fetch_scenario_iterations_by_run(
+    pool: &SqlitePool,
+    run_id: &str,
+) -> Result<Vec<ScenarioIteration>, sqlx::Error> {
+    let scenario_iterations = sqlx::query_as!(
+        ScenarioIteration,
+        "SELECT * FROM scenario_iteration WHERE run_id = ? ORDER BY start_time",
+        run_id
+    )
+    .fetch_all(pool)
+    .await?;
+    Ok(scenario_iterations)
+}
+
 async fn insert_scenario_iteration_into_db(
     pool: &SqlitePool,
     scenario_iteration: &ScenarioIteration,
 ) -> Result<(), sqlx::Error> {
     sqlx::query!(
-        "INSERT INTO scenario_iteration (run_id, scenario_name, iteration, start_time, stop_time) VALUES (?, ?, ?, ?, ?)",
+        "INSERT INTO scenario_iteration (run_id, scenario_name, iteration, start_time, stop_time, requests, budget_exceeded, cold_start, functional_units, joules, stdout, stderr, exit_code, failed, failed_requests) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
         scenario_iteration.run_id,
         scenario_iteration.scenario_name,
         scenario_iteration.iteration,
         scenario_iteration.start_time,
-        scenario_iteration.stop_time
+        scenario_iteration.stop_time,
+        scenario_iteration.requests,
+        scenario_iteration.budget_exceeded,
+        scenario_iteration.cold_start,
+        scenario_iteration.functional_units,
+        scenario_iteration.joules,
+        scenario_iteration.stdout,
+        scenario_iteration.stderr,
+        scenario_iteration.exit_code,
+        scenario_iteration.failed,
+        scenario_iteration.failed_requests
+    )
+    .execute(pool)
+    .await?;
+    Ok(())
+}
+
+// Below routes must conform to the routes found in src/data_access/run.rs
+#[instrument(name = "Fetch run")]
+pub async fn run_fetch(
+    Path(run_id): Path<String>,
+    State(pool): State<SqlitePool>,
+) -> anyhow::Result<Json<Option<Run>>, ServerError> {
+    tracing::debug!("Received request to fetch run with ID: {}", run_id);
+
+    let run = fetch_run(&pool, &run_id).await.map_err(|e| {
+        tracing::error!("Failed to fetch run from database: {:?}", e);
+        ServerError::DatabaseError(e)
+    })?;
+
+    tracing::info!("Successfully fetched run");
+    Ok(Json(run))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct SinceParams {
+    since: Option<i64>,
+    /// Only runs of this project are fetched, every run if it isn't given.
+    project: Option<String>,
+}
+#[instrument(name = "Fetch runs since a point in time")]
+pub async fn run_fetch_since(
+    Query(params): Query<SinceParams>,
+    State(pool): State<SqlitePool>,
+) -> anyhow::Result<Json<Vec<Run>>, ServerError> {
+    let since = params.since.unwrap_or(0);
+    tracing::debug!("Received request to fetch runs since: {}", since);
+
+    let mut runs = fetch_runs_since(&pool, since).await.map_err(|e| {
+        tracing::error!("Failed to fetch runs from database: {:?}", e);
+        ServerError::DatabaseError(e)
+    })?;
+    if let Some(project) = &params.project {
+        runs.retain(|run| run.project.as_ref() == Some(project));
+    }
+
+    tracing::info!("Successfully fetched {} runs", runs.len());
+    Ok(Json(runs))
+}
+
+#[instrument(name = "Persist run")]
+pub async fn run_persist(
+    State(pool): State<SqlitePool>,
+    Json(payload): Json<Run>,
+) -> anyhow::Result<String, ServerError> {
+    tracing::debug!("Received payload: {:?}", payload);
+
+    insert_run_into_db(&pool, &payload).await.map_err(|e| {
+        tracing::error!("Failed to persist run: {:?}", e);
+        ServerError::DatabaseError(e)
+    })?;
+
+    tracing::info!("Run persisted successfully");
+    Ok("Run persisted".to_string())
+}
+
+async fn fetch_run(pool: &SqlitePool, run_id: &str) -> Result<Option<Run>, sqlx::Error> {
+    let run = sqlx::query_as!(Run, "SELECT * FROM run WHERE run_id = ?", run_id)
+        .fetch_optional(pool)
+        .await?;
+    Ok(run)
+}
+
+async fn fetch_runs_since(pool: &SqlitePool, since: i64) -> Result<Vec<Run>, sqlx::Error> {
+    let runs = sqlx::query_as!(
+        Run,
+        "SELECT * FROM run WHERE start_time >= ? ORDER BY start_time",
+        since
+    )
+    .fetch_all(pool)
+    .await?;
+    Ok(runs)
+}
+
+async fn insert_run_into_db(pool: &SqlitePool, run: &Run) -> Result<(), sqlx::Error> {
+    sqlx::query!(
+        "INSERT INTO run (run_id, start_time, stop_time, tdp, tdp_source, energy_unavailable, config, baseline_start, baseline_stop, retries, shuffle_seed, scenario_order, pauses, environment, carbon_intensity, carbon_intensity_source, pue, label, git_commit, git_branch, git_dirty, git_tag, project, annotations, imported_from, aborted) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+        run.run_id,
+        run.start_time,
+        run.stop_time,
+        run.tdp,
+        run.tdp_source,
+        run.energy_unavailable,
+        run.config,
+        run.baseline_start,
+        run.baseline_stop,
+        run.retries,
+        run.shuffle_seed,
+        run.scenario_order,
+        run.pauses,
+        run.environment,
+        run.carbon_intensity,
+        run.carbon_intensity_source,
+        run.pue,
+        run.label,
+        run.git_commit,
+        run.git_branch,
+        run.git_dirty,
+        run.git_tag,
+        run.project,
+        run.annotations,
+        run.imported_from,
+        run.aborted
+    )
+    .execute(pool)
+    .await?;
+    Ok(())
+}
+
+// Below routes must conform to the routes found in src/data_access/artifact.rs
+#[instrument(name = "Fetch artifacts for a run")]
+pub async fn artifact_fetch_by_run(
+    Path(run_id): Path<String>,
+    State(pool): State<SqlitePool>,
+) -> anyhow::Result<Json<Vec<Artifact>>, ServerError> {
+    tracing::debug!(
+        "Received request to fetch artifacts for run with ID: {}",
+        run_id
+    );
+
+    let artifacts = fetch_artifacts_by_run(&pool, &run_id).await.map_err(|e| {
+        tracing::error!("Failed to fetch artifacts from database: {:?}", e);
+        ServerError::DatabaseError(e)
+    })?;
+
+    tracing::info!("Successfully fetched {} artifacts", artifacts.len());
+    Ok(Json(artifacts))
+}
+
+#[instrument(name = "Persist artifact", skip(payload))]
+pub async fn artifact_persist(
+    State(pool): State<SqlitePool>,
+    Json(payload): Json<Artifact>,
+) -> anyhow::Result<String, ServerError> {
+    // artifacts can be large so only log what's being stored, not the content
+    tracing::debug!(
+        "Received artifact {} for run {} ({} bytes)",
+        payload.name,
+        payload.run_id,
+        payload.content.len()
+    );
+
+    insert_artifact_into_db(&pool, &payload)
+        .await
+        .map_err(|e| {
+            tracing::error!("Failed to persist artifact: {:?}", e);
+            ServerError::DatabaseError(e)
+        })?;
+
+    tracing::info!("Artifact persisted successfully");
+    Ok("Artifact persisted".to_string())
+}
+
+async fn fetch_artifacts_by_run(
+    pool: &SqlitePool,
+    run_id: &str,
+) -> Result<Vec<Artifact>, sqlx::Error> {
+    let artifacts = sqlx::query_as!(
+        Artifact,
+        "SELECT * FROM artifact WHERE run_id = ? ORDER BY created_at, name",
+        run_id
+    )
+    .fetch_all(pool)
+    .await?;
+    Ok(artifacts)
+}
+
+async fn insert_artifact_into_db(
+    pool: &SqlitePool,
+    artifact: &Artifact,
+) -> Result<(), sqlx::Error> {
+    sqlx::query!(
+        "INSERT INTO artifact (run_id, name, file_name, content, created_at) VALUES (?, ?, ?, ?, ?)",
+        artifact.run_id,
+        artifact.name,
+        artifact.file_name,
+        artifact.content,
+        artifact.created_at
+    )
+    .execute(pool)
+    .await?;
+    Ok(())
+}
+
+// Below routes must conform to the routes found in src/data_access/compressed_samples.rs
+#[instrument(name = "Fetch the compressed samples of a run")]
+pub async fn compressed_samples_fetch(
+    Path(run_id): Path<String>,
+    State(pool): State<SqlitePool>,
+) -> anyhow::Result<Json<Option<CompressedSamples>>, ServerError> {
+    tracing::debug!(
+        "Received request to fetch the compressed samples of run with ID: {}",
+        run_id
+    );
+
+    let compressed_samples = sqlx::query_as!(
+        CompressedSamples,
+        "SELECT * FROM compressed_samples WHERE run_id = ?",
+        run_id
+    )
+    .fetch_optional(&pool)
+    .await
+    .map_err(|e| {
+        tracing::error!("Failed to fetch compressed samples from database: {:?}", e);
+        ServerError::DatabaseError(e)
+    })?;
+    Ok(Json(compressed_samples))
+}
+
+// Below routes must conform to the routes found in src/data_access/endpoint_energy.rs
+#[instrument(name = "Fetch endpoint energy for a run")]
+pub async fn endpoint_energy_fetch_by_run(
+    Path(run_id): Path<String>,
+    State(pool): State<SqlitePool>,
+) -> anyhow::Result<Json<Vec<EndpointEnergy>>, ServerError> {
+    tracing::debug!(
+        "Received request to fetch endpoint energy for run with ID: {}",
+        run_id
+    );
+
+    let endpoint_energy = fetch_endpoint_energy_by_run(&pool, &run_id)
+        .await
+        .map_err(|e| {
+            tracing::error!("Failed to fetch endpoint energy from database: {:?}", e);
+            ServerError::DatabaseError(e)
+        })?;
+
+    tracing::info!(
+        "Successfully fetched endpoint energy of {} routes",
+        endpoint_energy.len()
+    );
+    Ok(Json(endpoint_energy))
+}
+
+#[instrument(name = "Persist endpoint energy")]
+pub async fn endpoint_energy_persist(
+    State(pool): State<SqlitePool>,
+    Json(payload): Json<EndpointEnergy>,
+) -> anyhow::Result<String, ServerError> {
+    tracing::debug!("Received payload: {:?}", payload);
+
+    insert_endpoint_energy_into_db(&pool, &payload)
+        .await
+        .map_err(|e| {
+            tracing::error!("Failed to persist endpoint energy: {:?}", e);
+            ServerError::DatabaseError(e)
+        })?;
+
+    tracing::info!("Endpoint energy persisted successfully");
+    Ok("Endpoint energy persisted".to_string())
+}
+
+async fn fetch_endpoint_energy_by_run(
+    pool: &SqlitePool,
+    run_id: &str,
+) -> Result<Vec<EndpointEnergy>, sqlx::Error> {
+    let endpoint_energy = sqlx::query_as!(
+        EndpointEnergy,
+        "SELECT * FROM endpoint_energy WHERE run_id = ? ORDER BY scenario_name, iteration, route",
+        run_id
+    )
+    .fetch_all(pool)
+    .await?;
+    Ok(endpoint_energy)
+}
+
+async fn insert_endpoint_energy_into_db(
+    pool: &SqlitePool,
+    endpoint_energy: &EndpointEnergy,
+) -> Result<(), sqlx::Error> {
+    sqlx::query!(
+        "INSERT INTO endpoint_energy (run_id, scenario_name, iteration, process_name, route, requests, joules) VALUES (?, ?, ?, ?, ?, ?, ?)",
+        endpoint_energy.run_id,
+        endpoint_energy.scenario_name,
+        endpoint_energy.iteration,
+        endpoint_energy.process_name,
+        endpoint_energy.route,
+        endpoint_energy.requests,
+        endpoint_energy.joules
     )
     .execute(pool)
     .await?;
@@ -0,0 +1,335 @@
+//! The read API under `/api/v1` for dashboards and scripts. Responses follow the schema of
+//! `cardamon export` rather than the database tables, so they don't change with migrations.
+
+use super::errors::ServerError;
+use axum::{
+    extract::{Path, Query, State},
+    routing::get,
+    Json, Router,
+};
+use cardamon::{
+    annotation::Annotation,
+    data_access::{run::Run, DataAccessService, LocalDataAccessService},
+    dataset::RunDataset,
+    export::{self, EnergyStats, RawSample, RunExport},
+    git::Git,
+    report, trend,
+};
+use serde::{Deserialize, Serialize};
+use sqlx::SqlitePool;
+use std::cmp::Reverse;
+use tracing::instrument;
+
+/// How many items a page has unless a limit is given.
+const DEFAULT_LIMIT: usize = 50;
+
+/// The most items a single page can have, larger limits are cut down to it.
+const MAX_LIMIT: usize = 1000;
+
+pub fn router() -> Router<SqlitePool> {
+    Router::new()
+        .route("/runs", get(list_runs))
+        .route("/runs/:run_id", get(run_detail))
+        .route("/runs/:run_id/samples", get(run_samples))
+        .route("/scenarios/:scenario/history", get(scenario_history))
+}
+
+/// `?limit=&offset=` of every list.
+#[derive(Debug, Default, Deserialize)]
+pub struct PageParams {
+    limit: Option<usize>,
+    offset: Option<usize>,
+}
+impl PageParams {
+    fn limit(&self) -> usize {
+        self.limit.unwrap_or(DEFAULT_LIMIT).clamp(1, MAX_LIMIT)
+    }
+
+    fn offset(&self) -> usize {
+        self.offset.unwrap_or_default()
+    }
+}
+
+/// A page of a list, follow `next_offset` until it's null to fetch the rest.
+#[derive(Debug, Serialize)]
+pub struct Page<T> {
+    pub items: Vec<T>,
+    pub offset: usize,
+    /// The offset of the next page, null on the last page.
+    pub next_offset: Option<usize>,
+}
+impl<T> Page<T> {
+    /// # Returns
+    /// The items of the requested page out of every item of the list
+    fn of(items: impl IntoIterator<Item = T>, params: &PageParams) -> Self {
+        let (offset, limit) = (params.offset(), params.limit());
+        let mut items = items
+            .into_iter()
+            .skip(offset)
+            .take(limit + 1)
+            .collect::<Vec<_>>();
+        let next_offset = (items.len() > limit).then_some(offset + limit);
+        items.truncate(limit);
+        Self {
+            items,
+            offset,
+            next_offset,
+        }
+    }
+}
+
+/// A run in a list, fetch `/api/v1/runs/:run_id` for its scenarios and energy.
+#[derive(Debug, Serialize)]
+pub struct RunSummary {
+    pub run_id: String,
+    pub start_time: i64,
+    pub stop_time: i64,
+    pub label: Option<String>,
+    pub project: Option<String>,
+    pub git: Option<Git>,
+    /// Why energy couldn't be estimated, null if it could.
+    pub energy_unavailable: Option<String>,
+    /// The notes added to the run, oldest first.
+    pub annotations: Vec<Annotation>,
+}
+impl From<&Run> for RunSummary {
+    fn from(run: &Run) -> Self {
+        Self {
+            run_id: run.run_id.clone(),
+            start_time: run.start_time,
+            stop_time: run.stop_time,
+            label: run.label.clone(),
+            project: run.project.clone(),
+            git: run.git(),
+            energy_unavailable: run.energy_unavailable.clone(),
+            annotations: run.annotations(),
+        }
+    }
+}
+
+#[derive(Debug, Default, Deserialize)]
+pub struct RunFilter {
+    project: Option<String>,
+    label: Option<String>,
+    /// A prefix of the commit the runs measured.
+    commit: Option<String>,
+    /// Milliseconds since the unix epoch, runs started before it are left out.
+    since: Option<i64>,
+    /// Milliseconds since the unix epoch, runs started after it are left out.
+    until: Option<i64>,
+}
+impl RunFilter {
+    fn matches(&self, run: &Run) -> bool {
+        self.project
+            .as_ref()
+            .map_or(true, |project| run.project.as_ref() == Some(project))
+            && self
+                .label
+                .as_ref()
+                .map_or(true, |label| run.label.as_ref() == Some(label))
+            && self.commit.as_ref().map_or(true, |commit| {
+                run.git().is_some_and(|git| git.is_commit(commit))
+            })
+            && self.until.map_or(true, |until| run.start_time <= until)
+    }
+}
+
+/// # Returns
+/// The runs matching the filter, the latest first
+#[instrument(name = "List runs")]
+async fn list_runs(
+    Query(filter): Query<RunFilter>,
+    Query(page): Query<PageParams>,
+    State(pool): State<SqlitePool>,
+) -> Result<Json<Page<RunSummary>>, ServerError> {
+    let data_access_service = LocalDataAccessService::new(pool);
+    let runs = data_access_service
+        .run_dao()
+        .fetch_since(filter.since.unwrap_or_default())
+        .await
+        .map_err(ServerError::DataAccessError)?;
+
+    let runs = runs
+        .iter()
+        .rev()
+        .filter(|run| filter.matches(run))
+        .map(RunSummary::from);
+    Ok(Json(Page::of(runs, &page)))
+}
+
+/// # Returns
+/// The run with the energy of each of its scenarios, as exported with `cardamon export`
+#[instrument(name = "Fetch run detail")]
+async fn run_detail(
+    Path(run_id): Path<String>,
+    State(pool): State<SqlitePool>,
+) -> Result<Json<RunExport>, ServerError> {
+    let data_access_service = LocalDataAccessService::new(pool);
+    if data_access_service
+        .run_dao()
+        .fetch(&run_id)
+        .await
+        .map_err(ServerError::DataAccessError)?
+        .is_none()
+    {
+        return Err(ServerError::NotFound(format!("Run {} not found", run_id)));
+    }
+    let run_dataset = data_access_service
+        .fetch_run_dataset(&run_id)
+        .await
+        .map_err(ServerError::DataAccessError)?;
+    let blend = run_dataset.runs().first().and_then(report::run_blend);
+
+    export::export(&run_dataset, blend.as_ref())
+        .map(Json)
+        .ok_or(ServerError::NotFound(format!("Run {} not found", run_id)))
+}
+
+/// # Returns
+/// The CPU samples taken during the run in the order they were taken, as exported with
+/// `cardamon export --raw`
+#[instrument(name = "Fetch run samples")]
+async fn run_samples(
+    Path(run_id): Path<String>,
+    Query(page): Query<PageParams>,
+    State(pool): State<SqlitePool>,
+) -> Result<Json<Page<RawSample>>, ServerError> {
+    let data_access_service = LocalDataAccessService::new(pool);
+    let run = data_access_service
+        .run_dao()
+        .fetch(&run_id)
+        .await
+        .map_err(ServerError::DataAccessError)?
+        .ok_or(ServerError::NotFound(format!("Run {} not found", run_id)))?;
+    let cpu_metrics = data_access_service
+        .fetch_samples_within(&run_id, run.start_time, run.stop_time)
+        .await
+        .map_err(ServerError::DataAccessError)?
+        .cpu_metrics;
+    let scenario_iterations = data_access_service
+        .scenario_iteration_dao()
+        .fetch_by_run(&run_id)
+        .await
+        .map_err(ServerError::DataAccessError)?;
+
+    let samples = export::raw_samples(&run, &cpu_metrics, &scenario_iterations);
+    Ok(Json(Page::of(samples, &page)))
+}
+
+#[derive(Debug, Default, Deserialize)]
+pub struct HistoryParams {
+    project: Option<String>,
+}
+
+/// The energy of a scenario in one run.
+#[derive(Debug, Serialize)]
+pub struct HistoryPoint {
+    pub run_id: String,
+    pub start_time: i64,
+    pub label: Option<String>,
+    pub git: Option<Git>,
+    /// The energy of the scenario's iterations in joules.
+    pub energy: EnergyStats,
+    pub annotations: Vec<Annotation>,
+}
+impl From<trend::Point> for HistoryPoint {
+    fn from(point: trend::Point) -> Self {
+        Self {
+            run_id: point.run_id,
+            start_time: point.start_time,
+            label: point.label,
+            git: point.git,
+            energy: point.energy.into(),
+            annotations: point.annotations,
+        }
+    }
+}
+
+/// # Returns
+/// The energy of the scenario in each run it ran in, the latest first. Runs without energy are
+/// left out
+#[instrument(name = "Fetch scenario history")]
+async fn scenario_history(
+    Path(scenario): Path<String>,
+    Query(params): Query<HistoryParams>,
+    Query(page): Query<PageParams>,
+    State(pool): State<SqlitePool>,
+) -> Result<Json<Page<HistoryPoint>>, ServerError> {
+    let data_access_service = LocalDataAccessService::new(pool);
+    // one more run than the page is fetched to tell whether there's another page
+    let previous_runs = (page.offset() + page.limit() + 1) as u32;
+    let observation_dataset = data_access_service
+        .fetch_observation_dataset(vec![&scenario], params.project.as_deref(), previous_runs)
+        .await
+        .map_err(ServerError::DataAccessError)?;
+
+    let scenario_datasets = observation_dataset.by_scenario();
+    let mut runs = scenario_datasets
+        .iter()
+        .flat_map(|scenario_dataset| scenario_dataset.by_run())
+        .collect::<Vec<RunDataset>>();
+    runs.sort_by_key(|run_dataset| Reverse(run_dataset.run().map(|run| run.start_time)));
+
+    let points = trend::points(&runs).into_iter().map(HistoryPoint::from);
+    Ok(Json(Page::of(points, &page)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn lists_are_paged() {
+        let params = |limit, offset| PageParams { limit, offset };
+
+        let page = Page::of(0..120, &params(None, None));
+        assert_eq!(page.items.len(), DEFAULT_LIMIT);
+        assert_eq!(page.next_offset, Some(50));
+
+        let page = Page::of(0..120, &params(Some(50), Some(100)));
+        assert_eq!(page.items, (100..120).collect::<Vec<_>>());
+        assert_eq!(page.next_offset, None);
+
+        let page = Page::of(0..10, &params(Some(5), Some(5)));
+        assert_eq!(page.items, [5, 6, 7, 8, 9]);
+        assert_eq!(page.next_offset, None);
+
+        let page = Page::of(0..5000, &params(Some(0), None));
+        assert_eq!(page.items.len(), 1);
+        let page = Page::of(0..5000, &params(Some(5000), None));
+        assert_eq!(page.items.len(), MAX_LIMIT);
+    }
+
+    #[test]
+    fn runs_are_filtered() {
+        let mut run = Run::new("1", 1000, 2000, None, "config", None, None);
+        run.project = Some(String::from("shop"));
+        run.label = Some(String::from("main"));
+        run.git_commit = Some(String::from("3f9a2c1d0e"));
+
+        let filter = |filter: RunFilter| filter.matches(&run);
+        assert!(filter(RunFilter::default()));
+        assert!(filter(RunFilter {
+            project: Some(String::from("shop")),
+            commit: Some(String::from("3f9a2c1")),
+            until: Some(1000),
+            ..RunFilter::default()
+        }));
+        assert!(!filter(RunFilter {
+            project: Some(String::from("blog")),
+            ..RunFilter::default()
+        }));
+        assert!(!filter(RunFilter {
+            label: Some(String::from("feature")),
+            ..RunFilter::default()
+        }));
+        assert!(!filter(RunFilter {
+            commit: Some(String::from("4e0b3d2")),
+            ..RunFilter::default()
+        }));
+        assert!(!filter(RunFilter {
+            until: Some(999),
+            ..RunFilter::default()
+        }));
+    }
+}
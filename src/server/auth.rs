@@ -0,0 +1,153 @@
+//! Requires a token on every route once tokens are configured in `[server]`. Pushing runs takes a
+//! write token, everything else a read token. Grafana queries are POSTs but only read.
+
+use super::errors::ServerError;
+use axum::{
+    extract::{Request, State},
+    http::{header, HeaderMap, Method},
+    middleware::Next,
+    response::{IntoResponse, Response},
+};
+use base64::{engine::general_purpose::STANDARD, Engine as _};
+use cardamon::config::{self, TokenScope};
+use sha2::{Digest, Sha256};
+use std::sync::Arc;
+
+#[derive(Debug)]
+struct Token {
+    name: String,
+    secret: String,
+    scope: TokenScope,
+}
+
+/// The tokens the server accepts, no token is needed if there are none.
+#[derive(Debug, Clone, Default)]
+pub struct Tokens(Arc<Vec<Token>>);
+impl Tokens {
+    /// # Returns
+    /// The configured tokens, an error if any of their environment variables isn't set
+    pub fn from_config(server: Option<&config::Server>) -> anyhow::Result<Self> {
+        let mut tokens = vec![];
+        for token in server.iter().flat_map(|server| server.tokens.iter()) {
+            tokens.push(Token {
+                name: token.name.clone(),
+                secret: token.secret()?,
+                scope: token.scope,
+            });
+        }
+        Ok(Self(Arc::new(tokens)))
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+
+    /// # Returns
+    /// The token sent with the request as a bearer token or basic auth password, None if no
+    /// configured token was sent
+    fn of(&self, headers: &HeaderMap) -> Option<&Token> {
+        let authorization = headers.get(header::AUTHORIZATION)?.to_str().ok()?;
+        let (scheme, credentials) = authorization.split_once(' ')?;
+        let sent = match scheme.to_lowercase().as_str() {
+            "bearer" => credentials.trim().to_string(),
+            // browsers ask for a user and password, the user is ignored
+            "basic" => {
+                let decoded = String::from_utf8(STANDARD.decode(credentials.trim()).ok()?).ok()?;
+                decoded.split_once(':')?.1.to_string()
+            }
+            _ => return None,
+        };
+        self.0
+            .iter()
+            .find(|token| same(token.secret.as_bytes(), sent.as_bytes()))
+    }
+}
+
+/// Rejects requests without a token with the scope they need. Reading is a GET or a Grafana query,
+/// anything else writes.
+pub async fn authorise(State(tokens): State<Tokens>, request: Request, next: Next) -> Response {
+    if tokens.is_empty() {
+        return next.run(request).await;
+    }
+
+    let needed = match *request.method() {
+        Method::GET | Method::HEAD => TokenScope::Read,
+        _ if request.uri().path().starts_with("/grafana/") => TokenScope::Read,
+        _ => TokenScope::Write,
+    };
+    match tokens.of(request.headers()) {
+        None => ServerError::Unauthorised.into_response(),
+        Some(token) if token.scope < needed => {
+            tracing::warn!(
+                "Token {} can't {} {}",
+                token.name,
+                request.method(),
+                request.uri()
+            );
+            ServerError::Forbidden(format!("Token {} can only read", token.name)).into_response()
+        }
+        Some(token) => {
+            tracing::debug!(
+                "{} {} with token {}",
+                request.method(),
+                request.uri(),
+                token.name
+            );
+            next.run(request).await
+        }
+    }
+}
+
+/// Compares the digests of tokens rather than the tokens, so the time taken doesn't depend on
+/// where they differ or on how long they are and they can't be guessed a byte at a time.
+fn same(a: &[u8], b: &[u8]) -> bool {
+    let (a, b) = (Sha256::digest(a), Sha256::digest(b));
+    a.iter()
+        .zip(b.iter())
+        .fold(0, |diff, (a, b)| diff | (a ^ b))
+        == 0
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use axum::http::HeaderValue;
+
+    #[test]
+    fn tokens_are_sent_as_bearer_or_basic_auth() {
+        let tokens = Tokens(Arc::new(vec![
+            Token {
+                name: String::from("ci"),
+                secret: String::from("s3cret"),
+                scope: TokenScope::Write,
+            },
+            Token {
+                name: String::from("pm"),
+                secret: String::from("dashboard"),
+                scope: TokenScope::Read,
+            },
+        ]));
+        let sent = |authorization: &str| {
+            let mut headers = HeaderMap::new();
+            headers.insert(
+                header::AUTHORIZATION,
+                HeaderValue::from_str(authorization).unwrap(),
+            );
+            tokens.of(&headers).map(|token| token.name.as_str())
+        };
+
+        assert_eq!(sent("Bearer s3cret"), Some("ci"));
+        // "anyone:dashboard"
+        assert_eq!(sent("Basic YW55b25lOmRhc2hib2FyZA=="), Some("pm"));
+        assert_eq!(sent("Bearer s3cre"), None);
+        assert_eq!(sent("Token s3cret"), None);
+        assert_eq!(tokens.of(&HeaderMap::new()).map(|token| token.scope), None);
+
+        assert_eq!(sent("Basic YW55b25lOmRhc2hib2FyZA"), None);
+        assert_eq!(sent("Basic a!"), None);
+
+        assert!(same(b"s3cret", b"s3cret"));
+        assert!(!same(b"s3cret", b"s3cre"));
+        assert!(!same(b"s3cret", b"s3cres"));
+    }
+}
@@ -1,10 +1,20 @@
-use axum::{http::StatusCode, response::IntoResponse, Json};
+use axum::{
+    http::{header, StatusCode},
+    response::IntoResponse,
+    Json,
+};
 use serde_json::json;
 use std::fmt;
 
 #[derive(Debug)]
 pub enum ServerError {
     DatabaseError(sqlx::Error),
+    DataAccessError(anyhow::Error),
+    NotFound(String),
+    /// No token, or one the server doesn't know, was sent.
+    Unauthorised,
+    /// The token can't do what was asked, e.g. push with a read token.
+    Forbidden(String),
     #[allow(dead_code)]
     OtherError,
 }
@@ -13,6 +23,10 @@ impl ServerError {
     pub fn status_code(&self) -> StatusCode {
         match self {
             ServerError::DatabaseError(_) => StatusCode::INTERNAL_SERVER_ERROR,
+            ServerError::DataAccessError(_) => StatusCode::INTERNAL_SERVER_ERROR,
+            ServerError::NotFound(_) => StatusCode::NOT_FOUND,
+            ServerError::Unauthorised => StatusCode::UNAUTHORIZED,
+            ServerError::Forbidden(_) => StatusCode::FORBIDDEN,
             ServerError::OtherError => StatusCode::INTERNAL_SERVER_ERROR,
         }
     }
@@ -24,6 +38,10 @@ impl ServerError {
                 sqlx::Error::RowNotFound => format!("Row not found: {}", e),
                 _ => format!("Database error: {}", e),
             },
+            ServerError::DataAccessError(e) => format!("Database error: {:#}", e),
+            ServerError::NotFound(message) => message.clone(),
+            ServerError::Unauthorised => "A valid token is required".to_string(),
+            ServerError::Forbidden(message) => message.clone(),
             ServerError::OtherError => "Un-used error".to_string(),
         }
     }
@@ -37,6 +55,15 @@ impl fmt::Display for ServerError {
 
 impl IntoResponse for ServerError {
     fn into_response(self) -> axum::response::Response {
+        // lets browsers ask for the token
+        if let ServerError::Unauthorised = self {
+            return (
+                self.status_code(),
+                [(header::WWW_AUTHENTICATE, "Basic realm=\"cardamon\"")],
+                Json(json!({"error": self.error_message()})),
+            )
+                .into_response();
+        }
         (
             self.status_code(),
             Json(json!({"error": self.error_message()})),
@@ -0,0 +1,116 @@
+//! A Grafana JSON datasource under `/grafana`, see [cardamon::grafana]. Point the datasource at
+//! `<server>/grafana` and import a dashboard written by `cardamon grafana-dashboard`.
+
+use super::errors::ServerError;
+use axum::{
+    extract::State,
+    routing::{get, post},
+    Json, Router,
+};
+use cardamon::{
+    data_access::{DataAccessService, LocalDataAccessService},
+    dataset::RunDataset,
+    grafana::{self, AnnotationEvent, AnnotationRequest, QueryRequest, SearchRequest, TimeSeries},
+    trend,
+};
+use itertools::Itertools;
+use sqlx::SqlitePool;
+use tracing::instrument;
+
+/// The most runs of a scenario a series is made from, the latest are kept.
+const MAX_RUNS: u32 = 1000;
+
+pub fn router() -> Router<SqlitePool> {
+    Router::new()
+        // Grafana tests the datasource with a GET of its url
+        .route("/", get(|| async { "OK" }))
+        .route("/search", post(search))
+        .route("/query", post(query))
+        .route("/annotations", post(annotations))
+}
+
+/// # Returns
+/// The name of every scenario containing the text of the search
+#[instrument(name = "Search Grafana targets")]
+async fn search(
+    State(pool): State<SqlitePool>,
+    Json(search): Json<SearchRequest>,
+) -> Result<Json<Vec<String>>, ServerError> {
+    let data_access_service = LocalDataAccessService::new(pool);
+    let runs = data_access_service
+        .run_dao()
+        .fetch_since(0)
+        .await
+        .map_err(ServerError::DataAccessError)?;
+
+    let mut scenarios = vec![];
+    for run in runs.iter() {
+        scenarios.extend(
+            data_access_service
+                .scenario_iteration_dao()
+                .fetch_by_run(&run.run_id)
+                .await
+                .map_err(ServerError::DataAccessError)?
+                .into_iter()
+                .map(|scenario_iteration| scenario_iteration.scenario_name),
+        );
+    }
+    let scenarios = scenarios
+        .into_iter()
+        .filter(|scenario| scenario.contains(&search.target))
+        .unique()
+        .sorted()
+        .collect();
+    Ok(Json(scenarios))
+}
+
+/// # Returns
+/// The energy of each targeted scenario in the runs started within the range
+#[instrument(name = "Query Grafana targets")]
+async fn query(
+    State(pool): State<SqlitePool>,
+    Json(request): Json<QueryRequest>,
+) -> Result<Json<Vec<TimeSeries>>, ServerError> {
+    let data_access_service = LocalDataAccessService::new(pool);
+    let mut series = vec![];
+    for target in request.targets.iter().filter(|target| !target.hide) {
+        let observation_dataset = data_access_service
+            .fetch_observation_dataset(vec![&target.target], target.project(), MAX_RUNS)
+            .await
+            .map_err(ServerError::DataAccessError)?;
+
+        let scenario_datasets = observation_dataset.by_scenario();
+        let mut runs = scenario_datasets
+            .iter()
+            .flat_map(|scenario_dataset| scenario_dataset.by_run())
+            .collect::<Vec<RunDataset>>();
+        runs.sort_by_key(|run_dataset| run_dataset.run().map(|run| run.start_time));
+
+        series.push(grafana::time_series(
+            &target.target,
+            &trend::points(&runs),
+            &request.range,
+            request.max_data_points,
+        ));
+    }
+    Ok(Json(series))
+}
+
+/// # Returns
+/// The notes of the runs started within the range
+#[instrument(name = "Query Grafana annotations")]
+async fn annotations(
+    State(pool): State<SqlitePool>,
+    Json(request): Json<AnnotationRequest>,
+) -> Result<Json<Vec<AnnotationEvent>>, ServerError> {
+    let data_access_service = LocalDataAccessService::new(pool);
+    let mut runs = data_access_service
+        .run_dao()
+        .fetch_since(request.range.from.timestamp_millis())
+        .await
+        .map_err(ServerError::DataAccessError)?;
+    if let Some(project) = request.annotation.project() {
+        runs.retain(|run| run.project.as_deref() == Some(project));
+    }
+    Ok(Json(grafana::annotation_events(&runs, &request.range)))
+}
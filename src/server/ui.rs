@@ -0,0 +1,208 @@
+//! The pages of the dashboard, see [cardamon::dashboard].
+
+use super::errors::ServerError;
+use axum::{
+    extract::{Path, Query, State},
+    response::Html,
+    routing::get,
+    Router,
+};
+use cardamon::{
+    compare, dashboard,
+    data_access::{DataAccessService, LocalDataAccessService},
+    dataset::RunDataset,
+    regression, report, trend,
+    units::Units,
+};
+use itertools::Itertools;
+use serde::Deserialize;
+use sqlx::SqlitePool;
+use tracing::instrument;
+
+/// How many runs the run history shows per page.
+const RUNS_PER_PAGE: usize = 50;
+
+/// How many of a scenario's latest runs its trend shows unless told otherwise.
+const TREND_RUNS: u32 = 30;
+
+#[derive(Debug, Clone)]
+struct UiState {
+    pool: SqlitePool,
+    units: Units,
+}
+
+/// # Arguments
+/// * units - the units figures are shown in
+pub fn router(pool: SqlitePool, units: Units) -> Router<SqlitePool> {
+    Router::new()
+        .route("/", get(runs))
+        .route("/ui/runs/:run_id", get(run))
+        .route("/ui/scenarios/:scenario", get(scenario))
+        .route("/ui/compare", get(comparison))
+        .with_state(UiState { pool, units })
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct RunsParams {
+    project: Option<String>,
+    offset: Option<usize>,
+}
+
+#[instrument(name = "Show run history")]
+async fn runs(
+    Query(params): Query<RunsParams>,
+    State(state): State<UiState>,
+) -> Result<Html<String>, ServerError> {
+    let data_access_service = LocalDataAccessService::new(state.pool);
+    let mut runs = data_access_service
+        .run_dao()
+        .fetch_since(0)
+        .await
+        .map_err(ServerError::DataAccessError)?;
+    if let Some(project) = &params.project {
+        runs.retain(|run| run.project.as_ref() == Some(project));
+    }
+
+    let offset = params.offset.unwrap_or_default();
+    let page = runs
+        .iter()
+        .rev()
+        .skip(offset)
+        .take(RUNS_PER_PAGE)
+        .collect::<Vec<_>>();
+    let older = (runs.len() > offset + RUNS_PER_PAGE).then_some(offset + RUNS_PER_PAGE);
+
+    let mut rows = vec![];
+    for run in page.into_iter() {
+        let scenarios = data_access_service
+            .scenario_iteration_dao()
+            .fetch_by_run(&run.run_id)
+            .await
+            .map_err(ServerError::DataAccessError)?
+            .into_iter()
+            .map(|scenario_iteration| scenario_iteration.scenario_name)
+            .unique()
+            .collect();
+        rows.push(dashboard::RunRow { run, scenarios });
+    }
+    Ok(Html(dashboard::runs_page(
+        &rows,
+        params.project.as_deref(),
+        older,
+    )))
+}
+
+#[instrument(name = "Show run")]
+async fn run(
+    Path(run_id): Path<String>,
+    State(state): State<UiState>,
+) -> Result<Html<String>, ServerError> {
+    let data_access_service = LocalDataAccessService::new(state.pool);
+    if data_access_service
+        .run_dao()
+        .fetch(&run_id)
+        .await
+        .map_err(ServerError::DataAccessError)?
+        .is_none()
+    {
+        return Err(ServerError::NotFound(format!("Run {} not found", run_id)));
+    }
+
+    let observation_dataset = data_access_service
+        .fetch_run_dataset(&run_id)
+        .await
+        .map_err(ServerError::DataAccessError)?;
+    let artifacts = data_access_service
+        .artifact_dao()
+        .fetch_by_run(&run_id)
+        .await
+        .map_err(ServerError::DataAccessError)?;
+    let blend = observation_dataset
+        .runs()
+        .first()
+        .and_then(report::run_blend);
+    Ok(Html(dashboard::run_report(
+        &observation_dataset,
+        blend.as_ref(),
+        &artifacts,
+    )))
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct ScenarioParams {
+    project: Option<String>,
+    last: Option<u32>,
+}
+
+#[instrument(name = "Show scenario trend")]
+async fn scenario(
+    Path(scenario): Path<String>,
+    Query(params): Query<ScenarioParams>,
+    State(state): State<UiState>,
+) -> Result<Html<String>, ServerError> {
+    let data_access_service = LocalDataAccessService::new(state.pool);
+    let observation_dataset = data_access_service
+        .fetch_observation_dataset(
+            vec![&scenario],
+            params.project.as_deref(),
+            params.last.unwrap_or(TREND_RUNS),
+        )
+        .await
+        .map_err(ServerError::DataAccessError)?;
+
+    let scenario_datasets = observation_dataset.by_scenario();
+    let mut runs = scenario_datasets
+        .iter()
+        .flat_map(|scenario_dataset| scenario_dataset.by_run())
+        .collect::<Vec<RunDataset>>();
+    runs.sort_by_key(|run_dataset| run_dataset.run().map(|run| run.start_time));
+
+    let points = trend::points(&runs);
+    let breaks = trend::breaks(&points);
+    Ok(Html(dashboard::scenario_page(
+        &scenario,
+        &points,
+        &breaks,
+        &state.units,
+    )))
+}
+
+#[derive(Debug, Deserialize)]
+struct ComparisonParams {
+    /// The run compared against, a run id, label or commit.
+    a: String,
+    b: String,
+}
+
+#[instrument(name = "Show run comparison")]
+async fn comparison(
+    Query(params): Query<ComparisonParams>,
+    State(state): State<UiState>,
+) -> Result<Html<String>, ServerError> {
+    let data_access_service = LocalDataAccessService::new(state.pool);
+    let runs = data_access_service
+        .run_dao()
+        .fetch_since(0)
+        .await
+        .map_err(ServerError::DataAccessError)?;
+    let find = |run: &str| {
+        regression::find_run(&runs, run)
+            .ok_or(ServerError::NotFound(format!("Run {} not found", run)))
+    };
+    let (run_a, run_b) = (find(&params.a)?, find(&params.b)?);
+
+    let a = data_access_service
+        .fetch_run_dataset(&run_a.run_id)
+        .await
+        .map_err(ServerError::DataAccessError)?;
+    let b = data_access_service
+        .fetch_run_dataset(&run_b.run_id)
+        .await
+        .map_err(ServerError::DataAccessError)?;
+    Ok(Html(dashboard::comparison_page(
+        run_a,
+        run_b,
+        &compare::compare(&a, &b),
+        &state.units,
+    )))
+}
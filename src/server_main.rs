@@ -1,10 +1,9 @@
 mod server;
 
-use axum::routing::{get, post, Router};
+use cardamon::config::Config;
 use dotenv::dotenv;
-use server::{fetch_within, persist_metrics, scenario_iteration_persist};
 use sqlx::{migrate::MigrateDatabase, sqlite::SqlitePool};
-use std::fs::File;
+use std::{fs::File, path::Path};
 use tracing::{info, subscriber::set_global_default, Subscriber};
 use tracing_bunyan_formatter::{BunyanFormattingLayer, JsonStorageLayer};
 use tracing_log::LogTracer;
@@ -16,32 +15,15 @@ async fn main() -> anyhow::Result<()> {
     let subscriber = get_subscriber("cardamon".into(), "debug".into());
     init_subscriber(subscriber);
     let pool = create_db().await?;
-    let app = create_app(pool).await;
-    let listener = tokio::net::TcpListener::bind(format!(
-        "0.0.0.0:{}",
-        std::env::var("SERVER_PORT").expect("Server port not set")
-    ))
-    .await
-    .unwrap();
+    let port = match std::env::var("SERVER_PORT") {
+        Ok(port) => port.parse()?,
+        Err(_) => server::DEFAULT_PORT,
+    };
+    // the units and tokens are read from the config like `cardamon server` does
+    let global = Config::global_from_path(Path::new("./cardamon.toml"))?;
+    let tokens = server::Tokens::from_config(global.server.as_ref())?;
     info!("Starting cardamon server");
-    axum::serve(listener, app).await.unwrap();
-    Ok(())
-}
-
-// Keep seperated for integraion tests
-async fn create_app(pool: SqlitePool) -> Router {
-    // Middleware later
-    /*
-    let protected = Router::new()
-    .route("/user", get(routes::user::get_user))
-    .layer(middleware::from_fn_with_state(pool.clone(), api_key_auth));
-    */
-    Router::new()
-        .route("/cpu_metrics", post(persist_metrics))
-        .route("/cpu_metrics/:id", get(fetch_within))
-        //.route("/cpu_metrics/:id", delete(delete_metrics)) removed for now
-        .route("/scenario", post(scenario_iteration_persist))
-        .with_state(pool)
+    server::serve(port, pool, global.units, tokens).await
 }
 
 fn get_subscriber(name: String, env_filter: String) -> impl Subscriber + Sync + Send {
@@ -0,0 +1,65 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use std::time;
+
+/// A small seeded random number generator (splitmix64) used to shuffle the order scenarios run
+/// in. It's seeded so the order of a run can be reproduced by running again with the same seed.
+pub struct Rng {
+    state: u64,
+}
+impl Rng {
+    pub fn new(seed: u64) -> Self {
+        Self { state: seed }
+    }
+
+    pub fn next_u64(&mut self) -> u64 {
+        self.state = self.state.wrapping_add(0x9e3779b97f4a7c15);
+        let mut z = self.state;
+        z = (z ^ (z >> 30)).wrapping_mul(0xbf58476d1ce4e5b9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94d049bb133111eb);
+        z ^ (z >> 31)
+    }
+
+    /// Shuffles the items in place with the Fisher-Yates shuffle.
+    pub fn shuffle<T>(&mut self, items: &mut [T]) {
+        for i in (1..items.len()).rev() {
+            let j = (self.next_u64() % (i as u64 + 1)) as usize;
+            items.swap(i, j);
+        }
+    }
+}
+
+/// # Returns
+/// A seed taken from the clock, small enough to be saved with the run
+pub fn seed() -> u64 {
+    let nanos = time::SystemTime::now()
+        .duration_since(time::UNIX_EPOCH)
+        .map(|since| since.as_nanos() as u64)
+        .unwrap_or_default();
+    nanos & i64::MAX as u64
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn shuffles_are_reproduced_from_their_seed() {
+        let shuffled = |seed| {
+            let mut items = (0..10).collect::<Vec<_>>();
+            Rng::new(seed).shuffle(&mut items);
+            items
+        };
+
+        assert_eq!(shuffled(42), shuffled(42));
+        assert_ne!(shuffled(42), shuffled(43));
+
+        let mut items = shuffled(42);
+        items.sort();
+        assert_eq!(items, (0..10).collect::<Vec<_>>());
+    }
+}
@@ -0,0 +1,222 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::dataset::Stats;
+
+/// A p-value below this is a significant difference, 5% is the chance of one being noise.
+pub const SIGNIFICANCE_LEVEL: f64 = 0.05;
+
+/// A t-test of the difference between the means of two samples, Welch's for unpaired samples or
+/// a paired test for pairs of iterations. Unlike Student's t-test Welch's doesn't assume both
+/// samples are equally noisy, which two runs on a busy machine often aren't.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct TTest {
+    /// The mean of b minus the mean of a.
+    pub difference: f64,
+    pub standard_error: f64,
+    pub degrees_of_freedom: f64,
+}
+impl TTest {
+    /// # Returns
+    /// The test of the difference between the means, None if either has fewer than two values or
+    /// neither has any spread to test against
+    pub fn welch(a: &Stats, b: &Stats) -> Option<Self> {
+        if a.iterations < 2 || b.iterations < 2 {
+            return None;
+        }
+        let variance = |stats: &Stats| stats.stddev.powi(2) / stats.iterations as f64;
+        let (a_variance, b_variance) = (variance(a), variance(b));
+        let total = a_variance + b_variance;
+        if total == 0.0 {
+            return None;
+        }
+        // the Welch-Satterthwaite approximation
+        let degrees_of_freedom = total.powi(2)
+            / (a_variance.powi(2) / (a.iterations - 1) as f64
+                + b_variance.powi(2) / (b.iterations - 1) as f64);
+        Some(Self {
+            difference: b.mean - a.mean,
+            standard_error: total.sqrt(),
+            degrees_of_freedom,
+        })
+    }
+
+    /// # Arguments
+    /// * difference - the stats of b minus a for each pair of values
+    ///
+    /// # Returns
+    /// The paired test of whether the mean difference is 0, None if there are fewer than two
+    /// pairs or the difference didn't vary
+    pub fn paired(difference: &Stats) -> Option<Self> {
+        if difference.iterations < 2 || difference.stddev == 0.0 {
+            return None;
+        }
+        Some(Self {
+            difference: difference.mean,
+            standard_error: difference.stddev / (difference.iterations as f64).sqrt(),
+            degrees_of_freedom: (difference.iterations - 1) as f64,
+        })
+    }
+
+    /// The t statistic, how many standard errors the difference is from 0.
+    pub fn t(&self) -> f64 {
+        self.difference / self.standard_error
+    }
+
+    /// The chance of a difference at least this large if the means were the same.
+    pub fn p_value(&self) -> f64 {
+        two_tailed_p(self.t(), self.degrees_of_freedom)
+    }
+
+    /// # Arguments
+    /// * confidence - e.g. 0.95
+    ///
+    /// # Returns
+    /// The range the true difference is within with the given confidence
+    pub fn confidence_interval(&self, confidence: f64) -> (f64, f64) {
+        let margin = t_critical(1.0 - confidence, self.degrees_of_freedom) * self.standard_error;
+        (self.difference - margin, self.difference + margin)
+    }
+}
+
+/// The chance of a t statistic at least as far from 0 as t, with the given degrees of freedom.
+fn two_tailed_p(t: f64, degrees_of_freedom: f64) -> f64 {
+    if !t.is_finite() {
+        return 0.0;
+    }
+    let x = degrees_of_freedom / (degrees_of_freedom + t * t);
+    incomplete_beta(degrees_of_freedom / 2.0, 0.5, x).clamp(0.0, 1.0)
+}
+
+/// # Returns
+/// The t statistic whose two tailed p-value is p
+fn t_critical(p: f64, degrees_of_freedom: f64) -> f64 {
+    // the p-value falls as t grows, so the t is found by bisection
+    let (mut low, mut high) = (0.0, 1e6);
+    for _ in 0..200 {
+        let mid = (low + high) / 2.0;
+        if two_tailed_p(mid, degrees_of_freedom) > p {
+            low = mid;
+        } else {
+            high = mid;
+        }
+    }
+    (low + high) / 2.0
+}
+
+/// The natural log of the gamma function by the Lanczos approximation.
+fn ln_gamma(x: f64) -> f64 {
+    const COEFFICIENTS: [f64; 6] = [
+        76.18009172947146,
+        -86.50532032941677,
+        24.01409824083091,
+        -1.231739572450155,
+        0.1208650973866179e-2,
+        -0.5395239384953e-5,
+    ];
+    let tmp = x + 5.5;
+    let tmp = tmp - (x + 0.5) * tmp.ln();
+    let series = COEFFICIENTS
+        .iter()
+        .enumerate()
+        .fold(1.000000000190015, |sum, (i, c)| {
+            sum + c / (x + 1.0 + i as f64)
+        });
+    -tmp + (2.5066282746310005 * series / x).ln()
+}
+
+/// The regularised incomplete beta function I_x(a, b).
+fn incomplete_beta(a: f64, b: f64, x: f64) -> f64 {
+    if x <= 0.0 {
+        return 0.0;
+    }
+    if x >= 1.0 {
+        return 1.0;
+    }
+    let front =
+        (ln_gamma(a + b) - ln_gamma(a) - ln_gamma(b) + a * x.ln() + b * (1.0 - x).ln()).exp();
+    // the continued fraction converges quickly on this side, the other is found by symmetry
+    if x < (a + 1.0) / (a + b + 2.0) {
+        front * beta_fraction(a, b, x) / a
+    } else {
+        1.0 - front * beta_fraction(b, a, 1.0 - x) / b
+    }
+}
+
+/// The continued fraction of the incomplete beta function, by Lentz's method.
+fn beta_fraction(a: f64, b: f64, x: f64) -> f64 {
+    const TINY: f64 = 1e-300;
+    let at_least_tiny = |v: f64| if v.abs() < TINY { TINY } else { v };
+
+    let mut c = 1.0;
+    let mut d = 1.0 / at_least_tiny(1.0 - (a + b) * x / (a + 1.0));
+    let mut fraction = d;
+    for m in 1..300 {
+        let m = m as f64;
+        let even = m * (b - m) * x / ((a + 2.0 * m - 1.0) * (a + 2.0 * m));
+        d = 1.0 / at_least_tiny(1.0 + even * d);
+        c = at_least_tiny(1.0 + even / c);
+        fraction *= d * c;
+
+        let odd = -(a + m) * (a + b + m) * x / ((a + 2.0 * m) * (a + 2.0 * m + 1.0));
+        d = 1.0 / at_least_tiny(1.0 + odd * d);
+        c = at_least_tiny(1.0 + odd / c);
+        let delta = d * c;
+        fraction *= delta;
+        if (delta - 1.0).abs() < 1e-12 {
+            break;
+        }
+    }
+    fraction
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn welch_t_tests_match_published_tables() {
+        // the two tailed 5% critical values of Student's t distribution
+        assert!((t_critical(0.05, 1.0) - 12.706).abs() < 1e-3);
+        assert!((t_critical(0.05, 10.0) - 2.228).abs() < 1e-3);
+        assert!((two_tailed_p(2.228, 10.0) - 0.05).abs() < 1e-4);
+        assert_eq!(two_tailed_p(0.0, 5.0), 1.0);
+
+        let stats = |values: &[f64]| Stats::of(values).expect("there are values");
+        let a = stats(&[20.0, 20.4, 19.6, 20.2, 19.8]);
+        let noisy = stats(&[19.0, 21.5, 20.4, 18.9, 21.0]);
+        let test = TTest::welch(&a, &noisy).expect("both have a spread");
+        assert!(test.p_value() > SIGNIFICANCE_LEVEL);
+        let (low, high) = test.confidence_interval(0.95);
+        assert!(low < 0.0 && high > 0.0);
+
+        let lower = stats(&[18.0, 18.3, 17.8, 18.1, 17.9]);
+        let test = TTest::welch(&a, &lower).expect("both have a spread");
+        assert!(test.p_value() < 0.001);
+        let (low, high) = test.confidence_interval(0.95);
+        assert!(low < -2.0 && high < -1.5);
+
+        // nothing to test a single iteration or identical iterations against
+        assert!(TTest::welch(&stats(&[20.0]), &lower).is_none());
+        assert!(TTest::welch(&stats(&[20.0, 20.0]), &stats(&[18.0, 18.0])).is_none());
+    }
+
+    #[test]
+    fn paired_t_tests_have_a_degree_of_freedom_less_than_the_pairs() {
+        assert!((t_critical(0.05, 2.0) - 4.303).abs() < 1e-3);
+        assert!((t_critical(0.05, 4.0) - 2.776).abs() < 1e-3);
+
+        let stats = |values: &[f64]| Stats::of(values).expect("there are values");
+        let test = TTest::paired(&stats(&[1.0, 2.0, 3.0])).expect("the difference varies");
+        assert_eq!(test.degrees_of_freedom, 2.0);
+        // over 2 standard errors from 0 but too few pairs to be significant
+        assert!(test.t() > 2.0);
+        assert!(test.p_value() > SIGNIFICANCE_LEVEL);
+
+        assert!(TTest::paired(&stats(&[1.0])).is_none());
+        assert!(TTest::paired(&stats(&[1.0, 1.0])).is_none());
+    }
+}
@@ -0,0 +1,229 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    data_access::{artifact::Artifact, DataAccessService},
+    dataset::ObservationDataset,
+    export, report,
+};
+use anyhow::{anyhow, Context};
+use object_store::{
+    aws::AmazonS3Builder, path::Path, Attribute, Attributes, ObjectStore, PutOptions,
+};
+
+/// A bucket and prefix runs are uploaded to, parsed from `s3://bucket/prefix`.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Destination {
+    pub bucket: String,
+    /// Prepended to the key of every file, without leading or trailing slashes.
+    pub prefix: String,
+}
+impl Destination {
+    pub fn parse(url: &str) -> anyhow::Result<Self> {
+        let path = url
+            .strip_prefix("s3://")
+            .ok_or(anyhow!("{} should be an s3://bucket/prefix url", url))?;
+        let (bucket, prefix) = path.split_once('/').unwrap_or((path, ""));
+        if bucket.is_empty() {
+            return Err(anyhow!("{} has no bucket", url));
+        }
+        Ok(Self {
+            bucket: bucket.to_string(),
+            prefix: prefix.trim_matches('/').to_string(),
+        })
+    }
+
+    /// # Returns
+    /// The key of a file of a run, under the run's project if it has one
+    fn key(&self, project: Option<&str>, run_id: &str, file_name: &str) -> String {
+        [
+            Some(self.prefix.as_str()),
+            project,
+            Some(run_id),
+            Some(file_name),
+        ]
+        .into_iter()
+        .flatten()
+        .filter(|part| !part.is_empty())
+        .collect::<Vec<_>>()
+        .join("/")
+    }
+}
+impl std::fmt::Display for Destination {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "s3://{}/{}", self.bucket, self.prefix)
+    }
+}
+
+/// A file uploaded for a run.
+#[derive(Debug, PartialEq)]
+pub struct Upload {
+    pub key: String,
+    pub content_type: &'static str,
+    pub content: Vec<u8>,
+}
+
+/// What was uploaded by a sync.
+#[derive(Debug, Default, Clone, Copy, PartialEq)]
+pub struct Synced {
+    pub files: usize,
+    pub bytes: usize,
+}
+
+/// # Arguments
+/// * destination - where the files are uploaded
+/// * observation_dataset - the dataset of a single run
+/// * artifacts - the files attached to the run
+///
+/// # Returns
+/// The export and HTML report of the run, then its artifacts, an error if the dataset has no run
+pub fn uploads(
+    destination: &Destination,
+    observation_dataset: &ObservationDataset,
+    artifacts: &[Artifact],
+) -> anyhow::Result<Vec<Upload>> {
+    let run = observation_dataset
+        .runs()
+        .first()
+        .context("The dataset has no run to upload.")?;
+    let blend = report::run_blend(run);
+    let key = |file_name: &str| destination.key(run.project.as_deref(), &run.run_id, file_name);
+
+    let export = export::export(observation_dataset, blend.as_ref())
+        .context(format!("Unable to export run {}", run.run_id))?;
+    let mut uploads = vec![
+        Upload {
+            key: key("export.json"),
+            content_type: "application/json",
+            content: serde_json::to_vec_pretty(&export)?,
+        },
+        Upload {
+            key: key("report.html"),
+            content_type: "text/html; charset=utf-8",
+            content: report::html(observation_dataset, blend.as_ref(), artifacts).into_bytes(),
+        },
+    ];
+    for artifact in artifacts.iter() {
+        // named as `cardamon artifacts` extracts them
+        let file_name = artifact.extracted_file_name()?;
+        uploads.push(Upload {
+            key: key(&format!("artifacts/{}", file_name)),
+            content_type: content_type(artifact.extension().as_deref()),
+            content: artifact.content.clone(),
+        });
+    }
+    Ok(uploads)
+}
+
+/// # Returns
+/// The media type of a file with the extension, so reports open in the browser rather than
+/// downloading
+fn content_type(extension: Option<&str>) -> &'static str {
+    match extension {
+        Some("html" | "htm") => "text/html; charset=utf-8",
+        Some("json") => "application/json",
+        Some("svg") => "image/svg+xml",
+        Some("png") => "image/png",
+        Some("jpg" | "jpeg") => "image/jpeg",
+        Some("txt" | "log" | "md" | "csv") => "text/plain; charset=utf-8",
+        _ => "application/octet-stream",
+    }
+}
+
+/// Uploads the export, HTML report and artifacts of a run to object storage, e.g. from a CI
+/// machine which is about to be thrown away. Credentials and the region are read from the
+/// standard `AWS_` environment variables, `AWS_ENDPOINT` points it at other S3 compatible
+/// storage.
+///
+/// # Arguments
+/// * run_id - the run to upload
+/// * data_access_service - where the run was saved
+/// * destination - where the files are uploaded, files already there are replaced
+///
+/// # Returns
+/// What was uploaded, an error if the run is missing or a file couldn't be uploaded
+pub async fn sync(
+    run_id: &str,
+    data_access_service: &dyn DataAccessService,
+    destination: &Destination,
+) -> anyhow::Result<Synced> {
+    if data_access_service.run_dao().fetch(run_id).await?.is_none() {
+        return Err(anyhow!("Unable to find run {}", run_id));
+    }
+    let observation_dataset = data_access_service.fetch_run_dataset(run_id).await?;
+    let artifacts = data_access_service
+        .artifact_dao()
+        .fetch_by_run(run_id)
+        .await?;
+    let uploads = uploads(destination, &observation_dataset, &artifacts)?;
+
+    let store = AmazonS3Builder::from_env()
+        .with_bucket_name(&destination.bucket)
+        .build()
+        .context("Unable to set up S3, check the AWS_ environment variables.")?;
+    let mut synced = Synced::default();
+    for upload in uploads.into_iter() {
+        let bytes = upload.content.len();
+        let attributes = Attributes::from_iter([(Attribute::ContentType, upload.content_type)]);
+        store
+            .put_opts(
+                &Path::from(upload.key.as_str()),
+                upload.content.into(),
+                PutOptions::from(attributes),
+            )
+            .await
+            .context(format!(
+                "Error uploading {} to {}",
+                upload.key, destination.bucket
+            ))?;
+        tracing::debug!("Uploaded {} ({} bytes)", upload.key, bytes);
+        synced.files += 1;
+        synced.bytes += bytes;
+    }
+    Ok(synced)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::data_access::run::Run;
+
+    #[test]
+    fn runs_are_uploaded_under_their_project() -> anyhow::Result<()> {
+        let destination = Destination::parse("s3://reports/ci/cardamon/")?;
+        assert_eq!(destination.bucket, "reports");
+        assert_eq!(destination.prefix, "ci/cardamon");
+        assert_eq!(Destination::parse("s3://reports")?.prefix, "");
+        assert!(Destination::parse("https://reports").is_err());
+        assert!(Destination::parse("s3:///ci").is_err());
+
+        let run = Run {
+            project: Some(String::from("shop")),
+            ..Run::new("1", 1000, 2000, None, "", None, None)
+        };
+        let observation_dataset = ObservationDataset::new(vec![], vec![run], vec![]);
+        let flamegraph = Artifact::new("1", "flamegraph", "perf.SVG", vec![1, 2, 3], 2000);
+
+        let uploads = uploads(&destination, &observation_dataset, &[flamegraph])?;
+        let keys = uploads
+            .iter()
+            .map(|upload| (upload.key.as_str(), upload.content_type))
+            .collect::<Vec<_>>();
+        assert_eq!(
+            keys,
+            [
+                ("ci/cardamon/shop/1/export.json", "application/json"),
+                ("ci/cardamon/shop/1/report.html", "text/html; charset=utf-8"),
+                (
+                    "ci/cardamon/shop/1/artifacts/flamegraph.svg",
+                    "image/svg+xml"
+                )
+            ]
+        );
+        assert_eq!(uploads[2].content, [1, 2, 3]);
+        Ok(())
+    }
+}
@@ -0,0 +1,99 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::{anyhow, Context};
+use std::collections::BTreeMap;
+
+/// Replaces the `{{name}}` placeholders in a process or scenario command with the values of
+/// variables. Variables come from `[variables]` in the config, `--set` on the command line and the
+/// built-ins `run_id`, `port`, `scenario` and `iteration`.
+///
+/// # Arguments
+/// * template - the command containing placeholders
+/// * variables - the values of the variables
+///
+/// # Returns
+/// The command with every placeholder replaced, an error if a placeholder has no variable
+pub fn render(template: &str, variables: &BTreeMap<String, String>) -> anyhow::Result<String> {
+    let mut rendered = String::new();
+    let mut rest = template;
+    while let Some(start) = rest.find("{{") {
+        let end = rest[start..]
+            .find("}}")
+            .ok_or(anyhow!("Unclosed placeholder in `{template}`"))?;
+        let name = rest[start + 2..start + end].trim();
+        let value = variables
+            .get(name)
+            .ok_or(anyhow!("Unknown variable {{{{{name}}}}} in `{template}`"))?;
+
+        rendered.push_str(&rest[..start]);
+        rendered.push_str(value);
+        rest = &rest[start + end + 2..];
+    }
+    rendered.push_str(rest);
+
+    Ok(rendered)
+}
+
+/// Parses a variable set on the command line.
+///
+/// # Arguments
+/// * assignment - the variable and its value, e.g. `port=8080`
+///
+/// # Returns
+/// The name and value of the variable
+pub fn parse_assignment(assignment: &str) -> anyhow::Result<(String, String)> {
+    let (name, value) = assignment
+        .split_once('=')
+        .ok_or(anyhow!("Expected name=value but got {assignment}"))?;
+    let name = name.trim();
+    if name.is_empty() {
+        return Err(anyhow!("Expected name=value but got {assignment}"));
+    }
+    Ok((String::from(name), String::from(value)))
+}
+
+/// Asks the operating system for a TCP port which isn't in use, it's picked once per run so the
+/// processes and the scenarios agree on it.
+///
+/// # Returns
+/// A free port on localhost
+pub fn free_port() -> anyhow::Result<u16> {
+    let listener =
+        std::net::TcpListener::bind("127.0.0.1:0").context("Unable to find a free port")?;
+    Ok(listener.local_addr()?.port())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn placeholders_are_replaced_with_variables() -> anyhow::Result<()> {
+        let variables = BTreeMap::from([
+            (String::from("port"), String::from("8080")),
+            (String::from("run_id"), String::from("a1b2c")),
+        ]);
+
+        assert_eq!(
+            render(
+                "node server.js --port {{port}} --out {{ run_id }}.log",
+                &variables
+            )?,
+            "node server.js --port 8080 --out a1b2c.log"
+        );
+        assert_eq!(render("kill {pid}", &variables)?, "kill {pid}");
+        assert!(render("node server.js --port {{host}}", &variables).is_err());
+        assert!(render("node server.js --port {{port", &variables).is_err());
+
+        assert_eq!(
+            parse_assignment("url=http://localhost?a=b")?,
+            (String::from("url"), String::from("http://localhost?a=b"))
+        );
+        assert!(parse_assignment("port").is_err());
+        Ok(())
+    }
+}
@@ -0,0 +1,199 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use crate::{
+    annotation::Annotation,
+    compare,
+    data_access::run::Run,
+    dataset::{RunDataset, Stats},
+    git::Git,
+    report,
+};
+
+const SPARKS: [char; 8] = ['▁', '▂', '▃', '▄', '▅', '▆', '▇', '█'];
+
+/// How many runs either side of a run are compared to tell whether the trend broke at it.
+const WINDOW: usize = 5;
+
+/// A shift smaller than this percentage isn't reported as a trend break however steady the runs
+/// either side of it are.
+const MIN_SHIFT_PCT: f64 = 5.0;
+
+/// The energy of a scenario in one run.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Point {
+    pub run_id: String,
+    pub start_time: i64,
+    pub label: Option<String>,
+    /// The commit the run measured.
+    pub git: Option<Git>,
+    /// The energy of each iteration of the scenario in the run.
+    pub energy: Stats,
+    /// The notes added to the run, e.g. what changed since the run before it.
+    pub annotations: Vec<Annotation>,
+}
+
+/// A run from which the energy of a scenario settled at a different level.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Break {
+    /// The index of the first point at the new level.
+    pub index: usize,
+    /// The mean energy of the runs before the break.
+    pub before: f64,
+    /// The mean energy of the runs from the break on.
+    pub after: f64,
+}
+impl Break {
+    /// The shift as a percentage of the energy before the break.
+    pub fn change_pct(&self) -> f64 {
+        (self.after - self.before) / self.before * 100.0
+    }
+}
+
+/// # Arguments
+/// * runs - the runs of a scenario, oldest first
+///
+/// # Returns
+/// The energy of the scenario in each run, runs without energy are left out
+pub fn points(runs: &[RunDataset]) -> Vec<Point> {
+    runs.iter()
+        .filter_map(|run_dataset| {
+            let (_, _, joules) = compare::per_iteration(run_dataset)
+                .into_iter()
+                .find(|(metric, _, _)| *metric == "energy")?;
+            let run = run_dataset.run();
+            Some(Point {
+                run_id: String::from(run_dataset.run_id()),
+                start_time: run.map(|run| run.start_time).unwrap_or_default(),
+                label: run.and_then(|run| run.label.clone()),
+                git: run.and_then(Run::git),
+                energy: Stats::excluding_outliers(
+                    &joules,
+                    run.and_then(report::run_outlier_threshold),
+                )?,
+                annotations: run.map(Run::annotations).unwrap_or_default(),
+            })
+        })
+        .collect()
+}
+
+/// # Returns
+/// A line of block characters, one per value, scaled between the smallest and largest value
+pub fn sparkline(values: &[f64]) -> String {
+    let min = values.iter().copied().fold(f64::INFINITY, f64::min);
+    let max = values.iter().copied().fold(f64::NEG_INFINITY, f64::max);
+    values
+        .iter()
+        .map(|value| {
+            if max > min {
+                let level = (value - min) / (max - min) * (SPARKS.len() - 1) as f64;
+                SPARKS[level.round() as usize]
+            } else {
+                SPARKS[SPARKS.len() / 2]
+            }
+        })
+        .collect()
+}
+
+/// Finds where the energy of a scenario shifted to a new level and stayed there, rather than a
+/// single noisy run. The mean energy of the runs either side of each run is compared, a break
+/// needs the shift to be over two standard errors of the spread between runs and at least
+/// MIN_SHIFT_PCT. Of neighbouring runs which both look like breaks only the largest shift is kept.
+///
+/// # Arguments
+/// * points - the energy of a scenario in each run, oldest first
+pub fn breaks(points: &[Point]) -> Vec<Break> {
+    let means = points
+        .iter()
+        .map(|point| point.energy.mean)
+        .collect::<Vec<_>>();
+    let mut candidates: Vec<Break> = vec![];
+    for index in 2..means.len().saturating_sub(1) {
+        let (Some(before), Some(after)) = (
+            Stats::of(&means[index.saturating_sub(WINDOW)..index]),
+            Stats::of(&means[index..(index + WINDOW).min(means.len())]),
+        ) else {
+            continue;
+        };
+        let standard_error = (before.stddev.powi(2) / before.iterations as f64
+            + after.stddev.powi(2) / after.iterations as f64)
+            .sqrt();
+        let shift = after.mean - before.mean;
+        let candidate = Break {
+            index,
+            before: before.mean,
+            after: after.mean,
+        };
+        if before.mean == 0.0
+            || shift.abs() <= 2.0 * standard_error
+            || candidate.change_pct().abs() < MIN_SHIFT_PCT
+        {
+            continue;
+        }
+
+        match candidates.last_mut() {
+            Some(previous) if index - previous.index < WINDOW => {
+                if shift.abs() > (previous.after - previous.before).abs() {
+                    *previous = candidate;
+                }
+            }
+            _ => candidates.push(candidate),
+        }
+    }
+    candidates
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn point(joules: f64) -> Point {
+        Point {
+            run_id: String::new(),
+            start_time: 0,
+            label: None,
+            git: None,
+            annotations: vec![],
+            energy: Stats {
+                iterations: 3,
+                mean: joules,
+                median: joules,
+                p90: joules,
+                p99: joules,
+                stddev: 0.1,
+                min: joules,
+                max: joules,
+                outliers: 0,
+            },
+        }
+    }
+
+    #[test]
+    fn lasting_shifts_are_trend_breaks() {
+        let joules = [
+            10.0, 10.2, 9.9, 10.1, 10.0, 12.1, 11.9, 12.0, 12.2, 11.8, 12.0,
+        ];
+        let points = joules
+            .iter()
+            .map(|joules| point(*joules))
+            .collect::<Vec<_>>();
+        assert_eq!(sparkline(&joules), "▁▂▁▂▁█▇▇█▇▇");
+
+        let breaks = breaks(&points);
+        assert_eq!(breaks.len(), 1);
+        assert_eq!(breaks[0].index, 5);
+        assert!((breaks[0].change_pct() - 20.0).abs() < 1.0);
+
+        // a single noisy run isn't a break
+        let joules = [10.0, 10.2, 9.9, 14.0, 10.1, 10.0, 9.8, 10.1];
+        let points = joules
+            .iter()
+            .map(|joules| point(*joules))
+            .collect::<Vec<_>>();
+        assert!(super::breaks(&points).is_empty());
+        assert_eq!(sparkline(&[5.0, 5.0]), "▅▅");
+    }
+}
@@ -0,0 +1,229 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use anyhow::anyhow;
+use serde::Deserialize;
+
+const JOULES_PER_WH: f64 = 3_600.0;
+
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default, clap::ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub enum EnergyUnit {
+    #[default]
+    J,
+    Wh,
+    Kwh,
+}
+impl EnergyUnit {
+    pub fn symbol(&self) -> &'static str {
+        match self {
+            EnergyUnit::J => "J",
+            EnergyUnit::Wh => "Wh",
+            EnergyUnit::Kwh => "kWh",
+        }
+    }
+
+    /// The unit as it's written in names, e.g. of JUnit properties.
+    pub fn name(&self) -> &'static str {
+        match self {
+            EnergyUnit::J => "joules",
+            EnergyUnit::Wh => "wh",
+            EnergyUnit::Kwh => "kwh",
+        }
+    }
+
+    pub fn from_joules(&self, joules: f64) -> f64 {
+        match self {
+            EnergyUnit::J => joules,
+            EnergyUnit::Wh => joules / JOULES_PER_WH,
+            EnergyUnit::Kwh => joules / JOULES_PER_WH / 1000.0,
+        }
+    }
+
+    /// The decimal places of figures in this unit unless significant digits are set, enough to
+    /// show a small scenario's energy.
+    fn decimals(&self) -> usize {
+        match self {
+            EnergyUnit::J => 3,
+            EnergyUnit::Wh => 6,
+            EnergyUnit::Kwh => 9,
+        }
+    }
+}
+
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default, clap::ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub enum CarbonUnit {
+    #[default]
+    G,
+    Kg,
+}
+impl CarbonUnit {
+    pub fn symbol(&self) -> &'static str {
+        match self {
+            CarbonUnit::G => "gCO2e",
+            CarbonUnit::Kg => "kgCO2e",
+        }
+    }
+
+    pub fn name(&self) -> &'static str {
+        match self {
+            CarbonUnit::G => "grams",
+            CarbonUnit::Kg => "kilograms",
+        }
+    }
+
+    pub fn from_grams(&self, grams: f64) -> f64 {
+        match self {
+            CarbonUnit::G => grams,
+            CarbonUnit::Kg => grams / 1000.0,
+        }
+    }
+
+    fn decimals(&self) -> usize {
+        match self {
+            CarbonUnit::G => 6,
+            CarbonUnit::Kg => 9,
+        }
+    }
+}
+
+/// The units energy and carbon are shown in, so figures from every team's runs read the same.
+/// The JSON export is always in joules and grams so tools reading it don't need to convert.
+#[derive(Debug, Deserialize, PartialEq, Clone, Copy, Default)]
+pub struct Units {
+    #[serde(default)]
+    pub energy: EnergyUnit,
+    #[serde(default)]
+    pub carbon: CarbonUnit,
+    /// Figures are rounded to this many significant digits, otherwise to a fixed number of
+    /// decimal places for each unit.
+    pub significant_digits: Option<usize>,
+}
+impl Units {
+    pub fn validate(&self) -> anyhow::Result<()> {
+        if self.significant_digits == Some(0) {
+            return Err(anyhow!("significant_digits must be at least 1."));
+        }
+        Ok(())
+    }
+
+    /// # Returns
+    /// The energy in the chosen unit with its symbol, e.g. `12.500 J`
+    pub fn energy(&self, joules: f64) -> String {
+        format!("{} {}", self.energy_value(joules), self.energy.symbol())
+    }
+
+    /// The same as [`Units::energy`] with three more decimal places, for the energy of a single
+    /// request or unit of work.
+    pub fn energy_per(&self, joules: f64) -> String {
+        format!(
+            "{} {}",
+            self.number(self.energy.from_joules(joules), self.energy.decimals() + 3),
+            self.energy.symbol()
+        )
+    }
+
+    /// # Returns
+    /// The energy in the chosen unit without its symbol, for tables and exports which name the
+    /// unit once
+    pub fn energy_value(&self, joules: f64) -> String {
+        self.number(self.energy.from_joules(joules), self.energy.decimals())
+    }
+
+    /// # Returns
+    /// The carbon in the chosen unit with its symbol, e.g. `0.000120 gCO2e`
+    pub fn carbon(&self, grams: f64) -> String {
+        format!("{} {}", self.carbon_value(grams), self.carbon.symbol())
+    }
+
+    pub fn carbon_value(&self, grams: f64) -> String {
+        self.number(self.carbon.from_grams(grams), self.carbon.decimals())
+    }
+
+    /// # Arguments
+    /// * value - a figure in joules or grams of CO2e
+    /// * unit - `J` or `gCO2e`, figures in any other unit are shown as they are
+    ///
+    /// # Returns
+    /// The figure in the chosen unit with its symbol
+    pub fn quantity(&self, value: f64, unit: &str) -> String {
+        match unit {
+            "J" => self.energy(value),
+            "gCO2e" => self.carbon(value),
+            _ => format!("{} {}", self.number(value, 3), unit),
+        }
+    }
+
+    /// The same as [`Units::quantity`] with a sign, for differences.
+    pub fn difference(&self, value: f64, unit: &str) -> String {
+        let quantity = self.quantity(value, unit);
+        if quantity.starts_with('-') {
+            quantity
+        } else {
+            format!("+{}", quantity)
+        }
+    }
+
+    fn number(&self, value: f64, decimals: usize) -> String {
+        match self.significant_digits {
+            Some(digits) => significant(value, digits),
+            None => format!("{:.*}", decimals, value),
+        }
+    }
+}
+
+/// Rounds a value to significant digits, e.g. 1234.5 to 3 digits is 1230.
+fn significant(value: f64, digits: usize) -> String {
+    if value == 0.0 || !value.is_finite() {
+        return format!("{}", value);
+    }
+    let digits = digits.max(1) as i32;
+    let magnitude = value.abs().log10().floor() as i32;
+    let scale = 10f64.powi(magnitude - digits + 1);
+    let rounded = (value / scale).round() * scale;
+    let decimals = (digits - 1 - magnitude).max(0) as usize;
+    format!("{:.*}", decimals, rounded)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn figures_are_shown_in_the_chosen_units() {
+        let default = Units::default();
+        assert_eq!(default.energy(12.5), "12.500 J");
+        assert_eq!(default.carbon(0.00012), "0.000120 gCO2e");
+        assert_eq!(default.energy_per(0.0002), "0.000200 J");
+
+        let units = Units {
+            energy: EnergyUnit::Wh,
+            carbon: CarbonUnit::Kg,
+            significant_digits: Some(3),
+        };
+        assert_eq!(units.energy(7200.0), "2.00 Wh");
+        assert_eq!(units.carbon(1234.5), "1.23 kgCO2e");
+        assert_eq!(significant(1234.5, 3), "1230");
+        assert_eq!(significant(0.00123456, 2), "0.0012");
+        assert_eq!(significant(-0.5, 1), "-0.5");
+
+        let kwh = Units {
+            energy: EnergyUnit::Kwh,
+            ..Units::default()
+        };
+        assert_eq!(kwh.energy(3_600_000.0), "1.000000000 kWh");
+        assert_eq!(kwh.difference(-3_600.0, "J"), "-0.001000000 kWh");
+        assert_eq!(units.difference(7200.0, "J"), "+2.00 Wh");
+        assert_eq!(units.quantity(12.0, "W"), "12.0 W");
+        assert!(Units {
+            significant_digits: Some(0),
+            ..Units::default()
+        }
+        .validate()
+        .is_err());
+    }
+}
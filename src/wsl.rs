@@ -0,0 +1,113 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+use std::fs;
+
+/// Checks the kernel release for the WSL2 kernel, e.g. `5.15.153.1-microsoft-standard-WSL2`.
+/// WSL1 has no kernel of its own and reports `4.4.0-19041-Microsoft`, it has no VM to correct
+/// for.
+///
+/// # Returns
+/// True if cardamon is running inside WSL2
+pub fn is_wsl2() -> bool {
+    fs::read_to_string("/proc/sys/kernel/osrelease")
+        .map(|release| is_wsl2_release(&release))
+        .unwrap_or(false)
+}
+
+fn is_wsl2_release(release: &str) -> bool {
+    let release = release.trim().to_lowercase();
+    release.contains("microsoft") && release.contains("wsl2")
+}
+
+/// Finds the number of logical processors of the Windows host. The WSL2 VM only sees the
+/// processors it's been given in `.wslconfig`, Windows is asked through interop.
+///
+/// # Returns
+/// The number of logical processors of the host, None if Windows can't be reached
+pub fn host_logical_processors() -> Option<u32> {
+    let output = std::process::Command::new("cmd.exe")
+        .args(["/C", "echo %NUMBER_OF_PROCESSORS%"])
+        .output()
+        .ok()?;
+    String::from_utf8_lossy(&output.stdout)
+        .trim()
+        .parse::<u32>()
+        .ok()
+        .filter(|processors| *processors > 0)
+}
+
+/// The share of the host's CPU the WSL2 VM can use. The TDP is the power of the host's whole CPU
+/// but utilisation read from `/proc` is a share of the VM's processors, so the TDP is scaled by
+/// this factor before it's used.
+///
+/// # Arguments
+/// * vm_processors - the logical processors the VM sees
+/// * host_processors - the logical processors of the host
+///
+/// # Returns
+/// The correction factor, never more than 1
+pub fn correction_factor(vm_processors: u32, host_processors: u32) -> f64 {
+    if host_processors == 0 {
+        return 1.0;
+    }
+    (vm_processors as f64 / host_processors as f64).min(1.0)
+}
+
+/// Scales a TDP down to the share of the host's CPU the WSL2 VM can use. Outside of WSL2, or if
+/// the host's processors can't be found, the TDP is returned unchanged.
+///
+/// # Arguments
+/// * tdp - the TDP of the host's CPU in watts
+/// * host_processors - the logical processors of the host if they're configured, otherwise
+///   Windows is asked
+///
+/// # Returns
+/// The TDP in watts of the processors the VM can use
+pub fn corrected_tdp(tdp: f64, host_processors: Option<u32>) -> f64 {
+    if !is_wsl2() {
+        return tdp;
+    }
+
+    let vm_processors = std::thread::available_parallelism()
+        .map(|processors| processors.get() as u32)
+        .unwrap_or(0);
+    match host_processors.or_else(host_logical_processors) {
+        Some(host_processors) if vm_processors > 0 => {
+            let factor = correction_factor(vm_processors, host_processors);
+            tracing::info!(
+                "Running in WSL2 with {} of the host's {} processors, scaling TDP by {:.2}",
+                vm_processors,
+                host_processors,
+                factor
+            );
+            tdp * factor
+        }
+        _ => {
+            tracing::warn!(
+                "Running in WSL2 but the host's processors couldn't be found, set host_processors \
+                 in [cpu] if the VM is limited to some of them"
+            );
+            tdp
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn wsl2_is_detected_and_corrected_for() {
+        assert!(is_wsl2_release("5.15.153.1-microsoft-standard-WSL2\n"));
+        assert!(!is_wsl2_release("4.4.0-19041-Microsoft"));
+        assert!(!is_wsl2_release("6.8.0-45-generic"));
+
+        assert_eq!(correction_factor(8, 16), 0.5);
+        assert_eq!(correction_factor(16, 16), 1.0);
+        assert_eq!(correction_factor(8, 0), 1.0);
+    }
+}